@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+const (
+	providerApple = "apple"
+
+	appleIssuer       = "https://appleid.apple.com"
+	appleJWKSURL      = "https://appleid.apple.com/auth/keys"
+	appleCallbackPath = "/api/oauth/apple"
+
+	appleStateCookieKey = "apple_state"
+
+	// applePrivateRelayDomain is the domain of the relay addresses Apple
+	// hands out to users who hide their email address.
+	applePrivateRelayDomain = "privaterelay.appleid.com"
+
+	// appleClientSecretTTL is how long generated client secrets are
+	// valid. Apple accepts up to six months.
+	appleClientSecretTTL = time.Hour
+)
+
+var appleEndpoint = oauth2.Endpoint{
+	AuthURL:   "https://appleid.apple.com/auth/authorize",
+	TokenURL:  "https://appleid.apple.com/auth/token",
+	AuthStyle: oauth2.AuthStyleInParams,
+}
+
+// newAppleOAuthConfig creates a Sign in with Apple OAuth2 configuration.
+// The client secret is generated for each exchange by appleClientSecret.
+func newAppleOAuthConfig(clientID string) oauth2.Config {
+	return oauth2.Config{
+		ClientID:    clientID,
+		Endpoint:    appleEndpoint,
+		RedirectURL: appleCallbackPath,
+		Scopes:      []string{"name", "email"},
+	}
+}
+
+// appleClientSecret generates the client secrets Apple requires in place
+// of a static one: JWTs signed with ES256 by a private key registered for
+// Sign in with Apple.
+type appleClientSecret struct {
+	teamID   string
+	clientID string
+	keyID    string
+	key      *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	secret string
+	expiry time.Time
+}
+
+func newAppleClientSecret(teamID, clientID, keyID, privateKeyPEM string) (*appleClientSecret, error) {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return nil, errors.New("Apple private key is not PEM-encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Apple private key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return nil, errors.New("Apple private key is not a P-256 key")
+	}
+	return &appleClientSecret{teamID: teamID, clientID: clientID, keyID: keyID, key: ecKey}, nil
+}
+
+// get returns a client secret, generating a new one once the current one
+// is past half its lifetime.
+func (s *appleClientSecret) get(now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Before(s.expiry.Add(-appleClientSecretTTL / 2)) {
+		return s.secret, nil
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": s.teamID,
+		"sub": s.clientID,
+		"aud": appleIssuer,
+		"iat": now.Unix(),
+		"exp": now.Add(appleClientSecretTTL).Unix(),
+	})
+	token.Header["kid"] = s.keyID
+	secret, err := token.SignedString(s.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign Apple client secret: %w", err)
+	}
+	s.secret, s.expiry = secret, now.Add(appleClientSecretTTL)
+	return secret, nil
+}
+
+// appleIDTokenParser creates a function that parses and validates Apple ID
+// tokens.
+func appleIDTokenParser(jwks *keyfunc.JWKS, clientID string) func(string) (*authDetails, error) {
+	return func(idToken string) (*authDetails, error) {
+		token, err := jwt.Parse(idToken, jwks.Keyfunc, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Name}))
+		if err != nil {
+			return nil, err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		if !claims.VerifyAudience(clientID, true) {
+			return nil, errAudienceInvalid
+		}
+		if !claims.VerifyIssuer(appleIssuer, true) {
+			return nil, errIssuerInvalid
+		}
+		userID, _ := claims["sub"].(string)
+		email, _ := claims["email"].(string)
+		var issuedAt time.Time
+		if iat, ok := claims["iat"].(float64); ok {
+			issuedAt = time.Unix(int64(iat), 0)
+		}
+		return &authDetails{
+			idToken:  token,
+			claims:   claims,
+			userID:   userID,
+			email:    email,
+			issuedAt: issuedAt,
+			authTime: issuedAt,
+		}, nil
+	}
+}
+
+// applePrivateEmail reports whether an Apple user hid their email address
+// behind a relay address. Apple sends "is_private_email" as a string or a
+// boolean.
+func applePrivateEmail(claims jwt.MapClaims, email string) bool {
+	switch v := claims["is_private_email"].(type) {
+	case bool:
+		if v {
+			return true
+		}
+	case string:
+		if v == "true" {
+			return true
+		}
+	}
+	return strings.HasSuffix(strings.ToLower(email), "@"+applePrivateRelayDomain)
+}
+
+// appleUser is the "user" form field Apple posts to the callback, only on
+// a user's first authorization of the app.
+type appleUser struct {
+	Name struct {
+		FirstName string `json:"firstName"`
+		LastName  string `json:"lastName"`
+	} `json:"name"`
+}
+
+// appleDisplayName returns the name to show for an Apple user: their name
+// if Apple sent it, otherwise their email address, unless it is a relay
+// address, which is meaningless to the user.
+func appleDisplayName(rawUser, email string, privateEmail bool) string {
+	var user appleUser
+	if rawUser != "" && json.Unmarshal([]byte(rawUser), &user) == nil {
+		if name := strings.TrimSpace(user.Name.FirstName + " " + user.Name.LastName); name != "" {
+			return name
+		}
+	}
+	if privateEmail || email == "" {
+		return "Apple user"
+	}
+	return email
+}
+
+// registerAppleRoutes registers the Sign in with Apple flow. Apple posts
+// the authorization response back cross-site (response_mode=form_post), so
+// the state cookie must be sent with cross-site requests. As with Microsoft,
+// users are signed in with a session token minted by the backend. Apple's
+// tokens grant no API access, so they are not stored.
+func registerAppleRoutes(
+	routes *routeRegistry,
+	oauthConfig oauth2.Config,
+	clientSecret *appleClientSecret,
+	parseIDToken func(string) (*authDetails, error),
+	identities *identityStore,
+	states *oauthStateStore,
+	ids idSource,
+	clk clock,
+	secureCookies secureCookies,
+	binding *sessionBinding,
+	security *securityEvents,
+	logger *zap.Logger,
+) {
+	public := routes.group(groupPublic)
+
+	public.GET("/api/login/apple", func(w http.ResponseWriter, r *http.Request) {
+		nonce := make([]byte, 16)
+		if _, err := ids.Read(nonce); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to generate nonce")
+			return
+		}
+		encodedNonce := base64.RawURLEncoding.EncodeToString(nonce)
+		state, cookie, err := generateOAuthState(
+			r.Context(), ids, secureCookies, states,
+			appleStateCookieKey, appleCallbackPath,
+			map[string]string{"nonce": encodedNonce},
+		)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		cookie.SameSite = http.SameSiteNoneMode
+		http.SetCookie(w, cookie)
+		url := oauth2ConfigForURL(oauthConfig, r).AuthCodeURL(
+			state,
+			oauth2.SetAuthURLParam("nonce", encodedNonce),
+			oauth2.SetAuthURLParam("response_mode", "form_post"),
+		)
+		http.Redirect(w, r, url, http.StatusFound)
+	})
+
+	public.POST(appleCallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.With(traceLogFields(r.Context())...)
+		http.SetCookie(w, &http.Cookie{
+			Name:     appleStateCookieKey,
+			Path:     appleCallbackPath,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteNoneMode,
+			MaxAge:   -1,
+		})
+		if err := r.ParseForm(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if errCode := r.PostForm.Get("error"); errCode != "" {
+			logger.Info("Apple sign-in failed", zap.String("error", errCode))
+			writeError(w, r, http.StatusUnauthorized, "Apple sign-in failed: "+errCode)
+			return
+		}
+		data, err := validateOAuthState(secureCookies, states, r, appleStateCookieKey)
+		if err != nil {
+			security.record(r, securityEventOAuthState, reasonStateInvalid, "")
+			writeError(w, r, http.StatusUnauthorized, "invalid authorization state")
+			return
+		}
+
+		secret, err := clientSecret.get(clk.Now())
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		config := oauth2ConfigForURL(oauthConfig, r)
+		config.ClientSecret = secret
+		// The ID token is taken from the token response rather than the
+		// form, which the user agent could have tampered with.
+		token, err := config.Exchange(r.Context(), r.PostForm.Get("code"))
+		if err != nil {
+			security.record(r, securityEventAppleLogin, reasonInvalidCode, "")
+			writeError(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		idToken, _ := token.Extra("id_token").(string)
+		auth, err := parseIDToken(idToken)
+		if err != nil {
+			security.record(r, securityEventAppleLogin, tokenFailureReason(err), "")
+			writeError(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if nonce, _ := auth.claims["nonce"].(string); nonce == "" || nonce != data["nonce"] {
+			security.record(r, securityEventAppleLogin, reasonStateInvalid, auth.userID)
+			writeError(w, r, http.StatusUnauthorized, "invalid nonce")
+			return
+		}
+
+		if !resolveSignIn(w, r, identities, secureCookies, security, logger, securityEventAppleLogin, providerApple, auth) {
+			return
+		}
+		privateEmail := applePrivateEmail(auth.claims, auth.email)
+		now := clk.Now()
+		session, err := signLocalSession(localSessionKey(secureCookies.keys()), jwt.MapClaims{
+			"sub":           auth.userID,
+			"email":         auth.email,
+			"name":          appleDisplayName(r.PostForm.Get("user"), auth.email, privateEmail),
+			"idp":           providerApple,
+			"private_email": privateEmail,
+		}, now)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		cookieValue, err := secureCookies.Encode(session)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+			return
+		}
+		if err := binding.set(w, r, session, now.Add(localSessionTTL)); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     "credentials",
+			Path:     credentialsCookiePath,
+			Value:    cookieValue,
+			Secure:   true,
+			HttpOnly: true,
+			Expires:  now.Add(localSessionTTL),
+		})
+		security.record(r, securityEventAppleLogin, reasonSuccess, auth.userID)
+		logger.Info("user signed in with Apple", zap.String("user.id", auth.userID))
+		// 303, so that the browser follows with a GET.
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"app-backend/blobstore"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	recordAttachmentsIndex = "app-record-attachments"
+
+	defaultMaxAttachmentSize = 10 << 20
+
+	// attachmentURLTTL is how long the signed URLs of attachments are
+	// valid. Listing attachments issues new ones.
+	attachmentURLTTL = time.Hour
+)
+
+var (
+	errAttachmentNotFound = errors.New("attachment not found")
+	errAttachmentNotOwned = errors.New("only the uploader or a moderator may delete an attachment")
+	errAttachmentTooLarge = errors.New("attachment too large")
+	errNoThumbnail        = errors.New("attachment has no thumbnails")
+	errAttachmentInfected = errors.New("attachment flagged by content scan")
+)
+
+// attachment is the metadata of a file attached to a record. The content
+// is stored in a blob named after its ID, next to its thumbnails.
+type attachment struct {
+	ID          string    `json:"id"`
+	RecordID    string    `json:"record_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	UploadedBy  string    `json:"uploaded_by"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+
+	// Scan is the verdict of the content scan of the attachment, if
+	// uploads are scanned.
+	Scan *scanResult `json:"scan,omitempty"`
+}
+
+// attachmentStore manages the attachments of records, with metadata
+// persisted to Elasticsearch if configured, and contents stored in the
+// blob store. Uploads flagged by the content scanner, if any, are stored
+// under quarantine/ instead, and only their metadata is kept, for review.
+type attachmentStore struct {
+	client  *elasticsearch.Client
+	blobs   blobstore.Store
+	maxSize int64
+	logger  *zap.Logger
+	ids     idSource
+
+	scanner     contentScanner
+	scanTimeout time.Duration
+	// scanFailOpen accepts uploads the scanner fails to scan, marked
+	// unscanned, rather than rejecting them.
+	scanFailOpen bool
+
+	mu          sync.RWMutex
+	attachments map[string]*attachment
+
+	// thumbnails coalesces concurrent generation of the same thumbnail.
+	thumbnails singleflight.Group
+}
+
+func newAttachmentStore(config *appConfig, client *elasticsearch.Client, blobs blobstore.Store, logger *zap.Logger) (*attachmentStore, error) {
+	s := &attachmentStore{
+		client:      client,
+		blobs:       blobs,
+		maxSize:     config.Attachments.MaxSize,
+		logger:      logger,
+		ids:         cryptoIDs{},
+		attachments: make(map[string]*attachment),
+
+		scanTimeout:  config.Attachments.Scan.Timeout,
+		scanFailOpen: config.Attachments.Scan.FailOpen,
+	}
+	var err error
+	if s.scanner, err = newContentScanner(config); err != nil {
+		return nil, err
+	}
+	if s.scanTimeout <= 0 {
+		s.scanTimeout = defaultScanTimeout
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = defaultMaxAttachmentSize
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init attachment store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads the metadata of existing attachments from Elasticsearch.
+func (s *attachmentStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initAttachmentStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(recordAttachmentsIndex),
+		s.client.Search.WithSize(10000),
+	)
+	if err != nil {
+		logger.Info("could not load attachments from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.Info("could not load attachments from Elasticsearch", zap.String("status", res.Status()))
+		return nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source attachment `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	for i := range searchResult.Hits.Hits {
+		a := &searchResult.Hits.Hits[i].Source
+		if a.Scan == nil || a.Scan.Verdict != scanInfected {
+			s.attachments[a.ID] = a
+		}
+	}
+
+	logger.Info("loaded attachments", zap.Int("attachments", len(s.attachments)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// list returns the attachments of a record, oldest first.
+func (s *attachmentStore) list(recordID string) []*attachment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := []*attachment{}
+	for _, a := range s.attachments {
+		if a.RecordID == recordID {
+			result = append(result, a)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].UploadedAt.Equal(result[j].UploadedAt) {
+			return result[i].UploadedAt.Before(result[j].UploadedAt)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// get returns an attachment by ID.
+func (s *attachmentStore) get(id string) (*attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.attachments[id]
+	if !ok {
+		return nil, errAttachmentNotFound
+	}
+	return a, nil
+}
+
+// key returns the blob key of an attachment variant: the original if
+// variant is empty, otherwise a thumbnail.
+func (s *attachmentStore) key(id, variant string) string {
+	if variant == "" {
+		return "attachments/" + id
+	}
+	return "attachments/" + id + ".thumbnail-" + variant
+}
+
+// limit returns the maximum size of attachments: the quota of the tenant
+// of the request, if it overrides the configured one.
+func (s *attachmentStore) limit(ctx context.Context) int64 {
+	if quota := tenantSettingsFromContext(ctx).Quotas.AttachmentMaxSize; quota > 0 {
+		return quota
+	}
+	return s.maxSize
+}
+
+// add stores the content read from r as an attachment of a record. The
+// content type is detected from the content rather than trusted from the
+// client. If the content scanner flags the content, it is quarantined and
+// errAttachmentInfected returned.
+func (s *attachmentStore) add(ctx context.Context, recordID, filename, userID string, r io.Reader) (*attachment, error) {
+	a := &attachment{
+		ID:         s.ids.NewID(),
+		RecordID:   recordID,
+		Filename:   filepath.Base(filename),
+		UploadedBy: userID,
+		UploadedAt: time.Now().UTC(),
+	}
+
+	// The upload is spooled to a temporary file to be scanned before it is
+	// stored.
+	f, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	hash := sha256.New()
+	var head bytes.Buffer
+	limit := s.limit(ctx)
+	n, err := io.Copy(io.MultiWriter(f, hash, &limitedBuffer{&head, 512}), io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, errAttachmentTooLarge
+	}
+	a.Size, a.SHA256 = n, hex.EncodeToString(hash.Sum(nil))
+	a.ContentType, _, _ = mime.ParseMediaType(http.DetectContentType(head.Bytes()))
+	if s.scanner != nil {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if a.Scan, err = s.scan(ctx, f); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if a.Scan != nil && a.Scan.Verdict == scanInfected {
+		s.logger.Warn("quarantined attachment flagged by content scan", append(traceLogFields(ctx),
+			zap.String("attachment.id", a.ID),
+			zap.String("record.id", recordID),
+			zap.String("scan.signature", a.Scan.Signature),
+		)...)
+		if err := s.blobs.Put(ctx, "quarantine/"+a.ID, f, n, a.ContentType); err != nil {
+			return nil, err
+		}
+		if err := s.persist(ctx, a); err != nil {
+			return nil, err
+		}
+		return a, fmt.Errorf("%w: %s", errAttachmentInfected, a.Scan.Signature)
+	}
+	if err := s.blobs.Put(ctx, s.key(a.ID, ""), f, n, a.ContentType); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.attachments[a.ID] = a
+	s.mu.Unlock()
+	return a, s.persist(ctx, a)
+}
+
+// scan scans the content read from r. If the scanner fails, the content
+// is marked unscanned if scanFailOpen is set, and errScanFailed is returned
+// otherwise.
+func (s *attachmentStore) scan(ctx context.Context, r io.Reader) (*scanResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.scanTimeout)
+	defer cancel()
+	result, err := s.scanner.scan(ctx, r)
+	if err != nil {
+		s.logger.Warn("failed to scan attachment", append(traceLogFields(ctx), zap.Error(err))...)
+		if !s.scanFailOpen {
+			return nil, errScanFailed
+		}
+		result = scanResult{Verdict: scanUnscanned, ScannedAt: time.Now().UTC()}
+	}
+	return &result, nil
+}
+
+// limitedBuffer keeps the first n bytes written to it.
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	n   int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.n - b.buf.Len(); remaining > 0 {
+		b.buf.Write(p[:min(len(p), remaining)])
+	}
+	return len(p), nil
+}
+
+// delete deletes an attachment of a record, which only its uploader or a
+// moderator may do, with its thumbnails.
+func (s *attachmentStore) delete(ctx context.Context, recordID, id string, user *authDetails) error {
+	s.mu.Lock()
+	a, ok := s.attachments[id]
+	if !ok || a.RecordID != recordID {
+		s.mu.Unlock()
+		return errAttachmentNotFound
+	}
+	if a.UploadedBy != user.userID && !user.hasRole(commentModeratorRole) {
+		s.mu.Unlock()
+		return errAttachmentNotOwned
+	}
+	delete(s.attachments, id)
+	s.mu.Unlock()
+
+	for _, variant := range append([]string{""}, sortedKeys(thumbnailSizes)...) {
+		if err := s.blobs.Delete(ctx, s.key(id, variant)); err != nil {
+			s.logger.Warn("failed to delete attachment blob", zap.String("attachment.id", id), zap.Error(err))
+		}
+	}
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Delete(recordAttachmentsIndex, id, s.client.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("while deleting attachment: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting attachment failed: %s", res.Status())
+	}
+	return nil
+}
+
+// content returns the content of an attachment variant: the original if
+// variant is empty, otherwise a thumbnail of an image, generated on first
+// use. Thumbnails are cached in the blob store next to the original.
+func (s *attachmentStore) content(ctx context.Context, a *attachment, variant string) (io.ReadSeekCloser, error) {
+	if variant == "" {
+		return blobstore.OpenReader(ctx, s.blobs, s.key(a.ID, ""), a.Size)
+	}
+	if !thumbnailable(a.ContentType) {
+		return nil, errNoThumbnail
+	}
+	size, err := thumbnailVariant(variant)
+	if err != nil {
+		return nil, err
+	}
+	key := s.key(a.ID, variant)
+	if r, err := s.blobs.Get(ctx, key); err == nil {
+		// Thumbnails are small, and read whole to serve ranges of them.
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return bytesReadSeekCloser{bytes.NewReader(data)}, nil
+	} else if !errors.Is(err, blobstore.ErrNotFound) {
+		return nil, err
+	}
+	data, err, _ := s.thumbnails.Do(key, func() (interface{}, error) {
+		r, err := s.blobs.Get(ctx, s.key(a.ID, ""))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		original, err := io.ReadAll(io.LimitReader(r, a.Size+1))
+		if err != nil {
+			return nil, err
+		}
+		data, contentType, err := renderThumbnail(bytes.NewReader(original), size)
+		if err != nil {
+			return nil, fmt.Errorf("while generating thumbnail: %w", err)
+		}
+		return data, s.blobs.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bytesReadSeekCloser{bytes.NewReader(data.([]byte))}, nil
+}
+
+// bytesReadSeekCloser is a bytes.Reader with a no-op Close method.
+type bytesReadSeekCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadSeekCloser) Close() error {
+	return nil
+}
+
+// persist indexes the metadata of an attachment, if Elasticsearch is
+// configured.
+func (s *attachmentStore) persist(ctx context.Context, a *attachment) error {
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Index(
+		recordAttachmentsIndex, esutil.NewJSONReader(a),
+		s.client.Index.WithDocumentID(a.ID),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving attachment: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving attachment failed: %s", res.Status())
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// attachmentURLs creates the URLs attachments and their thumbnails are
+// served at: signed URLs, which work in <img> elements without a session,
+// if encryption keys are configured, otherwise the endpoint for signed-in
+// users.
+type attachmentURLs struct {
+	signer *urlSigner
+}
+
+// url returns the URL of an attachment variant: the original if variant
+// is empty, otherwise a thumbnail.
+func (u *attachmentURLs) url(a *attachment, variant string) (string, error) {
+	query := url.Values{}
+	if variant != "" {
+		query.Set("size", variant)
+	}
+	if !u.signer.signed() {
+		path := fmt.Sprintf("/api/records/%s/attachments/%s/content", a.RecordID, a.ID)
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+		return path, nil
+	}
+	token, _, err := u.signer.sign("attachment", []string{a.ID}, attachmentURLTTL)
+	if err != nil {
+		return "", err
+	}
+	query.Set("token", token)
+	return "/api/attachment-downloads?" + query.Encode(), nil
+}
+
+// attachmentView is an attachment as listed, with the URLs of its content
+// and thumbnails.
+type attachmentView struct {
+	attachment
+	URL        string            `json:"url"`
+	Thumbnails map[string]string `json:"thumbnails,omitempty"`
+}
+
+func (u *attachmentURLs) view(a *attachment) (attachmentView, error) {
+	view := attachmentView{attachment: *a}
+	var err error
+	if view.URL, err = u.url(a, ""); err != nil {
+		return view, err
+	}
+	if thumbnailable(a.ContentType) {
+		view.Thumbnails = make(map[string]string, len(thumbnailSizes))
+		for variant := range thumbnailSizes {
+			if view.Thumbnails[variant], err = u.url(a, variant); err != nil {
+				return view, err
+			}
+		}
+	}
+	return view, nil
+}
+
+// registerAttachmentRoutes registers the attachments sub-resource of
+// records, and the endpoint serving attachments by signed URL.
+func registerAttachmentRoutes(
+	routes *routeRegistry,
+	attachments *attachmentStore,
+	uploads *uploadStore,
+	records *recordStore,
+	signer *urlSigner,
+	downloads *downloadThrottle,
+	logger *zap.Logger,
+) {
+	user := routes.group(groupUser)
+	urls := &attachmentURLs{signer: signer}
+
+	// withRecord rejects requests for unknown records.
+	withRecord := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !records.exists(r.PathValue("id")) {
+				writeError(w, r, http.StatusNotFound, errUnknownRecord.Error())
+				return
+			}
+			h(w, r)
+		}
+	}
+
+	// serve serves an attachment, or one of its thumbnails, as requested by
+	// the "size" query parameter, with Range support. Only images are shown
+	// inline; anything else is downloaded, so that uploaded HTML cannot run
+	// in the app's origin.
+	serve := func(w http.ResponseWriter, r *http.Request, a *attachment) {
+		variant, contentType := r.URL.Query().Get("size"), a.ContentType
+		if variant != "" && a.ContentType != "image/jpeg" {
+			contentType = "image/png"
+		}
+		content, err := attachments.content(r.Context(), a, variant)
+		switch {
+		case errors.Is(err, errNoThumbnail), errors.Is(err, blobstore.ErrNotFound):
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		case err != nil:
+			logger.Warn("failed to get attachment content", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		defer content.Close()
+		disposition := "attachment"
+		if thumbnailable(a.ContentType) {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		etag := a.SHA256
+		if variant != "" {
+			etag += "-" + variant
+		}
+		w.Header().Set("ETag", `"`+etag+`"`)
+		downloads.serve(w, r, a.UploadedAt, content)
+	}
+
+	user.GET("/api/records/{id}/attachments", withRecord(func(w http.ResponseWriter, r *http.Request) {
+		list := attachments.list(r.PathValue("id"))
+		views := make([]attachmentView, 0, len(list))
+		for _, a := range list {
+			view, err := urls.view(a)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			views = append(views, view)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Attachments []attachmentView `json:"attachments"`
+		}{views})
+	}))
+
+	user.POST("/api/records/{id}/attachments", withRecord(func(w http.ResponseWriter, r *http.Request) {
+		userID := authFromContext(r.Context()).userID
+		var (
+			filename string
+			file     io.ReadCloser
+			upload   *uploadSession
+		)
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" && uploads != nil {
+			// The content was sent as a resumable upload.
+			var req struct {
+				UploadID string `json:"upload_id"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UploadID == "" {
+				writeError(w, r, http.StatusBadRequest, "expected an upload_id")
+				return
+			}
+			var err error
+			upload, file, err = uploads.open(r.Context(), req.UploadID, userID)
+			switch {
+			case errors.Is(err, errUploadNotFound):
+				writeError(w, r, http.StatusNotFound, err.Error())
+				return
+			case errors.Is(err, errUploadIncomplete):
+				writeError(w, r, http.StatusConflict, err.Error())
+				return
+			case err != nil:
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			filename = upload.Filename
+		} else {
+			r.Body = http.MaxBytesReader(w, r.Body, attachments.limit(r.Context())+1<<20)
+			var header *multipart.FileHeader
+			var err error
+			if file, header, err = r.FormFile("file"); err != nil {
+				writeError(w, r, http.StatusBadRequest, "expected a multipart/form-data file field")
+				return
+			}
+			filename = header.Filename
+		}
+		defer file.Close()
+		a, err := attachments.add(r.Context(), r.PathValue("id"), filename, userID, file)
+		if upload != nil && err == nil {
+			if err := uploads.remove(r.Context(), upload.ID); err != nil {
+				logger.Warn("failed to delete consumed upload", append(traceLogFields(r.Context()), zap.Error(err))...)
+			}
+		}
+		switch {
+		case errors.Is(err, errAttachmentTooLarge):
+			writeError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		case errors.Is(err, errAttachmentInfected):
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		case errors.Is(err, errScanFailed):
+			writeError(w, r, http.StatusServiceUnavailable, err.Error())
+			return
+		case err != nil:
+			logger.Error("failed to save attachment", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		view, err := urls.view(a)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(view)
+	}))
+
+	user.GET("/api/records/{id}/attachments/{attachment_id}/content", withRecord(func(w http.ResponseWriter, r *http.Request) {
+		a, err := attachments.get(r.PathValue("attachment_id"))
+		if err != nil || a.RecordID != r.PathValue("id") {
+			writeError(w, r, http.StatusNotFound, errAttachmentNotFound.Error())
+			return
+		}
+		serve(w, r, a)
+	}))
+
+	user.DELETE("/api/records/{id}/attachments/{attachment_id}", withRecord(func(w http.ResponseWriter, r *http.Request) {
+		err := attachments.delete(r.Context(), r.PathValue("id"), r.PathValue("attachment_id"), authFromContext(r.Context()))
+		switch {
+		case errors.Is(err, errAttachmentNotFound):
+			writeError(w, r, http.StatusNotFound, err.Error())
+		case errors.Is(err, errAttachmentNotOwned):
+			writeError(w, r, http.StatusForbidden, err.Error())
+		case err != nil:
+			logger.Error("failed to delete attachment", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	if signer.signed() {
+		routes.group(groupPublic).GET("/api/attachment-downloads", func(w http.ResponseWriter, r *http.Request) {
+			path, err := signer.verify(r.URL.Query().Get("token"), "attachment", 1)
+			switch {
+			case errors.Is(err, errDownloadLinkExpired):
+				writeError(w, r, http.StatusGone, err.Error())
+				return
+			case err != nil:
+				writeError(w, r, http.StatusNotFound, err.Error())
+				return
+			}
+			a, err := attachments.get(path[0])
+			if err != nil {
+				writeError(w, r, http.StatusNotFound, err.Error())
+				return
+			}
+			serve(w, r, a)
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.uber.org/zap"
+)
+
+const (
+	auditEventsIndex = "app-audit-events"
+
+	// webhookSignatureHeader carries the hex-encoded HMAC-SHA256 of the
+	// request body, keyed with the configured webhook secret.
+	webhookSignatureHeader = "X-Webhook-Signature"
+
+	webhookTimeout = 10 * time.Second
+
+	// auditActionStartup is the action of events recording startups.
+	auditActionStartup = "app.startup"
+)
+
+// auditEvent is a change to application data, as indexed into
+// Elasticsearch and posted to webhooks.
+type auditEvent struct {
+	Timestamp time.Time         `json:"@timestamp"`
+	Action    string            `json:"event.action"`
+	UserID    string            `json:"user.id,omitempty"`
+	RecordID  string            `json:"record.id,omitempty"`
+	Changes   map[string]string `json:"changes,omitempty"`
+	TraceID   string            `json:"trace.id,omitempty"`
+
+	// ChangeSeq is the cursor of changes to records in the change feed,
+	// for webhook receivers to tell whether they missed changes.
+	ChangeSeq int64 `json:"change.seq,omitempty"`
+
+	// Startup describes what the backend runs with, on startup.
+	Startup *startupSummary `json:"startup,omitempty"`
+}
+
+// auditLog records audit events in Elasticsearch, when configured, and
+// posts them to the configured webhooks. Both happen in the background,
+// so as not to delay responses. Changes to records are also appended to
+// the change feed, if set.
+type auditLog struct {
+	client        *elasticsearch.Client
+	webhookURLs   []string
+	webhookSecret string
+	httpClient    *http.Client
+	logger        *zap.Logger
+	changes       *changeFeed
+
+	pending pendingWrites
+
+	// appended is closed once the last event recorded has been appended
+	// to the change feed, which the next waits for, so that changes are
+	// numbered in the order they were recorded.
+	mu       sync.Mutex
+	appended chan struct{}
+}
+
+func newAuditLog(config *appConfig, client *elasticsearch.Client, logger *zap.Logger) *auditLog {
+	return &auditLog{
+		client:        client,
+		webhookURLs:   config.Webhooks.URLs,
+		webhookSecret: config.Webhooks.Secret,
+		httpClient:    &http.Client{Transport: http.DefaultClient.Transport, Timeout: webhookTimeout},
+		logger:        logger,
+	}
+}
+
+// record records an audit event of the given action by userID.
+func (a *auditLog) record(ctx context.Context, action, userID, recordID string, changes map[string]string) {
+	event := auditEvent{
+		Timestamp: time.Now().UTC(),
+		Action:    action,
+		UserID:    userID,
+		RecordID:  recordID,
+		Changes:   changes,
+	}
+	if fields := traceLogFields(ctx); len(fields) > 0 {
+		event.TraceID = fields[0].String
+	}
+	a.logger.Info("audit event", zap.String("event.action", action), zap.String("user.id", userID), zap.String("record.id", recordID))
+	a.mu.Lock()
+	previous, appended := a.appended, make(chan struct{})
+	a.appended = appended
+	a.mu.Unlock()
+	a.pending.run(func() {
+		// Changes to records are numbered first, so that webhooks receive
+		// their cursor.
+		if previous != nil {
+			<-previous
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if change, ok := a.changes.appendEvent(ctx, event); ok {
+			event.ChangeSeq = change.Seq
+		}
+		close(appended)
+		if a.client != nil {
+			a.pending.run(func() { a.index(event) })
+		}
+		if len(a.webhookURLs) > 0 {
+			a.pending.run(func() { a.notify(event) })
+		}
+	})
+}
+
+// recordStartup records the startup of the backend in Elasticsearch, so
+// that operators can reconstruct what a deployment was running. It is not
+// posted to webhooks, which are notified of changes to application data.
+func (a *auditLog) recordStartup(ctx context.Context, summary *startupSummary) {
+	event := auditEvent{
+		Timestamp: time.Now().UTC(),
+		Action:    auditActionStartup,
+		Startup:   summary,
+	}
+	if fields := traceLogFields(ctx); len(fields) > 0 {
+		event.TraceID = fields[0].String
+	}
+	if a.client != nil {
+		a.pending.run(func() { a.index(event) })
+	}
+}
+
+// flush waits for events being indexed and posted to webhooks.
+func (a *auditLog) flush(ctx context.Context) error {
+	if err := a.pending.wait(ctx); err != nil {
+		return fmt.Errorf("while flushing audit events: %w", err)
+	}
+	return nil
+}
+
+func (a *auditLog) index(event auditEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := a.client.Index(
+		auditEventsIndex, esutil.NewJSONReader(event),
+		a.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		a.logger.Warn("failed to index audit event", zap.Error(err))
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		a.logger.Warn("failed to index audit event", zap.String("status", res.Status()))
+	}
+}
+
+// notify posts an event to each webhook, signed with the webhook secret.
+func (a *auditLog) notify(event auditEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		a.logger.Warn("failed to encode webhook event", zap.Error(err))
+		return
+	}
+	signature := webhookSignature(a.webhookSecret, body)
+	for _, url := range a.webhookURLs {
+		if err := postWebhook(a.httpClient, url, body, signature); err != nil {
+			a.logger.Warn("failed to deliver webhook", zap.String("url.full", url), zap.Error(err))
+		}
+	}
+}
+
+// postWebhook posts body to a webhook, with its signature, if any.
+func postWebhook(client *http.Client, url string, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signature)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", res.Status)
+	}
+	return nil
+}
+
+// webhookSignature returns the hex-encoded HMAC-SHA256 of body, or "" if
+// no secret is configured.
+func webhookSignature(secret string, body []byte) string {
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
@@ -10,21 +9,22 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
+	"app-backend/tokenstore"
+
 	"github.com/MicahParks/keyfunc"
-	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/elastic/go-elasticsearch/v8/esutil"
 	"github.com/golang-jwt/jwt/v4"
-	"github.com/julienschmidt/httprouter"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/endpoints"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -37,6 +37,9 @@ var (
 
 	// errInvalidState is returned when OAuth state validation fails.
 	errInvalidState = errors.New("state does not match")
+
+	// errAudienceInvalid is returned when an ID token was not issued for this app.
+	errAudienceInvalid = errors.New("audience invalid or missing")
 )
 
 // authDetails holds information about an authenticated user.
@@ -47,6 +50,40 @@ type authDetails struct {
 	name    string
 	email   string
 	picture string
+
+	// issuedAt and sessionID hold the "iat" and "sid" claims,
+	// used for matching sessions terminated by a logout.
+	issuedAt  time.Time
+	sessionID string
+
+	// authTime holds the time the user last actively authenticated with
+	// the IdP: the "auth_time" claim if present, otherwise "iat".
+	authTime time.Time
+
+	// roles holds the application roles granted to the user.
+	roles []string
+
+	// principal holds the "principal" claim of local session tokens:
+	// principalGuest for guests, otherwise empty, for signed-in users.
+	principal string
+
+	// providerIDToken holds the "id_token" claim of local session tokens
+	// of users signed in with another provider: the provider's ID token,
+	// sent back to it as the id_token_hint of RP-initiated logouts.
+	providerIDToken string
+}
+
+// isGuest reports whether the session is a guest's rather than a user's.
+func (a *authDetails) isGuest() bool {
+	return a.principal == principalGuest
+}
+
+// principalType returns the type of principal the session belongs to.
+func (a *authDetails) principalType() string {
+	if a.isGuest() {
+		return principalGuest
+	}
+	return principalUser
 }
 
 type authKey struct{}
@@ -62,25 +99,37 @@ type oauthStateData struct {
 }
 
 // generateOAuthState generates a random "state" value for an OAuth 2.0 session,
-// for protecting against CSRF attacks on the redirect handler.
+// for protecting against CSRF attacks on the redirect handler. If states is
+// non-nil, additionalData is kept server-side rather than in the state.
 func generateOAuthState(
+	ctx context.Context,
+	ids idSource,
 	secureCookies secureCookies,
+	states *oauthStateStore,
 	cookieName, cookiePath string,
 	additionalData map[string]string,
 ) (string, *http.Cookie, error) {
 	nonce := make([]byte, 32)
-	if _, err := rand.Read(nonce); err != nil {
+	if _, err := ids.Read(nonce); err != nil {
 		return "", nil, fmt.Errorf("failed to generate state nonce: %w", err)
 	}
 
-	stateJSON, err := json.Marshal(oauthStateData{
-		Nonce: nonce,
-		Data:  additionalData,
-	})
-	if err != nil {
-		return "", nil, fmt.Errorf("failed to marshal state data: %w", err)
+	var state string
+	if states != nil {
+		state = base64.URLEncoding.EncodeToString(nonce)
+		if err := states.put(ctx, state, additionalData); err != nil {
+			return "", nil, err
+		}
+	} else {
+		stateJSON, err := json.Marshal(oauthStateData{
+			Nonce: nonce,
+			Data:  additionalData,
+		})
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to marshal state data: %w", err)
+		}
+		state = base64.URLEncoding.EncodeToString(stateJSON)
 	}
-	state := base64.URLEncoding.EncodeToString(stateJSON)
 
 	cookieValue, err := secureCookies.Encode(state)
 	if err != nil {
@@ -95,13 +144,15 @@ func generateOAuthState(
 	}, nil
 }
 
-// validateOAuthState validates the "state" query parameter matches the value
-// in the cookie with the given name.
+// validateOAuthState validates the "state" parameter, from the query or a
+// posted form, matches the value in the cookie with the given name. If states is non-nil, the state is
+// consumed from it, so it cannot be replayed.
 func validateOAuthState(
 	secureCookies secureCookies,
+	states *oauthStateStore,
 	r *http.Request, cookieName string,
 ) (map[string]string, error) {
-	state := r.URL.Query().Get("state")
+	state := r.FormValue("state")
 	stateCookie, err := r.Cookie(cookieName)
 	if err != nil {
 		return nil, err
@@ -114,6 +165,9 @@ func validateOAuthState(
 	if subtle.ConstantTimeCompare([]byte(state), []byte(expected)) != 1 {
 		return nil, errInvalidState
 	}
+	if states != nil {
+		return states.consume(r.Context(), state)
+	}
 
 	// Decode state to get the additional data
 	stateDecoded, err := base64.URLEncoding.DecodeString(state)
@@ -137,18 +191,30 @@ func idTokenParser(jwks *keyfunc.JWKS, googleClientID string) func(string) (*aut
 		}
 		claims := token.Claims.(jwt.MapClaims)
 		if !claims.VerifyAudience(googleClientID, true) {
-			return nil, errors.New("audience invalid or missing")
+			return nil, errAudienceInvalid
 		}
 
 		picture, _ := claims["picture"].(string)
 		name, _ := claims["name"].(string)
+		sid, _ := claims["sid"].(string)
+		var issuedAt time.Time
+		if iat, ok := claims["iat"].(float64); ok {
+			issuedAt = time.Unix(int64(iat), 0)
+		}
+		authTime := issuedAt
+		if at, ok := claims["auth_time"].(float64); ok {
+			authTime = time.Unix(int64(at), 0)
+		}
 		return &authDetails{
-			idToken: token,
-			claims:  claims,
-			userID:  claims["sub"].(string),
-			email:   claims["email"].(string),
-			name:    name,
-			picture: picture,
+			idToken:   token,
+			claims:    claims,
+			userID:    claims["sub"].(string),
+			email:     claims["email"].(string),
+			name:      name,
+			picture:   picture,
+			issuedAt:  issuedAt,
+			sessionID: sid,
+			authTime:  authTime,
 		}, nil
 	}
 }
@@ -172,64 +238,126 @@ func oauth2ConfigForURL(cfg oauth2.Config, r *http.Request) *oauth2.Config {
 // getAuthMiddleware creates middleware that validates authentication.
 func getAuthMiddleware(
 	secureCookies secureCookies,
+	binding *sessionBinding,
 	parseIDToken func(string) (*authDetails, error),
-) func(h httprouter.Handle) httprouter.Handle {
-	return func(h httprouter.Handle) httprouter.Handle {
-		return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	roles *roleResolver,
+	guests *guestPolicy,
+	security *securityEvents,
+) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			cookie, err := r.Cookie("credentials")
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
+				security.record(r, securityEventAuth, reasonCookieMissing, "")
+				writeError(w, r, http.StatusUnauthorized, err.Error())
 				return
 			}
 			credentials, err := secureCookies.Decode(cookie.Value)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
+				security.record(r, securityEventAuth, reasonCookieDecodeError, "")
+				writeError(w, r, http.StatusUnauthorized, err.Error())
+				return
+			}
+			if !binding.matches(r, credentials) {
+				security.record(r, securityEventAuth, reasonBindingMismatch, "")
+				writeError(w, r, http.StatusUnauthorized, "session is bound to another client")
 				return
 			}
 			details, err := parseIDToken(credentials)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
+				security.record(r, securityEventAuth, tokenFailureReason(err), "")
+				writeError(w, r, http.StatusUnauthorized, err.Error())
+				return
+			}
+			// Guests may only read the endpoints opened to them.
+			if details.isGuest() && !guests.allows(r) {
+				security.record(r, securityEventAuth, reasonGuestForbidden, details.userID)
+				writeError(w, r, http.StatusForbidden, "not available to guests")
 				return
 			}
+			details.roles = roles.rolesFor(r.Context(), details.email)
 			if span := trace.SpanFromContext(r.Context()); span != nil {
 				span.SetAttributes(
 					attribute.String("user.id", details.userID),
 					attribute.String("user.email", details.email),
+					attribute.String("user.principal", details.principalType()),
 				)
 			}
 			r = r.WithContext(context.WithValue(r.Context(), authKey{}, details))
-			h(w, r, p)
-		}
+			h.ServeHTTP(w, r)
+		})
 	}
 }
 
-// tokenStorage manages OAuth tokens for Google.
-type tokenStorage struct {
-	googleConfig oauth2.Config
-	client       *elasticsearch.Client
-	logger       *zap.Logger
+const (
+	providerGoogle = "google"
+
+	// tokenRefreshInterval is how often tokens expiring within
+	// tokenRefreshWindow are refreshed, for users active within
+	// tokenActiveWindow.
+	tokenRefreshInterval = time.Minute
+	tokenRefreshWindow   = 5 * time.Minute
+	tokenActiveWindow    = time.Hour
+)
 
-	mu           sync.RWMutex
-	googleTokens map[string]*oauth2.Token
+// tokenKey identifies a user's token from a provider.
+type tokenKey struct {
+	provider string
+	id       string
 }
 
-// tokenDocument represents a token document in Elasticsearch.
-type tokenDocument struct {
-	Google struct {
-		RefreshToken string `json:"refresh_token"`
-	} `json:"google"`
+// tokenStorage manages OAuth tokens of users, by provider, cached in
+// memory and persisted in a tokenstore.Store. Access tokens are persisted
+// encrypted with secureCookies, along with their expiry.
+type tokenStorage struct {
+	configs       map[string]oauth2.Config
+	oauthClient   *http.Client
+	secureCookies secureCookies
+	store         tokenstore.Store
+	logger        *zap.Logger
+	invalidations *invalidator
+	clock         clock
+
+	mu     sync.RWMutex
+	tokens map[tokenKey]*oauth2.Token
+
+	// lastUsed holds when each token was last requested, so that only
+	// tokens of active users are refreshed proactively.
+	lastUsed map[tokenKey]time.Time
+
+	// refreshes deduplicates concurrent token refreshes, by provider and
+	// user ID.
+	refreshes singleflight.Group
+
+	// refreshCount counts token refreshes, by provider and outcome.
+	refreshCount metric.Int64Counter
 }
 
-// newTokenStorage creates a new tokenStorage instance.
+// newTokenStorage creates a token storage for the providers configured in
+// configs, loading existing tokens from store.
 func newTokenStorage(
-	googleConfig oauth2.Config,
-	client *elasticsearch.Client, logger *zap.Logger,
+	configs map[string]oauth2.Config,
+	oauthClient *http.Client,
+	secureCookies secureCookies,
+	store tokenstore.Store, logger *zap.Logger,
 ) (*tokenStorage, error) {
+	refreshCount, err := otel.Meter("main").Int64Counter(
+		"app.oauth.token_refreshes",
+		metric.WithDescription("OAuth token refreshes by provider and outcome"),
+	)
+	if err != nil {
+		return nil, err
+	}
 	s := &tokenStorage{
-		googleConfig: googleConfig,
-		googleTokens: make(map[string]*oauth2.Token),
-		client:       client,
-		logger:       logger,
+		configs:       configs,
+		oauthClient:   oauthClient,
+		secureCookies: secureCookies,
+		tokens:        make(map[tokenKey]*oauth2.Token),
+		lastUsed:      make(map[tokenKey]time.Time),
+		store:         store,
+		logger:        logger,
+		clock:         systemClock{},
+		refreshCount:  refreshCount,
 	}
 	if err := s.init(logger); err != nil {
 		return nil, fmt.Errorf("failed to init token storage: %w", err)
@@ -237,139 +365,313 @@ func newTokenStorage(
 	return s, nil
 }
 
-// init loads existing tokens from Elasticsearch.
+// init loads existing tokens from the store.
 func (s *tokenStorage) init(logger *zap.Logger) error {
-	if s.client == nil {
-		return nil
-	}
-
 	ctx, span := otel.Tracer("main").Start(context.Background(), "initTokenStorage")
 	defer span.End()
 	logger = logger.With(traceLogFields(ctx)...)
 
-	// Search for all token documents
-	res, err := s.client.Search(
-		s.client.Search.WithContext(ctx),
-		s.client.Search.WithIndex("app-sessions"),
-		s.client.Search.WithSize(1000),
-	)
+	stored, err := s.store.List(ctx)
 	if err != nil {
-		// Index might not exist yet
-		logger.Info("could not load tokens from Elasticsearch", zap.Error(err))
+		// The store might not be ready yet; tokens are then loaded when
+		// next stored by any replica.
+		logger.Info("could not load tokens", zap.Error(err))
 		return nil
 	}
-	defer res.Body.Close()
 
-	if res.IsError() {
-		logger.Info("could not load tokens from Elasticsearch", zap.String("status", res.Status()))
-		return nil
+	counts := make(map[string]int)
+	for _, token := range stored {
+		if token.RefreshToken == "" {
+			continue
+		}
+		s.tokens[tokenKey{token.Provider, token.UserID}] = s.decodeToken(logger, token)
+		counts[token.Provider]++
 	}
 
-	var searchResult struct {
-		Hits struct {
-			Hits []struct {
-				ID     string        `json:"_id"`
-				Source tokenDocument `json:"_source"`
-			} `json:"hits"`
-		} `json:"hits"`
-	}
-	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return err
+	fields := make([]zap.Field, 0, len(counts))
+	for provider, n := range counts {
+		fields = append(fields, zap.Int(provider+"_tokens", n))
 	}
+	logger.Info("loaded OAuth tokens", fields...)
 
-	for _, hit := range searchResult.Hits.Hits {
-		if hit.Source.Google.RefreshToken != "" {
-			s.googleTokens[hit.ID] = &oauth2.Token{
-				TokenType:    "Bearer",
-				RefreshToken: hit.Source.Google.RefreshToken,
-			}
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// decodeToken returns the OAuth token of a stored token.
+func (s *tokenStorage) decodeToken(logger *zap.Logger, stored tokenstore.Token) *oauth2.Token {
+	token := &oauth2.Token{
+		TokenType:    "Bearer",
+		RefreshToken: stored.RefreshToken,
+	}
+	if stored.AccessToken != "" {
+		accessToken, err := s.secureCookies.Decode(stored.AccessToken)
+		if err != nil {
+			// Likely encrypted with a retired key; the token will be
+			// refreshed when next used.
+			logger.Info("could not decrypt access token", zap.String("id", stored.UserID), zap.Error(err))
+		} else {
+			token.AccessToken = accessToken
+			token.Expiry = stored.Expiry
 		}
 	}
+	return token
+}
 
-	logger.Info(
-		"loaded OAuth tokens",
-		zap.Int("google_tokens", len(s.googleTokens)),
-	)
+// set sets a user's OAuth token from a provider.
+func (s *tokenStorage) set(ctx context.Context, provider, id string, token *oauth2.Token) error {
+	s.mu.Lock()
+	s.tokens[tokenKey{provider, id}] = token
+	s.mu.Unlock()
 
-	span.SetStatus(codes.Ok, "")
+	if err := s.putToken(ctx, provider, id, token); err != nil {
+		return err
+	}
+	s.invalidations.notify(ctx, invalidateToken, id, s.clock.Now())
 	return nil
 }
 
-// setGoogle sets a Google OAuth token for a user.
-func (s *tokenStorage) setGoogle(ctx context.Context, id string, token *oauth2.Token) error {
+// delete deletes a user's OAuth tokens from all providers, returning those
+// which were stored, by provider, for them to be revoked.
+func (s *tokenStorage) delete(ctx context.Context, id string) (map[string]*oauth2.Token, error) {
+	deleted := make(map[string]*oauth2.Token)
 	s.mu.Lock()
-	s.googleTokens[id] = token
+	for provider := range s.configs {
+		key := tokenKey{provider, id}
+		if token := s.tokens[key]; token != nil {
+			deleted[provider] = token
+		}
+		delete(s.tokens, key)
+		delete(s.lastUsed, key)
+	}
 	s.mu.Unlock()
 
-	if s.client != nil {
-		return s.putToken(ctx, "google", id, token)
+	for provider := range s.configs {
+		if err := s.store.Delete(ctx, provider, id); err != nil {
+			return deleted, fmt.Errorf("while deleting %s token: %w", provider, err)
+		}
+	}
+	s.invalidations.notify(ctx, invalidateToken, id, s.clock.Now())
+	return deleted, nil
+}
+
+// watch propagates tokens stored by other replicas, reloading them from
+// the store.
+func (s *tokenStorage) watch(invalidations *invalidator) {
+	s.invalidations = invalidations
+	invalidations.subscribe(invalidateToken, func(ctx context.Context, inv invalidation) {
+		if err := s.reload(ctx, inv.Key); err != nil {
+			s.logger.Warn("failed to reload token", zap.String("user.id", inv.Key), zap.Error(err))
+		}
+	})
+}
+
+// reload loads a user's tokens from the store, replacing those in memory.
+func (s *tokenStorage) reload(ctx context.Context, id string) error {
+	stored := make(map[string]*tokenstore.Token, len(s.configs))
+	for provider := range s.configs {
+		token, err := s.store.Get(ctx, provider, id)
+		if err != nil && !errors.Is(err, tokenstore.ErrNotFound) {
+			return err
+		}
+		stored[provider] = token
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for provider, token := range stored {
+		key := tokenKey{provider, id}
+		if token == nil || token.RefreshToken == "" {
+			delete(s.tokens, key)
+			continue
+		}
+		s.tokens[key] = s.decodeToken(s.logger, *token)
 	}
 	return nil
 }
 
-// putToken persists an OAuth token to Elasticsearch.
-func (s *tokenStorage) putToken(ctx context.Context, typ, id string, token *oauth2.Token) error {
+// setGoogle sets a Google OAuth token for a user.
+func (s *tokenStorage) setGoogle(ctx context.Context, id string, token *oauth2.Token) error {
+	return s.set(ctx, providerGoogle, id, token)
+}
+
+// putToken persists an OAuth token, encrypting its access token.
+func (s *tokenStorage) putToken(ctx context.Context, provider, id string, token *oauth2.Token) error {
 	if token.RefreshToken == "" {
 		return fmt.Errorf("empty refresh token for user ID %q", id)
 	}
 
-	body := esutil.NewJSONReader(map[string]interface{}{
-		"doc_as_upsert": true,
-		"doc": map[string]interface{}{
-			typ: map[string]interface{}{
-				"issued_at":     time.Now().UTC().Format(time.RFC3339),
-				"refresh_token": token.RefreshToken,
-			},
-		},
-	})
-	res, err := s.client.Update("app-sessions", id, body, s.client.Update.WithContext(ctx))
-	if err != nil {
-		return fmt.Errorf("while saving token for user ID %q: %w", id, err)
+	stored := tokenstore.Token{
+		Provider:     provider,
+		UserID:       id,
+		RefreshToken: token.RefreshToken,
+		Scopes:       s.scopes(provider, token),
+		IssuedAt:     s.clock.Now(),
+	}
+	if token.AccessToken != "" {
+		accessToken, err := s.secureCookies.Encode(token.AccessToken)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt access token: %w", err)
+		}
+		stored.AccessToken = accessToken
+		stored.Expiry = token.Expiry
 	}
-	if res.IsError() {
-		defer res.Body.Close()
-		return fmt.Errorf("updating token failed: %s", res.Status())
+	return s.store.Set(ctx, stored)
+}
+
+// scopes returns the scopes granted to a token, as reported by the
+// provider, or else as requested.
+func (s *tokenStorage) scopes(provider string, token *oauth2.Token) []string {
+	if scope, ok := token.Extra("scope").(string); ok && scope != "" {
+		return strings.Fields(scope)
 	}
-	defer res.Body.Close()
-	return nil
+	return s.configs[provider].Scopes
 }
 
 // getGoogle gets a Google OAuth token for a user, refreshing it if necessary.
 func (s *tokenStorage) getGoogle(ctx context.Context, id string, r *http.Request) (*oauth2.Token, error) {
-	s.mu.RLock()
-	token := s.googleTokens[id]
-	s.mu.RUnlock()
-	if token == nil || token.RefreshToken == "" {
-		return nil, errUnauthorized
+	return s.get(ctx, providerGoogle, id, r)
+}
+
+// get gets a user's OAuth token from a provider, refreshing it if
+// necessary. Concurrent refreshes for the same token are deduplicated,
+// since providers which rotate refresh tokens may invalidate all but the
+// first.
+func (s *tokenStorage) get(ctx context.Context, provider, id string, r *http.Request) (*oauth2.Token, error) {
+	config, ok := s.configs[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown OAuth provider %q", provider)
 	}
+	key := tokenKey{provider, id}
+	s.mu.Lock()
+	s.lastUsed[key] = s.clock.Now()
+	s.mu.Unlock()
+	return s.refresh(ctx, key, oauth2ConfigForURL(config, r), 0)
+}
 
-	newToken, err := oauth2ConfigForURL(s.googleConfig, r).TokenSource(ctx, token).Token()
+// httpClient returns an HTTP client authorized with a user's OAuth token from a
+// provider, refreshed if necessary, for calls made on the user's behalf
+// outside of their requests.
+func (s *tokenStorage) httpClient(ctx context.Context, provider, id string) (*http.Client, error) {
+	config, ok := s.configs[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown OAuth provider %q", provider)
+	}
+	token, err := s.refresh(ctx, tokenKey{provider, id}, &config, 0)
 	if err != nil {
 		return nil, err
 	}
+	return oauth2.NewClient(s.oauthContext(ctx), oauth2.StaticTokenSource(token)), nil
+}
 
-	if token.AccessToken != newToken.AccessToken {
-		s.logger.Info("refreshed google token", zap.String("id", id))
-		s.mu.Lock()
-		s.googleTokens[id] = newToken
-		s.mu.Unlock()
-	}
-	if token.RefreshToken != newToken.RefreshToken {
-		if err := s.setGoogle(ctx, id, newToken); err != nil {
+// refresh refreshes a token if it expires within earlyExpiry, or the
+// default expiry delta if zero, sharing the refresh with concurrent
+// callers.
+func (s *tokenStorage) refresh(
+	ctx context.Context, key tokenKey, config *oauth2.Config, earlyExpiry time.Duration,
+) (*oauth2.Token, error) {
+	// The refresh is shared with concurrent callers, so must not be
+	// cancelled with the first caller's request.
+	ctx = context.WithoutCancel(ctx)
+	v, err, _ := s.refreshes.Do(key.provider+"/"+key.id, func() (interface{}, error) {
+		s.mu.RLock()
+		token := s.tokens[key]
+		s.mu.RUnlock()
+		if token == nil || token.RefreshToken == "" {
+			return nil, errUnauthorized
+		}
+
+		refresher := config.TokenSource(s.oauthContext(ctx), &oauth2.Token{RefreshToken: token.RefreshToken})
+		newToken, err := oauth2.ReuseTokenSourceWithExpiry(token, refresher, earlyExpiry).Token()
+		if err != nil {
+			s.countRefresh(ctx, key.provider, "failure")
 			return nil, err
 		}
+
+		if token.AccessToken != newToken.AccessToken {
+			s.countRefresh(ctx, key.provider, "success")
+			s.logger.Info("refreshed OAuth token", zap.String("provider", key.provider), zap.String("id", key.id))
+			if err := s.set(ctx, key.provider, key.id, newToken); err != nil {
+				return nil, err
+			}
+		}
+		return newToken, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*oauth2.Token), nil
+}
+
+// countRefresh counts a token refresh with a provider.
+func (s *tokenStorage) countRefresh(ctx context.Context, provider, outcome string) {
+	s.refreshCount.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("oauth.provider", provider),
+		attribute.String("event.outcome", outcome),
+	))
+}
+
+// start proactively refreshes, in the background, tokens of active users
+// which are about to expire, so that requests need not wait for refreshes.
+func (s *tokenStorage) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(tokenRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.refreshExpiring(ctx)
+			}
+		}
+	}()
+}
+
+// refreshExpiring refreshes tokens of active users expiring within
+// tokenRefreshWindow.
+func (s *tokenStorage) refreshExpiring(ctx context.Context) {
+	var expiring []tokenKey
+	now := s.clock.Now()
+	s.mu.Lock()
+	for key, lastUsed := range s.lastUsed {
+		if now.Sub(lastUsed) > tokenActiveWindow {
+			delete(s.lastUsed, key)
+			continue
+		}
+		token := s.tokens[key]
+		if token != nil && !token.Expiry.IsZero() && token.Expiry.Sub(now) < tokenRefreshWindow {
+			expiring = append(expiring, key)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, key := range expiring {
+		config := s.configs[key.provider]
+		if _, err := s.refresh(ctx, key, &config, tokenRefreshWindow); err != nil {
+			s.logger.Warn(
+				"failed to refresh OAuth token",
+				zap.String("provider", key.provider), zap.String("id", key.id), zap.Error(err),
+			)
+		}
+	}
+}
+
+// oauthContext returns a context for OAuth exchanges, which makes them
+// with the storage's HTTP client.
+func (s *tokenStorage) oauthContext(ctx context.Context) context.Context {
+	if s.oauthClient == nil {
+		return ctx
 	}
-	return newToken, nil
+	return context.WithValue(ctx, oauth2.HTTPClient, s.oauthClient)
 }
 
 // newGoogleOAuthConfig creates a Google OAuth2 configuration.
-func newGoogleOAuthConfig(clientID, clientSecret string) oauth2.Config {
+func newGoogleOAuthConfig(clientID, clientSecret string, endpoint oauth2.Endpoint) oauth2.Config {
 	return oauth2.Config{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
-		Endpoint:     endpoints.Google,
+		Endpoint:     endpoint,
 		RedirectURL:  "/api/oauth/google",
 		Scopes:       []string{"openid", "email", "profile"},
 	}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuthCacheTTL = 30 * time.Second
+
+	// maxAuthCacheEntries bounds the memory used by the cache. Once full,
+	// credentials are verified on every request until entries expire.
+	maxAuthCacheEntries = 10000
+)
+
+type authCacheEntry struct {
+	details *authDetails
+	expires time.Time
+}
+
+// authCache caches the authDetails of verified credentials, keyed by their
+// digest, for a short TTL, so that repeated requests of a session do not
+// verify the signature of its ID token every time. Only successfully
+// verified credentials are cached, and never beyond the expiry of their
+// token. A nil authCache caches nothing.
+type authCache struct {
+	ttl   time.Duration
+	clock clock
+
+	mu      sync.RWMutex
+	entries map[[sha256.Size]byte]*authCacheEntry
+}
+
+// newAuthCache returns a cache of verified credentials, or nil if disabled.
+func newAuthCache(config *appConfig) *authCache {
+	if config.AuthCache.Disabled {
+		return nil
+	}
+	c := &authCache{
+		ttl:     config.AuthCache.TTL,
+		clock:   systemClock{},
+		entries: make(map[[sha256.Size]byte]*authCacheEntry),
+	}
+	if c.ttl <= 0 {
+		c.ttl = defaultAuthCacheTTL
+	}
+	return c
+}
+
+// wrap returns an ID token parser that answers from the cache, calling
+// parseIDToken only for credentials not cached. Checks which must see
+// changes immediately, like revocations, go outside of it.
+func (c *authCache) wrap(
+	parseIDToken func(string) (*authDetails, error),
+) func(string) (*authDetails, error) {
+	if c == nil {
+		return parseIDToken
+	}
+	return func(idToken string) (*authDetails, error) {
+		key := sha256.Sum256([]byte(idToken))
+		now := c.clock.Now()
+		c.mu.RLock()
+		entry, ok := c.entries[key]
+		c.mu.RUnlock()
+		if ok && now.Before(entry.expires) {
+			// Callers set fields of the details they are returned,
+			// like roles, so each gets its own copy.
+			details := *entry.details
+			return &details, nil
+		}
+		details, err := parseIDToken(idToken)
+		if err != nil {
+			return nil, err
+		}
+		c.add(key, details, now)
+		return details, nil
+	}
+}
+
+func (c *authCache) add(key [sha256.Size]byte, details *authDetails, now time.Time) {
+	expires := now.Add(c.ttl)
+	if exp, ok := details.claims["exp"].(float64); ok {
+		if tokenExpires := time.Unix(int64(exp), 0); tokenExpires.Before(expires) {
+			expires = tokenExpires
+		}
+	}
+	cached := *details
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxAuthCacheEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxAuthCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = &authCacheEntry{details: &cached, expires: expires}
+}
+
+// removeSubject evicts the cached credentials of a user.
+func (c *authCache) removeSubject(subject string) {
+	c.remove(func(details *authDetails) bool { return details.userID == subject })
+}
+
+// removeSID evicts the cached credentials of an IdP session.
+func (c *authCache) removeSID(sid string) {
+	c.remove(func(details *authDetails) bool { return details.sessionID == sid })
+}
+
+func (c *authCache) remove(match func(*authDetails) bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if match(entry.details) {
+			delete(c.entries, key)
+		}
+	}
+}
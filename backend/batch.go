@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	batchPath = "/api/batch"
+
+	// maxBatchRequests bounds the sub-requests of a batch, and
+	// maxBatchBytes the size of its body.
+	maxBatchRequests = 20
+	maxBatchBytes    = 1 << 20
+)
+
+// batchRequest is a sub-request of a batch.
+type batchRequest struct {
+	// Method defaults to GET.
+	Method string `json:"method"`
+
+	// Path is the path of an API endpoint, with any query string.
+	Path string `json:"path"`
+
+	// Body is sent as the JSON body of the sub-request.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// batchResponse is the response to a sub-request: its status, and its body,
+// as JSON if it is JSON, and as a string otherwise.
+type batchResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// batchResponseWriter records the response to a sub-request.
+type batchResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *batchResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// jsonBody returns the body of the response as JSON if it is JSON, and as
+// a string otherwise, or nil if empty.
+func (w *batchResponseWriter) jsonBody() json.RawMessage {
+	mediaType, _, _ := mime.ParseMediaType(w.header.Get("Content-Type"))
+	if mediaType == "application/json" && json.Valid(w.body.Bytes()) {
+		return bytes.TrimSpace(w.body.Bytes())
+	}
+	if w.body.Len() > 0 {
+		return jsonString(strings.TrimSpace(w.body.String()))
+	}
+	return nil
+}
+
+// batchHandler serves POST /api/batch, which makes sub-requests to the API
+// in order, as the caller, with the caller's cookies and headers, so that
+// the frontend can load e.g. the config, user, and data of a dashboard in
+// a single round trip. Each sub-request goes through the middleware of its
+// route, and is authorized by it, and the cookies it sets are set on the
+// response. Sub-requests may not be batches themselves.
+type batchHandler struct {
+	// handler serves sub-requests: the router, without the server's
+	// middleware, which already applies to the batch, but with bot
+	// protection, whose checks depend on the route requested.
+	handler http.Handler
+}
+
+func (b *batchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var requests []batchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&requests); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid batch: "+err.Error())
+		return
+	}
+	if len(requests) > maxBatchRequests {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("batches are limited to %d requests", maxBatchRequests))
+		return
+	}
+
+	responses := make([]batchResponse, len(requests))
+	for i, request := range requests {
+		rec, err := b.do(w, r, request)
+		if err != nil {
+			responses[i] = batchResponse{Status: http.StatusBadRequest, Body: jsonString(err.Error())}
+			continue
+		}
+		responses[i] = batchResponse{Status: rec.status, Body: rec.jsonBody()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(responses)
+}
+
+// do makes a sub-request on behalf of r, setting the cookies it sets on w,
+// and returns its response.
+func (b *batchHandler) do(w http.ResponseWriter, r *http.Request, request batchRequest) (*batchResponseWriter, error) {
+	sub, err := b.newRequest(r, request)
+	if err != nil {
+		return nil, err
+	}
+	rec := &batchResponseWriter{header: make(http.Header)}
+	b.handler.ServeHTTP(rec, sub)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	for _, cookie := range rec.header.Values("Set-Cookie") {
+		w.Header().Add("Set-Cookie", cookie)
+	}
+	return rec, nil
+}
+
+// newRequest returns the sub-request for request, made on behalf of r.
+func (b *batchHandler) newRequest(r *http.Request, request batchRequest) (*http.Request, error) {
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !strings.HasPrefix(request.Path, "/api/") {
+		return nil, fmt.Errorf("invalid path %q: only API endpoints may be requested", request.Path)
+	}
+	sub, err := http.NewRequestWithContext(r.Context(), strings.ToUpper(method), request.Path, bytes.NewReader(request.Body))
+	if err != nil {
+		return nil, err
+	}
+	if sub.URL.Path == batchPath || sub.URL.Path == bootstrapPath {
+		return nil, fmt.Errorf("batches may not be nested")
+	}
+	sub.Host = r.Host
+	sub.RemoteAddr = r.RemoteAddr
+	sub.TLS = r.TLS
+	sub.Header = r.Header.Clone()
+	// The body, and preconditions meant for the batch, are the
+	// sub-request's own.
+	for _, name := range []string{"Content-Length", "Content-Type", "If-Match", "If-None-Match", "If-Modified-Since", "Range"} {
+		sub.Header.Del(name)
+	}
+	if request.Body != nil {
+		sub.Header.Set("Content-Type", "application/json")
+	}
+	return sub, nil
+}
+
+// jsonString returns s encoded as a JSON string.
+func jsonString(s string) json.RawMessage {
+	encoded, _ := json.Marshal(s)
+	return encoded
+}
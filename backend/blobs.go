@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"app-backend/blobstore"
+
+	"go.uber.org/zap"
+)
+
+const defaultBlobCleanupInterval = time.Hour
+
+// startBlobCleanup periodically deletes the blobs which have outlived the
+// configured lifecycle rules, if there are any.
+func startBlobCleanup(ctx context.Context, blobs blobstore.Store, config blobstore.Config, logger *zap.Logger) {
+	if len(config.Lifecycle) == 0 {
+		return
+	}
+	interval := config.CleanupInterval
+	if interval <= 0 {
+		interval = defaultBlobCleanupInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				deleted, err := blobstore.Cleanup(ctx, blobs, config.Lifecycle, time.Now())
+				if err != nil {
+					logger.Warn("blob lifecycle cleanup failed", zap.Int("blobs.deleted", deleted), zap.Error(err))
+				} else if deleted > 0 {
+					logger.Info("deleted expired blobs", zap.Int("blobs.deleted", deleted))
+				}
+			}
+		}
+	}()
+}
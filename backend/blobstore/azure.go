@@ -0,0 +1,269 @@
+package blobstore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureVersion is the version of the Blob Storage REST API requests are
+// made with.
+const azureVersion = "2021-08-06"
+
+// azureStore stores blobs in an Azure Blob Storage container, signing
+// requests with the account key, or authorizing them with a shared access
+// signature.
+type azureStore struct {
+	client          *http.Client
+	endpoint        string
+	account         string
+	container       string
+	key             []byte
+	sas             url.Values
+	encryptionScope string
+
+	now func() time.Time
+}
+
+func azureEndpoint(config Config) string {
+	if config.Azure.Endpoint != "" {
+		return config.Azure.Endpoint
+	}
+	return "https://" + config.Azure.Account + ".blob.core.windows.net"
+}
+
+func newAzureStore(config Config, client *http.Client) (*azureStore, error) {
+	if config.Azure.Account == "" || config.Azure.Container == "" {
+		return nil, errors.New("account and container are required")
+	}
+	s := &azureStore{
+		client:          client,
+		endpoint:        strings.TrimSuffix(azureEndpoint(config), "/"),
+		account:         config.Azure.Account,
+		container:       config.Azure.Container,
+		encryptionScope: config.Azure.EncryptionScope,
+		now:             time.Now,
+	}
+	switch {
+	case config.Azure.Key != "":
+		key, err := base64.StdEncoding.DecodeString(config.Azure.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %w", err)
+		}
+		s.key = key
+	case config.Azure.SASToken != "":
+		sas, err := url.ParseQuery(strings.TrimPrefix(config.Azure.SASToken, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SAS token: %w", err)
+		}
+		s.sas = sas
+	default:
+		return nil, errors.New("key or sas_token is required")
+	}
+	return s, nil
+}
+
+// url returns the URL of the blob at key, or of the container if key is
+// empty.
+func (s *azureStore) url(key string, query url.Values) string {
+	rawURL := s.endpoint + "/" + url.PathEscape(s.container)
+	if key != "" {
+		segments := strings.Split(key, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		rawURL += "/" + strings.Join(segments, "/")
+	}
+	if len(query) > 0 {
+		rawURL += "?" + query.Encode()
+	}
+	return rawURL
+}
+
+func (s *azureStore) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	if s.sas != nil {
+		merged := url.Values{}
+		for name, values := range s.sas {
+			merged[name] = values
+		}
+		for name, values := range query {
+			merged[name] = values
+		}
+		query = merged
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.url(key, query), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		// The transport closes request bodies, which belong to the caller.
+		req.Body = io.NopCloser(body)
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Ms-Version", azureVersion)
+	req.Header.Set("X-Ms-Date", s.now().UTC().Format(http.TimeFormat))
+	if s.key != nil {
+		s.sign(req)
+	}
+	return s.client.Do(req)
+}
+
+func (s *azureStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	header := http.Header{}
+	header.Set("X-Ms-Blob-Type", "BlockBlob")
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if s.encryptionScope != "" {
+		header.Set("X-Ms-Encryption-Scope", s.encryptionScope)
+	}
+	res, err := s.do(ctx, http.MethodPut, key, nil, r, size, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return responseError("Azure Blob Storage", res)
+	}
+	return nil
+}
+
+func (s *azureStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.get(ctx, key, nil)
+}
+
+func (s *azureStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return s.get(ctx, key, http.Header{"X-Ms-Range": {rangeHeader(offset, length)}})
+}
+
+func (s *azureStore) get(ctx context.Context, key string, header http.Header) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	defer res.Body.Close()
+	return nil, responseError("Azure Blob Storage", res)
+}
+
+func (s *azureStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted && res.StatusCode != http.StatusNotFound {
+		return responseError("Azure Blob Storage", res)
+	}
+	return nil
+}
+
+func (s *azureStore) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+	for {
+		res, err := s.do(ctx, http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			defer res.Body.Close()
+			return nil, responseError("Azure Blob Storage", res)
+		}
+		var result struct {
+			Blobs []struct {
+				Name       string `xml:"Name"`
+				Properties struct {
+					LastModified  string `xml:"Last-Modified"`
+					ContentLength int64  `xml:"Content-Length"`
+				} `xml:"Properties"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range result.Blobs {
+			modified, err := http.ParseTime(blob.Properties.LastModified)
+			if err != nil {
+				return nil, fmt.Errorf("blob %s: %w", blob.Name, err)
+			}
+			objects = append(objects, Object{Key: blob.Name, Size: blob.Properties.ContentLength, Modified: modified})
+		}
+		if result.NextMarker == "" {
+			return objects, nil
+		}
+		query.Set("marker", result.NextMarker)
+	}
+}
+
+// sign signs a request with the account key, as Shared Key authorization
+// requires.
+func (s *azureStore) sign(req *http.Request) {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var names []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	canonical.WriteString("/" + s.account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		canonical.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		req.Header.Get("Date"),
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonical.String(),
+	}, "\n")
+	signature := base64.StdEncoding.EncodeToString(hmacSHA256(s.key, stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+s.account+":"+signature)
+}
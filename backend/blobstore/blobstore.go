@@ -0,0 +1,338 @@
+// Package blobstore stores blobs, such as attachments and exports, on local
+// disk or in S3, Google Cloud Storage, or Azure Blob Storage, as selected by
+// configuration. The cloud backends talk to the services' REST APIs
+// directly, signing requests themselves, rather than through their SDKs.
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Drivers of blob stores.
+const (
+	DriverLocal = "local"
+	DriverS3    = "s3"
+	DriverGCS   = "gcs"
+	DriverAzure = "azure"
+)
+
+// DefaultLocalDir is the directory blobs are stored in by the local driver,
+// if none is configured.
+const DefaultLocalDir = "data/blobs"
+
+var (
+	// ErrNotFound is returned when getting a blob which does not exist.
+	ErrNotFound = errors.New("blob not found")
+
+	// ErrInvalidKey is returned for keys which are empty, absolute, or
+	// have "." or ".." segments.
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// Object describes a stored blob.
+type Object struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// Store stores blobs by key. Keys are slash-separated paths, such as
+// "attachments/<id>".
+type Store interface {
+	// Put stores size bytes read from r as the blob at key, replacing any
+	// existing blob.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+	// Get returns the content of the blob at key, or ErrNotFound.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// GetRange returns length bytes of the content of the blob at key,
+	// starting at offset, or the rest of it if length is negative.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+
+	// Delete deletes the blob at key, if it exists.
+	Delete(ctx context.Context, key string) error
+
+	// List returns the blobs with keys starting with prefix.
+	List(ctx context.Context, prefix string) ([]Object, error)
+}
+
+// Config selects and configures a blob store.
+type Config struct {
+	// Driver is one of local (the default), s3, gcs, or azure.
+	Driver string `yaml:"driver"`
+
+	// Prefix is prepended to all keys, so that a bucket may be shared.
+	Prefix string `yaml:"prefix"`
+
+	// Lifecycle maps key prefixes to the age after which blobs under them
+	// are deleted by Cleanup, e.g. "quarantine/": 720h. Blobs are matched
+	// by the longest prefix. Maps can only be set in the config file.
+	Lifecycle map[string]time.Duration `yaml:"lifecycle"`
+
+	// CleanupInterval is how often lifecycle cleanup runs. Defaults to an
+	// hour.
+	CleanupInterval time.Duration `yaml:"cleanup_interval"`
+
+	Local struct {
+		// Dir defaults to data/blobs.
+		Dir string `yaml:"dir"`
+	} `yaml:"local"`
+
+	S3 struct {
+		Bucket string `yaml:"bucket"`
+		// Region defaults to us-east-1.
+		Region string `yaml:"region"`
+		// Endpoint overrides the AWS endpoint, for S3-compatible services
+		// such as MinIO.
+		Endpoint string `yaml:"endpoint"`
+		// PathStyle addresses buckets in the path rather than the host
+		// name, as some S3-compatible services require.
+		PathStyle bool `yaml:"path_style"`
+		// Credentials default to the AWS_ACCESS_KEY_ID,
+		// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment
+		// variables.
+		AccessKeyID     string `yaml:"access_key_id"`
+		SecretAccessKey string `yaml:"secret_access_key"`
+		SessionToken    string `yaml:"session_token"`
+		// ServerSideEncryption is AES256 or aws:kms, or empty for the
+		// bucket's default.
+		ServerSideEncryption string `yaml:"server_side_encryption"`
+		// KMSKeyID is the KMS key of aws:kms encryption, or empty for the
+		// AWS managed key.
+		KMSKeyID string `yaml:"kms_key_id"`
+	} `yaml:"s3"`
+
+	GCS struct {
+		Bucket string `yaml:"bucket"`
+		// CredentialsFile is a service account key file. Defaults to
+		// GOOGLE_APPLICATION_CREDENTIALS, or else the credentials of the
+		// instance from the metadata server.
+		CredentialsFile string `yaml:"credentials_file"`
+		// KMSKeyName is a Cloud KMS key blobs are encrypted with, instead
+		// of Google-managed keys.
+		KMSKeyName string `yaml:"kms_key_name"`
+		// Endpoint overrides the API endpoint, for emulators.
+		Endpoint string `yaml:"endpoint"`
+	} `yaml:"gcs"`
+
+	Azure struct {
+		Account   string `yaml:"account"`
+		Container string `yaml:"container"`
+		// Key is the base64-encoded account key requests are signed with.
+		// Either it or SASToken must be set.
+		Key string `yaml:"key"`
+		// SASToken is a shared access signature, the query string of
+		// requests, with read, write, delete, and list permissions on the
+		// container.
+		SASToken string `yaml:"sas_token"`
+		// EncryptionScope encrypts blobs with the scope's key, instead of
+		// the account's.
+		EncryptionScope string `yaml:"encryption_scope"`
+		// Endpoint overrides https://<account>.blob.core.windows.net, for
+		// emulators such as Azurite.
+		Endpoint string `yaml:"endpoint"`
+	} `yaml:"azure"`
+}
+
+// Open returns the configured blob store, sending requests to cloud
+// services with client.
+func Open(config Config, client *http.Client) (Store, error) {
+	var store Store
+	var err error
+	switch config.Driver {
+	case "", DriverLocal:
+		store, err = newLocalStore(config)
+	case DriverS3:
+		store, err = newS3Store(config, client)
+	case DriverGCS:
+		store, err = newGCSStore(config, client)
+	case DriverAzure:
+		store, err = newAzureStore(config, client)
+	default:
+		return nil, fmt.Errorf("unknown blob store driver %q", config.Driver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s blob store: %w", config.Driver, err)
+	}
+	store = &checkedStore{store}
+	if config.Prefix != "" {
+		store = &prefixedStore{store, strings.TrimSuffix(config.Prefix, "/") + "/"}
+	}
+	return store, nil
+}
+
+// Hosts returns the hosts the configured blob store sends requests to, for
+// egress allowlists.
+func (c Config) Hosts() []string {
+	var urls []string
+	switch c.Driver {
+	case DriverS3:
+		urls = append(urls, s3Endpoint(c))
+	case DriverGCS:
+		urls = append(urls, gcsEndpoint(c), gcsTokenURL, gcsMetadataURL)
+	case DriverAzure:
+		urls = append(urls, azureEndpoint(c))
+	}
+	var hosts []string
+	for _, rawURL := range urls {
+		if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	if c.Driver == DriverS3 && !c.S3.PathStyle && c.S3.Bucket != "" && len(hosts) > 0 {
+		hosts[0] = c.S3.Bucket + "." + hosts[0]
+	}
+	return hosts
+}
+
+// Cleanup deletes the blobs older than the age of the lifecycle rule with
+// the longest prefix matching their key, as of now. It returns the number
+// of blobs deleted.
+func Cleanup(ctx context.Context, store Store, lifecycle map[string]time.Duration, now time.Time) (int, error) {
+	prefixes := make([]string, 0, len(lifecycle))
+	for prefix := range lifecycle {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	deleted := 0
+	for _, prefix := range prefixes {
+		objects, err := store.List(ctx, prefix)
+		if err != nil {
+			return deleted, err
+		}
+		for _, object := range objects {
+			if rule := longestPrefix(prefixes, object.Key); rule != prefix {
+				// A more specific rule applies to the blob.
+				continue
+			}
+			if now.Sub(object.Modified) < lifecycle[prefix] {
+				continue
+			}
+			if err := store.Delete(ctx, object.Key); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func longestPrefix(prefixes []string, key string) string {
+	longest := ""
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) && len(prefix) >= len(longest) {
+			longest = prefix
+		}
+	}
+	return longest
+}
+
+// checkKey returns ErrInvalidKey for keys which could escape the store's
+// root, such as "../secret".
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.ContainsAny(key, "\\\x00") {
+		return ErrInvalidKey
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
+
+// checkedStore rejects invalid keys before they reach a backend.
+type checkedStore struct {
+	Store
+}
+
+func (s *checkedStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return s.Store.Put(ctx, key, r, size, contentType)
+}
+
+func (s *checkedStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return s.Store.Get(ctx, key)
+}
+
+func (s *checkedStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid offset %d", offset)
+	}
+	return s.Store.GetRange(ctx, key, offset, length)
+}
+
+func (s *checkedStore) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return s.Store.Delete(ctx, key)
+}
+
+// prefixedStore prepends a prefix to the keys of a store.
+type prefixedStore struct {
+	store  Store
+	prefix string
+}
+
+func (s *prefixedStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	return s.store.Put(ctx, s.prefix+key, r, size, contentType)
+}
+
+func (s *prefixedStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.store.Get(ctx, s.prefix+key)
+}
+
+func (s *prefixedStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return s.store.GetRange(ctx, s.prefix+key, offset, length)
+}
+
+func (s *prefixedStore) Delete(ctx context.Context, key string) error {
+	return s.store.Delete(ctx, s.prefix+key)
+}
+
+func (s *prefixedStore) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects, err := s.store.List(ctx, s.prefix+prefix)
+	for i := range objects {
+		objects[i].Key = strings.TrimPrefix(objects[i].Key, s.prefix)
+	}
+	return objects, err
+}
+
+// rangeHeader returns the value of the Range header requesting length
+// bytes from offset, or the rest of the content if length is negative.
+func rangeHeader(offset, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// responseError returns an error describing an unexpected response of a
+// cloud service, including the start of its body, which usually holds an
+// error code.
+func responseError(service string, res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	if len(body) == 0 {
+		return fmt.Errorf("%s responded %s", service, res.Status)
+	}
+	return fmt.Errorf("%s responded %s: %s", service, res.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,244 @@
+package blobstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+const (
+	gcsDefaultEndpoint = "https://storage.googleapis.com"
+	gcsTokenURL        = "https://oauth2.googleapis.com/token"
+	gcsMetadataURL     = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcsScope           = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// gcsStore stores blobs in a Google Cloud Storage bucket, through its JSON
+// API.
+type gcsStore struct {
+	client     *http.Client
+	endpoint   string
+	bucket     string
+	kmsKeyName string
+}
+
+func gcsEndpoint(config Config) string {
+	if config.GCS.Endpoint != "" {
+		return config.GCS.Endpoint
+	}
+	return gcsDefaultEndpoint
+}
+
+func newGCSStore(config Config, client *http.Client) (*gcsStore, error) {
+	if config.GCS.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	tokens, err := gcsTokenSource(ctx, config, client)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsStore{
+		client:     oauth2.NewClient(ctx, tokens),
+		endpoint:   strings.TrimSuffix(gcsEndpoint(config), "/"),
+		bucket:     config.GCS.Bucket,
+		kmsKeyName: config.GCS.KMSKeyName,
+	}, nil
+}
+
+// gcsTokenSource returns the source of access tokens of the configured
+// service account key, or else of the instance's service account.
+func gcsTokenSource(ctx context.Context, config Config, client *http.Client) (oauth2.TokenSource, error) {
+	file := config.GCS.CredentialsFile
+	if file == "" {
+		file = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if file == "" {
+		return oauth2.ReuseTokenSource(nil, &metadataTokenSource{client: client}), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var key struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		PrivateKeyID string `json:"private_key_id"`
+		TokenURI     string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("invalid credentials file: %w", err)
+	}
+	if key.Type != "service_account" {
+		return nil, fmt.Errorf("credentials file: unsupported type %q", key.Type)
+	}
+	jwtConfig := &jwt.Config{
+		Email:        key.ClientEmail,
+		PrivateKey:   []byte(key.PrivateKey),
+		PrivateKeyID: key.PrivateKeyID,
+		Scopes:       []string{gcsScope},
+		TokenURL:     key.TokenURI,
+	}
+	if jwtConfig.TokenURL == "" {
+		jwtConfig.TokenURL = gcsTokenURL
+	}
+	return jwtConfig.TokenSource(ctx), nil
+}
+
+// metadataTokenSource gets access tokens of the instance's service
+// account from the metadata server of Compute Engine, GKE, or Cloud Run.
+type metadataTokenSource struct {
+	client *http.Client
+}
+
+func (s *metadataTokenSource) Token() (*oauth2.Token, error) {
+	req, err := http.NewRequest(http.MethodGet, gcsMetadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("metadata server: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError("metadata server", res)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func (s *gcsStore) objectURL(key string) string {
+	return s.endpoint + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(key)
+}
+
+func (s *gcsStore) do(ctx context.Context, method, rawURL string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		// The transport closes request bodies, which belong to the caller.
+		req.Body = io.NopCloser(body)
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return s.client.Do(req)
+}
+
+func (s *gcsStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	query := url.Values{"uploadType": {"media"}, "name": {key}}
+	if s.kmsKeyName != "" {
+		query.Set("kmsKeyName", s.kmsKeyName)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	rawURL := s.endpoint + "/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?" + query.Encode()
+	res, err := s.do(ctx, http.MethodPost, rawURL, r, size, http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError("GCS", res)
+	}
+	return nil
+}
+
+func (s *gcsStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.get(ctx, key, nil)
+}
+
+func (s *gcsStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return s.get(ctx, key, http.Header{"Range": {rangeHeader(offset, length)}})
+}
+
+func (s *gcsStore) get(ctx context.Context, key string, header http.Header) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, s.objectURL(key)+"?alt=media", nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	defer res.Body.Close()
+	return nil, responseError("GCS", res)
+}
+
+func (s *gcsStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, s.objectURL(key), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return responseError("GCS", res)
+	}
+	return nil
+}
+
+func (s *gcsStore) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	query := url.Values{"prefix": {prefix}, "fields": {"items(name,size,updated),nextPageToken"}}
+	for {
+		rawURL := s.endpoint + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?" + query.Encode()
+		res, err := s.do(ctx, http.MethodGet, rawURL, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			defer res.Body.Close()
+			return nil, responseError("GCS", res)
+		}
+		var result struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Size    int64     `json:"size,string"`
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range result.Items {
+			objects = append(objects, Object{Key: item.Name, Size: item.Size, Modified: item.Updated})
+		}
+		if result.NextPageToken == "" {
+			return objects, nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
@@ -0,0 +1,74 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// OpenReader returns a reader of the content of the blob at key, size
+// bytes long, which can seek, as serving ranges with http.ServeContent
+// requires, or ErrNotFound. After seeking, content is fetched from the new
+// offset when next read, so that seeking back and forth is free.
+func OpenReader(ctx context.Context, store Store, key string, size int64) (io.ReadSeekCloser, error) {
+	body, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{ctx: ctx, store: store, key: key, size: size, body: body}, nil
+}
+
+type reader struct {
+	ctx    context.Context
+	store  Store
+	key    string
+	size   int64
+	offset int64
+
+	// body is the content being read, from bodyOffset.
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body != nil && r.bodyOffset != r.offset {
+		r.Close()
+	}
+	if r.body == nil {
+		body, err := r.store.GetRange(r.ctx, r.key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.bodyOffset = body, r.offset
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	r.bodyOffset += int64(n)
+	return n, err
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("blobstore: negative offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,316 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+
+	// emptyPayloadHash is the SHA-256 of an empty request body.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// unsignedPayload leaves uploads, sent over TLS, out of signatures, so
+	// that they can be streamed rather than hashed beforehand.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// s3Store stores blobs in an S3 bucket, signing requests with AWS
+// Signature Version 4.
+type s3Store struct {
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	pathStyle bool
+
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+
+	sse      string
+	kmsKeyID string
+
+	now func() time.Time
+}
+
+func s3Endpoint(config Config) string {
+	if config.S3.Endpoint != "" {
+		return config.S3.Endpoint
+	}
+	return "https://s3." + s3Region(config) + ".amazonaws.com"
+}
+
+func s3Region(config Config) string {
+	if config.S3.Region != "" {
+		return config.S3.Region
+	}
+	return defaultS3Region
+}
+
+func newS3Store(config Config, client *http.Client) (*s3Store, error) {
+	if config.S3.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(s3Endpoint(config), "/"))
+	if err != nil {
+		return nil, err
+	}
+	switch config.S3.ServerSideEncryption {
+	case "", "AES256", "aws:kms":
+	default:
+		return nil, fmt.Errorf("unknown server-side encryption %q", config.S3.ServerSideEncryption)
+	}
+	s := &s3Store{
+		client:          client,
+		endpoint:        endpoint,
+		bucket:          config.S3.Bucket,
+		region:          s3Region(config),
+		pathStyle:       config.S3.PathStyle,
+		accessKeyID:     config.S3.AccessKeyID,
+		secretAccessKey: config.S3.SecretAccessKey,
+		sessionToken:    config.S3.SessionToken,
+		sse:             config.S3.ServerSideEncryption,
+		kmsKeyID:        config.S3.KMSKeyID,
+		now:             time.Now,
+	}
+	if s.accessKeyID == "" {
+		s.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if s.accessKeyID == "" || s.secretAccessKey == "" {
+		return nil, errors.New("credentials are required")
+	}
+	return s, nil
+}
+
+// url returns the URL of the object at key, or of the bucket if key is
+// empty.
+func (s *s3Store) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	path := "/" + key
+	if s.pathStyle {
+		path = "/" + s.bucket + path
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path, u.RawPath = path, awsURIEncode(path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func (s *s3Store) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		// The transport closes request bodies, which belong to the caller.
+		req.Body = io.NopCloser(body)
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, payloadHash)
+	return s.client.Do(req)
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if s.sse != "" {
+		header.Set("X-Amz-Server-Side-Encryption", s.sse)
+		if s.sse == "aws:kms" && s.kmsKeyID != "" {
+			header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.kmsKeyID)
+		}
+	}
+	res, err := s.do(ctx, http.MethodPut, s.url(key, nil), r, size, unsignedPayload, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError("S3", res)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.get(ctx, key, nil)
+}
+
+func (s *s3Store) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return s.get(ctx, key, http.Header{"Range": {rangeHeader(offset, length)}})
+}
+
+func (s *s3Store) get(ctx context.Context, key string, header http.Header) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, s.url(key, nil), nil, 0, emptyPayloadHash, header)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	defer res.Body.Close()
+	return nil, responseError("S3", res)
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, s.url(key, nil), nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return responseError("S3", res)
+	}
+	return nil
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		res, err := s.do(ctx, http.MethodGet, s.url("", query), nil, 0, emptyPayloadHash, nil)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			defer res.Body.Close()
+			return nil, responseError("S3", res)
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+				Size         int64     `xml:"Size"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, Object{Key: c.Key, Size: c.Size, Modified: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// sign signs a request with AWS Signature Version 4, including the host,
+// content type, range, and x-amz-* headers.
+func (s *s3Store) sign(req *http.Request, payloadHash string) {
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "range" {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Host
+		if name != "host" {
+			value = strings.Join(req.Header.Values(name), ",")
+		} else if value == "" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	date := t.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes s as AWS signatures require: everything but
+// unreserved characters, and slashes unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery returns query encoded as AWS signatures require, sorted
+// by name and value.
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const bootstrapPath = "/api/bootstrap"
+
+// bootstrapResponse holds what the frontend loads at start. Parts whose
+// sub-request failed are null, and their responses are in Errors.
+type bootstrapResponse struct {
+	Config json.RawMessage `json:"config"`
+	User   json.RawMessage `json:"user"`
+
+	// Flags holds the feature flags of the user's tenant, and Preferences
+	// those of the session's team, if one is selected.
+	Flags       map[string]bool   `json:"flags"`
+	Preferences map[string]string `json:"preferences"`
+
+	// Data holds the first page of /api/data, and DataNext the link to
+	// the next one, if any.
+	Data     json.RawMessage `json:"data"`
+	DataNext string          `json:"data_next,omitempty"`
+
+	Errors map[string]batchResponse `json:"errors,omitempty"`
+}
+
+// bootstrapHandler serves GET /api/bootstrap, which returns the config,
+// the user's profile, flags, and preferences, and the first page of data
+// in one call, rather than the frontend's waterfall of requests at start.
+// The config, profile, and data are those of their endpoints, requested as
+// the caller like the sub-requests of a batch; query parameters of the
+// bootstrap, such as limit and fields, apply to the page of data.
+type bootstrapHandler struct {
+	batch *batchHandler
+}
+
+func (b *bootstrapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result := bootstrapResponse{
+		Flags:       tenantSettingsFromContext(r.Context()).Features,
+		Preferences: map[string]string{},
+	}
+	if result.Flags == nil {
+		result.Flags = map[string]bool{}
+	}
+	if t := teamFromContext(r.Context()); t != nil {
+		result.Preferences = t.Preferences
+	}
+
+	dataPath := "/api/data"
+	if r.URL.RawQuery != "" {
+		dataPath += "?" + r.URL.RawQuery
+	}
+	for _, part := range []struct {
+		name string
+		path string
+		body *json.RawMessage
+	}{
+		{"config", "/api/config", &result.Config},
+		{"user", "/api/user", &result.User},
+		{"data", dataPath, &result.Data},
+	} {
+		rec, err := b.batch.do(w, r, batchRequest{Method: http.MethodGet, Path: part.path})
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if rec.status != http.StatusOK {
+			if result.Errors == nil {
+				result.Errors = make(map[string]batchResponse)
+			}
+			result.Errors[part.name] = batchResponse{Status: rec.status, Body: rec.jsonBody()}
+			continue
+		}
+		*part.body = rec.jsonBody()
+		if part.name == "data" {
+			result.DataNext = nextLink(rec.header)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	turnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	recaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+
+	// Bot protection checks, configurable per route.
+	botCheckCaptcha     = "captcha"
+	botCheckProofOfWork = "pow"
+
+	securityEventBot = "bot_protection"
+
+	powChallengeTTL       = 5 * time.Minute
+	defaultPoWDifficulty  = 20
+	defaultTarpitDelay    = 10 * time.Second
+	abuseWindow           = 10 * time.Minute
+	abuseFailureThreshold = 10
+	abuseFlagDuration     = time.Hour
+)
+
+// defaultSuspiciousUserAgents are user-agent substrings of scripted
+// clients, which have no business calling login endpoints.
+var defaultSuspiciousUserAgents = []string{
+	"curl/", "wget/", "python-requests", "python-urllib", "go-http-client",
+	"okhttp", "libwww-perl", "scrapy", "httpclient", "headlesschrome",
+}
+
+// defaultHoneypotPaths are paths no legitimate client of this app
+// requests, but vulnerability scanners do.
+var defaultHoneypotPaths = []string{
+	"/api/.env", "/api/wp-login.php", "/api/admin.php", "/api/.git/config",
+	"/api/phpmyadmin", "/api/config.php",
+}
+
+var (
+	errCaptchaFailed = errors.New("captcha verification failed")
+	errPoWFailed     = errors.New("proof of work verification failed")
+)
+
+// botProtection mitigates automated abuse of login-adjacent endpoints, by
+// requiring captcha or proof-of-work tokens on configured routes, rejecting
+// scripted user agents there, and tarpitting clients that hit honeypot
+// paths or repeatedly fail checks.
+type botProtection struct {
+	routes          map[string][]string
+	captchaVerifier func(ctx context.Context, token, remoteIP string) error
+	powDifficulty   int
+	tarpitDelay     time.Duration
+	userAgents      []string
+	honeypotPaths   []string
+	secureCookies   secureCookies
+	security        *securityEvents
+	logger          *zap.Logger
+	ids             idSource
+
+	// clock tells when challenges expire, and for how long clients are
+	// flagged.
+	clock clock
+
+	mu        sync.Mutex
+	clients   map[string]*clientAbuse
+	usedNonce map[string]time.Time
+}
+
+// clientAbuse tracks failed checks for a client IP.
+type clientAbuse struct {
+	failures     []time.Time
+	flaggedUntil time.Time
+}
+
+func newBotProtection(
+	config *appConfig,
+	secureCookies secureCookies,
+	security *securityEvents,
+	logger *zap.Logger,
+) *botProtection {
+	cfg := config.BotProtection
+	b := &botProtection{
+		routes:        cfg.Routes,
+		powDifficulty: cfg.ProofOfWorkDifficulty,
+		tarpitDelay:   cfg.TarpitDelay,
+		userAgents:    cfg.SuspiciousUserAgents,
+		honeypotPaths: cfg.HoneypotPaths,
+		secureCookies: secureCookies,
+		security:      security,
+		logger:        logger,
+		ids:           cryptoIDs{},
+		clock:         systemClock{},
+		clients:       make(map[string]*clientAbuse),
+		usedNonce:     make(map[string]time.Time),
+	}
+	if b.powDifficulty == 0 {
+		b.powDifficulty = defaultPoWDifficulty
+	}
+	if b.tarpitDelay == 0 {
+		b.tarpitDelay = defaultTarpitDelay
+	}
+	if b.userAgents == nil {
+		b.userAgents = defaultSuspiciousUserAgents
+	}
+	if b.honeypotPaths == nil {
+		b.honeypotPaths = defaultHoneypotPaths
+	}
+	client := newBudgetClient(http.DefaultClient.Transport, timeoutOrDefault(config.Timeouts.Captcha))
+	switch {
+	case cfg.Turnstile.SecretKey != "":
+		b.captchaVerifier = siteVerifier(client, turnstileVerifyURL, cfg.Turnstile.SecretKey, 0)
+	case cfg.Recaptcha.SecretKey != "":
+		b.captchaVerifier = siteVerifier(client, recaptchaVerifyURL, cfg.Recaptcha.SecretKey, cfg.Recaptcha.MinScore)
+	}
+	return b
+}
+
+// siteVerifier returns a function verifying captcha tokens with a
+// Turnstile- or reCAPTCHA-compatible siteverify endpoint.
+func siteVerifier(
+	client *http.Client, verifyURL, secret string, minScore float64,
+) func(context.Context, string, string) error {
+	return func(ctx context.Context, token, remoteIP string) error {
+		if token == "" {
+			return errCaptchaFailed
+		}
+		form := url.Values{"secret": {secret}, "response": {token}}
+		if remoteIP != "" {
+			form.Set("remoteip", remoteIP)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, verifyURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("captcha verification request failed: %w", err)
+		}
+		defer res.Body.Close()
+		var result struct {
+			Success bool     `json:"success"`
+			Score   *float64 `json:"score"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			return fmt.Errorf("invalid captcha verification response: %w", err)
+		}
+		if !result.Success || (result.Score != nil && *result.Score < minScore) {
+			return errCaptchaFailed
+		}
+		return nil
+	}
+}
+
+// handler wraps h with bot protection.
+func (b *botProtection) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if slices.Contains(b.honeypotPaths, r.URL.Path) {
+			b.logger.Warn("honeypot path requested", zap.String("client.ip", ip), zap.String("url.path", r.URL.Path))
+			b.security.record(r, securityEventBot, "honeypot", "")
+			b.flag(ip)
+			b.tarpit(w, r)
+			return
+		}
+		if b.flagged(ip) {
+			b.security.record(r, securityEventBot, "tarpitted", "")
+			b.tarpit(w, r)
+			return
+		}
+
+		checks, protected := b.routes[r.Method+" "+r.URL.Path]
+		if !protected {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if b.suspiciousUserAgent(r.UserAgent()) {
+			b.reject(w, r, ip, "user_agent_blocked")
+			return
+		}
+		for _, check := range checks {
+			switch check {
+			case botCheckCaptcha:
+				if b.captchaVerifier == nil {
+					continue
+				}
+				if err := b.captchaVerifier(r.Context(), r.Header.Get("X-Captcha-Token"), ip); err != nil {
+					b.logger.Info("captcha verification failed", zap.String("client.ip", ip), zap.Error(err))
+					b.reject(w, r, ip, "captcha_failed")
+					return
+				}
+			case botCheckProofOfWork:
+				if err := b.verifyProofOfWork(r.Header.Get("X-PoW-Challenge"), r.Header.Get("X-PoW-Nonce")); err != nil {
+					b.reject(w, r, ip, "pow_failed")
+					return
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (b *botProtection) suspiciousUserAgent(userAgent string) bool {
+	if userAgent == "" {
+		return true
+	}
+	userAgent = strings.ToLower(userAgent)
+	for _, s := range b.userAgents {
+		if strings.Contains(userAgent, strings.ToLower(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// reject records a failed check and responds with 403, flagging the
+// client for tarpitting if it keeps failing.
+func (b *botProtection) reject(w http.ResponseWriter, r *http.Request, ip, reason string) {
+	b.security.record(r, securityEventBot, reason, "")
+	now := b.clock.Now()
+	b.mu.Lock()
+	client := b.clients[ip]
+	if client == nil {
+		client = &clientAbuse{}
+		b.clients[ip] = client
+	}
+	cutoff := now.Add(-abuseWindow)
+	client.failures = slices.DeleteFunc(client.failures, func(t time.Time) bool { return t.Before(cutoff) })
+	client.failures = append(client.failures, now)
+	if len(client.failures) >= abuseFailureThreshold {
+		client.flaggedUntil = now.Add(abuseFlagDuration)
+	}
+	b.mu.Unlock()
+	writeError(w, r, http.StatusForbidden, "request blocked: "+reason)
+}
+
+// flag marks a client as abusive.
+func (b *botProtection) flag(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	client := b.clients[ip]
+	if client == nil {
+		client = &clientAbuse{}
+		b.clients[ip] = client
+	}
+	client.flaggedUntil = b.clock.Now().Add(abuseFlagDuration)
+}
+
+func (b *botProtection) flagged(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	// Prune stale entries opportunistically, so the map stays bounded.
+	if len(b.clients) > 10000 {
+		for k, c := range b.clients {
+			if c.flaggedUntil.Before(now) && (len(c.failures) == 0 || c.failures[len(c.failures)-1].Before(now.Add(-abuseWindow))) {
+				delete(b.clients, k)
+			}
+		}
+	}
+	client := b.clients[ip]
+	return client != nil && client.flaggedUntil.After(now)
+}
+
+// tarpit holds the connection open before responding, slowing down
+// abusive clients at little cost to the server.
+func (b *botProtection) tarpit(w http.ResponseWriter, r *http.Request) {
+	timer := time.NewTimer(b.tarpitDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(abuseFlagDuration.Seconds())))
+	writeError(w, r, http.StatusTooManyRequests, "Too Many Requests")
+}
+
+// newProofOfWorkChallenge returns a signed, expiring challenge.
+func (b *botProtection) newProofOfWorkChallenge() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := b.ids.Read(nonce); err != nil {
+		return "", err
+	}
+	expiry := b.clock.Now().Add(powChallengeTTL).Unix()
+	return b.secureCookies.Encode(hex.EncodeToString(nonce) + "." + strconv.FormatInt(expiry, 10))
+}
+
+// verifyProofOfWork checks that sha256(challenge + ":" + nonce) has at
+// least powDifficulty leading zero bits, and that the challenge is
+// authentic, unexpired, and not previously used.
+func (b *botProtection) verifyProofOfWork(challenge, nonce string) error {
+	if challenge == "" || nonce == "" {
+		return errPoWFailed
+	}
+	decoded, err := b.secureCookies.Decode(challenge)
+	if err != nil {
+		return errPoWFailed
+	}
+	_, expiryString, ok := strings.Cut(decoded, ".")
+	if !ok {
+		return errPoWFailed
+	}
+	expiry, err := strconv.ParseInt(expiryString, 10, 64)
+	if err != nil || b.clock.Now().Unix() > expiry {
+		return errPoWFailed
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) < b.powDifficulty {
+		return errPoWFailed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	for k, exp := range b.usedNonce {
+		if exp.Before(now) {
+			delete(b.usedNonce, k)
+		}
+	}
+	if _, used := b.usedNonce[challenge]; used {
+		return errPoWFailed
+	}
+	b.usedNonce[challenge] = time.Unix(expiry, 0)
+	return nil
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// powChallengeHandler serves GET /api/bot/challenge.
+func (b *botProtection) powChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	challenge, err := b.newProofOfWorkChallenge()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}{challenge, b.powDifficulty})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// brandingColorPattern matches the CSS hex colors allowed as the primary
+// color.
+var brandingColorPattern = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// brandingLink is a link shown in the footer of the frontend.
+type brandingLink struct {
+	Label string `yaml:"label" json:"label"`
+	URL   string `yaml:"url" json:"url"`
+}
+
+// branding is how the frontend presents the app, as returned by
+// /api/config.
+type branding struct {
+	AppName      string         `json:"app_name"`
+	LogoURL      string         `json:"logo_url,omitempty"`
+	PrimaryColor string         `json:"primary_color,omitempty"`
+	FooterLinks  []brandingLink `json:"footer_links"`
+}
+
+// newBranding returns the configured branding, with defaults, after
+// checking that its URLs and color are safe to render.
+func newBranding(config *appConfig) (*branding, error) {
+	b := &branding{
+		AppName:      config.Branding.AppName,
+		LogoURL:      config.Branding.LogoURL,
+		PrimaryColor: config.Branding.PrimaryColor,
+		FooterLinks:  config.Branding.FooterLinks,
+	}
+	if b.AppName == "" {
+		b.AppName = defaultAppName
+	}
+	if b.FooterLinks == nil {
+		b.FooterLinks = []brandingLink{}
+	}
+	if b.PrimaryColor != "" && !brandingColorPattern.MatchString(b.PrimaryColor) {
+		return nil, fmt.Errorf("branding.primary_color: %q is not a hex color, such as #0077cc", b.PrimaryColor)
+	}
+	if b.LogoURL != "" {
+		if err := checkBrandingURL(b.LogoURL); err != nil {
+			return nil, fmt.Errorf("branding.logo_url: %w", err)
+		}
+	}
+	for _, link := range b.FooterLinks {
+		if link.Label == "" {
+			return nil, fmt.Errorf("branding.footer_links: link to %q has no label", link.URL)
+		}
+		if err := checkBrandingURL(link.URL); err != nil {
+			return nil, fmt.Errorf("branding.footer_links: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// checkBrandingURL checks that a URL is an absolute http(s) URL, or a path
+// on the app's origin, so that it cannot run scripts when rendered.
+func checkBrandingURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	switch {
+	case u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/"):
+		return nil
+	case (u.Scheme == "https" || u.Scheme == "http") && u.Host != "":
+		return nil
+	}
+	return fmt.Errorf("%q is neither an http(s) URL nor an absolute path", raw)
+}
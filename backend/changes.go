@@ -0,0 +1,572 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	changesPath        = "/api/changes"
+	changeStreamPath   = "/api/changes/stream"
+	recordChangesIndex = "app-record-changes"
+
+	// recordActionPrefix prefixes the audit actions of changes to records,
+	// which are appended to the change feed.
+	recordActionPrefix = "record."
+
+	// changeFeedCapacity bounds the changes retained for clients to catch
+	// up with. Clients further behind reload instead.
+	changeFeedCapacity = 1000
+
+	// defaultChangesHold stays below the request timeout and the idle
+	// timeouts of common proxies.
+	defaultChangesHold = 20 * time.Second
+
+	// changeStreamKeepAlive is how often idle change streams are sent a
+	// comment.
+	changeStreamKeepAlive = 15 * time.Second
+)
+
+// recordChange is a change to a record, as listed by GET /api/changes.
+type recordChange struct {
+	Seq       int64             `json:"seq,omitempty"`
+	Timestamp time.Time         `json:"@timestamp"`
+	Action    string            `json:"action"`
+	RecordID  string            `json:"record_id"`
+	UserID    string            `json:"user_id,omitempty"`
+	Changes   map[string]string `json:"changes,omitempty"`
+}
+
+// changeFeed holds the latest changes to records, numbered in order, for
+// clients to follow. Streaming and long-polling endpoints share it,
+// waiting for changes after the sequence number they last saw, their
+// cursor.
+//
+// With Elasticsearch, changes are appended to an index with a single
+// shard, numbered by their sequence number in it, so that cursors are
+// monotonic across replicas and restarts. Replicas load changes appended
+// by others when notified through the invalidator, and clients further
+// behind than the changes in memory catch up from the index. Changes
+// appended concurrently by several replicas may become visible out of
+// order, and be missed by clients which already moved past them.
+type changeFeed struct {
+	client        *elasticsearch.Client
+	logger        *zap.Logger
+	invalidations *invalidator
+	ids           idSource
+
+	// writes serializes appends, so that changes are appended to the feed
+	// in the order they were numbered.
+	writes sync.Mutex
+
+	mu      sync.Mutex
+	changes []recordChange
+	seq     int64
+
+	// from is the sequence number after which all changes are in memory.
+	from int64
+
+	// updated is closed, and replaced, when changes are appended, and
+	// done when the backend shuts down.
+	updated chan struct{}
+	done    chan struct{}
+	closed  sync.Once
+}
+
+func newChangeFeed(client *elasticsearch.Client, logger *zap.Logger) (*changeFeed, error) {
+	f := &changeFeed{
+		client:  client,
+		logger:  logger,
+		ids:     cryptoIDs{},
+		updated: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := f.init(); err != nil {
+		return nil, fmt.Errorf("failed to init change feed: %w", err)
+	}
+	return f, nil
+}
+
+// init creates the index of changes, if needed, and loads the latest
+// changes from it.
+func (f *changeFeed) init() error {
+	if f.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initChangeFeed")
+	defer span.End()
+	logger := f.logger.With(traceLogFields(ctx)...)
+
+	res, err := f.client.Indices.Create(
+		recordChangesIndex,
+		f.client.Indices.Create.WithBody(esutil.NewJSONReader(map[string]interface{}{
+			// Sequence numbers are per shard.
+			"settings": map[string]interface{}{"number_of_shards": 1},
+			"mappings": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"@timestamp": map[string]interface{}{"type": "date"},
+					"action":     map[string]interface{}{"type": "keyword"},
+					"record_id":  map[string]interface{}{"type": "keyword"},
+					"user_id":    map[string]interface{}{"type": "keyword"},
+					"changes":    map[string]interface{}{"type": "object", "enabled": false},
+				},
+			},
+		})),
+		f.client.Indices.Create.WithContext(ctx),
+	)
+	if err != nil {
+		logger.Info("could not create change feed index", zap.Error(err))
+		return nil
+	}
+	res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusBadRequest {
+		// 400 is returned if the index already exists.
+		logger.Info("could not create change feed index", zap.String("status", res.Status()))
+		return nil
+	}
+
+	latest, err := f.search(ctx, -1, changeFeedCapacity, "desc")
+	if err != nil {
+		logger.Info("could not load changes from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	slices.Reverse(latest)
+	f.changes = latest
+	if len(latest) > 0 {
+		f.seq = latest[len(latest)-1].Seq
+		if len(latest) == changeFeedCapacity {
+			f.from = latest[0].Seq - 1
+		}
+	}
+	logger.Info("loaded changes", zap.Int("changes", len(latest)), zap.Int64("changes.seq", f.seq))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// watch loads changes appended by other replicas.
+func (f *changeFeed) watch(invalidations *invalidator) {
+	f.invalidations = invalidations
+	invalidations.subscribe(invalidateChanges, func(ctx context.Context, inv invalidation) {
+		if err := f.load(ctx); err != nil {
+			f.logger.Warn("failed to load changes", zap.Error(err))
+		}
+	})
+}
+
+// load loads the changes after the latest in memory from Elasticsearch.
+func (f *changeFeed) load(ctx context.Context) error {
+	f.mu.Lock()
+	seq := f.seq
+	f.mu.Unlock()
+	changes, err := f.search(ctx, seq, changeFeedCapacity, "asc")
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		f.insert(change)
+	}
+	return nil
+}
+
+// search returns up to size changes after seq, in the given order of
+// sequence numbers.
+func (f *changeFeed) search(ctx context.Context, seq int64, size int, order string) ([]recordChange, error) {
+	query := map[string]interface{}{"match_all": map[string]interface{}{}}
+	if seq > 0 {
+		query = map[string]interface{}{
+			"range": map[string]interface{}{"_seq_no": map[string]interface{}{"gte": seq}},
+		}
+	}
+	res, err := f.client.Search(
+		f.client.Search.WithContext(ctx),
+		f.client.Search.WithIndex(recordChangesIndex),
+		f.client.Search.WithBody(esutil.NewJSONReader(map[string]interface{}{
+			"query":               query,
+			"sort":                []interface{}{map[string]interface{}{"_seq_no": order}},
+			"seq_no_primary_term": true,
+		})),
+		f.client.Search.WithSize(size),
+		f.client.Search.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("while searching changes: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("searching changes failed: %s", res.Status())
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				SeqNo  int64        `json:"_seq_no"`
+				Source recordChange `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		return nil, err
+	}
+	changes := make([]recordChange, len(searchResult.Hits.Hits))
+	for i, hit := range searchResult.Hits.Hits {
+		changes[i] = hit.Source
+		changes[i].Seq = changeSeq(hit.SeqNo)
+	}
+	return changes, nil
+}
+
+// changeSeq returns the cursor of a change from its sequence number in
+// Elasticsearch, which starts at 0, so that cursor 0 is before the first
+// change.
+func changeSeq(seqNo int64) int64 {
+	return seqNo + 1
+}
+
+// append numbers a change and appends it to the feed, waking waiters. With
+// Elasticsearch, the change is numbered by, and waits for, its indexing,
+// and other replicas are notified of it; if it fails, the change is not
+// appended. The change's document ID is chosen up front, so that requests
+// retried after the change was indexed conflict rather than append it
+// again.
+func (f *changeFeed) append(ctx context.Context, change recordChange) (recordChange, error) {
+	f.writes.Lock()
+	defer f.writes.Unlock()
+	if f.client == nil {
+		f.mu.Lock()
+		change.Seq = f.seq + 1
+		f.mu.Unlock()
+		f.insert(change)
+		return change, nil
+	}
+
+	id := f.ids.NewID()
+	res, err := f.client.Index(
+		recordChangesIndex, esutil.NewJSONReader(change),
+		f.client.Index.WithContext(ctx),
+		f.client.Index.WithDocumentID(id),
+		f.client.Index.WithOpType("create"),
+		// Changes are searchable by other replicas once notified.
+		f.client.Index.WithRefresh("wait_for"),
+	)
+	if err != nil {
+		return change, fmt.Errorf("while appending change: %w", err)
+	}
+	defer res.Body.Close()
+	var created struct {
+		SeqNo int64 `json:"_seq_no"`
+	}
+	switch {
+	case res.StatusCode == http.StatusConflict:
+		// A retried request, after the change was indexed.
+		if created.SeqNo, err = f.seqNo(ctx, id); err != nil {
+			return change, err
+		}
+	case res.IsError():
+		return change, fmt.Errorf("appending change failed: %s", res.Status())
+	default:
+		if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+			return change, err
+		}
+	}
+	change.Seq = changeSeq(created.SeqNo)
+	f.insert(change)
+	f.invalidations.notify(ctx, invalidateChanges, strconv.FormatInt(change.Seq, 10), change.Timestamp)
+	return change, nil
+}
+
+// seqNo returns the sequence number of the change with the given
+// document ID in Elasticsearch.
+func (f *changeFeed) seqNo(ctx context.Context, id string) (int64, error) {
+	res, err := f.client.Get(recordChangesIndex, id, f.client.Get.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("while getting change %s: %w", id, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return 0, fmt.Errorf("getting change %s failed: %s", id, res.Status())
+	}
+	var doc struct {
+		SeqNo int64 `json:"_seq_no"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return 0, err
+	}
+	return doc.SeqNo, nil
+}
+
+// insert inserts a numbered change in the feed, in order, unless it is
+// already there or older than those retained, waking waiters.
+func (f *changeFeed) insert(change recordChange) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i, found := slices.BinarySearchFunc(f.changes, change.Seq, func(c recordChange, seq int64) int {
+		return cmp.Compare(c.Seq, seq)
+	})
+	if found || change.Seq <= f.from {
+		return
+	}
+	f.changes = slices.Insert(f.changes, i, change)
+	if len(f.changes) > changeFeedCapacity {
+		f.from = f.changes[0].Seq
+		f.changes = slices.Delete(f.changes, 0, 1)
+	}
+	f.seq = max(f.seq, change.Seq)
+	close(f.updated)
+	f.updated = make(chan struct{})
+}
+
+// since returns the changes after seq and the latest sequence number, with
+// a channel closed on the next change. It returns errCursorExpired if
+// changes after seq are no longer in memory, or seq is unknown, as after a
+// restart without Elasticsearch.
+func (f *changeFeed) since(seq int64) ([]recordChange, int64, <-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if seq > f.seq || seq < f.from {
+		return nil, f.seq, nil, errCursorExpired
+	}
+	i := sort.Search(len(f.changes), func(i int) bool { return f.changes[i].Seq > seq })
+	return slices.Clone(f.changes[i:]), f.seq, f.updated, nil
+}
+
+// wait returns the changes after seq, waiting for some until ctx is done or
+// the backend shuts down, and the sequence number to continue from. Clients
+// further behind than the changes in memory catch up from Elasticsearch,
+// a page at a time.
+func (f *changeFeed) wait(ctx context.Context, seq int64) ([]recordChange, int64, error) {
+	for {
+		changes, latest, updated, err := f.since(seq)
+		if errors.Is(err, errCursorExpired) && seq <= latest && f.client != nil {
+			return f.catchUp(ctx, seq)
+		}
+		if err != nil || len(changes) > 0 {
+			return changes, latest, err
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return nil, latest, nil
+		case <-f.done:
+			return nil, latest, nil
+		}
+	}
+}
+
+// catchUp returns the page of changes after seq from Elasticsearch, and the
+// sequence number of the last.
+func (f *changeFeed) catchUp(ctx context.Context, seq int64) ([]recordChange, int64, error) {
+	changes, err := f.search(ctx, seq, changeFeedCapacity, "asc")
+	if err != nil {
+		return nil, seq, err
+	}
+	if len(changes) == 0 {
+		// The changes were deleted from the index.
+		return nil, seq, errCursorExpired
+	}
+	return changes, changes[len(changes)-1].Seq, nil
+}
+
+// close releases waiters, so that connections are not held while the
+// backend drains them on shutdown.
+func (f *changeFeed) close() {
+	f.closed.Do(func() { close(f.done) })
+}
+
+// parseChangeCursor parses the cursor of a client following changes.
+func parseChangeCursor(cursor string) (int64, error) {
+	seq, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return seq, nil
+}
+
+// visibleChanges keeps the changes to records a user may read.
+func visibleChanges(changes []recordChange, shares *shareStore, a recordAccessor) []recordChange {
+	return slices.DeleteFunc(changes, func(change recordChange) bool {
+		return shares.access(change.RecordID, a) == accessNone
+	})
+}
+
+// changesHandler serves GET /api/changes, the long-polling fallback for
+// clients behind proxies which break streaming: it returns the changes to
+// records the user may read after the since cursor, holding the request
+// for up to hold until there are some. Without since, it returns the
+// current cursor at once, for clients to load records and then follow
+// changes from it. Expired cursors are rejected with 410 Gone, for clients
+// to reload.
+func changesHandler(changes *changeFeed, shares *shareStore, hold time.Duration, logger *zap.Logger) http.HandlerFunc {
+	if hold <= 0 {
+		hold = defaultChangesHold
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := struct {
+			Changes []recordChange `json:"changes"`
+			Cursor  string         `json:"cursor"`
+		}{Changes: []recordChange{}}
+
+		since := r.URL.Query().Get("since")
+		if since == "" {
+			_, latest, _, _ := changes.since(0)
+			result.Cursor = strconv.FormatInt(latest, 10)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+		seq, err := parseChangeCursor(since)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Hold the request no longer than its deadline allows.
+		wait := hold
+		if remaining, ok := remainingBudget(r.Context()); ok && remaining < wait {
+			wait = max(remaining, 0)
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		auth := authFromContext(r.Context())
+		accessor := shares.accessor(auth.userID, auth.roles)
+		for {
+			found, latest, err := changes.wait(ctx, seq)
+			switch {
+			case errors.Is(err, errCursorExpired):
+				writeError(w, r, http.StatusGone, err.Error())
+				return
+			case err != nil:
+				logger.Error("failed to load changes", append(traceLogFields(r.Context()), zap.Error(err))...)
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			result.Changes = append(result.Changes, visibleChanges(found, shares, accessor)...)
+			// Keep waiting if none of the changes are visible to the
+			// user, unless the hold is over.
+			seq = latest
+			if len(result.Changes) > 0 || len(found) == 0 || ctx.Err() != nil {
+				break
+			}
+		}
+		if r.Context().Err() != nil {
+			logger.Debug("client stopped waiting for changes", traceLogFields(r.Context())...)
+			return
+		}
+		result.Cursor = strconv.FormatInt(seq, 10)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// changeStreamHandler serves GET /api/changes/stream, which streams the
+// changes to records the user may read as server-sent events, each with
+// its cursor as ID, from the Last-Event-ID of a reconnecting EventSource,
+// the since cursor, or else the current cursor. Comments are sent every
+// keepAlive so that proxies do not close idle streams. Streams end with
+// the request timeout, or on shutdown, and EventSource reconnects from the
+// last cursor; expired cursors are rejected with 410 Gone before the
+// stream starts, for clients to reload.
+func changeStreamHandler(changes *changeFeed, shares *shareStore, keepAlive time.Duration, logger *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since := r.Header.Get("Last-Event-ID")
+		if since == "" {
+			since = r.URL.Query().Get("since")
+		}
+		_, seq, _, _ := changes.since(0)
+		if since != "" {
+			var err error
+			if seq, err = parseChangeCursor(since); err != nil {
+				writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			if _, latest, _, err := changes.since(seq); errors.Is(err, errCursorExpired) && (seq > latest || changes.client == nil) {
+				writeError(w, r, http.StatusGone, err.Error())
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		// Disable response buffering by nginx.
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		if err := rc.Flush(); err != nil {
+			logger.Warn("change stream cannot be flushed", append(traceLogFields(r.Context()), zap.Error(err))...)
+			return
+		}
+
+		auth := authFromContext(r.Context())
+		accessor := shares.accessor(auth.userID, auth.roles)
+		for r.Context().Err() == nil {
+			ctx, cancel := context.WithTimeout(r.Context(), keepAlive)
+			found, latest, err := changes.wait(ctx, seq)
+			cancel()
+			if err != nil {
+				// Ending the stream makes the client reconnect, and be
+				// told to reload if the cursor expired.
+				logger.Warn("failed to load changes", append(traceLogFields(r.Context()), zap.Error(err))...)
+				return
+			}
+			if len(found) == 0 {
+				select {
+				case <-changes.done:
+					return
+				default:
+				}
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+			sent := seq
+			for _, change := range visibleChanges(found, shares, accessor) {
+				data, _ := json.Marshal(change)
+				fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", change.Seq, data)
+				sent = change.Seq
+			}
+			if sent != latest {
+				// Move the client's cursor past changes it may not read.
+				fmt.Fprintf(w, "id: %d\n\n", latest)
+			}
+			seq = latest
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// appendEvent appends audit events of changes to records to the feed,
+// returning the numbered change and whether it was appended. It is a no-op
+// on a nil feed.
+func (f *changeFeed) appendEvent(ctx context.Context, event auditEvent) (recordChange, bool) {
+	if f == nil || !strings.HasPrefix(event.Action, recordActionPrefix) || event.RecordID == "" {
+		return recordChange{}, false
+	}
+	change, err := f.append(ctx, recordChange{
+		Timestamp: event.Timestamp,
+		Action:    event.Action,
+		RecordID:  event.RecordID,
+		UserID:    event.UserID,
+		Changes:   event.Changes,
+	})
+	if err != nil {
+		f.logger.Warn("failed to append change", zap.String("record.id", event.RecordID), zap.Error(err))
+		return change, false
+	}
+	return change, true
+}
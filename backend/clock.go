@@ -0,0 +1,18 @@
+package main
+
+import "time"
+
+// clock tells the current time. Components which expire or retain state,
+// such as sessions and cookies, take the time from an injected clock
+// rather than from time.Now, so that tests can travel in time, with
+// testsupport.Clock.
+type clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock of the system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/sync/singleflight"
+)
+
+// readCoalescer runs identical concurrent reads once, sharing the result
+// with all callers, so that many users opening the app at once trigger one
+// Elasticsearch query per distinct read rather than one each. Reads are
+// identified by name and key; the key must include the user for reads
+// whose result depends on who asks. Callers must not modify shared
+// results. A nil readCoalescer does not coalesce.
+type readCoalescer struct {
+	group    singleflight.Group
+	requests metric.Int64Counter
+}
+
+func newReadCoalescer() (*readCoalescer, error) {
+	requests, err := otel.Meter("main").Int64Counter(
+		"app.coalescing.requests",
+		metric.WithDescription("Coalescable reads, by read, and whether they ran or waited for an identical one"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &readCoalescer{requests: requests}, nil
+}
+
+// coalesce returns the result of read, run once for all concurrent callers
+// with the same name and key. The read is shared, so runs without the
+// cancellation of the first caller's context, while each caller stops
+// waiting when its own context is done.
+func coalesce[T any](
+	ctx context.Context, c *readCoalescer, name, key string, read func(context.Context) (T, error),
+) (T, error) {
+	if c == nil {
+		return read(ctx)
+	}
+	shared := context.WithoutCancel(ctx)
+	executed := false
+	results := c.group.DoChan(name+"\x00"+key, func() (interface{}, error) {
+		executed = true
+		return read(shared)
+	})
+	select {
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	case result := <-results:
+		outcome := "coalesced"
+		if executed {
+			outcome = "executed"
+		}
+		c.requests.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("coalescing.read", name),
+			attribute.String("coalescing.outcome", outcome),
+		))
+		if result.Err != nil {
+			var zero T
+			return zero, result.Err
+		}
+		return result.Val.(T), nil
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	recordCommentsIndex = "app-record-comments"
+
+	maxCommentLength = 10000
+
+	// commentModeratorRole lets users delete others' comments.
+	commentModeratorRole = "moderator"
+)
+
+var (
+	errCommentInvalid  = fmt.Errorf("comments must be 1 to %d characters", maxCommentLength)
+	errCommentNotFound = errors.New("comment not found")
+	errCommentNotOwned = errors.New("only the author or a moderator may delete a comment")
+)
+
+// comment is a comment on a record. Its body is rich text, sanitized when
+// saved. Deleted comments are kept, with DeletedAt set, so that deletions
+// can be audited.
+type comment struct {
+	ID         string     `json:"id"`
+	RecordID   string     `json:"record_id"`
+	AuthorID   string     `json:"author_id"`
+	AuthorName string     `json:"author_name"`
+	Body       string     `json:"body" sanitize:"html"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy  string     `json:"deleted_by,omitempty"`
+}
+
+// commentSortKey orders comments by creation, with ties broken by ID.
+func commentSortKey(c *comment) string {
+	return c.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000000") + "/" + c.ID
+}
+
+// commentStore manages comments on records, persisted to Elasticsearch if
+// configured, in an index of their own.
+type commentStore struct {
+	client    *elasticsearch.Client
+	sanitizer *htmlSanitizer
+	logger    *zap.Logger
+	ids       idSource
+
+	mu sync.RWMutex
+
+	// comments maps record IDs to their comments, oldest first.
+	comments map[string][]*comment
+}
+
+func newCommentStore(client *elasticsearch.Client, sanitizer *htmlSanitizer, logger *zap.Logger) (*commentStore, error) {
+	s := &commentStore{
+		client:    client,
+		sanitizer: sanitizer,
+		logger:    logger,
+		ids:       cryptoIDs{},
+		comments:  make(map[string][]*comment),
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init comment store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing comments from Elasticsearch.
+func (s *commentStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initCommentStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(recordCommentsIndex),
+		s.client.Search.WithSize(10000),
+	)
+	if err != nil {
+		logger.Info("could not load comments from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.Info("could not load comments from Elasticsearch", zap.String("status", res.Status()))
+		return nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source comment `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	for i := range searchResult.Hits.Hits {
+		c := &searchResult.Hits.Hits[i].Source
+		s.comments[c.RecordID] = append(s.comments[c.RecordID], c)
+	}
+	for _, comments := range s.comments {
+		sort.Slice(comments, func(i, j int) bool { return commentSortKey(comments[i]) < commentSortKey(comments[j]) })
+	}
+
+	logger.Info("loaded comments", zap.Int("records", len(s.comments)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// list returns the comments on a record that have not been deleted,
+// oldest first.
+func (s *commentStore) list(recordID string) []*comment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := []*comment{}
+	for _, c := range s.comments[recordID] {
+		if c.DeletedAt == nil {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// add adds a comment by the given user to a record.
+func (s *commentStore) add(ctx context.Context, recordID string, author *authDetails, body string) (*comment, error) {
+	c := &comment{
+		ID:         s.ids.NewID(),
+		RecordID:   recordID,
+		AuthorID:   author.userID,
+		AuthorName: author.name,
+		Body:       body,
+		CreatedAt:  time.Now().UTC(),
+	}
+	s.sanitizer.sanitizeFields(c)
+	c.Body = strings.TrimSpace(c.Body)
+	if c.Body == "" || utf8.RuneCountInString(c.Body) > maxCommentLength {
+		return nil, errCommentInvalid
+	}
+	s.mu.Lock()
+	s.comments[recordID] = append(s.comments[recordID], c)
+	s.mu.Unlock()
+	return c, s.persist(ctx, c)
+}
+
+// delete soft-deletes a comment, which only its author or a moderator
+// may do.
+func (s *commentStore) delete(ctx context.Context, recordID, commentID string, user *authDetails) error {
+	s.mu.Lock()
+	var deleted *comment
+	for i, c := range s.comments[recordID] {
+		if c.ID != commentID || c.DeletedAt != nil {
+			continue
+		}
+		if c.AuthorID != user.userID && !user.hasRole(commentModeratorRole) {
+			s.mu.Unlock()
+			return errCommentNotOwned
+		}
+		now := time.Now().UTC()
+		copied := *c
+		copied.DeletedAt, copied.DeletedBy = &now, user.userID
+		s.comments[recordID][i] = &copied
+		deleted = &copied
+		break
+	}
+	s.mu.Unlock()
+	if deleted == nil {
+		return errCommentNotFound
+	}
+	return s.persist(ctx, deleted)
+}
+
+// persist indexes a comment, if Elasticsearch is configured.
+func (s *commentStore) persist(ctx context.Context, c *comment) error {
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Index(
+		recordCommentsIndex, esutil.NewJSONReader(c),
+		s.client.Index.WithDocumentID(c.ID),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving comment: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving comment failed: %s", res.Status())
+	}
+	return nil
+}
+
+// registerCommentRoutes registers the comments sub-resource of records.
+func registerCommentRoutes(
+	routes *routeRegistry,
+	comments *commentStore,
+	records *recordStore,
+	cursors *cursorCodec,
+	logger *zap.Logger,
+) {
+	user := routes.group(groupUser)
+
+	// withRecord rejects requests for unknown records.
+	withRecord := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !records.exists(r.PathValue("id")) {
+				writeError(w, r, http.StatusNotFound, errUnknownRecord.Error())
+				return
+			}
+			h(w, r)
+		}
+	}
+
+	user.GET("/api/records/{id}/comments", withRecord(func(w http.ResponseWriter, r *http.Request) {
+		recordID := r.PathValue("id")
+		fields, err := parseFields[comment](r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		page, err := paginate(w, r, cursors, "comments:"+recordID, comments.list(recordID), commentSortKey)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		projected, err := fields.project(page)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Comments any `json:"comments"`
+		}{projected})
+	}))
+
+	user.POST("/api/records/{id}/comments", withRecord(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Body string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		c, err := comments.add(r.Context(), r.PathValue("id"), authFromContext(r.Context()), req.Body)
+		if errors.Is(err, errCommentInvalid) {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		} else if err != nil {
+			logger.Error("failed to save comment", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+	}))
+
+	user.DELETE("/api/records/{id}/comments/{comment_id}", withRecord(func(w http.ResponseWriter, r *http.Request) {
+		err := comments.delete(r.Context(), r.PathValue("id"), r.PathValue("comment_id"), authFromContext(r.Context()))
+		switch {
+		case errors.Is(err, errCommentNotFound):
+			writeError(w, r, http.StatusNotFound, err.Error())
+		case errors.Is(err, errCommentNotOwned):
+			writeError(w, r, http.StatusForbidden, err.Error())
+		case err != nil:
+			logger.Error("failed to delete comment", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
@@ -4,8 +4,15 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
+	"app-backend/blobstore"
+	"app-backend/kms"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
 	"gopkg.in/yaml.v3"
 )
 
@@ -22,45 +29,935 @@ type appConfig struct {
 	// enabling key rotation.
 	EncryptionKeys []string `yaml:"encryption_keys"`
 
+	// KMS configures a key management service wrapping the encryption
+	// keys, which then replace EncryptionKeys, so that raw key material
+	// is not held in configuration.
+	KMS kms.Config `yaml:"kms"`
+
 	Elasticsearch struct {
 		URL    string `yaml:"url"`
 		APIKey string `yaml:"api_key"`
+
+		// TokenFile authenticates with the JWT in this file rather than
+		// an API key, with Elasticsearch's JWT realm, such as a projected
+		// Kubernetes service account token. The file is read again as it
+		// is rotated.
+		TokenFile string `yaml:"token_file"`
+
+		// SharedSecret authenticates the backend as a client of the JWT
+		// realm, if it requires it.
+		SharedSecret string `yaml:"shared_secret"`
+
+		// SlowThreshold is the duration above which requests to
+		// Elasticsearch are logged as slow, or 0 to not log them.
+		SlowThreshold time.Duration `yaml:"slow_threshold"`
 	} `yaml:"elasticsearch"`
 
+	// Timeouts bound the handling of requests, and calls to each
+	// dependency, so that slow upstreams cannot pin goroutines. Calls to
+	// dependencies are further bounded by the remaining time of the
+	// request making them.
+	Timeouts struct {
+		// Request bounds the handling of each request. Defaults to 30s.
+		Request time.Duration `yaml:"request"`
+
+		// Elasticsearch, OAuth, Captcha, and LDAP bound each call to
+		// those dependencies. They default to 10s.
+		Elasticsearch time.Duration `yaml:"elasticsearch"`
+		OAuth         time.Duration `yaml:"oauth"`
+		Captcha       time.Duration `yaml:"captcha"`
+		LDAP          time.Duration `yaml:"ldap"`
+	} `yaml:"timeouts"`
+
+	// Egress restricts outbound HTTP requests to allowed hosts. Google
+	// endpoints, captcha verification, Microsoft and Apple endpoints if
+	// their sign-in is enabled, and the hosts of Elasticsearch, the OTLP
+	// collector, the OIDC issuer, and other configured URLs are always
+	// allowed.
+	Egress struct {
+		// AllowedHosts lists further allowed hosts. Entries prefixed with
+		// "*." allow all subdomains.
+		AllowedHosts []string `yaml:"allowed_hosts"`
+
+		// ReportOnly logs requests to other hosts, without blocking them.
+		ReportOnly bool `yaml:"report_only"`
+	} `yaml:"egress"`
+
+	// Retry configures retries of calls to Elasticsearch, OAuth token
+	// exchanges, and JWKS fetches.
+	Retry retryPolicy `yaml:"retry"`
+
+	// HTTPCache configures the in-memory cache of outbound GET requests to
+	// identity providers, such as for their signing keys, which follows the
+	// responses' Cache-Control and validator headers.
+	HTTPCache struct {
+		// Disabled turns the cache off.
+		Disabled bool `yaml:"disabled"`
+
+		// MaxEntries bounds the cached responses. Defaults to 1000.
+		MaxEntries int `yaml:"max_entries"`
+	} `yaml:"http_cache"`
+
+	// WarmUp configures the priming of caches and connection pools at
+	// startup, before GET /api/ready reports the backend ready.
+	WarmUp struct {
+		// Timeout bounds warming up, after which the backend reports ready
+		// regardless. Defaults to 30s.
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"warm_up"`
+
+	// Tracing configures where traces are exported.
+	Tracing struct {
+		// Exporter is "otlp" (default) to export traces to the APM server,
+		// or another OTLP endpoint, as set by OTEL_EXPORTER_OTLP_ENDPOINT
+		// or ELASTIC_APM_SERVER_URL. In development, "stdout" or "file"
+		// print them, pretty-printed, instead.
+		Exporter string `yaml:"exporter"`
+
+		// File is the file traces are appended to by the file exporter.
+		// Defaults to traces.json.
+		File string `yaml:"file"`
+	} `yaml:"tracing"`
+
+	// Metrics configures the export of metrics, including runtime metrics
+	// such as GC pauses, heap size, and goroutine counts, to the same OTLP
+	// endpoint as traces. Metrics are not exported along with traces by
+	// the development exporters. They are also served to Prometheus at
+	// /metrics, to admins.
+	Metrics struct {
+		Disabled bool `yaml:"disabled"`
+
+		// Interval is how often metrics are exported. Defaults to 1m.
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"metrics"`
+
+	// Logging bounds the volume of logs, e.g. while a dependency is down
+	// and every request logs the same error.
+	Logging struct {
+		// Sampling samples repeated messages below the error level: of
+		// the messages with the same level and text, the first Initial
+		// per second are logged, then every Thereafter-th. Both default
+		// to 100.
+		Sampling struct {
+			Disabled   bool `yaml:"disabled"`
+			Initial    int  `yaml:"initial"`
+			Thereafter int  `yaml:"thereafter"`
+		} `yaml:"sampling"`
+
+		// ErrorLimit limits repeated error messages: of the errors with
+		// the same text, at most Burst are logged per Interval, and the
+		// next one logged reports how many were suppressed. Burst
+		// defaults to 10, Interval to 1m.
+		ErrorLimit struct {
+			Disabled bool          `yaml:"disabled"`
+			Interval time.Duration `yaml:"interval"`
+			Burst    int           `yaml:"burst"`
+		} `yaml:"error_limit"`
+	} `yaml:"logging"`
+
+	// Invalidation configures the propagation of session revocations, OAuth
+	// tokens, and MFA enrollments, which each replica keeps in memory,
+	// between replicas, through a change log in Elasticsearch.
+	Invalidation struct {
+		// Disabled turns propagation off, e.g. for a single replica.
+		Disabled bool `yaml:"disabled"`
+
+		// Interval is how often the change log is polled. Defaults to 2s.
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"invalidation"`
+
+	// Locale configures the locale and time zone of requests which do not
+	// specify theirs, with the tz and locale query parameters, the
+	// X-Timezone and Accept-Language headers, or the timezone and locale
+	// preferences of the session's team.
+	Locale struct {
+		// Default is a BCP 47 language tag. Defaults to "en".
+		Default string `yaml:"default"`
+
+		// Timezone is an IANA time zone name. Defaults to UTC.
+		Timezone string `yaml:"timezone"`
+	} `yaml:"locale"`
+
+	// Branding configures how the frontend presents the app, returned by
+	// /api/config, so that deployments can be white-labeled without
+	// changing the frontend.
+	Branding struct {
+		// AppName defaults to "App Scaffold".
+		AppName string `yaml:"app_name"`
+
+		// LogoURL is an http(s) URL, or a path on the app's origin.
+		LogoURL string `yaml:"logo_url"`
+
+		// PrimaryColor is a CSS hex color, such as "#0077cc".
+		PrimaryColor string `yaml:"primary_color"`
+
+		// FooterLinks may only be set in the config file.
+		FooterLinks []brandingLink `yaml:"footer_links"`
+	} `yaml:"branding"`
+
+	// Features holds feature flags, by name, which tenants may override
+	// with the /api/admin/tenants endpoints.
+	Features map[string]bool `yaml:"features"`
+
+	// Changes configures GET /api/changes, which long-polls for changes
+	// to records.
+	Changes struct {
+		// Hold is how long requests are held waiting for changes,
+		// bounded by the request timeout. Defaults to 20s.
+		Hold time.Duration `yaml:"hold"`
+	} `yaml:"changes"`
+
+	// Server configures the listener of the backend. When started by
+	// systemd socket activation, the backend serves on the socket it is
+	// passed instead.
+	Server struct {
+		// Addr is the address to listen on. Defaults to ":4000".
+		Addr string `yaml:"addr"`
+
+		// ReusePort sets SO_REUSEPORT on the listener, so that a new
+		// version of the backend can bind the port while the previous
+		// one is still serving, during rolling restarts.
+		ReusePort bool `yaml:"reuse_port"`
+
+		// DrainTimeout is how long the backend waits, on SIGTERM or
+		// interrupt, for in-flight requests to complete before closing
+		// their connections. Defaults to 20s.
+		DrainTimeout time.Duration `yaml:"drain_timeout"`
+
+		// TerminationGracePeriod is how long the orchestrator waits after
+		// SIGTERM before killing the backend, such as the
+		// terminationGracePeriodSeconds of its pod. The drain timeout
+		// defaults to what it leaves after flushing.
+		TerminationGracePeriod time.Duration `yaml:"termination_grace_period"`
+
+		// TLS serves HTTPS with the certificate and key in these PEM
+		// files, rather than HTTP behind a proxy terminating TLS.
+		TLS struct {
+			CertFile string `yaml:"cert_file"`
+			KeyFile  string `yaml:"key_file"`
+		} `yaml:"tls"`
+
+		// TrustedProxies are the addresses and CIDR ranges of the
+		// reverse proxies in front of the backend, whose X-Forwarded-For
+		// tells the address of clients, for bot protection, security
+		// events, and session binding. Without them, the address of
+		// clients is that of their connection.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+
+		// StaticDir is a build of the frontend, served on paths other
+		// than those of the API, as the proxy and nginx do when they are
+		// deployed apart. Backends built with -tags standalone serve the
+		// build embedded in them unless set.
+		StaticDir string `yaml:"static_dir"`
+	} `yaml:"server"`
+
+	// API configures the format of responses.
+	API struct {
+		// Envelope wraps JSON responses in an object, as some frontends
+		// expect: {"data": ..., "meta": {...}, "errors": [...]}, with
+		// the response in data, its trace ID and the link to the next
+		// page of lists in meta, and errors, including those otherwise
+		// written as text, in errors.
+		Envelope bool `yaml:"envelope"`
+
+		// ConfigMaxAge is how long browsers and proxies may use
+		// /api/config before revalidating it with its ETag, which
+		// changes with the config and the build. Defaults to 5m.
+		ConfigMaxAge time.Duration `yaml:"config_max_age"`
+	} `yaml:"api"`
+
 	Google struct {
 		ClientID     string `yaml:"client_id"`
 		ClientSecret string `yaml:"client_secret"`
+
+		// Endpoints optionally replace Google's endpoints with those of
+		// a mock identity provider, for development and end-to-end
+		// tests. Each defaults to Google's.
+		Endpoints struct {
+			AuthURL   string `yaml:"auth_url"`
+			TokenURL  string `yaml:"token_url"`
+			JWKSURL   string `yaml:"jwks_url"`
+			RevokeURL string `yaml:"revoke_url"`
+		} `yaml:"endpoints"`
+
+		// RevokeOnLogout revokes users' Google tokens when they log out
+		// with POST /api/logout, so that the app loses access to their
+		// Google data until they sign in and consent again.
+		RevokeOnLogout bool `yaml:"revoke_on_logout"`
 	} `yaml:"google"`
+
+	// Microsoft optionally enables signing in with Microsoft Entra ID
+	// (Azure AD), alongside Google. Requires encryption_keys, since
+	// Microsoft users are issued session tokens signed by the backend.
+	Microsoft struct {
+		ClientID     string `yaml:"client_id"`
+		ClientSecret string `yaml:"client_secret"`
+
+		// Tenant is the ID of the tenant users sign in from, or
+		// "organizations" for any work or school account, "consumers"
+		// for personal accounts, or "common" for both. Defaults to
+		// "organizations". Users' email addresses, which their tenant
+		// sets, grant roles and invitations only with a single tenant
+		// or AllowedTenants.
+		Tenant string `yaml:"tenant"`
+
+		// AllowedTenants optionally restricts sign-in through a
+		// multi-tenant Tenant to these tenant IDs, whose users' email
+		// addresses are then trusted.
+		AllowedTenants []string `yaml:"allowed_tenants"`
+	} `yaml:"microsoft"`
+
+	// Apple optionally enables Sign in with Apple, alongside Google.
+	// Requires encryption_keys, like Microsoft sign-in.
+	Apple struct {
+		// ClientID is the Services ID identifying the website.
+		ClientID string `yaml:"client_id"`
+		TeamID   string `yaml:"team_id"`
+
+		// KeyID identifies the Sign in with Apple private key, and
+		// PrivateKey holds it, PEM-encoded as downloaded from Apple.
+		// Client secrets are generated from it as needed.
+		KeyID      string `yaml:"key_id"`
+		PrivateKey string `yaml:"private_key"`
+	} `yaml:"apple"`
+
+	// Guest optionally lets visitors use the app without signing in,
+	// with read-only access to selected endpoints, e.g. for public demos.
+	// Requires encryption_keys, since guests are issued session tokens
+	// signed by the backend.
+	Guest struct {
+		Enabled bool `yaml:"enabled"`
+
+		// Endpoints lists the paths, as registered, guests may GET.
+		// Defaults to /api/data.
+		Endpoints []string `yaml:"endpoints"`
+	} `yaml:"guest"`
+
+	// Workflow configures the statuses records move through.
+	Workflow struct {
+		// Transitions maps each status to the statuses records may
+		// move to from it. Defaults to a workflow of the sample
+		// statuses.
+		Transitions map[string][]string `yaml:"transitions"`
+	} `yaml:"workflow"`
+
+	// Webhooks configures the URLs audit events, such as workflow
+	// transitions, are posted to.
+	Webhooks struct {
+		URLs []string `yaml:"urls"`
+
+		// Secret optionally keys the HMAC-SHA256 signature of events,
+		// sent in the X-Webhook-Signature header.
+		Secret string `yaml:"secret"`
+	} `yaml:"webhooks"`
+
+	// RichText configures the HTML allowed in rich-text fields, such as
+	// comment bodies. Everything else is stripped when they are saved.
+	RichText struct {
+		// Elements lists the allowed elements. Defaults to those of
+		// bluemonday's user-generated content policy, when empty.
+		Elements []string `yaml:"elements"`
+
+		// Attributes lists the attributes allowed on the elements.
+		Attributes []string `yaml:"attributes"`
+
+		// URLSchemes lists the schemes allowed in URLs, such as of links,
+		// besides http, https, and mailto.
+		URLSchemes []string `yaml:"url_schemes"`
+	} `yaml:"rich_text"`
+
+	// Blobstore configures where files, such as attachments and report
+	// snapshots, are stored: on local disk, or in S3, GCS, or Azure.
+	Blobstore blobstore.Config `yaml:"blobstore"`
+
+	// Profiling configures the periodic capture of CPU and heap profiles
+	// into the blob store, under profiles/, for investigating performance
+	// after the fact.
+	Profiling struct {
+		Enabled bool `yaml:"enabled"`
+
+		// Interval is how often profiles are captured. Defaults to 5m.
+		Interval time.Duration `yaml:"interval"`
+
+		// CPUDuration is how long the CPU is profiled. Defaults to 10s.
+		CPUDuration time.Duration `yaml:"cpu_duration"`
+
+		// Retention is how long profiles are kept. Defaults to 72h.
+		Retention time.Duration `yaml:"retention"`
+
+		// MinGoroutines skips captures while fewer goroutines are
+		// running, so that idle replicas do not store profiles. Each
+		// open connection runs a goroutine.
+		MinGoroutines int `yaml:"min_goroutines"`
+	} `yaml:"profiling"`
+
+	// Attachments configures the files attached to records.
+	Attachments struct {
+		// MaxSize is the maximum size of attachments, in bytes. Defaults to
+		// 10 MiB.
+		MaxSize int64 `yaml:"max_size"`
+
+		// Scan configures the scanning of uploads for malware, with a ClamAV
+		// daemon or an external scanning API. Uploads are not scanned if
+		// neither is set. Flagged uploads are rejected and quarantined.
+		Scan struct {
+			// ClamAV is the address of clamd, as "unix:/path/to/clamd.sock"
+			// or host:port.
+			ClamAV string `yaml:"clamav"`
+
+			// URL is the endpoint of a scanning API, which is posted the
+			// content, and responds like {"infected": bool, "signature": ""}.
+			URL string `yaml:"url"`
+
+			// Timeout bounds scans. Defaults to 30s.
+			Timeout time.Duration `yaml:"timeout"`
+
+			// FailOpen accepts uploads, marked unscanned, when the scanner
+			// fails. By default they are rejected.
+			FailOpen bool `yaml:"fail_open"`
+		} `yaml:"scan"`
+	} `yaml:"attachments"`
+
+	// Uploads configures resumable uploads, with which large files are
+	// uploaded in chunks, resuming after interruptions.
+	Uploads struct {
+		// MaxSize is the maximum size of uploads, in bytes. Defaults to
+		// 1 GiB. Uploads consumed as attachments are also limited by
+		// attachments.max_size.
+		MaxSize int64 `yaml:"max_size"`
+
+		// TTL is how long upload sessions are kept after their last chunk.
+		// Defaults to 24h.
+		TTL time.Duration `yaml:"ttl"`
+	} `yaml:"uploads"`
+
+	// Downloads configures downloads of attachments and report snapshots.
+	Downloads struct {
+		// BytesPerSecond limits the bandwidth of each download, so that a
+		// single large download cannot saturate the backend or a proxy.
+		// Unlimited if 0.
+		BytesPerSecond int64 `yaml:"bytes_per_second"`
+	} `yaml:"downloads"`
+
+	// OAuth configures OAuth 2.0 authorization flows.
+	OAuth struct {
+		// ServerSideState keeps OAuth state data server-side, in
+		// Elasticsearch when configured, rather than in the state cookie.
+		// Server-side states expire after 10 minutes and may be used only
+		// once.
+		ServerSideState bool `yaml:"server_side_state"`
+	} `yaml:"oauth"`
+
+	// OIDC holds settings for propagating logout to the identity provider,
+	// and optionally enables signing in with a generic OpenID Connect
+	// provider, such as Okta, Auth0, Keycloak, or Azure AD, alongside
+	// Google.
+	OIDC struct {
+		// Issuer is matched against the "iss" parameter of front-channel
+		// logout requests. Defaults to Google's issuer. With ClientID set,
+		// it is also the URL of the provider, whose endpoints are read
+		// from its discovery document at start.
+		Issuer string `yaml:"issuer"`
+
+		// ClientID enables sign-in with the provider at Issuer. Like
+		// Microsoft sign-in, it requires encryption_keys.
+		ClientID     string `yaml:"client_id"`
+		ClientSecret string `yaml:"client_secret"`
+
+		// Scopes are requested on sign-in, with "openid" always
+		// included. Defaults to "openid email profile"; add
+		// "offline_access" for refresh tokens where providers require
+		// it.
+		Scopes []string `yaml:"scopes"`
+
+		// Name is shown to users on the sign-in button. Defaults to
+		// "Single sign-on".
+		Name string `yaml:"name"`
+
+		// EndSessionEndpoint is the IdP's end_session_endpoint, to which
+		// users are redirected on logout. Defaults to the one in the
+		// discovery document of the provider at Issuer, if ClientID is
+		// set. If neither, only the local session is terminated.
+		EndSessionEndpoint string `yaml:"end_session_endpoint"`
+
+		// PostLogoutRedirectURL is where the IdP (or the backend, if no
+		// end_session_endpoint is configured) sends users after logout.
+		PostLogoutRedirectURL string `yaml:"post_logout_redirect_url"`
+	} `yaml:"oidc"`
+
+	// AuthCache configures the cache of verified credentials, which saves
+	// verifying the signature of a session's ID token on every request.
+	AuthCache struct {
+		Disabled bool `yaml:"disabled"`
+
+		// TTL is how long verified credentials are cached. Defaults to
+		// 30s. Revoked sessions are rejected regardless.
+		TTL time.Duration `yaml:"ttl"`
+	} `yaml:"auth_cache"`
+
+	// Profiles configures the cache of profiles of users signed in with
+	// providers whose profile data requires an API call, such as Microsoft
+	// Graph.
+	Profiles struct {
+		// TTL is how long profiles are used before being refetched, in
+		// the background. Defaults to 15m.
+		TTL time.Duration `yaml:"ttl"`
+
+		// MaxStale is how long profiles are used while they cannot be
+		// refetched. Defaults to 24h.
+		MaxStale time.Duration `yaml:"max_stale"`
+	} `yaml:"profiles"`
+
+	// StepUp configures re-authentication requirements for sensitive
+	// endpoints.
+	StepUp struct {
+		// MaxAge is the maximum time since the user last signed in
+		// for sensitive operations to be allowed. Defaults to 5m.
+		MaxAge time.Duration `yaml:"max_age"`
+	} `yaml:"step_up"`
+
+	// MFA configures TOTP second-factor authentication.
+	MFA struct {
+		// Issuer is shown in authenticator apps. Defaults to the app name.
+		Issuer string `yaml:"issuer"`
+
+		// Required makes a second factor mandatory for all users,
+		// rather than only for those who have enrolled one.
+		Required bool `yaml:"required"`
+	} `yaml:"mfa"`
+
+	// SessionBinding binds sessions to characteristics of the client they
+	// were started from, rejecting credentials cookies replayed from a very
+	// different client. Sessions are not bound unless one is set.
+	SessionBinding struct {
+		// UserAgent binds sessions to the browser's User-Agent, ignoring
+		// version numbers.
+		UserAgent bool `yaml:"user_agent"`
+
+		// IPv4Prefix and IPv6Prefix bind sessions to the network of the
+		// client's address, of the given prefix length: the shorter, the
+		// more lenient with clients moving between addresses.
+		IPv4Prefix int `yaml:"ipv4_prefix"`
+		IPv6Prefix int `yaml:"ipv6_prefix"`
+	} `yaml:"session_binding"`
+
+	// WebAuthn configures the relying party for passkey support.
+	WebAuthn struct {
+		// RPID is the relying party ID: the site's domain, without
+		// scheme or port. Defaults to localhost.
+		RPID string `yaml:"rp_id"`
+
+		// RPDisplayName defaults to the MFA issuer.
+		RPDisplayName string `yaml:"rp_display_name"`
+
+		// RPOrigins lists the allowed origins. Defaults to
+		// https://localhost:8443, for the dev proxy.
+		RPOrigins []string `yaml:"rp_origins"`
+	} `yaml:"webauthn"`
+
+	// Roles maps application role names to the email addresses of
+	// users granted that role.
+	Roles map[string][]string `yaml:"roles"`
+
+	// SCIM configures the SCIM 2.0 provisioning endpoints.
+	SCIM struct {
+		// Token is the bearer token identity providers must present.
+		// SCIM endpoints reject all requests when it is empty.
+		Token string `yaml:"token"`
+	} `yaml:"scim"`
+
+	// LDAP optionally configures a directory from which group
+	// memberships are synchronized into application roles.
+	LDAP struct {
+		// URL of the directory server, e.g. ldaps://ad.example.com:636.
+		// LDAP synchronization is disabled when empty.
+		URL          string `yaml:"url"`
+		BindDN       string `yaml:"bind_dn"`
+		BindPassword string `yaml:"bind_password"`
+		BaseDN       string `yaml:"base_dn"`
+
+		// UserFilter is the search filter used to locate a user entry,
+		// with %s substituted by the (escaped) email address.
+		// Defaults to (&(objectClass=user)(mail=%s)).
+		UserFilter string `yaml:"user_filter"`
+
+		// GroupAttribute is the user entry attribute listing group DNs.
+		// Defaults to memberOf.
+		GroupAttribute string `yaml:"group_attribute"`
+
+		// GroupRoles maps group DNs to the application roles they grant.
+		GroupRoles map[string][]string `yaml:"group_roles"`
+
+		// RefreshInterval controls how long synchronized memberships
+		// are cached before being looked up again. Defaults to 15m.
+		RefreshInterval time.Duration `yaml:"refresh_interval"`
+	} `yaml:"ldap"`
+
+	// BotProtection configures mitigation of automated abuse of
+	// login-adjacent endpoints.
+	BotProtection struct {
+		// Routes maps routes, as "METHOD /path", to the checks required
+		// on them: "captcha" and/or "pow" (proof of work). Scripted user
+		// agents are rejected on all listed routes.
+		Routes map[string][]string `yaml:"routes"`
+
+		// Turnstile and Recaptcha configure captcha token verification.
+		// Turnstile takes precedence if both are set; captcha checks
+		// are skipped if neither is.
+		Turnstile struct {
+			SiteKey   string `yaml:"site_key"`
+			SecretKey string `yaml:"secret_key"`
+		} `yaml:"turnstile"`
+		Recaptcha struct {
+			SiteKey   string `yaml:"site_key"`
+			SecretKey string `yaml:"secret_key"`
+
+			// MinScore is the minimum reCAPTCHA v3 score accepted.
+			MinScore float64 `yaml:"min_score"`
+		} `yaml:"recaptcha"`
+
+		// ProofOfWorkDifficulty is the number of leading zero bits
+		// required of proof-of-work hashes. Defaults to 20.
+		ProofOfWorkDifficulty int `yaml:"proof_of_work_difficulty"`
+
+		// SuspiciousUserAgents lists user-agent substrings rejected on
+		// protected routes. Defaults to common HTTP libraries and tools.
+		SuspiciousUserAgents []string `yaml:"suspicious_user_agents"`
+
+		// HoneypotPaths lists paths which flag clients requesting them
+		// as abusive. Defaults to common vulnerability scanner targets.
+		HoneypotPaths []string `yaml:"honeypot_paths"`
+
+		// TarpitDelay is how long responses to abusive clients are
+		// delayed. Defaults to 10s.
+		TarpitDelay time.Duration `yaml:"tarpit_delay"`
+	} `yaml:"bot_protection"`
+
+	// FaultInjection configures chaos testing, for development only:
+	// injecting latency, errors, and dropped connections into requests.
+	FaultInjection struct {
+		Enabled bool `yaml:"enabled"`
+
+		// Routes maps routes, as "METHOD /path", to the faults injected.
+		// Keys ending in "*" match by prefix, so "*" matches all routes.
+		Routes map[string]faultRule `yaml:"routes"`
+	} `yaml:"fault_injection"`
+
+	// Debug configures debugging aids, for development only.
+	Debug struct {
+		// CaptureRequests records sanitized request/response pairs,
+		// downloadable as a HAR file from /api/admin/debug/har.
+		CaptureRequests bool `yaml:"capture_requests"`
+
+		// CaptureCapacity is the number of most recent requests kept.
+		// Defaults to 200.
+		CaptureCapacity int `yaml:"capture_capacity"`
+
+		// CaptureMaxBodyBytes limits the captured size of each request
+		// and response body. Defaults to 64 KiB.
+		CaptureMaxBodyBytes int64 `yaml:"capture_max_body_bytes"`
+
+		// ValidateOpenAPI checks requests and responses against the
+		// served OpenAPI spec, logging mismatches and flagging them with
+		// an X-OpenAPI-Mismatch response header.
+		ValidateOpenAPI bool `yaml:"validate_openapi"`
+	} `yaml:"debug"`
+
+	// Deprecations marks API endpoints, keyed by route pattern, such as
+	// "DELETE /api/reports/{id}", as deprecated, adding Deprecation,
+	// Sunset, and Link headers to their responses.
+	Deprecations map[string]routeDeprecation `yaml:"deprecations"`
+
+	// SLO configures service level objectives of route groups, whose
+	// error budget burn rates are reported by /api/admin/slo.
+	SLO struct {
+		// Objectives maps objective names to their definitions.
+		Objectives map[string]sloObjective `yaml:"objectives"`
+
+		// AlertURLs are the webhooks posted an alert when an objective
+		// starts or stops burning its error budget too fast, signed like
+		// other webhooks.
+		AlertURLs []string `yaml:"alert_urls"`
+	} `yaml:"slo"`
+
+	// Policies configures the optional policy engine, authorizing
+	// requests of signed-in users with CEL expressions beyond roles.
+	Policies struct {
+		// Dir holds the policy files, *.yaml. Empty disables the engine.
+		Dir string `yaml:"dir"`
+
+		// ReloadInterval is how often the policy files are checked for
+		// changes. Defaults to 10s.
+		ReloadInterval time.Duration `yaml:"reload_interval"`
+
+		// LogDecisions records allowed requests in the audit log too, not
+		// only denied ones.
+		LogDecisions bool `yaml:"log_decisions"`
+	} `yaml:"policies"`
+
+	// Invitations configures invitations of users to teams, which require
+	// encryption_keys to sign their links.
+	Invitations struct {
+		// BaseURL is the URL the application is served at, which
+		// invitation links are relative to.
+		BaseURL string `yaml:"base_url"`
+
+		// TTL is how long invitations may be accepted. Defaults to 7 days.
+		TTL time.Duration `yaml:"ttl"`
+
+		// SMTP configures the mail server invitations are sent through.
+		// Without Addr, invitation links are only returned to the admin
+		// creating them, to pass on.
+		SMTP smtpSettings `yaml:"smtp"`
+	} `yaml:"invitations"`
+
+	// Middleware configures the middleware pipelines of route groups.
+	Middleware struct {
+		// Groups maps route groups (public, signed_in, user, admin, and
+		// scim) to the names of the middlewares applied to their routes,
+		// outermost first, overriding the defaults. Available middlewares
+		// are auth, mfa, tenant, team, locale, policy, sharing,
+		// admin_auth, and scim_auth.
+		Groups map[string][]string `yaml:"groups"`
+	} `yaml:"middleware"`
+
+	// Modules configures API modules added with registerModule.
+	Modules struct {
+		// Disabled lists the names of modules not to load.
+		Disabled []string `yaml:"disabled"`
+
+		// Settings holds module-specific settings, keyed by module name.
+		Settings map[string]yaml.Node `yaml:"settings"`
+	} `yaml:"modules"`
+
+	// SelfTest configures the admin self-test endpoint.
+	SelfTest struct {
+		// TokenURL is the token endpoint of a mock identity provider,
+		// against which a dummy refresh token is exchanged. The token
+		// refresh step is skipped when empty.
+		TokenURL string `yaml:"token_url"`
+	} `yaml:"self_test"`
+
+	// sources maps the dotted paths of settings not left to their
+	// defaults, such as "elasticsearch.url", to where they were set.
+	sources map[string]string
 }
 
-func setConfigFromEnv(cfg *appConfig) {
-	var walk func(v reflect.Value, prefix string)
-	walk = func(v reflect.Value, prefix string) {
+// Sources of configuration settings. Settings set from environment
+// variables have the source "env:" followed by the name of the variable.
+const (
+	configSourceDefault = "default"
+	configSourceFile    = "file"
+	configSourceEnv     = "env:"
+	configSourceKMS     = "kms"
+)
+
+// setSource records where the setting at path was set.
+func (c *appConfig) setSource(path, source string) {
+	if c.sources == nil {
+		c.sources = make(map[string]string)
+	}
+	c.sources[path] = source
+}
+
+// source returns where the setting at path, or the setting containing it,
+// was set.
+func (c *appConfig) source(path string) string {
+	for {
+		if source, ok := c.sources[path]; ok {
+			return source
+		}
+		i := strings.LastIndexByte(path, '.')
+		if i < 0 {
+			return configSourceDefault
+		}
+		path = path[:i]
+	}
+}
+
+// setFileSources records the settings present in a configuration file.
+func (c *appConfig) setFileSources(node *yaml.Node, path string) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			c.setFileSources(child, path)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			c.setFileSources(node.Content[i+1], key)
+		}
+	default:
+		if path != "" {
+			c.setSource(path, configSourceFile)
+		}
+	}
+}
+
+// setConfigFromEnv overrides the settings of cfg with the environment
+// variables named after their path, e.g. GOOGLE_CLIENT_ID. Values which do
+// not parse as their setting's type are reported as errors.
+func setConfigFromEnv(cfg *appConfig) error {
+	var walk func(v reflect.Value, prefix, path string) error
+	walk = func(v reflect.Value, prefix, path string) error {
 		typ := v.Type()
 		n := v.NumField()
 		for i := 0; i < n; i++ {
 			field := v.Field(i)
 			yamlTag := typ.Field(i).Tag.Get("yaml")
+			if yamlTag == "" {
+				// Unexported state, such as the sources of settings.
+				continue
+			}
 			name := strings.ToUpper(prefix + yamlTag)
+			fieldPath := path + yamlTag
 			switch field.Kind() {
 			case reflect.Struct:
-				walk(field, name+"_")
+				if err := walk(field, name+"_", fieldPath+"."); err != nil {
+					return err
+				}
+				continue
 			case reflect.String:
 				if v := os.Getenv(name); v != "" {
 					field.Set(reflect.ValueOf(v))
 				}
 			case reflect.Slice:
+				if field.Type().Elem().Kind() != reflect.String {
+					// Like maps, lists of structs may only be set in the
+					// config file.
+					continue
+				}
 				if v := os.Getenv(name); v != "" {
 					field.Set(reflect.ValueOf(strings.Fields(v)))
 				}
+			case reflect.Bool:
+				if v := os.Getenv(name); v != "" {
+					b, err := strconv.ParseBool(v)
+					if err != nil {
+						return fmt.Errorf("%s: %q is not a boolean, such as true or false", name, v)
+					}
+					field.SetBool(b)
+				}
+			case reflect.Int, reflect.Int64:
+				if v := os.Getenv(name); v != "" {
+					if field.Type() == reflect.TypeOf(time.Duration(0)) {
+						d, err := time.ParseDuration(v)
+						if err != nil {
+							return fmt.Errorf("%s: %q is not a duration, such as 30s or 5m", name, v)
+						}
+						field.SetInt(int64(d))
+						break
+					}
+					n, err := strconv.ParseInt(v, 10, 64)
+					if err != nil {
+						return fmt.Errorf("%s: %q is not an integer", name, v)
+					}
+					field.SetInt(n)
+				}
+			case reflect.Float64:
+				if v := os.Getenv(name); v != "" {
+					f, err := strconv.ParseFloat(v, 64)
+					if err != nil {
+						return fmt.Errorf("%s: %q is not a number", name, v)
+					}
+					field.SetFloat(f)
+				}
+			case reflect.Map:
+				// Maps cannot be expressed as a single environment
+				// variable; they may only be set in the config file.
+				continue
 			default:
 				panic(fmt.Sprintf("%s: %s", name, typ))
 			}
+			if os.Getenv(name) != "" {
+				cfg.setSource(fieldPath, configSourceEnv+name)
+			}
 		}
+		return nil
+	}
+	return walk(reflect.ValueOf(cfg).Elem(), "", "")
+}
+
+// stepUpMaxAge returns the configured step-up max age, or the default.
+func (c *appConfig) stepUpMaxAge() time.Duration {
+	if c.StepUp.MaxAge > 0 {
+		return c.StepUp.MaxAge
+	}
+	return defaultStepUpMaxAge
+}
+
+// configMaxAge returns how long /api/config may be cached, or the default.
+func (c *appConfig) configMaxAge() time.Duration {
+	if c.API.ConfigMaxAge > 0 {
+		return c.API.ConfigMaxAge
+	}
+	return defaultConfigMaxAge
+}
+
+// drainTimeout returns how long in-flight requests are waited for on
+// shutdown.
+func (c *appConfig) drainTimeout() time.Duration {
+	if c.Server.DrainTimeout > 0 {
+		return c.Server.DrainTimeout
+	}
+	if grace := c.Server.TerminationGracePeriod; grace > 0 {
+		return max(grace-flushTimeout-terminationMargin, grace/3)
 	}
-	walk(reflect.ValueOf(cfg).Elem(), "")
+	return defaultDrainTimeout
 }
 
+// googleEndpoint returns Google's OAuth endpoint, with any configured
+// replacements.
+func (c *appConfig) googleEndpoint() oauth2.Endpoint {
+	endpoint := endpoints.Google
+	if c.Google.Endpoints.AuthURL != "" {
+		endpoint.AuthURL = c.Google.Endpoints.AuthURL
+	}
+	if c.Google.Endpoints.TokenURL != "" {
+		endpoint.TokenURL = c.Google.Endpoints.TokenURL
+	}
+	return endpoint
+}
+
+// googleRevokeURL returns the URL of Google's token revocation endpoint,
+// or the configured replacement.
+func (c *appConfig) googleRevokeURL() string {
+	if c.Google.Endpoints.RevokeURL != "" {
+		return c.Google.Endpoints.RevokeURL
+	}
+	return googleRevokeURL
+}
+
+// googleJWKSURL returns the URL of Google's signing keys, or the
+// configured replacement.
+func (c *appConfig) googleJWKSURL() string {
+	if c.Google.Endpoints.JWKSURL != "" {
+		return c.Google.Endpoints.JWKSURL
+	}
+	return googleJWKSURL
+}
+
+// oidcName returns the name of the generic OIDC provider shown to users.
+func (c *appConfig) oidcName() string {
+	if c.OIDC.Name != "" {
+		return c.OIDC.Name
+	}
+	return "Single sign-on"
+}
+
+// microsoftTenant returns the configured Microsoft tenant, or the default.
+func (c *appConfig) microsoftTenant() string {
+	if c.Microsoft.Tenant != "" {
+		return c.Microsoft.Tenant
+	}
+	return "organizations"
+}
+
+// loadConfig loads the configuration file at path, if any, decrypting it
+// if encrypted, then overrides it with environment variables.
 func loadConfig(path string) (*appConfig, error) {
 	var cfg appConfig
 	if path != "" {
@@ -68,10 +965,22 @@ func loadConfig(path string) (*appConfig, error) {
 		if err != nil {
 			return nil, err
 		}
-		if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
+		defer f.Close()
+		plaintext, err := decryptConfig(f)
+		if err != nil {
 			return nil, err
 		}
+		var node yaml.Node
+		if err := yaml.NewDecoder(plaintext).Decode(&node); err != nil {
+			return nil, err
+		}
+		if err := node.Decode(&cfg); err != nil {
+			return nil, err
+		}
+		cfg.setFileSources(&node, "")
+	}
+	if err := setConfigFromEnv(&cfg); err != nil {
+		return nil, err
 	}
-	setConfigFromEnv(&cfg)
 	return &cfg, nil
 }
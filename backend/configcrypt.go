@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+const (
+	// configIdentityEnv and configIdentityFileEnv hold the age identity
+	// decrypting encrypted configuration files, or the path of a file
+	// holding it.
+	configIdentityEnv     = "CONFIG_AGE_IDENTITY"
+	configIdentityFileEnv = "CONFIG_AGE_IDENTITY_FILE"
+
+	ageBinaryHeader = "age-encryption.org/v1\n"
+)
+
+// errConfigIdentityMissing is returned when loading an encrypted
+// configuration file without an identity to decrypt it with.
+var errConfigIdentityMissing = errors.New(
+	"configuration file is encrypted: set " + configIdentityEnv + " or " + configIdentityFileEnv)
+
+// configIdentities returns the age identities set in the environment.
+func configIdentities() ([]age.Identity, error) {
+	var keys io.Reader
+	if v := os.Getenv(configIdentityEnv); v != "" {
+		keys = strings.NewReader(v)
+	} else if path := os.Getenv(configIdentityFileEnv); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		keys = f
+	} else {
+		return nil, errConfigIdentityMissing
+	}
+	identities, err := age.ParseIdentities(keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", configIdentityEnv, err)
+	}
+	return identities, nil
+}
+
+// decryptConfig returns the plaintext of a configuration file, decrypting
+// it if encrypted with age, whether armored or not. Plaintext files are
+// returned as is.
+func decryptConfig(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	start, _ := br.Peek(len(armor.Header))
+	var ciphertext io.Reader
+	switch {
+	case bytes.HasPrefix(start, []byte(armor.Header)):
+		ciphertext = armor.NewReader(br)
+	case bytes.HasPrefix(start, []byte(ageBinaryHeader)):
+		ciphertext = br
+	default:
+		return br, nil
+	}
+	identities, err := configIdentities()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := age.Decrypt(ciphertext, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting configuration file: %w", err)
+	}
+	return plaintext, nil
+}
+
+// runConfigCommand runs the "config" command, which manages encrypted
+// configuration files, so that they may be committed:
+//
+//	app-backend config keygen
+//	app-backend config encrypt -r <recipient>... [file]
+//	app-backend config decrypt [file]
+//
+// Files are read from stdin if not given, and written to stdout.
+func runConfigCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	usage := errors.New("usage: config keygen | config encrypt -r <recipient>... [file] | config decrypt [file]")
+	if len(args) == 0 {
+		return usage
+	}
+	flags := flag.NewFlagSet("config "+args[0], flag.ContinueOnError)
+	var recipients stringsFlag
+	if args[0] == "encrypt" {
+		flags.Var(&recipients, "r", "age recipient (public key) to encrypt for; may be repeated")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return usage
+	}
+	input := stdin
+	if path := flags.Arg(0); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+
+	switch args[0] {
+	case "keygen":
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(stdout, "# public key: %s\n%s\n", identity.Recipient(), identity)
+		return err
+	case "encrypt":
+		if len(recipients) == 0 {
+			return errors.New("config encrypt: at least one recipient (-r) is required")
+		}
+		parsed, err := age.ParseRecipients(strings.NewReader(strings.Join(recipients, "\n")))
+		if err != nil {
+			return err
+		}
+		armored := armor.NewWriter(stdout)
+		w, err := age.Encrypt(armored, parsed...)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, input); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return armored.Close()
+	case "decrypt":
+		plaintext, err := decryptConfig(input)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(stdout, plaintext)
+		return err
+	default:
+		return usage
+	}
+}
+
+// stringsFlag is a flag that may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// confirmationHeader carries the token confirming a dangerous action.
+	confirmationHeader = "X-Confirmation-Token"
+
+	// confirmationTTL is how long a confirmation token is valid after it
+	// was issued.
+	confirmationTTL = 30 * time.Second
+
+	// confirmationRequired is the code of the error reported when a
+	// dangerous action was not confirmed.
+	confirmationRequired = "confirmation_required"
+)
+
+// confirmations issues and checks the tokens confirming dangerous admin
+// actions, such as purging sessions or deleting data, so that they are not
+// performed by accident, e.g. by a script run against the wrong backend.
+// A dangerous request is first rejected with a token bound to its method,
+// path, and query, which must be sent back with the same request within
+// confirmationTTL. Tokens are signed rather than stored, so they can be
+// confirmed on any replica. Without an admin secret, tokens could be
+// forged, so none are issued, and dangerous actions are refused.
+type confirmations struct {
+	key []byte
+	now func() time.Time
+}
+
+func newConfirmations(adminSecret string) *confirmations {
+	c := &confirmations{now: time.Now}
+	if adminSecret != "" {
+		sum := sha256.Sum256([]byte("confirmation:" + adminSecret))
+		c.key = sum[:]
+	}
+	return c
+}
+
+// confirmationAction identifies the action a request performs.
+func confirmationAction(r *http.Request) string {
+	return r.Method + " " + r.URL.RequestURI()
+}
+
+func (c *confirmations) sign(action, expiry string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(action + "\n" + expiry))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issue returns a token confirming an action, and when it expires.
+func (c *confirmations) issue(action string) (string, time.Time) {
+	expiresAt := c.now().Add(confirmationTTL).Truncate(time.Second)
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expiry + "." + c.sign(action, expiry), expiresAt
+}
+
+// valid reports whether a token confirms an action, and has not expired.
+func (c *confirmations) valid(action, token string) bool {
+	expiry, signature, ok := strings.Cut(token, ".")
+	if !ok || c.key == nil {
+		return false
+	}
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || c.now().After(time.Unix(seconds, 0)) {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(c.sign(action, expiry)))
+}
+
+// wrap requires requests to h to carry a valid confirmation token, unless
+// they are dry runs. Requests without one are rejected with 428
+// Precondition Required, and a JSON body with a new token for the same
+// request.
+func (c *confirmations) wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := confirmationAction(r)
+		if isDryRun(r.Context()) || c.valid(action, r.Header.Get(confirmationHeader)) {
+			h(w, r)
+			return
+		}
+		if c.key == nil {
+			writeError(w, r, http.StatusForbidden, "dangerous actions require admin_secret to be configured")
+			return
+		}
+		token, expiresAt := c.issue(action)
+		w.Header().Set("Cache-Control", "no-store")
+		writeErrorBody(w, http.StatusPreconditionRequired, struct {
+			errorResponse
+			Action            string    `json:"action"`
+			ConfirmationToken string    `json:"confirmation_token"`
+			ExpiresAt         time.Time `json:"expires_at"`
+		}{
+			errorResponse{newAPIError(r, confirmationRequired, "Confirm "+action+" with the confirmation token")},
+			action, token, expiresAt.UTC(),
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// cursorTTL is how long cursor tokens are valid, bounding how stale a
+	// listing paged through can get.
+	cursorTTL = time.Hour
+
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+var (
+	errCursorInvalid = errors.New("invalid cursor")
+	errCursorExpired = errors.New("cursor expired")
+)
+
+// pageCursor is the content of a cursor token: the sort values of the last
+// item of a page, after which paginate resumes in the sorted list, so that
+// pages neither skip nor repeat items added or removed in between, unlike
+// offsets. Order names the ordering the values belong to, so that a cursor
+// cannot be used with another list.
+type pageCursor struct {
+	Order   string        `json:"o"`
+	After   []interface{} `json:"a"`
+	Expires int64         `json:"e"`
+}
+
+// cursorCodec encodes and decodes cursor tokens, opaque to clients and
+// signed and encrypted with secureCookies.
+type cursorCodec struct {
+	secureCookies secureCookies
+
+	// clock tells when cursors expire.
+	clock clock
+}
+
+func newCursorCodec(secureCookies secureCookies, clk clock) *cursorCodec {
+	return &cursorCodec{secureCookies: secureCookies, clock: clk}
+}
+
+func (c *cursorCodec) encode(order string, after []interface{}) (string, error) {
+	data, err := json.Marshal(pageCursor{Order: order, After: after, Expires: c.clock.Now().Add(cursorTTL).Unix()})
+	if err != nil {
+		return "", err
+	}
+	return c.secureCookies.Encode(base64.RawURLEncoding.EncodeToString(data))
+}
+
+// decode returns the sort values of a cursor token of the given ordering.
+func (c *cursorCodec) decode(token, order string) ([]interface{}, error) {
+	value, err := c.secureCookies.Decode(token)
+	if err != nil {
+		return nil, errCursorInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errCursorInvalid
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Order != order || len(cursor.After) == 0 {
+		return nil, errCursorInvalid
+	}
+	if c.clock.Now().Unix() >= cursor.Expires {
+		return nil, errCursorExpired
+	}
+	return cursor.After, nil
+}
+
+// pageRequest holds the "limit" and "cursor" query parameters of a list
+// request. A request with neither lists all items.
+type pageRequest struct {
+	limit int
+	after []interface{}
+}
+
+func (c *cursorCodec) parsePageRequest(r *http.Request, order string) (*pageRequest, error) {
+	query := r.URL.Query()
+	var page pageRequest
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+		page.limit = n
+	}
+	if token := query.Get("cursor"); token != "" {
+		after, err := c.decode(token, order)
+		if err != nil {
+			return nil, err
+		}
+		page.after = after
+		if page.limit == 0 {
+			page.limit = defaultPageSize
+		}
+	}
+	return &page, nil
+}
+
+// setNextLink sets a Link header pointing to the next page, keeping the
+// other query parameters of r, such as fields.
+func setNextLink(w http.ResponseWriter, r *http.Request, limit int, cursor string) {
+	query := r.URL.Query()
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("cursor", cursor)
+	w.Header().Add("Link", "<"+r.URL.Path+"?"+query.Encode()+`>; rel="next"`)
+}
+
+// paginate returns the page of items, sorted by key, a unique sort key,
+// requested by r, setting a Link header to the next page if there is one.
+// The key is stable, so pages neither skip nor repeat items as items are
+// added or removed between requests.
+func paginate[T any](
+	w http.ResponseWriter, r *http.Request, cursors *cursorCodec, order string, items []T, key func(T) string,
+) ([]T, error) {
+	return paginateOrdered(w, r, cursors, order, items, key, false)
+}
+
+// paginateOrdered is paginate for items sorted by key in ascending order,
+// or descending if desc is set.
+func paginateOrdered[T any](
+	w http.ResponseWriter, r *http.Request, cursors *cursorCodec, order string, items []T, key func(T) string, desc bool,
+) ([]T, error) {
+	page, err := cursors.parsePageRequest(r, order)
+	if err != nil {
+		return nil, err
+	}
+	if page.after != nil {
+		after, ok := page.after[0].(string)
+		if !ok {
+			return nil, errCursorInvalid
+		}
+		items = items[sort.Search(len(items), func(i int) bool {
+			if desc {
+				return key(items[i]) < after
+			}
+			return key(items[i]) > after
+		}):]
+	}
+	if page.limit == 0 || len(items) <= page.limit {
+		return items, nil
+	}
+	items = items[:page.limit]
+	next, err := cursors.encode(order, []interface{}{key(items[len(items)-1])})
+	if err != nil {
+		return nil, err
+	}
+	setNextLink(w, r, page.limit, next)
+	return items, nil
+}
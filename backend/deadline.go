@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultRequestTimeout    = 30 * time.Second
+	defaultDependencyTimeout = 10 * time.Second
+
+	// budgetReserve is withheld from the remaining time of a request
+	// when calling dependencies, leaving the handler time to respond
+	// if a call times out.
+	budgetReserve = 250 * time.Millisecond
+)
+
+// timeoutOrDefault returns d, or defaultDependencyTimeout if d is unset.
+func timeoutOrDefault(d time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return defaultDependencyTimeout
+}
+
+// withBudget returns a context for a call to a dependency, bounded by the
+// dependency's timeout and by the remaining deadline budget of ctx, less
+// budgetReserve. The call fails immediately if the budget is exhausted.
+func withBudget(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, budgetTimeout(ctx, timeout))
+}
+
+// budgetTimeout returns the timeout for a call to a dependency, for
+// clients which do not take a context.
+func budgetTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if remaining, ok := remainingBudget(ctx); ok && remaining < timeout {
+		return max(remaining, 0)
+	}
+	return timeout
+}
+
+// remainingBudget returns the time left for calls to dependencies before
+// the deadline of ctx, if it has one.
+func remainingBudget(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline) - budgetReserve, true
+}
+
+// deadlineMiddleware bounds the handling of each request by timeout, so
+// that calls to slow dependencies made with the request's context are
+// abandoned rather than pinning goroutines.
+func deadlineMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// budgetTransport bounds HTTP requests to a dependency with withBudget.
+type budgetTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+// newBudgetClient returns an HTTP client whose requests are bounded by
+// timeout, and by the deadline budget of their context.
+func newBudgetClient(base http.RoundTripper, timeout time.Duration) *http.Client {
+	return &http.Client{Transport: &budgetTransport{base: base, timeout: timeout}}
+}
+
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := withBudget(req.Context(), t.timeout)
+	res, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The context must outlive the round trip, until the body is read.
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
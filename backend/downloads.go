@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// downloadChunkSize bounds how much of a throttled download is written at
+// once.
+const downloadChunkSize = 32 << 10
+
+// downloadThrottle limits the bandwidth of each download of attachments
+// and report snapshots, so that a single large download cannot saturate
+// the backend or a proxy. A nil downloadThrottle does not limit them.
+type downloadThrottle struct {
+	bytesPerSecond int64
+}
+
+func newDownloadThrottle(config *appConfig) *downloadThrottle {
+	if config.Downloads.BytesPerSecond <= 0 {
+		return nil
+	}
+	return &downloadThrottle{bytesPerSecond: config.Downloads.BytesPerSecond}
+}
+
+// serve serves content with http.ServeContent, which handles Range and
+// conditional requests, at the configured bandwidth. The Content-Type
+// header should be set beforehand.
+func (t *downloadThrottle) serve(w http.ResponseWriter, r *http.Request, modtime time.Time, content io.ReadSeeker) {
+	http.ServeContent(t.writer(w, r), r, "", modtime, content)
+}
+
+// writer returns w, throttled to the configured bandwidth for the rest of
+// the request.
+func (t *downloadThrottle) writer(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if t == nil {
+		return w
+	}
+	return &throttledWriter{
+		ResponseWriter: w,
+		ctx:            r.Context(),
+		bytesPerSecond: t.bytesPerSecond,
+		start:          time.Now(),
+	}
+}
+
+// throttledWriter writes a response no faster than bytesPerSecond,
+// pausing between chunks until the bytes written since start are within
+// the limit.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx            context.Context
+	bytesPerSecond int64
+	start          time.Time
+	written        int64
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	chunkSize := min(downloadChunkSize, int(w.bytesPerSecond))
+	var total int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), chunkSize)]
+		due := w.start.Add(time.Duration(float64(w.written+int64(len(chunk))) / float64(w.bytesPerSecond) * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-w.ctx.Done():
+				timer.Stop()
+				return total, w.ctx.Err()
+			case <-timer.C:
+			}
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		total += n
+		w.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		b = b[n:]
+	}
+	return total, nil
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
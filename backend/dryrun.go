@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// mutationEffect describes the effect of an admin mutation, as returned by
+// its dry runs.
+type mutationEffect struct {
+	DocumentsAffected  int `json:"documents_affected"`
+	UsersSignedOut     int `json:"users_signed_out"`
+	CacheEntriesPurged int `json:"cache_entries_purged"`
+}
+
+type dryRunKey struct{}
+
+// dryRunRoute marks an admin mutation as supporting dry runs, with the
+// dry_run query parameter. Dry runs of other admin mutations are rejected,
+// rather than applied.
+func dryRunRoute() routeOption {
+	return func(rt *route) {
+		rt.DryRun = true
+	}
+}
+
+// isDryRun reports whether the request is a dry run.
+func isDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// dryRunHandler parses the dry_run query parameter of requests to an admin
+// mutation, for h to check with dryRun.
+func dryRunHandler(rt *route, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get("dry_run")
+		if value == "" {
+			h(w, r)
+			return
+		}
+		dryRun, err := strconv.ParseBool(value)
+		switch {
+		case err != nil:
+			writeError(w, r, http.StatusBadRequest, "invalid dry_run parameter")
+			return
+		case dryRun && !rt.DryRun:
+			writeError(w, r, http.StatusBadRequest, "dry runs are not supported by "+rt.operation())
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), dryRunKey{}, dryRun)))
+	}
+}
+
+// dryRun reports whether the request is a dry run, in which case it
+// responds with the effect the request would have had. Handlers call it
+// once they validated the request and computed its effect, and return
+// without applying it if it reports true.
+func dryRun(w http.ResponseWriter, r *http.Request, effect mutationEffect) bool {
+	if !isDryRun(r.Context()) {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		DryRun bool `json:"dry_run"`
+		mutationEffect
+	}{true, effect})
+	return true
+}
@@ -0,0 +1,130 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/chromedp"
+)
+
+// gsiStub stands in for the Google Identity Services client, which the
+// frontend loads from accounts.google.com: it records the configuration
+// the frontend initializes it with, and its sign-in button passes the ID
+// token formatted into it to the frontend's callback.
+const gsiStub = `window.google = {accounts: {id: {
+	initialize(config) { window.gsiConfig = config; },
+	renderButton(parent) {
+		const button = document.createElement("button");
+		button.id = "gsi-sign-in";
+		button.textContent = "Sign in with Google";
+		button.onclick = () => window.gsiConfig.callback({credential: %q});
+		parent.appendChild(button);
+	},
+	prompt() {},
+}}};`
+
+// newChrome returns the context of a tab of headless Chrome, which trusts
+// the proxy's self-signed certificate, and is served gsiStub, signing in
+// with idToken, for scripts of accounts.google.com.
+func newChrome(t *testing.T, idToken string) context.Context {
+	t.Helper()
+	opts := append(chromedp.DefaultExecAllocatorOptions[:],
+		chromedp.Flag("ignore-certificate-errors", true),
+		chromedp.WindowSize(1400, 1000),
+	)
+	ctx, cancelAllocator := chromedp.NewExecAllocator(context.Background(), opts...)
+	ctx, cancelTab := chromedp.NewContext(ctx)
+	ctx, cancelTimeout := context.WithTimeout(ctx, time.Minute)
+	t.Cleanup(func() {
+		cancelTimeout()
+		cancelTab()
+		cancelAllocator()
+	})
+
+	script := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(gsiStub, idToken)))
+	chromedp.ListenTarget(ctx, func(ev any) {
+		paused, ok := ev.(*fetch.EventRequestPaused)
+		if !ok {
+			return
+		}
+		// Events are handled one at a time, so requests are fulfilled
+		// outside of the listener.
+		go func() {
+			fulfill := fetch.FulfillRequest(paused.RequestID, http.StatusOK).
+				WithResponseHeaders([]*fetch.HeaderEntry{{Name: "Content-Type", Value: "text/javascript"}}).
+				WithBody(script)
+			fulfill.Do(cdp.WithExecutor(ctx, chromedp.FromContext(ctx).Target))
+		}()
+	})
+	intercept := fetch.Enable().WithPatterns([]*fetch.RequestPattern{{URLPattern: "https://accounts.google.com/*"}})
+	if err := chromedp.Run(ctx, intercept); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func TestBrowserSignIn(t *testing.T) {
+	idToken, err := dev.IdP.IDToken("carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := newChrome(t, idToken)
+
+	// Signed out, the frontend is branded and signs in with Google as
+	// configured by /api/config
+	var title, configuredClientID string
+	if err := chromedp.Run(ctx,
+		chromedp.Navigate(dev.URL+"/"),
+		chromedp.WaitVisible("#gsi-sign-in", chromedp.ByQuery),
+		chromedp.Title(&title),
+		chromedp.Evaluate("window.gsiConfig.client_id", &configuredClientID),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if title != appName {
+		t.Errorf("expected the title %q, got %q", appName, title)
+	}
+	if configuredClientID != clientID {
+		t.Errorf("expected sign-in with the client ID %q, got %q", clientID, configuredClientID)
+	}
+
+	// Signed in, the data table shows the first page of records
+	firstID := `document.querySelector("tbody tr td").innerText`
+	var rows int
+	var first string
+	if err := chromedp.Run(ctx,
+		chromedp.Click("#gsi-sign-in", chromedp.ByQuery),
+		chromedp.WaitVisible(`//td[contains(., "REC-")]`, chromedp.BySearch),
+		chromedp.Evaluate(`document.querySelectorAll("tbody tr").length`, &rows),
+		chromedp.Evaluate(firstID, &first),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 10 {
+		t.Errorf("expected a page of 10 records, got %d rows", rows)
+	}
+
+	// The next page is requested from the backend
+	if err := chromedp.Run(ctx,
+		chromedp.Click(`[data-test-subj="pagination-button-next"]`, chromedp.ByQuery),
+		chromedp.Poll(fmt.Sprintf("%s !== %q", firstID, first), nil),
+	); err != nil {
+		t.Fatalf("expected the next page of records: %v", err)
+	}
+
+	// The session is kept in a cookie, so the app loads signed in
+	if err := chromedp.Run(ctx,
+		chromedp.Reload(),
+		chromedp.WaitVisible(`//h2[text()="Welcome!"]`, chromedp.BySearch),
+	); err != nil {
+		t.Fatal(err)
+	}
+}
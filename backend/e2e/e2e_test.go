@@ -0,0 +1,531 @@
+//go:build e2e
+
+// Package e2e tests the dev stack end to end: the backend, with in-memory
+// storage and a mock identity provider, and the built frontend, behind the
+// dev TLS proxy. The API is driven over HTTPS like a browser would,
+// following redirects and keeping cookies, and the frontend in headless
+// Chrome. Run it with "make e2e", which needs npm and Chrome.
+package e2e
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"app-backend/testsupport"
+)
+
+const (
+	clientID = "e2e-client"
+	appName  = "E2E App"
+)
+
+// stack is the running dev stack.
+type stack struct {
+	// URL is the base URL of the proxy, and AdminURL that of its admin
+	// API, which reads its routes from RoutesFile.
+	URL        string
+	AdminURL   string
+	RoutesFile string
+	IdP        *testsupport.IdP
+}
+
+var dev *stack
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "e2e")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	s, stop, err := start(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		stop()
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	dev = s
+	code := m.Run()
+	stop()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// start builds and starts the backend, the proxy, and the frontend,
+// returning once the backend is ready. stop stops whatever was started, and
+// prints the output of the processes if they failed.
+func start(dir string) (s *stack, stop func(), err error) {
+	var stops []func()
+	var output bytes.Buffer
+	stop = func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+		if err != nil {
+			os.Stderr.Write(output.Bytes())
+		}
+	}
+
+	backendBin := filepath.Join(dir, "app-backend")
+	proxyBin := filepath.Join(dir, "app-proxy")
+	if err := build("..", backendBin); err != nil {
+		return nil, stop, err
+	}
+	if err := build("../../deploy/dev/app-proxy", proxyBin); err != nil {
+		return nil, stop, err
+	}
+	frontendDir := filepath.Join(dir, "frontend")
+	if err := buildFrontend("../../frontend", frontendDir); err != nil {
+		return nil, stop, err
+	}
+	certFile, keyFile, err := writeCertificate(dir)
+	if err != nil {
+		return nil, stop, err
+	}
+
+	idp, err := testsupport.NewIdP(clientID)
+	if err != nil {
+		return nil, stop, err
+	}
+	stops = append(stops, idp.Close)
+	frontend := httptest.NewServer(serveFrontend(frontendDir))
+	stops = append(stops, frontend.Close)
+
+	backendAddr, err := freeAddr()
+	if err != nil {
+		return nil, stop, err
+	}
+	proxyAddr, err := freeAddr()
+	if err != nil {
+		return nil, stop, err
+	}
+	adminAddr, err := freeAddr()
+	if err != nil {
+		return nil, stop, err
+	}
+	routesFile := filepath.Join(dir, "routes.json")
+	if err := os.WriteFile(routesFile, devRoutes("http://"+backendAddr, frontend.URL), 0o600); err != nil {
+		return nil, stop, err
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	// Without an Elasticsearch API key, the backend keeps its state in
+	// memory.
+	backend := exec.Command(backendBin)
+	backend.Env = append(os.Environ(),
+		"SERVER_ADDR="+backendAddr,
+		"ENCRYPTION_KEYS="+base64.StdEncoding.EncodeToString(key),
+		"GOOGLE_CLIENT_ID="+clientID,
+		"GOOGLE_CLIENT_SECRET=e2e-secret",
+		"GOOGLE_ENDPOINTS_AUTH_URL="+idp.AuthURL(),
+		"GOOGLE_ENDPOINTS_TOKEN_URL="+idp.TokenURL(),
+		"GOOGLE_ENDPOINTS_JWKS_URL="+idp.JWKSURL(),
+		"ELASTICSEARCH_API_KEY=",
+		"TRACING_EXPORTER=file",
+		"TRACING_FILE="+filepath.Join(dir, "traces.json"),
+		"METRICS_DISABLED=true",
+		"BRANDING_APP_NAME="+appName,
+	)
+	proxy := exec.Command(proxyBin)
+	proxy.Env = append(os.Environ(),
+		"LISTEN_ADDR="+proxyAddr,
+		"ADMIN_ADDR="+adminAddr,
+		"ROUTES_FILE="+routesFile,
+		"HEALTH_CHECK_INTERVAL=1s",
+		"TLS_CERT_FILE="+certFile,
+		"TLS_KEY_FILE="+keyFile,
+	)
+	for _, cmd := range []*exec.Cmd{backend, proxy} {
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		if err := cmd.Start(); err != nil {
+			return nil, stop, err
+		}
+		stops = append(stops, func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+	}
+
+	s = &stack{URL: "https://" + proxyAddr, AdminURL: "http://" + adminAddr, RoutesFile: routesFile, IdP: idp}
+	client := newBrowser(nil)
+	deadline := time.Now().Add(time.Minute)
+	for {
+		resp, err := client.Get(s.URL + "/api/ready")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return s, stop, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("the stack did not become ready: %v", err)
+			return nil, stop, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// devRoutes returns the routes file of the proxy, routing like the dev
+// stack does.
+func devRoutes(backendURL, frontendURL string) []byte {
+	return []byte(fmt.Sprintf(`{"routes": [
+		{"prefix": "/api/", "upstream": %[1]q, "health_path": "/api/ready"},
+		{"prefix": "/scim/", "upstream": %[1]q, "health_path": "/api/ready"},
+		{"prefix": "/", "upstream": %[2]q}
+	]}`, backendURL, frontendURL))
+}
+
+// build builds the Go program in dir to the binary out.
+func build(dir, out string) error {
+	cmd := exec.Command("go", "build", "-o", out, ".")
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("building %s: %w", dir, err)
+	}
+	return nil
+}
+
+// buildFrontend installs the dependencies of the frontend in dir, unless
+// already installed, and builds it to out.
+func buildFrontend(dir, out string) error {
+	steps := [][]string{{"npx", "vite", "build", "--outDir", out, "--emptyOutDir"}}
+	if _, err := os.Stat(filepath.Join(dir, "node_modules")); err != nil {
+		steps = append([][]string{{"npm", "ci"}}, steps...)
+	}
+	for _, step := range steps {
+		cmd := exec.Command(step[0], step[1:]...)
+		cmd.Dir = dir
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("building the frontend: %s: %w", strings.Join(step, " "), err)
+		}
+	}
+	return nil
+}
+
+// serveFrontend serves the frontend built to dir like its nginx does,
+// with index.html for paths of no file, which are routes of the app.
+func serveFrontend(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(path.Clean(r.URL.Path)))); err != nil {
+			r.URL.Path = "/"
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// freeAddr returns a local address with a free port.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key to dir, for the proxy to serve.
+func writeCertificate(dir string) (certFile, keyFile string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// newBrowser returns a client which, like a browser, keeps cookies in jar
+// and follows redirects. The proxy's self-signed certificate is trusted.
+func newBrowser(jar http.CookieJar) *http.Client {
+	return &http.Client{
+		Jar:     jar,
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+// getJSON does req, expecting status, and decodes the response into v
+// if non-nil.
+func getJSON(t *testing.T, client *http.Client, req *http.Request, status int, v any) {
+	t.Helper()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s %s: expected %d, got %d: %s", req.Method, req.URL, status, resp.StatusCode, body)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+		}
+	}
+}
+
+func get(t *testing.T, rawURL string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// signIn signs in as email, like the frontend does with an ID token from
+// the identity provider, returning the response of /api/authenticate.
+func signIn(t *testing.T, browser *http.Client, email string) (result struct {
+	Profile struct {
+		Email string `json:"email"`
+	} `json:"profile"`
+	GoogleOAuthState string `json:"google_oauth_state"`
+}) {
+	t.Helper()
+	idToken, err := dev.IdP.IDToken(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := get(t, dev.URL+"/api/authenticate")
+	req.Header.Set("Authorization", "Bearer "+idToken)
+	getJSON(t, browser, req, http.StatusOK, &result)
+	return result
+}
+
+func newJar(t *testing.T) http.CookieJar {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jar
+}
+
+func TestSignInAndLoadData(t *testing.T) {
+	browser := newBrowser(newJar(t))
+
+	// Signed out, the frontend is served but the API is not
+	getJSON(t, browser, get(t, dev.URL+"/"), http.StatusOK, nil)
+	getJSON(t, browser, get(t, dev.URL+"/api/authenticate"), http.StatusUnauthorized, nil)
+	getJSON(t, browser, get(t, dev.URL+"/api/data"), http.StatusUnauthorized, nil)
+
+	result := signIn(t, browser, "alice@example.com")
+	if result.Profile.Email != "alice@example.com" {
+		t.Errorf("expected to be signed in as alice@example.com, got %q", result.Profile.Email)
+	}
+
+	// The session is kept in a cookie
+	getJSON(t, browser, get(t, dev.URL+"/api/authenticate"), http.StatusOK, nil)
+	var records []struct {
+		ID string `json:"id"`
+	}
+	getJSON(t, browser, get(t, dev.URL+"/api/data"), http.StatusOK, &records)
+	if len(records) == 0 {
+		t.Error("expected sample data")
+	}
+}
+
+func TestOAuthCallback(t *testing.T) {
+	browser := newBrowser(newJar(t))
+	result := signIn(t, browser, "bob@example.com")
+	if result.GoogleOAuthState == "" {
+		t.Fatal("expected an OAuth state")
+	}
+	var config struct {
+		Google struct {
+			ClientID   string `json:"client_id"`
+			OAuthScope string `json:"oauth_scope"`
+			AuthURL    string `json:"auth_url"`
+		} `json:"google"`
+	}
+	getJSON(t, browser, get(t, dev.URL+"/api/config"), http.StatusOK, &config)
+	if config.Google.AuthURL != dev.IdP.AuthURL() {
+		t.Fatalf("expected the mock identity provider's authorization endpoint, got %q", config.Google.AuthURL)
+	}
+
+	// Authorize like the frontend does, with the identity provider
+	// redirecting back to the callback, and the callback to the app.
+	authorize := func(state string) *http.Request {
+		query := url.Values{
+			"response_type": {"code"},
+			"redirect_uri":  {dev.URL + "/api/oauth/google"},
+			"client_id":     {config.Google.ClientID},
+			"login_hint":    {"bob@example.com"},
+			"scope":         {config.Google.OAuthScope},
+			"state":         {state},
+		}
+		return get(t, config.Google.AuthURL+"?"+query.Encode())
+	}
+	resp, err := browser.Do(authorize(result.GoogleOAuthState))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.String() != dev.URL+"/" {
+		t.Errorf("expected to land on %s/, got %d at %s", dev.URL, resp.StatusCode, resp.Request.URL)
+	}
+
+	// A forged state is rejected
+	getJSON(t, browser, authorize("forged"), http.StatusUnauthorized, nil)
+
+	// As is the state issued to another session
+	other := newBrowser(newJar(t))
+	signIn(t, other, "bob@example.com")
+	getJSON(t, other, authorize(result.GoogleOAuthState), http.StatusUnauthorized, nil)
+}
+
+func TestConfigCaching(t *testing.T) {
+	browser := newBrowser(nil)
+	resp, err := browser.Do(get(t, dev.URL+"/api/config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" || !strings.HasPrefix(resp.Header.Get("Cache-Control"), "public, max-age=") {
+		t.Fatalf("expected a cacheable config, got %d with ETag %q and Cache-Control %q",
+			resp.StatusCode, etag, resp.Header.Get("Cache-Control"))
+	}
+
+	// Through the proxy, browsers revalidate their copy
+	req := get(t, dev.URL+"/api/config")
+	req.Header.Set("If-None-Match", etag)
+	getJSON(t, browser, req, http.StatusNotModified, nil)
+	req = get(t, dev.URL+"/api/config")
+	req.Header.Set("If-None-Match", `"stale"`)
+	getJSON(t, browser, req, http.StatusOK, nil)
+}
+
+func TestProxyAdmin(t *testing.T) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	type route struct {
+		Prefix   string `json:"prefix"`
+		Upstream string `json:"upstream"`
+	}
+	var routes []route
+	getJSON(t, client, get(t, dev.AdminURL+"/routes"), http.StatusOK, &routes)
+	if len(routes) != 3 || routes[0].Prefix != "/scim/" || routes[1].Prefix != "/api/" || routes[2].Prefix != "/" {
+		t.Fatalf("expected the routes of the dev stack, longest prefix first, got %+v", routes)
+	}
+
+	// The upstreams become healthy once checked
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var health []struct {
+			Prefix  string `json:"prefix"`
+			Healthy bool   `json:"healthy"`
+			Error   string `json:"error"`
+		}
+		getJSON(t, client, get(t, dev.AdminURL+"/health"), http.StatusOK, &health)
+		healthy := len(health) == 3
+		for _, h := range health {
+			healthy = healthy && h.Healthy
+		}
+		if healthy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected healthy upstreams, got %+v", health)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Invalid routes files are rejected, keeping the routes in use
+	original, err := os.ReadFile(dev.RoutesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.WriteFile(dev.RoutesFile, original, 0o600)
+		if resp, err := client.Post(dev.AdminURL+"/routes/reload", "", nil); err == nil {
+			resp.Body.Close()
+		}
+	})
+	if err := os.WriteFile(dev.RoutesFile, []byte(`{"routes": [{"prefix": "api", "upstream": "http://127.0.0.1:1"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reload, err := http.NewRequest(http.MethodPost, dev.AdminURL+"/routes/reload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getJSON(t, client, reload, http.StatusBadRequest, nil)
+	getJSON(t, newBrowser(nil), get(t, dev.URL+"/api/ready"), http.StatusOK, nil)
+	if err := os.WriteFile(dev.RoutesFile, original, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reload, _ = http.NewRequest(http.MethodPost, dev.AdminURL+"/routes/reload", nil)
+	getJSON(t, client, reload, http.StatusOK, &routes)
+	if len(routes) != 3 {
+		t.Errorf("expected the routes to be reloaded, got %+v", routes)
+	}
+
+	resp, err := client.Get(dev.AdminURL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	metrics, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`proxy_requests_total{route="/api/",code="200"}`,
+		`proxy_upstream_up{route="/api/",upstream=`,
+		`proxy_config_reloads_total{result="failure"} 1`,
+	} {
+		if !strings.Contains(string(metrics), want) {
+			t.Errorf("expected metrics to include %s, got:\n%s", want, metrics)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the responses")
+
+// response is what the golden files record of a response: its status,
+// content type, and the shape of its JSON body, or the text of others.
+// The code and message of errors are recorded as they are.
+type response struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        any    `json:"body"`
+}
+
+// shape returns the shape of a decoded JSON value: objects map their keys
+// to the shapes of their values, arrays hold the shape of all of their
+// elements, merged, and other values are replaced with the name of their
+// type. Shapes are stable across responses with different values, such as
+// tokens, timestamps, and random sample data.
+func shape(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		result := make(map[string]any, len(v))
+		for key, value := range v {
+			result[key] = shape(value)
+		}
+		return result
+	case []any:
+		var merged any
+		for i, value := range v {
+			if i == 0 {
+				merged = shape(value)
+			} else {
+				merged = mergeShapes(merged, shape(value))
+			}
+		}
+		if merged == nil {
+			return []any{}
+		}
+		return []any{merged}
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+// mergeShapes merges the shapes of elements of an array: the keys of
+// objects are merged, and differing types are joined, as in
+// "string|null".
+func mergeShapes(a, b any) any {
+	objectA, okA := a.(map[string]any)
+	objectB, okB := b.(map[string]any)
+	if okA && okB {
+		for key, value := range objectB {
+			if existing, ok := objectA[key]; ok {
+				objectA[key] = mergeShapes(existing, value)
+			} else {
+				objectA[key] = value
+			}
+		}
+		return objectA
+	}
+	encodedA, _ := json.Marshal(a)
+	encodedB, _ := json.Marshal(b)
+	if bytes.Equal(encodedA, encodedB) {
+		return a
+	}
+	typeA, okA := a.(string)
+	typeB, okB := b.(string)
+	if !okA || !okB {
+		return string(encodedA) + "|" + string(encodedB)
+	}
+	types := slices.Compact(slices.Sorted(slices.Values(append(strings.Split(typeA, "|"), strings.Split(typeB, "|")...))))
+	return strings.Join(types, "|")
+}
+
+// checkGolden compares the response to req with the golden file
+// testdata/golden/name.json, or rewrites it with -update.
+// errorOf returns the shape of the error of an error body, keeping its
+// code and message, or nil if the body is not an error.
+func errorOf(body any) map[string]any {
+	object, _ := body.(map[string]any)
+	e, _ := object["error"].(map[string]any)
+	if _, ok := e["code"].(string); !ok {
+		return nil
+	}
+	result := shape(e).(map[string]any)
+	result["code"], result["message"] = e["code"], e["message"]
+	return result
+}
+
+func checkGolden(t *testing.T, client *http.Client, req *http.Request, name string) {
+	t.Helper()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := response{Status: resp.StatusCode, ContentType: resp.Header.Get("Content-Type")}
+	if strings.HasPrefix(got.ContentType, "application/json") {
+		var decoded any
+		if err := json.Unmarshal(body, &decoded); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got.Body = shape(decoded)
+		if e := errorOf(decoded); e != nil {
+			got.Body.(map[string]any)["error"] = e
+		}
+	} else {
+		got.Body = strings.TrimSpace(string(body))
+	}
+	encoded, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded = append(encoded, '\n')
+
+	path := filepath.Join("testdata", "golden", name+".json")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, encoded, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s: %v (run with -update to create it)", name, err)
+	}
+	if !bytes.Equal(expected, encoded) {
+		t.Errorf("%s: the response changed, expected:\n%s\ngot:\n%s\nRun with -update if the change is intended.", name, expected, encoded)
+	}
+}
+
+func TestGoldenResponses(t *testing.T) {
+	// Without a cookie jar, signing in with a Bearer token does not sign
+	// the client in.
+	signedOut := newBrowser(nil)
+	browser := newBrowser(newJar(t))
+	signIn(t, browser, "carol@example.com")
+	idToken, err := dev.IdP.IDToken("carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withHeader := func(req *http.Request, name, value string) *http.Request {
+		req.Header.Set(name, value)
+		return req
+	}
+	post := func(path, body string) *http.Request {
+		req, err := http.NewRequest(http.MethodPost, dev.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	for _, tc := range []struct {
+		name   string
+		client *http.Client
+		req    *http.Request
+	}{
+		{"config", signedOut, get(t, dev.URL+"/api/config")},
+		{"authenticate", signedOut, withHeader(get(t, dev.URL+"/api/authenticate"), "Authorization", "Bearer "+idToken)},
+		{"authenticate_cookie", browser, get(t, dev.URL+"/api/authenticate")},
+		{"user", browser, get(t, dev.URL+"/api/user")},
+		{"hello", browser, get(t, dev.URL+"/api/hello")},
+		{"data", browser, get(t, dev.URL+"/api/data")},
+		{"data_fields", browser, get(t, dev.URL+"/api/data?fields=id,name")},
+		{"data_page", browser, get(t, dev.URL+"/api/data?page=2&per_page=5&sort_field=name&sort_order=desc&fields=id,name,category")},
+		{"bootstrap", browser, get(t, dev.URL+"/api/bootstrap?limit=5")},
+		{"stats_created_per_week", browser, get(t, dev.URL+"/api/stats/created-per-week?tz=Europe/Madrid")},
+		{"teams_create", browser, post("/api/teams", `{"name":"Golden"}`)},
+		{"teams", browser, get(t, dev.URL+"/api/teams")},
+
+		// Errors
+		{"error_signed_out", signedOut, get(t, dev.URL+"/api/authenticate")},
+		{"error_invalid_authorization", signedOut, withHeader(get(t, dev.URL+"/api/authenticate"), "Authorization", "Basic x")},
+		{"error_data_signed_out", signedOut, get(t, dev.URL+"/api/data")},
+		{"error_data_unknown_field", browser, get(t, dev.URL+"/api/data?fields=nope")},
+		{"error_data_unsortable_field", browser, get(t, dev.URL+"/api/data?sort_field=description")},
+		{"error_invalid_timezone", browser, get(t, dev.URL+"/api/hello?tz=Nowhere/Special")},
+		{"error_not_found", browser, get(t, dev.URL+"/api/nope")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			checkGolden(t, tc.client, tc.req, tc.name)
+		})
+	}
+}
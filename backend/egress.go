@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+var errEgressDenied = errors.New("outbound request to host not allowed by egress policy")
+
+// defaultEgressHosts are the hosts the backend needs to reach, besides
+// those derived from configuration.
+var defaultEgressHosts = []string{
+	"accounts.google.com",
+	"*.googleapis.com",
+	"challenges.cloudflare.com",
+	"www.google.com",
+}
+
+// egressPolicy restricts outbound HTTP requests to an allowlist of hosts,
+// so that user-influenced URLs, such as webhooks or avatars, cannot be
+// used to reach internal services. Entries match a host exactly, or, if
+// prefixed with "*.", any of its subdomains.
+type egressPolicy struct {
+	allowed    []string
+	reportOnly bool
+	logger     *zap.Logger
+	violations metric.Int64Counter
+}
+
+func newEgressPolicy(config *appConfig, logger *zap.Logger) (*egressPolicy, error) {
+	violations, err := otel.Meter("main").Int64Counter(
+		"app.egress.violations",
+		metric.WithDescription("Outbound requests to hosts not allowed by the egress policy"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	p := &egressPolicy{
+		allowed:    append(append([]string{}, defaultEgressHosts...), config.Egress.AllowedHosts...),
+		reportOnly: config.Egress.ReportOnly,
+		logger:     logger,
+		violations: violations,
+	}
+	// Hosts of configured dependencies
+	for _, rawURL := range slices.Concat([]string{
+		config.Elasticsearch.URL,
+		config.Google.Endpoints.TokenURL,
+		config.Google.Endpoints.JWKSURL,
+		config.Google.Endpoints.RevokeURL,
+		config.OIDC.EndSessionEndpoint,
+		config.OIDC.Issuer,
+		config.SelfTest.TokenURL,
+		config.Attachments.Scan.URL,
+	}, config.Webhooks.URLs, config.SLO.AlertURLs) {
+		if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" {
+			p.allowed = append(p.allowed, u.Hostname())
+		}
+	}
+	p.allowed = append(p.allowed, config.Blobstore.Hosts()...)
+	p.allowed = append(p.allowed, config.KMS.Hosts()...)
+	if config.Microsoft.ClientID != "" {
+		p.allowed = append(p.allowed, "login.microsoftonline.com", "graph.microsoft.com")
+	}
+	if config.Apple.ClientID != "" {
+		p.allowed = append(p.allowed, "appleid.apple.com")
+	}
+	if endpoint, _ := otlpEndpointFromEnv(); endpoint != "" {
+		host, _, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			host = endpoint
+		}
+		p.allowed = append(p.allowed, host)
+	}
+	return p, nil
+}
+
+// allows reports whether requests to host are allowed.
+func (p *egressPolicy) allows(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.allowed {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// transport wraps base, rejecting requests to hosts which are not
+// allowed, including redirects. Violations are logged, and requests are
+// let through if the policy is report-only.
+func (p *egressPolicy) transport(base http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		host := req.URL.Hostname()
+		if p.allows(host) {
+			return base.RoundTrip(req)
+		}
+		p.violations.Add(req.Context(), 1, metric.WithAttributes(
+			attribute.String("server.address", host),
+			attribute.Bool("egress.blocked", !p.reportOnly),
+		))
+		p.logger.Warn(
+			"outbound request to host not allowed by egress policy",
+			append(
+				traceLogFields(req.Context()),
+				zap.String("server.address", host),
+				zap.String("http.request.method", req.Method),
+				zap.String("url.path", req.URL.Path),
+				zap.Bool("egress.blocked", !p.reportOnly),
+			)...,
+		)
+		if p.reportOnly {
+			return base.RoundTrip(req)
+		}
+		return nil, permanent(fmt.Errorf("%w: %s", errEgressDenied, host))
+	})
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// envelope is the object JSON responses are wrapped in when api.envelope
+// is enabled: the response in Data, and errors, including those written as
+// text or with writeError, in Errors.
+type envelope struct {
+	Data   json.RawMessage `json:"data"`
+	Meta   envelopeMeta    `json:"meta"`
+	Errors []envelopeError `json:"errors"`
+}
+
+// envelopeMeta holds metadata of a response: the ID of its trace, and the
+// link to the next page of lists, as otherwise only found in headers.
+type envelopeMeta struct {
+	TraceID string `json:"trace_id,omitempty"`
+	Next    string `json:"next,omitempty"`
+}
+
+type envelopeError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// envelopeMiddleware wraps JSON responses in envelopes, and turns error
+// responses, as written by writeError or http.Error, into envelopes with
+// the error. Other responses, such as downloads, SCIM responses, and those
+// without a body, are written as is. JSON bodies are streamed into the
+// envelope rather than buffered, but for those of errors.
+func envelopeMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ew := &envelopeWriter{ResponseWriter: w, r: r}
+		h.ServeHTTP(ew, r)
+		ew.finish()
+	})
+}
+
+// envelopeWriter decides how to write a response once its header is
+// written: as is, streaming a JSON body into an envelope, or buffering an
+// error to write in an envelope when the handler returns.
+type envelopeWriter struct {
+	http.ResponseWriter
+	r      *http.Request
+	status int
+	mode   envelopeMode
+
+	// started reports whether the start of the envelope was written, with
+	// the first write of the body.
+	started bool
+	errBody bytes.Buffer
+}
+
+type envelopeMode int
+
+const (
+	envelopeUndecided envelopeMode = iota
+	envelopeNone
+	envelopeData
+	envelopeErrorJSON
+	envelopeErrorText
+)
+
+func (w *envelopeWriter) WriteHeader(status int) {
+	if w.mode != envelopeUndecided || status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	switch {
+	case status == http.StatusNoContent || status == http.StatusNotModified:
+		w.mode = envelopeNone
+	case mediaType == "application/json" && status >= http.StatusBadRequest:
+		w.mode = envelopeErrorJSON
+	case mediaType == "application/json":
+		w.mode = envelopeData
+	case status >= http.StatusBadRequest && (mediaType == "text/plain" || mediaType == ""):
+		w.mode = envelopeErrorText
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		w.mode = envelopeNone
+	}
+	if w.mode != envelopeNone {
+		w.Header().Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *envelopeWriter) Write(b []byte) (int, error) {
+	if w.mode == envelopeUndecided {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch w.mode {
+	case envelopeData:
+		if !w.started {
+			w.started = true
+			if _, err := w.ResponseWriter.Write([]byte(`{"data":`)); err != nil {
+				return 0, err
+			}
+		}
+	case envelopeErrorJSON, envelopeErrorText:
+		return w.errBody.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *envelopeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes the rest of the envelope, once the handler has returned.
+func (w *envelopeWriter) finish() {
+	meta := envelopeMeta{Next: nextLink(w.Header())}
+	if sc := trace.SpanContextFromContext(w.r.Context()); sc.HasTraceID() {
+		meta.TraceID = sc.TraceID().String()
+	}
+	errs := []envelopeError{}
+	data := json.RawMessage("null")
+	switch {
+	case w.mode == envelopeErrorJSON:
+		e, rest := splitErrorBody(w.errBody.Bytes())
+		if e.Message == "" {
+			e.Message = http.StatusText(w.status)
+		}
+		errs = append(errs, envelopeError{Status: w.status, Code: e.Code, Message: e.Message})
+		if rest != nil {
+			data = rest
+		}
+	case w.status >= http.StatusBadRequest:
+		message := strings.TrimSpace(w.errBody.String())
+		if w.mode == envelopeData || message == "" {
+			message = http.StatusText(w.status)
+		}
+		errs = append(errs, envelopeError{Status: w.status, Message: message})
+	}
+
+	switch w.mode {
+	case envelopeData:
+		if !w.started {
+			w.ResponseWriter.Write([]byte(`{"data":null`))
+		}
+		rest, _ := json.Marshal(struct {
+			Meta   envelopeMeta    `json:"meta"`
+			Errors []envelopeError `json:"errors"`
+		}{meta, errs})
+		// The object is spliced after data, replacing its opening brace.
+		w.ResponseWriter.Write(append([]byte{','}, rest[1:]...))
+	case envelopeErrorJSON, envelopeErrorText:
+		json.NewEncoder(w.ResponseWriter).Encode(envelope{Data: data, Meta: meta, Errors: errs})
+	}
+}
+
+// splitErrorBody splits a JSON error body into its error, as written by
+// writeError, and the rest of the body, such as the confirmation token of
+// confirmation errors, which is nil when there is nothing else or the body
+// is not JSON. Bodies of other errors are the rest as a whole.
+func splitErrorBody(body []byte) (apiError, json.RawMessage) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		if !json.Valid(body) {
+			return apiError{}, nil
+		}
+		return apiError{}, body
+	}
+	var e apiError
+	if err := json.Unmarshal(fields["error"], &e); err != nil || e.Code == "" {
+		return apiError{}, body
+	}
+	delete(fields, "error")
+	if len(fields) == 0 {
+		return e, nil
+	}
+	rest, _ := json.Marshal(fields)
+	return e, rest
+}
+
+// nextLink returns the target of the Link header with rel="next", if any.
+func nextLink(h http.Header) string {
+	for _, value := range h.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+			if ok && strings.Contains(params, `rel="next"`) {
+				return strings.Trim(strings.TrimSpace(target), "<>")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// apiError is the error of an error response: a code, which clients may
+// rely on, a message, for people, and the ID of the request's trace, to
+// look it up.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// errorResponse is the body of error responses.
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+// errorCode returns the code of errors with a status: its text in snake
+// case, such as "not_found".
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return (c < 'a' || c > 'z') && (c < '0' || c > '9')
+	}), "_")
+}
+
+// newAPIError returns the error with the code and message, for the trace
+// of r.
+func newAPIError(r *http.Request, code, message string) apiError {
+	e := apiError{Code: code, Message: message}
+	if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+		e.TraceID = sc.TraceID().String()
+	}
+	return e
+}
+
+// writeError replies to r with an error with the status and message, as
+// {"error": {"code", "message", "trace_id"}}. Like http.Error, it leaves
+// other headers as they are, and the handler should write nothing more.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeErrorBody(w, status, errorResponse{newAPIError(r, errorCode(status), message)})
+}
+
+// writeErrorBody replies with an error response, which may embed
+// errorResponse to tell clients more, as the confirmation of dangerous
+// actions does.
+func writeErrorBody(w http.ResponseWriter, status int, body any) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// muxErrors replies with JSON errors to requests which match no route of
+// mux, which replies to them with text: 404 Not Found, or 405 Method Not
+// Allowed with the methods of the path in Allow.
+func muxErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		mw := &muxErrorWriter{ResponseWriter: w}
+		mux.ServeHTTP(mw, r)
+		if mw.status != 0 {
+			writeError(w, r, mw.status, http.StatusText(mw.status))
+		}
+	})
+}
+
+// muxErrorWriter drops the error responses of a mux, keeping their status,
+// and writes others, such as redirects to clean paths, as is.
+type muxErrorWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *muxErrorWriter) WriteHeader(status int) {
+	if status >= http.StatusBadRequest {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *muxErrorWriter) Write(b []byte) (int, error) {
+	if w.status != 0 {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
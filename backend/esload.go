@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+const (
+	// loadPageSize is the number of documents loadAll fetches at a time.
+	loadPageSize = 1000
+
+	// loadScrollKeepAlive is how long Elasticsearch keeps the scroll
+	// context of loadAll between pages.
+	loadScrollKeepAlive = time.Minute
+)
+
+// loadedHit is a document of an index loaded by loadAll.
+type loadedHit struct {
+	ID          string          `json:"_id"`
+	SeqNo       int             `json:"_seq_no"`
+	PrimaryTerm int             `json:"_primary_term"`
+	Source      json.RawMessage `json:"_source"`
+}
+
+// loadAll passes each document of index to fn, scrolling through it a page
+// at a time, so that stores loading an index into memory load all of it,
+// however many documents it holds. A missing index has no documents. Any
+// other failure is returned, so that a store does not start with part of
+// its documents.
+func loadAll(ctx context.Context, client *elasticsearch.Client, index string, fn func(hit loadedHit) error) error {
+	res, err := client.Search(
+		client.Search.WithContext(ctx),
+		client.Search.WithIndex(index),
+		client.Search.WithSize(loadPageSize),
+		client.Search.WithSort("_doc"),
+		client.Search.WithSeqNoPrimaryTerm(true),
+		client.Search.WithScroll(loadScrollKeepAlive),
+	)
+	if err != nil {
+		return fmt.Errorf("while loading %s: %w", index, err)
+	}
+	var scrollID string
+	defer func() {
+		if scrollID == "" {
+			return
+		}
+		res, err := client.ClearScroll(client.ClearScroll.WithContext(ctx), client.ClearScroll.WithScrollID(scrollID))
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	for {
+		if res.StatusCode == http.StatusNotFound && scrollID == "" {
+			res.Body.Close()
+			return nil
+		}
+		if res.IsError() {
+			res.Body.Close()
+			return fmt.Errorf("while loading %s: %s", index, res.Status())
+		}
+		var page struct {
+			ScrollID string `json:"_scroll_id"`
+			Hits     struct {
+				Hits []loadedHit `json:"hits"`
+			} `json:"hits"`
+		}
+		err := json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("while loading %s: %w", index, err)
+		}
+		scrollID = page.ScrollID
+		for _, hit := range page.Hits.Hits {
+			if err := fn(hit); err != nil {
+				return fmt.Errorf("while loading %s document %q: %w", index, hit.ID, err)
+			}
+		}
+		if len(page.Hits.Hits) < loadPageSize || scrollID == "" {
+			return nil
+		}
+		res, err = client.Scroll(
+			client.Scroll.WithContext(ctx),
+			client.Scroll.WithScrollID(scrollID),
+			client.Scroll.WithScroll(loadScrollKeepAlive),
+		)
+		if err != nil {
+			return fmt.Errorf("while loading %s: %w", index, err)
+		}
+	}
+}
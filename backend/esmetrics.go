@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// esTookPrefixSize is how much of a response body is kept to find the
+// time Elasticsearch took to run the request, which it reports first.
+const esTookPrefixSize = 64
+
+var esTookField = []byte(`"took":`)
+
+// esMetrics records metrics about the requests made by the Elasticsearch
+// client: their duration, the time Elasticsearch reports having taken to
+// run them, how often they were retried, and how often they failed, by
+// endpoint and status. It
+// also logs requests slower than a threshold, as Elasticsearch latency is
+// the main performance unknown of apps built on the scaffold.
+type esMetrics struct {
+	logger        *zap.Logger
+	slowThreshold time.Duration
+	duration      metric.Float64Histogram
+	took          metric.Float64Histogram
+	retries       metric.Int64Counter
+	errors        metric.Int64Counter
+}
+
+func newESMetrics(config *appConfig, logger *zap.Logger) (*esMetrics, error) {
+	meter := otel.Meter("main")
+	duration, err := meter.Float64Histogram(
+		"app.elasticsearch.duration",
+		metric.WithDescription("Duration of Elasticsearch requests, including retries"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	took, err := meter.Float64Histogram(
+		"app.elasticsearch.took",
+		metric.WithDescription("Time Elasticsearch reports having taken to run requests"),
+		metric.WithUnit("ms"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	retries, err := meter.Int64Counter(
+		"app.elasticsearch.retries",
+		metric.WithDescription("Retried Elasticsearch requests, by endpoint"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	errs, err := meter.Int64Counter(
+		"app.elasticsearch.errors",
+		metric.WithDescription("Elasticsearch requests which failed, were rejected, or got a server error, by endpoint"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &esMetrics{
+		logger:        logger,
+		slowThreshold: config.Elasticsearch.SlowThreshold,
+		duration:      duration,
+		took:          took,
+		retries:       retries,
+		errors:        errs,
+	}, nil
+}
+
+type esAttemptsKey struct{}
+
+// transport records the requests sent through base. It goes outside of
+// the retrying transport, which goes outside of attempts.
+func (m *esMetrics) transport(base http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts := new(atomic.Int64)
+		req = req.WithContext(context.WithValue(req.Context(), esAttemptsKey{}, attempts))
+		start := time.Now()
+		res, err := base.RoundTrip(req)
+		if err != nil {
+			m.record(req, start, 0, attempts.Load(), -1)
+			return nil, err
+		}
+		res.Body = &esResponseBody{ReadCloser: res.Body, done: func(took int64) {
+			m.record(req, start, res.StatusCode, attempts.Load(), took)
+		}}
+		return res, nil
+	})
+}
+
+// attempts counts the attempts at sending requests through base, for
+// transport to report retries.
+func (m *esMetrics) attempts(base http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if attempts, ok := req.Context().Value(esAttemptsKey{}).(*atomic.Int64); ok {
+			attempts.Add(1)
+		}
+		return base.RoundTrip(req)
+	})
+}
+
+// record records a request answered with status, or failed if status is
+// 0, once its response was read. took is -1 when not reported.
+func (m *esMetrics) record(req *http.Request, start time.Time, status int, attempts, took int64) {
+	elapsed := time.Since(start)
+	index, endpoint := esEndpoint(req.Method, req.URL.Path)
+	attrs := []attribute.KeyValue{
+		attribute.String("elasticsearch.endpoint", endpoint),
+		attribute.String("elasticsearch.index", index),
+	}
+	if status == 0 {
+		attrs = append(attrs, attribute.String("error.type", "transport"))
+	} else {
+		attrs = append(attrs, attribute.Int("http.response.status_code", status))
+	}
+	ctx := req.Context()
+	m.duration.Record(ctx, elapsed.Seconds(), metric.WithAttributes(attrs...))
+	if took >= 0 {
+		m.took.Record(ctx, float64(took), metric.WithAttributes(attrs...))
+	}
+	if attempts > 1 {
+		m.retries.Add(ctx, attempts-1, metric.WithAttributes(attrs[:2]...))
+	}
+	// Client errors other than rejections, such as missing documents and
+	// version conflicts, are answers rather than failures.
+	if status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError {
+		m.errors.Add(ctx, 1, metric.WithAttributes(attrs...))
+	}
+
+	if m.slowThreshold > 0 && elapsed >= m.slowThreshold {
+		fields := []zap.Field{
+			zap.String("elasticsearch.endpoint", endpoint),
+			zap.String("elasticsearch.index", index),
+			zap.String("url.path", req.URL.Path),
+			zap.Int("http.response.status_code", status),
+			zap.Duration("duration", elapsed),
+			zap.Int64("attempts", attempts),
+		}
+		if took >= 0 {
+			fields = append(fields, zap.Duration("elasticsearch.took", time.Duration(took)*time.Millisecond))
+		}
+		m.logger.Warn("slow Elasticsearch request", fields...)
+	}
+}
+
+// esEndpoint returns the index and the endpoint a request is made to, such
+// as "app-sessions" and "GET _doc", so that metrics are not broken down by
+// document ID. The endpoint is the method followed by the first path
+// segment starting with "_", or "index" for requests to an index itself.
+func esEndpoint(method, path string) (index, endpoint string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if segments[0] != "" && !strings.HasPrefix(segments[0], "_") {
+		index = segments[0]
+	}
+	for _, segment := range segments {
+		if strings.HasPrefix(segment, "_") {
+			return index, method + " " + segment
+		}
+	}
+	if index != "" {
+		return index, method + " index"
+	}
+	return index, method + " /"
+}
+
+// esResponseBody keeps the start of a response body as it is read, to find
+// the time Elasticsearch took, and reports it once the body is closed.
+type esResponseBody struct {
+	io.ReadCloser
+	prefix []byte
+	done   func(took int64)
+	closed bool
+}
+
+func (b *esResponseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if missing := esTookPrefixSize - len(b.prefix); missing > 0 {
+		b.prefix = append(b.prefix, p[:min(n, missing)]...)
+	}
+	return n, err
+}
+
+func (b *esResponseBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.closed {
+		b.closed = true
+		b.done(esTook(b.prefix))
+	}
+	return err
+}
+
+// esTook returns the took field at the start of a response body, or -1.
+func esTook(prefix []byte) int64 {
+	i := bytes.Index(prefix, esTookField)
+	if i < 0 {
+		return -1
+	}
+	digits := prefix[i+len(esTookField):]
+	end := 0
+	for end < len(digits) && digits[end] >= '0' && digits[end] <= '9' {
+		end++
+	}
+	took, err := strconv.ParseInt(string(digits[:end]), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return took
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// defaultConfigMaxAge is how long /api/config may be used without
+// revalidation, unless configured otherwise.
+const defaultConfigMaxAge = 5 * time.Minute
+
+// buildVersion returns the VCS revision the backend was built from, if
+// known: builds outside of a repository, and go run, have none.
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return ""
+}
+
+// contentETag returns a strong ETag for a response body, which changes
+// with the body and with the build, so that caches pick up changes to the
+// response's format after a deploy even if the body is unchanged.
+func contentETag(version string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(version))
+	h.Write([]byte{0})
+	h.Write(body)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag,
+// comparing weakly, as RFC 9110 requires of If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCacheable writes a JSON body which browsers and proxies may cache
+// for maxAge, then revalidate with its ETag, answering with 304 Not
+// Modified if they still hold it.
+func serveCacheable(w http.ResponseWriter, r *http.Request, body []byte, etag string, maxAge time.Duration) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
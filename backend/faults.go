@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// faultRule configures the faults injected into requests to a route.
+// Percentages are in the range 0-100, and are applied independently.
+type faultRule struct {
+	// LatencyPercent of requests are delayed by Latency.
+	LatencyPercent float64       `yaml:"latency_percent"`
+	Latency        time.Duration `yaml:"latency"`
+
+	// ErrorPercent of requests fail with ErrorStatus (default 503),
+	// without reaching the handler.
+	ErrorPercent float64 `yaml:"error_percent"`
+	ErrorStatus  int     `yaml:"error_status"`
+
+	// DropPercent of requests have their connection dropped, without
+	// a response.
+	DropPercent float64 `yaml:"drop_percent"`
+}
+
+// faultInjector injects latency, errors, and dropped connections into
+// requests, so that frontend retry and error handling can be exercised.
+// It is meant for development only.
+type faultInjector struct {
+	rules  map[string]faultRule
+	logger *zap.Logger
+	chance func() float64
+}
+
+func newFaultInjector(rules map[string]faultRule, logger *zap.Logger) *faultInjector {
+	return &faultInjector{
+		rules:  rules,
+		logger: logger,
+		chance: func() float64 { return rand.Float64() * 100 },
+	}
+}
+
+// rule returns the rule for a request. Rules are keyed by "METHOD /path";
+// keys ending in "*" match by prefix, and "*" matches all requests. The
+// most specific rule applies.
+func (f *faultInjector) rule(r *http.Request) (faultRule, bool) {
+	key := r.Method + " " + r.URL.Path
+	if rule, ok := f.rules[key]; ok {
+		return rule, true
+	}
+	var match string
+	for pattern := range f.rules {
+		prefix, ok := strings.CutSuffix(pattern, "*")
+		if ok && strings.HasPrefix(key, prefix) && len(pattern) > len(match) {
+			match = pattern
+		}
+	}
+	if match == "" {
+		return faultRule{}, false
+	}
+	return f.rules[match], true
+}
+
+func (f *faultInjector) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := f.rule(r)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		logger := f.logger.With(zap.String("http.request.method", r.Method), zap.String("url.path", r.URL.Path))
+
+		if rule.LatencyPercent > 0 && f.chance() < rule.LatencyPercent {
+			logger.Debug("injecting latency", zap.Duration("latency", rule.Latency))
+			w.Header().Add("X-Fault-Injected", "latency")
+			select {
+			case <-time.After(rule.Latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if rule.DropPercent > 0 && f.chance() < rule.DropPercent {
+			logger.Debug("injecting dropped connection")
+			// Aborting the handler makes the server close the
+			// connection without writing a response.
+			panic(http.ErrAbortHandler)
+		}
+		if rule.ErrorPercent > 0 && f.chance() < rule.ErrorPercent {
+			status := rule.ErrorStatus
+			if status == 0 {
+				status = http.StatusServiceUnavailable
+			}
+			logger.Debug("injecting error", zap.Int("http.response.status_code", status))
+			w.Header().Add("X-Fault-Injected", "error")
+			writeError(w, r, status, "injected fault: "+http.StatusText(status))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// fieldSelection holds the fields of list items requested with the
+// "fields" query parameter, by JSON name. A nil selection selects all
+// fields. Field names are those of the items' documents, so list endpoints
+// backed by an Elasticsearch search can pass the selection on as
+// _source_includes rather than fetching whole documents.
+type fieldSelection []string
+
+// parseFields parses the comma-separated "fields" query parameter of r,
+// validating the names against the JSON fields of T.
+func parseFields[T any](r *http.Request) (fieldSelection, error) {
+	param := r.URL.Query().Get("fields")
+	if param == "" {
+		return nil, nil
+	}
+	return selectFields[T](strings.Split(param, ","))
+}
+
+// selectFields returns the selection of the named fields of T, rejecting
+// unknown names.
+func selectFields[T any](names []string) (fieldSelection, error) {
+	known := jsonFieldNames(reflect.TypeFor[T]())
+	var fields fieldSelection
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(known, name) {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		if !slices.Contains(fields, name) {
+			fields = append(fields, name)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields selected")
+	}
+	return fields, nil
+}
+
+// jsonFieldNames returns the names of the fields of struct type t as
+// encoded by encoding/json, including those of embedded structs.
+func jsonFieldNames(t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		switch {
+		case name == "-":
+		case field.Anonymous && name == "":
+			names = append(names, jsonFieldNames(field.Type)...)
+		case field.IsExported():
+			if name == "" {
+				name = field.Name
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// project returns items, a slice, with only the selected fields of each.
+func (f fieldSelection) project(items any) (any, error) {
+	if f == nil {
+		return items, nil
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	var docs []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &docs); err != nil {
+		return nil, err
+	}
+	if docs == nil {
+		docs = []map[string]json.RawMessage{}
+	}
+	for _, doc := range docs {
+		for name := range doc {
+			if !slices.Contains(f, name) {
+				delete(doc, name)
+			}
+		}
+	}
+	return docs, nil
+}
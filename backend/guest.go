@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.uber.org/zap"
+)
+
+// Principal types, distinguishing guests from signed-in users.
+const (
+	principalUser  = "user"
+	principalGuest = "guest"
+)
+
+// guestSessionTTL bounds guest sessions, which are cheap to renew.
+const guestSessionTTL = 24 * time.Hour
+
+// defaultGuestEndpoints are the paths guests may read by default.
+var defaultGuestEndpoints = []string{"/api/data"}
+
+// guestPolicy decides which endpoints guests may call: only reads of the
+// configured endpoints, matched by route path pattern.
+type guestPolicy struct {
+	endpoints []string
+
+	// clock tells when guest sessions are issued, and ids generates the
+	// user IDs of guests.
+	clock clock
+	ids   idSource
+}
+
+func newGuestPolicy(config *appConfig) *guestPolicy {
+	if !config.Guest.Enabled {
+		return nil
+	}
+	endpoints := config.Guest.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = defaultGuestEndpoints
+	}
+	return &guestPolicy{endpoints: endpoints, clock: systemClock{}, ids: cryptoIDs{}}
+}
+
+// allows reports whether a guest may make a request. Requests are denied
+// if guest mode is disabled.
+func (p *guestPolicy) allows(r *http.Request) bool {
+	if p == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	rt := routeFromContext(r.Context())
+	return rt != nil && slices.Contains(p.endpoints, rt.Path)
+}
+
+// issueGuestSession mints a session token for a new guest, with a distinct
+// user ID so that guests' usage can be told apart.
+func issueGuestSession(key []byte, ids idSource, now time.Time) (string, string, error) {
+	id := make([]byte, 16)
+	if _, err := ids.Read(id); err != nil {
+		return "", "", err
+	}
+	userID := "guest-" + hex.EncodeToString(id)
+	token, err := signLocalSession(key, jwt.MapClaims{
+		"sub":       userID,
+		"name":      "Guest",
+		"principal": principalGuest,
+		"exp":       now.Add(guestSessionTTL).Unix(),
+	}, now)
+	return token, userID, err
+}
+
+// registerGuestRoutes registers POST /api/guest, which starts a guest
+// session, if guest mode is enabled.
+func registerGuestRoutes(
+	routes *routeRegistry,
+	guests *guestPolicy,
+	secureCookies secureCookies,
+	binding *sessionBinding,
+	security *securityEvents,
+	logger *zap.Logger,
+) {
+	if guests == nil {
+		return
+	}
+	routes.group(groupPublic).POST("/api/guest", func(w http.ResponseWriter, r *http.Request) {
+		now := guests.clock.Now()
+		token, userID, err := issueGuestSession(localSessionKey(secureCookies.keys()), guests.ids, now)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		cookieValue, err := secureCookies.Encode(token)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+			return
+		}
+		if err := binding.set(w, r, token, now.Add(guestSessionTTL)); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     "credentials",
+			Path:     credentialsCookiePath,
+			Value:    cookieValue,
+			Secure:   true,
+			HttpOnly: true,
+			Expires:  now.Add(guestSessionTTL),
+		})
+		security.record(r, securityEventGuestSession, reasonSuccess, userID)
+		logger.Info("guest session started", append(traceLogFields(r.Context()), zap.String("user.id", userID))...)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
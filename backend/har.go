@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	harPath = "/api/admin/debug/har"
+
+	defaultHARCapacity     = 200
+	defaultHARMaxBodyBytes = 64 << 10
+
+	redacted = "[REDACTED]"
+)
+
+// sensitiveHeaders are replaced with redacted when capturing requests.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Captcha-Token":     true,
+	"X-Api-Key":           true,
+}
+
+// sensitiveFieldMarkers redact JSON body fields whose names contain them.
+var sensitiveFieldMarkers = []string{"token", "secret", "password", "code", "credential", "assertion"}
+
+// HAR 1.2 types; see http://www.softwareishard.com/blog/har-12-spec/.
+type (
+	harLog struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	}
+	harCreator struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	harEntry struct {
+		StartedDateTime time.Time   `json:"startedDateTime"`
+		Time            float64     `json:"time"`
+		Request         harRequest  `json:"request"`
+		Response        harResponse `json:"response"`
+		Cache           struct{}    `json:"cache"`
+		Timings         harTimings  `json:"timings"`
+	}
+	harRequest struct {
+		Method      string         `json:"method"`
+		URL         string         `json:"url"`
+		HTTPVersion string         `json:"httpVersion"`
+		Headers     []harNameValue `json:"headers"`
+		QueryString []harNameValue `json:"queryString"`
+		Cookies     []harNameValue `json:"cookies"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int64          `json:"bodySize"`
+		PostData    *harPostData   `json:"postData,omitempty"`
+	}
+	harResponse struct {
+		Status      int            `json:"status"`
+		StatusText  string         `json:"statusText"`
+		HTTPVersion string         `json:"httpVersion"`
+		Headers     []harNameValue `json:"headers"`
+		Cookies     []harNameValue `json:"cookies"`
+		Content     harContent     `json:"content"`
+		RedirectURL string         `json:"redirectURL"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int64          `json:"bodySize"`
+	}
+	harNameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	harPostData struct {
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+	}
+	harContent struct {
+		Size     int64  `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text,omitempty"`
+		Comment  string `json:"comment,omitempty"`
+	}
+	harTimings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
+
+// harCapture records sanitized request/response pairs into a ring buffer,
+// for debugging frontend/backend interactions.
+type harCapture struct {
+	maxBodyBytes int64
+
+	mu      sync.Mutex
+	entries *ringBuffer[harEntry]
+}
+
+func newHARCapture(capacity int, maxBodyBytes int64) *harCapture {
+	if capacity <= 0 {
+		capacity = defaultHARCapacity
+	}
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = defaultHARMaxBodyBytes
+	}
+	return &harCapture{maxBodyBytes: maxBodyBytes, entries: newRingBuffer[harEntry](capacity)}
+}
+
+// harResponseWriter captures the status and the start of the body.
+type harResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+	body   bytes.Buffer
+	limit  int64
+}
+
+func (w *harResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *harResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if remaining := w.limit - int64(w.body.Len()); remaining > 0 {
+		w.body.Write(b[:min(int64(len(b)), remaining)])
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *harResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (c *harCapture) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, harPath) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+
+		var requestBody []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			requestBody, _ = io.ReadAll(io.LimitReader(r.Body, c.maxBodyBytes))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(requestBody), r.Body), r.Body}
+		}
+
+		rw := &harResponseWriter{ResponseWriter: w, limit: c.maxBodyBytes}
+		defer func() {
+			// Record the entry even if the handler aborts the request.
+			c.record(r, rw, requestBody, start)
+		}()
+		h.ServeHTTP(rw, r)
+	})
+}
+
+func (c *harCapture) record(r *http.Request, rw *harResponseWriter, requestBody []byte, start time.Time) {
+	elapsed := float64(time.Since(start).Microseconds()) / 1000
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	entry := harEntry{
+		StartedDateTime: start.UTC(),
+		Time:            elapsed,
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         scheme + "://" + r.Host + r.URL.RequestURI(),
+			HTTPVersion: r.Proto,
+			Headers:     harHeaders(r.Header),
+			QueryString: []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    r.ContentLength,
+		},
+		Response: harResponse{
+			Status:      rw.status,
+			StatusText:  http.StatusText(rw.status),
+			HTTPVersion: r.Proto,
+			Headers:     harHeaders(rw.Header()),
+			Cookies:     []harNameValue{},
+			Content: harContent{
+				Size:     rw.size,
+				MimeType: rw.Header().Get("Content-Type"),
+			},
+			HeadersSize: -1,
+			BodySize:    rw.size,
+		},
+		Timings: harTimings{Wait: elapsed},
+	}
+	for name, values := range r.URL.Query() {
+		for _, value := range values {
+			if isSensitiveField(name) {
+				value = redacted
+			}
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{name, value})
+		}
+	}
+	if len(requestBody) > 0 {
+		mimeType := r.Header.Get("Content-Type")
+		entry.Request.PostData = &harPostData{MimeType: mimeType, Text: sanitizeBody(mimeType, requestBody)}
+	}
+	if rw.body.Len() > 0 {
+		entry.Response.Content.Text = sanitizeBody(entry.Response.Content.MimeType, rw.body.Bytes())
+		if int64(rw.body.Len()) < rw.size {
+			entry.Response.Content.Comment = "truncated"
+		}
+	}
+
+	c.mu.Lock()
+	c.entries.push(entry)
+	c.mu.Unlock()
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+				value = redacted
+			}
+			headers = append(headers, harNameValue{name, value})
+		}
+	}
+	return headers
+}
+
+func isSensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	for _, marker := range sensitiveFieldMarkers {
+		if strings.Contains(name, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeBody redacts sensitive fields from JSON bodies, and omits
+// non-textual bodies.
+func sanitizeBody(contentType string, body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			// Likely truncated; sensitive fields cannot be
+			// reliably redacted, so omit the body.
+			return "[unparseable JSON omitted]"
+		}
+		sanitized, _ := json.Marshal(redactJSON(v))
+		return string(sanitized)
+	case mediaType == "application/x-www-form-urlencoded":
+		return redacted
+	case strings.HasPrefix(mediaType, "text/"):
+		return string(body)
+	default:
+		return ""
+	}
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if isSensitiveField(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactJSON(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactJSON(value)
+		}
+	}
+	return v
+}
+
+// harHandler serves GET /api/admin/debug/har, downloading the captured
+// entries as a HAR file.
+func harHandler(capture *harCapture) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		capture.mu.Lock()
+		entries := capture.entries.all()
+		capture.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+serviceName+`.har"`)
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			Log harLog `json:"log"`
+		}{harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: serviceName, Version: "1.0"},
+			Entries: entries,
+		}})
+	}
+}
+
+// harClearHandler serves DELETE /api/admin/debug/har.
+func harClearHandler(capture *harCapture) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		capture.mu.Lock()
+		defer capture.mu.Unlock()
+		if dryRun(w, r, mutationEffect{DocumentsAffected: capture.entries.len()}) {
+			return
+		}
+		capture.entries = newRingBuffer[harEntry](len(capture.entries.items))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	healthHistoryIndex = "app-health-history"
+
+	healthCheckInterval    = time.Minute
+	healthCheckTimeout     = 5 * time.Second
+	healthHistoryRetention = 7 * 24 * time.Hour
+
+	healthStatusUp   = "up"
+	healthStatusDown = "down"
+)
+
+// uptimeWindows are the windows over which uptime is reported.
+var uptimeWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+}
+
+// healthResult is the outcome of a single dependency check, as indexed
+// into Elasticsearch.
+type healthResult struct {
+	Timestamp  time.Time `json:"@timestamp"`
+	Dependency string    `json:"dependency"`
+	Status     string    `json:"status"`
+	LatencyMS  float64   `json:"latency_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthMonitor periodically checks the backend's dependencies, keeping
+// a history of results in memory, and in Elasticsearch when configured.
+type healthMonitor struct {
+	client *elasticsearch.Client
+	logger *zap.Logger
+	checks []healthCheck
+
+	// reads coalesces identical concurrent uptime queries.
+	reads *readCoalescer
+
+	mu      sync.RWMutex
+	history map[string]*ringBuffer[healthResult]
+}
+
+func newHealthMonitor(client *elasticsearch.Client, logger *zap.Logger) *healthMonitor {
+	return &healthMonitor{
+		client:  client,
+		logger:  logger,
+		history: make(map[string]*ringBuffer[healthResult]),
+	}
+}
+
+// register adds a dependency check. It must be called before start.
+func (m *healthMonitor) register(name string, check func(ctx context.Context) error) {
+	m.checks = append(m.checks, healthCheck{name, check})
+	m.history[name] = newRingBuffer[healthResult](int(healthHistoryRetention / healthCheckInterval))
+}
+
+// start runs all checks immediately, and then every healthCheckInterval
+// until ctx is done.
+func (m *healthMonitor) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			m.runChecks(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runChecks runs all checks concurrently and records their results.
+func (m *healthMonitor) runChecks(ctx context.Context) []healthResult {
+	ctx, span := otel.Tracer("main").Start(ctx, "healthChecks")
+	defer span.End()
+
+	results := make([]healthResult, len(m.checks))
+	var wg sync.WaitGroup
+	for i, c := range m.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = m.runCheck(ctx, c)
+		}()
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	for _, result := range results {
+		m.history[result.Dependency].push(result)
+	}
+	m.mu.Unlock()
+
+	if m.client != nil {
+		for _, result := range results {
+			m.index(ctx, result)
+		}
+	}
+	return results
+}
+
+func (m *healthMonitor) runCheck(ctx context.Context, c healthCheck) healthResult {
+	ctx, span := otel.Tracer("main").Start(ctx, "healthCheck "+c.name)
+	defer span.End()
+	span.SetAttributes(attribute.String("dependency", c.name))
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := c.check(ctx)
+	result := healthResult{
+		Timestamp:  start.UTC(),
+		Dependency: c.name,
+		Status:     healthStatusUp,
+		LatencyMS:  float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = healthStatusDown
+		result.Error = err.Error()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		m.logger.Warn(
+			"dependency health check failed",
+			append(traceLogFields(ctx), zap.String("dependency", c.name), zap.Error(err))...,
+		)
+	}
+	return result
+}
+
+func (m *healthMonitor) index(ctx context.Context, result healthResult) {
+	res, err := m.client.Index(
+		healthHistoryIndex, esutil.NewJSONReader(result),
+		m.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		m.logger.Warn("failed to index health check result", zap.Error(err))
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		m.logger.Warn("failed to index health check result", zap.String("status", res.Status()))
+	}
+}
+
+// latest returns the most recent result of each check, and whether all
+// dependencies are up.
+func (m *healthMonitor) latest() (map[string]*healthResult, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	latest := make(map[string]*healthResult, len(m.history))
+	ok := true
+	for name, history := range m.history {
+		results := history.all()
+		if len(results) == 0 {
+			latest[name] = nil
+			continue
+		}
+		result := results[len(results)-1]
+		latest[name] = &result
+		ok = ok && result.Status == healthStatusUp
+	}
+	return latest, ok
+}
+
+// dependencyHistory reports a dependency's uptime percentages, and its
+// check results over the last hour.
+type dependencyHistory struct {
+	Uptime map[string]*float64 `json:"uptime"`
+	Recent []healthResult      `json:"recent"`
+}
+
+// uptime returns the uptime percentage of each dependency over each of
+// uptimeWindows, or nil where there are no results. Percentages come from
+// Elasticsearch if configured, so that they span restarts; otherwise from
+// this process's memory.
+func (m *healthMonitor) uptime(ctx context.Context) (map[string]map[string]*float64, error) {
+	uptime := make(map[string]map[string]*float64)
+	for _, c := range m.checks {
+		uptime[c.name] = make(map[string]*float64)
+		for _, window := range uptimeWindows {
+			uptime[c.name][window.name] = nil
+		}
+	}
+	percentage := func(up, total int64) *float64 {
+		if total == 0 {
+			return nil
+		}
+		p := float64(up) * 100 / float64(total)
+		return &p
+	}
+	if m.client != nil {
+		return coalesce(ctx, m.reads, "health.uptime", "", func(ctx context.Context) (map[string]map[string]*float64, error) {
+			return uptime, m.uptimeFromES(ctx, uptime, percentage)
+		})
+	}
+
+	now := time.Now()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for name, history := range m.history {
+		results := history.all()
+		for _, window := range uptimeWindows {
+			var up, total int64
+			for _, result := range results {
+				if result.Timestamp.Before(now.Add(-window.duration)) {
+					continue
+				}
+				total++
+				if result.Status == healthStatusUp {
+					up++
+				}
+			}
+			uptime[name][window.name] = percentage(up, total)
+		}
+	}
+	return uptime, nil
+}
+
+func (m *healthMonitor) uptimeFromES(
+	ctx context.Context,
+	uptime map[string]map[string]*float64,
+	percentage func(up, total int64) *float64,
+) error {
+	windowAggs := make(map[string]interface{})
+	for _, window := range uptimeWindows {
+		windowAggs[window.name] = map[string]interface{}{
+			"filter": map[string]interface{}{
+				"range": map[string]interface{}{
+					"@timestamp": map[string]interface{}{
+						"gte": fmt.Sprintf("now-%ds", int64(window.duration.Seconds())),
+					},
+				},
+			},
+			"aggs": map[string]interface{}{
+				"up": map[string]interface{}{
+					"filter": map[string]interface{}{
+						"term": map[string]interface{}{"status": healthStatusUp},
+					},
+				},
+			},
+		}
+	}
+	query := map[string]interface{}{
+		"size": 0,
+		"query": map[string]interface{}{
+			"range": map[string]interface{}{
+				"@timestamp": map[string]interface{}{
+					"gte": fmt.Sprintf("now-%ds", int64(healthHistoryRetention.Seconds())),
+				},
+			},
+		},
+		"aggs": map[string]interface{}{
+			"dependency": map[string]interface{}{
+				"terms": map[string]interface{}{"field": "dependency", "size": 100},
+				"aggs":  windowAggs,
+			},
+		},
+	}
+	res, err := m.client.Search(
+		m.client.Search.WithContext(ctx),
+		m.client.Search.WithIndex(healthHistoryIndex),
+		m.client.Search.WithBody(esutil.NewJSONReader(query)),
+		m.client.Search.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return errors.New("health history search failed: " + res.Status())
+	}
+
+	type windowBucket struct {
+		DocCount int64 `json:"doc_count"`
+		Up       struct {
+			DocCount int64 `json:"doc_count"`
+		} `json:"up"`
+	}
+	var result struct {
+		Aggregations struct {
+			Dependency struct {
+				Buckets []map[string]json.RawMessage `json:"buckets"`
+			} `json:"dependency"`
+		} `json:"aggregations"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return err
+	}
+	for _, bucket := range result.Aggregations.Dependency.Buckets {
+		var name string
+		if err := json.Unmarshal(bucket["key"], &name); err != nil {
+			return err
+		}
+		if uptime[name] == nil {
+			uptime[name] = make(map[string]*float64)
+		}
+		for _, window := range uptimeWindows {
+			var w windowBucket
+			if err := json.Unmarshal(bucket[window.name], &w); err != nil {
+				return err
+			}
+			uptime[name][window.name] = percentage(w.Up.DocCount, w.DocCount)
+		}
+	}
+	return nil
+}
+
+// historyReport returns the uptime and recent results of each dependency.
+func (m *healthMonitor) historyReport(ctx context.Context) (map[string]*dependencyHistory, error) {
+	uptime, err := m.uptime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := make(map[string]*dependencyHistory, len(uptime))
+	for name, u := range uptime {
+		report[name] = &dependencyHistory{Uptime: u, Recent: []healthResult{}}
+	}
+
+	cutoff := time.Now().Add(-time.Hour)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for name, history := range m.history {
+		results := history.all()
+		i := sort.Search(len(results), func(i int) bool { return results[i].Timestamp.After(cutoff) })
+		report[name].Recent = results[i:]
+	}
+	return report, nil
+}
+
+// healthHandler serves GET /api/admin/health, reporting the latest
+// result of each dependency check.
+func healthHandler(monitor *healthMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		latest, ok := monitor.latest()
+		result := struct {
+			Status       string                   `json:"status"`
+			Timestamp    string                   `json:"timestamp"`
+			Dependencies map[string]*healthResult `json:"dependencies"`
+		}{
+			Status:       "ok",
+			Timestamp:    time.Now().UTC().Format(time.RFC3339),
+			Dependencies: latest,
+		}
+		if !ok {
+			result.Status = "degraded"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// healthHistoryHandler serves GET /api/admin/health/history.
+func healthHistoryHandler(monitor *healthMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := monitor.historyReport(r.Context())
+		if err != nil {
+			writeError(w, r, http.StatusBadGateway, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Interval     string                        `json:"interval"`
+			Dependencies map[string]*dependencyHistory `json:"dependencies"`
+		}{healthCheckInterval.String(), report})
+	}
+}
+
+// elasticsearchHealthCheck pings the Elasticsearch cluster.
+func elasticsearchHealthCheck(client *elasticsearch.Client) func(context.Context) error {
+	return func(ctx context.Context) error {
+		res, err := client.Ping(client.Ping.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.IsError() {
+			return errors.New("ping failed: " + res.Status())
+		}
+		return nil
+	}
+}
+
+// httpHealthCheck requests the given URL, expecting a 2xx response.
+func httpHealthCheck(url string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			return errors.New("unexpected status: " + res.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	defaultHTTPCacheEntries = 1000
+
+	// maxCachedBodyBytes bounds the responses the outbound HTTP cache
+	// stores. Larger responses are passed through.
+	maxCachedBodyBytes = 1 << 20
+)
+
+// Outcomes of outbound requests through the HTTP cache, as recorded in
+// the app.http_cache.requests metric.
+const (
+	httpCacheHit         = "hit"
+	httpCacheMiss        = "miss"
+	httpCacheRevalidated = "revalidated"
+	httpCacheBypass      = "bypass"
+)
+
+// httpCache caches responses to outbound GET requests, such as those for
+// the signing keys (JWKS) of identity providers, in memory, as their
+// Cache-Control, Expires, ETag, and Last-Modified headers allow. Stale
+// responses with validators are revalidated with conditional requests.
+// Responses are keyed by URL and Authorization header, so that responses
+// for one user are never served to another.
+type httpCache struct {
+	maxEntries int
+	now        func() time.Time
+	requests   metric.Int64Counter
+
+	mu      sync.Mutex
+	entries map[string]*httpCacheEntry
+}
+
+type httpCacheEntry struct {
+	host       string
+	status     int
+	header     http.Header
+	body       []byte
+	storedAt   time.Time
+	expiresAt  time.Time
+	revalidate bool
+}
+
+// fresh reports whether the entry may be served without revalidation.
+func (e *httpCacheEntry) fresh(now time.Time) bool {
+	return !e.revalidate && now.Before(e.expiresAt)
+}
+
+// newHTTPCache returns the outbound HTTP cache, or nil if it is disabled.
+func newHTTPCache(config *appConfig) (*httpCache, error) {
+	if config.HTTPCache.Disabled {
+		return nil, nil
+	}
+	requests, err := otel.Meter("main").Int64Counter(
+		"app.http_cache.requests",
+		metric.WithDescription("Outbound GET requests through the HTTP cache by host and outcome"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c := &httpCache{
+		maxEntries: config.HTTPCache.MaxEntries,
+		now:        time.Now,
+		requests:   requests,
+		entries:    make(map[string]*httpCacheEntry),
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultHTTPCacheEntries
+	}
+	return c, nil
+}
+
+// transport returns a RoundTripper serving cached responses, and sending
+// other requests through base. A nil httpCache returns base.
+func (c *httpCache) transport(base http.RoundTripper) http.RoundTripper {
+	if c == nil {
+		return base
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return c.roundTrip(base, req)
+	})
+}
+
+func httpCacheKey(req *http.Request) string {
+	auth := sha256.Sum256([]byte(req.Header.Get("Authorization")))
+	return req.URL.String() + " " + hex.EncodeToString(auth[:])
+}
+
+func (c *httpCache) roundTrip(base http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" ||
+		strings.Contains(req.Header.Get("Cache-Control"), "no-cache") {
+		c.record(req, httpCacheBypass)
+		return base.RoundTrip(req)
+	}
+	key := httpCacheKey(req)
+	now := c.now()
+	c.mu.Lock()
+	entry := c.entries[key]
+	c.mu.Unlock()
+	if entry != nil && entry.fresh(now) {
+		c.record(req, httpCacheHit)
+		return entry.response(req), nil
+	}
+
+	if entry != nil {
+		etag, lastModified := entry.header.Get("ETag"), entry.header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			req = req.Clone(req.Context())
+			if etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				req.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotModified && entry != nil {
+		res.Body.Close()
+		updated := *entry
+		updated.header = entry.header.Clone()
+		for _, name := range []string{"Cache-Control", "Expires", "ETag", "Last-Modified", "Date", "Age"} {
+			if values, ok := res.Header[name]; ok {
+				updated.header[name] = values
+			}
+		}
+		updated.storedAt = now
+		updated.expiresAt, updated.revalidate, _ = cacheFreshness(updated.header, now)
+		c.store(key, &updated)
+		c.record(req, httpCacheRevalidated)
+		return updated.response(req), nil
+	}
+	c.record(req, httpCacheMiss)
+	if res.StatusCode != http.StatusOK {
+		return res, nil
+	}
+	// Responses which are never fresh are only worth storing if they can
+	// be revalidated.
+	expiresAt, revalidate, cacheable := cacheFreshness(res.Header, now)
+	validators := res.Header.Get("ETag") != "" || res.Header.Get("Last-Modified") != ""
+	if !cacheable || ((revalidate || !expiresAt.After(now)) && !validators) || res.ContentLength > maxCachedBodyBytes {
+		return res, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxCachedBodyBytes+1))
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if len(body) <= maxCachedBodyBytes {
+		c.store(key, &httpCacheEntry{
+			host:       req.URL.Hostname(),
+			status:     res.StatusCode,
+			header:     res.Header.Clone(),
+			body:       body,
+			storedAt:   now,
+			expiresAt:  expiresAt,
+			revalidate: revalidate,
+		})
+	}
+	return res, nil
+}
+
+// cacheFreshness returns until when a response with the given headers is
+// fresh, from its Cache-Control max-age, less its Age, or else its
+// Expires header; whether it must be revalidated before each use; and
+// whether it may be stored at all.
+func cacheFreshness(header http.Header, now time.Time) (expiresAt time.Time, revalidate, cacheable bool) {
+	maxAge, hasMaxAge := -1, false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "no-store":
+			return time.Time{}, false, false
+		case "no-cache":
+			revalidate = true
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+				maxAge, hasMaxAge = seconds, true
+			}
+		}
+	}
+	switch {
+	case hasMaxAge:
+		age, _ := strconv.Atoi(header.Get("Age"))
+		expiresAt = now.Add(time.Duration(maxAge-age) * time.Second)
+	case header.Get("Expires") != "":
+		// Invalid dates, such as "0", mean already expired.
+		expiresAt, _ = http.ParseTime(header.Get("Expires"))
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			expiresAt = now.Add(expiresAt.Sub(date))
+		}
+	}
+	return expiresAt, revalidate, true
+}
+
+// response returns the cached response to req.
+func (e *httpCacheEntry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(e.status) + " " + http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// store caches an entry, evicting expired entries, or else the oldest
+// one, when the cache is full.
+func (c *httpCache) store(key string, entry *httpCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		var oldest string
+		for k, e := range c.entries {
+			if !e.fresh(entry.storedAt) && e.header.Get("ETag") == "" && e.header.Get("Last-Modified") == "" {
+				delete(c.entries, k)
+			} else if oldest == "" || e.storedAt.Before(c.entries[oldest].storedAt) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = entry
+}
+
+func (c *httpCache) record(req *http.Request, outcome string) {
+	c.requests.Add(req.Context(), 1, metric.WithAttributes(
+		attribute.String("server.address", req.URL.Hostname()),
+		attribute.String("http_cache.outcome", outcome),
+	))
+}
+
+// purge drops the cached responses of a host, or all of them if host is
+// empty, returning how many it dropped. If dryRun is set, it only counts
+// them.
+func (c *httpCache) purge(host string, dryRun bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := 0
+	for key, entry := range c.entries {
+		if host == "" || entry.host == host {
+			if !dryRun {
+				delete(c.entries, key)
+			}
+			purged++
+		}
+	}
+	return purged
+}
+
+// httpCachePurgeHandler serves DELETE /api/admin/http-cache, which drops
+// the cached responses of the host given by the "host" query parameter,
+// or all of them, e.g. after an identity provider rotated its keys early.
+func httpCachePurgeHandler(cache *httpCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		purged := 0
+		if cache != nil {
+			purged = cache.purge(r.URL.Query().Get("host"), isDryRun(r.Context()))
+		}
+		if dryRun(w, r, mutationEffect{CacheEntriesPurged: purged}) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Purged int `json:"purged"`
+		}{purged})
+	}
+}
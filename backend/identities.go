@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	identitiesIndex = "app-identities"
+
+	accountLinkCookieName = "account_link"
+
+	// accountLinkTTL bounds how long users may take to sign in with their
+	// existing account to confirm a link.
+	accountLinkTTL = 10 * time.Minute
+)
+
+var (
+	// errAccountLinkRequired is returned when a user signs in with a
+	// provider for the first time, with the email address of an existing
+	// user.
+	errAccountLinkRequired = errors.New("an account with this email address exists; sign in with it to link this identity")
+
+	// errAccountLinkInvalid is returned when a pending link is missing,
+	// expired, or was not started for the signed-in user.
+	errAccountLinkInvalid = errors.New("no pending account link for this user")
+)
+
+// identity is an identity of a user at an identity provider.
+type identity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func identityKey(provider, subject string) string {
+	return provider + ":" + subject
+}
+
+// identityOf returns the provider and subject of an identity provider's ID
+// token, and false for session tokens minted by the backend, whose subject
+// is already a canonical user ID.
+func identityOf(auth *authDetails) (provider, subject string, ok bool) {
+	if auth.claims == nil || auth.claims.VerifyIssuer(localSessionIssuer, true) {
+		return "", "", false
+	}
+	subject, _ = auth.claims["sub"].(string)
+	return providerGoogle, subject, subject != ""
+}
+
+// identityStore maps identities at identity providers to canonical user
+// IDs, so that a user signing in with several providers is one user, with
+// the same MFA enrollments, tokens and sessions. The first identity of a
+// user provides its canonical ID. An identity with the email address of an
+// existing user is only linked to it once the user proves control of both,
+// by signing in with each, since providers such as Entra ID let users set
+// unverified email addresses.
+type identityStore struct {
+	client *elasticsearch.Client
+	logger *zap.Logger
+
+	// clock tells when identities are created, and when pending links
+	// expire.
+	clock clock
+
+	mu         sync.RWMutex
+	identities map[string]*identity
+
+	// owners maps lowercased email addresses to the canonical user ID
+	// of the first user seen with them.
+	owners map[string]string
+}
+
+func newIdentityStore(client *elasticsearch.Client, logger *zap.Logger) (*identityStore, error) {
+	s := &identityStore{
+		client:     client,
+		logger:     logger,
+		clock:      systemClock{},
+		identities: make(map[string]*identity),
+		owners:     make(map[string]string),
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init identity store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing identities from Elasticsearch.
+func (s *identityStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initIdentityStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(identitiesIndex),
+		s.client.Search.WithSize(10000),
+		s.client.Search.WithSort("created_at:asc"),
+	)
+	if err != nil {
+		logger.Info("could not load identities from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.Info("could not load identities from Elasticsearch", zap.String("status", res.Status()))
+		return nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source identity `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		s.add(&hit.Source)
+	}
+
+	logger.Info("loaded identities", zap.Int("identities", len(s.identities)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// add adds an identity to the in-memory maps. The caller must hold mu, or
+// have exclusive access.
+func (s *identityStore) add(id *identity) {
+	s.identities[identityKey(id.Provider, id.Subject)] = id
+	if email := strings.ToLower(id.Email); email != "" {
+		if _, ok := s.owners[email]; !ok {
+			s.owners[email] = id.UserID
+		}
+	}
+}
+
+// userID returns the canonical user ID of an identity, or subject if it
+// has not been seen.
+func (s *identityStore) userID(provider, subject string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id := s.identities[identityKey(provider, subject)]; id != nil {
+		return id.UserID
+	}
+	return subject
+}
+
+// resolve returns the canonical user ID of an identity signing in,
+// registering it as a new user if it has not been seen. If another user
+// has the identity's email address, it fails with errAccountLinkRequired,
+// and returns that user's ID.
+func (s *identityStore) resolve(ctx context.Context, provider, subject, email string) (string, error) {
+	s.mu.Lock()
+	if id := s.identities[identityKey(provider, subject)]; id != nil {
+		s.mu.Unlock()
+		return id.UserID, nil
+	}
+	if owner, ok := s.owners[strings.ToLower(email)]; ok && email != "" && owner != subject {
+		s.mu.Unlock()
+		return owner, errAccountLinkRequired
+	}
+	id := &identity{Provider: provider, Subject: subject, UserID: subject, Email: email, CreatedAt: s.clock.Now().UTC()}
+	s.add(id)
+	s.mu.Unlock()
+	return subject, s.persist(ctx, id)
+}
+
+// link links an identity to the user with the given canonical ID.
+func (s *identityStore) link(ctx context.Context, provider, subject, email, userID string) error {
+	id := &identity{Provider: provider, Subject: subject, UserID: userID, Email: email, CreatedAt: s.clock.Now().UTC()}
+	s.mu.Lock()
+	s.add(id)
+	s.mu.Unlock()
+	return s.persist(ctx, id)
+}
+
+// forUser returns the identities linked to a user, oldest first.
+func (s *identityStore) forUser(userID string) []*identity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []*identity
+	for _, id := range s.identities {
+		if id.UserID == userID {
+			result = append(result, id)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return identitySortKey(result[i]) < identitySortKey(result[j]) })
+	return result
+}
+
+// identitySortKey orders identities by creation, with ties broken by
+// provider and subject.
+func identitySortKey(id *identity) string {
+	return id.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000000") + "/" + identityKey(id.Provider, id.Subject)
+}
+
+// persist indexes an identity, if Elasticsearch is configured.
+func (s *identityStore) persist(ctx context.Context, id *identity) error {
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Index(
+		identitiesIndex, esutil.NewJSONReader(id),
+		s.client.Index.WithDocumentID(identityKey(id.Provider, id.Subject)),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving identity: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving identity failed: %s", res.Status())
+	}
+	return nil
+}
+
+// wrap returns an ID token parser that maps the subjects of identity
+// provider tokens to canonical user IDs.
+func (s *identityStore) wrap(
+	parseIDToken func(string) (*authDetails, error),
+) func(string) (*authDetails, error) {
+	return func(idToken string) (*authDetails, error) {
+		details, err := parseIDToken(idToken)
+		if err != nil {
+			return nil, err
+		}
+		if provider, subject, ok := identityOf(details); ok {
+			details.userID = s.userID(provider, subject)
+		}
+		return details, nil
+	}
+}
+
+// pendingAccountLink is a link of a new identity to an existing user,
+// awaiting the user's confirmation. It is kept in an encrypted cookie,
+// proving the holder signed in with the new identity.
+type pendingAccountLink struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	UserID    string    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// setPendingAccountLink starts linking an identity to an existing user,
+// until accountLinkTTL from the time of clk.
+func setPendingAccountLink(w http.ResponseWriter, secureCookies secureCookies, clk clock, link pendingAccountLink) error {
+	link.ExpiresAt = clk.Now().Add(accountLinkTTL).UTC()
+	data, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	value, err := secureCookies.Encode(base64.URLEncoding.EncodeToString(data))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     accountLinkCookieName,
+		Path:     credentialsCookiePath,
+		Value:    value,
+		Secure:   true,
+		HttpOnly: true,
+		Expires:  link.ExpiresAt,
+	})
+	return nil
+}
+
+// pendingAccountLinkFor returns the pending link to the given user, if any
+// is unexpired by the time of clk.
+func pendingAccountLinkFor(r *http.Request, secureCookies secureCookies, clk clock, userID string) *pendingAccountLink {
+	cookie, err := r.Cookie(accountLinkCookieName)
+	if err != nil {
+		return nil
+	}
+	value, err := secureCookies.Decode(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	data, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	var link pendingAccountLink
+	if err := json.Unmarshal(data, &link); err != nil {
+		return nil
+	}
+	if link.UserID != userID || clk.Now().After(link.ExpiresAt) {
+		return nil
+	}
+	return &link
+}
+
+func clearPendingAccountLink(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     accountLinkCookieName,
+		Path:     credentialsCookiePath,
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+}
+
+// resolveSignIn maps an identity signing in through a redirect flow to its
+// canonical user ID. If the identity must first be linked to an existing
+// user, it starts the link and redirects to the application, where the
+// user is asked to sign in with their existing account, returning false.
+func resolveSignIn(
+	w http.ResponseWriter, r *http.Request,
+	identities *identityStore, secureCookies secureCookies, security *securityEvents, logger *zap.Logger,
+	eventKind, provider string, auth *authDetails,
+) bool {
+	userID, err := identities.resolve(r.Context(), provider, auth.userID, auth.email)
+	if errors.Is(err, errAccountLinkRequired) {
+		link := pendingAccountLink{Provider: provider, Subject: auth.userID, Email: auth.email, UserID: userID}
+		if err := setPendingAccountLink(w, secureCookies, identities.clock, link); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return false
+		}
+		security.record(r, eventKind, reasonLinkRequired, auth.userID)
+		http.Redirect(w, r, "/?link="+provider, http.StatusSeeOther)
+		return false
+	} else if err != nil {
+		logger.Warn("failed to save identity", zap.Error(err))
+	}
+	auth.userID = userID
+	return true
+}
+
+// registerAccountRoutes registers endpoints for listing a user's linked
+// identities, and confirming a pending link.
+func registerAccountRoutes(
+	routes *routeRegistry,
+	identities *identityStore,
+	secureCookies secureCookies,
+	cursors *cursorCodec,
+	security *securityEvents,
+	logger *zap.Logger,
+) {
+	user := routes.group(groupUser)
+
+	user.GET("/api/account/identities", func(w http.ResponseWriter, r *http.Request) {
+		auth := authFromContext(r.Context())
+		type identityResult struct {
+			Provider  string    `json:"provider"`
+			Email     string    `json:"email"`
+			CreatedAt time.Time `json:"created_at"`
+		}
+		fields, err := parseFields[identityResult](r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		result := struct {
+			Identities any `json:"identities"`
+
+			// Pending holds the provider of an identity awaiting
+			// confirmation of a link to this user.
+			Pending string `json:"pending,omitempty"`
+		}{}
+		page, err := paginate(w, r, cursors, "identities:created_at", identities.forUser(auth.userID), identitySortKey)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		list := []identityResult{}
+		for _, id := range page {
+			list = append(list, identityResult{id.Provider, id.Email, id.CreatedAt})
+		}
+		if result.Identities, err = fields.project(list); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if link := pendingAccountLinkFor(r, secureCookies, identities.clock, auth.userID); link != nil {
+			result.Pending = link.Provider
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	user.POST("/api/account/link", func(w http.ResponseWriter, r *http.Request) {
+		auth := authFromContext(r.Context())
+		link := pendingAccountLinkFor(r, secureCookies, identities.clock, auth.userID)
+		if link == nil {
+			security.record(r, securityEventAccountLink, reasonLinkInvalid, auth.userID)
+			writeError(w, r, http.StatusConflict, errAccountLinkInvalid.Error())
+			return
+		}
+		if err := identities.link(r.Context(), link.Provider, link.Subject, link.Email, auth.userID); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		clearPendingAccountLink(w)
+		security.record(r, securityEventAccountLink, reasonSuccess, auth.userID)
+		logger.Info(
+			"linked identity",
+			append(
+				traceLogFields(r.Context()),
+				zap.String("user.id", auth.userID),
+				zap.String("identity.provider", link.Provider),
+			)...,
+		)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/google/uuid"
+)
+
+// idSource generates the IDs of new documents, and the random bytes of
+// nonces. Components take them from an injected idSource rather than from
+// crypto/rand or the uuid package directly, so that tests can make them
+// deterministic, with testsupport.IDs. Secrets, such as encryption keys
+// and MFA recovery codes, are read from crypto/rand directly, as are the
+// invalidator's replica ID and the self-test's probe values, which only
+// need to be unique.
+type idSource interface {
+	// NewID returns a new UUIDv7, which sorts by creation time, so that
+	// documents keyed by it are stored in insertion order.
+	NewID() string
+
+	// Read fills b with random bytes.
+	Read(b []byte) (int, error)
+}
+
+// cryptoIDs is the idSource of the system, reading crypto/rand.
+type cryptoIDs struct{}
+
+func (cryptoIDs) NewID() string {
+	return uuid.Must(uuid.NewV7()).String()
+}
+
+func (cryptoIDs) Read(b []byte) (int, error) {
+	return rand.Read(b)
+}
+
+// seedFrom returns a seed for math/rand read from ids.
+func seedFrom(ids idSource) (int64, error) {
+	var b [8]byte
+	if _, err := ids.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b[:])), nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.uber.org/zap"
+)
+
+const (
+	invalidationsIndex = "app-invalidations"
+
+	defaultInvalidationInterval = 2 * time.Second
+
+	// invalidationOverlap is how far each poll looks back past the
+	// previous one, so that invalidations are not missed because of clock
+	// skew between replicas, or because Elasticsearch had not refreshed
+	// yet. Invalidations seen in the overlap are only handled once.
+	invalidationOverlap = 10 * time.Second
+
+	// invalidationRetention is how long invalidations are kept in the
+	// change log.
+	invalidationRetention = time.Hour
+)
+
+// Kinds of invalidations.
+const (
+	invalidateSessionSubject = "session.subject"
+	invalidateSessionSID     = "session.sid"
+	invalidateToken          = "token"
+	invalidateMFA            = "mfa"
+	invalidateTenant         = "tenant"
+	invalidateKeyring        = "keyring"
+	invalidateRecordShares   = "record_shares"
+	invalidateTeam           = "team"
+	invalidateInvitation     = "invitation"
+	invalidateChanges        = "changes"
+	invalidateRecord         = "record"
+)
+
+// invalidation is an entry of the change log, telling other replicas that
+// their in-memory copy of a key changed.
+type invalidation struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key"`
+	Replica string `json:"replica"`
+
+	// At is when the change took effect, such as when a session was
+	// revoked.
+	At        time.Time `json:"at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// invalidator propagates changes of in-memory state, such as session
+// revocations, OAuth tokens, and MFA enrollments, between replicas of the
+// backend, through a change log in Elasticsearch which each replica polls.
+// A nil invalidator, as returned without Elasticsearch, does nothing.
+type invalidator struct {
+	client   *elasticsearch.Client
+	logger   *zap.Logger
+	interval time.Duration
+	replica  string
+
+	mu       sync.Mutex
+	handlers map[string][]func(ctx context.Context, inv invalidation)
+	since    time.Time
+	seen     map[string]time.Time
+}
+
+// newInvalidator returns the invalidator, or nil if Elasticsearch is not
+// configured or invalidation is disabled.
+func newInvalidator(config *appConfig, client *elasticsearch.Client, logger *zap.Logger) *invalidator {
+	if client == nil || config.Invalidation.Disabled {
+		return nil
+	}
+	replica := make([]byte, 8)
+	rand.Read(replica)
+	i := &invalidator{
+		client:   client,
+		logger:   logger,
+		interval: config.Invalidation.Interval,
+		replica:  hex.EncodeToString(replica),
+		handlers: make(map[string][]func(context.Context, invalidation)),
+		since:    time.Now(),
+		seen:     make(map[string]time.Time),
+	}
+	if i.interval <= 0 {
+		i.interval = defaultInvalidationInterval
+	}
+	return i
+}
+
+// subscribe registers a handler of invalidations of a kind made by other
+// replicas.
+func (i *invalidator) subscribe(kind string, handler func(ctx context.Context, inv invalidation)) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.handlers[kind] = append(i.handlers[kind], handler)
+}
+
+// publish tells other replicas that a key changed at the given time.
+func (i *invalidator) publish(ctx context.Context, kind, key string, at time.Time) error {
+	if i == nil {
+		return nil
+	}
+	res, err := i.client.Index(
+		invalidationsIndex, esutil.NewJSONReader(invalidation{
+			Kind:      kind,
+			Key:       key,
+			Replica:   i.replica,
+			At:        at.UTC(),
+			CreatedAt: time.Now().UTC(),
+		}),
+		i.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving invalidation: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving invalidation failed: %s", res.Status())
+	}
+	return nil
+}
+
+// notify publishes an invalidation, logging failures: the change already
+// took effect locally, and other replicas pick it up when they reload.
+func (i *invalidator) notify(ctx context.Context, kind, key string, at time.Time) {
+	if err := i.publish(ctx, kind, key, at); err != nil {
+		i.logger.Warn("failed to publish invalidation", zap.String("invalidation.kind", kind), zap.Error(err))
+	}
+}
+
+// start periodically polls the change log for invalidations made by other
+// replicas, and deletes expired ones.
+func (i *invalidator) start(ctx context.Context) {
+	if i == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(i.interval)
+		defer ticker.Stop()
+		cleanup := time.NewTicker(invalidationRetention / 4)
+		defer cleanup.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := i.poll(ctx); err != nil {
+					i.logger.Warn("failed to poll invalidations", zap.Error(err))
+				}
+			case now := <-cleanup.C:
+				if err := i.cleanup(ctx, now); err != nil {
+					i.logger.Warn("failed to delete expired invalidations", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// poll handles the invalidations logged since the previous poll.
+func (i *invalidator) poll(ctx context.Context) error {
+	now := time.Now()
+	i.mu.Lock()
+	since := i.since.Add(-invalidationOverlap)
+	i.mu.Unlock()
+
+	res, err := i.client.Search(
+		i.client.Search.WithContext(ctx),
+		i.client.Search.WithIndex(invalidationsIndex),
+		i.client.Search.WithBody(esutil.NewJSONReader(map[string]interface{}{
+			"query": map[string]interface{}{
+				"range": map[string]interface{}{
+					"created_at": map[string]interface{}{"gte": since.UTC().Format(time.RFC3339Nano)},
+				},
+			},
+			"sort": []interface{}{map[string]interface{}{"created_at": "asc"}},
+		})),
+		i.client.Search.WithSize(10000),
+		i.client.Search.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return fmt.Errorf("while searching invalidations: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("searching invalidations failed: %s", res.Status())
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				ID     string       `json:"_id"`
+				Source invalidation `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		return err
+	}
+	ids := make([]string, len(searchResult.Hits.Hits))
+	invalidations := make([]invalidation, len(searchResult.Hits.Hits))
+	for n, hit := range searchResult.Hits.Hits {
+		ids[n], invalidations[n] = hit.ID, hit.Source
+	}
+	i.dispatch(ctx, now, ids, invalidations)
+	return nil
+}
+
+// dispatch calls the handlers of invalidations made by other replicas which
+// were not handled yet, and records the time of the poll which found them.
+func (i *invalidator) dispatch(ctx context.Context, polledAt time.Time, ids []string, invalidations []invalidation) {
+	i.mu.Lock()
+	var pending []invalidation
+	for n, inv := range invalidations {
+		if _, ok := i.seen[ids[n]]; ok {
+			continue
+		}
+		i.seen[ids[n]] = inv.CreatedAt
+		if inv.Replica != i.replica {
+			pending = append(pending, inv)
+		}
+	}
+	i.since = polledAt
+	for id, createdAt := range i.seen {
+		if createdAt.Before(polledAt.Add(-2 * invalidationOverlap)) {
+			delete(i.seen, id)
+		}
+	}
+	handlers := make(map[string][]func(context.Context, invalidation), len(i.handlers))
+	for kind, h := range i.handlers {
+		handlers[kind] = h
+	}
+	i.mu.Unlock()
+
+	for _, inv := range pending {
+		i.logger.Debug("applying invalidation", zap.String("invalidation.kind", inv.Kind), zap.String("invalidation.replica", inv.Replica))
+		for _, handler := range handlers[inv.Kind] {
+			handler(ctx, inv)
+		}
+	}
+}
+
+// cleanup deletes invalidations older than invalidationRetention.
+func (i *invalidator) cleanup(ctx context.Context, now time.Time) error {
+	res, err := i.client.DeleteByQuery(
+		[]string{invalidationsIndex},
+		esutil.NewJSONReader(map[string]interface{}{
+			"query": map[string]interface{}{
+				"range": map[string]interface{}{
+					"created_at": map[string]interface{}{"lt": now.Add(-invalidationRetention).UTC().Format(time.RFC3339Nano)},
+				},
+			},
+		}),
+		i.client.DeleteByQuery.WithContext(ctx),
+		i.client.DeleteByQuery.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return fmt.Errorf("while deleting invalidations: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("deleting invalidations failed: %s", res.Status())
+	}
+	return nil
+}
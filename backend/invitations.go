@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	invitationsIndex = "app-invitations"
+
+	defaultInvitationTTL = 7 * 24 * time.Hour
+
+	// invitationCookieName holds the token of the invitation link the
+	// user followed, until they sign in and it is accepted.
+	invitationCookieName = "invitation"
+
+	auditActionInvitationCreated  = "team.invitation_created"
+	auditActionInvitationRevoked  = "team.invitation_revoked"
+	auditActionInvitationAccepted = "team.invitation_accepted"
+)
+
+// Statuses of invitations.
+const (
+	invitationPending  = "pending"
+	invitationAccepted = "accepted"
+	invitationRevoked  = "revoked"
+	invitationExpired  = "expired"
+)
+
+var (
+	errInvitationNotFound      = errors.New("invitation not found")
+	errInvitationNotPending    = errors.New("invitation is no longer pending")
+	errInvitationEmailMismatch = errors.New("invitation is for another email address")
+	errInvalidInvitationEmail  = errors.New("a valid email address is required")
+)
+
+// invitation invites the user with an email address to join a team.
+type invitation struct {
+	ID        string    `json:"id"`
+	TeamID    string    `json:"team_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	AcceptedBy string     `json:"accepted_by,omitempty"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// status returns the status of the invitation at a time.
+func (inv *invitation) status(now time.Time) string {
+	switch {
+	case inv.AcceptedAt != nil:
+		return invitationAccepted
+	case inv.RevokedAt != nil:
+		return invitationRevoked
+	case !now.Before(inv.ExpiresAt):
+		return invitationExpired
+	default:
+		return invitationPending
+	}
+}
+
+// invitationView is an invitation as returned by the API, with its status.
+type invitationView struct {
+	invitation
+	Status string `json:"status"`
+
+	// Link is the invitation link, returned to the admin creating the
+	// invitation only.
+	Link string `json:"link,omitempty"`
+}
+
+// invitationStore manages invitations to teams, persisted to
+// Elasticsearch if configured, with a document per invitation.
+type invitationStore struct {
+	client        *elasticsearch.Client
+	logger        *zap.Logger
+	invalidations *invalidator
+	ids           idSource
+	ttl           time.Duration
+
+	// clock tells when invitations expire.
+	clock clock
+
+	mu          sync.RWMutex
+	invitations map[string]*invitation
+}
+
+func newInvitationStore(config *appConfig, client *elasticsearch.Client, logger *zap.Logger) (*invitationStore, error) {
+	s := &invitationStore{
+		client:      client,
+		logger:      logger,
+		ids:         cryptoIDs{},
+		ttl:         config.Invitations.TTL,
+		clock:       systemClock{},
+		invitations: make(map[string]*invitation),
+	}
+	if s.ttl <= 0 {
+		s.ttl = defaultInvitationTTL
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init invitation store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing invitations from Elasticsearch.
+func (s *invitationStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initInvitationStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(invitationsIndex),
+		s.client.Search.WithSize(10000),
+	)
+	if err != nil {
+		logger.Info("could not load invitations from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.Info("could not load invitations from Elasticsearch", zap.String("status", res.Status()))
+		return nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source invitation `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	for i := range searchResult.Hits.Hits {
+		inv := &searchResult.Hits.Hits[i].Source
+		s.invitations[inv.ID] = inv
+	}
+
+	logger.Info("loaded invitations", zap.Int("invitations", len(s.invitations)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// watch propagates invitations changed by other replicas, reloading them
+// from Elasticsearch.
+func (s *invitationStore) watch(invalidations *invalidator) {
+	s.invalidations = invalidations
+	invalidations.subscribe(invalidateInvitation, func(ctx context.Context, inv invalidation) {
+		if err := s.reload(ctx, inv.Key); err != nil {
+			s.logger.Warn("failed to reload invitation", zap.String("invitation.id", inv.Key), zap.Error(err))
+		}
+	})
+}
+
+// reload loads an invitation from Elasticsearch, replacing the one in
+// memory.
+func (s *invitationStore) reload(ctx context.Context, id string) error {
+	res, err := s.client.Get(invitationsIndex, id, s.client.Get.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("while loading invitation: %w", err)
+	}
+	defer res.Body.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if res.StatusCode == http.StatusNotFound {
+		delete(s.invitations, id)
+		return nil
+	}
+	if res.IsError() {
+		return fmt.Errorf("loading invitation failed: %s", res.Status())
+	}
+	var doc struct {
+		Source invitation `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return err
+	}
+	s.invitations[id] = &doc.Source
+	return nil
+}
+
+// forTeam returns copies of the invitations to a team, newest first.
+func (s *invitationStore) forTeam(teamID string) []*invitation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []*invitation
+	for _, inv := range s.invitations {
+		if inv.TeamID == teamID {
+			c := *inv
+			result = append(result, &c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result
+}
+
+// create invites the user with an email address to join a team with a
+// role, until the invitation expires.
+func (s *invitationStore) create(ctx context.Context, teamID, email, role, invitedBy string) (*invitation, error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != strings.TrimSpace(email) {
+		return nil, errInvalidInvitationEmail
+	}
+	if role != teamRoleAdmin && role != teamRoleMember {
+		return nil, errInvalidTeamRole
+	}
+	now := s.clock.Now().UTC()
+	inv := &invitation{
+		ID:        s.ids.NewID(),
+		TeamID:    teamID,
+		Email:     strings.ToLower(addr.Address),
+		Role:      role,
+		InvitedBy: invitedBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	s.mu.Lock()
+	s.invitations[inv.ID] = inv
+	s.mu.Unlock()
+	if err := s.save(ctx, inv); err != nil {
+		return nil, err
+	}
+	c := *inv
+	return &c, nil
+}
+
+// update applies a change to a pending invitation, then saves it.
+func (s *invitationStore) update(ctx context.Context, id string, change func(inv *invitation) error) (*invitation, error) {
+	s.mu.Lock()
+	current, ok := s.invitations[id]
+	if !ok {
+		s.mu.Unlock()
+		return nil, errInvitationNotFound
+	}
+	if current.status(s.clock.Now()) != invitationPending {
+		s.mu.Unlock()
+		return nil, errInvitationNotPending
+	}
+	inv := *current
+	if err := change(&inv); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.invitations[id] = &inv
+	s.mu.Unlock()
+	if err := s.save(ctx, &inv); err != nil {
+		return nil, err
+	}
+	c := inv
+	return &c, nil
+}
+
+// revoke revokes a pending invitation to a team.
+func (s *invitationStore) revoke(ctx context.Context, teamID, id string) (*invitation, error) {
+	return s.update(ctx, id, func(inv *invitation) error {
+		if inv.TeamID != teamID {
+			return errInvitationNotFound
+		}
+		now := s.clock.Now().UTC()
+		inv.RevokedAt = &now
+		return nil
+	})
+}
+
+// accept accepts a pending invitation on behalf of the user it was sent
+// to, identified by their email address.
+func (s *invitationStore) accept(ctx context.Context, id, userID, email string) (*invitation, error) {
+	return s.update(ctx, id, func(inv *invitation) error {
+		if !strings.EqualFold(inv.Email, email) {
+			return errInvitationEmailMismatch
+		}
+		now := s.clock.Now().UTC()
+		inv.AcceptedBy, inv.AcceptedAt = userID, &now
+		return nil
+	})
+}
+
+func (s *invitationStore) save(ctx context.Context, inv *invitation) error {
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Index(
+		invitationsIndex, esutil.NewJSONReader(inv),
+		s.client.Index.WithDocumentID(inv.ID),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving invitation: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving invitation failed: %s", res.Status())
+	}
+	s.invalidations.notify(ctx, invalidateInvitation, inv.ID, s.clock.Now())
+	return nil
+}
+
+// smtpSettings configures a mail server. Mail is not sent if Addr is
+// empty.
+type smtpSettings struct {
+	Addr     string `yaml:"addr"`
+	From     string `yaml:"from"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// invitationLinks creates and verifies the signed links of invitations,
+// and sends them by email if SMTP is configured.
+type invitationLinks struct {
+	signer  *urlSigner
+	baseURL string
+	smtp    smtpSettings
+
+	// sendMail sends email, replaced in tests.
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func newInvitationLinks(config *appConfig, secureCookies secureCookies, clk clock) *invitationLinks {
+	return &invitationLinks{
+		signer:   newURLSigner(secureCookies, clk),
+		baseURL:  strings.TrimSuffix(config.Invitations.BaseURL, "/"),
+		smtp:     config.Invitations.SMTP,
+		sendMail: smtp.SendMail,
+	}
+}
+
+// url returns the link of an invitation, valid until it expires.
+func (l *invitationLinks) url(inv *invitation) (string, error) {
+	token, _, err := l.signer.sign("invitation", []string{inv.ID}, inv.ExpiresAt.Sub(l.signer.clock.Now()))
+	if err != nil {
+		return "", err
+	}
+	return l.baseURL + "/api/invitations/accept?" + url.Values{"token": {token}}.Encode(), nil
+}
+
+// decode returns the invitation ID of an invitation link token.
+func (l *invitationLinks) decode(token string) (string, error) {
+	path, err := l.signer.verify(token, "invitation", 1)
+	if err != nil {
+		return "", err
+	}
+	return path[0], nil
+}
+
+// emailEnabled reports whether invitations can be sent by email.
+func (l *invitationLinks) emailEnabled() bool {
+	return l.smtp.Addr != ""
+}
+
+// email sends an invitation link to the invited user.
+func (l *invitationLinks) email(inv *invitation, teamName, link string) error {
+	var auth smtp.Auth
+	if l.smtp.Username != "" {
+		host, _, err := net.SplitHostPort(l.smtp.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", l.smtp.Username, l.smtp.Password, host)
+	}
+	subject := fmt.Sprintf("You are invited to join %q", teamName)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", l.smtp.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", inv.Email)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", inv.CreatedAt.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "You are invited to join the team %q as %s.\r\n\r\n", teamName, inv.Role)
+	fmt.Fprintf(&msg, "Accept the invitation at %s\r\n", link)
+	fmt.Fprintf(&msg, "and sign in with %s. The link expires at %s.\r\n", inv.Email, inv.ExpiresAt.Format(time.RFC1123))
+	return l.sendMail(l.smtp.Addr, auth, l.smtp.From, []string{inv.Email}, msg.Bytes())
+}
+
+// acceptFromCookie accepts the invitation whose link the user followed
+// before signing in, if any, adding them to its team. Invitations which
+// cannot be accepted, such as those for another email address, are
+// dropped. It does not fail the request.
+func (s *invitationStore) acceptFromCookie(
+	w http.ResponseWriter,
+	r *http.Request,
+	auth *authDetails,
+	links *invitationLinks,
+	teams *teamStore,
+	audit *auditLog,
+	logger *zap.Logger,
+) {
+	cookie, err := r.Cookie(invitationCookieName)
+	if err != nil || auth.isGuest() || !links.signer.signed() {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     invitationCookieName,
+		Path:     credentialsCookiePath,
+		Value:    "",
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+	logger = logger.With(traceLogFields(r.Context())...)
+	id, err := links.decode(cookie.Value)
+	if err != nil {
+		logger.Info("ignored invitation", zap.Error(err))
+		return
+	}
+	inv, err := s.accept(r.Context(), id, auth.userID, auth.email)
+	if err != nil {
+		logger.Info("could not accept invitation", zap.String("invitation.id", id), zap.Error(err))
+		return
+	}
+	if _, err := teams.join(r.Context(), inv.TeamID, auth.userID, inv.Role); err != nil {
+		logger.Warn("failed to add invited user to team", zap.String("invitation.id", id), zap.Error(err))
+		return
+	}
+	audit.record(r.Context(), auditActionInvitationAccepted, auth.userID, inv.TeamID, map[string]string{
+		"invitation": inv.ID,
+		"role":       inv.Role,
+	})
+}
+
+// invitationError writes the response of an error of the invitation store.
+func invitationError(w http.ResponseWriter, r *http.Request, err error, logger *zap.Logger) {
+	switch {
+	case errors.Is(err, errInvitationNotFound):
+		writeError(w, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, errInvitationNotPending):
+		writeError(w, r, http.StatusConflict, err.Error())
+	case errors.Is(err, errInvalidInvitationEmail), errors.Is(err, errInvalidTeamRole):
+		writeError(w, r, http.StatusBadRequest, err.Error())
+	default:
+		logger.Error("failed to save invitation", append(traceLogFields(r.Context()), zap.Error(err))...)
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// registerInvitationRoutes registers the endpoints for team admins to
+// invite users to their teams, and for users to follow invitation links.
+func registerInvitationRoutes(
+	routes *routeRegistry,
+	invitations *invitationStore,
+	links *invitationLinks,
+	teams *teamStore,
+	audit *auditLog,
+	logger *zap.Logger,
+) {
+	user := routes.group(groupUser)
+
+	// admin returns the team of the request's path, if the user is an
+	// admin of it. Teams of other users are reported as not found.
+	admin := func(w http.ResponseWriter, r *http.Request) (*team, bool) {
+		userID := authFromContext(r.Context()).userID
+		t, err := teams.get(r.PathValue("team"))
+		switch {
+		case err == nil && t.Members[userID] == "":
+			err = errTeamNotFound
+		case err == nil && !t.isAdmin(userID):
+			err = errTeamAdminOnly
+		}
+		if err != nil {
+			teamError(w, r, err, logger)
+			return nil, false
+		}
+		return t, true
+	}
+
+	user.GET("/api/teams/{team}/invitations", func(w http.ResponseWriter, r *http.Request) {
+		t, ok := admin(w, r)
+		if !ok {
+			return
+		}
+		now := invitations.clock.Now()
+		result := struct {
+			Invitations []invitationView `json:"invitations"`
+		}{Invitations: []invitationView{}}
+		for _, inv := range invitations.forTeam(t.ID) {
+			result.Invitations = append(result.Invitations, invitationView{invitation: *inv, Status: inv.status(now)})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	user.POST("/api/teams/{team}/invitations", func(w http.ResponseWriter, r *http.Request) {
+		t, ok := admin(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Email string `json:"email"`
+			Role  string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Role == "" {
+			req.Role = teamRoleMember
+		}
+		auth := authFromContext(r.Context())
+		inv, err := invitations.create(r.Context(), t.ID, req.Email, req.Role, auth.userID)
+		if err != nil {
+			invitationError(w, r, err, logger)
+			return
+		}
+		link, err := links.url(inv)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		audit.record(r.Context(), auditActionInvitationCreated, auth.userID, t.ID, map[string]string{
+			"invitation": inv.ID,
+			"email":      inv.Email,
+			"role":       inv.Role,
+		})
+		if links.emailEnabled() {
+			if err := links.email(inv, t.Name, link); err != nil {
+				logger.Warn("failed to email invitation",
+					append(traceLogFields(r.Context()), zap.String("invitation.id", inv.ID), zap.Error(err))...)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(invitationView{invitation: *inv, Status: invitationPending, Link: link})
+	})
+
+	user.DELETE("/api/teams/{team}/invitations/{invitation}", func(w http.ResponseWriter, r *http.Request) {
+		t, ok := admin(w, r)
+		if !ok {
+			return
+		}
+		inv, err := invitations.revoke(r.Context(), t.ID, r.PathValue("invitation"))
+		if err != nil {
+			invitationError(w, r, err, logger)
+			return
+		}
+		audit.record(r.Context(), auditActionInvitationRevoked, authFromContext(r.Context()).userID, t.ID, map[string]string{
+			"invitation": inv.ID,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Invitation links keep the token in a cookie and lead to the
+	// application, to sign in; the invitation is accepted by
+	// /api/authenticate once the user is signed in.
+	routes.group(groupPublic).GET("/api/invitations/accept", func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		id, err := links.decode(token)
+		switch {
+		case errors.Is(err, errDownloadLinkExpired):
+			writeError(w, r, http.StatusGone, "invitation expired")
+			return
+		case err != nil:
+			writeError(w, r, http.StatusNotFound, errInvitationNotFound.Error())
+			return
+		}
+		invitations.mu.RLock()
+		inv, ok := invitations.invitations[id]
+		var status string
+		if ok {
+			status = inv.status(invitations.clock.Now())
+		}
+		invitations.mu.RUnlock()
+		switch {
+		case !ok:
+			writeError(w, r, http.StatusNotFound, errInvitationNotFound.Error())
+			return
+		case status != invitationPending:
+			writeError(w, r, http.StatusGone, "invitation "+status)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     invitationCookieName,
+			Path:     credentialsCookiePath,
+			Value:    token,
+			Secure:   true,
+			HttpOnly: true,
+			Expires:  inv.ExpiresAt,
+		})
+		http.Redirect(w, r, links.baseURL+"/", http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// jsonListChunkSize is how much of a list is encoded before it is
+	// written out.
+	jsonListChunkSize = 32 << 10
+
+	// maxPooledJSONBuffer bounds the buffers kept for reuse, so that a
+	// single huge item does not stay allocated.
+	maxPooledJSONBuffer = 1 << 20
+)
+
+var jsonListBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// jsonField is a field of a struct type, as encoded by encoding/json.
+type jsonField struct {
+	index     []int
+	omitEmpty bool
+
+	// key is the encoded name, followed by a colon.
+	key []byte
+}
+
+// jsonFields returns the fields of struct type t as encoded by
+// encoding/json, including those of embedded structs, by name.
+func jsonFields(t reflect.Type, index []int) map[string]jsonField {
+	fields := make(map[string]jsonField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		fieldIndex := append(slices.Clone(index), i)
+		switch {
+		case name == "-":
+		case field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct:
+			for embeddedName, embedded := range jsonFields(field.Type, fieldIndex) {
+				if _, ok := fields[embeddedName]; !ok {
+					fields[embeddedName] = embedded
+				}
+			}
+		case field.IsExported():
+			if name == "" {
+				name = field.Name
+			}
+			fields[name] = jsonField{
+				index:     fieldIndex,
+				omitEmpty: slices.Contains(strings.Split(options, ","), "omitempty"),
+			}
+		}
+	}
+	return fields
+}
+
+// isEmptyJSONValue reports whether v is empty, as omitted by omitempty.
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+// writeJSONList writes items as a JSON array, followed by a newline, like
+// json.Encoder, with only the selected fields of each item, as project
+// would. Rather than encoding the whole list in memory first, items are
+// encoded into a pooled buffer, which is written out in chunks, so that
+// large pages are served in bounded memory, and without the intermediate
+// documents of project.
+func writeJSONList[T any](w io.Writer, items []T, fields fieldSelection) error {
+	buf := jsonListBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledJSONBuffer {
+			jsonListBuffers.Put(buf)
+		}
+	}()
+	enc := json.NewEncoder(buf)
+
+	// The selected fields, in the order project encodes them.
+	var selected []jsonField
+	if fields != nil {
+		t := reflect.TypeFor[T]()
+		if t.Kind() != reflect.Struct {
+			data, err := fields.project(items)
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(w).Encode(data)
+		}
+		known := jsonFields(t, nil)
+		for _, name := range slices.Sorted(slices.Values(fields)) {
+			if field, ok := known[name]; ok {
+				key, err := json.Marshal(name)
+				if err != nil {
+					return err
+				}
+				field.key = append(key, ':')
+				selected = append(selected, field)
+			}
+		}
+	}
+
+	// Encode terminates each value with a newline, which is dropped
+	// within the array. Values are encoded through pointers, which are
+	// not allocated when converted to interfaces.
+	encode := func(v any) error {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		buf.Truncate(buf.Len() - 1)
+		return nil
+	}
+
+	if items == nil && fields == nil {
+		// Like json.Encoder, rather than project.
+		buf.WriteString("null\n")
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	buf.WriteByte('[')
+	for i := range items {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if fields == nil {
+			if err := encode(&items[i]); err != nil {
+				return err
+			}
+		} else {
+			v := reflect.ValueOf(&items[i]).Elem()
+			buf.WriteByte('{')
+			first := true
+			for _, field := range selected {
+				value := v.FieldByIndex(field.index)
+				if field.omitEmpty && isEmptyJSONValue(value) {
+					continue
+				}
+				if !first {
+					buf.WriteByte(',')
+				}
+				first = false
+				buf.Write(field.key)
+				if err := encode(value.Addr().Interface()); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte('}')
+		}
+		if buf.Len() >= jsonListChunkSize {
+			if _, err := w.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+	}
+	buf.WriteString("]\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"app-backend/kms"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.uber.org/zap"
+)
+
+const (
+	keyringIndex = "app-encryption-keys"
+	keyringID    = "keyring"
+
+	defaultRewrapInterval = 24 * time.Hour
+
+	defaultRetainedRotations = 2
+
+	// rotationCheckInterval is how often the age of the primary key is
+	// checked against the rotation interval.
+	rotationCheckInterval = time.Minute
+
+	// generatedKeySize is the size of generated encryption keys.
+	generatedKeySize = 32
+
+	auditActionKeyRotated = "encryption_key.rotated"
+	auditActionKeyRetired = "encryption_key.retired"
+)
+
+// wrappedKey is an encryption key, wrapped by the key management service.
+type wrappedKey struct {
+	// ID identifies the key in audit events. Keys seeded before rotation
+	// was introduced have none.
+	ID          string    `json:"id,omitempty"`
+	Wrapped     string    `json:"wrapped"`
+	CreatedAt   time.Time `json:"created_at"`
+	RewrappedAt time.Time `json:"rewrapped_at,omitempty"`
+}
+
+type keyringDocument struct {
+	// Keys holds the encryption keys, primary first.
+	Keys []wrappedKey `json:"keys"`
+}
+
+// keyring keeps the encryption keys wrapped by a key management service,
+// so that raw key material is only ever held in memory. Wrapped keys are
+// stored in Elasticsearch, shared by all replicas, and periodically
+// rewrapped with the current version of the service's key, so that older
+// versions can be retired. When rotation is enabled, a new key is
+// generated every rotation interval, and keys replaced more than the
+// retained number of rotations ago are retired.
+type keyring struct {
+	wrapper  kms.Wrapper
+	client   *elasticsearch.Client
+	logger   *zap.Logger
+	interval time.Duration
+	rotation time.Duration
+	retain   int
+	now      func() time.Time
+
+	// cookies, audit, and invalidations are set once the backend is
+	// wired, and receive rotated keys, record rotations, and tell other
+	// replicas about them.
+	cookies       secureCookies
+	audit         *auditLog
+	invalidations *invalidator
+
+	mu  sync.Mutex
+	doc keyringDocument
+
+	// seqNo and primaryTerm hold the version of the stored document, so
+	// that concurrent updates by other replicas are not overwritten.
+	seqNo       int
+	primaryTerm int
+}
+
+func newKeyring(config *appConfig, wrapper kms.Wrapper, client *elasticsearch.Client, logger *zap.Logger) *keyring {
+	k := &keyring{
+		wrapper:  wrapper,
+		client:   client,
+		logger:   logger,
+		interval: config.KMS.RewrapInterval,
+		rotation: config.KMS.RotationInterval,
+		retain:   config.KMS.RetainedRotations,
+		now:      time.Now,
+	}
+	if k.interval <= 0 {
+		k.interval = defaultRewrapInterval
+	}
+	if k.retain <= 0 {
+		k.retain = defaultRetainedRotations
+	}
+	if k.rotation > 0 {
+		if lifetime := k.rotation * time.Duration(k.retain+1); lifetime < localSessionTTL {
+			logger.Warn("encryption keys are retired before sessions expire: increase kms.rotation_interval or kms.retained_rotations",
+				zap.Duration("key.lifetime", lifetime), zap.Duration("session.ttl", localSessionTTL))
+		}
+		if client == nil {
+			logger.Warn("rotated encryption keys are not stored without Elasticsearch: sessions will not survive restarts")
+		}
+	}
+	return k
+}
+
+// newWrappedKey generates a key and wraps it.
+func (k *keyring) newWrappedKey(ctx context.Context, now time.Time) (wrappedKey, error) {
+	plaintext := make([]byte, generatedKeySize)
+	if _, err := rand.Read(plaintext); err != nil {
+		return wrappedKey{}, err
+	}
+	wrapped, err := k.wrapper.Wrap(ctx, plaintext)
+	if err != nil {
+		return wrappedKey{}, fmt.Errorf("while wrapping encryption key: %w", err)
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return wrappedKey{ID: hex.EncodeToString(id), Wrapped: wrapped, CreatedAt: now}, nil
+}
+
+// load returns the encryption keys, unwrapped and base64-encoded as
+// EncryptionKeys are. The first time, with no keys stored yet, the keyring
+// is seeded with the wrapped keys configured, else with the plaintext keys
+// configured, wrapped, else with a generated key.
+func (k *keyring) load(ctx context.Context, config *appConfig) ([]string, error) {
+	ctx, span := otel.Tracer("main").Start(ctx, "loadKeyring")
+	defer span.End()
+
+	found, err := k.reload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if err := k.seed(ctx, config); err != nil {
+			return nil, err
+		}
+	} else if len(config.EncryptionKeys) > 0 {
+		k.logger.Warn("encryption_keys are ignored, as keys are managed by kms: remove them from the configuration")
+	}
+
+	return k.unwrap(ctx)
+}
+
+// unwrap returns the encryption keys, unwrapped and base64-encoded.
+func (k *keyring) unwrap(ctx context.Context) ([]string, error) {
+	k.mu.Lock()
+	wrapped := append([]wrappedKey(nil), k.doc.Keys...)
+	k.mu.Unlock()
+	keys := make([]string, len(wrapped))
+	for i, key := range wrapped {
+		plaintext, err := k.wrapper.Unwrap(ctx, key.Wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("while unwrapping encryption key %d: %w", i, err)
+		}
+		keys[i] = base64.StdEncoding.EncodeToString(plaintext)
+	}
+	return keys, nil
+}
+
+// seed stores the initial keys of the keyring.
+func (k *keyring) seed(ctx context.Context, config *appConfig) error {
+	now := k.now()
+	var doc keyringDocument
+	switch {
+	case len(config.KMS.WrappedKeys) > 0:
+		for _, wrapped := range config.KMS.WrappedKeys {
+			doc.Keys = append(doc.Keys, wrappedKey{Wrapped: wrapped, CreatedAt: now})
+		}
+	case len(config.EncryptionKeys) > 0:
+		k.logger.Warn("wrapping the configured encryption_keys: remove them from the configuration once stored")
+		for _, encoded := range config.EncryptionKeys {
+			plaintext, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return fmt.Errorf("failed to base64-decode encryption key: %w", err)
+			}
+			wrapped, err := k.wrapper.Wrap(ctx, plaintext)
+			if err != nil {
+				return fmt.Errorf("while wrapping encryption key: %w", err)
+			}
+			doc.Keys = append(doc.Keys, wrappedKey{Wrapped: wrapped, CreatedAt: now})
+		}
+	default:
+		key, err := k.newWrappedKey(ctx, now)
+		if err != nil {
+			return err
+		}
+		doc.Keys = append(doc.Keys, key)
+		if k.client == nil {
+			k.logger.Warn("generated an encryption key which is not stored without Elasticsearch: sessions will not survive restarts")
+		}
+	}
+
+	if k.client == nil {
+		k.mu.Lock()
+		k.doc = doc
+		k.mu.Unlock()
+		return nil
+	}
+	res, err := k.client.Create(
+		keyringIndex, keyringID, esutil.NewJSONReader(doc),
+		k.client.Create.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while storing keyring: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusConflict {
+		// Another replica seeded the keyring first.
+		_, err := k.reload(ctx)
+		return err
+	}
+	if res.IsError() {
+		return fmt.Errorf("storing keyring failed: %s", res.Status())
+	}
+	var created struct {
+		SeqNo       int `json:"_seq_no"`
+		PrimaryTerm int `json:"_primary_term"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.doc, k.seqNo, k.primaryTerm = doc, created.SeqNo, created.PrimaryTerm
+	return nil
+}
+
+// reload loads the keyring from Elasticsearch, reporting whether it was
+// found. Without Elasticsearch, the keyring is only held in memory.
+func (k *keyring) reload(ctx context.Context) (bool, error) {
+	if k.client == nil {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		return len(k.doc.Keys) > 0, nil
+	}
+	res, err := k.client.Get(keyringIndex, keyringID, k.client.Get.WithContext(ctx))
+	if err != nil {
+		return false, fmt.Errorf("while loading keyring: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.IsError() {
+		return false, fmt.Errorf("loading keyring failed: %s", res.Status())
+	}
+	var doc struct {
+		SeqNo       int             `json:"_seq_no"`
+		PrimaryTerm int             `json:"_primary_term"`
+		Source      keyringDocument `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return false, fmt.Errorf("failed to decode keyring: %w", err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.doc, k.seqNo, k.primaryTerm = doc.Source, doc.SeqNo, doc.PrimaryTerm
+	return true, nil
+}
+
+// rewrap re-encrypts the wrapped keys with the current version of the
+// service's key. If another replica changed the keyring meanwhile, its
+// version is kept.
+func (k *keyring) rewrap(ctx context.Context) error {
+	ctx, span := otel.Tracer("main").Start(ctx, "rewrapKeyring")
+	defer span.End()
+
+	k.mu.Lock()
+	doc := keyringDocument{Keys: append([]wrappedKey(nil), k.doc.Keys...)}
+	seqNo, primaryTerm := k.seqNo, k.primaryTerm
+	k.mu.Unlock()
+	now := k.now()
+	for i, key := range doc.Keys {
+		wrapped, err := k.wrapper.Rewrap(ctx, key.Wrapped)
+		if err != nil {
+			return fmt.Errorf("while rewrapping encryption key %d: %w", i, err)
+		}
+		doc.Keys[i].Wrapped, doc.Keys[i].RewrappedAt = wrapped, now
+	}
+	_, err := k.store(ctx, doc, seqNo, primaryTerm)
+	return err
+}
+
+// store replaces the stored keyring with doc, provided it is still at the
+// given version, reporting whether it was. Otherwise, the keyring changed
+// by another replica is reloaded.
+func (k *keyring) store(ctx context.Context, doc keyringDocument, seqNo, primaryTerm int) (bool, error) {
+	if k.client == nil {
+		k.mu.Lock()
+		k.doc = doc
+		k.mu.Unlock()
+		return true, nil
+	}
+	res, err := k.client.Index(
+		keyringIndex, esutil.NewJSONReader(doc),
+		k.client.Index.WithDocumentID(keyringID),
+		k.client.Index.WithIfSeqNo(seqNo),
+		k.client.Index.WithIfPrimaryTerm(primaryTerm),
+		k.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return false, fmt.Errorf("while storing keyring: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusConflict {
+		_, err := k.reload(ctx)
+		return false, err
+	}
+	if res.IsError() {
+		return false, fmt.Errorf("storing keyring failed: %s", res.Status())
+	}
+	var stored struct {
+		SeqNo       int `json:"_seq_no"`
+		PrimaryTerm int `json:"_primary_term"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&stored); err != nil {
+		return false, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.doc, k.seqNo, k.primaryTerm = doc, stored.SeqNo, stored.PrimaryTerm
+	return true, nil
+}
+
+// rotate makes a new key primary once the primary key is older than the
+// rotation interval, and retires keys replaced more than the retained
+// number of rotations ago. The keys of the secure cookies are replaced,
+// and other replicas told to reload theirs.
+func (k *keyring) rotate(ctx context.Context) error {
+	k.mu.Lock()
+	doc := keyringDocument{Keys: append([]wrappedKey(nil), k.doc.Keys...)}
+	seqNo, primaryTerm := k.seqNo, k.primaryTerm
+	k.mu.Unlock()
+	now := k.now()
+	if k.rotation <= 0 || len(doc.Keys) > 0 && now.Sub(doc.Keys[0].CreatedAt) < k.rotation {
+		return nil
+	}
+
+	ctx, span := otel.Tracer("main").Start(ctx, "rotateKeyring")
+	defer span.End()
+	key, err := k.newWrappedKey(ctx, now)
+	if err != nil {
+		return err
+	}
+	doc.Keys = append([]wrappedKey{key}, doc.Keys...)
+	var retired []wrappedKey
+	if len(doc.Keys) > k.retain+1 {
+		retired = doc.Keys[k.retain+1:]
+		doc.Keys = doc.Keys[:k.retain+1]
+	}
+	stored, err := k.store(ctx, doc, seqNo, primaryTerm)
+	if err != nil {
+		return err
+	}
+	// Whether this replica rotated the keys or another one did first, the
+	// keys of the secure cookies are now out of date.
+	if err := k.apply(ctx); err != nil {
+		return err
+	}
+	if !stored {
+		return nil
+	}
+
+	k.logger.Info("rotated encryption keys", zap.String("key.id", key.ID), zap.Int("keys.retired", len(retired)))
+	if k.audit != nil {
+		k.audit.record(ctx, auditActionKeyRotated, "", key.ID, map[string]string{"keys": strconv.Itoa(len(doc.Keys))})
+		for _, old := range retired {
+			k.audit.record(ctx, auditActionKeyRetired, "", old.ID, map[string]string{"created_at": old.CreatedAt.Format(time.RFC3339)})
+		}
+	}
+	k.invalidations.notify(ctx, invalidateKeyring, keyringID, now)
+	return nil
+}
+
+// apply replaces the keys of the secure cookies with those of the keyring.
+func (k *keyring) apply(ctx context.Context) error {
+	if k.cookies.state == nil {
+		return nil
+	}
+	keys, err := k.unwrap(ctx)
+	if err != nil {
+		return err
+	}
+	return k.cookies.setKeys(keys)
+}
+
+// watch reloads the keyring when another replica rotates its keys.
+func (k *keyring) watch(invalidations *invalidator) {
+	invalidations.subscribe(invalidateKeyring, func(ctx context.Context, inv invalidation) {
+		if _, err := k.reload(ctx); err != nil {
+			k.logger.Warn("failed to reload encryption keys", zap.Error(err))
+			return
+		}
+		if err := k.apply(ctx); err != nil {
+			k.logger.Warn("failed to apply reloaded encryption keys", zap.Error(err))
+		}
+	})
+}
+
+// start rewraps the keys every rewrap interval, and rotates them when due,
+// until ctx is done.
+func (k *keyring) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(k.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := k.rewrap(ctx); err != nil {
+					k.logger.Warn("failed to rewrap encryption keys", zap.Error(err))
+				}
+			}
+		}
+	}()
+	if k.rotation <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(rotationCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := k.rotate(ctx); err != nil {
+					k.logger.Warn("failed to rotate encryption keys", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
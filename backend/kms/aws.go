@@ -0,0 +1,199 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultAWSRegion = "us-east-1"
+
+// awsWrapper wraps keys with AWS KMS, through its JSON API, signing
+// requests with AWS Signature Version 4.
+type awsWrapper struct {
+	client   *http.Client
+	endpoint string
+	region   string
+	keyID    string
+
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+
+	now func() time.Time
+}
+
+func awsEndpoint(config Config) string {
+	if config.AWS.Endpoint != "" {
+		return config.AWS.Endpoint
+	}
+	return "https://kms." + awsRegion(config) + ".amazonaws.com"
+}
+
+func awsRegion(config Config) string {
+	if config.AWS.Region != "" {
+		return config.AWS.Region
+	}
+	return defaultAWSRegion
+}
+
+func newAWSWrapper(config Config, client *http.Client) (*awsWrapper, error) {
+	if config.AWS.KeyID == "" {
+		return nil, errors.New("key_id is required")
+	}
+	w := &awsWrapper{
+		client:          client,
+		endpoint:        strings.TrimSuffix(awsEndpoint(config), "/") + "/",
+		region:          awsRegion(config),
+		keyID:           config.AWS.KeyID,
+		accessKeyID:     config.AWS.AccessKeyID,
+		secretAccessKey: config.AWS.SecretAccessKey,
+		sessionToken:    config.AWS.SessionToken,
+		now:             time.Now,
+	}
+	if w.accessKeyID == "" {
+		w.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		w.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		w.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if w.accessKeyID == "" || w.secretAccessKey == "" {
+		return nil, errors.New("credentials are required")
+	}
+	return w, nil
+}
+
+func (w *awsWrapper) Wrap(ctx context.Context, plaintext []byte) (string, error) {
+	var out struct {
+		CiphertextBlob []byte
+	}
+	err := w.call(ctx, "Encrypt", map[string]interface{}{"KeyId": w.keyID, "Plaintext": plaintext}, &out)
+	return base64.StdEncoding.EncodeToString(out.CiphertextBlob), err
+}
+
+func (w *awsWrapper) Unwrap(ctx context.Context, wrapped string) ([]byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	var out struct {
+		Plaintext []byte
+	}
+	err = w.call(ctx, "Decrypt", map[string]interface{}{"KeyId": w.keyID, "CiphertextBlob": blob}, &out)
+	return out.Plaintext, err
+}
+
+func (w *awsWrapper) Rewrap(ctx context.Context, wrapped string) (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return "", fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	var out struct {
+		CiphertextBlob []byte
+	}
+	err = w.call(ctx, "ReEncrypt", map[string]interface{}{
+		"CiphertextBlob":   blob,
+		"SourceKeyId":      w.keyID,
+		"DestinationKeyId": w.keyID,
+	}, &out)
+	return base64.StdEncoding.EncodeToString(out.CiphertextBlob), err
+}
+
+// call calls an action of the KMS API. Binary fields are base64-encoded
+// in JSON, as []byte values are.
+func (w *awsWrapper) call(ctx context.Context, action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	w.sign(req, body)
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError("AWS KMS", res)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (w *awsWrapper) sign(req *http.Request, body []byte) {
+	t := w.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if w.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", w.sessionToken)
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Host
+		if name != "host" {
+			value = strings.Join(req.Header.Values(name), ",")
+		} else if value == "" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256(body)
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	date := t.Format("20060102")
+	scope := date + "/" + w.region + "/kms/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+w.secretAccessKey), date)
+	for _, part := range []string{w.region, "kms", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		w.accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
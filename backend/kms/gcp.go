@@ -0,0 +1,113 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	gcpDefaultEndpoint = "https://cloudkms.googleapis.com"
+	gcpTokenURL        = "https://oauth2.googleapis.com/token"
+	gcpMetadataURL     = "http://metadata.google.internal"
+	gcpScope           = "https://www.googleapis.com/auth/cloudkms"
+)
+
+// gcpWrapper wraps keys with Google Cloud KMS, through its REST API.
+type gcpWrapper struct {
+	client   *http.Client
+	endpoint string
+	keyName  string
+}
+
+func gcpEndpoint(config Config) string {
+	if config.GCP.Endpoint != "" {
+		return config.GCP.Endpoint
+	}
+	return gcpDefaultEndpoint
+}
+
+func newGCPWrapper(config Config, client *http.Client) (*gcpWrapper, error) {
+	if config.GCP.KeyName == "" {
+		return nil, errors.New("key_name is required")
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	var credentials *google.Credentials
+	var err error
+	if config.GCP.CredentialsFile != "" {
+		var data []byte
+		data, err = os.ReadFile(config.GCP.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		credentials, err = google.CredentialsFromJSON(ctx, data, gcpScope)
+	} else {
+		credentials, err = google.FindDefaultCredentials(ctx, gcpScope)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &gcpWrapper{
+		client:   oauth2.NewClient(ctx, credentials.TokenSource),
+		endpoint: strings.TrimSuffix(gcpEndpoint(config), "/"),
+		keyName:  config.GCP.KeyName,
+	}, nil
+}
+
+func (w *gcpWrapper) Wrap(ctx context.Context, plaintext []byte) (string, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := w.call(ctx, "encrypt", map[string]interface{}{"plaintext": plaintext}, &out)
+	return out.Ciphertext, err
+}
+
+func (w *gcpWrapper) Unwrap(ctx context.Context, wrapped string) ([]byte, error) {
+	var out struct {
+		Plaintext []byte `json:"plaintext"`
+	}
+	err := w.call(ctx, "decrypt", map[string]interface{}{"ciphertext": wrapped}, &out)
+	return out.Plaintext, err
+}
+
+// Rewrap decrypts and encrypts the key again, as Cloud KMS has no
+// re-encryption API: encryption always uses the primary version of the key.
+func (w *gcpWrapper) Rewrap(ctx context.Context, wrapped string) (string, error) {
+	plaintext, err := w.Unwrap(ctx, wrapped)
+	if err != nil {
+		return "", err
+	}
+	return w.Wrap(ctx, plaintext)
+}
+
+// call calls a method of the key. Binary fields are base64-encoded in
+// JSON, as []byte values are.
+func (w *gcpWrapper) call(ctx context.Context, method string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, w.endpoint+"/v1/"+w.keyName+":"+method, bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError("Cloud KMS", res)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
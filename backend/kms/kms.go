@@ -0,0 +1,156 @@
+// Package kms wraps and unwraps encryption keys with a key management
+// service: AWS KMS, Google Cloud KMS, or the transit secrets engine of
+// HashiCorp Vault, as selected by configuration. Like the blob stores, the
+// services' REST APIs are called directly rather than through their SDKs.
+package kms
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Providers of key management services.
+const (
+	ProviderAWS   = "aws"
+	ProviderGCP   = "gcp"
+	ProviderVault = "vault"
+)
+
+// Wrapper encrypts and decrypts keys with a key held by a key management
+// service, which never leaves it. Wrapped keys are opaque strings.
+type Wrapper interface {
+	// Wrap encrypts plaintext with the current version of the key.
+	Wrap(ctx context.Context, plaintext []byte) (string, error)
+
+	// Unwrap decrypts a wrapped key, with whichever version of the key
+	// wrapped it.
+	Unwrap(ctx context.Context, wrapped string) ([]byte, error)
+
+	// Rewrap re-encrypts a wrapped key with the current version of the
+	// key, without the plaintext leaving the service where possible, so
+	// that older versions of the key can be retired.
+	Rewrap(ctx context.Context, wrapped string) (string, error)
+}
+
+// Config selects and configures a key management service.
+type Config struct {
+	// Provider is one of aws, gcp, or vault. Empty disables wrapping.
+	Provider string `yaml:"provider"`
+
+	// WrappedKeys holds the initial encryption keys, wrapped by the
+	// service, primary first. They are safe to commit.
+	WrappedKeys []string `yaml:"wrapped_keys"`
+
+	// RewrapInterval is how often wrapped keys are re-encrypted with the
+	// current version of the service's key. Defaults to 24h.
+	RewrapInterval time.Duration `yaml:"rewrap_interval"`
+
+	// RotationInterval is how often a new encryption key is generated and
+	// made primary. Zero disables rotation.
+	RotationInterval time.Duration `yaml:"rotation_interval"`
+
+	// RetainedRotations is how many rotations a key is kept for decoding
+	// after it was replaced, before it is retired. Defaults to 2.
+	RetainedRotations int `yaml:"retained_rotations"`
+
+	AWS struct {
+		// KeyID is the ID, ARN, or alias of the KMS key.
+		KeyID string `yaml:"key_id"`
+		// Region defaults to us-east-1.
+		Region string `yaml:"region"`
+		// Endpoint overrides the AWS endpoint, e.g. for VPC endpoints.
+		Endpoint string `yaml:"endpoint"`
+		// Credentials default to the AWS_ACCESS_KEY_ID,
+		// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment
+		// variables.
+		AccessKeyID     string `yaml:"access_key_id"`
+		SecretAccessKey string `yaml:"secret_access_key"`
+		SessionToken    string `yaml:"session_token"`
+	} `yaml:"aws"`
+
+	GCP struct {
+		// KeyName is the resource name of the key:
+		// projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>.
+		KeyName string `yaml:"key_name"`
+		// CredentialsFile is a service account key file. Defaults to
+		// Application Default Credentials.
+		CredentialsFile string `yaml:"credentials_file"`
+		// Endpoint overrides the API endpoint.
+		Endpoint string `yaml:"endpoint"`
+	} `yaml:"gcp"`
+
+	Vault struct {
+		// Address defaults to VAULT_ADDR.
+		Address string `yaml:"address"`
+		// Token defaults to VAULT_TOKEN, or the contents of TokenFile,
+		// such as written by the Vault agent.
+		Token     string `yaml:"token"`
+		TokenFile string `yaml:"token_file"`
+		// Namespace is the Vault Enterprise namespace, if any.
+		Namespace string `yaml:"namespace"`
+		// Mount is the path of the transit engine. Defaults to transit.
+		Mount string `yaml:"mount"`
+		// Key is the name of the transit key.
+		Key string `yaml:"key"`
+	} `yaml:"vault"`
+}
+
+// Open returns the configured wrapper, sending requests with client, or nil
+// if no provider is configured.
+func Open(config Config, client *http.Client) (Wrapper, error) {
+	var wrapper Wrapper
+	var err error
+	switch config.Provider {
+	case "":
+		return nil, nil
+	case ProviderAWS:
+		wrapper, err = newAWSWrapper(config, client)
+	case ProviderGCP:
+		wrapper, err = newGCPWrapper(config, client)
+	case ProviderVault:
+		wrapper, err = newVaultWrapper(config, client)
+	default:
+		return nil, fmt.Errorf("unknown key management provider %q", config.Provider)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s key management: %w", config.Provider, err)
+	}
+	return wrapper, nil
+}
+
+// Hosts returns the hosts the configured service is sent requests to, for
+// egress allowlists.
+func (c Config) Hosts() []string {
+	var urls []string
+	switch c.Provider {
+	case ProviderAWS:
+		urls = append(urls, awsEndpoint(c))
+	case ProviderGCP:
+		urls = append(urls, gcpEndpoint(c), gcpTokenURL, gcpMetadataURL)
+	case ProviderVault:
+		urls = append(urls, vaultAddress(c))
+	}
+	var hosts []string
+	for _, rawURL := range urls {
+		if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return hosts
+}
+
+// responseError returns an error describing an unexpected response of a
+// key management service, including the start of its body, which usually
+// holds an error code.
+func responseError(service string, res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	if len(body) == 0 {
+		return fmt.Errorf("%s responded %s", service, res.Status)
+	}
+	return fmt.Errorf("%s responded %s: %s", service, res.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,229 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAWSSignature checks signing against the signature computed by the
+// AWS SDK for the same request.
+func TestAWSSignature(t *testing.T) {
+	w := &awsWrapper{
+		region:          "eu-west-1",
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		now:             func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}
+	body := []byte(`{"KeyId":"alias/app","Plaintext":"AAAA"}`)
+	req := httptest.NewRequest(http.MethodPost, "https://kms.eu-west-1.amazonaws.com/", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Encrypt")
+	w.sign(req, body)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240102/eu-west-1/kms/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date;x-amz-target, " +
+		"Signature=14d87d199a388faf989c9caad7fc948b2a5640fc3a525f5d8fd09ee97d15fc14"
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Errorf("Authorization = %q, want %q", got, expected)
+	}
+}
+
+// fakeWrap "encrypts" by prefixing the version of the key, as services
+// record the version of the key which wrapped a key.
+func fakeWrap(version string, plaintext []byte) string {
+	return version + ":" + base64.StdEncoding.EncodeToString(plaintext)
+}
+
+func fakeUnwrap(wrapped string) []byte {
+	_, encoded, _ := strings.Cut(wrapped, ":")
+	plaintext, _ := base64.StdEncoding.DecodeString(encoded)
+	return plaintext
+}
+
+// testWrapper checks that wrapped keys round-trip, and are rewrapped with
+// the current version of the key, v2.
+func testWrapper(t *testing.T, w Wrapper) {
+	t.Helper()
+	ctx := context.Background()
+	wrapped, err := w.Wrap(ctx, []byte("secret key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(wrapped, "secret key") {
+		t.Errorf("expected the key to be wrapped, got %q", wrapped)
+	}
+	old := strings.Replace(wrapped, "v2", "v1", 1)
+	rewrapped, err := w.Rewrap(ctx, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped != wrapped {
+		t.Errorf("expected %q rewrapped as %q, got %q", old, wrapped, rewrapped)
+	}
+	plaintext, err := w.Unwrap(ctx, rewrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret key" {
+		t.Errorf("unwrapped %q", plaintext)
+	}
+}
+
+func TestAWSWrapper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			http.Error(w, `{"__type":"UnrecognizedClientException"}`, http.StatusBadRequest)
+			return
+		}
+		var in struct {
+			KeyId            string
+			DestinationKeyId string
+			Plaintext        []byte
+			CiphertextBlob   []byte
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		var out map[string]interface{}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			out = map[string]interface{}{"CiphertextBlob": []byte(fakeWrap("v2", in.Plaintext))}
+		case "TrentService.Decrypt":
+			out = map[string]interface{}{"Plaintext": fakeUnwrap(string(in.CiphertextBlob))}
+		case "TrentService.ReEncrypt":
+			out = map[string]interface{}{"CiphertextBlob": []byte(fakeWrap("v2", fakeUnwrap(string(in.CiphertextBlob))))}
+		}
+		if in.KeyId != "alias/app" && in.DestinationKeyId != "alias/app" {
+			http.Error(w, `{"__type":"NotFoundException"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(out)
+	}))
+	defer server.Close()
+
+	config := Config{Provider: ProviderAWS}
+	config.AWS.KeyID = "alias/app"
+	config.AWS.Endpoint = server.URL
+	config.AWS.AccessKeyID = "AKID"
+	config.AWS.SecretAccessKey = "secret"
+	w, err := Open(config, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wrapped keys are base64-encoded ciphertext blobs, so the versions
+	// of fakeWrap are not visible in them.
+	aws := w.(*awsWrapper)
+	wrapped, err := aws.Wrap(context.Background(), []byte("secret key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, _ := base64.StdEncoding.DecodeString(wrapped)
+	old := base64.StdEncoding.EncodeToString([]byte(strings.Replace(string(blob), "v2", "v1", 1)))
+	if rewrapped, err := aws.Rewrap(context.Background(), old); err != nil || rewrapped != wrapped {
+		t.Errorf("expected %q rewrapped as %q, got %q, %v", old, wrapped, rewrapped, err)
+	}
+	if plaintext, err := aws.Unwrap(context.Background(), wrapped); err != nil || string(plaintext) != "secret key" {
+		t.Errorf("unwrapped %q, %v", plaintext, err)
+	}
+
+	config.AWS.AccessKeyID = "other"
+	w, _ = Open(config, server.Client())
+	if _, err := w.Wrap(context.Background(), []byte("secret key")); err == nil ||
+		!strings.Contains(err.Error(), "UnrecognizedClientException") {
+		t.Errorf("expected the service's error, got %v", err)
+	}
+}
+
+func TestGCPWrapper(t *testing.T) {
+	const keyName = "projects/p/locations/global/keyRings/app/cryptoKeys/cookies"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Plaintext  []byte `json:"plaintext"`
+			Ciphertext string `json:"ciphertext"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		switch r.URL.Path {
+		case "/v1/" + keyName + ":encrypt":
+			json.NewEncoder(w).Encode(map[string]string{"ciphertext": fakeWrap("v2", in.Plaintext)})
+		case "/v1/" + keyName + ":decrypt":
+			json.NewEncoder(w).Encode(map[string][]byte{"plaintext": fakeUnwrap(in.Ciphertext)})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	testWrapper(t, &gcpWrapper{client: server.Client(), endpoint: server.URL, keyName: keyName})
+}
+
+func TestVaultWrapper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		var in struct {
+			Plaintext  string `json:"plaintext"`
+			Ciphertext string `json:"ciphertext"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		var data map[string]string
+		switch r.URL.Path {
+		case "/v1/secrets/transit/encrypt/cookies":
+			plaintext, _ := base64.StdEncoding.DecodeString(in.Plaintext)
+			data = map[string]string{"ciphertext": "vault:" + fakeWrap("v2", plaintext)}
+		case "/v1/secrets/transit/decrypt/cookies":
+			data = map[string]string{"plaintext": base64.StdEncoding.EncodeToString(fakeUnwrap(strings.TrimPrefix(in.Ciphertext, "vault:")))}
+		case "/v1/secrets/transit/rewrap/cookies":
+			data = map[string]string{"ciphertext": "vault:" + fakeWrap("v2", fakeUnwrap(strings.TrimPrefix(in.Ciphertext, "vault:")))}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer server.Close()
+
+	// Tokens are read from the token file on every call, as agents
+	// renew them.
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("s.expired\n"), 0o600)
+	config := Config{Provider: ProviderVault}
+	config.Vault.Address = server.URL + "/"
+	config.Vault.TokenFile = tokenFile
+	config.Vault.Mount = "/secrets/transit/"
+	config.Vault.Key = "cookies"
+	w, err := Open(config, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Wrap(context.Background(), []byte("secret key")); err == nil ||
+		!strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected the service's error, got %v", err)
+	}
+	os.WriteFile(tokenFile, []byte("s.token\n"), 0o600)
+	testWrapper(t, w)
+}
+
+func TestOpen(t *testing.T) {
+	if w, err := Open(Config{}, nil); w != nil || err != nil {
+		t.Errorf("expected no wrapper without a provider, got %v, %v", w, err)
+	}
+	for _, config := range []Config{{Provider: "hsm"}, {Provider: ProviderAWS}, {Provider: ProviderVault}} {
+		if _, err := Open(config, nil); err == nil {
+			t.Errorf("expected %+v to be rejected", config)
+		}
+	}
+
+	config := Config{Provider: ProviderAWS}
+	config.AWS.Region = "eu-west-1"
+	if hosts := config.Hosts(); len(hosts) != 1 || hosts[0] != "kms.eu-west-1.amazonaws.com" {
+		t.Errorf("Hosts() = %v", hosts)
+	}
+}
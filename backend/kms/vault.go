@@ -0,0 +1,127 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const defaultVaultMount = "transit"
+
+// vaultWrapper wraps keys with the transit secrets engine of HashiCorp
+// Vault.
+type vaultWrapper struct {
+	client    *http.Client
+	address   string
+	token     string
+	tokenFile string
+	namespace string
+	mount     string
+	key       string
+}
+
+func vaultAddress(config Config) string {
+	if config.Vault.Address != "" {
+		return config.Vault.Address
+	}
+	return os.Getenv("VAULT_ADDR")
+}
+
+func newVaultWrapper(config Config, client *http.Client) (*vaultWrapper, error) {
+	if config.Vault.Key == "" {
+		return nil, errors.New("key is required")
+	}
+	w := &vaultWrapper{
+		client:    client,
+		address:   strings.TrimSuffix(vaultAddress(config), "/"),
+		token:     config.Vault.Token,
+		tokenFile: config.Vault.TokenFile,
+		namespace: config.Vault.Namespace,
+		mount:     strings.Trim(config.Vault.Mount, "/"),
+		key:       config.Vault.Key,
+	}
+	if w.address == "" {
+		return nil, errors.New("address is required")
+	}
+	if w.mount == "" {
+		w.mount = defaultVaultMount
+	}
+	if w.token == "" && w.tokenFile == "" {
+		w.token = os.Getenv("VAULT_TOKEN")
+	}
+	if w.token == "" && w.tokenFile == "" {
+		return nil, errors.New("token is required")
+	}
+	return w, nil
+}
+
+func (w *vaultWrapper) Wrap(ctx context.Context, plaintext []byte) (string, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := w.call(ctx, "encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}, &out)
+	return out.Ciphertext, err
+}
+
+func (w *vaultWrapper) Unwrap(ctx context.Context, wrapped string) ([]byte, error) {
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := w.call(ctx, "decrypt", map[string]string{"ciphertext": wrapped}, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+func (w *vaultWrapper) Rewrap(ctx context.Context, wrapped string) (string, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := w.call(ctx, "rewrap", map[string]string{"ciphertext": wrapped}, &out)
+	return out.Ciphertext, err
+}
+
+// call calls an operation of the transit key, decoding the data of its
+// response into out.
+func (w *vaultWrapper) call(ctx context.Context, operation string, in, out interface{}) error {
+	token := w.token
+	if w.tokenFile != "" {
+		// Read on every call, as agents renew the token in place.
+		data, err := os.ReadFile(w.tokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		w.address+"/v1/"+w.mount+"/"+operation+"/"+url.PathEscape(w.key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", token)
+	if w.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", w.namespace)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError("Vault", res)
+	}
+	return json.NewDecoder(res.Body).Decode(&struct {
+		Data interface{} `json:"data"`
+	}{out})
+}
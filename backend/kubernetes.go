@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Environment variables set from the downward API by the Helm chart.
+const (
+	envPodName      = "POD_NAME"
+	envPodNamespace = "POD_NAMESPACE"
+	envNodeName     = "NODE_NAME"
+)
+
+// kubernetesResourceAttributes describes the pod the backend runs in, as
+// told by the downward API, so that its traces and metrics can be told
+// apart from those of other replicas.
+func kubernetesResourceAttributes() []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if pod := os.Getenv(envPodName); pod != "" {
+		attrs = append(attrs, semconv.K8SPodName(pod), semconv.ServiceInstanceID(pod))
+	}
+	if namespace := os.Getenv(envPodNamespace); namespace != "" {
+		attrs = append(attrs, semconv.K8SNamespaceName(namespace))
+	}
+	if node := os.Getenv(envNodeName); node != "" {
+		attrs = append(attrs, semconv.K8SNodeName(node))
+	}
+	return attrs
+}
+
+// tokenFileMaxAge is how long a token read from a file is used before the
+// file is read again. The kubelet rotates projected service account tokens
+// once 80% of their lifetime, 10 minutes at least, has passed.
+const tokenFileMaxAge = time.Minute
+
+// tokenFileTransport authenticates requests to Elasticsearch with the JWT
+// in a file, such as a projected service account token, for its JWT realm,
+// reading the file again as it is rotated. With a shared secret, it also
+// authenticates the backend as a client of the realm.
+type tokenFileTransport struct {
+	base         http.RoundTripper
+	path         string
+	sharedSecret string
+
+	mu     sync.Mutex
+	token  string
+	readAt time.Time
+}
+
+func (t *tokenFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.read()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	if t.sharedSecret != "" {
+		req.Header.Set("ES-Client-Authentication", "SharedSecret "+t.sharedSecret)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// read returns the token, reading the file if the token was read more than
+// tokenFileMaxAge ago. If the file cannot be read, the previous token is
+// used until it is rejected.
+func (t *tokenFileTransport) read() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Since(t.readAt) < tokenFileMaxAge {
+		return t.token, nil
+	}
+	data, err := os.ReadFile(t.path)
+	token := strings.TrimSpace(string(data))
+	if err == nil && token == "" {
+		err = errors.New("empty token")
+	}
+	if err != nil {
+		if t.token != "" {
+			return t.token, nil
+		}
+		return "", fmt.Errorf("elasticsearch.token_file: %w", err)
+	}
+	t.token, t.readAt = token, time.Now()
+	return token, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	defaultServerAddr = ":4000"
+
+	// listenFDsStart is the first file descriptor passed by systemd
+	// socket activation.
+	listenFDsStart = 3
+)
+
+// newListener returns the listener the backend serves on: the socket
+// passed by systemd socket activation if any, so that systemd holds the
+// port across restarts, or else a TCP listener on the configured address,
+// with SO_REUSEPORT if enabled, so that two versions of the backend can
+// briefly share the port during rolling restarts. It serves TLS if
+// server.tls is set.
+func newListener(config *appConfig) (net.Listener, error) {
+	listener, err := activatedListener()
+	if err != nil {
+		return nil, err
+	}
+	if listener == nil {
+		addr := config.Server.Addr
+		if addr == "" {
+			addr = defaultServerAddr
+		}
+		var lc net.ListenConfig
+		if config.Server.ReusePort {
+			lc.Control = reusePort
+		}
+		if listener, err = lc.Listen(context.Background(), "tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	return withTLS(config, listener)
+}
+
+// withTLS serves TLS on listener with the certificate and key of
+// server.tls, if set, for the backend to face browsers without a proxy.
+func withTLS(config *appConfig, listener net.Listener) (net.Listener, error) {
+	if config.Server.TLS.CertFile == "" && config.Server.TLS.KeyFile == "" {
+		return listener, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.Server.TLS.CertFile, config.Server.TLS.KeyFile)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("server.tls: %w", err)
+	}
+	return tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}), nil
+}
+
+// activatedListener returns the first socket passed by systemd socket
+// activation, as described in sd_listen_fds(3), or nil if the backend was
+// not socket activated.
+func activatedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	// Child processes must not inherit the sockets.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(listenFDsStart, "LISTEN_FD_"+strconv.Itoa(listenFDsStart))
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("while using socket passed by systemd: %w", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort fails, since SO_REUSEPORT is not supported on this platform.
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return errors.New("server.reuse_port is not supported on this platform")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	// Time zones are embedded, for images without a zoneinfo database.
+	_ "time/tzdata"
+
+	"golang.org/x/text/language"
+)
+
+const (
+	defaultLocale = "en"
+
+	// timezoneHeader carries the IANA time zone of the client, such as
+	// the one reported by the browser's Intl API.
+	timezoneHeader = "X-Timezone"
+)
+
+// requestLocale is the locale and time zone of a request, which
+// server-generated timestamps and aggregations by date respect.
+type requestLocale struct {
+	Locale   language.Tag
+	Location *time.Location
+}
+
+type localeKey struct{}
+
+// localeFromContext returns the locale of the request, or UTC and the
+// default locale outside of the locale middleware.
+func localeFromContext(ctx context.Context) requestLocale {
+	if l, ok := ctx.Value(localeKey{}).(requestLocale); ok {
+		return l
+	}
+	return requestLocale{Locale: language.Make(defaultLocale), Location: time.UTC}
+}
+
+// localeResolver resolves the locale and time zone of requests, from the
+// first of which specifies them: the tz and locale query parameters, the
+// X-Timezone and Accept-Language headers, the timezone and locale
+// preferences of the session's team, and the configured defaults.
+type localeResolver struct {
+	defaults requestLocale
+}
+
+func newLocaleResolver(config *appConfig) (*localeResolver, error) {
+	r := &localeResolver{defaults: requestLocale{Locale: language.Make(defaultLocale), Location: time.UTC}}
+	if config.Locale.Default != "" {
+		tag, err := language.Parse(config.Locale.Default)
+		if err != nil {
+			return nil, fmt.Errorf("locale.default: %w", err)
+		}
+		r.defaults.Locale = tag
+	}
+	if config.Locale.Timezone != "" {
+		loc, err := time.LoadLocation(config.Locale.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("locale.timezone: %w", err)
+		}
+		r.defaults.Location = loc
+	}
+	return r, nil
+}
+
+// resolve returns the locale of a request. Invalid query parameters are
+// errors, while invalid headers and preferences are ignored.
+func (lr *localeResolver) resolve(r *http.Request) (requestLocale, error) {
+	result := lr.defaults
+	var preferences map[string]string
+	if t := teamFromContext(r.Context()); t != nil {
+		preferences = t.Preferences
+	}
+
+	// The time zone, from the least to the most specific source
+	for _, name := range []string{preferences["timezone"], r.Header.Get(timezoneHeader)} {
+		if loc, err := loadTimezone(name); err == nil && loc != nil {
+			result.Location = loc
+		}
+	}
+	if name := r.URL.Query().Get("tz"); name != "" {
+		loc, err := loadTimezone(name)
+		if err != nil {
+			return requestLocale{}, fmt.Errorf("invalid tz %q", name)
+		}
+		result.Location = loc
+	}
+
+	// The locale, likewise
+	if tag, err := language.Parse(preferences["locale"]); err == nil {
+		result.Locale = tag
+	}
+	if tags, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language")); err == nil && len(tags) > 0 {
+		result.Locale = tags[0]
+	}
+	if param := r.URL.Query().Get("locale"); param != "" {
+		tag, err := language.Parse(param)
+		if err != nil {
+			return requestLocale{}, fmt.Errorf("invalid locale %q", param)
+		}
+		result.Locale = tag
+	}
+	return result, nil
+}
+
+// loadTimezone loads an IANA time zone, or returns nil if name is empty.
+// Names relative to the zoneinfo database, such as "Local", are rejected.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if name == "Local" {
+		return nil, fmt.Errorf("unknown time zone %s", name)
+	}
+	return time.LoadLocation(name)
+}
+
+// middleware resolves the locale of requests, for handlers to get with
+// localeFromContext, and reports it with the Content-Language header. It
+// must run after the team middleware for the team's preferences to apply.
+func (lr *localeResolver) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, err := lr.resolve(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Content-Language", l.Locale.String())
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localeKey{}, l)))
+	})
+}
+
+// weekCount is the number of records created in the week starting at
+// Start, at midnight on Monday.
+type weekCount struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// startOfWeek returns midnight on the Monday of the week of t, in loc.
+func startOfWeek(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	days := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-days, 0, 0, 0, 0, loc)
+}
+
+// createdPerWeek counts records by the week they were created in, oldest
+// first, with weeks starting in loc. Records with an invalid creation time
+// are skipped.
+func createdPerWeek(records []SampleRecord, loc *time.Location) []weekCount {
+	counts := make(map[int64]int)
+	for _, record := range records {
+		createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
+		if err != nil {
+			continue
+		}
+		counts[startOfWeek(createdAt, loc).Unix()]++
+	}
+	result := make([]weekCount, 0, len(counts))
+	for start, count := range counts {
+		result = append(result, weekCount{Start: time.Unix(start, 0).In(loc), Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+	return result
+}
@@ -2,9 +2,26 @@ package main
 
 import (
 	"context"
+	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	defaultLogSampleInitial    = 100
+	defaultLogSampleThereafter = 100
+	defaultErrorLimitInterval  = time.Minute
+	defaultErrorLimitBurst     = 10
+
+	// maxLimitedErrors bounds the number of distinct error messages
+	// tracked by the error limit. Further messages are not limited.
+	maxLimitedErrors = 1000
 )
 
 func traceLogFields(ctx context.Context) []zap.Field {
@@ -17,3 +34,139 @@ func traceLogFields(ctx context.Context) []zap.Field {
 		zap.String("span_id", sc.SpanID().String()),
 	}
 }
+
+// newLogCore bounds the volume of logs written to core, as configured,
+// by sampling repeated messages below the error level, and limiting
+// repeated errors. Messages left out are counted in the app.log.suppressed
+// metric.
+func newLogCore(core zapcore.Core, config *appConfig) (zapcore.Core, error) {
+	suppressed, err := otel.Meter("main").Int64Counter(
+		"app.log.suppressed",
+		metric.WithDescription("Log messages left out by sampling or the error limit, by level"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	count := func(level zapcore.Level, reason string) {
+		suppressed.Add(context.Background(), 1, metric.WithAttributes(
+			attribute.String("log.level", level.String()),
+			attribute.String("reason", reason),
+		))
+	}
+
+	c := &limitedLogCore{Core: core, sampled: core}
+	if sampling := config.Logging.Sampling; !sampling.Disabled {
+		initial, thereafter := sampling.Initial, sampling.Thereafter
+		if initial <= 0 {
+			initial = defaultLogSampleInitial
+		}
+		if thereafter <= 0 {
+			thereafter = defaultLogSampleThereafter
+		}
+		c.sampled = zapcore.NewSamplerWithOptions(core, time.Second, initial, thereafter,
+			zapcore.SamplerHook(func(ent zapcore.Entry, dec zapcore.SamplingDecision) {
+				if dec&zapcore.LogDropped != 0 {
+					count(ent.Level, "sampled")
+				}
+			}),
+		)
+	}
+	if limit := config.Logging.ErrorLimit; !limit.Disabled {
+		c.errors = &errorLimiter{
+			interval: limit.Interval,
+			burst:    limit.Burst,
+			now:      time.Now,
+			messages: make(map[string]*limitedError),
+			dropped:  func(level zapcore.Level) { count(level, "rate_limited") },
+		}
+		if c.errors.interval <= 0 {
+			c.errors.interval = defaultErrorLimitInterval
+		}
+		if c.errors.burst <= 0 {
+			c.errors.burst = defaultErrorLimitBurst
+		}
+	}
+	return c, nil
+}
+
+// limitedLogCore writes messages below the error level through a sampler,
+// and errors through an errorLimiter.
+type limitedLogCore struct {
+	zapcore.Core
+	sampled zapcore.Core
+	errors  *errorLimiter
+}
+
+func (c *limitedLogCore) With(fields []zapcore.Field) zapcore.Core {
+	return &limitedLogCore{Core: c.Core.With(fields), sampled: c.sampled.With(fields), errors: c.errors}
+}
+
+func (c *limitedLogCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	switch {
+	case ent.Level < zapcore.ErrorLevel:
+		return c.sampled.Check(ent, ce)
+	case ent.Level > zapcore.ErrorLevel || c.errors == nil || !c.Enabled(ent.Level):
+		return c.Core.Check(ent, ce)
+	}
+	allowed, suppressed := c.errors.allow(ent)
+	switch {
+	case !allowed:
+		return ce
+	case suppressed > 0:
+		return c.Core.With([]zapcore.Field{zap.Int64("log.suppressed", suppressed)}).Check(ent, ce)
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// errorLimiter limits how many errors with the same message are logged
+// per interval.
+type errorLimiter struct {
+	interval time.Duration
+	burst    int
+	now      func() time.Time
+	dropped  func(level zapcore.Level)
+
+	mu       sync.Mutex
+	messages map[string]*limitedError
+}
+
+type limitedError struct {
+	start      time.Time
+	logged     int
+	suppressed int64
+}
+
+// allow reports whether ent may be logged, and how many errors with the
+// same message were suppressed since the last one logged.
+func (l *errorLimiter) allow(ent zapcore.Entry) (bool, int64) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.messages[ent.Message]
+	if !ok {
+		if len(l.messages) >= maxLimitedErrors {
+			for message, e := range l.messages {
+				if now.Sub(e.start) >= l.interval && e.suppressed == 0 {
+					delete(l.messages, message)
+				}
+			}
+			if len(l.messages) >= maxLimitedErrors {
+				return true, 0
+			}
+		}
+		e = &limitedError{start: now}
+		l.messages[ent.Message] = e
+	}
+	if now.Sub(e.start) >= l.interval {
+		e.start, e.logged = now, 0
+	}
+	if e.logged >= l.burst {
+		e.suppressed++
+		l.dropped(ent.Level)
+		return false, 0
+	}
+	e.logged++
+	suppressed := e.suppressed
+	e.suppressed = 0
+	return true, suppressed
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultOIDCIssuer is the issuer used to validate front-channel
+	// logout requests when none is configured.
+	defaultOIDCIssuer = "https://accounts.google.com"
+
+	// credentialsCookiePath is the path the credentials cookie is scoped to.
+	// The cookie is set by /api/authenticate without an explicit path, so
+	// browsers default it to "/api"; clearing it must use the same path.
+	credentialsCookiePath = "/api"
+)
+
+// errSessionRevoked is returned when an otherwise valid ID token belongs
+// to a session that has been terminated by a logout.
+var errSessionRevoked = errors.New("session has been revoked")
+
+// sessionRevocations records logouts so that ID tokens issued before
+// the logout are rejected, even though the tokens themselves remain
+// cryptographically valid until they expire.
+type sessionRevocations struct {
+	invalidations *invalidator
+
+	// clock tells when sessions are revoked by logouts.
+	clock clock
+
+	// cache holds verified credentials, evicted when their sessions are
+	// revoked.
+	cache *authCache
+
+	mu        sync.RWMutex
+	bySubject map[string]time.Time
+	bySID     map[string]time.Time
+}
+
+func newSessionRevocations() *sessionRevocations {
+	return &sessionRevocations{
+		clock:     systemClock{},
+		bySubject: make(map[string]time.Time),
+		bySID:     make(map[string]time.Time),
+	}
+}
+
+// watch propagates revocations to and from other replicas.
+func (s *sessionRevocations) watch(invalidations *invalidator) {
+	s.invalidations = invalidations
+	invalidations.subscribe(invalidateSessionSubject, func(ctx context.Context, inv invalidation) {
+		s.setSubject(inv.Key, inv.At)
+	})
+	invalidations.subscribe(invalidateSessionSID, func(ctx context.Context, inv invalidation) {
+		s.setSID(inv.Key, inv.At)
+	})
+}
+
+// revokeSubject terminates all sessions for the given user that were
+// issued at or before the given time.
+func (s *sessionRevocations) revokeSubject(subject string, at time.Time) {
+	s.setSubject(subject, at)
+	s.invalidations.notify(context.Background(), invalidateSessionSubject, subject, at)
+}
+
+// revokeSID terminates the IdP session with the given "sid" claim.
+func (s *sessionRevocations) revokeSID(sid string, at time.Time) {
+	s.setSID(sid, at)
+	s.invalidations.notify(context.Background(), invalidateSessionSID, sid, at)
+}
+
+func (s *sessionRevocations) setSubject(subject string, at time.Time) {
+	s.mu.Lock()
+	if at.After(s.bySubject[subject]) {
+		s.bySubject[subject] = at
+	}
+	s.mu.Unlock()
+	s.cache.removeSubject(subject)
+}
+
+func (s *sessionRevocations) setSID(sid string, at time.Time) {
+	s.mu.Lock()
+	if at.After(s.bySID[sid]) {
+		s.bySID[sid] = at
+	}
+	s.mu.Unlock()
+	s.cache.removeSID(sid)
+}
+
+// isRevoked reports whether the given authenticated session has been revoked.
+func (s *sessionRevocations) isRevoked(details *authDetails) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if at, ok := s.bySubject[details.userID]; ok && !details.issuedAt.After(at) {
+		return true
+	}
+	if details.sessionID != "" {
+		if at, ok := s.bySID[details.sessionID]; ok && !details.issuedAt.After(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns an ID token parser that additionally rejects revoked sessions.
+func (s *sessionRevocations) wrap(
+	parseIDToken func(string) (*authDetails, error),
+) func(string) (*authDetails, error) {
+	return func(idToken string) (*authDetails, error) {
+		details, err := parseIDToken(idToken)
+		if err != nil {
+			return nil, err
+		}
+		if s.isRevoked(details) {
+			return nil, errSessionRevoked
+		}
+		return details, nil
+	}
+}
+
+// clearCredentialsCookie instructs the browser to drop the credentials
+// cookie, and the session's team selection.
+func clearCredentialsCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "credentials",
+		Path:     credentialsCookiePath,
+		Value:    "",
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+	clearTeamCookie(w)
+}
+
+// oidcLogoutHandler implements RP-initiated logout: the local session is
+// terminated and the browser is redirected to the IdP's end_session_endpoint,
+// as configured or discovered, if any, so the IdP session is terminated too.
+func oidcLogoutHandler(
+	config *appConfig,
+	discovery *oidcDiscovery,
+	secureCookies secureCookies,
+	parseIDToken func(string) (*authDetails, error),
+	revocations *sessionRevocations,
+	logger *zap.Logger,
+) http.HandlerFunc {
+	endSessionEndpoint := config.OIDC.EndSessionEndpoint
+	if endSessionEndpoint == "" && discovery != nil {
+		endSessionEndpoint = discovery.EndSessionEndpoint
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.With(traceLogFields(r.Context())...)
+
+		idTokenHint, clientID := "", config.OIDC.ClientID
+		if clientID == "" {
+			clientID = config.Google.ClientID
+		}
+		if cookie, err := r.Cookie("credentials"); err == nil {
+			if credentials, err := secureCookies.Decode(cookie.Value); err == nil {
+				if details, err := parseIDToken(credentials); err == nil {
+					if hint, id := logoutHint(config, details, credentials); hint != "" {
+						idTokenHint, clientID = hint, id
+					}
+					revocations.revokeSubject(details.userID, revocations.clock.Now())
+					logger.Info("user logged out", zap.String("user.id", details.userID))
+				}
+			}
+		}
+		clearCredentialsCookie(w)
+
+		redirectURL := config.OIDC.PostLogoutRedirectURL
+		if redirectURL == "" {
+			redirectURL = "/"
+		}
+		if endSessionEndpoint != "" {
+			endSession, err := url.Parse(endSessionEndpoint)
+			if err != nil {
+				logger.Error("invalid end_session_endpoint", zap.Error(err))
+				writeError(w, r, http.StatusInternalServerError, "invalid end_session_endpoint")
+				return
+			}
+			query := endSession.Query()
+			if idTokenHint != "" {
+				query.Set("id_token_hint", idTokenHint)
+			}
+			if clientID != "" {
+				query.Set("client_id", clientID)
+			}
+			if config.OIDC.PostLogoutRedirectURL != "" {
+				query.Set("post_logout_redirect_uri", config.OIDC.PostLogoutRedirectURL)
+			}
+			endSession.RawQuery = query.Encode()
+			redirectURL = endSession.String()
+		}
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+	}
+}
+
+// logoutHint returns the ID token the IdP issued for the session of details,
+// with credentials, and the client it was issued to, for RP-initiated
+// logouts: the provider's ID token kept in sessions minted for OIDC
+// sign-ins, or the credentials themselves, for Google sign-ins. Other
+// sessions, of providers other than the IdP, have none.
+func logoutHint(config *appConfig, details *authDetails, credentials string) (idToken, clientID string) {
+	switch details.claims["idp"] {
+	case providerOIDC:
+		return details.providerIDToken, config.OIDC.ClientID
+	case nil:
+		if iss, _ := details.claims["iss"].(string); iss != localSessionIssuer {
+			return credentials, config.Google.ClientID
+		}
+	}
+	return "", ""
+}
+
+// frontChannelLogoutHandler implements OpenID Connect Front-Channel Logout.
+// The IdP renders this URL in a hidden iframe in the user's browser, passing
+// the "iss" and "sid" of the IdP session being terminated.
+func frontChannelLogoutHandler(
+	config *appConfig,
+	secureCookies secureCookies,
+	parseIDToken func(string) (*authDetails, error),
+	revocations *sessionRevocations,
+	logger *zap.Logger,
+) http.HandlerFunc {
+	issuer := config.OIDC.Issuer
+	if issuer == "" {
+		issuer = defaultOIDCIssuer
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.With(traceLogFields(r.Context())...)
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+		w.Header().Set("Pragma", "no-cache")
+
+		query := r.URL.Query()
+		iss, sid := query.Get("iss"), query.Get("sid")
+		if iss != "" && iss != issuer {
+			writeError(w, r, http.StatusBadRequest, "issuer mismatch")
+			return
+		}
+
+		now := revocations.clock.Now()
+		if sid != "" {
+			revocations.revokeSID(sid, now)
+		}
+		if cookie, err := r.Cookie("credentials"); err == nil {
+			if credentials, err := secureCookies.Decode(cookie.Value); err == nil {
+				if details, err := parseIDToken(credentials); err == nil {
+					if sid == "" || sid == details.sessionID {
+						revocations.revokeSubject(details.userID, now)
+					}
+				}
+			}
+		}
+		clearCredentialsCookie(w)
+		logger.Info("front-channel logout", zap.String("sid", sid))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// logoutHandler serves POST /api/logout, which terminates the session
+// server-side: the user's sessions issued until now are revoked, and their
+// stored OAuth tokens deleted, and revoked with Google if
+// google.revoke_on_logout is set. The credentials cookie is cleared even if
+// the session is no longer valid.
+func logoutHandler(
+	config *appConfig,
+	secureCookies secureCookies,
+	parseIDToken func(string) (*authDetails, error),
+	revocations *sessionRevocations,
+	tokens *tokenStorage,
+	logger *zap.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.With(traceLogFields(r.Context())...)
+		w.Header().Set("Cache-Control", "no-store")
+		clearCredentialsCookie(w)
+
+		cookie, err := r.Cookie("credentials")
+		if err != nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		credentials, err := secureCookies.Decode(cookie.Value)
+		if err != nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		details, err := parseIDToken(credentials)
+		if err != nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		revocations.revokeSubject(details.userID, revocations.clock.Now())
+
+		deleted, err := tokens.delete(r.Context(), details.userID)
+		if err != nil {
+			logger.Error("failed to delete OAuth tokens on logout", zap.String("user.id", details.userID), zap.Error(err))
+		}
+		if token := deleted[providerGoogle]; token != nil && config.Google.RevokeOnLogout {
+			revoke := token.RefreshToken
+			if revoke == "" {
+				revoke = token.AccessToken
+			}
+			client := tokens.oauthClient
+			if client == nil {
+				client = http.DefaultClient
+			}
+			if err := revokeOAuthToken(r.Context(), client, config.googleRevokeURL(), revoke); err != nil {
+				logger.Warn("failed to revoke Google token", zap.String("user.id", details.userID), zap.Error(err))
+			}
+		}
+		logger.Info("user logged out", zap.String("user.id", details.userID))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// revokeOAuthToken revokes a token with an OAuth 2.0 revocation endpoint
+// (RFC 7009). Revoking a refresh token revokes the grant, and with it all
+// access tokens issued from it.
+func revokeOAuthToken(ctx context.Context, client *http.Client, revokeURL, token string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL, strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("while revoking token: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("revoking token failed: %s", res.Status)
+	}
+	return nil
+}
+
+// sessionPurgeHandler serves DELETE /api/admin/users/{id}/sessions, which
+// terminates all sessions of a user, e.g. when their device was lost.
+func sessionPurgeHandler(revocations *sessionRevocations, logger *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("id")
+		if dryRun(w, r, mutationEffect{UsersSignedOut: 1}) {
+			return
+		}
+		revocations.revokeSubject(userID, revocations.clock.Now())
+		logger.Info("sessions purged", append(traceLogFields(r.Context()), zap.String("user.id", userID))...)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
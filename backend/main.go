@@ -4,22 +4,38 @@ import (
 	"context"
 	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"app-backend/blobstore"
+	"app-backend/kms"
+	"app-backend/tokenstore"
+	"app-backend/tokenstore/esstore"
+	"app-backend/tokenstore/memstore"
+
 	"github.com/MicahParks/keyfunc"
 	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/julienschmidt/httprouter"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/oauth2"
 )
 
 const (
-	serviceName = "app-backend"
+	serviceName   = "app-backend"
+	googleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+	googleRevokeURL = "https://oauth2.googleapis.com/revoke"
 )
 
 func main() {
@@ -39,25 +55,30 @@ func main() {
 	logger := zap.New(core, zap.AddCaller())
 	zap.ReplaceGlobals(logger)
 
-	shutdown, err := initOpenTelemetry(context.Background(), serviceName)
-	if err != nil {
-		logger.Fatal("failed to init OpenTelemetry", zap.Error(err))
-	}
-	defer shutdown(context.Background())
-
 	configPath := flag.String("c", "", "path to configuration file")
 	flag.Parse()
+	if flag.Arg(0) == "config" {
+		if err := runConfigCommand(flag.Args()[1:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	config, err := loadConfig(*configPath)
 	if err != nil {
 		logger.Fatal("while loading config", zap.Error(err))
 	}
-	secureCookies, err := newSecureCookies(config.EncryptionKeys)
+	limitedCore, err := newLogCore(core, config)
 	if err != nil {
-		logger.Fatal("failed to construct secure cookie codecs", zap.Error(err))
+		logger.Fatal("failed to configure logging", zap.Error(err))
 	}
-	if len(secureCookies) == 0 {
-		logger.Warn("encryption_keys configuration unspecified: cookies will not be signed or encrypted")
+	logger = zap.New(limitedCore, zap.AddCaller())
+	zap.ReplaceGlobals(logger)
+
+	shutdown, spanExports, metricsHandler, err := initOpenTelemetry(context.Background(), serviceName, config)
+	if err != nil {
+		logger.Fatal("failed to init OpenTelemetry", zap.Error(err))
 	}
 
 	apmServerURL := os.Getenv("ELASTIC_APM_SERVER_URL")
@@ -65,13 +86,47 @@ func main() {
 		apmServerURL = "http://localhost:8200"
 	}
 
+	// Restrict outbound requests to expected hosts
+	egress, err := newEgressPolicy(config, logger)
+	if err != nil {
+		logger.Fatal("failed to create egress policy", zap.Error(err))
+	}
+	egressTransport := egress.transport(http.DefaultTransport)
+
+	// Retry transient failures of outbound calls, per call site
+	retriers := make(map[string]*retrier)
+	for _, callSite := range []string{"elasticsearch", "oauth", "jwks"} {
+		retriers[callSite], err = newRetrier(callSite, config.Retry)
+		if err != nil {
+			logger.Fatal("failed to create retrier", zap.Error(err))
+		}
+	}
+
 	var esClient *elasticsearch.Client
-	if config.Elasticsearch.APIKey == "" {
+	if config.Elasticsearch.APIKey == "" && config.Elasticsearch.TokenFile == "" {
 		logger.Info("Elasticsearch API Key not set, using in-memory storage")
 	} else {
+		esMetrics, err := newESMetrics(config, logger)
+		if err != nil {
+			logger.Fatal("failed to create Elasticsearch metrics", zap.Error(err))
+		}
+		base := egressTransport
+		if config.Elasticsearch.TokenFile != "" {
+			base = &tokenFileTransport{
+				base:         egressTransport,
+				path:         config.Elasticsearch.TokenFile,
+				sharedSecret: config.Elasticsearch.SharedSecret,
+			}
+		}
+		transport := esMetrics.transport(&budgetTransport{
+			base:    &retryTransport{base: esMetrics.attempts(base), retrier: retriers["elasticsearch"]},
+			timeout: timeoutOrDefault(config.Timeouts.Elasticsearch),
+		})
 		client, err := elasticsearch.NewClient(elasticsearch.Config{
 			Addresses:       []string{config.Elasticsearch.URL},
 			APIKey:          config.Elasticsearch.APIKey,
+			Transport:       transport,
+			DisableRetry:    true, // retried by the transport
 			Instrumentation: elasticsearch.NewOpenTelemetryInstrumentation(otel.GetTracerProvider(), false),
 		})
 		if err != nil {
@@ -81,99 +136,541 @@ func main() {
 	}
 
 	// Instrument all outgoing HTTP requests
-	http.DefaultClient.Transport = otelhttp.NewTransport(http.DefaultTransport)
+	http.DefaultClient.Transport = otelhttp.NewTransport(egressTransport)
+
+	// Unwrap the encryption keys with the key management service, if any
+	wrapper, err := kms.Open(config.KMS, http.DefaultClient)
+	if err != nil {
+		logger.Fatal("failed to configure key management", zap.Error(err))
+	}
+	var keys *keyring
+	if wrapper != nil {
+		keys = newKeyring(config, wrapper, esClient, logger)
+		config.EncryptionKeys, err = keys.load(context.Background(), config)
+		if err != nil {
+			logger.Fatal("failed to load encryption keys", zap.Error(err))
+		}
+		config.setSource("encryption_keys", configSourceKMS)
+	}
+	secureCookies, err := newSecureCookies(config.EncryptionKeys)
+	if err != nil {
+		logger.Fatal("failed to construct secure cookie codecs", zap.Error(err))
+	}
+	if len(secureCookies.keys()) == 0 {
+		logger.Warn("encryption_keys configuration unspecified: cookies will not be signed or encrypted")
+	}
+
+	// The time of sessions, cookies, and generated data, and the source
+	// of IDs and nonces, which tests replace to be deterministic
+	var clk clock = systemClock{}
+	var ids idSource = cryptoIDs{}
+
+	// Cache responses of identity providers, such as their signing keys
+	outboundCache, err := newHTTPCache(config)
+	if err != nil {
+		logger.Fatal("failed to create outbound HTTP cache", zap.Error(err))
+	}
 
 	// Initialize Google JWKs for token validation
 	googleJWKS, err := keyfunc.Get(
-		"https://www.googleapis.com/oauth2/v3/certs",
-		keyfunc.Options{RefreshInterval: time.Hour},
+		config.googleJWKSURL(),
+		keyfunc.Options{
+			Client: &http.Client{
+				Transport: outboundCache.transport(&retryTransport{base: http.DefaultClient.Transport, retrier: retriers["jwks"]}),
+			},
+			RefreshInterval: time.Hour,
+		},
 	)
 	if err != nil {
 		logger.Fatal("failed to obtain Google JWKS", zap.Error(err))
 	}
-	parseIDToken := idTokenParser(googleJWKS, config.Google.ClientID)
+	directory, err := newUserDirectory(esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create user directory", zap.Error(err))
+	}
+	directory.ids = ids
+
+	identities, err := newIdentityStore(esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create identity store", zap.Error(err))
+	}
+	identities.clock = clk
+
+	// Changes to state kept in memory by each replica are propagated
+	// through a change log
+	invalidations := newInvalidator(config, esClient, logger)
+	invalidations.start(context.Background())
+
+	revocations := newSessionRevocations()
+	revocations.clock = clk
+	revocations.watch(invalidations)
+	// Verified credentials are cached briefly, inside of the checks of
+	// revocations and deprovisioned users, which apply immediately.
+	authCache := newAuthCache(config)
+	if authCache != nil {
+		authCache.clock = clk
+	}
+	revocations.cache = authCache
+	parseIDToken := identities.wrap(idTokenParser(googleJWKS, config.Google.ClientID))
+	parseIDToken = authCache.wrap(localSessionParser(secureCookies, clk, parseIDToken))
+	parseIDToken = revocations.wrap(directory.wrap(parseIDToken))
+
+	googleConfig := newGoogleOAuthConfig(config.Google.ClientID, config.Google.ClientSecret, config.googleEndpoint())
+	oauthConfigs := map[string]oauth2.Config{providerGoogle: googleConfig}
+
+	// Optional Microsoft Entra ID sign-in
+	var microsoftJWKS *keyfunc.JWKS
+	if config.Microsoft.ClientID != "" {
+		if localSessionKey(config.EncryptionKeys) == nil {
+			logger.Fatal("Microsoft sign-in requires encryption_keys to be configured")
+		}
+		microsoftJWKS, err = keyfunc.Get(
+			microsoftJWKSURL,
+			keyfunc.Options{
+				Client: &http.Client{
+					Transport: outboundCache.transport(&retryTransport{base: http.DefaultClient.Transport, retrier: retriers["jwks"]}),
+				},
+				RefreshInterval: time.Hour,
+			},
+		)
+		if err != nil {
+			logger.Fatal("failed to obtain Microsoft JWKS", zap.Error(err))
+		}
+		oauthConfigs[providerMicrosoft] = newMicrosoftOAuthConfig(
+			config.Microsoft.ClientID, config.Microsoft.ClientSecret, config.microsoftTenant(),
+		)
+	}
+
+	oauthClient := newBudgetClient(
+		outboundCache.transport(&retryTransport{base: http.DefaultClient.Transport, retrier: retriers["oauth"]}),
+		timeoutOrDefault(config.Timeouts.OAuth),
+	)
+	// Optional Sign in with Apple
+	var appleJWKS *keyfunc.JWKS
+	var appleSecret *appleClientSecret
+	if config.Apple.ClientID != "" {
+		if localSessionKey(config.EncryptionKeys) == nil {
+			logger.Fatal("Sign in with Apple requires encryption_keys to be configured")
+		}
+		appleSecret, err = newAppleClientSecret(
+			config.Apple.TeamID, config.Apple.ClientID, config.Apple.KeyID, config.Apple.PrivateKey,
+		)
+		if err != nil {
+			logger.Fatal("invalid Apple configuration", zap.Error(err))
+		}
+		appleJWKS, err = keyfunc.Get(
+			appleJWKSURL,
+			keyfunc.Options{
+				Client: &http.Client{
+					Transport: outboundCache.transport(&retryTransport{base: http.DefaultClient.Transport, retrier: retriers["jwks"]}),
+				},
+				RefreshInterval: time.Hour,
+			},
+		)
+		if err != nil {
+			logger.Fatal("failed to obtain Apple JWKS", zap.Error(err))
+		}
+	}
 
-	googleConfig := newGoogleOAuthConfig(config.Google.ClientID, config.Google.ClientSecret)
+	// Optional sign-in with a generic OpenID Connect provider, configured
+	// from its discovery document
+	var oidcJWKS *keyfunc.JWKS
+	var oidcProvider *oidcDiscovery
+	if config.OIDC.ClientID != "" {
+		if localSessionKey(config.EncryptionKeys) == nil {
+			logger.Fatal("OIDC sign-in requires encryption_keys to be configured")
+		}
+		client := &http.Client{
+			Transport: outboundCache.transport(&retryTransport{base: http.DefaultClient.Transport, retrier: retriers["jwks"]}),
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeoutOrDefault(config.Timeouts.OAuth))
+		oidcProvider, err = fetchOIDCDiscovery(ctx, client, config.OIDC.Issuer)
+		cancel()
+		if err != nil {
+			logger.Fatal("failed to discover OIDC provider", zap.String("issuer", config.OIDC.Issuer), zap.Error(err))
+		}
+		oidcJWKS, err = keyfunc.Get(oidcProvider.JWKSURI, keyfunc.Options{Client: client, RefreshInterval: time.Hour})
+		if err != nil {
+			logger.Fatal("failed to obtain OIDC JWKS", zap.Error(err))
+		}
+		oauthConfigs[providerOIDC] = newOIDCOAuthConfig(
+			config.OIDC.ClientID, config.OIDC.ClientSecret, config.OIDC.Scopes, oidcProvider,
+		)
+	}
 
-	tokens, err := newTokenStorage(googleConfig, esClient, logger)
+	var tokenStore tokenstore.Store = memstore.New()
+	if esClient != nil {
+		tokenStore = esstore.New(esClient, logger)
+	}
+	tokens, err := newTokenStorage(
+		oauthConfigs, oauthClient, secureCookies, tokenStore, logger,
+	)
 	if err != nil {
 		logger.Fatal("failed to create token storage", zap.Error(err))
 	}
+	tokens.clock = clk
+	tokens.watch(invalidations)
+	tokens.start(context.Background())
 
-	// Generate sample data
-	sampleData := generateSampleData()
+	// Profiles which require a call to the provider's API are resolved
+	// from a cache, refreshed in the background
+	profiles := newProfileResolver(config, logger)
+	if microsoftJWKS != nil {
+		profiles.register(providerMicrosoft, microsoftProfileFetcher(
+			tokens, microsoftEmailTrusted(config.microsoftTenant(), config.Microsoft.AllowedTenants),
+		))
+	}
+	parseIDToken = profiles.wrap(parseIDToken)
 
-	router := httprouter.New()
+	var oauthStates *oauthStateStore
+	if config.OAuth.ServerSideState {
+		oauthStates = newOAuthStateStore(esClient, logger)
+		oauthStates.clock = clk
+	}
 
-	// Public endpoint: returns frontend configuration
-	router.GET("/api/config", wrapHandler(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		var result struct {
-			APM struct {
-				ServerURL string `json:"server_url"`
-			} `json:"apm"`
+	brand, err := newBranding(config)
+	if err != nil {
+		logger.Fatal("invalid branding configuration", zap.Error(err))
+	}
 
-			Google struct {
-				ClientID   string `json:"client_id"`
-				OAuthScope string `json:"oauth_scope"`
-			} `json:"google"`
-		}
-		result.APM.ServerURL = apmServerURL
-		result.Google.ClientID = config.Google.ClientID
-		result.Google.OAuthScope = "openid email profile"
-		json.NewEncoder(w).Encode(result)
-	}, "GET /api/config"))
+	mfaIssuer := config.MFA.Issuer
+	if mfaIssuer == "" {
+		mfaIssuer = brand.AppName
+	}
+	mfa, err := newMFAStorage(mfaIssuer, secureCookies, esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create MFA storage", zap.Error(err))
+	}
+	mfa.clock, mfa.ids = clk, ids
+	mfa.watch(invalidations)
+
+	tenants, err := newTenantStore(config, esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create tenant store", zap.Error(err))
+	}
+	tenants.watch(invalidations)
 
-	authMiddleware := getAuthMiddleware(secureCookies, parseIDToken)
+	// Identical concurrent reads, such as those of many users opening the
+	// app at once, share a single Elasticsearch query
+	reads, err := newReadCoalescer()
+	if err != nil {
+		logger.Fatal("failed to create read coalescer", zap.Error(err))
+	}
+
+	// Records, seeded with sample data the first time
+	sanitizer := newHTMLSanitizer(config)
+	records, err := newRecordStore(esClient, ids, clk, sanitizer, generateSampleData(clk, ids), logger)
+	if err != nil {
+		logger.Fatal("failed to create record store", zap.Error(err))
+	}
+	records.watch(invalidations)
+	tags, err := newTagStore(esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create tag store", zap.Error(err))
+	}
+	tags.reads = reads
+	comments, err := newCommentStore(esClient, sanitizer, logger)
+	if err != nil {
+		logger.Fatal("failed to create comment store", zap.Error(err))
+	}
+	comments.ids = ids
+	stars, err := newStarStore(esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create star store", zap.Error(err))
+	}
+	shares, err := newShareStore(esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create share store", zap.Error(err))
+	}
+	shares.watch(invalidations)
+	teams, err := newTeamStore(esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create team store", zap.Error(err))
+	}
+	teams.ids = ids
+	teams.watch(invalidations)
+	shares.teamsOf = teams.teamsOf
+	invitations, err := newInvitationStore(config, esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create invitation store", zap.Error(err))
+	}
+	invitations.clock, invitations.ids = clk, ids
+	invitations.watch(invalidations)
+	workflowStates, err := newWorkflowStore(esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create workflow store", zap.Error(err))
+	}
+	audit := newAuditLog(config, esClient, logger)
+	changes, err := newChangeFeed(esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create change feed", zap.Error(err))
+	}
+	changes.ids = ids
+	changes.watch(invalidations)
+	audit.changes = changes
+	if keys != nil {
+		keys.cookies, keys.audit, keys.invalidations = secureCookies, audit, invalidations
+		keys.watch(invalidations)
+		keys.start(context.Background())
+	}
+	blobs, err := blobstore.Open(config.Blobstore, http.DefaultClient)
+	if err != nil {
+		logger.Fatal("failed to open blob store", zap.Error(err))
+	}
+	startBlobCleanup(context.Background(), blobs, config.Blobstore, logger)
+	go newProfiler(config, blobs, logger).run(context.Background())
+	attachments, err := newAttachmentStore(config, esClient, blobs, logger)
+	if err != nil {
+		logger.Fatal("failed to create attachment store", zap.Error(err))
+	}
+	attachments.ids = ids
+	uploads, err := newUploadStore(config, esClient, blobs, logger)
+	if err != nil {
+		logger.Fatal("failed to create upload store", zap.Error(err))
+	}
+	uploads.clock, uploads.ids = clk, ids
+	uploads.startExpiry(context.Background())
+
+	security, err := newSecurityEvents(esClient, logger)
+	if err != nil {
+		logger.Fatal("failed to create security event recorder", zap.Error(err))
+	}
+	security.reads = reads
+	bots := newBotProtection(config, secureCookies, security, logger)
+	bots.clock, bots.ids = clk, ids
+	roles := newRoleResolver(config, logger)
+	guests := newGuestPolicy(config)
+	if guests != nil {
+		guests.clock, guests.ids = clk, ids
+	}
+	if guests != nil && localSessionKey(config.EncryptionKeys) == nil {
+		logger.Fatal("guest mode requires encryption_keys to be configured")
+	}
+	binding, err := newSessionBinding(config, secureCookies)
+	if err != nil {
+		logger.Fatal("invalid session binding configuration", zap.Error(err))
+	}
+	authMiddleware := getAuthMiddleware(secureCookies, binding, parseIDToken, roles, guests, security)
+	mfaMiddleware := requireMFA(mfa, secureCookies, config.MFA.Required)
+
+	router := http.NewServeMux()
+	routes := newRouteRegistry(router, config.Deprecations)
+	routes.slos, err = newSLOTracker(config, logger)
+	if err != nil {
+		logger.Fatal("invalid SLO configuration", zap.Error(err))
+	}
+	go routes.slos.run(context.Background())
+	cursors := newCursorCodec(secureCookies, clk)
+	invitationLinks := newInvitationLinks(config, secureCookies, clk)
+	policies, err := newPolicyEngine(config, audit, logger)
+	if err != nil {
+		logger.Fatal("failed to load policies", zap.Error(err))
+	}
+	policies.start(context.Background())
+	locales, err := newLocaleResolver(config)
+	if err != nil {
+		logger.Fatal("invalid locale configuration", zap.Error(err))
+	}
+
+	// Middleware pipelines of route groups, which may be overridden by
+	// configuration
+	routes.middleware.use("auth", authMiddleware)
+	routes.middleware.use("mfa", mfaMiddleware)
+	if config.AdminSecret == "" {
+		logger.Warn("admin_secret configuration unspecified: admin endpoints are disabled")
+	}
+	routes.middleware.use("admin_auth", func(h http.Handler) http.Handler {
+		return basicAuthMiddleware(config.AdminSecret, h)
+	})
+	routes.middleware.use("scim_auth", func(h http.Handler) http.Handler {
+		return scimAuthMiddleware(config.SCIM.Token, h)
+	})
+	routes.middleware.use("tenant", tenants.middleware)
+	routes.middleware.use("team", teams.middleware(secureCookies))
+	routes.middleware.use("locale", locales.middleware)
+	routes.middleware.use("policy", policies.middleware)
+	routes.middleware.use("sharing", shares.middleware)
+	routes.middleware.group(groupPublic)
+	routes.middleware.group(groupSignedIn, "auth", "tenant", "locale")
+	if policies != nil {
+		routes.middleware.group(groupUser, "auth", "mfa", "tenant", "team", "locale", "policy", "sharing")
+	} else {
+		routes.middleware.group(groupUser, "auth", "mfa", "tenant", "team", "locale", "sharing")
+	}
+	routes.middleware.group(groupAdmin, "admin_auth")
+	routes.middleware.group(groupSCIM, "scim_auth")
+	if err := routes.middleware.configure(config.Middleware.Groups); err != nil {
+		logger.Fatal("invalid middleware configuration", zap.Error(err))
+	}
+	public := routes.group(groupPublic)
+	user := routes.group(groupUser)
+	admin := routes.group(groupAdmin)
+
+	// Public endpoint: returns frontend configuration, which only changes
+	// with the config and the build, so is encoded once and cached by
+	// browsers and proxies
+	var configResult struct {
+		APM struct {
+			ServerURL string `json:"server_url"`
+		} `json:"apm"`
+
+		Google struct {
+			ClientID   string `json:"client_id"`
+			OAuthScope string `json:"oauth_scope"`
+			AuthURL    string `json:"auth_url"`
+		} `json:"google"`
+
+		Microsoft struct {
+			LoginURL string `json:"login_url,omitempty"`
+		} `json:"microsoft"`
+
+		Apple struct {
+			LoginURL string `json:"login_url,omitempty"`
+		} `json:"apple"`
+
+		OIDC struct {
+			LoginURL string `json:"login_url,omitempty"`
+			Name     string `json:"name,omitempty"`
+		} `json:"oidc"`
+
+		Captcha struct {
+			Provider string `json:"provider,omitempty"`
+			SiteKey  string `json:"site_key,omitempty"`
+		} `json:"captcha"`
+
+		Guest struct {
+			Enabled bool `json:"enabled"`
+		} `json:"guest"`
+
+		Branding *branding `json:"branding"`
+	}
+	configResult.APM.ServerURL = apmServerURL
+	configResult.Google.ClientID = config.Google.ClientID
+	configResult.Google.OAuthScope = "openid email profile"
+	configResult.Google.AuthURL = googleConfig.Endpoint.AuthURL
+	if microsoftJWKS != nil {
+		configResult.Microsoft.LoginURL = "/api/login/microsoft"
+	}
+	if appleJWKS != nil {
+		configResult.Apple.LoginURL = "/api/login/apple"
+	}
+	if oidcJWKS != nil {
+		configResult.OIDC.LoginURL = "/api/login/oidc"
+		configResult.OIDC.Name = config.oidcName()
+	}
+	configResult.Guest.Enabled = guests != nil
+	configResult.Branding = brand
+	switch {
+	case config.BotProtection.Turnstile.SiteKey != "":
+		configResult.Captcha.Provider = "turnstile"
+		configResult.Captcha.SiteKey = config.BotProtection.Turnstile.SiteKey
+	case config.BotProtection.Recaptcha.SiteKey != "":
+		configResult.Captcha.Provider = "recaptcha"
+		configResult.Captcha.SiteKey = config.BotProtection.Recaptcha.SiteKey
+	}
+	configBody, err := json.Marshal(configResult)
+	if err != nil {
+		logger.Fatal("failed to encode frontend configuration", zap.Error(err))
+	}
+	configBody = append(configBody, '\n')
+	configETag := contentETag(buildVersion(), configBody)
+	public.GET("/api/config", func(w http.ResponseWriter, r *http.Request) {
+		serveCacheable(w, r, configBody, configETag, config.configMaxAge())
+	})
 
 	// Authenticate endpoint: validates credentials and returns user profile
-	router.GET("/api/authenticate", wrapHandler(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	public.GET("/api/authenticate", func(w http.ResponseWriter, r *http.Request) {
 		logger := logger.With(traceLogFields(r.Context())...)
 		authHeader := r.Header.Get("Authorization")
 		var credentials string
+		eventKind := securityEventAuth
 		if authHeader != "" {
+			eventKind = securityEventSignIn
 			fields := splitAuthHeader(authHeader)
 			if len(fields) != 2 || fields[0] != "Bearer" {
-				http.Error(w, "invalid Authorization header", http.StatusUnauthorized)
+				security.record(r, eventKind, reasonInvalidHeader, "")
+				writeError(w, r, http.StatusUnauthorized, "invalid Authorization header")
 				return
 			}
 			credentials = fields[1]
-			cookieValue, err := secureCookies.Encode(credentials)
-			if err != nil {
-				logger.Error("failed to encode credentials cookie", zap.Error(err))
-				http.Error(w, "failed to encode cookie", http.StatusInternalServerError)
-				return
-			}
-			http.SetCookie(w, &http.Cookie{
-				Name:     "credentials",
-				Value:    cookieValue,
-				Secure:   true,
-				HttpOnly: true,
-				Expires:  time.Now().Add(7 * 24 * time.Hour),
-			})
 		} else {
 			cookie, err := r.Cookie("credentials")
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
+				security.record(r, eventKind, reasonCookieMissing, "")
+				writeError(w, r, http.StatusUnauthorized, err.Error())
 				return
 			}
 			credentials, err = secureCookies.Decode(cookie.Value)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
+				security.record(r, eventKind, reasonCookieDecodeError, "")
+				writeError(w, r, http.StatusUnauthorized, err.Error())
+				return
+			}
+			if !binding.matches(r, credentials) {
+				security.record(r, eventKind, reasonBindingMismatch, "")
+				writeError(w, r, http.StatusUnauthorized, "session is bound to another client")
 				return
 			}
 		}
 		auth, err := parseIDToken(credentials)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			security.record(r, eventKind, tokenFailureReason(err), "")
+			writeError(w, r, http.StatusUnauthorized, err.Error())
 			return
 		}
+		if eventKind == securityEventSignIn {
+			// A new identity with the email address of an existing
+			// user must be linked to it before signing in.
+			if provider, subject, ok := identityOf(auth); ok {
+				userID, err := identities.resolve(r.Context(), provider, subject, auth.email)
+				if errors.Is(err, errAccountLinkRequired) {
+					link := pendingAccountLink{Provider: provider, Subject: subject, Email: auth.email, UserID: userID}
+					if err := setPendingAccountLink(w, secureCookies, identities.clock, link); err != nil {
+						writeError(w, r, http.StatusInternalServerError, err.Error())
+						return
+					}
+					security.record(r, eventKind, reasonLinkRequired, subject)
+					writeError(w, r, http.StatusConflict, err.Error())
+					return
+				} else if err != nil {
+					logger.Warn("failed to save identity", zap.Error(err))
+				}
+				auth.userID = userID
+			}
+
+			cookieValue, err := secureCookies.Encode(credentials)
+			if err != nil {
+				logger.Error("failed to encode credentials cookie", zap.Error(err))
+				writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+				return
+			}
+			expires := clk.Now().Add(7 * 24 * time.Hour)
+			if err := binding.set(w, r, credentials, expires); err != nil {
+				logger.Error("failed to bind session", zap.Error(err))
+				writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     "credentials",
+				Value:    cookieValue,
+				Secure:   true,
+				HttpOnly: true,
+				Expires:  expires,
+			})
+		}
+		security.record(r, eventKind, reasonSuccess, auth.userID)
+		invitations.acceptFromCookie(w, r, auth, invitationLinks, teams, audit, logger)
 
 		result := struct {
 			Profile struct {
-				Name    string `json:"name"`
-				UserID  string `json:"id"`
-				Email   string `json:"email"`
-				Picture string `json:"picture"`
+				Name    string   `json:"name"`
+				UserID  string   `json:"id"`
+				Email   string   `json:"email"`
+				Picture string   `json:"picture"`
+				Roles   []string `json:"roles"`
+
+				// Principal is "guest" for guest sessions, otherwise "user"
+				Principal string `json:"principal"`
 			} `json:"profile"`
 
 			// GoogleAuthorized reports whether the user has authorized additional Google scopes
@@ -184,94 +681,528 @@ func main() {
 
 			// GoogleAuthorizationError holds an error message related to authorization
 			GoogleAuthorizationError string `json:"google_authorization_error,omitempty"`
+
+			// MFAEnrolled reports whether the user has enrolled a second factor
+			MFAEnrolled bool `json:"mfa_enrolled"`
+
+			// MFAPassed reports whether the session has passed second-factor verification
+			MFAPassed bool `json:"mfa_passed"`
+
+			// TOTPEnrolled reports whether the user has enrolled an authenticator app
+			TOTPEnrolled bool `json:"totp_enrolled"`
+
+			// Passkeys holds the number of passkeys the user has registered
+			Passkeys int `json:"passkeys"`
+
+			// AccountLinkPending holds the provider of an identity awaiting
+			// confirmation of a link to this user, with POST /api/account/link
+			AccountLinkPending string `json:"account_link_pending,omitempty"`
 		}{}
 		result.Profile.Name = auth.name
 		result.Profile.Picture = auth.picture
 		result.Profile.UserID = auth.userID
 		result.Profile.Email = auth.email
+		result.Profile.Roles = roles.rolesFor(r.Context(), auth.email)
+		result.Profile.Principal = auth.principalType()
 
 		// For this simple app, we consider the user authorized after initial sign-in
 		// Additional Google Drive scopes could be requested if needed
 		result.GoogleAuthorized = true
+		if auth.principalType() == principalUser {
+			state, cookie, err := generateOAuthState(
+				r.Context(), ids, secureCookies, oauthStates,
+				googleStateCookieKey, googleConfig.RedirectURL, nil,
+			)
+			if err != nil {
+				logger.Error("failed to generate Google OAuth state", zap.Error(err))
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			http.SetCookie(w, cookie)
+			result.GoogleOAuthState = state
+		}
+
+		result.MFAEnrolled = mfa.enrolled(auth.userID)
+		result.MFAPassed = mfaPassed(r, secureCookies, auth)
+		result.TOTPEnrolled = mfa.totpEnabled(auth.userID)
+		result.Passkeys = mfa.passkeyCount(auth.userID)
+		if link := pendingAccountLinkFor(r, secureCookies, identities.clock, auth.userID); link != nil {
+			result.AccountLinkPending = link.Provider
+		}
 
+		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(result)
-	}, "GET /api/authenticate"))
+	})
+
+	// Logout, terminating the session server-side
+	public.POST("/api/logout",
+		logoutHandler(config, secureCookies, parseIDToken, revocations, tokens, logger),
+	)
+
+	// OpenID Connect RP-initiated and front-channel logout
+	public.GET("/api/oidc/logout",
+		oidcLogoutHandler(config, oidcProvider, secureCookies, parseIDToken, revocations, logger),
+	)
+	public.GET("/api/oidc/frontchannel-logout",
+		frontChannelLogoutHandler(config, secureCookies, parseIDToken, revocations, logger),
+	)
 
 	// Google OAuth callback
-	router.GET("/api/oauth/google", wrapHandler(authMiddleware(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	routes.group(groupSignedIn).GET("/api/oauth/google", func(w http.ResponseWriter, r *http.Request) {
 		auth := authFromContext(r.Context())
 		code := r.URL.Query().Get("code")
-		if _, err := validateOAuthState(secureCookies, r, googleStateCookieKey); err != nil {
-			http.Error(w, "invalid authorization state", http.StatusUnauthorized)
+		if _, err := validateOAuthState(secureCookies, oauthStates, r, googleStateCookieKey); err != nil {
+			security.record(r, securityEventOAuthState, reasonStateInvalid, auth.userID)
+			writeError(w, r, http.StatusUnauthorized, "invalid authorization state")
 			return
 		}
-		token, err := oauth2ConfigForURL(googleConfig, r).Exchange(r.Context(), code)
+		token, err := oauth2ConfigForURL(googleConfig, r).Exchange(tokens.oauthContext(r.Context()), code)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			writeError(w, r, http.StatusUnauthorized, err.Error())
 			return
 		}
 		if err := tokens.setGoogle(r.Context(), auth.userID, token); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
 			return
 		}
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-	}), "GET /api/oauth/google"))
+	})
 
 	// User profile endpoint (authenticated)
-	router.GET("/api/user", wrapHandler(authMiddleware(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user.GET("/api/user", func(w http.ResponseWriter, r *http.Request) {
 		auth := authFromContext(r.Context())
+		tenant := tenantSettingsFromContext(r.Context())
 		result := struct {
-			Name    string `json:"name"`
-			Email   string `json:"email"`
-			Picture string `json:"picture"`
-			UserID  string `json:"user_id"`
+			Name     string          `json:"name"`
+			Email    string          `json:"email"`
+			Picture  string          `json:"picture"`
+			UserID   string          `json:"user_id"`
+			Tenant   string          `json:"tenant,omitempty"`
+			Features map[string]bool `json:"features"`
 		}{
-			Name:    auth.name,
-			Email:   auth.email,
-			Picture: auth.picture,
-			UserID:  auth.userID,
+			Name:     auth.name,
+			Email:    auth.email,
+			Picture:  auth.picture,
+			UserID:   auth.userID,
+			Tenant:   tenant.Tenant,
+			Features: tenant.Features,
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(result)
-	}), "GET /api/user"))
+	})
 
 	// Hello endpoint (authenticated) - returns a greeting message
-	router.GET("/api/hello", wrapHandler(authMiddleware(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user.GET("/api/hello", func(w http.ResponseWriter, r *http.Request) {
 		auth := authFromContext(r.Context())
 		result := struct {
 			Message   string `json:"message"`
 			Timestamp string `json:"timestamp"`
 			User      string `json:"user"`
 		}{
-			Message:   "Hello, " + auth.name + "! Welcome to the App Scaffold.",
-			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Message:   "Hello, " + auth.name + "! Welcome to the " + tenantSettingsFromContext(r.Context()).Branding.AppName + ".",
+			Timestamp: clk.Now().In(localeFromContext(r.Context()).Location).Format(time.RFC3339),
 			User:      auth.email,
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(result)
-	}), "GET /api/hello"))
+	})
+
+	var searchRecords recordSource = func(userID string, search recordSearch) []SampleRecord {
+		result := tags.tagged(records.list(), search.Tags)
+		result = shares.visible(result, shares.accessor(userID, search.Roles), search.SharedWithMe, search.Team)
+		result = stars.starred(result, userID, search.StarredOnly)
+		return search.filter(workflowStates.apply(result))
+	}
 
-	// Data endpoint (authenticated) - returns sample table data
-	router.GET("/api/data", wrapHandler(authMiddleware(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	// Data endpoint (authenticated) - returns table data
+	user.GET("/api/data", func(w http.ResponseWriter, r *http.Request) {
+		fields, err := parseFields[SampleRecord](r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		filter, err := parseTagFilter(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		starredOnly, err := parseStarredOnly(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		sharedWithMe, err := parseSharedWithMe(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		team, err := parseTeamOnly(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		order, err := parseRecordOrder(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		numbered, err := parseRecordPage(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		auth := authFromContext(r.Context())
+		query := r.URL.Query()
+		records := searchRecords(auth.userID, recordSearch{
+			Tags:         filter,
+			StarredOnly:  starredOnly,
+			SharedWithMe: sharedWithMe,
+			Team:         team,
+			Status:       query.Get("status"),
+			Category:     query.Get("category"),
+			Query:        query.Get("q"),
+			Roles:        auth.roles,
+		})
+		order.sort(records)
+		if numbered != nil {
+			w.Header().Set("Content-Type", "application/json")
+			if err := numbered.write(w, records, fields); err != nil {
+				logger.Warn("failed to write data", append(traceLogFields(r.Context()), zap.Error(err))...)
+			}
+			return
+		}
+		page, err := paginateOrdered(w, r, cursors, order.name(), records, order.key, order.desc)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(sampleData)
-	}), "GET /api/data"))
+		if err := writeJSONList(w, page, fields); err != nil {
+			logger.Warn("failed to write data", append(traceLogFields(r.Context()), zap.Error(err))...)
+		}
+	})
 
-	// Admin endpoint for health checks
-	router.GET("/api/admin/health", wrapHandler(basicAuthMiddleware(config.AdminSecret, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	// Records created per week, in the time zone of the request
+	user.GET("/api/stats/created-per-week", func(w http.ResponseWriter, r *http.Request) {
+		auth := authFromContext(r.Context())
+		loc := localeFromContext(r.Context()).Location
 		result := struct {
-			Status    string `json:"status"`
-			Timestamp string `json:"timestamp"`
+			Timezone string      `json:"timezone"`
+			Weeks    []weekCount `json:"weeks"`
 		}{
-			Status:    "ok",
-			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Timezone: loc.String(),
+			Weeks:    createdPerWeek(searchRecords(auth.userID, recordSearch{Roles: auth.roles}), loc),
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(result)
-	}), "GET /api/admin/health"))
+	})
+
+	// Record tagging and tag suggestions
+	registerTagRoutes(routes, tags, records, shares, logger)
+
+	// Comments on records
+	registerCommentRoutes(routes, comments, records, cursors, logger)
+
+	// Sharing records with users and roles
+	registerShareRoutes(routes, shares, records, audit, logger)
+
+	// Teams, their members and preferences, and the session's team
+	registerTeamRoutes(routes, teams, secureCookies, audit, logger)
+	if len(secureCookies.keys()) > 0 {
+		registerInvitationRoutes(routes, invitations, invitationLinks, teams, audit, logger)
+	} else {
+		logger.Warn("encryption_keys configuration unspecified: invitations to teams are disabled")
+	}
+
+	// Starred records
+	registerStarRoutes(routes, stars, records, cursors, logger)
+
+	// Record assignment and workflow transitions
+	wf := newWorkflow(config)
+	registerWorkflowRoutes(routes, wf, workflowStates, records, audit, logger)
+
+	// Reading, creating, updating, and deleting records
+	registerRecordRoutes(routes, records, wf, func(userID string, record SampleRecord) SampleRecord {
+		presented := tags.tagged([]SampleRecord{record}, nil)
+		return workflowStates.apply(stars.starred(presented, userID, false))[0]
+	}, audit, logger)
+
+	// Following changes to records, streamed or long-polled
+	user.GET(changeStreamPath, changeStreamHandler(changes, shares, changeStreamKeepAlive, logger))
+	user.GET(changesPath, changesHandler(changes, shares, config.Changes.Hold, logger))
 
-	logger.Info("starting server on :4000")
-	if err := http.ListenAndServe(":4000", router); err != nil {
+	// Files attached to records, with thumbnails of images
+	registerUploadRoutes(routes, uploads, logger)
+	registerAttachmentRoutes(routes, attachments, uploads, records, newURLSigner(secureCookies, clk), newDownloadThrottle(config), logger)
+
+	// Column schema of the records, for rendering the data grid
+	if err := registerSchemaRoutes(routes, map[string][]string{
+		"category": categories,
+		"status":   wf.statuses(),
+	}); err != nil {
+		logger.Fatal("failed to register schema routes", zap.Error(err))
+	}
+
+	// Global search across records, comments, and users
+	registerSearchRoutes(
+		routes,
+		recordSearchSource(searchRecords),
+		commentSearchSource(comments, shares),
+		userSearchSource(identities),
+	)
+
+	// Typeahead suggestions of record field values
+	registerSuggestRoutes(routes, newRecordSuggester(searchRecords), tags, shares)
+
+	// TOTP second-factor enrollment and verification
+	registerMFARoutes(routes, mfa, secureCookies, security, config.stepUpMaxAge())
+
+	// WebAuthn passkey registration and assertion
+	if err := registerWebAuthnRoutes(routes, config, mfa, secureCookies, binding, security, logger); err != nil {
+		logger.Fatal("failed to register WebAuthn routes", zap.Error(err))
+	}
+
+	// Microsoft Entra ID sign-in
+	if microsoftJWKS != nil {
+		registerMicrosoftRoutes(
+			routes,
+			oauthConfigs[providerMicrosoft],
+			microsoftIDTokenParser(
+				microsoftJWKS, config.Microsoft.ClientID, config.microsoftTenant(), config.Microsoft.AllowedTenants,
+			),
+			microsoftEmailTrusted(config.microsoftTenant(), config.Microsoft.AllowedTenants),
+			tokens, identities, profiles, oauthStates, ids, clk, secureCookies, binding, security, logger,
+		)
+	}
+
+	// Sign in with Apple
+	if appleJWKS != nil {
+		registerAppleRoutes(
+			routes,
+			newAppleOAuthConfig(config.Apple.ClientID),
+			appleSecret,
+			appleIDTokenParser(appleJWKS, config.Apple.ClientID),
+			identities, oauthStates, ids, clk, secureCookies, binding, security, logger,
+		)
+	}
+
+	// Generic OpenID Connect sign-in
+	if oidcJWKS != nil {
+		registerOIDCRoutes(
+			routes,
+			oauthConfigs[providerOIDC],
+			oidcIDTokenParser(oidcJWKS, config.OIDC.ClientID, oidcProvider),
+			tokens, identities, oauthStates, ids, clk, secureCookies, binding, security, logger,
+		)
+	}
+
+	// Guest sessions, for public demos
+	registerGuestRoutes(routes, guests, secureCookies, binding, security, logger)
+
+	// Identities linked to the user's account
+	registerAccountRoutes(routes, identities, secureCookies, cursors, security, logger)
+
+	// SCIM 2.0 provisioning endpoints, for identity providers
+	registerSCIMRoutes(routes, directory)
+
+	// Dependency health checks, run periodically in the background
+	health := newHealthMonitor(esClient, logger)
+	health.reads = reads
+	if esClient != nil {
+		health.register("elasticsearch", elasticsearchHealthCheck(esClient))
+	}
+	health.register("google_jwks", httpHealthCheck(config.googleJWKSURL()))
+	if microsoftJWKS != nil {
+		health.register("microsoft_jwks", httpHealthCheck(microsoftJWKSURL))
+	}
+	if appleJWKS != nil {
+		health.register("apple_jwks", httpHealthCheck(appleJWKSURL))
+	}
+	if oidcJWKS != nil {
+		health.register("oidc_jwks", httpHealthCheck(oidcProvider.JWKSURI))
+	}
+	if roles.ldap != nil {
+		health.register("ldap", roles.ldap.ping)
+	}
+
+	// API modules added with registerModule
+	if err := loadModules(context.Background(), moduleEnv{
+		Config:        config,
+		Routes:        routes,
+		Client:        esClient,
+		Logger:        logger,
+		SecureCookies: secureCookies,
+		Health:        health,
+		Records:       searchRecords,
+		Blobs:         blobs,
+		IDs:           ids,
+		Clock:         clk,
+	}); err != nil {
+		logger.Fatal("failed to load modules", zap.Error(err))
+	}
+	health.start(context.Background())
+
+	// Admin endpoints for health checks
+	admin.GET("/api/admin/health", healthHandler(health))
+	admin.GET("/api/admin/health/history", healthHistoryHandler(health))
+
+	// Admin endpoint reporting per-endpoint usage
+	admin.GET("/api/admin/usage/endpoints", endpointUsageHandler(routes, cursors))
+
+	// Admin endpoint running an end-to-end self test
+	admin.POST("/api/admin/selftest", selfTestHandler(&selfTest{
+		secureCookies: secureCookies,
+		client:        esClient,
+		exports:       spanExports,
+		tokenURL:      config.SelfTest.TokenURL,
+	}))
+
+	// Admin endpoint dumping the effective middleware chains
+	admin.GET("/api/admin/middleware", middlewareHandler(routes))
+
+	// Admin endpoint reporting the effective configuration, with secrets
+	// redacted, and where each setting was set
+	admin.GET("/api/admin/config", configReportHandler(config))
+
+	// Admin endpoint to report error budget burn rates of SLOs
+	admin.GET("/api/admin/slo", sloHandler(routes.slos))
+
+	// Admin endpoint serving metrics to Prometheus, in the OpenMetrics
+	// format if requested
+	if metricsHandler != nil {
+		admin.GET("/metrics", metricsHandler.ServeHTTP)
+	}
+
+	// Admin endpoint dropping cached responses of identity providers
+	admin.DELETE("/api/admin/http-cache", httpCachePurgeHandler(outboundCache), dryRunRoute())
+
+	// Dangerous admin actions must be confirmed with a token issued
+	// seconds earlier
+	confirm := newConfirmations(config.AdminSecret)
+
+	// Admin endpoint terminating all sessions of a user
+	admin.DELETE("/api/admin/users/{id}/sessions", confirm.wrap(sessionPurgeHandler(revocations, logger)), dryRunRoute())
+
+	// Admin endpoints to manage tenants' overrides of configuration values
+	registerTenantRoutes(routes, tenants, confirm, logger)
+
+	// Admin endpoint summarizing authentication events
+	admin.GET("/api/admin/security/summary", securitySummaryHandler(security))
+
+	// Public endpoint: serves the OpenAPI spec
+	public.GET("/api/openapi.yaml", openAPISpecHandler)
+
+	// Public endpoint: issues proof-of-work challenges for bot protection
+	public.GET("/api/bot/challenge", bots.powChallengeHandler)
+
+	// Prime caches and connection pools before reporting ready
+	warm := newWarmUp(config, logger)
+	warm.register("jwks.google", warmJWKS(googleJWKS))
+	if microsoftJWKS != nil {
+		warm.register("jwks.microsoft", warmJWKS(microsoftJWKS))
+	}
+	if appleJWKS != nil {
+		warm.register("jwks.apple", warmJWKS(appleJWKS))
+	}
+	if oidcJWKS != nil {
+		warm.register("jwks.oidc", warmJWKS(oidcJWKS))
+	}
+	if esClient != nil {
+		warm.register("elasticsearch", warmElasticsearch(esClient))
+	}
+	warm.register("tag_suggestions", func(ctx context.Context) error {
+		_, err := tags.suggest(ctx, "", defaultTagSuggestions, nil)
+		return err
+	})
+	public.GET("/api/ready", readyHandler(warm))
+	go warm.run(context.Background())
+
+	// Requests matching no route get JSON errors, as others do
+	api := muxErrors(router)
+
+	// Batches of requests to the API. Bot protection applies to each of
+	// their sub-requests, as it does to requests of the routes it protects.
+	batch := &batchHandler{handler: bots.handler(api)}
+	public.POST(batchPath, batch.ServeHTTP)
+
+	// Everything the frontend loads at start, in one request
+	user.GET(bootstrapPath, (&bootstrapHandler{batch: batch}).ServeHTTP)
+
+	handler := api
+	handler = routes.middleware.wrapServer("deadline", handler, deadlineMiddleware(config.Timeouts.Request))
+	if config.Debug.ValidateOpenAPI {
+		doc, err := loadOpenAPISpec()
+		if err != nil {
+			logger.Fatal("failed to load OpenAPI spec", zap.Error(err))
+		}
+		validator, err := newOpenAPIValidator(doc, logger)
+		if err != nil {
+			logger.Fatal("failed to create OpenAPI validator", zap.Error(err))
+		}
+		logger.Warn("OpenAPI validation enabled: responses are buffered for validation")
+		handler = routes.middleware.wrapServer("openapi_validation", handler, validator.handler)
+	}
+	if config.FaultInjection.Enabled {
+		logger.Warn("fault injection enabled: requests will be delayed, failed, or dropped")
+		handler = routes.middleware.wrapServer(
+			"fault_injection", handler, newFaultInjector(config.FaultInjection.Routes, logger).handler,
+		)
+	}
+	if config.Debug.CaptureRequests {
+		logger.Warn("request capture enabled: sanitized requests and responses are kept in memory")
+		capture := newHARCapture(config.Debug.CaptureCapacity, config.Debug.CaptureMaxBodyBytes)
+		handler = routes.middleware.wrapServer("request_capture", handler, capture.handler)
+
+		// Admin endpoints to download and clear captured requests
+		admin.GET(harPath, harHandler(capture))
+		admin.DELETE(harPath, harClearHandler(capture), dryRunRoute())
+	}
+
+	handler = routes.middleware.wrapServer("bot_protection", handler, bots.handler)
+	if config.API.Envelope {
+		handler = routes.middleware.wrapServer("envelope", handler, envelopeMiddleware)
+	}
+	proxies, err := newTrustedProxies(config)
+	if err != nil {
+		logger.Fatal("invalid trusted proxies", zap.Error(err))
+	}
+	handler = routes.middleware.wrapServer("client_ip", handler, proxies.middleware)
+
+	// Serve the frontend too in single-binary deployments
+	frontend, err := frontendFiles(config)
+	if err != nil {
+		logger.Fatal("failed to load the frontend", zap.Error(err))
+	}
+	if frontend != nil {
+		logger.Info("serving the frontend along with the API")
+		handler = frontendHandler(router, handler, frontend)
+	}
+
+	listener, err := newListener(config)
+	if err != nil {
+		logger.Fatal("failed to listen", zap.Error(err))
+	}
+	storage := "elasticsearch"
+	if esClient == nil {
+		storage = "memory"
+	}
+	startup, err := newStartupSummary(config, storage, []string{listener.Addr().String()})
+	if err != nil {
+		logger.Fatal("failed to summarize configuration", zap.Error(err))
+	}
+	startup.log(context.Background(), logger, audit)
+
+	// Drain connections on SIGTERM, then flush pending Elasticsearch
+	// writes, and the telemetry recording them.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if grace := config.Server.TerminationGracePeriod; grace > 0 && config.drainTimeout()+flushTimeout > grace {
+		logger.Warn("the drain timeout leaves no time to flush within the termination grace period",
+			zap.Duration("drain_timeout", config.drainTimeout()), zap.Duration("termination_grace_period", grace))
+	}
+	server := &http.Server{Handler: handler}
+	server.RegisterOnShutdown(changes.close)
+	if err := serve(ctx, server, listener, config.drainTimeout(), logger, audit.flush, security.flush, shutdown); err != nil {
 		logger.Fatal("server error", zap.Error(err))
 	}
 }
@@ -290,23 +1221,39 @@ func splitAuthHeader(header string) []string {
 	return []string{header[:idx], header[idx+1:]}
 }
 
-func basicAuthMiddleware(secret string, h httprouter.Handle) httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+// basicAuthMiddleware requires the admin secret as the password of HTTP
+// basic authentication. Without a secret, admin endpoints are not mounted:
+// they are not found, rather than open to an empty password.
+func basicAuthMiddleware(secret string, h http.Handler) http.Handler {
+	if secret == "" {
+		return http.NotFoundHandler()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, password, ok := r.BasicAuth()
 		if ok && subtle.ConstantTimeCompare([]byte(password), []byte(secret)) == 1 {
-			h(w, r, p)
+			h.ServeHTTP(w, r)
 			return
 		}
 		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-	}
+		writeError(w, r, http.StatusUnauthorized, "Unauthorized")
+	})
 }
 
-func wrapHandler(handler httprouter.Handle, operation string) httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		adapted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			handler(w, r, p)
-		})
-		otelhttp.NewHandler(adapted, operation).ServeHTTP(w, r)
-	}
+// wrapHandler traces the requests to a route, in spans named after its
+// operation, and records their metrics. Neither are labeled by the raw
+// path, whose parameters are unbounded, but by the route pattern, nor by
+// the Host header, which clients set to anything, but by serviceName.
+func wrapHandler(handler http.Handler, operation string) http.Handler {
+	// otelhttp only labels spans with the route.
+	_, pattern, _ := strings.Cut(operation, " ")
+	routeAttrs := []attribute.KeyValue{attribute.String("http.route", pattern)}
+	return otelhttp.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			w.Header().Set(traceIDHeader, sc.TraceID().String())
+		}
+		handler.ServeHTTP(w, r)
+	}), operation,
+		otelhttp.WithServerName(serviceName),
+		otelhttp.WithMetricAttributesFn(func(*http.Request) []attribute.KeyValue { return routeAttrs }),
+	)
 }
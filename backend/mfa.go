@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	mfaIndex      = "app-mfa"
+	mfaCookieName = "mfa"
+
+	numRecoveryCodes = 10
+
+	// totpPeriod is the time step of TOTP codes, in seconds.
+	totpPeriod = 30
+
+	// maxMFAFailures is the number of consecutive failed verifications
+	// after which a user's verifications are refused for mfaLockout.
+	maxMFAFailures = 5
+	mfaLockout     = 15 * time.Minute
+
+	// mfaRequired is the code of the error returned when the user must
+	// complete second-factor verification.
+	mfaRequired = "mfa_required"
+)
+
+var (
+	errMFANotEnrolled = errors.New("second factor not enrolled")
+	errInvalidMFACode = errors.New("invalid verification code")
+	errMFALockedOut   = errors.New("too many failed verifications, try again later")
+)
+
+// mfaDocument holds a user's second-factor enrollments, as persisted in
+// Elasticsearch. The TOTP secret is encrypted with the secure cookie
+// keys, and recovery codes are stored as SHA-256 hashes.
+type mfaDocument struct {
+	TOTP struct {
+		Secret     string   `json:"secret"`
+		Enabled    bool     `json:"enabled"`
+		EnrolledAt string   `json:"enrolled_at,omitempty"`
+		Recovery   []string `json:"recovery_code_hashes,omitempty"`
+
+		// LastStep is the time step of the last code accepted, so that
+		// codes are accepted once.
+		LastStep int64 `json:"last_step,omitempty"`
+	} `json:"totp"`
+
+	// WebAuthn holds registered passkeys, along with the profile details
+	// needed to sign the user in with a passkey alone.
+	WebAuthn struct {
+		UserHandle  []byte                `json:"user_handle,omitempty"`
+		Credentials []webauthn.Credential `json:"credentials,omitempty"`
+		Email       string                `json:"email,omitempty"`
+		Name        string                `json:"name,omitempty"`
+		Picture     string                `json:"picture,omitempty"`
+	} `json:"webauthn"`
+}
+
+// mfaStorage manages second-factor enrollments.
+type mfaStorage struct {
+	issuer        string
+	secureCookies secureCookies
+	client        *elasticsearch.Client
+	logger        *zap.Logger
+	invalidations *invalidator
+	ids           idSource
+	clock         clock
+
+	mu   sync.RWMutex
+	docs map[string]*mfaDocument
+
+	// failures holds the failed verifications of each user since their
+	// last successful one, in this replica.
+	failuresMu sync.Mutex
+	failures   map[string]*mfaFailures
+}
+
+// mfaFailures counts a user's consecutive failed verifications, and when
+// their lockout, if any, ends.
+type mfaFailures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+// newMFAStorage creates a new mfaStorage instance.
+func newMFAStorage(
+	issuer string, secureCookies secureCookies,
+	client *elasticsearch.Client, logger *zap.Logger,
+) (*mfaStorage, error) {
+	s := &mfaStorage{
+		issuer:        issuer,
+		secureCookies: secureCookies,
+		client:        client,
+		logger:        logger,
+		ids:           cryptoIDs{},
+		clock:         systemClock{},
+		docs:          make(map[string]*mfaDocument),
+		failures:      make(map[string]*mfaFailures),
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init MFA storage: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing enrollments from Elasticsearch.
+func (s *mfaStorage) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initMFAStorage")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	err := loadAll(ctx, s.client, mfaIndex, func(hit loadedHit) error {
+		var doc mfaDocument
+		if err := json.Unmarshal(hit.Source, &doc); err != nil {
+			return err
+		}
+		s.docs[hit.ID] = &doc
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	logger.Info("loaded MFA enrollments", zap.Int("enrollments", len(s.docs)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+func (s *mfaStorage) put(ctx context.Context, userID string, doc *mfaDocument) error {
+	if err := s.store(ctx, userID, doc); err != nil {
+		return err
+	}
+	s.invalidations.notify(ctx, invalidateMFA, userID, s.clock.Now())
+	return nil
+}
+
+func (s *mfaStorage) store(ctx context.Context, userID string, doc *mfaDocument) error {
+	s.mu.Lock()
+	if doc == nil {
+		delete(s.docs, userID)
+	} else {
+		s.docs[userID] = doc
+	}
+	s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+
+	if doc == nil {
+		res, err := s.client.Delete(mfaIndex, userID, s.client.Delete.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("while deleting MFA enrollment for user ID %q: %w", userID, err)
+		}
+		defer res.Body.Close()
+		if res.IsError() && res.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("deleting MFA enrollment failed: %s", res.Status())
+		}
+		return nil
+	}
+	res, err := s.client.Index(
+		mfaIndex, esutil.NewJSONReader(doc),
+		s.client.Index.WithDocumentID(userID),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving MFA enrollment for user ID %q: %w", userID, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving MFA enrollment failed: %s", res.Status())
+	}
+	return nil
+}
+
+// watch propagates enrollments changed by other replicas, reloading them
+// from Elasticsearch.
+func (s *mfaStorage) watch(invalidations *invalidator) {
+	s.invalidations = invalidations
+	invalidations.subscribe(invalidateMFA, func(ctx context.Context, inv invalidation) {
+		if err := s.reload(ctx, inv.Key); err != nil {
+			s.logger.Warn("failed to reload MFA enrollment", zap.String("user.id", inv.Key), zap.Error(err))
+		}
+	})
+}
+
+// reload loads a user's enrollment from Elasticsearch, replacing the one
+// in memory.
+func (s *mfaStorage) reload(ctx context.Context, userID string) error {
+	res, err := s.client.Get(mfaIndex, userID, s.client.Get.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("while loading MFA enrollment for user ID %q: %w", userID, err)
+	}
+	defer res.Body.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if res.StatusCode == http.StatusNotFound {
+		delete(s.docs, userID)
+		return nil
+	}
+	if res.IsError() {
+		return fmt.Errorf("loading MFA enrollment failed: %s", res.Status())
+	}
+	var doc struct {
+		Source mfaDocument `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return err
+	}
+	s.docs[userID] = &doc.Source
+	return nil
+}
+
+func (s *mfaStorage) get(userID string) *mfaDocument {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.docs[userID]
+}
+
+// enrolled reports whether the user has an active TOTP enrollment or
+// a registered passkey.
+func (s *mfaStorage) enrolled(userID string) bool {
+	doc := s.get(userID)
+	return doc != nil && (doc.TOTP.Enabled || len(doc.WebAuthn.Credentials) > 0)
+}
+
+// totpEnabled reports whether the user has an active TOTP enrollment.
+func (s *mfaStorage) totpEnabled(userID string) bool {
+	doc := s.get(userID)
+	return doc != nil && doc.TOTP.Enabled
+}
+
+// totpEnrollment is returned when a user begins TOTP enrollment.
+type totpEnrollment struct {
+	Secret          string   `json:"secret"`
+	ProvisioningURI string   `json:"provisioning_uri"`
+	QRCode          string   `json:"qr_code"`
+	RecoveryCodes   []string `json:"recovery_codes"`
+}
+
+// enroll generates a new, not yet enabled, TOTP secret and recovery codes
+// for the user. Enrollment takes effect once activate is called with a
+// valid code, proving the authenticator app was set up correctly.
+func (s *mfaStorage) enroll(ctx context.Context, userID, accountName string) (*totpEnrollment, error) {
+	if s.totpEnabled(userID) {
+		return nil, errors.New("second factor already enrolled")
+	}
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      s.issuer,
+		AccountName: accountName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render QR code: %w", err)
+	}
+	var qr bytes.Buffer
+	if err := png.Encode(&qr, img); err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %w", err)
+	}
+
+	encryptedSecret, err := s.secureCookies.Encode(key.Secret())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt TOTP secret: %w", err)
+	}
+	recoveryCodes := make([]string, numRecoveryCodes)
+	doc := &mfaDocument{}
+	if existing := s.get(userID); existing != nil {
+		doc.WebAuthn = existing.WebAuthn
+	}
+	doc.TOTP.Secret = encryptedSecret
+	for i := range recoveryCodes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		recoveryCodes[i] = code
+		doc.TOTP.Recovery = append(doc.TOTP.Recovery, hashRecoveryCode(code))
+	}
+	if err := s.put(ctx, userID, doc); err != nil {
+		return nil, err
+	}
+	return &totpEnrollment{
+		Secret:          key.Secret(),
+		ProvisioningURI: key.URL(),
+		QRCode:          "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr.Bytes()),
+		RecoveryCodes:   recoveryCodes,
+	}, nil
+}
+
+// activate enables a pending TOTP enrollment, given a valid code.
+func (s *mfaStorage) activate(ctx context.Context, userID, code string) error {
+	existing := s.get(userID)
+	if existing == nil {
+		return errMFANotEnrolled
+	}
+	now := s.clock.Now()
+	step, err := s.validateTOTP(existing, code, now)
+	if err != nil {
+		return err
+	}
+	doc := *existing
+	doc.TOTP.Enabled = true
+	doc.TOTP.EnrolledAt = now.UTC().Format(time.RFC3339)
+	doc.TOTP.LastStep = step
+	return s.put(ctx, userID, &doc)
+}
+
+// verify checks a TOTP code or, failing that, a single-use recovery code.
+// After maxMFAFailures consecutive invalid codes, the user's codes are
+// refused until mfaLockout has passed.
+func (s *mfaStorage) verify(ctx context.Context, userID, code string) error {
+	existing := s.get(userID)
+	if existing == nil || !existing.TOTP.Enabled {
+		return errMFANotEnrolled
+	}
+	now := s.clock.Now()
+	if s.lockedOut(userID, now) {
+		return errMFALockedOut
+	}
+	err := s.verifyCode(ctx, userID, existing, code, now)
+	s.countVerification(userID, now, err)
+	return err
+}
+
+// lockedOut reports whether the user's verifications are refused at now.
+func (s *mfaStorage) lockedOut(userID string, now time.Time) bool {
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+	f := s.failures[userID]
+	return f != nil && now.Before(f.lockedUntil)
+}
+
+// countVerification counts a verification which returned err, locking the
+// user out once too many have failed in a row.
+func (s *mfaStorage) countVerification(userID string, now time.Time, err error) {
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+	if !errors.Is(err, errInvalidMFACode) {
+		if err == nil {
+			delete(s.failures, userID)
+		}
+		return
+	}
+	f := s.failures[userID]
+	if f == nil {
+		f = &mfaFailures{}
+		s.failures[userID] = f
+	}
+	f.count++
+	if f.count >= maxMFAFailures {
+		s.logger.Warn("MFA verification locked out", zap.String("user.id", userID), zap.Int("failures", f.count))
+		f.count = 0
+		f.lockedUntil = now.Add(mfaLockout)
+	}
+}
+
+// verifyCode checks a TOTP code, not older than the last one accepted, or
+// a recovery code, and records that it was used.
+func (s *mfaStorage) verifyCode(ctx context.Context, userID string, existing *mfaDocument, code string, now time.Time) error {
+	if step, err := s.validateTOTP(existing, code, now); err == nil {
+		doc := *existing
+		doc.TOTP.LastStep = step
+		return s.put(ctx, userID, &doc)
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, h := range existing.TOTP.Recovery {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			doc := *existing
+			doc.TOTP.Recovery = append(
+				append([]string(nil), existing.TOTP.Recovery[:i]...),
+				existing.TOTP.Recovery[i+1:]...,
+			)
+			s.logger.Info(
+				"recovery code used", zap.String("user.id", userID),
+				zap.Int("remaining", len(doc.TOTP.Recovery)),
+			)
+			return s.put(ctx, userID, &doc)
+		}
+	}
+	return errInvalidMFACode
+}
+
+// removeTOTP removes the user's TOTP enrollment and recovery codes.
+func (s *mfaStorage) removeTOTP(ctx context.Context, userID string) error {
+	existing := s.get(userID)
+	if existing == nil {
+		return nil
+	}
+	if len(existing.WebAuthn.Credentials) == 0 {
+		return s.put(ctx, userID, nil)
+	}
+	doc := mfaDocument{WebAuthn: existing.WebAuthn}
+	return s.put(ctx, userID, &doc)
+}
+
+// validateTOTP returns the time step of a TOTP code valid at now, allowing
+// for a step of clock skew either way, as totp.Validate does. Codes of
+// steps up to the last one accepted are invalid, so that each is accepted
+// once.
+func (s *mfaStorage) validateTOTP(doc *mfaDocument, code string, now time.Time) (int64, error) {
+	secret, err := s.secureCookies.Decode(doc.TOTP.Secret)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrypt TOTP secret: %w", err)
+	}
+	code = strings.TrimSpace(code)
+	current := now.Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0, errInvalidMFACode
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+			if step <= doc.TOTP.LastStep {
+				return 0, errInvalidMFACode
+			}
+			return step, nil
+		}
+	}
+	return 0, errInvalidMFACode
+}
+
+// generateRecoveryCode returns a random code of the form xxxxx-xxxxx.
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate recovery code: %w", err)
+	}
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// mfaCookieValue binds the "mfa_passed" session flag to a specific
+// session, identified by the user ID and the ID token's issue time.
+func mfaCookieValue(auth *authDetails) string {
+	return auth.userID + ":" + strconv.FormatInt(auth.issuedAt.Unix(), 10)
+}
+
+// setMFAPassed records that the current session has passed MFA.
+func setMFAPassed(w http.ResponseWriter, secureCookies secureCookies, auth *authDetails) error {
+	value, err := secureCookies.Encode(mfaCookieValue(auth))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     mfaCookieName,
+		Path:     credentialsCookiePath,
+		Value:    value,
+		Secure:   true,
+		HttpOnly: true,
+	})
+	return nil
+}
+
+// mfaPassed reports whether the current session has passed MFA.
+func mfaPassed(r *http.Request, secureCookies secureCookies, auth *authDetails) bool {
+	cookie, err := r.Cookie(mfaCookieName)
+	if err != nil {
+		return false
+	}
+	value, err := secureCookies.Decode(cookie.Value)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(value), []byte(mfaCookieValue(auth))) == 1
+}
+
+// requireMFA creates middleware that requires users enrolled in a second
+// factor to have passed verification in the current session. If required
+// is true, users without an enrollment are rejected too. Guests, who
+// cannot enroll, are exempt. It must be applied inside the auth middleware.
+func requireMFA(
+	mfa *mfaStorage, secureCookies secureCookies, required bool,
+) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := authFromContext(r.Context())
+			if auth.isGuest() || (!required && !mfa.enrolled(auth.userID)) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if !mfaPassed(r, secureCookies, auth) {
+				writeErrorBody(w, http.StatusUnauthorized, struct {
+					errorResponse
+					Enrolled bool `json:"enrolled"`
+				}{
+					errorResponse{newAPIError(r, mfaRequired, "Second-factor verification is required")},
+					mfa.enrolled(auth.userID),
+				})
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// registerMFARoutes registers the TOTP enrollment and verification endpoints.
+func registerMFARoutes(
+	routes *routeRegistry,
+	mfa *mfaStorage,
+	secureCookies secureCookies,
+	security *securityEvents,
+	stepUpMaxAge time.Duration,
+) {
+	signedIn := routes.group(groupSignedIn)
+
+	// Users who already have a second factor must have passed it in this
+	// session to enroll another, so that a first factor alone cannot.
+	requirePassedMFA := requireMFA(mfa, secureCookies, false)
+
+	decodeCode := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		var body struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&body); err != nil || body.Code == "" {
+			writeError(w, r, http.StatusBadRequest, "missing code")
+			return "", false
+		}
+		return body.Code, true
+	}
+
+	// Begin enrollment: requires a recent sign-in, since it changes
+	// how the account is protected.
+	signedIn.POST("/api/mfa/totp/enroll", requireRecentAuth(mfa.clock, stepUpMaxAge,
+		requirePassedMFA(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := authFromContext(r.Context())
+			enrollment, err := mfa.enroll(r.Context(), auth.userID, auth.email)
+			if err != nil {
+				writeError(w, r, http.StatusConflict, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			json.NewEncoder(w).Encode(enrollment)
+		})).ServeHTTP,
+	))
+
+	// Confirm enrollment with a code from the authenticator app. This does
+	// not pass MFA for the session, which verifies the code it needs to.
+	signedIn.POST("/api/mfa/totp/activate",
+		requirePassedMFA(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := authFromContext(r.Context())
+			code, ok := decodeCode(w, r)
+			if !ok {
+				return
+			}
+			if err := mfa.activate(r.Context(), auth.userID, code); err != nil {
+				writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})).ServeHTTP,
+	)
+
+	// Verify a TOTP or recovery code for the current session.
+	signedIn.POST("/api/mfa/totp/verify",
+		func(w http.ResponseWriter, r *http.Request) {
+			auth := authFromContext(r.Context())
+			code, ok := decodeCode(w, r)
+			if !ok {
+				return
+			}
+			if err := mfa.verify(r.Context(), auth.userID, code); errors.Is(err, errMFALockedOut) {
+				security.record(r, securityEventMFA, reasonLockedOut, auth.userID)
+				w.Header().Set("Retry-After", strconv.Itoa(int(mfaLockout.Seconds())))
+				writeError(w, r, http.StatusTooManyRequests, err.Error())
+				return
+			} else if err != nil {
+				security.record(r, securityEventMFA, reasonInvalidCode, auth.userID)
+				writeError(w, r, http.StatusUnauthorized, err.Error())
+				return
+			}
+			security.record(r, securityEventMFA, reasonSuccess, auth.userID)
+			if err := setMFAPassed(w, secureCookies, auth); err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		},
+	)
+
+	// Remove the enrollment: requires both a recent sign-in and MFA.
+	signedIn.DELETE("/api/mfa/totp", requireRecentAuth(mfa.clock, stepUpMaxAge,
+		requireMFA(mfa, secureCookies, false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := authFromContext(r.Context())
+			if err := mfa.removeTOTP(r.Context(), auth.userID); err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})).ServeHTTP,
+	))
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+const (
+	providerMicrosoft = "microsoft"
+
+	microsoftStateCookieKey = "microsoft_state"
+	microsoftCallbackPath   = "/api/oauth/microsoft"
+
+	// microsoftJWKSURL serves the signing keys of all tenants.
+	microsoftJWKSURL = "https://login.microsoftonline.com/common/discovery/v2.0/keys"
+
+	microsoftGraphProfileURL = "https://graph.microsoft.com/v1.0/me?$select=id,displayName,mail,userPrincipalName"
+
+	// microsoftConsumerTenant is the tenant ID of personal Microsoft
+	// accounts.
+	microsoftConsumerTenant = "9188040d-6c67-4c5b-b112-36a304b66dad"
+)
+
+var (
+	// errIssuerInvalid is returned when an ID token was not issued by
+	// the expected identity provider.
+	errIssuerInvalid = errors.New("issuer invalid or missing")
+
+	// errTenantNotAllowed is returned when an ID token was issued for a
+	// Microsoft tenant users may not sign in from.
+	errTenantNotAllowed = errors.New("tenant not allowed")
+)
+
+// newMicrosoftOAuthConfig creates a Microsoft Entra ID OAuth2 configuration,
+// using the v2.0 endpoints of tenant.
+func newMicrosoftOAuthConfig(clientID, clientSecret, tenant string) oauth2.Config {
+	return oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint:     endpoints.AzureAD(tenant),
+		RedirectURL:  microsoftCallbackPath,
+		Scopes:       []string{"openid", "email", "profile", "offline_access", "User.Read"},
+	}
+}
+
+// microsoftTenantAllowed reports whether users of the tenant with ID tid
+// may sign in, given the configured tenant: a tenant ID, or
+// "organizations", "consumers" or "common" for multi-tenant apps.
+func microsoftTenantAllowed(tenant string, allowedTenants []string, tid string) bool {
+	switch strings.ToLower(tenant) {
+	case "common":
+	case "organizations":
+		if strings.EqualFold(tid, microsoftConsumerTenant) {
+			return false
+		}
+	case "consumers":
+		if !strings.EqualFold(tid, microsoftConsumerTenant) {
+			return false
+		}
+	default:
+		if !strings.EqualFold(tid, tenant) {
+			return false
+		}
+	}
+	return len(allowedTenants) == 0 || slices.ContainsFunc(allowedTenants, func(allowed string) bool {
+		return strings.EqualFold(allowed, tid)
+	})
+}
+
+// microsoftEmailTrusted reports whether the email addresses of users
+// signing in from the configured tenants may be trusted, to grant roles,
+// accept invitations and link accounts. Users' addresses are set by their
+// tenant's admins, unverified, so any tenant could claim any address:
+// only a single tenant, or an allowed_tenants list, is trusted.
+func microsoftEmailTrusted(tenant string, allowedTenants []string) bool {
+	switch strings.ToLower(tenant) {
+	case "common", "organizations", "consumers":
+		return len(allowedTenants) > 0
+	}
+	return true
+}
+
+// microsoftIDTokenParser creates a function that parses and validates
+// Microsoft Entra ID v2.0 ID tokens. Tokens of multi-tenant apps are issued
+// by the user's tenant, so the issuer is checked against the token's "tid"
+// claim, which is in turn checked against the configured tenants. Email
+// addresses are left out unless microsoftEmailTrusted.
+func microsoftIDTokenParser(
+	jwks *keyfunc.JWKS, clientID, tenant string, allowedTenants []string,
+) func(string) (*authDetails, error) {
+	emailTrusted := microsoftEmailTrusted(tenant, allowedTenants)
+	return func(idToken string) (*authDetails, error) {
+		token, err := jwt.Parse(idToken, jwks.Keyfunc, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Name}))
+		if err != nil {
+			return nil, err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		if !claims.VerifyAudience(clientID, true) {
+			return nil, errAudienceInvalid
+		}
+		tid, _ := claims["tid"].(string)
+		if tid == "" || !claims.VerifyIssuer("https://login.microsoftonline.com/"+tid+"/v2.0", true) {
+			return nil, errIssuerInvalid
+		}
+		if !microsoftTenantAllowed(tenant, allowedTenants, tid) {
+			return nil, errTenantNotAllowed
+		}
+
+		// "oid" identifies the user across apps of the tenant, while
+		// "sub" is specific to this app.
+		userID, _ := claims["oid"].(string)
+		if userID == "" {
+			userID, _ = claims["sub"].(string)
+		}
+		var email string
+		if emailTrusted {
+			email, _ = claims["email"].(string)
+			if email == "" {
+				email, _ = claims["preferred_username"].(string)
+			}
+		}
+		name, _ := claims["name"].(string)
+		sid, _ := claims["sid"].(string)
+		var issuedAt time.Time
+		if iat, ok := claims["iat"].(float64); ok {
+			issuedAt = time.Unix(int64(iat), 0)
+		}
+		return &authDetails{
+			idToken:   token,
+			claims:    claims,
+			userID:    userID,
+			email:     email,
+			name:      name,
+			issuedAt:  issuedAt,
+			sessionID: sid,
+			authTime:  issuedAt,
+		}, nil
+	}
+}
+
+// microsoftProfile holds the fields of a Microsoft Graph user used for the
+// user's profile.
+type microsoftProfile struct {
+	ID                string `json:"id"`
+	DisplayName       string `json:"displayName"`
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+}
+
+// fetchMicrosoftProfile fetches the signed-in user's profile from
+// Microsoft Graph.
+func fetchMicrosoftProfile(ctx context.Context, client *http.Client) (*microsoftProfile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, microsoftGraphProfileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("while fetching Microsoft Graph profile: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching Microsoft Graph profile failed: %s", res.Status)
+	}
+	var profile microsoftProfile
+	if err := json.NewDecoder(res.Body).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("failed to decode Microsoft Graph profile: %w", err)
+	}
+	return &profile, nil
+}
+
+// microsoftProfileFetcher fetches the profiles of users signed in with
+// Microsoft from Graph, with their stored tokens. Their email addresses
+// are left out unless emailTrusted, as by microsoftEmailTrusted.
+func microsoftProfileFetcher(tokens *tokenStorage, emailTrusted bool) profileFetcher {
+	return func(ctx context.Context, userID string) (*userProfile, error) {
+		client, err := tokens.httpClient(ctx, providerMicrosoft, userID)
+		if err != nil {
+			return nil, err
+		}
+		profile, err := fetchMicrosoftProfile(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		return profile.userProfile(emailTrusted), nil
+	}
+}
+
+// userProfile returns the profile of the user, preferring their mailbox
+// address, which may be empty, to their user principal name. The address
+// is left out unless emailTrusted.
+func (p *microsoftProfile) userProfile(emailTrusted bool) *userProfile {
+	if !emailTrusted {
+		return &userProfile{Name: p.DisplayName}
+	}
+	email := p.Mail
+	if email == "" {
+		email = p.UserPrincipalName
+	}
+	return &userProfile{Name: p.DisplayName, Email: email}
+}
+
+// registerMicrosoftRoutes registers the Microsoft sign-in flow: users are
+// redirected to Entra ID, and on their return signed in with a session
+// token minted by the backend, since Microsoft ID tokens cannot be renewed
+// by the frontend as Google's are. Users' email addresses from Graph are
+// only used if emailTrusted, as by microsoftEmailTrusted.
+func registerMicrosoftRoutes(
+	routes *routeRegistry,
+	oauthConfig oauth2.Config,
+	parseIDToken func(string) (*authDetails, error),
+	emailTrusted bool,
+	tokens *tokenStorage,
+	identities *identityStore,
+	profiles *profileResolver,
+	states *oauthStateStore,
+	ids idSource,
+	clk clock,
+	secureCookies secureCookies,
+	binding *sessionBinding,
+	security *securityEvents,
+	logger *zap.Logger,
+) {
+	public := routes.group(groupPublic)
+
+	public.GET("/api/login/microsoft", func(w http.ResponseWriter, r *http.Request) {
+		nonce := make([]byte, 16)
+		if _, err := ids.Read(nonce); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to generate nonce")
+			return
+		}
+		encodedNonce := base64.RawURLEncoding.EncodeToString(nonce)
+		state, cookie, err := generateOAuthState(
+			r.Context(), ids, secureCookies, states,
+			microsoftStateCookieKey, microsoftCallbackPath,
+			map[string]string{"nonce": encodedNonce},
+		)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		http.SetCookie(w, cookie)
+		url := oauth2ConfigForURL(oauthConfig, r).AuthCodeURL(
+			state,
+			oauth2.SetAuthURLParam("nonce", encodedNonce),
+			oauth2.SetAuthURLParam("response_mode", "query"),
+			oauth2.SetAuthURLParam("prompt", "select_account"),
+		)
+		http.Redirect(w, r, url, http.StatusFound)
+	})
+
+	public.GET(microsoftCallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.With(traceLogFields(r.Context())...)
+		// The state cookie is single use.
+		http.SetCookie(w, &http.Cookie{
+			Name:     microsoftStateCookieKey,
+			Path:     microsoftCallbackPath,
+			Secure:   true,
+			HttpOnly: true,
+			MaxAge:   -1,
+		})
+		if errCode := r.URL.Query().Get("error"); errCode != "" {
+			logger.Info(
+				"Microsoft sign-in failed",
+				zap.String("error", errCode),
+				zap.String("error_description", r.URL.Query().Get("error_description")),
+			)
+			writeError(w, r, http.StatusUnauthorized, "Microsoft sign-in failed: "+errCode)
+			return
+		}
+		data, err := validateOAuthState(secureCookies, states, r, microsoftStateCookieKey)
+		if err != nil {
+			security.record(r, securityEventOAuthState, reasonStateInvalid, "")
+			writeError(w, r, http.StatusUnauthorized, "invalid authorization state")
+			return
+		}
+
+		config := oauth2ConfigForURL(oauthConfig, r)
+		ctx := tokens.oauthContext(r.Context())
+		token, err := config.Exchange(ctx, r.URL.Query().Get("code"))
+		if err != nil {
+			security.record(r, securityEventMicrosoftLogin, reasonInvalidCode, "")
+			writeError(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		idToken, _ := token.Extra("id_token").(string)
+		auth, err := parseIDToken(idToken)
+		if err != nil {
+			security.record(r, securityEventMicrosoftLogin, tokenFailureReason(err), "")
+			writeError(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if nonce, _ := auth.claims["nonce"].(string); nonce == "" || nonce != data["nonce"] {
+			security.record(r, securityEventMicrosoftLogin, reasonStateInvalid, auth.userID)
+			writeError(w, r, http.StatusUnauthorized, "invalid nonce")
+			return
+		}
+
+		// Graph holds the user's mailbox address, which the ID token
+		// lacks unless the "email" optional claim is configured.
+		profile, err := fetchMicrosoftProfile(r.Context(), config.Client(ctx, token))
+		if err != nil {
+			logger.Warn("failed to fetch Microsoft profile", zap.Error(err))
+		} else {
+			if emailTrusted && profile.Mail != "" {
+				auth.email = profile.Mail
+			} else if emailTrusted && auth.email == "" {
+				auth.email = profile.UserPrincipalName
+			}
+			if profile.DisplayName != "" {
+				auth.name = profile.DisplayName
+			}
+		}
+
+		if !resolveSignIn(w, r, identities, secureCookies, security, logger, securityEventMicrosoftLogin, providerMicrosoft, auth) {
+			return
+		}
+		if token.RefreshToken != "" {
+			if err := tokens.set(r.Context(), providerMicrosoft, auth.userID, token); err != nil {
+				logger.Warn("failed to store Microsoft token", zap.Error(err))
+			}
+		}
+		if profile != nil {
+			profiles.set(providerMicrosoft, auth.userID, profile.userProfile(emailTrusted))
+		}
+
+		now := clk.Now()
+		claims := providerSessionClaims(providerMicrosoft, auth)
+		claims["tid"] = auth.claims["tid"]
+		session, err := signLocalSession(localSessionKey(secureCookies.keys()), claims, now)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		cookieValue, err := secureCookies.Encode(session)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+			return
+		}
+		if err := binding.set(w, r, session, now.Add(localSessionTTL)); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     "credentials",
+			Path:     credentialsCookiePath,
+			Value:    cookieValue,
+			Secure:   true,
+			HttpOnly: true,
+			Expires:  now.Add(localSessionTTL),
+		})
+		security.record(r, securityEventMicrosoftLogin, reasonSuccess, auth.userID)
+		logger.Info("user signed in with Microsoft", zap.String("user.id", auth.userID))
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
@@ -0,0 +1,44 @@
+//go:build module_example
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// The example module demonstrates how to add an API module without
+// editing main.go. Build with -tags module_example to include it.
+func init() {
+	registerModule(apiModule{
+		Name: "example",
+		Migrations: []migration{
+			createIndexMigration("001-create-index", "app-example", map[string]interface{}{
+				"properties": map[string]interface{}{
+					"message":    map[string]string{"type": "text"},
+					"created_at": map[string]string{"type": "date"},
+				},
+			}),
+		},
+		Register: func(env *moduleEnv) error {
+			settings := struct {
+				Greeting string `yaml:"greeting"`
+			}{Greeting: "Hello from the example module"}
+			if err := env.DecodeSettings(&settings); err != nil {
+				return err
+			}
+
+			env.Routes.group(groupUser).GET("/api/example",
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "application/json")
+					json.NewEncoder(w).Encode(struct {
+						Message   string `json:"message"`
+						Timestamp string `json:"timestamp"`
+					}{settings.Greeting, time.Now().UTC().Format(time.RFC3339)})
+				},
+			)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"app-backend/blobstore"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const migrationsIndex = "app-migrations"
+
+// apiModule is a self-contained API module, with its own routes, storage,
+// and Elasticsearch migrations. Modules register themselves from an init
+// function in their own file, by calling registerModule, so they can be
+// added without editing main.go. A build constraint on the file (e.g.
+// //go:build module_reports) makes a module opt-in at build time.
+type apiModule struct {
+	// Name identifies the module, in configuration and logs.
+	Name string
+
+	// Migrations are applied in order, once each, before Register is
+	// called. They are skipped when Elasticsearch is not configured.
+	Migrations []migration
+
+	// Register creates the module's storage and registers its routes.
+	Register func(env *moduleEnv) error
+}
+
+// migration is a one-off change to Elasticsearch, such as creating an
+// index or updating a mapping. Applied migrations are recorded in the
+// migrationsIndex, keyed by module name and migration ID.
+type migration struct {
+	ID    string
+	Apply func(ctx context.Context, client *elasticsearch.Client) error
+}
+
+// moduleEnv gives modules access to shared services. Modules register
+// routes in route groups, e.g. Routes.group(groupUser), to apply the
+// groups' authentication middleware.
+type moduleEnv struct {
+	Config        *appConfig
+	Routes        *routeRegistry
+	Client        *elasticsearch.Client
+	Logger        *zap.Logger
+	SecureCookies secureCookies
+	Health        *healthMonitor
+
+	// Records searches the application's records.
+	Records recordSource
+
+	// Blobs stores files, such as exports.
+	Blobs blobstore.Store
+
+	// IDs generates the IDs of new documents.
+	IDs idSource
+
+	// Clock tells the time, e.g. when links expire.
+	Clock clock
+
+	settings yaml.Node
+}
+
+// DecodeSettings decodes the module's settings from modules.settings in
+// the config file into v. It leaves v unchanged if there are none.
+func (env *moduleEnv) DecodeSettings(v interface{}) error {
+	if env.settings.IsZero() {
+		return nil
+	}
+	return env.settings.Decode(v)
+}
+
+var apiModules = map[string]apiModule{}
+
+// registerModule adds a module to those loaded at startup. It must be
+// called from an init function.
+func registerModule(m apiModule) {
+	if _, ok := apiModules[m.Name]; ok {
+		panic(fmt.Sprintf("module %q registered twice", m.Name))
+	}
+	apiModules[m.Name] = m
+}
+
+// loadModules applies pending migrations of, and registers, all modules
+// which are not disabled by configuration, in name order.
+func loadModules(ctx context.Context, env moduleEnv) error {
+	names := make([]string, 0, len(apiModules))
+	for name := range apiModules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		logger := env.Logger.With(zap.String("module", name))
+		if slices.Contains(env.Config.Modules.Disabled, name) {
+			logger.Info("module disabled by configuration")
+			continue
+		}
+		m := apiModules[name]
+		if err := applyMigrations(ctx, env.Client, m, logger); err != nil {
+			return fmt.Errorf("module %q: %w", name, err)
+		}
+		moduleEnv := env
+		moduleEnv.Logger = logger
+		moduleEnv.settings = env.Config.Modules.Settings[name]
+		if err := m.Register(&moduleEnv); err != nil {
+			return fmt.Errorf("module %q: %w", name, err)
+		}
+		logger.Info("loaded module")
+	}
+	return nil
+}
+
+func applyMigrations(ctx context.Context, client *elasticsearch.Client, m apiModule, logger *zap.Logger) error {
+	if len(m.Migrations) == 0 {
+		return nil
+	}
+	if client == nil {
+		logger.Info("Elasticsearch not configured, skipping migrations")
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(ctx, "applyMigrations")
+	defer span.End()
+
+	for _, mig := range m.Migrations {
+		docID := m.Name + "/" + mig.ID
+		res, err := client.Get(migrationsIndex, docID, client.Get.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("while checking migration %q: %w", mig.ID, err)
+		}
+		res.Body.Close()
+		switch {
+		case res.StatusCode == http.StatusOK:
+			continue
+		case res.StatusCode != http.StatusNotFound:
+			return fmt.Errorf("checking migration %q failed: %s", mig.ID, res.Status())
+		}
+
+		logger.Info("applying migration", zap.String("migration", mig.ID))
+		if err := mig.Apply(ctx, client); err != nil {
+			return fmt.Errorf("migration %q failed: %w", mig.ID, err)
+		}
+		res, err = client.Index(
+			migrationsIndex,
+			esutil.NewJSONReader(map[string]string{
+				"module":     m.Name,
+				"migration":  mig.ID,
+				"applied_at": time.Now().UTC().Format(time.RFC3339),
+			}),
+			client.Index.WithDocumentID(docID),
+			client.Index.WithContext(ctx),
+		)
+		if err != nil {
+			return fmt.Errorf("while recording migration %q: %w", mig.ID, err)
+		}
+		res.Body.Close()
+		if res.IsError() {
+			return fmt.Errorf("recording migration %q failed: %s", mig.ID, res.Status())
+		}
+	}
+	return nil
+}
+
+// createIndexMigration returns a migration creating an index with the
+// given mappings, tolerating an existing index.
+func createIndexMigration(id, index string, mappings map[string]interface{}) migration {
+	return migration{
+		ID: id,
+		Apply: func(ctx context.Context, client *elasticsearch.Client) error {
+			res, err := client.Indices.Create(
+				index,
+				client.Indices.Create.WithBody(esutil.NewJSONReader(map[string]interface{}{"mappings": mappings})),
+				client.Indices.Create.WithContext(ctx),
+			)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			if res.IsError() && res.StatusCode != http.StatusBadRequest {
+				// 400 is returned if the index already exists.
+				return fmt.Errorf("creating index %s failed: %s", index, res.Status())
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.uber.org/zap"
+)
+
+const (
+	oauthStatesIndex = "app-oauth-states"
+
+	// oauthStateTTL bounds how long users may take to complete an OAuth
+	// authorization.
+	oauthStateTTL = 10 * time.Minute
+)
+
+// oauthStateStore keeps OAuth state data server-side, keyed by a hash of
+// the state nonce, so that state cookies hold only the nonce however
+// large the data, and each state expires after oauthStateTTL and may be
+// used only once, preventing replay.
+type oauthStateStore struct {
+	client *elasticsearch.Client
+	logger *zap.Logger
+	clock  clock
+
+	mu        sync.Mutex
+	states    map[string]oauthStateEntry
+	lastSweep time.Time
+}
+
+type oauthStateEntry struct {
+	Data      map[string]string `json:"data,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+func newOAuthStateStore(client *elasticsearch.Client, logger *zap.Logger) *oauthStateStore {
+	return &oauthStateStore{
+		client: client,
+		logger: logger,
+		clock:  systemClock{},
+		states: make(map[string]oauthStateEntry),
+	}
+}
+
+func oauthStateID(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+// put stores the data of a new state.
+func (s *oauthStateStore) put(ctx context.Context, state string, data map[string]string) error {
+	now := s.clock.Now()
+	entry := oauthStateEntry{Data: data, ExpiresAt: now.Add(oauthStateTTL).UTC()}
+	id := oauthStateID(state)
+
+	s.mu.Lock()
+	sweep := now.Sub(s.lastSweep) > oauthStateTTL
+	if sweep {
+		s.lastSweep = now
+	}
+	if s.client == nil {
+		if sweep {
+			for key, existing := range s.states {
+				if now.After(existing.ExpiresAt) {
+					delete(s.states, key)
+				}
+			}
+		}
+		s.states[id] = entry
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	if sweep {
+		go s.sweep()
+	}
+	res, err := s.client.Index(
+		oauthStatesIndex,
+		esutil.NewJSONReader(entry),
+		s.client.Index.WithDocumentID(id),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving OAuth state: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving OAuth state failed: %s", res.Status())
+	}
+	return nil
+}
+
+// consume removes and returns the data of a state. It fails with
+// errInvalidState if the state is unknown, expired, or already used.
+func (s *oauthStateStore) consume(ctx context.Context, state string) (map[string]string, error) {
+	id := oauthStateID(state)
+	if s.client == nil {
+		s.mu.Lock()
+		entry, ok := s.states[id]
+		delete(s.states, id)
+		s.mu.Unlock()
+		if !ok || s.clock.Now().After(entry.ExpiresAt) {
+			return nil, errInvalidState
+		}
+		return entry.Data, nil
+	}
+
+	ctx, span := otel.Tracer("main").Start(ctx, "consumeOAuthState")
+	defer span.End()
+
+	res, err := s.client.Get(oauthStatesIndex, id, s.client.Get.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("while loading OAuth state: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errInvalidState
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("loading OAuth state failed: %s", res.Status())
+	}
+	var doc struct {
+		SeqNo       int             `json:"_seq_no"`
+		PrimaryTerm int             `json:"_primary_term"`
+		Source      oauthStateEntry `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode OAuth state: %w", err)
+	}
+
+	// Only one of concurrent requests replaying the state can delete
+	// this version of the document.
+	res, err = s.client.Delete(
+		oauthStatesIndex, id,
+		s.client.Delete.WithIfSeqNo(doc.SeqNo),
+		s.client.Delete.WithIfPrimaryTerm(doc.PrimaryTerm),
+		s.client.Delete.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("while consuming OAuth state: %w", err)
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusConflict:
+		return nil, errInvalidState
+	case res.IsError():
+		return nil, fmt.Errorf("consuming OAuth state failed: %s", res.Status())
+	}
+	if s.clock.Now().After(doc.Source.ExpiresAt) {
+		return nil, errInvalidState
+	}
+	return doc.Source.Data, nil
+}
+
+// sweep deletes expired states from Elasticsearch.
+func (s *oauthStateStore) sweep() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	query := fmt.Sprintf(`{"query":{"range":{"expires_at":{"lt":%q}}}}`, s.clock.Now().UTC().Format(time.RFC3339))
+	res, err := s.client.DeleteByQuery(
+		[]string{oauthStatesIndex},
+		strings.NewReader(query),
+		s.client.DeleteByQuery.WithConflicts("proceed"),
+		s.client.DeleteByQuery.WithContext(ctx),
+	)
+	if err != nil {
+		s.logger.Warn("failed to delete expired OAuth states", zap.Error(err))
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		s.logger.Warn("deleting expired OAuth states failed", zap.String("status", res.Status()))
+	}
+}
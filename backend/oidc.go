@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+const (
+	providerOIDC = "oidc"
+
+	oidcStateCookieKey = "oidc_state"
+	oidcCallbackPath   = "/api/oauth/oidc"
+
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+)
+
+// oidcSigningMethods are the ID token signing algorithms accepted from
+// generic OpenID Connect providers, if they advertise them.
+var oidcSigningMethods = []string{
+	"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA",
+}
+
+// oidcDiscovery holds the fields of an OpenID Connect discovery document
+// used by the backend.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethods         []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// fetchOIDCDiscovery fetches the discovery document of the provider with
+// the given issuer URL, which must match the issuer it declares.
+func fetchOIDCDiscovery(ctx context.Context, client *http.Client, issuer string) (*oidcDiscovery, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuer, "/")+oidcDiscoveryPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("while fetching OIDC discovery document: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching OIDC discovery document failed: %s", res.Status)
+	}
+	var discovery oidcDiscovery
+	if err := json.NewDecoder(res.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("failed to decode OIDC discovery document: %w", err)
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("OIDC discovery document is for issuer %q, not %q", discovery.Issuer, issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document lacks authorization_endpoint, token_endpoint, or jwks_uri")
+	}
+	return &discovery, nil
+}
+
+// signingMethods returns the signing algorithms accepted for ID tokens:
+// those advertised by the provider, or RS256, which all providers support.
+func (d *oidcDiscovery) signingMethods() []string {
+	methods := slices.DeleteFunc(slices.Clone(d.IDTokenSigningAlgValuesSupported), func(alg string) bool {
+		return !slices.Contains(oidcSigningMethods, alg)
+	})
+	if len(methods) == 0 {
+		return []string{jwt.SigningMethodRS256.Name}
+	}
+	return methods
+}
+
+// newOIDCOAuthConfig creates the OAuth2 configuration of a generic OpenID
+// Connect provider, from its discovery document. Scopes default to
+// "openid email profile".
+func newOIDCOAuthConfig(clientID, clientSecret string, scopes []string, discovery *oidcDiscovery) oauth2.Config {
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	} else if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	endpoint := oauth2.Endpoint{AuthURL: discovery.AuthorizationEndpoint, TokenURL: discovery.TokenEndpoint}
+	// Providers which only accept credentials in the body, as some
+	// Keycloak and Auth0 clients do, advertise only client_secret_post.
+	if methods := discovery.TokenEndpointAuthMethods; len(methods) > 0 && !slices.Contains(methods, "client_secret_basic") {
+		endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
+	return oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint:     endpoint,
+		RedirectURL:  oidcCallbackPath,
+		Scopes:       scopes,
+	}
+}
+
+// oidcIDTokenParser creates a function that parses and validates ID tokens
+// of a generic OpenID Connect provider.
+func oidcIDTokenParser(jwks *keyfunc.JWKS, clientID string, discovery *oidcDiscovery) func(string) (*authDetails, error) {
+	methods := discovery.signingMethods()
+	return func(idToken string) (*authDetails, error) {
+		token, err := jwt.Parse(idToken, jwks.Keyfunc, jwt.WithValidMethods(methods))
+		if err != nil {
+			return nil, err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		if !claims.VerifyAudience(clientID, true) {
+			return nil, errAudienceInvalid
+		}
+		if !claims.VerifyIssuer(discovery.Issuer, true) {
+			return nil, errIssuerInvalid
+		}
+		userID, _ := claims["sub"].(string)
+		// The email address grants roles, accepts invitations and links
+		// accounts, so it is only used once the provider has verified
+		// it: with self-service profiles, users may set any address. The
+		// preferred_username is a user name, not an address.
+		var email string
+		if oidcEmailVerified(claims) {
+			email, _ = claims["email"].(string)
+		}
+		name, _ := claims["name"].(string)
+		sid, _ := claims["sid"].(string)
+		var issuedAt time.Time
+		if iat, ok := claims["iat"].(float64); ok {
+			issuedAt = time.Unix(int64(iat), 0)
+		}
+		authTime := issuedAt
+		if at, ok := claims["auth_time"].(float64); ok {
+			authTime = time.Unix(int64(at), 0)
+		}
+		return &authDetails{
+			idToken:   token,
+			claims:    claims,
+			userID:    userID,
+			email:     email,
+			name:      name,
+			issuedAt:  issuedAt,
+			sessionID: sid,
+			authTime:  authTime,
+		}, nil
+	}
+}
+
+// oidcEmailVerified reports whether the provider has verified the email
+// address of the ID token's claims. Some providers, such as Amazon
+// Cognito, send the "email_verified" claim as a string.
+func oidcEmailVerified(claims jwt.MapClaims) bool {
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		return verified
+	case string:
+		return verified == "true"
+	}
+	return false
+}
+
+// registerOIDCRoutes registers the sign-in flow of a generic OpenID
+// Connect provider, such as Okta, Auth0, Keycloak, or Azure AD. As with
+// Microsoft, users are signed in with a session token minted by the
+// backend, and their tokens are stored if the provider grants refresh
+// tokens, for calls to its APIs on their behalf.
+func registerOIDCRoutes(
+	routes *routeRegistry,
+	oauthConfig oauth2.Config,
+	parseIDToken func(string) (*authDetails, error),
+	tokens *tokenStorage,
+	identities *identityStore,
+	states *oauthStateStore,
+	ids idSource,
+	clk clock,
+	secureCookies secureCookies,
+	binding *sessionBinding,
+	security *securityEvents,
+	logger *zap.Logger,
+) {
+	public := routes.group(groupPublic)
+
+	public.GET("/api/login/oidc", func(w http.ResponseWriter, r *http.Request) {
+		nonce := make([]byte, 16)
+		if _, err := ids.Read(nonce); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to generate nonce")
+			return
+		}
+		encodedNonce := base64.RawURLEncoding.EncodeToString(nonce)
+		state, cookie, err := generateOAuthState(
+			r.Context(), ids, secureCookies, states,
+			oidcStateCookieKey, oidcCallbackPath,
+			map[string]string{"nonce": encodedNonce},
+		)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		http.SetCookie(w, cookie)
+		url := oauth2ConfigForURL(oauthConfig, r).AuthCodeURL(
+			state,
+			oauth2.SetAuthURLParam("nonce", encodedNonce),
+		)
+		http.Redirect(w, r, url, http.StatusFound)
+	})
+
+	public.GET(oidcCallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.With(traceLogFields(r.Context())...)
+		// The state cookie is single use.
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookieKey,
+			Path:     oidcCallbackPath,
+			Secure:   true,
+			HttpOnly: true,
+			MaxAge:   -1,
+		})
+		if errCode := r.URL.Query().Get("error"); errCode != "" {
+			logger.Info(
+				"OIDC sign-in failed",
+				zap.String("error", errCode),
+				zap.String("error_description", r.URL.Query().Get("error_description")),
+			)
+			writeError(w, r, http.StatusUnauthorized, "sign-in failed: "+errCode)
+			return
+		}
+		data, err := validateOAuthState(secureCookies, states, r, oidcStateCookieKey)
+		if err != nil {
+			security.record(r, securityEventOAuthState, reasonStateInvalid, "")
+			writeError(w, r, http.StatusUnauthorized, "invalid authorization state")
+			return
+		}
+
+		config := oauth2ConfigForURL(oauthConfig, r)
+		token, err := config.Exchange(tokens.oauthContext(r.Context()), r.URL.Query().Get("code"))
+		if err != nil {
+			security.record(r, securityEventOIDCLogin, reasonInvalidCode, "")
+			writeError(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		idToken, _ := token.Extra("id_token").(string)
+		auth, err := parseIDToken(idToken)
+		if err != nil {
+			security.record(r, securityEventOIDCLogin, tokenFailureReason(err), "")
+			writeError(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if nonce, _ := auth.claims["nonce"].(string); nonce == "" || nonce != data["nonce"] {
+			security.record(r, securityEventOIDCLogin, reasonStateInvalid, auth.userID)
+			writeError(w, r, http.StatusUnauthorized, "invalid nonce")
+			return
+		}
+
+		if !resolveSignIn(w, r, identities, secureCookies, security, logger, securityEventOIDCLogin, providerOIDC, auth) {
+			return
+		}
+		if token.RefreshToken != "" {
+			if err := tokens.set(r.Context(), providerOIDC, auth.userID, token); err != nil {
+				logger.Warn("failed to store OIDC token", zap.Error(err))
+			}
+		}
+
+		now := clk.Now()
+		session, err := signLocalSession(localSessionKey(secureCookies.keys()), providerSessionClaims(providerOIDC, auth), now)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		cookieValue, err := secureCookies.Encode(session)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+			return
+		}
+		if err := binding.set(w, r, session, now.Add(localSessionTTL)); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     "credentials",
+			Path:     credentialsCookiePath,
+			Value:    cookieValue,
+			Secure:   true,
+			HttpOnly: true,
+			Expires:  now.Add(localSessionTTL),
+		})
+		security.record(r, securityEventOIDCLogin, reasonSuccess, auth.userID)
+		logger.Info("user signed in with OIDC", zap.String("user.id", auth.userID))
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
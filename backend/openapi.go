@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"go.uber.org/zap"
+)
+
+// openAPISpec is the API contract, served at /api/openapi.yaml.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// openAPIMismatchHeader flags responses to requests, or responses, that
+// do not conform to the OpenAPI spec.
+const openAPIMismatchHeader = "X-OpenAPI-Mismatch"
+
+// loadOpenAPISpec parses and validates the embedded OpenAPI spec.
+func loadOpenAPISpec() (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI spec: %w", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI spec: %w", err)
+	}
+	return doc, nil
+}
+
+// openAPISpecHandler serves GET /api/openapi.yaml.
+func openAPISpecHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPISpec)
+}
+
+// openAPIValidator checks requests and responses against the OpenAPI spec,
+// logging mismatches and flagging them with openAPIMismatchHeader. It
+// buffers responses in full, so is meant for development only.
+type openAPIValidator struct {
+	router  routers.Router
+	options *openapi3filter.Options
+	logger  *zap.Logger
+}
+
+func newOpenAPIValidator(doc *openapi3.T, logger *zap.Logger) (*openAPIValidator, error) {
+	router, err := legacy.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &openAPIValidator{
+		router: router,
+		options: &openapi3filter.Options{
+			AuthenticationFunc:    openapi3filter.NoopAuthenticationFunc,
+			IncludeResponseStatus: true,
+			MultiError:            true,
+		},
+		logger: logger,
+	}, nil
+}
+
+// bufferedResponseWriter holds the response until it has been validated.
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header { return w.header }
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(b)
+}
+
+func (v *openAPIValidator) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		logger := v.logger.With(append(
+			traceLogFields(r.Context()),
+			zap.String("http.request.method", r.Method),
+			zap.String("url.path", r.URL.Path),
+		)...)
+
+		route, pathParams, err := v.router.FindRoute(r)
+		if err != nil {
+			var routeErr *routers.RouteError
+			if errors.As(err, &routeErr) {
+				logger.Warn("request to route missing from OpenAPI spec", zap.Error(err))
+				w.Header().Set(openAPIMismatchHeader, "undocumented-route")
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		requestInput := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    v.options,
+		}
+		var mismatches []string
+		if err := openapi3filter.ValidateRequest(r.Context(), requestInput); err != nil {
+			logger.Warn("request does not conform to OpenAPI spec", zap.Error(err))
+			mismatches = append(mismatches, "request")
+		}
+
+		buffered := &bufferedResponseWriter{header: w.Header()}
+		h.ServeHTTP(buffered, r)
+		if buffered.status == 0 {
+			buffered.status = http.StatusOK
+		}
+
+		responseInput := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: requestInput,
+			Status:                 buffered.status,
+			Header:                 buffered.header,
+			Options:                v.options,
+		}
+		responseInput.SetBodyBytes(buffered.body.Bytes())
+		if err := openapi3filter.ValidateResponse(r.Context(), responseInput); err != nil {
+			logger.Warn(
+				"response does not conform to OpenAPI spec",
+				zap.Int("http.response.status_code", buffered.status), zap.Error(err),
+			)
+			mismatches = append(mismatches, "response")
+		}
+		if len(mismatches) > 0 {
+			w.Header().Set(openAPIMismatchHeader, strings.Join(mismatches, ", "))
+		}
+		w.WriteHeader(buffered.status)
+		w.Write(buffered.body.Bytes())
+	})
+}
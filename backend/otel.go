@@ -2,40 +2,52 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/runtime"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func initOpenTelemetry(ctx context.Context, serviceName string) (shutdown func(context.Context) error, _ error) {
-	endpoint, insecure := otlpEndpointFromEnv()
-	headers := otlpHeadersFromEnv()
+// Trace exporters, selected by tracing.exporter.
+const (
+	tracingExporterOTLP   = "otlp"
+	tracingExporterStdout = "stdout"
+	tracingExporterFile   = "file"
 
-	opts := []otlptracehttp.Option{
-		otlptracehttp.WithEndpoint(endpoint),
-	}
-	if insecure {
-		opts = append(opts, otlptracehttp.WithInsecure())
-	}
-	if len(headers) > 0 {
-		opts = append(opts, otlptracehttp.WithHeaders(headers))
-	}
+	defaultTracingFile = "traces.json"
+)
 
-	exp, err := otlptracehttp.New(ctx, opts...)
+// initOpenTelemetry sets up the export of traces and metrics. It returns
+// the handler serving metrics to Prometheus, nil if metrics are disabled.
+func initOpenTelemetry(ctx context.Context, serviceName string, config *appConfig) (shutdown func(context.Context) error, exports *spanExports, metrics http.Handler, _ error) {
+	exporter, err := newSpanExporter(ctx, config)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
+	exp := &spanExports{SpanExporter: exporter, watched: make(map[trace.SpanID]chan error)}
 
 	res := resource.NewWithAttributes(
 		semconv.SchemaURL,
-		semconv.ServiceNameKey.String(serviceName),
+		append([]attribute.KeyValue{semconv.ServiceNameKey.String(serviceName)}, kubernetesResourceAttributes()...)...,
 	)
 
 	tp := sdktrace.NewTracerProvider(
@@ -43,13 +55,194 @@ func initOpenTelemetry(ctx context.Context, serviceName string) (shutdown func(c
 		sdktrace.WithResource(res),
 	)
 
+	exp.flush = tp.ForceFlush
 	otel.SetTracerProvider(tp)
-	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+	otel.SetTextMapPropagator(textMapPropagator())
+
+	mp, registry, err := newMeterProvider(ctx, config, res)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if mp == nil {
+		return tp.Shutdown, exp, nil, nil
+	}
+	otel.SetMeterProvider(mp)
+	// Export GC, heap, and goroutine metrics alongside those of the app.
+	if err := runtime.Start(runtime.WithMeterProvider(mp)); err != nil {
+		return nil, nil, nil, err
+	}
+	shutdown = func(ctx context.Context) error {
+		return errors.Join(tp.Shutdown(ctx), mp.Shutdown(ctx))
+	}
+	metrics = promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+	return shutdown, exp, metrics, nil
+}
+
+// newMeterProvider returns a meter provider collecting metrics for
+// Prometheus in the returned registry, and periodically exporting them over
+// OTLP unless traces are exported by a development exporter. It returns nil
+// if metrics are disabled.
+func newMeterProvider(ctx context.Context, config *appConfig, res *resource.Resource) (*sdkmetric.MeterProvider, *prometheus.Registry, error) {
+	if config.Metrics.Disabled {
+		return nil, nil, nil
+	}
+	registry := prometheus.NewRegistry()
+	collector, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := []sdkmetric.Option{
+		sdkmetric.WithReader(collector),
+		sdkmetric.WithResource(res),
+	}
+	if config.Tracing.Exporter != "" && config.Tracing.Exporter != tracingExporterOTLP {
+		return sdkmetric.NewMeterProvider(opts...), registry, nil
+	}
+	reader, err := newOTLPMetricReader(ctx, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sdkmetric.NewMeterProvider(append(opts, sdkmetric.WithReader(reader))...), registry, nil
+}
+
+// newOTLPMetricReader returns a reader periodically exporting metrics to
+// the same OTLP endpoint as traces.
+func newOTLPMetricReader(ctx context.Context, config *appConfig) (sdkmetric.Reader, error) {
+	endpoint, insecure := otlpEndpointFromEnv()
+	opts := []otlpmetrichttp.Option{
+		otlpmetrichttp.WithEndpoint(endpoint),
+	}
+	if insecure {
+		opts = append(opts, otlpmetrichttp.WithInsecure())
+	}
+	if headers := otlpHeadersFromEnv(); len(headers) > 0 {
+		opts = append(opts, otlpmetrichttp.WithHeaders(headers))
+	}
+	exporter, err := otlpmetrichttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var readerOpts []sdkmetric.PeriodicReaderOption
+	if config.Metrics.Interval > 0 {
+		readerOpts = append(readerOpts, sdkmetric.WithInterval(config.Metrics.Interval))
+	}
+	return sdkmetric.NewPeriodicReader(exporter, readerOpts...), nil
+}
+
+// newSpanExporter returns the exporter selected by tracing.exporter.
+func newSpanExporter(ctx context.Context, config *appConfig) (sdktrace.SpanExporter, error) {
+	switch config.Tracing.Exporter {
+	case "", tracingExporterOTLP:
+		endpoint, insecure := otlpEndpointFromEnv()
+		headers := otlpHeadersFromEnv()
+
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(endpoint),
+		}
+		if insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(headers))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case tracingExporterStdout:
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case tracingExporterFile:
+		path := config.Tracing.File
+		if path == "" {
+			path = defaultTracingFile
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f), stdouttrace.WithPrettyPrint())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &fileSpanExporter{SpanExporter: exporter, file: f}, nil
+	}
+	return nil, fmt.Errorf("tracing.exporter: unknown exporter %q, expected otlp, stdout, or file", config.Tracing.Exporter)
+}
+
+// fileSpanExporter closes the file spans are written to on shutdown.
+type fileSpanExporter struct {
+	sdktrace.SpanExporter
+	file *os.File
+}
+
+func (e *fileSpanExporter) Shutdown(ctx context.Context) error {
+	err := e.SpanExporter.Shutdown(ctx)
+	if closeErr := e.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// traceIDHeader echoes the trace ID of API requests in responses, so that
+// support tickets can be correlated with traces.
+const traceIDHeader = "X-Trace-Id"
+
+// textMapPropagator propagates W3C trace context and baggage. Requests of
+// the frontend carry the traceparent and tracestate headers of the Elastic
+// APM RUM agent, so that backend spans continue its traces.
+func textMapPropagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(
 		propagation.TraceContext{},
 		propagation.Baggage{},
-	))
+	)
+}
+
+// spanExports wraps a span exporter, allowing callers to wait for
+// confirmation that specific spans were exported.
+type spanExports struct {
+	sdktrace.SpanExporter
+	flush func(ctx context.Context) error
+
+	mu      sync.Mutex
+	watched map[trace.SpanID]chan error
+}
 
-	return tp.Shutdown, nil
+func (e *spanExports) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, span := range spans {
+		id := span.SpanContext().SpanID()
+		if ch, ok := e.watched[id]; ok {
+			ch <- err
+			delete(e.watched, id)
+		}
+	}
+	return err
+}
+
+// watch returns a function which waits for the span with the given ID to
+// be exported, returning the export error. It must be called before the
+// span ends.
+func (e *spanExports) watch(id trace.SpanID) (wait func(ctx context.Context) error) {
+	ch := make(chan error, 1)
+	e.mu.Lock()
+	e.watched[id] = ch
+	e.mu.Unlock()
+	return func(ctx context.Context) error {
+		defer func() {
+			e.mu.Lock()
+			delete(e.watched, id)
+			e.mu.Unlock()
+		}()
+		if err := e.flush(ctx); err != nil {
+			return err
+		}
+		select {
+		case err := <-ch:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 func otlpEndpointFromEnv() (endpoint string, insecure bool) {
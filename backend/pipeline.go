@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Route groups, each with its own middleware pipeline.
+const (
+	// groupPublic routes require no authentication.
+	groupPublic = "public"
+
+	// groupSignedIn routes require a signed-in user, but not
+	// second-factor verification, e.g. to enroll a second factor.
+	groupSignedIn = "signed_in"
+
+	// groupUser routes require a signed-in user, and second-factor
+	// verification when applicable.
+	groupUser = "user"
+
+	// groupAdmin routes require the admin secret.
+	groupAdmin = "admin"
+
+	// groupSCIM routes require the SCIM bearer token.
+	groupSCIM = "scim"
+)
+
+// middlewarePipeline holds the named middlewares available to routes,
+// and the ordered names of those applied to each route group, outermost
+// first. Groups' pipelines may be reordered or extended by configuration,
+// rather than by nesting closures at each route.
+type middlewarePipeline struct {
+	middlewares map[string]func(http.Handler) http.Handler
+	groups      map[string][]string
+
+	// server lists the middlewares wrapping the whole server, outermost
+	// first, for debugging.
+	server []string
+}
+
+func newMiddlewarePipeline() *middlewarePipeline {
+	return &middlewarePipeline{
+		middlewares: make(map[string]func(http.Handler) http.Handler),
+		groups:      make(map[string][]string),
+	}
+}
+
+// use makes a middleware available to route groups.
+func (mp *middlewarePipeline) use(name string, wrap func(http.Handler) http.Handler) {
+	mp.middlewares[name] = wrap
+}
+
+// group sets the default pipeline of a route group.
+func (mp *middlewarePipeline) group(name string, middlewares ...string) {
+	mp.groups[name] = append([]string{}, middlewares...)
+}
+
+// configure overrides the pipelines of route groups by configuration,
+// then checks that all groups refer only to available middlewares. It
+// must be called before routes are registered.
+func (mp *middlewarePipeline) configure(groups map[string][]string) error {
+	for name, middlewares := range groups {
+		mp.group(name, middlewares...)
+	}
+	for name, middlewares := range mp.groups {
+		for _, middleware := range middlewares {
+			if _, ok := mp.middlewares[middleware]; !ok {
+				return fmt.Errorf("route group %q: unknown middleware %q", name, middleware)
+			}
+		}
+	}
+	return nil
+}
+
+// chain returns the names of the middlewares of a route group. It panics
+// if the group is undefined, as routes are registered at startup.
+func (mp *middlewarePipeline) chain(group string) []string {
+	middlewares, ok := mp.groups[group]
+	if !ok {
+		panic(fmt.Sprintf("undefined route group %q", group))
+	}
+	return middlewares
+}
+
+// apply wraps h in the middlewares of a route group.
+func (mp *middlewarePipeline) apply(group string, h http.Handler) http.Handler {
+	middlewares := mp.chain(group)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = mp.middlewares[middlewares[i]](h)
+	}
+	return h
+}
+
+// wrapServer wraps the server's handler in a middleware, recording it as
+// the outermost one.
+func (mp *middlewarePipeline) wrapServer(name string, h http.Handler, wrap func(http.Handler) http.Handler) http.Handler {
+	mp.server = append([]string{name}, mp.server...)
+	return wrap(h)
+}
+
+// routeGroup registers routes sharing a middleware pipeline.
+type routeGroup struct {
+	routes *routeRegistry
+	name   string
+}
+
+// group returns the named route group. It panics if the group is
+// undefined.
+func (rr *routeRegistry) group(name string) *routeGroup {
+	rr.middleware.chain(name)
+	return &routeGroup{routes: rr, name: name}
+}
+
+func (g *routeGroup) handle(method, path string, h http.HandlerFunc, opts ...routeOption) {
+	g.routes.handle(method, path, h, append([]routeOption{inGroup(g.name)}, opts...)...)
+}
+
+func (g *routeGroup) GET(path string, h http.HandlerFunc, opts ...routeOption) {
+	g.handle(http.MethodGet, path, h, opts...)
+}
+
+func (g *routeGroup) POST(path string, h http.HandlerFunc, opts ...routeOption) {
+	g.handle(http.MethodPost, path, h, opts...)
+}
+
+func (g *routeGroup) PUT(path string, h http.HandlerFunc, opts ...routeOption) {
+	g.handle(http.MethodPut, path, h, opts...)
+}
+
+func (g *routeGroup) PATCH(path string, h http.HandlerFunc, opts ...routeOption) {
+	g.handle(http.MethodPatch, path, h, opts...)
+}
+
+func (g *routeGroup) DELETE(path string, h http.HandlerFunc, opts ...routeOption) {
+	g.handle(http.MethodDelete, path, h, opts...)
+}
+
+// inGroup applies a route group's middleware pipeline to a route.
+func inGroup(name string) routeOption {
+	return func(rt *route) {
+		rt.Group = name
+	}
+}
+
+// routeChain describes the effective middleware chain of a route.
+type routeChain struct {
+	Method string   `json:"method"`
+	Path   string   `json:"path"`
+	Group  string   `json:"group,omitempty"`
+	Chain  []string `json:"chain"`
+}
+
+// middlewareReport describes the middleware pipelines, and the effective
+// chain of each registered route, outermost middleware first.
+func (rr *routeRegistry) middlewareReport() interface{} {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	routes := make([]routeChain, 0, len(rr.routes))
+	for _, rt := range rr.routes {
+		chain := append([]string{}, rr.middleware.server...)
+		chain = append(chain, "router", "tracing", "usage")
+		if rt.Deprecation != nil {
+			chain = append(chain, "deprecation")
+		}
+		chain = append(chain, rt.Middleware...)
+		routes = append(routes, routeChain{Method: rt.Method, Path: rt.Path, Group: rt.Group, Chain: chain})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return struct {
+		Server []string            `json:"server"`
+		Groups map[string][]string `json:"groups"`
+		Routes []routeChain        `json:"routes"`
+	}{rr.middleware.server, rr.middleware.groups, routes}
+}
+
+// middlewareHandler serves GET /api/admin/middleware, dumping the
+// effective middleware chains.
+func middlewareHandler(rr *routeRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rr.middlewareReport())
+	}
+}
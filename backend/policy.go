@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultPolicyReloadInterval = 10 * time.Second
+
+	// policyLanguageCEL is the language of policies, and the only one
+	// supported.
+	policyLanguageCEL = "cel"
+
+	auditActionPolicyDecision = "policy.decision"
+)
+
+// patternWildcard matches the wildcards of route patterns, such as {id}
+// and {path...}.
+var patternWildcard = regexp.MustCompile(`\{([^}.]+)(?:\.\.\.)?\}`)
+
+// policyFile is a file of policies, in the policy directory.
+type policyFile struct {
+	Policies []policyRule `yaml:"policies"`
+}
+
+// policyRule authorizes requests to the routes it matches with a CEL
+// expression, evaluated with the variables:
+//
+//   - user: id, email, name, roles, principal, tenant, and team, the ID
+//     of the team selected for the session
+//   - route: method, path (the route pattern), and group
+//   - resource: the path values of the route, such as resource.id
+//   - request: path and query, the first value of each parameter
+//   - now: the current time
+//
+// Requests matching a rule are allowed only if its expression is true.
+type policyRule struct {
+	Name string `yaml:"name"`
+
+	// Language defaults to cel.
+	Language string `yaml:"language"`
+
+	// Routes lists the routes the rule applies to, as "METHOD /path"
+	// with the path as registered, such as "DELETE /api/data/{id}", or
+	// as a path alone for all methods. Empty matches all routes.
+	Routes []string `yaml:"routes"`
+
+	// Allow is the expression which must be true for requests to be
+	// allowed.
+	Allow string `yaml:"allow"`
+
+	file    string
+	program cel.Program
+}
+
+// matches reports whether the rule applies to a route.
+func (p *policyRule) matches(rt *route) bool {
+	if len(p.Routes) == 0 {
+		return true
+	}
+	if rt == nil {
+		return false
+	}
+	for _, r := range p.Routes {
+		if r == rt.Path || r == rt.operation() {
+			return true
+		}
+	}
+	return false
+}
+
+// policySet is the policies loaded from the policy directory, and the
+// digest of its files, to detect changes.
+type policySet struct {
+	rules  []*policyRule
+	digest [sha256.Size]byte
+}
+
+// policyEngine authorizes requests of signed-in users with the policies
+// of the policy directory, beyond roles. Policies are reloaded when the
+// files change. Decisions are recorded in the audit log: denials always,
+// and allowed requests if configured. A nil policyEngine, as returned
+// without a policy directory, allows all requests.
+type policyEngine struct {
+	dir          string
+	interval     time.Duration
+	logDecisions bool
+	env          *cel.Env
+	audit        *auditLog
+	logger       *zap.Logger
+	now          func() time.Time
+
+	policies atomic.Pointer[policySet]
+}
+
+// newPolicyEngine returns the policy engine, or nil if no policy
+// directory is configured. The policies must load.
+func newPolicyEngine(config *appConfig, audit *auditLog, logger *zap.Logger) (*policyEngine, error) {
+	if config.Policies.Dir == "" {
+		return nil, nil
+	}
+	env, err := cel.NewEnv(
+		cel.Variable("user", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("route", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("resource", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("now", cel.TimestampType),
+	)
+	if err != nil {
+		return nil, err
+	}
+	e := &policyEngine{
+		dir:          config.Policies.Dir,
+		interval:     config.Policies.ReloadInterval,
+		logDecisions: config.Policies.LogDecisions,
+		env:          env,
+		audit:        audit,
+		logger:       logger,
+		now:          time.Now,
+	}
+	if e.interval <= 0 {
+		e.interval = defaultPolicyReloadInterval
+	}
+	if _, err := e.reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// reload loads the policies if the policy files changed, reporting
+// whether they did. If they fail to load, the previous policies are kept.
+func (e *policyEngine) reload() (bool, error) {
+	paths, err := filepath.Glob(filepath.Join(e.dir, "*.y*ml"))
+	if err != nil {
+		return false, err
+	}
+	sort.Strings(paths)
+	contents := make(map[string][]byte, len(paths))
+	digest := sha256.New()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		contents[path] = data
+		fmt.Fprintf(digest, "%s\x00%d\x00", path, len(data))
+		digest.Write(data)
+	}
+	set := &policySet{}
+	digest.Sum(set.digest[:0])
+	if current := e.policies.Load(); current != nil && current.digest == set.digest {
+		return false, nil
+	}
+
+	for _, path := range paths {
+		var file policyFile
+		if err := yaml.Unmarshal(contents[path], &file); err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+		for i := range file.Policies {
+			rule := &file.Policies[i]
+			if err := e.compile(rule); err != nil {
+				return false, fmt.Errorf("%s: policy %q: %w", path, rule.Name, err)
+			}
+			rule.file = filepath.Base(path)
+			set.rules = append(set.rules, rule)
+		}
+	}
+	e.policies.Store(set)
+	return true, nil
+}
+
+func (e *policyEngine) compile(rule *policyRule) error {
+	if rule.Name == "" {
+		return errors.New("name is required")
+	}
+	if rule.Language != "" && rule.Language != policyLanguageCEL {
+		return fmt.Errorf("unsupported language %q: only cel is supported", rule.Language)
+	}
+	ast, issues := e.env.Compile(rule.Allow)
+	if issues.Err() != nil {
+		return issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return fmt.Errorf("expected a bool expression, got %s", ast.OutputType())
+	}
+	program, err := e.env.Program(ast)
+	if err != nil {
+		return err
+	}
+	rule.program = program
+	return nil
+}
+
+// start reloads the policies every reload interval until ctx is done.
+func (e *policyEngine) start(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reloaded, err := e.reload()
+				if err != nil {
+					e.logger.Error("failed to reload policies, keeping the previous ones", zap.Error(err))
+				} else if reloaded {
+					e.logger.Info("reloaded policies", zap.Int("policies", len(e.policies.Load().rules)))
+				}
+			}
+		}
+	}()
+}
+
+// input returns the variables policies are evaluated with.
+func (e *policyEngine) input(r *http.Request, auth *authDetails) map[string]any {
+	user := map[string]any{"roles": []string{}}
+	if auth != nil {
+		user = map[string]any{
+			"id":        auth.userID,
+			"email":     auth.email,
+			"name":      auth.name,
+			"roles":     append([]string{}, auth.roles...),
+			"principal": auth.principalType(),
+			"tenant":    tenantOf(auth),
+			"team":      "",
+		}
+		if t := teamFromContext(r.Context()); t != nil {
+			user["team"] = t.ID
+		}
+	}
+	routeInput := map[string]string{"method": r.Method}
+	if rt := routeFromContext(r.Context()); rt != nil {
+		routeInput["path"], routeInput["group"] = rt.Path, rt.Group
+	}
+	resource := make(map[string]string)
+	for _, match := range patternWildcard.FindAllStringSubmatch(r.Pattern, -1) {
+		resource[match[1]] = r.PathValue(match[1])
+	}
+	query := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		query[name] = values[0]
+	}
+	return map[string]any{
+		"user":     user,
+		"route":    routeInput,
+		"resource": resource,
+		"request":  map[string]any{"path": r.URL.Path, "query": query},
+		"now":      e.now(),
+	}
+}
+
+// decide evaluates the policies matching the request's route, returning
+// the first which denies it, if any. Policies failing to evaluate deny.
+func (e *policyEngine) decide(r *http.Request, auth *authDetails) (*policyRule, []string, error) {
+	var input map[string]any
+	var evaluated []string
+	rt := routeFromContext(r.Context())
+	for _, rule := range e.policies.Load().rules {
+		if !rule.matches(rt) {
+			continue
+		}
+		if input == nil {
+			input = e.input(r, auth)
+		}
+		evaluated = append(evaluated, rule.Name)
+		out, _, err := rule.program.Eval(input)
+		if err != nil {
+			return rule, evaluated, err
+		}
+		if allowed, _ := out.Value().(bool); !allowed {
+			return rule, evaluated, nil
+		}
+	}
+	return nil, evaluated, nil
+}
+
+// middleware rejects requests denied by the policies. It must be applied
+// inside the auth middleware, and the tenant middleware if any.
+func (e *policyEngine) middleware(h http.Handler) http.Handler {
+	if e == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, _ := r.Context().Value(authKey{}).(*authDetails)
+		denied, evaluated, err := e.decide(r, auth)
+		if len(evaluated) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		var userID string
+		if auth != nil {
+			userID = auth.userID
+		}
+		if err != nil {
+			e.logger.Warn("failed to evaluate policy",
+				append(traceLogFields(r.Context()), zap.String("policy.name", denied.Name), zap.Error(err))...)
+		}
+		if denied != nil || e.logDecisions {
+			changes := map[string]string{
+				"decision": "allow",
+				"route":    r.Pattern,
+				"policies": strings.Join(evaluated, ","),
+			}
+			if denied != nil {
+				changes["decision"] = "deny"
+				changes["policy"] = denied.Name
+				changes["policy_file"] = denied.file
+			}
+			e.audit.record(r.Context(), auditActionPolicyDecision, userID, r.PathValue("id"), changes)
+		}
+		if denied != nil {
+			writeError(w, r, http.StatusForbidden, "Forbidden")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultProfileTTL      = 15 * time.Minute
+	defaultProfileMaxStale = 24 * time.Hour
+
+	// profileRetryInterval is how long after failing to fetch a profile it
+	// is fetched again, so that requests do not hammer a failing provider.
+	profileRetryInterval = time.Minute
+
+	// maxCachedProfiles bounds the memory used by the cache. Once full,
+	// profiles of further users are not cached until others expire.
+	maxCachedProfiles = 10000
+)
+
+// userProfile holds the profile fields of a user reported by a provider's
+// API, rather than by its ID token.
+type userProfile struct {
+	Name  string
+	Email string
+}
+
+// profileFetcher fetches the profile of a user from a provider's API.
+type profileFetcher func(ctx context.Context, userID string) (*userProfile, error)
+
+type profileEntry struct {
+	profile    *userProfile
+	fetched    time.Time
+	refreshing bool
+	retryAt    time.Time
+}
+
+// profileResolver keeps the profiles of users signed in with providers
+// whose profile data requires an API call, such as Microsoft Graph, up to
+// date in their authDetails. Profiles are served from a read-through cache:
+// fresh for the TTL, then stale for up to MaxStale while they are refetched
+// in the background. Resolving never blocks on the provider: until a
+// profile is first fetched, the claims of the session token are used.
+type profileResolver struct {
+	ttl      time.Duration
+	maxStale time.Duration
+	timeout  time.Duration
+	logger   *zap.Logger
+	now      func() time.Time
+
+	// fetchers holds the profile fetchers by provider, as set in the
+	// "idp" claim of local session tokens.
+	fetchers map[string]profileFetcher
+
+	mu      sync.Mutex
+	entries map[tokenKey]*profileEntry
+}
+
+func newProfileResolver(config *appConfig, logger *zap.Logger) *profileResolver {
+	r := &profileResolver{
+		ttl:      config.Profiles.TTL,
+		maxStale: config.Profiles.MaxStale,
+		timeout:  timeoutOrDefault(config.Timeouts.OAuth),
+		logger:   logger,
+		now:      time.Now,
+		fetchers: make(map[string]profileFetcher),
+		entries:  make(map[tokenKey]*profileEntry),
+	}
+	if r.ttl <= 0 {
+		r.ttl = defaultProfileTTL
+	}
+	if r.maxStale <= 0 {
+		r.maxStale = defaultProfileMaxStale
+	}
+	return r
+}
+
+// register makes the profiles of a provider's users resolved with fetch.
+func (r *profileResolver) register(provider string, fetch profileFetcher) {
+	r.fetchers[provider] = fetch
+}
+
+// set caches a profile fetched otherwise, such as on sign-in.
+func (r *profileResolver) set(provider, userID string, profile *userProfile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store(tokenKey{provider, userID}, profile)
+}
+
+// store caches a profile. It must be called with r.mu held.
+func (r *profileResolver) store(key tokenKey, profile *userProfile) {
+	now := r.now()
+	entry := r.entries[key]
+	if entry == nil {
+		if len(r.entries) >= maxCachedProfiles {
+			for k, e := range r.entries {
+				if !e.refreshing && now.Sub(e.fetched) > r.maxStale && now.After(e.retryAt) {
+					delete(r.entries, k)
+				}
+			}
+			if len(r.entries) >= maxCachedProfiles {
+				return
+			}
+		}
+		entry = &profileEntry{}
+		r.entries[key] = entry
+	}
+	entry.profile = profile
+	entry.fetched = now
+}
+
+// resolve returns the cached profile of a user, if not older than
+// MaxStale, refetching it in the background if missing or older than the
+// TTL.
+func (r *profileResolver) resolve(provider, userID string) *userProfile {
+	fetch, ok := r.fetchers[provider]
+	if !ok {
+		return nil
+	}
+	key := tokenKey{provider, userID}
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry := r.entries[key]
+	var profile *userProfile
+	if entry != nil && now.Sub(entry.fetched) <= r.maxStale {
+		profile = entry.profile
+	}
+	if entry != nil && (entry.refreshing || now.Sub(entry.fetched) < r.ttl || now.Before(entry.retryAt)) {
+		return profile
+	}
+	if entry == nil {
+		if len(r.entries) >= maxCachedProfiles {
+			return nil
+		}
+		entry = &profileEntry{}
+		r.entries[key] = entry
+	}
+	entry.refreshing = true
+	go r.refresh(key, fetch)
+	return profile
+}
+
+// refresh fetches a profile in the background. On failure, the stale
+// profile is kept, and fetched again on its first use after
+// profileRetryInterval.
+func (r *profileResolver) refresh(key tokenKey, fetch profileFetcher) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	profile, err := fetch(ctx, key.id)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.logger.Warn("failed to fetch user profile",
+			zap.String("provider", key.provider), zap.String("user.id", key.id), zap.Error(err))
+		if entry := r.entries[key]; entry != nil {
+			entry.refreshing = false
+			entry.retryAt = r.now().Add(profileRetryInterval)
+		}
+		return
+	}
+	r.store(key, profile)
+	if entry := r.entries[key]; entry != nil {
+		entry.refreshing = false
+	}
+}
+
+// wrap returns an ID token parser that updates the details of sessions of
+// providers with profile fetchers with their users' cached profiles.
+func (r *profileResolver) wrap(
+	parseIDToken func(string) (*authDetails, error),
+) func(string) (*authDetails, error) {
+	if len(r.fetchers) == 0 {
+		return parseIDToken
+	}
+	return func(idToken string) (*authDetails, error) {
+		details, err := parseIDToken(idToken)
+		if err != nil {
+			return nil, err
+		}
+		provider, _ := details.claims["idp"].(string)
+		if profile := r.resolve(provider, details.userID); profile != nil {
+			if profile.Name != "" {
+				details.name = profile.Name
+			}
+			if profile.Email != "" {
+				details.email = profile.Email
+			}
+		}
+		return details, nil
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"app-backend/blobstore"
+
+	"go.uber.org/zap"
+)
+
+const (
+	profilesPrefix = "profiles/"
+
+	defaultProfilingInterval    = 5 * time.Minute
+	defaultProfilingCPUDuration = 10 * time.Second
+	defaultProfilingRetention   = 72 * time.Hour
+)
+
+// profiler periodically captures CPU and heap profiles into the blob
+// store, keyed by replica and time, deleting them after the retention
+// period, so that performance can be investigated after an incident.
+type profiler struct {
+	blobs         blobstore.Store
+	logger        *zap.Logger
+	interval      time.Duration
+	cpuDuration   time.Duration
+	retention     time.Duration
+	minGoroutines int
+	replica       string
+	now           func() time.Time
+}
+
+// newProfiler returns a profiler, or nil if profiling is not enabled.
+func newProfiler(config *appConfig, blobs blobstore.Store, logger *zap.Logger) *profiler {
+	if !config.Profiling.Enabled {
+		return nil
+	}
+	p := &profiler{
+		blobs:         blobs,
+		logger:        logger,
+		interval:      config.Profiling.Interval,
+		cpuDuration:   config.Profiling.CPUDuration,
+		retention:     config.Profiling.Retention,
+		minGoroutines: config.Profiling.MinGoroutines,
+		now:           time.Now,
+	}
+	if p.interval <= 0 {
+		p.interval = defaultProfilingInterval
+	}
+	if p.cpuDuration <= 0 {
+		p.cpuDuration = defaultProfilingCPUDuration
+	}
+	if p.cpuDuration > p.interval {
+		p.cpuDuration = p.interval
+	}
+	if p.retention <= 0 {
+		p.retention = defaultProfilingRetention
+	}
+	p.replica, _ = os.Hostname()
+	if p.replica == "" {
+		p.replica = "unknown"
+	}
+	return p
+}
+
+// run captures profiles every interval, until ctx is done.
+func (p *profiler) run(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n := runtime.NumGoroutine(); n < p.minGoroutines {
+			continue
+		}
+		if err := p.capture(ctx); err != nil {
+			p.logger.Warn("failed to capture profiles", zap.Error(err))
+		}
+		lifecycle := map[string]time.Duration{profilesPrefix: p.retention}
+		if deleted, err := blobstore.Cleanup(ctx, p.blobs, lifecycle, p.now()); err != nil {
+			p.logger.Warn("failed to delete expired profiles", zap.Int("blobs.deleted", deleted), zap.Error(err))
+		}
+	}
+}
+
+// capture profiles the CPU for cpuDuration, then the heap, storing both.
+func (p *profiler) capture(ctx context.Context) error {
+	start := p.now().UTC()
+	var cpu bytes.Buffer
+	if err := pprof.StartCPUProfile(&cpu); err != nil {
+		// The CPU may already be profiled, e.g. through /debug/pprof.
+		return fmt.Errorf("while profiling the CPU: %w", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(p.cpuDuration):
+	}
+	pprof.StopCPUProfile()
+	if err := p.store(ctx, start, "cpu", &cpu); err != nil {
+		return err
+	}
+
+	var heap bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+		return fmt.Errorf("while profiling the heap: %w", err)
+	}
+	return p.store(ctx, start, "heap", &heap)
+}
+
+func (p *profiler) store(ctx context.Context, start time.Time, kind string, profile *bytes.Buffer) error {
+	key := fmt.Sprintf("%s%s/%s-%s.pprof", profilesPrefix, p.replica, start.Format("20060102T150405Z"), kind)
+	if err := p.blobs.Put(ctx, key, profile, int64(profile.Len()), "application/octet-stream"); err != nil {
+		return fmt.Errorf("while storing %s profile: %w", kind, err)
+	}
+	return nil
+}
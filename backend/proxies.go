@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// trustedProxies are the reverse proxies in front of the backend, whose
+// X-Forwarded-For tells the address of the client. Other peers are the
+// clients themselves, so that clients cannot claim another address by
+// sending the header.
+type trustedProxies []netip.Prefix
+
+// newTrustedProxies parses server.trusted_proxies, addresses and CIDR
+// ranges.
+func newTrustedProxies(config *appConfig) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, s := range config.Server.TrustedProxies {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("server.trusted_proxies: invalid address or range %q", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// trusts reports whether ip is the address of a trusted proxy.
+func (t trustedProxies) trusts(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of r: its peer, unless the
+// peer is a trusted proxy, in which case the last address in
+// X-Forwarded-For which is not, as proxies append the address of their
+// peer to it.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	ip := peerIP(r)
+	if !t.trusts(ip) {
+		return ip
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = hops[i]
+		if !t.trusts(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// middleware resolves the address of the client of requests, as clientIP
+// returns it.
+func (t trustedProxies) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, t.clientIP(r))))
+	})
+}
+
+// clientIP returns the address of the client of r, as resolved by the
+// trusted proxies middleware, or its peer outside of it.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+// peerIP returns the address of the peer of r.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
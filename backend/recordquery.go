@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRecordOrder is the order of /api/data without sort_field, and
+// that of its cursors before sorting was introduced.
+const defaultRecordOrder = "data:id"
+
+var errPagesCombined = errors.New("page and per_page cannot be combined with limit and cursor")
+
+// filter keeps the records, as seen by the user, which match the status,
+// category, and query of the search.
+func (s recordSearch) filter(records []SampleRecord) []SampleRecord {
+	if s.Status == "" && s.Category == "" && strings.TrimSpace(s.Query) == "" {
+		return records
+	}
+	return slices.DeleteFunc(records, func(record SampleRecord) bool { return !s.matches(record) })
+}
+
+// matches reports whether a record has the status and category of the
+// search, if set, and contains its query in its ID, name, description,
+// status, or category, ignoring case.
+func (s recordSearch) matches(record SampleRecord) bool {
+	if s.Status != "" && record.Status != s.Status || s.Category != "" && record.Category != s.Category {
+		return false
+	}
+	query := strings.ToLower(strings.TrimSpace(s.Query))
+	if query == "" {
+		return true
+	}
+	for _, value := range []string{record.ID, record.Name, record.Description, record.Status, record.Category} {
+		if strings.Contains(strings.ToLower(value), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordOrder is the order of a list of records: by a sortable column of
+// their schema, then by ID, so that the order is total, as cursors
+// require.
+type recordOrder struct {
+	field string
+	desc  bool
+}
+
+// parseRecordOrder parses the "sort_field" and "sort_order" query
+// parameters of r, which default to id and asc.
+func parseRecordOrder(r *http.Request) (recordOrder, error) {
+	query := r.URL.Query()
+	order := recordOrder{field: query.Get("sort_field")}
+	if order.field == "" {
+		order.field = "id"
+	}
+	columns, err := tableSchema[SampleRecord](nil)
+	if err != nil {
+		return order, err
+	}
+	if !slices.ContainsFunc(columns, func(c schemaColumn) bool { return c.Field == order.field && c.Sortable }) {
+		return order, fmt.Errorf("cannot sort by %q", order.field)
+	}
+	switch direction := query.Get("sort_order"); direction {
+	case "", "asc":
+	case "desc":
+		order.desc = true
+	default:
+		return order, fmt.Errorf(`sort_order must be "asc" or "desc", not %q`, direction)
+	}
+	return order, nil
+}
+
+// name names the order in cursors, so that cursors of one order cannot be
+// used with another.
+func (o recordOrder) name() string {
+	if o.field == "id" && !o.desc {
+		return defaultRecordOrder
+	}
+	direction := "asc"
+	if o.desc {
+		direction = "desc"
+	}
+	return "data:" + o.field + ":" + direction
+}
+
+// key returns the sort key of a record, which orders records as strings.
+func (o recordOrder) key(record SampleRecord) string {
+	var value string
+	switch o.field {
+	case "id":
+		return record.ID
+	case "name":
+		value = record.Name
+	case "created_at":
+		// Creation times may be in several offsets.
+		if t, err := time.Parse(time.RFC3339, record.CreatedAt); err == nil {
+			value = t.UTC().Format("2006-01-02T15:04:05")
+		}
+	case "status":
+		value = record.Status
+	case "category":
+		value = record.Category
+	case "assignee":
+		value = record.Assignee
+	case "stars":
+		value = fmt.Sprintf("%010d", record.Stars)
+	}
+	return value + "\x00" + record.ID
+}
+
+// sort sorts records, which are sorted by ID, in the order.
+func (o recordOrder) sort(records []SampleRecord) {
+	if o.name() == defaultRecordOrder {
+		return
+	}
+	type keyed struct {
+		key    string
+		record SampleRecord
+	}
+	sorted := make([]keyed, len(records))
+	for i, record := range records {
+		sorted[i] = keyed{o.key(record), record}
+	}
+	slices.SortFunc(sorted, func(a, b keyed) int {
+		if o.desc {
+			a, b = b, a
+		}
+		return strings.Compare(a.key, b.key)
+	})
+	for i := range sorted {
+		records[i] = sorted[i].record
+	}
+}
+
+// recordPage is a page of records requested by number, with the total
+// number of records matching the request, for tables which page by
+// number rather than with cursors.
+type recordPage struct {
+	page    int
+	perPage int
+}
+
+// parseRecordPage parses the "page" and "per_page" query parameters of
+// r, returning nil if neither is set. Pages are numbered from 1, and hold
+// defaultPageSize records unless set otherwise.
+func parseRecordPage(r *http.Request) (*recordPage, error) {
+	query := r.URL.Query()
+	if !query.Has("page") && !query.Has("per_page") {
+		return nil, nil
+	}
+	if query.Has("limit") || query.Has("cursor") {
+		return nil, errPagesCombined
+	}
+	p := &recordPage{page: 1, perPage: defaultPageSize}
+	if page := query.Get("page"); page != "" {
+		n, err := strconv.Atoi(page)
+		if err != nil || n < 1 {
+			return nil, errors.New("page must be a positive number")
+		}
+		p.page = n
+	}
+	if perPage := query.Get("per_page"); perPage != "" {
+		n, err := strconv.Atoi(perPage)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, errors.New("per_page must be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+		p.perPage = n
+	}
+	return p, nil
+}
+
+// write writes the page of records, with the selected fields, in an
+// object with the page number, size, and the total number of records.
+// Pages past the last one are empty.
+func (p *recordPage) write(w io.Writer, records []SampleRecord, fields fieldSelection) error {
+	start := len(records)
+	if p.page-1 < (len(records)+p.perPage-1)/p.perPage {
+		start = (p.page - 1) * p.perPage
+	}
+	end := min(start+p.perPage, len(records))
+	if _, err := fmt.Fprintf(w, `{"page":%d,"per_page":%d,"total":%d,"items":`, p.page, p.perPage, len(records)); err != nil {
+		return err
+	}
+	if err := writeJSONList(w, records[start:end:end], fields); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
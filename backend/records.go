@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	recordsIndex = "app-records"
+
+	maxRecordNameLength        = 200
+	maxRecordDescriptionLength = 10000
+)
+
+// Audit event actions of records.
+const (
+	auditActionRecordCreated = "record.created"
+	auditActionRecordUpdated = "record.updated"
+	auditActionRecordDeleted = "record.deleted"
+)
+
+var (
+	errRecordNameInvalid        = fmt.Errorf("names must be 1 to %d characters", maxRecordNameLength)
+	errRecordDescriptionInvalid = fmt.Errorf("descriptions must be at most %d characters", maxRecordDescriptionLength)
+	errUnknownCategory          = errors.New("unknown category")
+
+	// errRecordChanged is returned when a record changed since the version
+	// a write was based on, by another request or replica.
+	errRecordChanged = errors.New("record changed")
+)
+
+// storedRecord is a record with the version of its document, which
+// changes with every write.
+type storedRecord struct {
+	record      SampleRecord
+	seqNo       int
+	primaryTerm int
+}
+
+// etag returns the version of the record, as the strong ETag of its
+// responses and the If-Match of its writes.
+func (s storedRecord) etag() string {
+	return fmt.Sprintf(`"%d-%d"`, s.seqNo, s.primaryTerm)
+}
+
+// ifMatch reports whether an If-Match header matches the version of the
+// record, comparing strongly, as RFC 9110 requires of If-Match. Writes
+// without If-Match are unconditional.
+func (s storedRecord) ifMatch(header string) bool {
+	if header == "" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if candidate = strings.TrimSpace(candidate); candidate == "*" || candidate == s.etag() {
+			return true
+		}
+	}
+	return false
+}
+
+// recordStore manages records, persisted to Elasticsearch if configured,
+// with a document per record. Writes are conditional on the version of
+// the record they are based on, its sequence number and primary term, so
+// that concurrent writes by other replicas are not overwritten. With no
+// records stored, such as the first time, the store is seeded with sample
+// data.
+type recordStore struct {
+	client    *elasticsearch.Client
+	ids       idSource
+	clock     clock
+	sanitizer *htmlSanitizer
+	logger    *zap.Logger
+
+	// invalidations is set once the backend is wired, and tells other
+	// replicas about changed records.
+	invalidations *invalidator
+
+	mu      sync.RWMutex
+	records map[string]storedRecord
+
+	// seqNo numbers the writes of records without Elasticsearch.
+	seqNo int
+}
+
+func newRecordStore(
+	client *elasticsearch.Client,
+	ids idSource,
+	clk clock,
+	sanitizer *htmlSanitizer,
+	seed []SampleRecord,
+	logger *zap.Logger,
+) (*recordStore, error) {
+	s := &recordStore{
+		client:    client,
+		ids:       ids,
+		clock:     clk,
+		sanitizer: sanitizer,
+		logger:    logger,
+		records:   make(map[string]storedRecord),
+	}
+	if err := s.init(seed); err != nil {
+		return nil, fmt.Errorf("failed to init record store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing records from Elasticsearch, or seeds the store with
+// the sample records if there are none yet.
+func (s *recordStore) init(seed []SampleRecord) error {
+	if s.client == nil {
+		for _, record := range seed {
+			s.seqNo++
+			s.records[record.ID] = storedRecord{record: record, seqNo: s.seqNo, primaryTerm: 1}
+		}
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initRecordStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(recordsIndex),
+		s.client.Search.WithSize(10000),
+		s.client.Search.WithSeqNoPrimaryTerm(true),
+	)
+	if err != nil {
+		logger.Info("could not load records from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		logger.Info("could not load records from Elasticsearch", zap.String("status", res.Status()))
+		return nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				SeqNo       int          `json:"_seq_no"`
+				PrimaryTerm int          `json:"_primary_term"`
+				Source      SampleRecord `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if res.StatusCode != http.StatusNotFound {
+		if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		s.records[hit.Source.ID] = storedRecord{record: hit.Source, seqNo: hit.SeqNo, primaryTerm: hit.PrimaryTerm}
+	}
+	if len(s.records) == 0 {
+		s.seed(ctx, seed)
+		logger.Info("seeded records", zap.Int("records", len(s.records)))
+		span.SetStatus(codes.Ok, "")
+		return nil
+	}
+
+	logger.Info("loaded records", zap.Int("records", len(s.records)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// seed stores the sample records. Those another replica seeded first are
+// loaded instead.
+func (s *recordStore) seed(ctx context.Context, seed []SampleRecord) {
+	for _, record := range seed {
+		stored, err := s.create(ctx, record)
+		switch {
+		case errors.Is(err, errRecordChanged):
+			err = s.reload(ctx, record.ID)
+		case err == nil:
+			s.set(stored)
+		}
+		if err != nil {
+			s.logger.Warn("failed to seed record", zap.String("record.id", record.ID), zap.Error(err))
+		}
+	}
+}
+
+// watch reloads records changed by other replicas.
+func (s *recordStore) watch(invalidations *invalidator) {
+	s.invalidations = invalidations
+	invalidations.subscribe(invalidateRecord, func(ctx context.Context, inv invalidation) {
+		if err := s.reload(ctx, inv.Key); err != nil {
+			s.logger.Warn("failed to reload record", zap.String("record.id", inv.Key), zap.Error(err))
+		}
+	})
+}
+
+// reload loads a record from Elasticsearch, replacing the one in memory.
+func (s *recordStore) reload(ctx context.Context, id string) error {
+	res, err := s.client.Get(recordsIndex, id, s.client.Get.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("while loading record: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		s.mu.Lock()
+		delete(s.records, id)
+		s.mu.Unlock()
+		return nil
+	}
+	if res.IsError() {
+		return fmt.Errorf("loading record failed: %s", res.Status())
+	}
+	var doc struct {
+		SeqNo       int          `json:"_seq_no"`
+		PrimaryTerm int          `json:"_primary_term"`
+		Source      SampleRecord `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return err
+	}
+	s.set(storedRecord{record: doc.Source, seqNo: doc.SeqNo, primaryTerm: doc.PrimaryTerm})
+	return nil
+}
+
+// set replaces a record in memory, unless the one there is newer.
+func (s *recordStore) set(stored storedRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.records[stored.record.ID]; ok &&
+		current.primaryTerm == stored.primaryTerm && current.seqNo > stored.seqNo {
+		return
+	}
+	s.records[stored.record.ID] = stored
+}
+
+// list returns copies of the records, sorted by ID.
+func (s *recordStore) list() []SampleRecord {
+	s.mu.RLock()
+	records := make([]SampleRecord, 0, len(s.records))
+	for _, stored := range s.records {
+		records = append(records, stored.record)
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(records, func(a, b SampleRecord) int { return strings.Compare(a.ID, b.ID) })
+	return records
+}
+
+// get returns a record and its version.
+func (s *recordStore) get(id string) (storedRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stored, ok := s.records[id]
+	return stored, ok
+}
+
+// exists reports whether there is a record with the given ID.
+func (s *recordStore) exists(id string) bool {
+	_, ok := s.get(id)
+	return ok
+}
+
+// validate sanitizes the fields of a record written by users, and checks
+// them.
+func (s *recordStore) validate(record *SampleRecord) error {
+	s.sanitizer.sanitizeFields(record)
+	record.Name = strings.TrimSpace(record.Name)
+	record.Description = strings.TrimSpace(record.Description)
+	if record.Name == "" || utf8.RuneCountInString(record.Name) > maxRecordNameLength {
+		return errRecordNameInvalid
+	}
+	if utf8.RuneCountInString(record.Description) > maxRecordDescriptionLength {
+		return errRecordDescriptionInvalid
+	}
+	if !slices.Contains(categories, record.Category) {
+		return fmt.Errorf("%w %q", errUnknownCategory, record.Category)
+	}
+	return nil
+}
+
+// add creates a record, with a new ID and the current time.
+func (s *recordStore) add(ctx context.Context, record SampleRecord) (storedRecord, error) {
+	if err := s.validate(&record); err != nil {
+		return storedRecord{}, err
+	}
+	record.ID = s.ids.NewID()
+	record.CreatedAt = s.clock.Now().UTC().Format(time.RFC3339)
+	record.Assignee, record.Tags, record.Stars, record.Starred = "", nil, 0, false
+	stored, err := s.create(ctx, record)
+	if err != nil {
+		return storedRecord{}, err
+	}
+	s.set(stored)
+	s.invalidations.notify(ctx, invalidateRecord, record.ID, s.clock.Now())
+	return stored, nil
+}
+
+// create stores a new record, returning errRecordChanged if one with its
+// ID already exists.
+func (s *recordStore) create(ctx context.Context, record SampleRecord) (storedRecord, error) {
+	if s.client == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.records[record.ID]; ok {
+			return storedRecord{}, errRecordChanged
+		}
+		s.seqNo++
+		return storedRecord{record: record, seqNo: s.seqNo, primaryTerm: 1}, nil
+	}
+	res, err := s.client.Create(
+		recordsIndex, record.ID, esutil.NewJSONReader(record),
+		s.client.Create.WithContext(ctx),
+	)
+	if err != nil {
+		return storedRecord{}, fmt.Errorf("while saving record: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusConflict {
+		return storedRecord{}, errRecordChanged
+	}
+	if res.IsError() {
+		return storedRecord{}, fmt.Errorf("saving record failed: %s", res.Status())
+	}
+	return decodeStoredRecord(res.Body, record)
+}
+
+// update changes the editable fields of a record, its name, description,
+// and category, provided its version matches ifMatch. It returns the
+// previous and updated records.
+func (s *recordStore) update(ctx context.Context, id, ifMatch string, change SampleRecord) (storedRecord, storedRecord, error) {
+	if err := s.validate(&change); err != nil {
+		return storedRecord{}, storedRecord{}, err
+	}
+	s.mu.Lock()
+	current, ok := s.records[id]
+	if !ok {
+		s.mu.Unlock()
+		return storedRecord{}, storedRecord{}, errUnknownRecord
+	}
+	if !current.ifMatch(ifMatch) {
+		s.mu.Unlock()
+		return current, current, errRecordChanged
+	}
+	record := current.record
+	record.Name, record.Description, record.Category = change.Name, change.Description, change.Category
+	if s.client == nil {
+		s.seqNo++
+		updated := storedRecord{record: record, seqNo: s.seqNo, primaryTerm: current.primaryTerm}
+		s.records[id] = updated
+		s.mu.Unlock()
+		return current, updated, nil
+	}
+	s.mu.Unlock()
+
+	res, err := s.client.Index(
+		recordsIndex, esutil.NewJSONReader(record),
+		s.client.Index.WithDocumentID(id),
+		s.client.Index.WithIfSeqNo(current.seqNo),
+		s.client.Index.WithIfPrimaryTerm(current.primaryTerm),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return current, current, fmt.Errorf("while saving record: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusConflict {
+		return current, current, s.conflict(ctx, id)
+	}
+	if res.IsError() {
+		return current, current, fmt.Errorf("saving record failed: %s", res.Status())
+	}
+	updated, err := decodeStoredRecord(res.Body, record)
+	if err != nil {
+		return current, current, err
+	}
+	s.set(updated)
+	s.invalidations.notify(ctx, invalidateRecord, id, s.clock.Now())
+	return current, updated, nil
+}
+
+// delete deletes a record, provided its version matches ifMatch, and
+// returns it.
+func (s *recordStore) delete(ctx context.Context, id, ifMatch string) (storedRecord, error) {
+	s.mu.Lock()
+	current, ok := s.records[id]
+	if !ok {
+		s.mu.Unlock()
+		return storedRecord{}, errUnknownRecord
+	}
+	if !current.ifMatch(ifMatch) {
+		s.mu.Unlock()
+		return current, errRecordChanged
+	}
+	if s.client == nil {
+		delete(s.records, id)
+		s.mu.Unlock()
+		return current, nil
+	}
+	s.mu.Unlock()
+
+	res, err := s.client.Delete(
+		recordsIndex, id,
+		s.client.Delete.WithIfSeqNo(current.seqNo),
+		s.client.Delete.WithIfPrimaryTerm(current.primaryTerm),
+		s.client.Delete.WithContext(ctx),
+	)
+	if err != nil {
+		return current, fmt.Errorf("while deleting record: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusConflict || res.StatusCode == http.StatusNotFound {
+		return current, s.conflict(ctx, id)
+	}
+	if res.IsError() {
+		return current, fmt.Errorf("deleting record failed: %s", res.Status())
+	}
+	s.mu.Lock()
+	delete(s.records, id)
+	s.mu.Unlock()
+	s.invalidations.notify(ctx, invalidateRecord, id, s.clock.Now())
+	return current, nil
+}
+
+// conflict reloads a record another replica changed, returning
+// errRecordChanged, or errUnknownRecord if it was deleted.
+func (s *recordStore) conflict(ctx context.Context, id string) error {
+	if err := s.reload(ctx, id); err != nil {
+		return err
+	}
+	if !s.exists(id) {
+		return errUnknownRecord
+	}
+	return errRecordChanged
+}
+
+// decodeStoredRecord returns record with the version of a write response.
+func decodeStoredRecord(body io.Reader, record SampleRecord) (storedRecord, error) {
+	var written struct {
+		SeqNo       int `json:"_seq_no"`
+		PrimaryTerm int `json:"_primary_term"`
+	}
+	if err := json.NewDecoder(body).Decode(&written); err != nil {
+		return storedRecord{}, err
+	}
+	return storedRecord{record: record, seqNo: written.SeqNo, primaryTerm: written.PrimaryTerm}, nil
+}
+
+// recordEdit holds the fields of records written by users.
+type recordEdit struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Category    string `json:"category"`
+
+	// Status is the initial status of created records, Pending if unset.
+	// It then changes with workflow transitions.
+	Status string `json:"status,omitempty"`
+}
+
+func (e recordEdit) record() SampleRecord {
+	return SampleRecord{Name: e.Name, Description: e.Description, Category: e.Category, Status: e.Status}
+}
+
+// registerRecordRoutes registers the endpoints for reading, creating,
+// updating, and deleting records. Records are returned as seen by the
+// user, with present, and with their version as ETag, which writes may
+// require with If-Match.
+func registerRecordRoutes(
+	routes *routeRegistry,
+	records *recordStore,
+	wf *workflow,
+	present func(userID string, record SampleRecord) SampleRecord,
+	audit *auditLog,
+	logger *zap.Logger,
+) {
+	user := routes.group(groupUser)
+
+	writeRecord := func(w http.ResponseWriter, r *http.Request, status int, stored storedRecord) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", stored.etag())
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(present(authFromContext(r.Context()).userID, stored.record))
+	}
+	// writeFailure reports a failed write, as a failed precondition if the
+	// request had one.
+	writeFailure := func(w http.ResponseWriter, r *http.Request, err error) {
+		switch {
+		case errors.Is(err, errRecordNameInvalid), errors.Is(err, errRecordDescriptionInvalid),
+			errors.Is(err, errUnknownCategory), errors.Is(err, errUnknownStatus):
+			writeError(w, r, http.StatusBadRequest, err.Error())
+		case errors.Is(err, errUnknownRecord):
+			writeError(w, r, http.StatusNotFound, err.Error())
+		case errors.Is(err, errRecordChanged) && r.Header.Get("If-Match") != "":
+			writeError(w, r, http.StatusPreconditionFailed, err.Error())
+		case errors.Is(err, errRecordChanged):
+			writeError(w, r, http.StatusConflict, err.Error())
+		default:
+			logger.Error("failed to save record", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	user.GET("/api/records/{id}", func(w http.ResponseWriter, r *http.Request) {
+		stored, ok := records.get(r.PathValue("id"))
+		if !ok {
+			writeError(w, r, http.StatusNotFound, errUnknownRecord.Error())
+			return
+		}
+		writeRecord(w, r, http.StatusOK, stored)
+	})
+
+	user.POST("/api/records", func(w http.ResponseWriter, r *http.Request) {
+		var req recordEdit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Status == "" {
+			req.Status = "Pending"
+		} else if !wf.known(req.Status) {
+			writeFailure(w, r, fmt.Errorf("%w %q", errUnknownStatus, req.Status))
+			return
+		}
+		auth := authFromContext(r.Context())
+		record := req.record()
+		record.Owner = auth.userID
+		stored, err := records.add(r.Context(), record)
+		if err != nil {
+			writeFailure(w, r, err)
+			return
+		}
+		audit.record(r.Context(), auditActionRecordCreated, auth.userID, stored.record.ID, map[string]string{
+			"name":     stored.record.Name,
+			"category": stored.record.Category,
+			"status":   stored.record.Status,
+		})
+		w.Header().Set("Location", "/api/records/"+stored.record.ID)
+		writeRecord(w, r, http.StatusCreated, stored)
+	})
+
+	user.PUT("/api/records/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var req recordEdit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		previous, updated, err := records.update(r.Context(), r.PathValue("id"), r.Header.Get("If-Match"), req.record())
+		if err != nil {
+			writeFailure(w, r, err)
+			return
+		}
+		changes := map[string]string{}
+		for _, field := range []struct{ name, from, to string }{
+			{"name", previous.record.Name, updated.record.Name},
+			{"description", previous.record.Description, updated.record.Description},
+			{"category", previous.record.Category, updated.record.Category},
+		} {
+			if field.from != field.to {
+				changes[field.name+".from"], changes[field.name+".to"] = field.from, field.to
+			}
+		}
+		if len(changes) > 0 {
+			audit.record(r.Context(), auditActionRecordUpdated, authFromContext(r.Context()).userID, updated.record.ID, changes)
+		}
+		writeRecord(w, r, http.StatusOK, updated)
+	})
+
+	user.DELETE("/api/records/{id}", func(w http.ResponseWriter, r *http.Request) {
+		deleted, err := records.delete(r.Context(), r.PathValue("id"), r.Header.Get("If-Match"))
+		if err != nil {
+			writeFailure(w, r, err)
+			return
+		}
+		audit.record(r.Context(), auditActionRecordDeleted, authFromContext(r.Context()).userID, deleted.record.ID, map[string]string{
+			"name": deleted.record.Name,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
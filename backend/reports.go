@@ -0,0 +1,987 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"app-backend/blobstore"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	reportsIndex         = "app-reports"
+	reportSnapshotsIndex = "app-report-snapshots"
+
+	maxReportsPerUser     = 20
+	maxReportNameLength   = 100
+	maxSnapshotsPerReport = 10
+
+	reportFormatCSV  = "csv"
+	reportFormatJSON = "json"
+
+	// reportEventSnapshot is the event of webhook notifications of new
+	// report snapshots.
+	reportEventSnapshot = "report.snapshot"
+)
+
+// reportSchedules maps the schedules reports can run on to their intervals.
+var reportSchedules = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+var (
+	errReportNotFound     = errors.New("report not found")
+	errReportLimit        = fmt.Errorf("users may have at most %d reports", maxReportsPerUser)
+	errSnapshotNotFound   = errors.New("snapshot not found")
+	errEmailNotConfigured = errors.New("email notifications are not configured")
+	errReportNoEmail      = errors.New("no email address to notify")
+)
+
+// The reports module lets users save a search of records to be run on a
+// schedule. Each run stores a CSV or JSON snapshot of the matching
+// records, and notifies the user by email or webhook with a link to
+// download it, signed so that it works without a session.
+func init() {
+	registerModule(apiModule{
+		Name: "reports",
+		Migrations: []migration{
+			createIndexMigration("001-create-reports-index", reportsIndex, map[string]interface{}{
+				"properties": map[string]interface{}{
+					"id":          map[string]string{"type": "keyword"},
+					"owner_id":    map[string]string{"type": "keyword"},
+					"name":        map[string]string{"type": "keyword"},
+					"search":      map[string]string{"type": "flattened"},
+					"fields":      map[string]string{"type": "keyword"},
+					"format":      map[string]string{"type": "keyword"},
+					"schedule":    map[string]string{"type": "keyword"},
+					"notify":      map[string]string{"type": "flattened"},
+					"created_at":  map[string]string{"type": "date"},
+					"next_run_at": map[string]string{"type": "date"},
+					"last_run_at": map[string]string{"type": "date"},
+				},
+			}),
+			createIndexMigration("002-create-snapshots-index", reportSnapshotsIndex, map[string]interface{}{
+				"properties": map[string]interface{}{
+					"id":         map[string]string{"type": "keyword"},
+					"report_id":  map[string]string{"type": "keyword"},
+					"created_at": map[string]string{"type": "date"},
+					"format":     map[string]string{"type": "keyword"},
+					"records":    map[string]string{"type": "integer"},
+					"content":    map[string]string{"type": "binary"},
+				},
+			}),
+		},
+		Register: registerReportsModule,
+	})
+}
+
+// reportSettings are the settings of the reports module, from
+// modules.settings.reports in the config file.
+type reportSettings struct {
+	// BaseURL is the URL the application is served at, which download
+	// links in notifications are relative to.
+	BaseURL string `yaml:"base_url"`
+
+	// CheckInterval is how often reports due to run are looked for.
+	CheckInterval time.Duration `yaml:"check_interval"`
+
+	// LinkTTL is how long download links in notifications are valid.
+	LinkTTL time.Duration `yaml:"link_ttl"`
+
+	// SMTP configures the mail server notifications are sent through.
+	// Email notifications are unavailable if Addr is empty.
+	SMTP struct {
+		Addr     string `yaml:"addr"`
+		From     string `yaml:"from"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"smtp"`
+}
+
+func registerReportsModule(env *moduleEnv) error {
+	settings := reportSettings{CheckInterval: time.Minute, LinkTTL: 7 * 24 * time.Hour}
+	if err := env.DecodeSettings(&settings); err != nil {
+		return err
+	}
+	store, err := newReportStore(env.Client, env.Blobs, env.Logger)
+	if err != nil {
+		return err
+	}
+	store.ids = env.IDs
+	if len(env.SecureCookies.keys()) == 0 {
+		env.Logger.Warn("encryption_keys configuration unspecified: report notifications will link to the signed-in download endpoint")
+	}
+	links := newReportLinks(env.SecureCookies, env.Clock, settings)
+	notifier := newReportNotifier(env.Config, settings, env.Logger)
+	registerReportRoutes(env.Routes, store, links, notifier, newDownloadThrottle(env.Config), env.Logger)
+	newReportScheduler(store, env.Records, links, notifier, env.Logger).start(context.Background(), settings.CheckInterval)
+	return nil
+}
+
+// reportNotify holds where to notify the owner of a report of its runs.
+type reportNotify struct {
+	Email      string `json:"email,omitempty"`
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+// report is a saved search of records, run on a schedule.
+type report struct {
+	ID        string       `json:"id"`
+	OwnerID   string       `json:"owner_id"`
+	Name      string       `json:"name"`
+	Search    recordSearch `json:"search"`
+	Fields    []string     `json:"fields,omitempty"`
+	Format    string       `json:"format"`
+	Schedule  string       `json:"schedule"`
+	Notify    reportNotify `json:"notify"`
+	CreatedAt time.Time    `json:"created_at"`
+	NextRunAt time.Time    `json:"next_run_at"`
+	LastRunAt *time.Time   `json:"last_run_at,omitempty"`
+}
+
+// reportSnapshot is the rendered result of a run of a report, whose
+// content is stored in the blob store.
+type reportSnapshot struct {
+	ID        string    `json:"id"`
+	ReportID  string    `json:"report_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Format    string    `json:"format"`
+	Records   int       `json:"records"`
+
+	// Size is the size of the content, in bytes. Snapshots taken before it
+	// was recorded have none, and are served without Range support.
+	Size int64 `json:"size,omitempty"`
+}
+
+// contentType returns the media type of the snapshot's content.
+func (s *reportSnapshot) contentType() string {
+	if s.Format == reportFormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// filename returns the name the snapshot is downloaded as.
+func (s *reportSnapshot) filename() string {
+	return fmt.Sprintf("report-%s-%s.%s", s.ReportID, s.CreatedAt.UTC().Format("20060102T150405Z"), s.Format)
+}
+
+// reportStore manages reports and their snapshots, persisted to
+// Elasticsearch if configured, in an index each, with the content of
+// snapshots in the blob store. Each report keeps its last
+// maxSnapshotsPerReport snapshots.
+type reportStore struct {
+	client *elasticsearch.Client
+	blobs  blobstore.Store
+	logger *zap.Logger
+	ids    idSource
+
+	mu      sync.RWMutex
+	reports map[string]report
+
+	// snapshots maps report IDs to their snapshots, oldest first.
+	snapshots map[string][]*reportSnapshot
+}
+
+func newReportStore(client *elasticsearch.Client, blobs blobstore.Store, logger *zap.Logger) (*reportStore, error) {
+	s := &reportStore{
+		client:    client,
+		blobs:     blobs,
+		logger:    logger,
+		ids:       cryptoIDs{},
+		reports:   make(map[string]report),
+		snapshots: make(map[string][]*reportSnapshot),
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init report store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing reports and snapshots from Elasticsearch.
+func (s *reportStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initReportStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	reports, ok, err := loadReportDocuments[report](ctx, s, reportsIndex)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	} else if !ok {
+		return nil
+	}
+	snapshots, _, err := loadReportDocuments[*reportSnapshot](ctx, s, reportSnapshotsIndex)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	for _, r := range reports {
+		s.reports[r.ID] = r
+	}
+	for _, snapshot := range snapshots {
+		if _, ok := s.reports[snapshot.ReportID]; ok {
+			s.snapshots[snapshot.ReportID] = append(s.snapshots[snapshot.ReportID], snapshot)
+		}
+	}
+	for _, snapshots := range s.snapshots {
+		sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt) })
+	}
+
+	logger.Info("loaded reports", zap.Int("reports", len(s.reports)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// loadReportDocuments returns the documents of index. It reports false if
+// Elasticsearch could not be searched.
+func loadReportDocuments[T any](ctx context.Context, s *reportStore, index string) ([]T, bool, error) {
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(index),
+		s.client.Search.WithSize(10000),
+	)
+	if err != nil {
+		s.logger.Info("could not load reports from Elasticsearch", zap.String("index", index), zap.Error(err))
+		return nil, false, nil
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		s.logger.Info("could not load reports from Elasticsearch", zap.String("index", index), zap.String("status", res.Status()))
+		return nil, false, nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source T `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		return nil, false, err
+	}
+	docs := make([]T, len(searchResult.Hits.Hits))
+	for i, hit := range searchResult.Hits.Hits {
+		docs[i] = hit.Source
+	}
+	return docs, true, nil
+}
+
+// list returns the reports of a user, oldest first.
+func (s *reportStore) list(ownerID string) []report {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := []report{}
+	for _, r := range s.reports {
+		if r.OwnerID == ownerID {
+			result = append(result, r)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
+	return result
+}
+
+// get returns a report of a user.
+func (s *reportStore) get(ownerID, id string) (report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.reports[id]
+	if !ok || r.OwnerID != ownerID {
+		return report{}, errReportNotFound
+	}
+	return r, nil
+}
+
+// add adds a report, unless its owner has too many already.
+func (s *reportStore) add(ctx context.Context, r report) error {
+	s.mu.Lock()
+	count := 0
+	for _, existing := range s.reports {
+		if existing.OwnerID == r.OwnerID {
+			count++
+		}
+	}
+	if count >= maxReportsPerUser {
+		s.mu.Unlock()
+		return errReportLimit
+	}
+	s.reports[r.ID] = r
+	s.mu.Unlock()
+	return s.save(ctx, reportsIndex, r.ID, r)
+}
+
+// delete deletes a report of a user and its snapshots.
+func (s *reportStore) delete(ctx context.Context, ownerID, id string) error {
+	s.mu.Lock()
+	r, ok := s.reports[id]
+	if !ok || r.OwnerID != ownerID {
+		s.mu.Unlock()
+		return errReportNotFound
+	}
+	delete(s.reports, id)
+	snapshots := s.snapshots[id]
+	delete(s.snapshots, id)
+	s.mu.Unlock()
+
+	if err := s.remove(ctx, reportsIndex, id); err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		if err := s.removeSnapshot(ctx, snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// due returns the reports due to run at now.
+func (s *reportStore) due(now time.Time) []report {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []report
+	for _, r := range s.reports {
+		if !r.NextRunAt.After(now) {
+			result = append(result, r)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].NextRunAt.Before(result[j].NextRunAt) })
+	return result
+}
+
+// addSnapshot stores a snapshot of a report and its content, and schedules
+// the report's next run. It discards the report's oldest snapshots beyond
+// maxSnapshotsPerReport.
+func (s *reportStore) addSnapshot(ctx context.Context, snapshot *reportSnapshot, content []byte, nextRunAt time.Time) error {
+	snapshot.Size = int64(len(content))
+	if err := s.blobs.Put(ctx, snapshotKey(snapshot), bytes.NewReader(content), int64(len(content)), snapshot.contentType()); err != nil {
+		return fmt.Errorf("while storing snapshot content: %w", err)
+	}
+	s.mu.Lock()
+	r, ok := s.reports[snapshot.ReportID]
+	if !ok {
+		// The report was deleted while running.
+		s.mu.Unlock()
+		s.blobs.Delete(ctx, snapshotKey(snapshot))
+		return errReportNotFound
+	}
+	r.LastRunAt, r.NextRunAt = &snapshot.CreatedAt, nextRunAt
+	s.reports[r.ID] = r
+	snapshots := append(s.snapshots[r.ID], snapshot)
+	var discarded []*reportSnapshot
+	if n := len(snapshots) - maxSnapshotsPerReport; n > 0 {
+		discarded = snapshots[:n]
+		snapshots = append([]*reportSnapshot(nil), snapshots[n:]...)
+	}
+	s.snapshots[r.ID] = snapshots
+	s.mu.Unlock()
+
+	if err := s.save(ctx, reportSnapshotsIndex, snapshot.ID, snapshot); err != nil {
+		return err
+	}
+	if err := s.save(ctx, reportsIndex, r.ID, r); err != nil {
+		return err
+	}
+	for _, old := range discarded {
+		if err := s.removeSnapshot(ctx, old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSnapshot deletes a snapshot and its content.
+func (s *reportStore) removeSnapshot(ctx context.Context, snapshot *reportSnapshot) error {
+	if err := s.blobs.Delete(ctx, snapshotKey(snapshot)); err != nil {
+		return fmt.Errorf("while deleting snapshot content: %w", err)
+	}
+	return s.remove(ctx, reportSnapshotsIndex, snapshot.ID)
+}
+
+// snapshotKey returns the blob key of the content of a snapshot.
+func snapshotKey(snapshot *reportSnapshot) string {
+	return "reports/" + snapshot.ReportID + "/" + snapshot.ID
+}
+
+// content returns the content of a snapshot.
+func (s *reportStore) content(ctx context.Context, snapshot *reportSnapshot) (io.ReadCloser, error) {
+	if snapshot.Size > 0 {
+		return blobstore.OpenReader(ctx, s.blobs, snapshotKey(snapshot), snapshot.Size)
+	}
+	return s.blobs.Get(ctx, snapshotKey(snapshot))
+}
+
+// listSnapshots returns the snapshots of a report of a user, newest first.
+func (s *reportStore) listSnapshots(ownerID, reportID string) ([]reportSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if r, ok := s.reports[reportID]; !ok || r.OwnerID != ownerID {
+		return nil, errReportNotFound
+	}
+	snapshots := s.snapshots[reportID]
+	result := make([]reportSnapshot, 0, len(snapshots))
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		result = append(result, *snapshots[i])
+	}
+	return result, nil
+}
+
+// snapshot returns a snapshot of a report.
+func (s *reportStore) snapshot(reportID, snapshotID string) (*reportSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, snapshot := range s.snapshots[reportID] {
+		if snapshot.ID == snapshotID {
+			return snapshot, nil
+		}
+	}
+	return nil, errSnapshotNotFound
+}
+
+// save indexes a document, if Elasticsearch is configured.
+func (s *reportStore) save(ctx context.Context, index, id string, doc interface{}) error {
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Index(
+		index, esutil.NewJSONReader(doc),
+		s.client.Index.WithDocumentID(id),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving %s document: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving %s document failed: %s", index, res.Status())
+	}
+	return nil
+}
+
+// remove deletes a document, if Elasticsearch is configured.
+func (s *reportStore) remove(ctx context.Context, index, id string) error {
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Delete(index, id, s.client.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("while deleting %s document: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting %s document failed: %s", index, res.Status())
+	}
+	return nil
+}
+
+// renderReport renders records in the format of a report, with only its
+// fields, or all fields if it has none.
+func renderReport(r report, records []SampleRecord) ([]byte, error) {
+	if r.Format == reportFormatJSON {
+		projected, err := fieldSelection(r.Fields).project(records)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(projected)
+	}
+
+	columns := r.Fields
+	if len(columns) == 0 {
+		columns = jsonFieldNames(reflect.TypeFor[SampleRecord]())
+	}
+	projected, err := fieldSelection(columns).project(records)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(columns)
+	for _, doc := range projected.([]map[string]json.RawMessage) {
+		row := make([]string, len(columns))
+		for i, column := range columns {
+			row[i] = csvCell(doc[column])
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// csvCell returns a JSON value as a CSV cell: strings unquoted, and other
+// values as JSON. Strings which spreadsheets would take for formulas are
+// prefixed with a quote, so that opening a report cannot run them.
+func csvCell(value json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return string(value)
+	}
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// reportLinks creates and verifies download links of report snapshots.
+// Without encryption keys, links point to the download endpoint for
+// signed-in users instead.
+type reportLinks struct {
+	signer  *urlSigner
+	baseURL string
+	ttl     time.Duration
+}
+
+func newReportLinks(secureCookies secureCookies, clk clock, settings reportSettings) *reportLinks {
+	return &reportLinks{
+		signer:  newURLSigner(secureCookies, clk),
+		baseURL: strings.TrimSuffix(settings.BaseURL, "/"),
+		ttl:     settings.LinkTTL,
+	}
+}
+
+// url returns the download link of a snapshot, and when it expires, or
+// the zero time if it does not.
+func (l *reportLinks) url(snapshot *reportSnapshot) (string, time.Time, error) {
+	if !l.signer.signed() {
+		return fmt.Sprintf("%s/api/reports/%s/snapshots/%s", l.baseURL, snapshot.ReportID, snapshot.ID), time.Time{}, nil
+	}
+	token, expires, err := l.signer.sign("report", []string{snapshot.ReportID, snapshot.ID}, l.ttl)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return l.baseURL + "/api/report-downloads?" + url.Values{"token": {token}}.Encode(), expires, nil
+}
+
+// decode returns the report and snapshot IDs of a download link token.
+func (l *reportLinks) decode(token string) (string, string, error) {
+	path, err := l.signer.verify(token, "report", 2)
+	if err != nil {
+		return "", "", err
+	}
+	return path[0], path[1], nil
+}
+
+// reportNotification is the body of webhook notifications of new report
+// snapshots.
+type reportNotification struct {
+	Event       string     `json:"event"`
+	ReportID    string     `json:"report_id"`
+	ReportName  string     `json:"report_name"`
+	SnapshotID  string     `json:"snapshot_id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Records     int        `json:"records"`
+	DownloadURL string     `json:"download_url"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// reportNotifier notifies the owners of reports of new snapshots, by
+// email and webhook. Webhook requests are signed like audit events, and
+// subject to the egress policy, as are all requests of
+// http.DefaultClient.
+type reportNotifier struct {
+	settings      reportSettings
+	webhookSecret string
+	httpClient    *http.Client
+	logger        *zap.Logger
+
+	// sendMail sends email, replaced in tests.
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func newReportNotifier(config *appConfig, settings reportSettings, logger *zap.Logger) *reportNotifier {
+	return &reportNotifier{
+		settings:      settings,
+		webhookSecret: config.Webhooks.Secret,
+		httpClient:    &http.Client{Transport: http.DefaultClient.Transport, Timeout: webhookTimeout},
+		logger:        logger,
+		sendMail:      smtp.SendMail,
+	}
+}
+
+// emailEnabled reports whether email notifications can be sent.
+func (n *reportNotifier) emailEnabled() bool {
+	return n.settings.SMTP.Addr != ""
+}
+
+// notify notifies the owner of a report of a new snapshot.
+func (n *reportNotifier) notify(r report, notification reportNotification) error {
+	var errs []error
+	if r.Notify.Email != "" && n.emailEnabled() {
+		if err := n.email(r.Notify.Email, notification); err != nil {
+			errs = append(errs, fmt.Errorf("while sending email: %w", err))
+		}
+	}
+	if r.Notify.WebhookURL != "" {
+		body, err := json.Marshal(notification)
+		if err != nil {
+			return err
+		}
+		signature := webhookSignature(n.webhookSecret, body)
+		if err := postWebhook(n.httpClient, r.Notify.WebhookURL, body, signature); err != nil {
+			errs = append(errs, fmt.Errorf("while posting webhook: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *reportNotifier) email(to string, notification reportNotification) error {
+	smtpSettings := n.settings.SMTP
+	var auth smtp.Auth
+	if smtpSettings.Username != "" {
+		host, _, err := net.SplitHostPort(smtpSettings.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", smtpSettings.Username, smtpSettings.Password, host)
+	}
+	subject := fmt.Sprintf("Report %q is ready", notification.ReportName)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", smtpSettings.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", notification.CreatedAt.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Your report %q ran at %s, matching %d records.\r\n\r\n",
+		notification.ReportName, notification.CreatedAt.Format(time.RFC1123), notification.Records)
+	fmt.Fprintf(&msg, "Download it at %s\r\n", notification.DownloadURL)
+	if notification.ExpiresAt != nil {
+		fmt.Fprintf(&msg, "The link expires at %s.\r\n", notification.ExpiresAt.Format(time.RFC1123))
+	}
+	return n.sendMail(smtpSettings.Addr, auth, smtpSettings.From, []string{to}, msg.Bytes())
+}
+
+// reportScheduler runs reports when they are due. Each replica of the
+// backend runs the reports it knows of, so the module is meant for
+// single-replica deployments.
+type reportScheduler struct {
+	store    *reportStore
+	records  recordSource
+	links    *reportLinks
+	notifier *reportNotifier
+	logger   *zap.Logger
+	now      func() time.Time
+}
+
+func newReportScheduler(
+	store *reportStore, records recordSource, links *reportLinks, notifier *reportNotifier, logger *zap.Logger,
+) *reportScheduler {
+	return &reportScheduler{
+		store:    store,
+		records:  records,
+		links:    links,
+		notifier: notifier,
+		logger:   logger,
+		now:      time.Now,
+	}
+}
+
+// start runs due reports every interval until ctx is done.
+func (s *reportScheduler) start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.runDue(ctx)
+			}
+		}
+	}()
+}
+
+// runDue runs the reports which are due, one after the other.
+func (s *reportScheduler) runDue(ctx context.Context) {
+	for _, r := range s.store.due(s.now()) {
+		if err := s.run(ctx, r); err != nil && !errors.Is(err, errReportNotFound) {
+			s.logger.Error("failed to run report", zap.String("report.id", r.ID), zap.Error(err))
+		}
+	}
+}
+
+// run renders and stores a snapshot of a report, and notifies its owner.
+func (s *reportScheduler) run(ctx context.Context, r report) error {
+	ctx, span := otel.Tracer("main").Start(ctx, "runReport")
+	defer span.End()
+	span.SetAttributes(attribute.String("report.id", r.ID))
+
+	records := s.records(r.OwnerID, r.Search)
+	content, err := renderReport(r, records)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	now := s.now().UTC()
+	snapshot := &reportSnapshot{
+		ID:        s.store.ids.NewID(),
+		ReportID:  r.ID,
+		CreatedAt: now,
+		Format:    r.Format,
+		Records:   len(records),
+	}
+	// Schedule the next run from the due time rather than now, so that
+	// runs do not drift later, skipping runs missed while down.
+	next := r.NextRunAt
+	for !next.After(now) {
+		next = next.Add(reportSchedules[r.Schedule])
+	}
+	if err := s.store.addSnapshot(ctx, snapshot, content, next); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	link, expires, err := s.links.url(snapshot)
+	if err != nil {
+		return err
+	}
+	notification := reportNotification{
+		Event:       reportEventSnapshot,
+		ReportID:    r.ID,
+		ReportName:  r.Name,
+		SnapshotID:  snapshot.ID,
+		CreatedAt:   snapshot.CreatedAt,
+		Records:     snapshot.Records,
+		DownloadURL: link,
+	}
+	if !expires.IsZero() {
+		notification.ExpiresAt = &expires
+	}
+	if err := s.notifier.notify(r, notification); err != nil {
+		s.logger.Warn("failed to notify of report", zap.String("report.id", r.ID), zap.Error(err))
+	}
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// validReportName reports whether name can be used as a report name, which
+// appears in email headers.
+func validReportName(name string) bool {
+	if name == "" || len([]rune(name)) > maxReportNameLength {
+		return false
+	}
+	return !strings.ContainsFunc(name, unicode.IsControl)
+}
+
+// registerReportRoutes registers the endpoints for managing reports and
+// downloading their snapshots.
+func registerReportRoutes(
+	routes *routeRegistry,
+	store *reportStore,
+	links *reportLinks,
+	notifier *reportNotifier,
+	downloads *downloadThrottle,
+	logger *zap.Logger,
+) {
+	user := routes.group(groupUser)
+
+	writeJSON := func(w http.ResponseWriter, status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	download := func(w http.ResponseWriter, r *http.Request, snapshot *reportSnapshot) {
+		content, err := store.content(r.Context(), snapshot)
+		if errors.Is(err, blobstore.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, errSnapshotNotFound.Error())
+			return
+		} else if err != nil {
+			logger.Error("failed to get snapshot content", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusBadGateway, err.Error())
+			return
+		}
+		defer content.Close()
+		w.Header().Set("Content-Type", snapshot.contentType())
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": snapshot.filename()}))
+		if seeker, ok := content.(io.ReadSeeker); ok {
+			downloads.serve(w, r, snapshot.CreatedAt, seeker)
+			return
+		}
+		io.Copy(downloads.writer(w, r), content)
+	}
+
+	user.GET("/api/reports", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, struct {
+			Reports []report `json:"reports"`
+		}{store.list(authFromContext(r.Context()).userID)})
+	})
+
+	user.POST("/api/reports", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name     string       `json:"name"`
+			Search   recordSearch `json:"search"`
+			Fields   []string     `json:"fields"`
+			Format   string       `json:"format"`
+			Schedule string       `json:"schedule"`
+			Notify   struct {
+				Email      bool   `json:"email"`
+				WebhookURL string `json:"webhook_url"`
+			} `json:"notify"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		auth := authFromContext(r.Context())
+		rep := report{
+			OwnerID:  auth.userID,
+			Name:     strings.TrimSpace(req.Name),
+			Format:   req.Format,
+			Schedule: req.Schedule,
+		}
+		if !validReportName(rep.Name) {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("report names must be 1 to %d characters", maxReportNameLength))
+			return
+		}
+		if rep.Format != reportFormatCSV && rep.Format != reportFormatJSON {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("unknown format %q", rep.Format))
+			return
+		}
+		interval, ok := reportSchedules[rep.Schedule]
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("unknown schedule %q", rep.Schedule))
+			return
+		}
+		for _, tag := range req.Search.Tags {
+			tag, err := normalizeTag(tag)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			rep.Search.Tags = append(rep.Search.Tags, tag)
+		}
+		rep.Search.StarredOnly = req.Search.StarredOnly
+		rep.Search.Status, rep.Search.Category = req.Search.Status, req.Search.Category
+		rep.Search.Query = strings.TrimSpace(req.Search.Query)
+		if len(req.Fields) > 0 {
+			fields, err := selectFields[SampleRecord](req.Fields)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			rep.Fields = fields
+		}
+		if req.Notify.Email {
+			if !notifier.emailEnabled() {
+				writeError(w, r, http.StatusBadRequest, errEmailNotConfigured.Error())
+				return
+			}
+			if _, err := mail.ParseAddress(auth.email); err != nil {
+				writeError(w, r, http.StatusBadRequest, errReportNoEmail.Error())
+				return
+			}
+			rep.Notify.Email = auth.email
+		}
+		if req.Notify.WebhookURL != "" {
+			u, err := url.Parse(req.Notify.WebhookURL)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				writeError(w, r, http.StatusBadRequest, "invalid webhook URL")
+				return
+			}
+			rep.Notify.WebhookURL = u.String()
+		}
+
+		rep.ID = store.ids.NewID()
+		rep.CreatedAt = time.Now().UTC()
+		rep.NextRunAt = rep.CreatedAt.Add(interval)
+		if err := store.add(r.Context(), rep); errors.Is(err, errReportLimit) {
+			writeError(w, r, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			logger.Error("failed to save report", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, rep)
+	})
+
+	user.DELETE("/api/reports/{id}", func(w http.ResponseWriter, r *http.Request) {
+		err := store.delete(r.Context(), authFromContext(r.Context()).userID, r.PathValue("id"))
+		switch {
+		case errors.Is(err, errReportNotFound):
+			writeError(w, r, http.StatusNotFound, err.Error())
+		case err != nil:
+			logger.Error("failed to delete report", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	user.GET("/api/reports/{id}/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		snapshots, err := store.listSnapshots(authFromContext(r.Context()).userID, r.PathValue("id"))
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Snapshots []reportSnapshot `json:"snapshots"`
+		}{snapshots})
+	})
+
+	user.GET("/api/reports/{id}/snapshots/{snapshot_id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := store.get(authFromContext(r.Context()).userID, r.PathValue("id")); err != nil {
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		snapshot, err := store.snapshot(r.PathValue("id"), r.PathValue("snapshot_id"))
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		download(w, r, snapshot)
+	})
+
+	// Signed download links work without a session, e.g. when opened from
+	// an email on another device.
+	if links.signer.signed() {
+		routes.group(groupPublic).GET("/api/report-downloads", func(w http.ResponseWriter, r *http.Request) {
+			reportID, snapshotID, err := links.decode(r.URL.Query().Get("token"))
+			switch {
+			case errors.Is(err, errDownloadLinkExpired):
+				writeError(w, r, http.StatusGone, err.Error())
+				return
+			case err != nil:
+				writeError(w, r, http.StatusNotFound, err.Error())
+				return
+			}
+			snapshot, err := store.snapshot(reportID, snapshotID)
+			if err != nil {
+				writeError(w, r, http.StatusNotFound, err.Error())
+				return
+			}
+			download(w, r, snapshot)
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseDelay   = 100 * time.Millisecond
+	defaultRetryMaxDelay    = 2 * time.Second
+
+	// retryBudgetRatio is the number of retries each call earns, so
+	// that retries add at most 10% load to a struggling dependency.
+	retryBudgetRatio = 0.1
+
+	// retryBudgetMax bounds the retries which may be saved up, allowing
+	// bursts of retries after a period of successful calls.
+	retryBudgetMax = 10
+)
+
+// retryPolicy configures retries of outbound calls.
+type retryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the
+	// first. Defaults to 3.
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// BaseDelay is the backoff before the first retry, doubled for each
+	// further retry, up to MaxDelay. The actual delay is drawn uniformly
+	// from zero up to the backoff ("full jitter"), so that clients do not
+	// retry in lockstep. Default to 100ms and 2s.
+	BaseDelay time.Duration `yaml:"base_delay"`
+	MaxDelay  time.Duration `yaml:"max_delay"`
+}
+
+// withDefaults returns the policy with unset fields set to defaults.
+func (p retryPolicy) withDefaults() retryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	return p
+}
+
+// backoff returns the delay before the given retry, counting from 1.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	backoff := p.MaxDelay
+	if shift := retry - 1; shift < 32 {
+		backoff = min(p.BaseDelay<<shift, p.MaxDelay)
+	}
+	return rand.N(backoff + 1)
+}
+
+// retryBudget limits retries to a fraction of calls, so that retries do
+// not amplify the load on a dependency which is already failing.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+}
+
+// deposit earns retries for a call.
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	b.tokens = min(b.tokens+retryBudgetRatio, retryBudgetMax)
+	b.mu.Unlock()
+}
+
+// withdraw spends a retry, reporting whether the budget allowed it.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// permanentError marks an error as not worth retrying.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// permanent marks err as not worth retrying.
+func permanent(err error) error {
+	return &permanentError{err}
+}
+
+// retrier retries outbound calls made from a call site, with exponential
+// backoff and jitter, within a retry budget, recording each attempt as a
+// metric.
+type retrier struct {
+	callSite string
+	policy   retryPolicy
+	budget   retryBudget
+	attempts metric.Int64Counter
+}
+
+func newRetrier(callSite string, policy retryPolicy) (*retrier, error) {
+	attempts, err := otel.Meter("main").Int64Counter(
+		"app.retry.attempts",
+		metric.WithDescription("Outbound call attempts by call site and outcome"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	rt := &retrier{callSite: callSite, policy: policy.withDefaults(), attempts: attempts}
+	rt.budget.tokens = retryBudgetMax
+	return rt, nil
+}
+
+// do calls fn until it succeeds, returns a permanent error, or attempts,
+// the retry budget, or the deadline budget of ctx run out. It returns the
+// last error.
+func (rt *retrier) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	rt.budget.deposit()
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			rt.record(ctx, "success")
+			return nil
+		}
+		var permanentErr *permanentError
+		if errors.As(err, &permanentErr) {
+			rt.record(ctx, "failure")
+			return permanentErr.err
+		}
+		if attempt >= rt.policy.MaxAttempts || ctx.Err() != nil {
+			rt.record(ctx, "failure")
+			return err
+		}
+		delay := rt.policy.backoff(attempt)
+		if remaining, ok := remainingBudget(ctx); ok && remaining < delay {
+			rt.record(ctx, "deadline_exhausted")
+			return err
+		}
+		if !rt.budget.withdraw() {
+			rt.record(ctx, "budget_exhausted")
+			return err
+		}
+		rt.record(ctx, "retry")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (rt *retrier) record(ctx context.Context, outcome string) {
+	rt.attempts.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("retry.call_site", rt.callSite),
+		attribute.String("retry.outcome", outcome),
+	))
+}
+
+// retryableStatus reports whether a response status indicates a
+// transient failure.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryableStatusError carries a response with a retryable status.
+type retryableStatusError struct {
+	res *http.Response
+}
+
+func (e *retryableStatusError) Error() string { return e.res.Status }
+
+// retryTransport retries HTTP requests which fail with a transport error
+// or a retryable status. The response to the last attempt is returned
+// when attempts run out.
+type retryTransport struct {
+	base    http.RoundTripper
+	retrier *retrier
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// Buffer the body so it can be resent.
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	var res *http.Response
+	first := true
+	err := t.retrier.do(req.Context(), func(ctx context.Context) error {
+		attemptReq := req
+		if !first && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return permanent(err)
+			}
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+		first = false
+		if res != nil {
+			// Discard the response to the previous attempt.
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			res = nil
+		}
+
+		var err error
+		res, err = t.base.RoundTrip(attemptReq)
+		if err != nil {
+			return err
+		}
+		if retryableStatus(res.StatusCode) {
+			return &retryableStatusError{res}
+		}
+		return nil
+	})
+	var statusErr *retryableStatusError
+	if err != nil && !errors.As(err, &statusErr) {
+		return nil, err
+	}
+	return res, nil
+}
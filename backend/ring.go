@@ -0,0 +1,38 @@
+package main
+
+// ringBuffer holds the most recent items pushed to it, up to a fixed
+// capacity, overwriting the oldest. It is not safe for concurrent use.
+type ringBuffer[T any] struct {
+	items []T
+	next  int
+	full  bool
+}
+
+func newRingBuffer[T any](capacity int) *ringBuffer[T] {
+	return &ringBuffer[T]{items: make([]T, capacity)}
+}
+
+func (b *ringBuffer[T]) push(item T) {
+	b.items[b.next] = item
+	b.next++
+	if b.next == len(b.items) {
+		b.next = 0
+		b.full = true
+	}
+}
+
+// len returns the number of items in the buffer.
+func (b *ringBuffer[T]) len() int {
+	if b.full {
+		return len(b.items)
+	}
+	return b.next
+}
+
+// all returns the buffered items, oldest first.
+func (b *ringBuffer[T]) all() []T {
+	if !b.full {
+		return append([]T(nil), b.items[:b.next]...)
+	}
+	return append(append([]T(nil), b.items[b.next:]...), b.items[:b.next]...)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLDAPUserFilter      = "(&(objectClass=user)(mail=%s))"
+	defaultLDAPGroupAttribute  = "memberOf"
+	defaultLDAPRefreshInterval = 15 * time.Minute
+)
+
+// roleResolver determines the application roles of a user, combining
+// statically configured roles with those synchronized from LDAP.
+type roleResolver struct {
+	// static maps email addresses to roles, inverted from appConfig.Roles.
+	static map[string][]string
+	ldap   *ldapGroupSync
+	logger *zap.Logger
+}
+
+// newRoleResolver creates a roleResolver from the application config.
+func newRoleResolver(config *appConfig, logger *zap.Logger) *roleResolver {
+	static := make(map[string][]string)
+	for role, emails := range config.Roles {
+		for _, email := range emails {
+			static[email] = append(static[email], role)
+		}
+	}
+	r := &roleResolver{static: static, logger: logger}
+	if config.LDAP.URL != "" {
+		r.ldap = newLDAPGroupSync(config)
+	}
+	return r
+}
+
+// rolesFor returns the sorted, de-duplicated roles for the user with the
+// given email address. Directory lookup failures are logged, and only the
+// statically configured roles are returned. Users without an email
+// address trusted by their identity provider have no roles.
+func (r *roleResolver) rolesFor(ctx context.Context, email string) []string {
+	if email == "" {
+		return nil
+	}
+	roles := slices.Clone(r.static[email])
+	if r.ldap != nil {
+		ldapRoles, err := r.ldap.rolesFor(ctx, email)
+		if err != nil {
+			r.logger.Warn(
+				"failed to synchronize LDAP groups",
+				append(traceLogFields(ctx), zap.Error(err))...,
+			)
+		}
+		roles = append(roles, ldapRoles...)
+	}
+	sort.Strings(roles)
+	return slices.Compact(roles)
+}
+
+// hasRole reports whether the authenticated user has the given role.
+func (a *authDetails) hasRole(role string) bool {
+	return slices.Contains(a.roles, role)
+}
+
+// requireRole creates middleware that rejects authenticated users
+// lacking the given role. It must be applied inside the auth middleware.
+func requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authFromContext(r.Context()).hasRole(role) {
+			writeError(w, r, http.StatusForbidden, "Forbidden")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// ldapGroupSync looks up users' group memberships in an LDAP directory,
+// such as Active Directory, and maps them to application roles. Results
+// are cached per user for the configured refresh interval.
+type ldapGroupSync struct {
+	url             string
+	bindDN          string
+	bindPassword    string
+	baseDN          string
+	userFilter      string
+	groupAttribute  string
+	groupRoles      map[string][]string
+	refreshInterval time.Duration
+	timeout         time.Duration
+
+	mu    sync.Mutex
+	cache map[string]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	roles     []string
+	fetchedAt time.Time
+}
+
+func newLDAPGroupSync(config *appConfig) *ldapGroupSync {
+	s := &ldapGroupSync{
+		url:             config.LDAP.URL,
+		bindDN:          config.LDAP.BindDN,
+		bindPassword:    config.LDAP.BindPassword,
+		baseDN:          config.LDAP.BaseDN,
+		userFilter:      config.LDAP.UserFilter,
+		groupAttribute:  config.LDAP.GroupAttribute,
+		groupRoles:      config.LDAP.GroupRoles,
+		refreshInterval: config.LDAP.RefreshInterval,
+		timeout:         timeoutOrDefault(config.Timeouts.LDAP),
+		cache:           make(map[string]ldapCacheEntry),
+	}
+	if s.userFilter == "" {
+		s.userFilter = defaultLDAPUserFilter
+	}
+	if s.groupAttribute == "" {
+		s.groupAttribute = defaultLDAPGroupAttribute
+	}
+	if s.refreshInterval == 0 {
+		s.refreshInterval = defaultLDAPRefreshInterval
+	}
+	return s
+}
+
+// rolesFor returns the roles granted by the user's directory groups,
+// using a cached result if it is younger than the refresh interval.
+// If the directory cannot be reached, a stale cached result is returned
+// along with the error.
+func (s *ldapGroupSync) rolesFor(ctx context.Context, email string) ([]string, error) {
+	s.mu.Lock()
+	entry, ok := s.cache[email]
+	s.mu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < s.refreshInterval {
+		return entry.roles, nil
+	}
+
+	groups, err := s.lookupGroups(ctx, email)
+	if err != nil {
+		return entry.roles, err
+	}
+	roles := s.mapGroups(groups)
+
+	s.mu.Lock()
+	s.cache[email] = ldapCacheEntry{roles: roles, fetchedAt: time.Now()}
+	s.mu.Unlock()
+	return roles, nil
+}
+
+// mapGroups maps group DNs to application roles.
+func (s *ldapGroupSync) mapGroups(groups []string) []string {
+	var roles []string
+	for _, group := range groups {
+		roles = append(roles, s.groupRoles[group]...)
+	}
+	return roles
+}
+
+// dial connects to the directory server, bounding the connection and
+// its operations by the timeout and the deadline budget of ctx.
+func (s *ldapGroupSync) dial(ctx context.Context) (*ldap.Conn, error) {
+	timeout := budgetTimeout(ctx, s.timeout)
+	if timeout <= 0 {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", context.DeadlineExceeded)
+	}
+	conn, err := ldap.DialURL(s.url, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	conn.SetTimeout(timeout)
+	return conn, nil
+}
+
+// ping checks that the directory server is reachable and accepts the
+// configured bind credentials.
+func (s *ldapGroupSync) ping(ctx context.Context) error {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if s.bindDN != "" {
+		if err := conn.Bind(s.bindDN, s.bindPassword); err != nil {
+			return fmt.Errorf("failed to bind to LDAP server: %w", err)
+		}
+	}
+	return nil
+}
+
+// lookupGroups queries the directory for the groups of the user with
+// the given email address.
+func (s *ldapGroupSync) lookupGroups(ctx context.Context, email string) (_ []string, resultErr error) {
+	_, span := otel.Tracer("main").Start(ctx, "ldap.lookupGroups")
+	defer func() {
+		if resultErr != nil {
+			span.RecordError(resultErr)
+			span.SetStatus(codes.Error, resultErr.Error())
+		}
+		span.End()
+	}()
+	span.SetAttributes(attribute.String("server.address", s.url))
+
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if s.bindDN != "" {
+		if err := conn.Bind(s.bindDN, s.bindPassword); err != nil {
+			return nil, fmt.Errorf("failed to bind to LDAP server: %w", err)
+		}
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		s.baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 0, false,
+		fmt.Sprintf(s.userFilter, ldap.EscapeFilter(email)),
+		[]string{s.groupAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("LDAP search failed: %w", err)
+	}
+	switch len(res.Entries) {
+	case 0:
+		return nil, nil
+	case 1:
+		return res.Entries[0].GetAttributeValues(s.groupAttribute), nil
+	default:
+		return nil, fmt.Errorf("LDAP search for %q matched multiple entries", email)
+	}
+}
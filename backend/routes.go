@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxClientsPerEndpoint bounds the clients tracked per endpoint, so that
+// arbitrary client identifiers cannot exhaust memory. Further clients
+// are counted as otherClient.
+const (
+	maxClientsPerEndpoint = 100
+	otherClient           = "other"
+)
+
+// route describes a registered API endpoint.
+type route struct {
+	Method      string            `json:"method"`
+	Path        string            `json:"path"`
+	Deprecation *routeDeprecation `json:"deprecation,omitempty"`
+
+	// Group is the route group whose middleware pipeline, listed in
+	// Middleware, is applied to the route.
+	Group      string   `json:"group,omitempty"`
+	Middleware []string `json:"middleware,omitempty"`
+
+	// DryRun reports whether the route, an admin mutation, supports dry
+	// runs.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// operation returns the route's operation name, as used for spans.
+func (rt *route) operation() string {
+	return rt.Method + " " + rt.Path
+}
+
+type routeKey struct{}
+
+// routeFromContext returns the route of the request being handled, or nil
+// if it was not registered with a routeRegistry.
+func routeFromContext(ctx context.Context) *route {
+	rt, _ := ctx.Value(routeKey{}).(*route)
+	return rt
+}
+
+// routeDeprecation marks an endpoint as deprecated. Responses carry the
+// Deprecation (RFC 9745), Sunset (RFC 8594), and Link headers.
+type routeDeprecation struct {
+	// Since is when the endpoint was deprecated.
+	Since time.Time `yaml:"since" json:"since,omitempty"`
+
+	// Sunset is when the endpoint will be removed.
+	Sunset time.Time `yaml:"sunset" json:"sunset,omitempty"`
+
+	// Link points to documentation on migrating off the endpoint.
+	Link string `yaml:"link" json:"link,omitempty"`
+}
+
+func (d *routeDeprecation) setHeaders(h http.Header) {
+	if d.Since.IsZero() {
+		h.Set("Deprecation", "true")
+	} else {
+		h.Set("Deprecation", "@"+strconv.FormatInt(d.Since.Unix(), 10))
+	}
+	if !d.Sunset.IsZero() {
+		h.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if d.Link != "" {
+		h.Add("Link", "<"+d.Link+`>; rel="deprecation"`)
+	}
+}
+
+// routeOption customizes a route at registration.
+type routeOption func(*route)
+
+// deprecatedRoute marks a route as deprecated.
+func deprecatedRoute(deprecation routeDeprecation) routeOption {
+	return func(rt *route) {
+		rt.Deprecation = &deprecation
+	}
+}
+
+// routeRegistry registers API endpoints on the router, instrumenting
+// them uniformly, and keeps track of them and their usage.
+type routeRegistry struct {
+	router *http.ServeMux
+
+	// deprecations marks routes as deprecated by configuration, keyed
+	// by operation name.
+	deprecations map[string]routeDeprecation
+
+	// middleware holds the pipelines of route groups.
+	middleware *middlewarePipeline
+
+	// slos tracks the requests covered by service level objectives. It
+	// must be set before routes are registered.
+	slos *sloTracker
+
+	mu     sync.Mutex
+	routes []*route
+	usage  map[string]*endpointUsage
+}
+
+func newRouteRegistry(router *http.ServeMux, deprecations map[string]routeDeprecation) *routeRegistry {
+	return &routeRegistry{
+		router:       router,
+		deprecations: deprecations,
+		middleware:   newMiddlewarePipeline(),
+		usage:        make(map[string]*endpointUsage),
+	}
+}
+
+// handle registers a handler for the given method and path.
+func (rr *routeRegistry) handle(method, path string, h http.HandlerFunc, opts ...routeOption) {
+	rt := &route{Method: method, Path: path}
+	for _, opt := range opts {
+		opt(rt)
+	}
+	if deprecation, ok := rr.deprecations[rt.operation()]; ok {
+		rt.Deprecation = &deprecation
+	}
+	var handler http.Handler = h
+	if rt.Group == groupAdmin && method != http.MethodGet {
+		handler = dryRunHandler(rt, h)
+	}
+	if rt.Group != "" {
+		rt.Middleware = rr.middleware.chain(rt.Group)
+		handler = rr.middleware.apply(rt.Group, handler)
+	}
+	handler = rr.slos.middleware(rt, handler)
+	usage := &endpointUsage{clients: make(map[string]*usageCounts)}
+
+	rr.mu.Lock()
+	rr.routes = append(rr.routes, rt)
+	rr.usage[rt.operation()] = usage
+	rr.mu.Unlock()
+
+	// The operation is also the route's ServeMux pattern, which names
+	// its spans, and sets the request's path values.
+	rr.router.Handle(rt.operation(), wrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		usage.record(usageClient(r))
+		if rt.Deprecation != nil {
+			rt.Deprecation.setHeaders(w.Header())
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, rt)))
+	}), rt.operation()))
+}
+
+func (rr *routeRegistry) GET(path string, h http.HandlerFunc, opts ...routeOption) {
+	rr.handle(http.MethodGet, path, h, opts...)
+}
+
+func (rr *routeRegistry) POST(path string, h http.HandlerFunc, opts ...routeOption) {
+	rr.handle(http.MethodPost, path, h, opts...)
+}
+
+func (rr *routeRegistry) PUT(path string, h http.HandlerFunc, opts ...routeOption) {
+	rr.handle(http.MethodPut, path, h, opts...)
+}
+
+func (rr *routeRegistry) PATCH(path string, h http.HandlerFunc, opts ...routeOption) {
+	rr.handle(http.MethodPatch, path, h, opts...)
+}
+
+func (rr *routeRegistry) DELETE(path string, h http.HandlerFunc, opts ...routeOption) {
+	rr.handle(http.MethodDelete, path, h, opts...)
+}
+
+// usageClient identifies the calling client: by the X-Client-Id header
+// if set, otherwise by the product name of its user agent.
+func usageClient(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get("X-Client-Id")); id != "" {
+		return id
+	}
+	product, _, _ := strings.Cut(r.UserAgent(), "/")
+	if product = strings.TrimSpace(product); product != "" {
+		return product
+	}
+	return "unknown"
+}
+
+type usageCounts struct {
+	Calls    int64     `json:"calls"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// endpointUsage counts calls to an endpoint, in total and per client.
+type endpointUsage struct {
+	mu      sync.Mutex
+	total   usageCounts
+	clients map[string]*usageCounts
+}
+
+func (u *endpointUsage) record(client string) {
+	now := time.Now().UTC()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.total.Calls++
+	u.total.LastUsed = now
+	counts := u.clients[client]
+	if counts == nil {
+		if len(u.clients) >= maxClientsPerEndpoint {
+			client = otherClient
+		}
+		if counts = u.clients[client]; counts == nil {
+			counts = &usageCounts{}
+			u.clients[client] = counts
+		}
+	}
+	counts.Calls++
+	counts.LastUsed = now
+}
+
+// endpointUsageReport describes the usage of a registered endpoint.
+type endpointUsageReport struct {
+	route
+	Calls    int64                  `json:"calls"`
+	LastUsed *time.Time             `json:"last_used"`
+	Clients  map[string]usageCounts `json:"clients"`
+}
+
+// usageReport returns the usage of all registered endpoints, sorted by
+// path and method.
+func (rr *routeRegistry) usageReport() []endpointUsageReport {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	report := make([]endpointUsageReport, 0, len(rr.routes))
+	for _, rt := range rr.routes {
+		usage := rr.usage[rt.operation()]
+		usage.mu.Lock()
+		entry := endpointUsageReport{
+			route:   *rt,
+			Calls:   usage.total.Calls,
+			Clients: make(map[string]usageCounts, len(usage.clients)),
+		}
+		if usage.total.Calls > 0 {
+			lastUsed := usage.total.LastUsed
+			entry.LastUsed = &lastUsed
+		}
+		for client, counts := range usage.clients {
+			entry.Clients[client] = *counts
+		}
+		usage.mu.Unlock()
+		report = append(report, entry)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Path != report[j].Path {
+			return report[i].Path < report[j].Path
+		}
+		return report[i].Method < report[j].Method
+	})
+	return report
+}
+
+// endpointUsageHandler serves GET /api/admin/usage/endpoints.
+func endpointUsageHandler(rr *routeRegistry, cursors *cursorCodec) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields, err := parseFields[endpointUsageReport](r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		page, err := paginate(w, r, cursors, "usage:path", rr.usageReport(), func(e endpointUsageReport) string {
+			return e.Path + "\x00" + e.Method
+		})
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		endpoints, err := fields.project(page)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Endpoints any `json:"endpoints"`
+		}{endpoints})
+	}
+}
@@ -6,14 +6,32 @@ import (
 	"time"
 )
 
-// SampleRecord represents a single data record for the table
+// SampleRecord represents a single data record for the table. The schema
+// tags describe its columns to the frontend, as served by
+// /api/data/schema. Fields tagged sanitize:"html" are rich text, to be
+// passed through htmlSanitizer.sanitizeFields when written.
 type SampleRecord struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	CreatedAt   string `json:"created_at"`
-	Status      string `json:"status"`
-	Category    string `json:"category"`
+	ID          string `json:"id" schema:"label=ID,sortable"`
+	Name        string `json:"name" schema:"sortable,filterable"`
+	Description string `json:"description" sanitize:"html"`
+	CreatedAt   string `json:"created_at" schema:"label=Created,type=datetime,sortable"`
+	Status      string `json:"status" schema:"sortable,filterable"`
+	Category    string `json:"category" schema:"sortable,filterable"`
+
+	// Assignee holds the user the record is assigned to, managed with
+	// its status by workflowStore.
+	Assignee string `json:"assignee" schema:"sortable,filterable"`
+
+	// Tags holds the record's tags, managed by tagStore.
+	Tags []string `json:"tags" schema:"filterable"`
+
+	// Stars holds the number of users who starred the record, and
+	// Starred whether the signed-in user did, managed by starStore.
+	Stars   int  `json:"stars" schema:"sortable"`
+	Starred bool `json:"starred" schema:"filterable"`
+
+	// Owner holds the user who created the record, who may share it.
+	Owner string `json:"owner,omitempty"`
 }
 
 var categories = []string{
@@ -52,13 +70,18 @@ var descriptions = []string{
 	"Improving operational efficiency",
 }
 
-// generateSampleData creates a slice of sample records
-func generateSampleData() []SampleRecord {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+// generateSampleData creates a slice of sample records, created within the
+// year before the time of clk, with contents picked at random from ids
+func generateSampleData(clk clock, ids idSource) []SampleRecord {
+	now := clk.Now()
+	seed, err := seedFrom(ids)
+	if err != nil {
+		seed = now.UnixNano()
+	}
+	r := rand.New(rand.NewSource(seed))
 	numRecords := 50 + r.Intn(51) // 50-100 records
 
 	records := make([]SampleRecord, numRecords)
-	now := time.Now()
 
 	for i := 0; i < numRecords; i++ {
 		// Generate a random date within the last 365 days
@@ -82,3 +105,29 @@ func generateSampleData() []SampleRecord {
 
 	return records
 }
+
+// recordSearch filters records, as the query parameters of /api/data do.
+type recordSearch struct {
+	Tags         []string `json:"tags,omitempty"`
+	StarredOnly  bool     `json:"starred_only,omitempty"`
+	SharedWithMe bool     `json:"shared_with_me,omitempty"`
+
+	// Team keeps only the records shared with a team.
+	Team string `json:"team,omitempty"`
+
+	// Status and Category keep only the records with them, and Query
+	// those containing it, as matches checks.
+	Status   string `json:"status,omitempty"`
+	Category string `json:"category,omitempty"`
+	Query    string `json:"q,omitempty"`
+
+	// Roles holds the roles of the user, for records shared with roles.
+	// It is not persisted with scheduled reports, which only see records
+	// shared with their owner directly.
+	Roles []string `json:"-"`
+}
+
+// recordSource returns copies of the records matching search which the
+// given user may read, as seen by them, with the state kept by the tag,
+// star, and workflow stores applied.
+type recordSource func(userID string, search recordSearch) []SampleRecord
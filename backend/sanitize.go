@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+var defaultRichTextURLSchemes = []string{"http", "https", "mailto"}
+
+// htmlSanitizer strips rich-text fields of HTML not in the configured
+// allowlist, such as scripts and event handler attributes, so that stored
+// content is safe for the frontend to render.
+type htmlSanitizer struct {
+	policy *bluemonday.Policy
+}
+
+func newHTMLSanitizer(config *appConfig) *htmlSanitizer {
+	richText := config.RichText
+	var policy *bluemonday.Policy
+	if len(richText.Elements) == 0 {
+		policy = bluemonday.UGCPolicy()
+	} else {
+		policy = bluemonday.NewPolicy()
+		policy.AllowElements(richText.Elements...)
+		if len(richText.Attributes) > 0 {
+			policy.AllowAttrs(richText.Attributes...).OnElements(richText.Elements...)
+		}
+		policy.RequireParseableURLs(true)
+		policy.RequireNoFollowOnLinks(true)
+	}
+	policy.AllowURLSchemes(append(defaultRichTextURLSchemes, richText.URLSchemes...)...)
+	return &htmlSanitizer{policy: policy}
+}
+
+// sanitize returns html with only the allowed elements and attributes.
+func (s *htmlSanitizer) sanitize(html string) string {
+	return s.policy.Sanitize(html)
+}
+
+// sanitizeFields sanitizes the string fields of the struct v points to
+// which are tagged sanitize:"html", including those of embedded structs.
+func (s *htmlSanitizer) sanitizeFields(v interface{}) {
+	s.sanitizeValue(reflect.ValueOf(v).Elem())
+}
+
+func (s *htmlSanitizer) sanitizeValue(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		switch {
+		case field.Anonymous && value.Kind() == reflect.Struct:
+			s.sanitizeValue(value)
+		case field.Tag.Get("sanitize") == "html" && value.Kind() == reflect.String && value.CanSet():
+			value.SetString(s.sanitize(value.String()))
+		}
+	}
+}
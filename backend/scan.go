@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Verdicts of content scans.
+const (
+	scanClean     = "clean"
+	scanInfected  = "infected"
+	scanUnscanned = "unscanned"
+)
+
+const (
+	defaultScanTimeout = 30 * time.Second
+
+	// clamdChunkSize is the size of the chunks content is streamed to clamd
+	// in.
+	clamdChunkSize = 32 << 10
+)
+
+var errScanFailed = errors.New("content scan failed")
+
+// scanResult is the verdict of a content scan, recorded with the scanned
+// attachment.
+type scanResult struct {
+	Verdict   string    `json:"verdict"`
+	Signature string    `json:"signature,omitempty"`
+	Scanner   string    `json:"scanner,omitempty"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// contentScanner scans uploaded content for malware.
+type contentScanner interface {
+	scan(ctx context.Context, r io.Reader) (scanResult, error)
+}
+
+// newContentScanner returns the scanner configured for uploads, or nil if
+// none is.
+func newContentScanner(config *appConfig) (contentScanner, error) {
+	scan := config.Attachments.Scan
+	switch {
+	case scan.ClamAV != "" && scan.URL != "":
+		return nil, errors.New("attachments.scan: only one of clamav and url may be set")
+	case scan.ClamAV != "":
+		network, addr := "tcp", strings.TrimPrefix(scan.ClamAV, "tcp://")
+		if path, ok := strings.CutPrefix(scan.ClamAV, "unix:"); ok {
+			network, addr = "unix", path
+		}
+		return &clamdScanner{network: network, addr: addr}, nil
+	case scan.URL != "":
+		return &httpScanner{url: scan.URL, client: http.DefaultClient}, nil
+	}
+	return nil, nil
+}
+
+// clamdScanner scans content with a ClamAV daemon, streaming it with the
+// INSTREAM command.
+type clamdScanner struct {
+	network string
+	addr    string
+}
+
+func (s *clamdScanner) scan(ctx context.Context, r io.Reader) (scanResult, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.addr)
+	if err != nil {
+		return scanResult{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	chunk := make([]byte, clamdChunkSize)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			binary.Write(w, binary.BigEndian, uint32(n))
+			w.Write(chunk[:n])
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return scanResult{}, err
+		}
+	}
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err := w.Flush(); err != nil {
+		return scanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return scanResult{}, err
+	}
+	// Replies are "stream: OK", "stream: <signature> FOUND", or an error
+	// such as "INSTREAM size limit exceeded. ERROR".
+	reply = strings.TrimRight(reply, "\x00\n")
+	result := scanResult{Verdict: scanClean, Scanner: "clamav", ScannedAt: time.Now().UTC()}
+	switch status := strings.TrimPrefix(reply, "stream: "); {
+	case status == "OK":
+	case strings.HasSuffix(status, " FOUND"):
+		result.Verdict, result.Signature = scanInfected, strings.TrimSuffix(status, " FOUND")
+	default:
+		return scanResult{}, fmt.Errorf("clamd: %s", reply)
+	}
+	return result, nil
+}
+
+// httpScanner scans content with an external scanning API, which is
+// posted the content, and responds with a JSON object like
+// {"infected": true, "signature": "Eicar-Test-Signature"}.
+type httpScanner struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpScanner) scan(ctx context.Context, r io.Reader) (scanResult, error) {
+	// The transport closes request bodies, and r belongs to the caller.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, io.NopCloser(r))
+	if err != nil {
+		return scanResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return scanResult{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return scanResult{}, fmt.Errorf("scanning API responded %s", res.Status)
+	}
+	var verdict struct {
+		Infected  *bool  `json:"infected"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&verdict); err != nil || verdict.Infected == nil {
+		return scanResult{}, errors.New("invalid response from scanning API")
+	}
+	result := scanResult{Verdict: scanClean, Scanner: "api", ScannedAt: time.Now().UTC()}
+	if *verdict.Infected {
+		result.Verdict, result.Signature = scanInfected, verdict.Signature
+	}
+	return result, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Column types of table schemas.
+const (
+	columnTypeString   = "string"
+	columnTypeNumber   = "number"
+	columnTypeBoolean  = "boolean"
+	columnTypeArray    = "array"
+	columnTypeDatetime = "datetime"
+)
+
+// schemaColumn describes a column of a table, for clients to render data
+// grids generically.
+type schemaColumn struct {
+	Field      string   `json:"field"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Sortable   bool     `json:"sortable"`
+	Filterable bool     `json:"filterable"`
+	Enum       []string `json:"enum,omitempty"`
+}
+
+// tableSchema returns the columns of the JSON fields of T, described by
+// their "schema" struct tags, a comma-separated list of options:
+//
+//   - sortable and filterable mark the column as such
+//   - label=... sets the column name, which defaults to the field name
+//     in title case
+//   - type=... overrides the type derived from the field's Go type, e.g.
+//     for datetime strings
+//
+// Fields tagged schema:"-" are left out. enums maps field names to their
+// allowed values.
+func tableSchema[T any](enums map[string][]string) ([]schemaColumn, error) {
+	return schemaColumns(reflect.TypeFor[T](), enums)
+}
+
+func schemaColumns(t reflect.Type, enums map[string][]string) ([]schemaColumn, error) {
+	var columns []schemaColumn
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		tag := field.Tag.Get("schema")
+		switch {
+		case name == "-" || tag == "-":
+			continue
+		case field.Anonymous && name == "":
+			embedded, err := schemaColumns(field.Type, enums)
+			if err != nil {
+				return nil, err
+			}
+			columns = append(columns, embedded...)
+			continue
+		case !field.IsExported():
+			continue
+		case name == "":
+			name = field.Name
+		}
+
+		column := schemaColumn{Field: name, Name: columnLabel(name), Type: columnType(field.Type), Enum: enums[name]}
+		for _, option := range strings.Split(tag, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+			switch key {
+			case "":
+			case "sortable":
+				column.Sortable = true
+			case "filterable":
+				column.Filterable = true
+			case "label":
+				column.Name = value
+			case "type":
+				column.Type = value
+			default:
+				return nil, fmt.Errorf("field %s: unknown schema option %q", field.Name, key)
+			}
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+// columnLabel returns a field name in title case, e.g. "Created At" for
+// "created_at".
+func columnLabel(name string) string {
+	words := strings.Split(name, "_")
+	for i, word := range words {
+		if word != "" {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// columnType returns the column type of values of Go type t.
+func columnType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return columnTypeBoolean
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return columnTypeNumber
+	case reflect.Slice, reflect.Array:
+		return columnTypeArray
+	case reflect.Struct:
+		if t == reflect.TypeFor[time.Time]() {
+			return columnTypeDatetime
+		}
+	}
+	return columnTypeString
+}
+
+// registerSchemaRoutes registers the endpoint describing the columns of
+// the records returned by /api/data.
+func registerSchemaRoutes(routes *routeRegistry, enums map[string][]string) error {
+	columns, err := tableSchema[SampleRecord](enums)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(struct {
+		Columns []schemaColumn `json:"columns"`
+	}{columns})
+	if err != nil {
+		return err
+	}
+
+	routes.group(groupUser).GET("/api/data/schema", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	return nil
+}
@@ -0,0 +1,794 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	scimUsersIndex  = "app-scim-users"
+	scimGroupsIndex = "app-scim-groups"
+)
+
+var (
+	errSCIMNotFound = errors.New("resource not found")
+
+	// errUserDeprovisioned is returned when a user has been deactivated
+	// or deleted by the identity provider via SCIM.
+	errUserDeprovisioned = errors.New("user has been deprovisioned")
+)
+
+// scimMeta holds SCIM resource metadata.
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created"`
+	LastModified string `json:"lastModified"`
+}
+
+// scimUser is a SCIM 2.0 User resource, limited to the core attributes
+// the scaffold makes use of.
+type scimUser struct {
+	Schemas    []string `json:"schemas"`
+	ID         string   `json:"id"`
+	ExternalID string   `json:"externalId,omitempty"`
+	UserName   string   `json:"userName"`
+	Name       struct {
+		GivenName  string `json:"givenName,omitempty"`
+		FamilyName string `json:"familyName,omitempty"`
+	} `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+	Emails      []struct {
+		Value   string `json:"value"`
+		Type    string `json:"type,omitempty"`
+		Primary bool   `json:"primary,omitempty"`
+	} `json:"emails,omitempty"`
+	Active bool     `json:"active"`
+	Meta   scimMeta `json:"meta"`
+
+	// Deleted marks a user deleted by the identity provider. Deleted users
+	// are kept, so that they may not sign in as users never provisioned,
+	// but are no longer SCIM resources.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// addresses returns the user name and email addresses of a user, in lower
+// case.
+func (u *scimUser) addresses() []string {
+	addresses := []string{strings.ToLower(u.UserName)}
+	for _, e := range u.Emails {
+		addresses = append(addresses, strings.ToLower(e.Value))
+	}
+	return addresses
+}
+
+// scimMember references a member of a SCIM group.
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+// scimGroup is a SCIM 2.0 Group resource.
+type scimGroup struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members,omitempty"`
+	Meta        scimMeta     `json:"meta"`
+}
+
+// userDirectory holds users and groups provisioned by an identity
+// provider via SCIM, persisted to Elasticsearch when configured.
+type userDirectory struct {
+	client *elasticsearch.Client
+	logger *zap.Logger
+	ids    idSource
+
+	mu     sync.RWMutex
+	users  map[string]*scimUser
+	groups map[string]*scimGroup
+
+	// byAddress indexes users by their lower-cased user names and email
+	// addresses.
+	byAddress map[string][]*scimUser
+}
+
+// newUserDirectory creates a new userDirectory instance, loading any
+// existing users and groups from Elasticsearch.
+func newUserDirectory(client *elasticsearch.Client, logger *zap.Logger) (*userDirectory, error) {
+	d := &userDirectory{
+		client:    client,
+		logger:    logger,
+		ids:       cryptoIDs{},
+		users:     make(map[string]*scimUser),
+		groups:    make(map[string]*scimGroup),
+		byAddress: make(map[string][]*scimUser),
+	}
+	if err := d.init(); err != nil {
+		return nil, fmt.Errorf("failed to init user directory: %w", err)
+	}
+	return d, nil
+}
+
+func (d *userDirectory) init() error {
+	if d.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initUserDirectory")
+	defer span.End()
+	logger := d.logger.With(traceLogFields(ctx)...)
+
+	if err := loadAll(ctx, d.client, scimUsersIndex, func(hit loadedHit) error {
+		var user scimUser
+		if err := json.Unmarshal(hit.Source, &user); err != nil {
+			return err
+		}
+		d.users[hit.ID] = &user
+		d.index(nil, &user)
+		return nil
+	}); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	if err := loadAll(ctx, d.client, scimGroupsIndex, func(hit loadedHit) error {
+		var group scimGroup
+		if err := json.Unmarshal(hit.Source, &group); err != nil {
+			return err
+		}
+		d.groups[hit.ID] = &group
+		return nil
+	}); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	logger.Info(
+		"loaded user directory",
+		zap.Int("users", len(d.users)),
+		zap.Int("groups", len(d.groups)),
+	)
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// persist indexes or deletes a document, if Elasticsearch is configured.
+func (d *userDirectory) persist(ctx context.Context, index, id string, doc interface{}) error {
+	if d.client == nil {
+		return nil
+	}
+	if doc == nil {
+		res, err := d.client.Delete(index, id, d.client.Delete.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("while deleting %s/%s: %w", index, id, err)
+		}
+		defer res.Body.Close()
+		if res.IsError() && res.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("deleting %s/%s failed: %s", index, id, res.Status())
+		}
+		return nil
+	}
+	res, err := d.client.Index(
+		index, esutil.NewJSONReader(doc),
+		d.client.Index.WithDocumentID(id),
+		d.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while indexing %s/%s: %w", index, id, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("indexing %s/%s failed: %s", index, id, res.Status())
+	}
+	return nil
+}
+
+// index replaces previous with user in byAddress; either may be nil. It
+// must be called with mu held.
+func (d *userDirectory) index(previous, user *scimUser) {
+	if previous != nil {
+		for _, address := range previous.addresses() {
+			users := slices.DeleteFunc(d.byAddress[address], func(u *scimUser) bool { return u == previous })
+			if len(users) == 0 {
+				delete(d.byAddress, address)
+			} else {
+				d.byAddress[address] = users
+			}
+		}
+	}
+	if user != nil {
+		for _, address := range user.addresses() {
+			if !slices.Contains(d.byAddress[address], user) {
+				d.byAddress[address] = append(d.byAddress[address], user)
+			}
+		}
+	}
+}
+
+// userByEmail returns the provisioned user with the given email address
+// or user name, preferring users not deleted, or nil if there is none.
+func (d *userDirectory) userByEmail(email string) *scimUser {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var deleted *scimUser
+	for _, user := range d.byAddress[strings.ToLower(email)] {
+		if !user.Deleted {
+			return user
+		}
+		deleted = user
+	}
+	return deleted
+}
+
+// wrap returns an ID token parser that additionally rejects users that
+// the identity provider has deactivated or deleted. Users that were never
+// provisioned are accepted, so that SCIM provisioning remains optional.
+func (d *userDirectory) wrap(
+	parseIDToken func(string) (*authDetails, error),
+) func(string) (*authDetails, error) {
+	return func(idToken string) (*authDetails, error) {
+		details, err := parseIDToken(idToken)
+		if err != nil {
+			return nil, err
+		}
+		if user := d.userByEmail(details.email); user != nil && !user.Active {
+			return nil, errUserDeprovisioned
+		}
+		return details, nil
+	}
+}
+
+func (d *userDirectory) listUsers() []*scimUser {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	users := make([]*scimUser, 0, len(d.users))
+	for _, user := range d.users {
+		if !user.Deleted {
+			users = append(users, user)
+		}
+	}
+	// Resources created within the same second are ordered by ID, so
+	// that pages are consistent across requests.
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Meta.Created != users[j].Meta.Created {
+			return users[i].Meta.Created < users[j].Meta.Created
+		}
+		return users[i].ID < users[j].ID
+	})
+	return users
+}
+
+func (d *userDirectory) getUser(id string) (*scimUser, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	user, ok := d.users[id]
+	if !ok || user.Deleted {
+		return nil, errSCIMNotFound
+	}
+	return user, nil
+}
+
+// putUser creates or replaces a user. If user.ID is empty, a new ID is assigned.
+func (d *userDirectory) putUser(ctx context.Context, user *scimUser) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	d.mu.Lock()
+	existing, ok := d.users[user.ID]
+	if user.ID == "" {
+		user.ID = d.ids.NewID()
+		user.Meta.Created = now
+	} else if ok && !existing.Deleted {
+		user.Meta.Created = existing.Meta.Created
+	} else {
+		d.mu.Unlock()
+		return errSCIMNotFound
+	}
+	user.Schemas = []string{scimUserSchema}
+	user.Meta.ResourceType = "User"
+	user.Meta.LastModified = now
+	user.Deleted = false
+	d.users[user.ID] = user
+	d.index(existing, user)
+	d.mu.Unlock()
+	return d.persist(ctx, scimUsersIndex, user.ID, user)
+}
+
+// deleteUser deprovisions a user, removing it from all groups. The user is
+// kept, inactive and marked deleted, so that they may no longer sign in.
+func (d *userDirectory) deleteUser(ctx context.Context, id string) error {
+	d.mu.Lock()
+	existing, ok := d.users[id]
+	if !ok || existing.Deleted {
+		d.mu.Unlock()
+		return errSCIMNotFound
+	}
+	deleted := *existing
+	deleted.Active = false
+	deleted.Deleted = true
+	deleted.Meta.LastModified = time.Now().UTC().Format(time.RFC3339)
+	d.users[id] = &deleted
+	d.index(existing, &deleted)
+	var modified []*scimGroup
+	for groupID, group := range d.groups {
+		members := removeSCIMMembers(append([]scimMember(nil), group.Members...), id)
+		if len(members) != len(group.Members) {
+			updated := *group
+			updated.Members = members
+			d.groups[groupID] = &updated
+			modified = append(modified, &updated)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, group := range modified {
+		if err := d.persist(ctx, scimGroupsIndex, group.ID, group); err != nil {
+			return err
+		}
+	}
+	return d.persist(ctx, scimUsersIndex, id, &deleted)
+}
+
+func (d *userDirectory) listGroups() []*scimGroup {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	groups := make([]*scimGroup, 0, len(d.groups))
+	for _, group := range d.groups {
+		groups = append(groups, group)
+	}
+	// Resources created within the same second are ordered by ID, so
+	// that pages are consistent across requests.
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Meta.Created != groups[j].Meta.Created {
+			return groups[i].Meta.Created < groups[j].Meta.Created
+		}
+		return groups[i].ID < groups[j].ID
+	})
+	return groups
+}
+
+func (d *userDirectory) getGroup(id string) (*scimGroup, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	group, ok := d.groups[id]
+	if !ok {
+		return nil, errSCIMNotFound
+	}
+	return group, nil
+}
+
+// putGroup creates or replaces a group. If group.ID is empty, a new ID is assigned.
+func (d *userDirectory) putGroup(ctx context.Context, group *scimGroup) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	d.mu.Lock()
+	if group.ID == "" {
+		group.ID = d.ids.NewID()
+		group.Meta.Created = now
+	} else if existing, ok := d.groups[group.ID]; ok {
+		group.Meta.Created = existing.Meta.Created
+	} else {
+		d.mu.Unlock()
+		return errSCIMNotFound
+	}
+	group.Schemas = []string{scimGroupSchema}
+	group.Meta.ResourceType = "Group"
+	group.Meta.LastModified = now
+	d.groups[group.ID] = group
+	d.mu.Unlock()
+	return d.persist(ctx, scimGroupsIndex, group.ID, group)
+}
+
+func (d *userDirectory) deleteGroup(ctx context.Context, id string) error {
+	d.mu.Lock()
+	if _, ok := d.groups[id]; !ok {
+		d.mu.Unlock()
+		return errSCIMNotFound
+	}
+	delete(d.groups, id)
+	d.mu.Unlock()
+	return d.persist(ctx, scimGroupsIndex, id, nil)
+}
+
+func removeSCIMMembers(members []scimMember, ids ...string) []scimMember {
+	out := members[:0]
+	for _, m := range members {
+		remove := false
+		for _, id := range ids {
+			if m.Value == id {
+				remove = true
+				break
+			}
+		}
+		if !remove {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// scimPatchRequest is a SCIM PatchOp request body.
+type scimPatchRequest struct {
+	Schemas    []string `json:"schemas"`
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// applyUserPatch applies the subset of PatchOp operations identity
+// providers use for users in practice: replacing "active" (to suspend
+// or reactivate), and replacing simple top-level attributes.
+func applyUserPatch(user *scimUser, patch scimPatchRequest) error {
+	for _, op := range patch.Operations {
+		if !strings.EqualFold(op.Op, "replace") && !strings.EqualFold(op.Op, "add") {
+			return fmt.Errorf("unsupported op %q", op.Op)
+		}
+		values := map[string]json.RawMessage{}
+		if op.Path == "" {
+			if err := json.Unmarshal(op.Value, &values); err != nil {
+				return err
+			}
+		} else {
+			values[op.Path] = op.Value
+		}
+		for path, value := range values {
+			var err error
+			switch path {
+			case "active":
+				err = unmarshalSCIMBool(value, &user.Active)
+			case "userName":
+				err = json.Unmarshal(value, &user.UserName)
+			case "displayName":
+				err = json.Unmarshal(value, &user.DisplayName)
+			case "externalId":
+				err = json.Unmarshal(value, &user.ExternalID)
+			case "name.givenName":
+				err = json.Unmarshal(value, &user.Name.GivenName)
+			case "name.familyName":
+				err = json.Unmarshal(value, &user.Name.FamilyName)
+			default:
+				return fmt.Errorf("unsupported path %q", path)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid value for %q: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalSCIMBool decodes a boolean, also accepting the string form
+// sent by some identity providers (notably Entra ID).
+func unmarshalSCIMBool(data json.RawMessage, out *bool) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*out = b
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// applyGroupPatch applies membership and displayName changes to a group.
+func applyGroupPatch(group *scimGroup, patch scimPatchRequest) error {
+	for _, op := range patch.Operations {
+		switch {
+		case strings.EqualFold(op.Op, "add") && op.Path == "members":
+			var members []scimMember
+			if err := json.Unmarshal(op.Value, &members); err != nil {
+				return err
+			}
+			group.Members = removeSCIMMembers(group.Members, memberIDs(members)...)
+			group.Members = append(group.Members, members...)
+		case strings.EqualFold(op.Op, "remove") && strings.HasPrefix(op.Path, "members"):
+			if op.Path == "members" && len(op.Value) == 0 {
+				group.Members = nil
+				continue
+			}
+			var members []scimMember
+			if len(op.Value) > 0 {
+				if err := json.Unmarshal(op.Value, &members); err != nil {
+					return err
+				}
+			}
+			// Also accept the filter form: members[value eq "id"]
+			if _, filter, ok := strings.Cut(op.Path, "[value eq "); ok {
+				members = append(members, scimMember{Value: strings.Trim(filter, `"]`)})
+			}
+			group.Members = removeSCIMMembers(group.Members, memberIDs(members)...)
+		case strings.EqualFold(op.Op, "replace") && op.Path == "members":
+			var members []scimMember
+			if err := json.Unmarshal(op.Value, &members); err != nil {
+				return err
+			}
+			group.Members = members
+		case strings.EqualFold(op.Op, "replace") && (op.Path == "displayName" || op.Path == ""):
+			if op.Path == "" {
+				var values struct {
+					DisplayName string `json:"displayName"`
+				}
+				if err := json.Unmarshal(op.Value, &values); err != nil {
+					return err
+				}
+				group.DisplayName = values.DisplayName
+			} else if err := json.Unmarshal(op.Value, &group.DisplayName); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported operation %q on %q", op.Op, op.Path)
+		}
+	}
+	return nil
+}
+
+func memberIDs(members []scimMember) []string {
+	ids := make([]string, len(members))
+	for i, m := range members {
+		ids[i] = m.Value
+	}
+	return ids
+}
+
+// scimAuthMiddleware guards SCIM endpoints with a static bearer token.
+// If no token is configured, SCIM is disabled and all requests are rejected.
+func scimAuthMiddleware(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := splitAuthHeader(r.Header.Get("Authorization"))
+		if token == "" || len(fields) != 2 || fields[0] != "Bearer" ||
+			subtle.ConstantTimeCompare([]byte(fields[1]), []byte(token)) != 1 {
+			writeSCIMError(w, http.StatusUnauthorized, "invalid bearer token")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeSCIMError(w http.ResponseWriter, status int, detail string) {
+	writeSCIM(w, status, struct {
+		Schemas []string `json:"schemas"`
+		Status  string   `json:"status"`
+		Detail  string   `json:"detail"`
+	}{[]string{scimErrorSchema}, strconv.Itoa(status), detail})
+}
+
+func writeSCIMStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errSCIMNotFound) {
+		writeSCIMError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeSCIMError(w, http.StatusInternalServerError, err.Error())
+}
+
+// writeSCIMList writes a ListResponse, applying SCIM's 1-based
+// startIndex and count pagination parameters.
+func writeSCIMList[T any](w http.ResponseWriter, r *http.Request, resources []T) {
+	startIndex, _ := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	total := len(resources)
+	if startIndex > total {
+		resources = resources[:0]
+	} else {
+		resources = resources[startIndex-1:]
+	}
+	if count, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && count >= 0 && count < len(resources) {
+		resources = resources[:count]
+	}
+	writeSCIM(w, http.StatusOK, struct {
+		Schemas      []string `json:"schemas"`
+		TotalResults int      `json:"totalResults"`
+		StartIndex   int      `json:"startIndex"`
+		ItemsPerPage int      `json:"itemsPerPage"`
+		Resources    []T      `json:"Resources"`
+	}{[]string{scimListSchema}, total, startIndex, len(resources), resources})
+}
+
+// parseSCIMEqFilter parses the only filter form identity providers
+// commonly send: `<attribute> eq "<value>"`.
+func parseSCIMEqFilter(filter string) (attr, value string, ok bool) {
+	attr, value, ok = strings.Cut(filter, " eq ")
+	if !ok {
+		return "", "", false
+	}
+	return strings.TrimSpace(attr), strings.Trim(strings.TrimSpace(value), `"`), true
+}
+
+func decodeSCIMBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v)
+}
+
+// registerSCIMRoutes registers the SCIM 2.0 Users and Groups endpoints.
+func registerSCIMRoutes(routes *routeRegistry, directory *userDirectory) {
+	handle := routes.group(groupSCIM).handle
+
+	handle(http.MethodGet, "/scim/v2/Users", func(w http.ResponseWriter, r *http.Request) {
+		users := directory.listUsers()
+		if attr, value, ok := parseSCIMEqFilter(r.URL.Query().Get("filter")); ok {
+			filtered := users[:0]
+			for _, user := range users {
+				if (attr == "userName" && strings.EqualFold(user.UserName, value)) ||
+					(attr == "externalId" && user.ExternalID == value) {
+					filtered = append(filtered, user)
+				}
+			}
+			users = filtered
+		}
+		writeSCIMList(w, r, users)
+	})
+	handle(http.MethodGet, "/scim/v2/Users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user, err := directory.getUser(r.PathValue("id"))
+		if err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		writeSCIM(w, http.StatusOK, user)
+	})
+	handle(http.MethodPost, "/scim/v2/Users", func(w http.ResponseWriter, r *http.Request) {
+		var user scimUser
+		if err := decodeSCIMBody(w, r, &user); err != nil || user.UserName == "" {
+			writeSCIMError(w, http.StatusBadRequest, "invalid user")
+			return
+		}
+		if existing := directory.userByEmail(user.UserName); existing != nil && !existing.Deleted {
+			writeSCIMError(w, http.StatusConflict, "userName already exists")
+			return
+		}
+		user.ID = ""
+		if err := directory.putUser(r.Context(), &user); err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		writeSCIM(w, http.StatusCreated, user)
+	})
+	handle(http.MethodPut, "/scim/v2/Users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var user scimUser
+		if err := decodeSCIMBody(w, r, &user); err != nil || user.UserName == "" {
+			writeSCIMError(w, http.StatusBadRequest, "invalid user")
+			return
+		}
+		user.ID = r.PathValue("id")
+		if err := directory.putUser(r.Context(), &user); err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		writeSCIM(w, http.StatusOK, user)
+	})
+	handle(http.MethodPatch, "/scim/v2/Users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var patch scimPatchRequest
+		if err := decodeSCIMBody(w, r, &patch); err != nil {
+			writeSCIMError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		existing, err := directory.getUser(r.PathValue("id"))
+		if err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		user := *existing
+		if err := applyUserPatch(&user, patch); err != nil {
+			writeSCIMError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := directory.putUser(r.Context(), &user); err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		writeSCIM(w, http.StatusOK, &user)
+	})
+	handle(http.MethodDelete, "/scim/v2/Users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := directory.deleteUser(r.Context(), r.PathValue("id")); err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	handle(http.MethodGet, "/scim/v2/Groups", func(w http.ResponseWriter, r *http.Request) {
+		groups := directory.listGroups()
+		if attr, value, ok := parseSCIMEqFilter(r.URL.Query().Get("filter")); ok && attr == "displayName" {
+			filtered := groups[:0]
+			for _, group := range groups {
+				if group.DisplayName == value {
+					filtered = append(filtered, group)
+				}
+			}
+			groups = filtered
+		}
+		writeSCIMList(w, r, groups)
+	})
+	handle(http.MethodGet, "/scim/v2/Groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		group, err := directory.getGroup(r.PathValue("id"))
+		if err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		writeSCIM(w, http.StatusOK, group)
+	})
+	handle(http.MethodPost, "/scim/v2/Groups", func(w http.ResponseWriter, r *http.Request) {
+		var group scimGroup
+		if err := decodeSCIMBody(w, r, &group); err != nil || group.DisplayName == "" {
+			writeSCIMError(w, http.StatusBadRequest, "invalid group")
+			return
+		}
+		group.ID = ""
+		if err := directory.putGroup(r.Context(), &group); err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		writeSCIM(w, http.StatusCreated, group)
+	})
+	handle(http.MethodPut, "/scim/v2/Groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var group scimGroup
+		if err := decodeSCIMBody(w, r, &group); err != nil || group.DisplayName == "" {
+			writeSCIMError(w, http.StatusBadRequest, "invalid group")
+			return
+		}
+		group.ID = r.PathValue("id")
+		if err := directory.putGroup(r.Context(), &group); err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		writeSCIM(w, http.StatusOK, group)
+	})
+	handle(http.MethodPatch, "/scim/v2/Groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var patch scimPatchRequest
+		if err := decodeSCIMBody(w, r, &patch); err != nil {
+			writeSCIMError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		existing, err := directory.getGroup(r.PathValue("id"))
+		if err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		group := *existing
+		group.Members = append([]scimMember(nil), existing.Members...)
+		if err := applyGroupPatch(&group, patch); err != nil {
+			writeSCIMError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := directory.putGroup(r.Context(), &group); err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		writeSCIM(w, http.StatusOK, &group)
+	})
+	handle(http.MethodDelete, "/scim/v2/Groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := directory.deleteGroup(r.Context(), r.PathValue("id")); err != nil {
+			writeSCIMStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultSearchSize    = 5
+	maxSearchSize        = 20
+	maxSearchQueryLength = 200
+
+	// searchFragmentLength is the length, in characters, beyond which
+	// highlighted field values are cut down to the text around the first
+	// match.
+	searchFragmentLength = 150
+
+	// directoryRole lets users find other users in global search.
+	directoryRole = "directory"
+)
+
+// searchField is a searchable field of a document. Matches in fields of
+// greater weight rank higher.
+type searchField struct {
+	Name   string
+	Value  string
+	Weight int
+}
+
+// searchDocument is a document of an entity type, as searched by
+// /api/search.
+type searchDocument struct {
+	ID       string
+	Title    string
+	RecordID string
+	Fields   []searchField
+}
+
+// searchSource provides the documents of an entity type, each searched
+// into a result bucket of its own, named by Type.
+type searchSource struct {
+	Type string
+
+	// Documents returns the documents the user may see, and false if the
+	// user may not search the entity type at all.
+	Documents func(auth *authDetails) ([]searchDocument, bool)
+}
+
+// searchHit is a document matching a search. Highlight maps the names of
+// matching fields to HTML-escaped fragments of their values, with matches
+// wrapped in <mark> elements, as Elasticsearch's highlighter does.
+type searchHit struct {
+	ID        string              `json:"id"`
+	Title     string              `json:"title"`
+	RecordID  string              `json:"record_id,omitempty"`
+	Highlight map[string][]string `json:"highlight"`
+
+	score int
+}
+
+// searchBucket holds the best hits of an entity type, and the total
+// number of matching documents.
+type searchBucket struct {
+	Total int         `json:"total"`
+	Hits  []searchHit `json:"hits"`
+}
+
+// searchTerms splits a query into its terms, which documents must all
+// match, ignoring case.
+func searchTerms(q string) []string {
+	var terms []string
+	for _, term := range strings.Fields(q) {
+		if !slices.ContainsFunc(terms, func(t string) bool { return strings.EqualFold(t, term) }) {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// foldIndex returns the byte index of the first match of term in s at or
+// after from, ignoring case, or -1.
+func foldIndex(s, term string, from int) int {
+	for i := from; i+len(term) <= len(s); i++ {
+		if utf8.RuneStart(s[i]) && strings.EqualFold(s[i:i+len(term)], term) {
+			return i
+		}
+	}
+	return -1
+}
+
+// match returns the hit of doc for terms, and false if it does not match
+// all of them.
+func (doc *searchDocument) match(terms []string) (searchHit, bool) {
+	hit := searchHit{ID: doc.ID, Title: doc.Title, RecordID: doc.RecordID, Highlight: map[string][]string{}}
+	for _, term := range terms {
+		best := 0
+		for _, field := range doc.Fields {
+			if field.Weight > best && foldIndex(field.Value, term, 0) >= 0 {
+				best = field.Weight
+			}
+		}
+		if best == 0 {
+			return searchHit{}, false
+		}
+		hit.score += best
+	}
+	for _, field := range doc.Fields {
+		if fragment, ok := highlight(field.Value, terms); ok {
+			hit.Highlight[field.Name] = []string{fragment}
+		}
+	}
+	return hit, true
+}
+
+// highlight returns the HTML-escaped fragment of value around the first
+// match of terms, with matches wrapped in <mark> elements, and false if
+// no term matches.
+func highlight(value string, terms []string) (string, bool) {
+	type span struct{ start, end int }
+	var spans []span
+	for _, term := range terms {
+		for i := foldIndex(value, term, 0); i >= 0; i = foldIndex(value, term, i+len(term)) {
+			spans = append(spans, span{i, i + len(term)})
+		}
+	}
+	if len(spans) == 0 {
+		return "", false
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	start, end := 0, len(value)
+	if utf8.RuneCountInString(value) > searchFragmentLength {
+		// Start a little before the first match, at a rune boundary.
+		start = spans[0].start
+		for n := 0; start > 0 && n < searchFragmentLength/3; n++ {
+			_, size := utf8.DecodeLastRuneInString(value[:start])
+			start -= size
+		}
+		end = start
+		for n := 0; end < len(value) && n < searchFragmentLength; n++ {
+			_, size := utf8.DecodeRuneInString(value[end:])
+			end += size
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, s := range spans {
+		if s.start < pos || s.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(value[pos:s.start]))
+		b.WriteString("<mark>" + html.EscapeString(value[s.start:s.end]) + "</mark>")
+		pos = s.end
+	}
+	b.WriteString(html.EscapeString(value[pos:end]))
+	if end < len(value) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+// search returns the size best hits of docs for terms, and the total
+// number of matches.
+func search(docs []searchDocument, terms []string, size int) searchBucket {
+	hits := []searchHit{}
+	for i := range docs {
+		if hit, ok := docs[i].match(terms); ok {
+			hits = append(hits, hit)
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	bucket := searchBucket{Total: len(hits), Hits: hits}
+	if len(hits) > size {
+		bucket.Hits = hits[:size]
+	}
+	return bucket
+}
+
+// recordSearchSource searches the records the user may read.
+func recordSearchSource(records recordSource) searchSource {
+	return searchSource{
+		Type: "records",
+		Documents: func(auth *authDetails) ([]searchDocument, bool) {
+			var docs []searchDocument
+			for _, record := range records(auth.userID, recordSearch{Roles: auth.roles}) {
+				docs = append(docs, searchDocument{
+					ID:    record.ID,
+					Title: record.Name,
+					Fields: []searchField{
+						{"id", record.ID, 3},
+						{"name", record.Name, 3},
+						{"tags", strings.Join(record.Tags, ", "), 2},
+						{"description", record.Description, 1},
+						{"category", record.Category, 1},
+						{"status", record.Status, 1},
+						{"assignee", record.Assignee, 1},
+					},
+				})
+			}
+			return docs, true
+		},
+	}
+}
+
+// commentSearchSource searches comments which have not been deleted, on
+// records the user may read.
+func commentSearchSource(comments *commentStore, shares *shareStore) searchSource {
+	return searchSource{
+		Type: "comments",
+		Documents: func(auth *authDetails) ([]searchDocument, bool) {
+			accessor := shares.accessor(auth.userID, auth.roles)
+			comments.mu.RLock()
+			defer comments.mu.RUnlock()
+			var docs []searchDocument
+			for _, recordComments := range comments.comments {
+				for _, c := range recordComments {
+					if c.DeletedAt != nil || shares.access(c.RecordID, accessor) == accessNone {
+						continue
+					}
+					docs = append(docs, searchDocument{
+						ID:       c.ID,
+						Title:    "Comment by " + c.AuthorName,
+						RecordID: c.RecordID,
+						Fields: []searchField{
+							{"body", c.Body, 1},
+							{"author_name", c.AuthorName, 1},
+						},
+					})
+				}
+			}
+			return docs, true
+		},
+	}
+}
+
+// userSearchSource searches users by their email addresses, which only
+// users with the directory role may do.
+func userSearchSource(identities *identityStore) searchSource {
+	return searchSource{
+		Type: "users",
+		Documents: func(auth *authDetails) ([]searchDocument, bool) {
+			if !auth.hasRole(directoryRole) {
+				return nil, false
+			}
+			identities.mu.RLock()
+			defer identities.mu.RUnlock()
+			emails := map[string][]string{}
+			for _, id := range identities.identities {
+				if id.Email != "" && !slices.Contains(emails[id.UserID], id.Email) {
+					emails[id.UserID] = append(emails[id.UserID], id.Email)
+				}
+			}
+			var docs []searchDocument
+			for userID, addresses := range emails {
+				sort.Strings(addresses)
+				docs = append(docs, searchDocument{
+					ID:    userID,
+					Title: addresses[0],
+					Fields: []searchField{
+						{"email", strings.Join(addresses, ", "), 2},
+						{"user_id", userID, 1},
+					},
+				})
+			}
+			return docs, true
+		},
+	}
+}
+
+// registerSearchRoutes registers the global search endpoint, searching
+// each source into a bucket of its own.
+func registerSearchRoutes(routes *routeRegistry, sources ...searchSource) {
+	user := routes.group(groupUser)
+
+	user.GET("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		q := strings.TrimSpace(query.Get("q"))
+		if q == "" || utf8.RuneCountInString(q) > maxSearchQueryLength {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("q must be 1 to %d characters", maxSearchQueryLength))
+			return
+		}
+		size := defaultSearchSize
+		if param := query.Get("size"); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 1 || n > maxSearchSize {
+				writeError(w, r, http.StatusBadRequest, "size must be between 1 and "+strconv.Itoa(maxSearchSize))
+				return
+			}
+			size = n
+		}
+		var types []string
+		if param := query.Get("types"); param != "" {
+			for _, t := range strings.Split(param, ",") {
+				t = strings.TrimSpace(t)
+				if !slices.ContainsFunc(sources, func(s searchSource) bool { return s.Type == t }) {
+					writeError(w, r, http.StatusBadRequest, fmt.Sprintf("unknown type %q", t))
+					return
+				}
+				types = append(types, t)
+			}
+		}
+
+		auth := authFromContext(r.Context())
+		terms := searchTerms(q)
+		buckets := map[string]searchBucket{}
+		for _, source := range sources {
+			if types != nil && !slices.Contains(types, source.Type) {
+				continue
+			}
+			docs, ok := source.Documents(auth)
+			if !ok {
+				continue
+			}
+			buckets[source.Type] = search(docs, terms, size)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Query   string                  `json:"query"`
+			Buckets map[string]searchBucket `json:"buckets"`
+		}{q, buckets})
+	})
+}
@@ -2,47 +2,100 @@ package main
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/gorilla/securecookie"
 )
 
+// errEmptyCookieValue is returned when encoding an empty value, which
+// securecookie would encrypt to a ciphertext it cannot decrypt.
+var errEmptyCookieValue = errors.New("cannot encode an empty cookie value")
+
 // secureCookies provides a means of encoding and decoding secure cookie
 // string values, by applying AES encryption and HMAC. If secureCookies
-// is empty, encoding and decoding are no-ops, returning the input unchanged.
-type secureCookies []securecookie.Codec
+// has no keys, encoding and decoding are no-ops, returning the input
+// unchanged. Copies share their keys, which may be replaced at runtime by
+// key rotation.
+type secureCookies struct {
+	state *atomic.Pointer[cookieKeys]
+}
+
+// cookieKeys holds encryption keys, primary first, and their codecs.
+type cookieKeys struct {
+	keys   []string
+	codecs []securecookie.Codec
+}
 
 func newSecureCookies(encryptionKeys []string) (secureCookies, error) {
-	secureCookies := make(secureCookies, len(encryptionKeys))
+	s := secureCookies{state: new(atomic.Pointer[cookieKeys])}
+	if err := s.setKeys(encryptionKeys); err != nil {
+		return secureCookies{}, err
+	}
+	return s, nil
+}
+
+// setKeys replaces the encryption keys. The first is used for encoding new
+// values, while any may be used for decoding.
+func (s secureCookies) setKeys(encryptionKeys []string) error {
+	codecs := make([]securecookie.Codec, len(encryptionKeys))
 	for i, encodedKey := range encryptionKeys {
 		decodedKey, err := base64.StdEncoding.DecodeString(encodedKey)
 		if err != nil {
-			return nil, fmt.Errorf("failed to base64-decode encryption key: %w", err)
+			return fmt.Errorf("failed to base64-decode encryption key: %w", err)
 		}
 		if n := len(decodedKey); n != 32 && n != 64 {
-			return nil, fmt.Errorf("expected encryption key 32 or 64 bytes, got %d", n)
+			return fmt.Errorf("expected encryption key 32 or 64 bytes, got %d", n)
 		}
 		hashKey := decodedKey
 		blockKey := decodedKey[:32] // 32-byte key for AES-256
 		sc := securecookie.New(hashKey, blockKey)
 		sc.SetSerializer(securecookie.NopEncoder{})
-		secureCookies[i] = sc
+		codecs[i] = sc
+	}
+	s.state.Store(&cookieKeys{keys: append([]string(nil), encryptionKeys...), codecs: codecs})
+	return nil
+}
+
+// keys returns the encryption keys, primary first.
+func (s secureCookies) keys() []string {
+	if s.state == nil {
+		return nil
+	}
+	if current := s.state.Load(); current != nil {
+		return current.keys
+	}
+	return nil
+}
+
+func (s secureCookies) codecs() []securecookie.Codec {
+	if s.state == nil {
+		return nil
 	}
-	return secureCookies, nil
+	if current := s.state.Load(); current != nil {
+		return current.codecs
+	}
+	return nil
 }
 
 func (s secureCookies) Encode(value string) (string, error) {
-	if len(s) == 0 {
+	codecs := s.codecs()
+	if len(codecs) == 0 {
 		return value, nil
 	}
-	return securecookie.EncodeMulti("", []byte(value), s...)
+	if value == "" {
+		return "", errEmptyCookieValue
+	}
+	return securecookie.EncodeMulti("", []byte(value), codecs...)
 }
 
 func (s secureCookies) Decode(value string) (string, error) {
-	if len(s) == 0 {
+	codecs := s.codecs()
+	if len(codecs) == 0 {
 		return value, nil
 	}
 	var out []byte
-	err := securecookie.DecodeMulti("", value, &out, s...)
+	err := securecookie.DecodeMulti("", value, &out, codecs...)
 	return string(out), err
 }
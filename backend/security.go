@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"github.com/golang-jwt/jwt/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	securityEventsIndex = "app-security-events"
+
+	// securityEventRetention is how long events are kept in memory
+	// for summaries when Elasticsearch is not configured.
+	securityEventRetention = 7 * 24 * time.Hour
+
+	// maxSecurityEvents bounds the number of events kept in memory,
+	// so that a flood of failed attempts cannot exhaust memory.
+	maxSecurityEvents = 100000
+)
+
+// Security event kinds.
+const (
+	securityEventSignIn       = "sign_in"
+	securityEventAuth         = "authentication"
+	securityEventOAuthState   = "oauth_state"
+	securityEventMFA          = "mfa"
+	securityEventPasskeyLogin = "passkey_login"
+
+	securityEventMicrosoftLogin = "microsoft_login"
+	securityEventAppleLogin     = "apple_login"
+	securityEventOIDCLogin      = "oidc_login"
+	securityEventAccountLink    = "account_link"
+	securityEventGuestSession   = "guest_session"
+)
+
+// Security event reasons, describing the outcome.
+const (
+	reasonSuccess              = "success"
+	reasonInvalidHeader        = "invalid_header"
+	reasonCookieMissing        = "cookie_missing"
+	reasonCookieDecodeError    = "cookie_decode_error"
+	reasonTokenExpired         = "token_expired"
+	reasonTokenInvalid         = "token_invalid"
+	reasonAudienceInvalid      = "audience_invalid"
+	reasonIssuerInvalid        = "issuer_invalid"
+	reasonTenantNotAllowed     = "tenant_not_allowed"
+	reasonSessionRevoked       = "session_revoked"
+	reasonUserDeprovisioned    = "user_deprovisioned"
+	reasonStateInvalid         = "state_invalid"
+	reasonInvalidCode          = "invalid_code"
+	reasonLockedOut            = "locked_out"
+	reasonAssertionFailed      = "assertion_failed"
+	reasonPasswordlessDisabled = "passwordless_disabled"
+	reasonLinkRequired         = "link_required"
+	reasonLinkInvalid          = "link_invalid"
+	reasonGuestForbidden       = "guest_forbidden"
+	reasonBindingMismatch      = "binding_mismatch"
+)
+
+// tokenFailureReason categorizes an ID token validation error.
+func tokenFailureReason(err error) string {
+	var validationErr *jwt.ValidationError
+	switch {
+	case errors.Is(err, errSessionRevoked):
+		return reasonSessionRevoked
+	case errors.Is(err, errUserDeprovisioned):
+		return reasonUserDeprovisioned
+	case errors.Is(err, errAudienceInvalid):
+		return reasonAudienceInvalid
+	case errors.Is(err, errIssuerInvalid):
+		return reasonIssuerInvalid
+	case errors.Is(err, errTenantNotAllowed):
+		return reasonTenantNotAllowed
+	case errors.Is(err, errPasswordlessDisabled):
+		return reasonPasswordlessDisabled
+	case errors.As(err, &validationErr) && validationErr.Errors&jwt.ValidationErrorExpired != 0:
+		return reasonTokenExpired
+	default:
+		return reasonTokenInvalid
+	}
+}
+
+// securityEvent is a single authentication-related event, as indexed
+// into Elasticsearch.
+type securityEvent struct {
+	Timestamp time.Time `json:"@timestamp"`
+	Kind      string    `json:"event.kind"`
+	Reason    string    `json:"event.reason"`
+	Outcome   string    `json:"event.outcome"`
+	UserID    string    `json:"user.id,omitempty"`
+	ClientIP  string    `json:"client.ip,omitempty"`
+	UserAgent string    `json:"user_agent.original,omitempty"`
+	TraceID   string    `json:"trace.id,omitempty"`
+}
+
+// securityEvents records authentication-related events as metrics,
+// in memory for summaries, and in Elasticsearch when configured.
+type securityEvents struct {
+	client  *elasticsearch.Client
+	logger  *zap.Logger
+	counter metric.Int64Counter
+
+	// reads coalesces identical concurrent summary queries.
+	reads *readCoalescer
+
+	mu     sync.Mutex
+	events []securityEvent
+
+	pending pendingWrites
+}
+
+func newSecurityEvents(client *elasticsearch.Client, logger *zap.Logger) (*securityEvents, error) {
+	counter, err := otel.Meter("main").Int64Counter(
+		"app.security.events",
+		metric.WithDescription("Authentication-related events by kind and reason"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &securityEvents{client: client, logger: logger, counter: counter}, nil
+}
+
+// record records a security event for the given request, also as an
+// event of the request's span, so that failures can be told apart in
+// traces. Indexing into Elasticsearch happens in the background, so as not
+// to delay responses.
+func (s *securityEvents) record(r *http.Request, kind, reason, userID string) {
+	ctx := r.Context()
+	outcome := "failure"
+	if reason == reasonSuccess {
+		outcome = "success"
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("event.kind", kind),
+		attribute.String("event.reason", reason),
+		attribute.String("event.outcome", outcome),
+	}
+	s.counter.Add(ctx, 1, metric.WithAttributes(attrs...))
+	if span := trace.SpanFromContext(ctx); span.IsRecording() {
+		span.AddEvent("security."+kind, trace.WithAttributes(attrs...))
+		if outcome == "failure" {
+			span.SetAttributes(attribute.String("app.security.failure_reason", reason))
+		}
+	}
+
+	event := securityEvent{
+		Timestamp: time.Now().UTC(),
+		Kind:      kind,
+		Reason:    reason,
+		Outcome:   outcome,
+		UserID:    userID,
+		ClientIP:  clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if fields := traceLogFields(ctx); len(fields) > 0 {
+		event.TraceID = fields[0].String
+	}
+
+	s.mu.Lock()
+	cutoff := event.Timestamp.Add(-securityEventRetention)
+	i := sort.Search(len(s.events), func(i int) bool { return s.events[i].Timestamp.After(cutoff) })
+	if n := len(s.events) - i; n >= maxSecurityEvents {
+		i += n - maxSecurityEvents + 1
+	}
+	s.events = append(s.events[i:], event)
+	s.mu.Unlock()
+
+	if s.client != nil {
+		s.pending.run(func() { s.index(event) })
+	}
+}
+
+// flush waits for events being indexed.
+func (s *securityEvents) flush(ctx context.Context) error {
+	if err := s.pending.wait(ctx); err != nil {
+		return fmt.Errorf("while flushing security events: %w", err)
+	}
+	return nil
+}
+
+func (s *securityEvents) index(event securityEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := s.client.Index(
+		securityEventsIndex, esutil.NewJSONReader(event),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		s.logger.Warn("failed to index security event", zap.Error(err))
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		s.logger.Warn("failed to index security event", zap.String("status", res.Status()))
+	}
+}
+
+// securitySummary holds event counts by kind and reason, over time.
+type securitySummary struct {
+	From     time.Time                   `json:"from"`
+	To       time.Time                   `json:"to"`
+	Interval string                      `json:"interval"`
+	Totals   map[string]map[string]int64 `json:"totals"`
+	Buckets  []securitySummaryBucket     `json:"buckets"`
+	byStart  map[int64]*securitySummaryBucket
+}
+
+type securitySummaryBucket struct {
+	Start  time.Time                   `json:"start"`
+	Counts map[string]map[string]int64 `json:"counts"`
+}
+
+func newSecuritySummary(from, to time.Time, interval time.Duration) *securitySummary {
+	summary := &securitySummary{
+		From:     from,
+		To:       to,
+		Interval: interval.String(),
+		Totals:   make(map[string]map[string]int64),
+		Buckets:  []securitySummaryBucket{},
+		byStart:  make(map[int64]*securitySummaryBucket),
+	}
+	for start := from.Truncate(interval); start.Before(to); start = start.Add(interval) {
+		summary.Buckets = append(summary.Buckets, securitySummaryBucket{
+			Start:  start,
+			Counts: make(map[string]map[string]int64),
+		})
+	}
+	for i := range summary.Buckets {
+		summary.byStart[summary.Buckets[i].Start.Unix()] = &summary.Buckets[i]
+	}
+	return summary
+}
+
+func (s *securitySummary) add(start time.Time, kind, reason string, n int64) {
+	if s.Totals[kind] == nil {
+		s.Totals[kind] = make(map[string]int64)
+	}
+	s.Totals[kind][reason] += n
+	if bucket := s.byStart[start.Unix()]; bucket != nil {
+		if bucket.Counts[kind] == nil {
+			bucket.Counts[kind] = make(map[string]int64)
+		}
+		bucket.Counts[kind][reason] += n
+	}
+}
+
+// summary returns event counts over the given window, bucketed by
+// interval. Counts come from Elasticsearch if configured, so that they
+// cover all replicas; otherwise from this process's memory.
+func (s *securityEvents) summary(ctx context.Context, window, interval time.Duration) (*securitySummary, error) {
+	to := time.Now().UTC()
+	from := to.Add(-window)
+	summary := newSecuritySummary(from, to, interval)
+	if s.client != nil {
+		key := fmt.Sprintf("%s/%s", window, interval)
+		return coalesce(ctx, s.reads, "security.summary", key, func(ctx context.Context) (*securitySummary, error) {
+			return summary, s.summaryFromES(ctx, summary, interval)
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, event := range s.events {
+		if event.Timestamp.Before(from) {
+			continue
+		}
+		summary.add(event.Timestamp.Truncate(interval), event.Kind, event.Reason, 1)
+	}
+	return summary, nil
+}
+
+func (s *securityEvents) summaryFromES(ctx context.Context, summary *securitySummary, interval time.Duration) error {
+	query := map[string]interface{}{
+		"size": 0,
+		"query": map[string]interface{}{
+			"range": map[string]interface{}{
+				"@timestamp": map[string]interface{}{
+					"gte": summary.From.Format(time.RFC3339),
+					"lte": summary.To.Format(time.RFC3339),
+				},
+			},
+		},
+		"aggs": map[string]interface{}{
+			"over_time": map[string]interface{}{
+				"date_histogram": map[string]interface{}{
+					"field":          "@timestamp",
+					"fixed_interval": fmt.Sprintf("%ds", int64(interval.Seconds())),
+				},
+				"aggs": map[string]interface{}{
+					"kind": map[string]interface{}{
+						"terms": map[string]interface{}{"field": "event.kind"},
+						"aggs": map[string]interface{}{
+							"reason": map[string]interface{}{
+								"terms": map[string]interface{}{"field": "event.reason"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(securityEventsIndex),
+		s.client.Search.WithBody(esutil.NewJSONReader(query)),
+		s.client.Search.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return errors.New("security event search failed: " + res.Status())
+	}
+
+	type termsBucket struct {
+		Key      string `json:"key"`
+		DocCount int64  `json:"doc_count"`
+	}
+	var result struct {
+		Aggregations struct {
+			OverTime struct {
+				Buckets []struct {
+					Key  int64 `json:"key"`
+					Kind struct {
+						Buckets []struct {
+							termsBucket
+							Reason struct {
+								Buckets []termsBucket `json:"buckets"`
+							} `json:"reason"`
+						} `json:"buckets"`
+					} `json:"kind"`
+				} `json:"buckets"`
+			} `json:"over_time"`
+		} `json:"aggregations"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return err
+	}
+	for _, timeBucket := range result.Aggregations.OverTime.Buckets {
+		start := time.UnixMilli(timeBucket.Key).UTC()
+		for _, kind := range timeBucket.Kind.Buckets {
+			for _, reason := range kind.Reason.Buckets {
+				summary.add(start, kind.Key, reason.Key, reason.DocCount)
+			}
+		}
+	}
+	return nil
+}
+
+// securitySummaryHandler serves GET /api/admin/security/summary, accepting
+// optional "window" (default 24h) and "interval" (default 1h) durations.
+func securitySummaryHandler(events *securityEvents) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		window, interval := 24*time.Hour, time.Hour
+		if v := r.URL.Query().Get("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 || d > securityEventRetention {
+				writeError(w, r, http.StatusBadRequest, "invalid window")
+				return
+			}
+			window = d
+		}
+		if v := r.URL.Query().Get("interval"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Minute || window/d > 1000 {
+				writeError(w, r, http.StatusBadRequest, "invalid interval")
+				return
+			}
+			interval = d
+		}
+		summary, err := events.summary(r.Context(), window, interval)
+		if err != nil {
+			writeError(w, r, http.StatusBadGateway, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	}
+}
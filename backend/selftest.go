@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/oauth2"
+)
+
+const (
+	selfTestIndex   = "app-selftest"
+	selfTestTimeout = 30 * time.Second
+
+	selfTestPass = "pass"
+	selfTestFail = "fail"
+	selfTestSkip = "skip"
+)
+
+// errSelfTestSkipped is returned by self-test steps which cannot run in
+// the current configuration.
+var errSelfTestSkipped = errors.New("skipped")
+
+// selfTestStep is the result of a single self-test step.
+type selfTestStep struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// selfTestReport is the result of a self-test run.
+type selfTestReport struct {
+	Status     string         `json:"status"`
+	DurationMS float64        `json:"duration_ms"`
+	Steps      []selfTestStep `json:"steps"`
+}
+
+// selfTest exercises the backend's dependencies end to end.
+type selfTest struct {
+	secureCookies secureCookies
+	client        *elasticsearch.Client
+	exports       *spanExports
+	tokenURL      string
+}
+
+// run runs all steps, in order, returning a report.
+func (s *selfTest) run(ctx context.Context) *selfTestReport {
+	ctx, span := otel.Tracer("main").Start(ctx, "selftest")
+	defer span.End()
+
+	steps := []struct {
+		name string
+		run  func(context.Context) error
+	}{
+		{"secure_cookies", s.checkSecureCookies},
+		{"elasticsearch", s.checkElasticsearch},
+		{"trace_export", s.checkTraceExport},
+		{"token_refresh", s.checkTokenRefresh},
+	}
+	report := &selfTestReport{Status: selfTestPass, Steps: []selfTestStep{}}
+	start := time.Now()
+	for _, step := range steps {
+		stepStart := time.Now()
+		err := step.run(ctx)
+		result := selfTestStep{
+			Name:       step.name,
+			Status:     selfTestPass,
+			DurationMS: float64(time.Since(stepStart).Microseconds()) / 1000,
+		}
+		switch {
+		case errors.Is(err, errSelfTestSkipped):
+			result.Status = selfTestSkip
+			result.Error = err.Error()
+		case err != nil:
+			result.Status = selfTestFail
+			result.Error = err.Error()
+			report.Status = selfTestFail
+		}
+		report.Steps = append(report.Steps, result)
+	}
+	report.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+	return report
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkSecureCookies round-trips a random value through the cookie codecs.
+func (s *selfTest) checkSecureCookies(ctx context.Context) error {
+	value, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	encoded, err := s.secureCookies.Encode(value)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	decoded, err := s.secureCookies.Decode(encoded)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	if decoded != value {
+		return errors.New("decoded value does not match")
+	}
+	return nil
+}
+
+// checkElasticsearch writes, reads back, and deletes a document.
+func (s *selfTest) checkElasticsearch(ctx context.Context) error {
+	if s.client == nil {
+		return fmt.Errorf("elasticsearch not configured: %w", errSelfTestSkipped)
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	value, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.client.Index(
+		selfTestIndex, esutil.NewJSONReader(map[string]string{"value": value}),
+		s.client.Index.WithDocumentID(id),
+		s.client.Index.WithRefresh("true"),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("write failed: %s", res.Status())
+	}
+
+	res, err = s.client.Get(selfTestIndex, id, s.client.Get.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	var doc struct {
+		Source struct {
+			Value string `json:"value"`
+		} `json:"_source"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&doc)
+	res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("read failed: %s", res.Status())
+	}
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if doc.Source.Value != value {
+		return errors.New("read value does not match")
+	}
+
+	res, err = s.client.Delete(selfTestIndex, id, s.client.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("delete failed: %s", res.Status())
+	}
+	return nil
+}
+
+// checkTraceExport emits a span and waits for the exporter to confirm
+// it was exported.
+func (s *selfTest) checkTraceExport(ctx context.Context) error {
+	if s.exports == nil {
+		return fmt.Errorf("tracing not configured: %w", errSelfTestSkipped)
+	}
+	_, span := otel.Tracer("main").Start(ctx, "selftest.span")
+	wait := s.exports.watch(span.SpanContext().SpanID())
+	span.End()
+	if err := wait(ctx); err != nil {
+		return fmt.Errorf("span export: %w", err)
+	}
+	return nil
+}
+
+// checkTokenRefresh refreshes a dummy token against the configured
+// mock identity provider's token endpoint.
+func (s *selfTest) checkTokenRefresh(ctx context.Context) error {
+	if s.tokenURL == "" {
+		return fmt.Errorf("self_test.token_url not configured: %w", errSelfTestSkipped)
+	}
+	config := &oauth2.Config{
+		ClientID:     "selftest",
+		ClientSecret: "selftest",
+		Endpoint:     oauth2.Endpoint{TokenURL: s.tokenURL},
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, http.DefaultClient)
+	token, err := config.TokenSource(ctx, &oauth2.Token{RefreshToken: "selftest"}).Token()
+	if err != nil {
+		return fmt.Errorf("refresh: %w", err)
+	}
+	if strings.TrimSpace(token.AccessToken) == "" {
+		return errors.New("refresh returned no access token")
+	}
+	return nil
+}
+
+// selfTestHandler serves POST /api/admin/selftest, responding with 503
+// if any step fails.
+func selfTestHandler(test *selfTest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), selfTestTimeout)
+		defer cancel()
+		report := test.run(ctx)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status != selfTestPass {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
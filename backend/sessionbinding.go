@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const sessionBindingCookieName = "session_binding"
+
+// sessionBinding binds sessions to characteristics of the client they were
+// started from, so that a stolen credentials cookie is rejected when
+// replayed from a very different client. When a session starts, a digest of
+// its credentials and of the client's characteristics is stored alongside
+// it, in an encrypted cookie, and every request must match it. A nil
+// sessionBinding binds nothing.
+type sessionBinding struct {
+	secureCookies secureCookies
+	userAgent     bool
+	ipv4Prefix    int
+	ipv6Prefix    int
+
+	// proxies tell the address of clients behind them.
+	proxies trustedProxies
+}
+
+// newSessionBinding returns the session binding configured, or nil if
+// sessions are not bound.
+func newSessionBinding(config *appConfig, secureCookies secureCookies) (*sessionBinding, error) {
+	c := config.SessionBinding
+	if !c.UserAgent && c.IPv4Prefix == 0 && c.IPv6Prefix == 0 {
+		return nil, nil
+	}
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 {
+		return nil, fmt.Errorf("session_binding.ipv4_prefix: %d is not between 0 and 32", c.IPv4Prefix)
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("session_binding.ipv6_prefix: %d is not between 0 and 128", c.IPv6Prefix)
+	}
+	proxies, err := newTrustedProxies(config)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionBinding{
+		secureCookies: secureCookies,
+		userAgent:     c.UserAgent,
+		ipv4Prefix:    c.IPv4Prefix,
+		ipv6Prefix:    c.IPv6Prefix,
+		proxies:       proxies,
+	}, nil
+}
+
+// fingerprint returns the characteristics of the client a session is bound
+// to. Version numbers are dropped from the User-Agent, so that sessions
+// survive browser updates, and addresses are reduced to their network, so
+// that they survive address changes within it. Addresses are those of the
+// connection, or behind trusted proxies, those they forward, so that
+// clients cannot match a binding by sending X-Forwarded-For.
+func (b *sessionBinding) fingerprint(r *http.Request) string {
+	var parts []string
+	if b.userAgent {
+		parts = append(parts, "ua:"+strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) {
+				return -1
+			}
+			return r
+		}, r.UserAgent()))
+	}
+	if b.ipv4Prefix > 0 || b.ipv6Prefix > 0 {
+		network := "unknown"
+		if addr, err := netip.ParseAddr(b.proxies.clientIP(r)); err == nil {
+			addr = addr.Unmap()
+			bits := b.ipv6Prefix
+			if addr.Is4() {
+				bits = b.ipv4Prefix
+			}
+			if prefix, err := addr.Prefix(bits); err == nil {
+				network = prefix.String()
+			}
+		}
+		parts = append(parts, "ip:"+network)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// value returns the digest binding credentials to the client of r.
+func (b *sessionBinding) value(r *http.Request, credentials string) string {
+	sum := sha256.Sum256([]byte(credentials + "\x00" + b.fingerprint(r)))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// set binds a new session's credentials, kept until expires, to the client
+// starting it.
+func (b *sessionBinding) set(w http.ResponseWriter, r *http.Request, credentials string, expires time.Time) error {
+	if b == nil {
+		return nil
+	}
+	value, err := b.secureCookies.Encode(b.value(r, credentials))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionBindingCookieName,
+		Path:     credentialsCookiePath,
+		Value:    value,
+		Secure:   true,
+		HttpOnly: true,
+		Expires:  expires,
+	})
+	return nil
+}
+
+// matches reports whether credentials are used by the client they are bound
+// to. Sessions without a binding, such as those started before binding was
+// configured, do not match, as a stolen cookie could be replayed without it.
+func (b *sessionBinding) matches(r *http.Request, credentials string) bool {
+	if b == nil {
+		return true
+	}
+	cookie, err := r.Cookie(sessionBindingCookieName)
+	if err != nil {
+		return false
+	}
+	value, err := b.secureCookies.Decode(cookie.Value)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(value), []byte(b.value(r, credentials))) == 1
+}
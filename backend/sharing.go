@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	recordSharesIndex = "app-record-shares"
+
+	auditActionRecordShared = "record.shared"
+
+	// recordAdminRole lets users share records they do not own.
+	recordAdminRole = "admin"
+)
+
+// Access levels granted to records.
+const (
+	accessNone  = "none"
+	accessRead  = "read"
+	accessWrite = "write"
+)
+
+var (
+	errNotRecordOwner = errors.New("only the owner of the record or an admin may share it")
+	errInvalidGrant   = errors.New("exactly one of user, role, and team is required, with access read, write, or none")
+)
+
+// recordGrant grants a user, the users with a role, or the members of a
+// team access to a record.
+type recordGrant struct {
+	UserID string `json:"user_id,omitempty"`
+	Role   string `json:"role,omitempty"`
+	Team   string `json:"team,omitempty"`
+	Access string `json:"access"`
+}
+
+// matches reports whether the grant applies to a user.
+func (g recordGrant) matches(a recordAccessor) bool {
+	switch {
+	case g.UserID != "":
+		return g.UserID == a.userID
+	case g.Role != "":
+		return slices.Contains(a.roles, g.Role)
+	default:
+		return slices.Contains(a.teams, g.Team)
+	}
+}
+
+// principal names who the grant applies to, for audit events.
+func (g recordGrant) principal() string {
+	switch {
+	case g.UserID != "":
+		return "user:" + g.UserID
+	case g.Role != "":
+		return "role:" + g.Role
+	default:
+		return "team:" + g.Team
+	}
+}
+
+// recordAccessor is a user accessing records, with their roles and the
+// teams they are a member of.
+type recordAccessor struct {
+	userID string
+	roles  []string
+	teams  []string
+}
+
+// recordACL restricts a record to its owner and the users it was shared
+// with. Records without an ACL are accessible to all signed-in users;
+// sharing one gives it an ACL, owned by the user who created the record.
+type recordACL struct {
+	RecordID  string        `json:"record_id"`
+	Owner     string        `json:"owner"`
+	Grants    []recordGrant `json:"grants"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// access returns the access of a user.
+func (acl *recordACL) access(a recordAccessor) string {
+	if acl == nil || acl.Owner == a.userID {
+		return accessWrite
+	}
+	access := accessNone
+	for _, grant := range acl.Grants {
+		if !grant.matches(a) {
+			continue
+		}
+		if grant.Access == accessWrite {
+			return accessWrite
+		}
+		access = accessRead
+	}
+	return access
+}
+
+// sharedWith reports whether the record was shared with the user, directly
+// or through a role or team, rather than owned by them.
+func (acl *recordACL) sharedWith(a recordAccessor) bool {
+	return acl != nil && acl.Owner != a.userID && acl.access(a) != accessNone
+}
+
+// sharedWithTeam reports whether the record was shared with a team.
+func (acl *recordACL) sharedWithTeam(team string) bool {
+	return acl != nil && slices.ContainsFunc(acl.Grants, func(g recordGrant) bool { return g.Team == team })
+}
+
+// shareStore manages the ACLs of records, persisted to Elasticsearch if
+// configured, with a document per record.
+type shareStore struct {
+	client        *elasticsearch.Client
+	logger        *zap.Logger
+	invalidations *invalidator
+
+	// teamsOf returns the teams a user is a member of, if teams are
+	// wired.
+	teamsOf func(userID string) []string
+
+	mu   sync.RWMutex
+	acls map[string]*recordACL
+}
+
+func newShareStore(client *elasticsearch.Client, logger *zap.Logger) (*shareStore, error) {
+	s := &shareStore{
+		client: client,
+		logger: logger,
+		acls:   make(map[string]*recordACL),
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init share store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing ACLs from Elasticsearch.
+func (s *shareStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initShareStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	err := loadAll(ctx, s.client, recordSharesIndex, func(hit loadedHit) error {
+		acl := &recordACL{}
+		if err := json.Unmarshal(hit.Source, acl); err != nil {
+			return err
+		}
+		s.acls[acl.RecordID] = acl
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	logger.Info("loaded record shares", zap.Int("records", len(s.acls)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// watch propagates ACLs changed by other replicas, reloading them from
+// Elasticsearch.
+func (s *shareStore) watch(invalidations *invalidator) {
+	s.invalidations = invalidations
+	invalidations.subscribe(invalidateRecordShares, func(ctx context.Context, inv invalidation) {
+		if err := s.reload(ctx, inv.Key); err != nil {
+			s.logger.Warn("failed to reload record shares", zap.String("record.id", inv.Key), zap.Error(err))
+		}
+	})
+}
+
+// reload loads a record's ACL from Elasticsearch, replacing the one in
+// memory.
+func (s *shareStore) reload(ctx context.Context, recordID string) error {
+	res, err := s.client.Get(recordSharesIndex, recordID, s.client.Get.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("while loading record shares: %w", err)
+	}
+	defer res.Body.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if res.StatusCode == http.StatusNotFound {
+		delete(s.acls, recordID)
+		return nil
+	}
+	if res.IsError() {
+		return fmt.Errorf("loading record shares failed: %s", res.Status())
+	}
+	var doc struct {
+		Source recordACL `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return err
+	}
+	s.acls[recordID] = &doc.Source
+	return nil
+}
+
+// get returns a copy of the ACL of a record, or nil if it has none.
+func (s *shareStore) get(recordID string) *recordACL {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	acl := s.acls[recordID]
+	if acl == nil {
+		return nil
+	}
+	copied := *acl
+	copied.Grants = slices.Clone(acl.Grants)
+	return &copied
+}
+
+// accessor returns a user accessing records, with the given roles.
+func (s *shareStore) accessor(userID string, roles []string) recordAccessor {
+	a := recordAccessor{userID: userID, roles: roles}
+	if s.teamsOf != nil && userID != "" {
+		a.teams = s.teamsOf(userID)
+	}
+	return a
+}
+
+// access returns the access of a user to a record.
+func (s *shareStore) access(recordID string, a recordAccessor) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.acls[recordID].access(a)
+}
+
+// share grants access to a record on behalf of userID, who must own it or
+// be an admin. The owner of a record without an ACL is owner, the user who
+// created it; records without one, such as sample data, become owned by
+// the admin who first shares them. Granting access none revokes a grant.
+func (s *shareStore) share(ctx context.Context, recordID, owner, userID string, admin bool, grant recordGrant) (*recordACL, error) {
+	principals := 0
+	for _, principal := range []string{grant.UserID, grant.Role, grant.Team} {
+		if principal != "" {
+			principals++
+		}
+	}
+	if principals != 1 ||
+		!slices.Contains([]string{accessNone, accessRead, accessWrite}, grant.Access) {
+		return nil, errInvalidGrant
+	}
+	s.mu.Lock()
+	acl := s.acls[recordID]
+	switch {
+	case acl != nil:
+		owner = acl.Owner
+	case owner == "" && admin:
+		owner = userID
+	}
+	if owner != userID && !admin {
+		s.mu.Unlock()
+		return nil, errNotRecordOwner
+	}
+	updated := &recordACL{RecordID: recordID, Owner: owner, UpdatedAt: time.Now().UTC()}
+	if acl != nil {
+		updated.Grants = slices.DeleteFunc(slices.Clone(acl.Grants), func(g recordGrant) bool {
+			return g.UserID == grant.UserID && g.Role == grant.Role && g.Team == grant.Team
+		})
+	}
+	if grant.Access != accessNone && grant.UserID != owner {
+		updated.Grants = append(updated.Grants, grant)
+	}
+	s.acls[recordID] = updated
+	s.mu.Unlock()
+	if s.client == nil {
+		return updated, nil
+	}
+	res, err := s.client.Index(
+		recordSharesIndex, esutil.NewJSONReader(updated),
+		s.client.Index.WithDocumentID(recordID),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("while saving record shares: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("saving record shares failed: %s", res.Status())
+	}
+	s.invalidations.notify(ctx, invalidateRecordShares, recordID, updated.UpdatedAt)
+	return updated, nil
+}
+
+// hidden returns the sorted IDs of the records a user may not read.
+func (s *shareStore) hidden(a recordAccessor) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ids []string
+	for id, acl := range s.acls {
+		if acl.access(a) == accessNone {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// visible keeps the records a user may read, only those shared with them
+// if sharedOnly is set, and only those shared with team if set. records
+// must be copies, as returned by tagStore.tagged.
+func (s *shareStore) visible(records []SampleRecord, a recordAccessor, sharedOnly bool, team string) []SampleRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := records[:0]
+	for _, record := range records {
+		acl := s.acls[record.ID]
+		if acl.access(a) == accessNone || sharedOnly && !acl.sharedWith(a) || team != "" && !acl.sharedWithTeam(team) {
+			continue
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+// parseSharedWithMe parses the "shared_with_me" query parameter of r.
+func parseSharedWithMe(r *http.Request) (bool, error) {
+	param := r.URL.Query().Get("shared_with_me")
+	if param == "" {
+		return false, nil
+	}
+	sharedWithMe, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, fmt.Errorf("invalid shared_with_me %q", param)
+	}
+	return sharedWithMe, nil
+}
+
+// middleware enforces the ACLs of records on the routes of a record, whose
+// paths start with /api/records/{id} or /api/data/{id}: reading requires
+// read access, and other methods write access. Records a user may not read
+// are reported as unknown. It must run after authentication, without which
+// only records without an ACL are accessible.
+func (s *shareStore) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, path, _ := strings.Cut(r.Pattern, " ")
+		if !strings.HasPrefix(path, "/api/records/{id}") && !strings.HasPrefix(path, "/api/data/{id}") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		var userID string
+		var roles []string
+		if auth, _ := r.Context().Value(authKey{}).(*authDetails); auth != nil {
+			userID, roles = auth.userID, auth.roles
+		}
+		switch access := s.access(r.PathValue("id"), s.accessor(userID, roles)); {
+		case access == accessNone:
+			writeError(w, r, http.StatusNotFound, errUnknownRecord.Error())
+		case access == accessRead && r.Method != http.MethodGet && r.Method != http.MethodHead:
+			writeError(w, r, http.StatusForbidden, "Forbidden")
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// registerShareRoutes registers the endpoints for sharing records.
+func registerShareRoutes(
+	routes *routeRegistry,
+	shares *shareStore,
+	records *recordStore,
+	audit *auditLog,
+	logger *zap.Logger,
+) {
+	user := routes.group(groupUser)
+
+	writeACL := func(w http.ResponseWriter, recordID string, acl *recordACL) {
+		if acl == nil {
+			acl = &recordACL{RecordID: recordID}
+		}
+		if acl.Grants == nil {
+			acl.Grants = []recordGrant{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(acl)
+	}
+
+	user.GET("/api/records/{id}/share", func(w http.ResponseWriter, r *http.Request) {
+		recordID := r.PathValue("id")
+		if !records.exists(recordID) {
+			writeError(w, r, http.StatusNotFound, errUnknownRecord.Error())
+			return
+		}
+		writeACL(w, recordID, shares.get(recordID))
+	})
+
+	user.POST("/api/records/{id}/share", func(w http.ResponseWriter, r *http.Request) {
+		recordID := r.PathValue("id")
+		stored, ok := records.get(recordID)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, errUnknownRecord.Error())
+			return
+		}
+		var grant recordGrant
+		if err := json.NewDecoder(r.Body).Decode(&grant); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		auth := authFromContext(r.Context())
+		acl, err := shares.share(r.Context(), recordID, stored.record.Owner, auth.userID, auth.hasRole(recordAdminRole), grant)
+		switch {
+		case errors.Is(err, errInvalidGrant):
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		case errors.Is(err, errNotRecordOwner):
+			writeError(w, r, http.StatusForbidden, err.Error())
+			return
+		case err != nil:
+			logger.Error("failed to save record shares", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		audit.record(r.Context(), auditActionRecordShared, auth.userID, recordID, map[string]string{
+			"principal": grant.principal(),
+			"access":    grant.Access,
+		})
+		writeACL(w, recordID, acl)
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultDrainTimeout leaves time, within the 30 seconds Kubernetes
+	// grants pods to terminate by default, to flush what is pending.
+	defaultDrainTimeout = 20 * time.Second
+
+	// flushTimeout bounds flushing pending writes and telemetry once
+	// connections are drained.
+	flushTimeout = 5 * time.Second
+
+	// terminationMargin is left of termination grace periods for the
+	// backend to exit once flushed.
+	terminationMargin = 5 * time.Second
+)
+
+// serve serves on listener until ctx is done, e.g. on SIGTERM. The server
+// then stops accepting connections and waits up to drainTimeout for
+// in-flight requests to complete, closing the connections of those which
+// do not, before running flushes in order, within flushTimeout, so that
+// what is pending is written out before the backend exits.
+func serve(
+	ctx context.Context,
+	server *http.Server,
+	listener net.Listener,
+	drainTimeout time.Duration,
+	logger *zap.Logger,
+	flushes ...func(context.Context) error,
+) error {
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("shutting down: draining connections", zap.Duration("timeout", drainTimeout))
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(drainCtx); err != nil {
+		logger.Warn("requests still in flight after drain timeout: closing connections", zap.Error(err))
+		server.Close()
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	for _, flush := range flushes {
+		if err := flush(flushCtx); err != nil {
+			logger.Warn("failed to flush on shutdown", zap.Error(err))
+		}
+	}
+	logger.Info("shut down")
+	return nil
+}
+
+// pendingWrites tracks writes made in the background, so as not to delay
+// responses, for them to be waited for on shutdown. Its zero value is
+// ready to use.
+type pendingWrites struct {
+	wg sync.WaitGroup
+}
+
+// run runs write in the background.
+func (p *pendingWrites) run(write func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		write()
+	}()
+}
+
+// wait waits for the pending writes to complete, or ctx to be done.
+func (p *pendingWrites) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("pending writes not flushed: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+)
+
+var (
+	errDownloadLinkInvalid = errors.New("invalid download link")
+	errDownloadLinkExpired = errors.New("download link expired")
+)
+
+// signedToken is the content of a signed URL token. Kind names the
+// endpoint the token is for, so that it cannot be used with another, and
+// Path identifies the resource, e.g. a report and one of its snapshots.
+type signedToken struct {
+	Kind    string   `json:"k"`
+	Path    []string `json:"p"`
+	Expires int64    `json:"e"`
+}
+
+// urlSigner creates and verifies the tokens of signed URLs, which grant
+// access to a resource without a session until they expire, e.g. to
+// download files from links in emails or from <img> elements. Tokens are
+// signed and encrypted with secureCookies. Without encryption keys, they
+// could be forged, so callers must check signed, and fall back to
+// endpoints for signed-in users.
+type urlSigner struct {
+	secureCookies secureCookies
+
+	// clock tells when tokens expire.
+	clock clock
+}
+
+func newURLSigner(secureCookies secureCookies, clk clock) *urlSigner {
+	return &urlSigner{secureCookies: secureCookies, clock: clk}
+}
+
+// signed reports whether tokens are signed.
+func (s *urlSigner) signed() bool {
+	return len(s.secureCookies.keys()) > 0
+}
+
+// sign returns a token for the resource at path, of the given kind, valid
+// for ttl, and when it expires.
+func (s *urlSigner) sign(kind string, path []string, ttl time.Duration) (string, time.Time, error) {
+	expires := s.clock.Now().Add(ttl)
+	data, err := json.Marshal(signedToken{kind, path, expires.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token, err := s.secureCookies.Encode(base64.RawURLEncoding.EncodeToString(data))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expires, nil
+}
+
+// verify returns the resource path of a token of the given kind, with n
+// elements.
+func (s *urlSigner) verify(token, kind string, n int) ([]string, error) {
+	value, err := s.secureCookies.Decode(token)
+	if err != nil {
+		return nil, errDownloadLinkInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errDownloadLinkInvalid
+	}
+	var t signedToken
+	if err := json.Unmarshal(data, &t); err != nil || t.Kind != kind || len(t.Path) != n || slices.Contains(t.Path, "") {
+		return nil, errDownloadLinkInvalid
+	}
+	if s.clock.Now().Unix() >= t.Expires {
+		return nil, errDownloadLinkExpired
+	}
+	return t.Path, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// sloBucketCount is the number of one-minute buckets kept per
+	// objective, covering the longest burn rate window.
+	sloBucketCount = 6 * 60
+
+	sloEvaluationInterval = time.Minute
+
+	sloAlertFiring   = "firing"
+	sloAlertResolved = "resolved"
+)
+
+// sloWindows are the windows over which burn rates are computed.
+var sloWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+}
+
+// sloBurnAlerts are the multiwindow burn rate thresholds above which an
+// objective alerts: its error budget burns too fast if the burn rate
+// exceeds the threshold over both the long window, and the short one,
+// which ends the alert soon after the burn stops.
+var sloBurnAlerts = []struct {
+	long, short string
+	threshold   float64
+}{
+	{"1h", "5m", 14.4},
+	{"6h", "30m", 6},
+}
+
+// sloObjective is a service level objective of a route group.
+type sloObjective struct {
+	// Group is the route group (public, signed_in, user, admin, or
+	// scim) whose requests the objective covers, or empty for all.
+	Group string `yaml:"group"`
+
+	// Target is the share of requests which must be good, e.g. 0.999.
+	// Requests failing with a 5xx status are bad.
+	Target float64 `yaml:"target"`
+
+	// LatencyThreshold makes requests slower than it bad too, if set.
+	LatencyThreshold time.Duration `yaml:"latency_threshold"`
+}
+
+type sloBucket struct {
+	minute int64
+	total  int64
+	bad    int64
+}
+
+// sloState holds the per-minute request counts of an objective.
+type sloState struct {
+	name string
+	sloObjective
+
+	buckets  [sloBucketCount]sloBucket
+	alerting bool
+}
+
+// sloTracker tracks the requests covered by service level objectives,
+// computing the burn rates of their error budgets, and posting alerts to
+// webhooks when they burn too fast. A nil sloTracker tracks nothing.
+type sloTracker struct {
+	alertURLs     []string
+	webhookSecret string
+	httpClient    *http.Client
+	logger        *zap.Logger
+	now           func() time.Time
+
+	mu         sync.Mutex
+	objectives []*sloState
+}
+
+// newSLOTracker returns a tracker of the configured objectives, or nil if
+// none are.
+func newSLOTracker(config *appConfig, logger *zap.Logger) (*sloTracker, error) {
+	if len(config.SLO.Objectives) == 0 {
+		return nil, nil
+	}
+	t := &sloTracker{
+		alertURLs:     config.SLO.AlertURLs,
+		webhookSecret: config.Webhooks.Secret,
+		httpClient:    &http.Client{Transport: http.DefaultClient.Transport, Timeout: webhookTimeout},
+		logger:        logger,
+		now:           time.Now,
+	}
+	for name, objective := range config.SLO.Objectives {
+		switch objective.Group {
+		case "", groupPublic, groupSignedIn, groupUser, groupAdmin, groupSCIM:
+		default:
+			return nil, fmt.Errorf("slo.objectives.%s: unknown route group %q", name, objective.Group)
+		}
+		if objective.Target <= 0 || objective.Target >= 1 {
+			return nil, fmt.Errorf("slo.objectives.%s: target must be between 0 and 1, got %v", name, objective.Target)
+		}
+		t.objectives = append(t.objectives, &sloState{name: name, sloObjective: objective})
+	}
+	sort.Slice(t.objectives, func(i, j int) bool { return t.objectives[i].name < t.objectives[j].name })
+	return t, nil
+}
+
+// record records a request to a route of group, answered with status
+// after elapsed.
+func (t *sloTracker) record(group string, status int, elapsed time.Duration) {
+	if t == nil {
+		return
+	}
+	minute := t.now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.objectives {
+		if s.Group != "" && s.Group != group {
+			continue
+		}
+		b := &s.buckets[minute%sloBucketCount]
+		if b.minute != minute {
+			*b = sloBucket{minute: minute}
+		}
+		b.total++
+		if status >= 500 || (s.LatencyThreshold > 0 && elapsed > s.LatencyThreshold) {
+			b.bad++
+		}
+	}
+}
+
+// middleware records the requests to the routes of a route registry.
+func (t *sloTracker) middleware(rt *route, h http.Handler) http.Handler {
+	if t == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		t.record(rt.Group, status, time.Since(start))
+	})
+}
+
+// sloWindowReport describes the requests covered by an objective over a
+// window.
+type sloWindowReport struct {
+	Window    string  `json:"window"`
+	Requests  int64   `json:"requests"`
+	Bad       int64   `json:"bad"`
+	ErrorRate float64 `json:"error_rate"`
+
+	// BurnRate is how fast the error budget burns: 1 burns it exactly
+	// over the objective's period.
+	BurnRate float64 `json:"burn_rate"`
+}
+
+// sloReport describes the state of an objective.
+type sloReport struct {
+	Name             string            `json:"name"`
+	Group            string            `json:"group,omitempty"`
+	Target           float64           `json:"target"`
+	LatencyThreshold string            `json:"latency_threshold,omitempty"`
+	Windows          []sloWindowReport `json:"windows"`
+	Alerting         bool              `json:"alerting"`
+}
+
+// windows returns the burn rates of an objective, by window. It must be
+// called with t.mu held.
+func (t *sloTracker) windows(s *sloState) []sloWindowReport {
+	minute := t.now().Unix() / 60
+	reports := make([]sloWindowReport, len(sloWindows))
+	for i, w := range sloWindows {
+		report := sloWindowReport{Window: w.name}
+		since := minute - int64(w.duration/time.Minute)
+		for _, b := range s.buckets {
+			if b.minute > since && b.minute <= minute {
+				report.Requests += b.total
+				report.Bad += b.bad
+			}
+		}
+		if report.Requests > 0 {
+			report.ErrorRate = float64(report.Bad) / float64(report.Requests)
+			report.BurnRate = report.ErrorRate / (1 - s.Target)
+		}
+		reports[i] = report
+	}
+	return reports
+}
+
+// report returns the state of all objectives.
+func (t *sloTracker) report() []sloReport {
+	if t == nil {
+		return []sloReport{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reports := make([]sloReport, 0, len(t.objectives))
+	for _, s := range t.objectives {
+		report := sloReport{
+			Name:     s.name,
+			Group:    s.Group,
+			Target:   s.Target,
+			Windows:  t.windows(s),
+			Alerting: s.alerting,
+		}
+		if s.LatencyThreshold > 0 {
+			report.LatencyThreshold = s.LatencyThreshold.String()
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// sloAlert is posted to the alert webhooks when an objective starts or
+// stops burning its error budget too fast.
+type sloAlert struct {
+	Timestamp time.Time         `json:"@timestamp"`
+	Status    string            `json:"status"`
+	SLO       string            `json:"slo.name"`
+	Group     string            `json:"slo.group,omitempty"`
+	Target    float64           `json:"slo.target"`
+	Windows   []sloWindowReport `json:"windows"`
+}
+
+// evaluate checks the burn rates of all objectives, returning alerts for
+// those starting or stopping to burn their error budget too fast.
+func (t *sloTracker) evaluate() []sloAlert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var alerts []sloAlert
+	for _, s := range t.objectives {
+		windows := t.windows(s)
+		burnRates := make(map[string]float64, len(windows))
+		for _, w := range windows {
+			burnRates[w.Window] = w.BurnRate
+		}
+		alerting := false
+		for _, a := range sloBurnAlerts {
+			if burnRates[a.long] > a.threshold && burnRates[a.short] > a.threshold {
+				alerting = true
+			}
+		}
+		if alerting == s.alerting {
+			continue
+		}
+		s.alerting = alerting
+		status := sloAlertResolved
+		if alerting {
+			status = sloAlertFiring
+		}
+		alerts = append(alerts, sloAlert{
+			Timestamp: t.now().UTC(),
+			Status:    status,
+			SLO:       s.name,
+			Group:     s.Group,
+			Target:    s.Target,
+			Windows:   windows,
+		})
+	}
+	return alerts
+}
+
+// run evaluates the objectives every sloEvaluationInterval, until ctx is
+// done, logging alerts and posting them to the alert webhooks.
+func (t *sloTracker) run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(sloEvaluationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, alert := range t.evaluate() {
+			t.logger.Warn("SLO error budget alert",
+				zap.String("slo.name", alert.SLO), zap.String("status", alert.Status))
+			t.notify(alert)
+		}
+	}
+}
+
+// notify posts an alert to each alert webhook, signed with the webhook
+// secret.
+func (t *sloTracker) notify(alert sloAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		t.logger.Warn("failed to encode SLO alert", zap.Error(err))
+		return
+	}
+	signature := webhookSignature(t.webhookSecret, body)
+	for _, url := range t.alertURLs {
+		if err := postWebhook(t.httpClient, url, body, signature); err != nil {
+			t.logger.Warn("failed to deliver SLO alert", zap.String("url.full", url), zap.Error(err))
+		}
+	}
+}
+
+// sloHandler serves GET /api/admin/slo.
+func sloHandler(t *sloTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Objectives []sloReport `json:"objectives"`
+		}{t.report()})
+	}
+}
+
+// statusResponseWriter captures the status of a response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
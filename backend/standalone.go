@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// frontendIndex is the page of the frontend, served on paths without
+	// a file so that it routes them in the browser.
+	frontendIndex = "index.html"
+
+	// frontendAssetsDir holds the assets of frontend builds, whose names
+	// change with their content.
+	frontendAssetsDir = "assets/"
+)
+
+// apiPathPrefixes are the paths of the API, which the dev proxy routes to
+// the backend rather than to the frontend.
+var apiPathPrefixes = []string{"/api/", "/scim/"}
+
+// embeddedFrontend is the frontend build embedded in standalone builds, or
+// nil.
+var embeddedFrontend fs.FS
+
+// frontendFiles returns the frontend build the backend serves: that of
+// server.static_dir, or else that embedded in standalone builds. It returns
+// nil when the frontend is deployed apart, as in Kubernetes.
+func frontendFiles(config *appConfig) (fs.FS, error) {
+	dir := config.Server.StaticDir
+	if dir == "" {
+		return embeddedFrontend, nil
+	}
+	fsys := os.DirFS(dir)
+	if _, err := fs.Stat(fsys, frontendIndex); err != nil {
+		return nil, fmt.Errorf("server.static_dir: %w", err)
+	}
+	return fsys, nil
+}
+
+// frontendHandler serves the frontend in fsys along with the API, routing
+// requests in process as the dev proxy does across processes: paths of the
+// API, and those of other routes of router, such as /metrics, go to api,
+// and others to the frontend.
+func frontendHandler(router *http.ServeMux, api http.Handler, fsys fs.FS) http.Handler {
+	static := wrapHandler(staticHandler(fsys), "GET /")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range apiPathPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				api.ServeHTTP(w, r)
+				return
+			}
+		}
+		if _, pattern := router.Handler(r); pattern != "" {
+			api.ServeHTTP(w, r)
+			return
+		}
+		static.ServeHTTP(w, r)
+	})
+}
+
+// staticHandler serves the files of a frontend build, and its index on
+// paths without a file, like the nginx of the frontend image. Assets are
+// cached for good, and the index revalidated, so that browsers load new
+// builds.
+func staticHandler(fsys fs.FS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if info, err := fs.Stat(fsys, name); err != nil || info.IsDir() {
+			name = frontendIndex
+		}
+		if strings.HasPrefix(name, frontendAssetsDir) {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		// Unlike ServeContent, ServeFileFS redirects requests for the
+		// index to its directory.
+		f, err := fsys.Open(name)
+		if err != nil {
+			http.Error(w, "frontend not found", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		content, ok := f.(io.ReadSeeker)
+		if !ok {
+			http.Error(w, "frontend files cannot seek", http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, name, info.ModTime(), content)
+	})
+}
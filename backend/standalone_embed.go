@@ -0,0 +1,19 @@
+//go:build standalone
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Standalone builds embed the frontend build, copied into static/ by "make
+// standalone", to serve it from the same binary as the API. Build with
+// -tags standalone to include it.
+//
+//go:embed all:static
+var staticFiles embed.FS
+
+func init() {
+	embeddedFrontend, _ = fs.Sub(staticFiles, "static")
+}
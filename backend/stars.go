@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const recordStarsIndex = "app-record-stars"
+
+// star records that a user starred a record.
+type star struct {
+	UserID    string    `json:"user_id"`
+	RecordID  string    `json:"record_id"`
+	StarredAt time.Time `json:"starred_at"`
+}
+
+// starSortKey orders stars by when they were made, with ties broken by
+// record ID.
+func starSortKey(s *star) string {
+	return s.StarredAt.UTC().Format("2006-01-02T15:04:05.000000000") + "/" + s.RecordID
+}
+
+// starStore manages the records users starred, persisted to Elasticsearch
+// if configured, with a document per star.
+type starStore struct {
+	client *elasticsearch.Client
+	logger *zap.Logger
+
+	mu    sync.RWMutex
+	stars map[string]map[string]*star
+
+	// counts holds the number of users who starred each record.
+	counts map[string]int
+}
+
+func newStarStore(client *elasticsearch.Client, logger *zap.Logger) (*starStore, error) {
+	s := &starStore{
+		client: client,
+		logger: logger,
+		stars:  make(map[string]map[string]*star),
+		counts: make(map[string]int),
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init star store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing stars from Elasticsearch.
+func (s *starStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initStarStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(recordStarsIndex),
+		s.client.Search.WithSize(10000),
+	)
+	if err != nil {
+		logger.Info("could not load stars from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.Info("could not load stars from Elasticsearch", zap.String("status", res.Status()))
+		return nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source star `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	for i := range searchResult.Hits.Hits {
+		s.put(&searchResult.Hits.Hits[i].Source)
+	}
+
+	logger.Info("loaded stars", zap.Int("users", len(s.stars)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// put adds a star to the in-memory maps, reporting whether it is new.
+// The caller must hold mu, or have exclusive access.
+func (s *starStore) put(st *star) bool {
+	if s.stars[st.UserID] == nil {
+		s.stars[st.UserID] = make(map[string]*star)
+	}
+	if _, ok := s.stars[st.UserID][st.RecordID]; ok {
+		return false
+	}
+	s.stars[st.UserID][st.RecordID] = st
+	s.counts[st.RecordID]++
+	return true
+}
+
+// add stars a record for a user. Starring a record again is a no-op.
+func (s *starStore) add(ctx context.Context, userID, recordID string) error {
+	st := &star{UserID: userID, RecordID: recordID, StarredAt: time.Now().UTC()}
+	s.mu.Lock()
+	added := s.put(st)
+	s.mu.Unlock()
+	if !added || s.client == nil {
+		return nil
+	}
+	res, err := s.client.Index(
+		recordStarsIndex, esutil.NewJSONReader(st),
+		s.client.Index.WithDocumentID(starDocumentID(userID, recordID)),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving star: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving star failed: %s", res.Status())
+	}
+	return nil
+}
+
+// remove unstars a record for a user. Unstarring a record the user has
+// not starred is a no-op.
+func (s *starStore) remove(ctx context.Context, userID, recordID string) error {
+	s.mu.Lock()
+	_, ok := s.stars[userID][recordID]
+	if ok {
+		delete(s.stars[userID], recordID)
+		if s.counts[recordID]--; s.counts[recordID] <= 0 {
+			delete(s.counts, recordID)
+		}
+	}
+	s.mu.Unlock()
+	if !ok || s.client == nil {
+		return nil
+	}
+	res, err := s.client.Delete(
+		recordStarsIndex, starDocumentID(userID, recordID),
+		s.client.Delete.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while deleting star: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting star failed: %s", res.Status())
+	}
+	return nil
+}
+
+func starDocumentID(userID, recordID string) string {
+	return userID + ":" + recordID
+}
+
+// forUser returns the records a user starred, oldest star first.
+func (s *starStore) forUser(userID string) []*star {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]*star, 0, len(s.stars[userID]))
+	for _, st := range s.stars[userID] {
+		result = append(result, st)
+	}
+	sort.Slice(result, func(i, j int) bool { return starSortKey(result[i]) < starSortKey(result[j]) })
+	return result
+}
+
+// starred sets the star counts of records, and whether the user starred
+// them, keeping only the starred ones if starredOnly is set. records must
+// be copies, as returned by tagStore.tagged.
+func (s *starStore) starred(records []SampleRecord, userID string, starredOnly bool) []SampleRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := records[:0]
+	for _, record := range records {
+		_, record.Starred = s.stars[userID][record.ID]
+		if starredOnly && !record.Starred {
+			continue
+		}
+		record.Stars = s.counts[record.ID]
+		result = append(result, record)
+	}
+	return result
+}
+
+// parseStarredOnly parses the "starred_only" query parameter of r.
+func parseStarredOnly(r *http.Request) (bool, error) {
+	param := r.URL.Query().Get("starred_only")
+	if param == "" {
+		return false, nil
+	}
+	starredOnly, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, fmt.Errorf("invalid starred_only %q", param)
+	}
+	return starredOnly, nil
+}
+
+// registerStarRoutes registers the endpoints for starring records and
+// listing the signed-in user's starred records.
+func registerStarRoutes(
+	routes *routeRegistry,
+	stars *starStore,
+	records *recordStore,
+	cursors *cursorCodec,
+	logger *zap.Logger,
+) {
+	user := routes.group(groupUser)
+
+	change := func(apply func(ctx context.Context, userID, recordID string) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			recordID := r.PathValue("id")
+			if !records.exists(recordID) {
+				writeError(w, r, http.StatusNotFound, errUnknownRecord.Error())
+				return
+			}
+			if err := apply(r.Context(), authFromContext(r.Context()).userID, recordID); err != nil {
+				logger.Error("failed to save star", append(traceLogFields(r.Context()), zap.Error(err))...)
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	user.PUT("/api/records/{id}/star", change(stars.add))
+	user.DELETE("/api/records/{id}/star", change(stars.remove))
+
+	user.GET("/api/account/starred", func(w http.ResponseWriter, r *http.Request) {
+		auth := authFromContext(r.Context())
+		page, err := paginate(w, r, cursors, "starred:starred_at", stars.forUser(auth.userID), starSortKey)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		type starResult struct {
+			RecordID  string    `json:"record_id"`
+			StarredAt time.Time `json:"starred_at"`
+		}
+		result := struct {
+			Starred []starResult `json:"starred"`
+		}{Starred: make([]starResult, 0, len(page))}
+		for _, st := range page {
+			result.Starred = append(result.Starred, starResult{st.RecordID, st.StarredAt})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// sensitiveConfigMarkers redact configuration settings whose names contain
+// them.
+var sensitiveConfigMarkers = []string{"secret", "password", "token", "key", "credential"}
+
+// startupSummary describes what a deployment is running, as logged and
+// recorded in the audit log on startup.
+type startupSummary struct {
+	Version   string         `json:"version,omitempty"`
+	GoVersion string         `json:"go_version"`
+	Storage   string         `json:"storage"`
+	Blobstore string         `json:"blobstore"`
+	Modules   []string       `json:"modules"`
+	Addresses []string       `json:"addresses"`
+	Config    map[string]any `json:"config"`
+}
+
+// newStartupSummary summarizes the effective configuration, with secrets
+// redacted, and what the backend runs with.
+func newStartupSummary(config *appConfig, storage string, addresses []string) (*startupSummary, error) {
+	redactedConfig, err := redactConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &startupSummary{
+		Storage:   storage,
+		Blobstore: config.Blobstore.Driver,
+		Modules:   enabledModules(config),
+		Addresses: addresses,
+		Config:    redactedConfig,
+	}
+	if s.Blobstore == "" {
+		s.Blobstore = "local"
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		s.GoVersion = info.GoVersion
+	}
+	s.Version = buildVersion()
+	return s, nil
+}
+
+// log logs the summary as a single structured event, and records it in the
+// audit log.
+func (s *startupSummary) log(ctx context.Context, logger *zap.Logger, audit *auditLog) {
+	logger.Info("starting server",
+		zap.String("service.version", s.Version),
+		zap.String("go.version", s.GoVersion),
+		zap.String("storage", s.Storage),
+		zap.String("blobstore", s.Blobstore),
+		zap.Strings("modules", s.Modules),
+		zap.Strings("addresses", s.Addresses),
+		zap.Any("config", s.Config),
+	)
+	audit.recordStartup(ctx, s)
+}
+
+// redactConfig returns the configuration as its YAML representation, with
+// set secrets replaced with redacted, and credentials removed from URLs.
+func redactConfig(config *appConfig) (map[string]any, error) {
+	raw, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := yaml.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	redactConfigValue(m)
+	return m, nil
+}
+
+// configReport is the effective configuration, with secrets redacted, and
+// where each of its settings was set, so that operators can check that
+// overrides took effect.
+type configReport struct {
+	Config map[string]any `json:"config"`
+
+	// Sources maps the dotted path of each setting to its source: default,
+	// file, kms, or env: followed by the name of the variable.
+	Sources map[string]string `json:"sources"`
+}
+
+func newConfigReport(config *appConfig) (*configReport, error) {
+	redactedConfig, err := redactConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	report := &configReport{Config: redactedConfig, Sources: make(map[string]string)}
+	var walk func(v any, path string)
+	walk = func(v any, path string) {
+		if m, ok := v.(map[string]any); ok && len(m) > 0 {
+			for key, value := range m {
+				if path != "" {
+					key = path + "." + key
+				}
+				walk(value, key)
+			}
+			return
+		}
+		report.Sources[path] = config.source(path)
+	}
+	walk(redactedConfig, "")
+	return report, nil
+}
+
+// configReportHandler reports the effective configuration.
+func configReportHandler(config *appConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := newConfigReport(config)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+func redactConfigValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if isSensitiveConfigKey(key) {
+				if value != nil && value != "" {
+					v[key] = redacted
+				}
+			} else {
+				v[key] = redactConfigValue(value)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = redactConfigValue(value)
+		}
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			u.User = nil
+			return u.String()
+		}
+	}
+	return v
+}
+
+func isSensitiveConfigKey(key string) bool {
+	key = strings.ToLower(key)
+	return slices.ContainsFunc(sensitiveConfigMarkers, func(marker string) bool {
+		return strings.Contains(key, marker)
+	})
+}
+
+// enabledModules returns the names of the modules not disabled by
+// configuration, sorted.
+func enabledModules(config *appConfig) []string {
+	names := make([]string, 0, len(apiModules))
+	for name := range apiModules {
+		if !slices.Contains(config.Modules.Disabled, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultStepUpMaxAge is the default maximum time since the user last
+	// authenticated for accessing sensitive endpoints.
+	defaultStepUpMaxAge = 5 * time.Minute
+
+	// reauthenticationRequired is the code of the error returned when the
+	// user must sign in again before accessing a sensitive endpoint.
+	// The frontend should respond by prompting for a fresh sign-in.
+	reauthenticationRequired = "reauthentication_required"
+)
+
+// requireRecentAuth creates middleware that requires the user to have
+// authenticated within maxAge, by the time of clk, for sensitive operations. It must be
+// applied inside the auth middleware.
+//
+// Stale sessions are rejected with a 401 carrying a step-up challenge
+// as described in RFC 9470, and a JSON body with a distinct reason
+// so the frontend can distinguish it from an expired session.
+func requireRecentAuth(clk clock, maxAge time.Duration, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authFromContext(r.Context())
+		if clk.Now().Sub(auth.authTime) <= maxAge {
+			h(w, r)
+			return
+		}
+		seconds := int(maxAge.Seconds())
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Bearer error="insufficient_user_authentication", `+
+				`error_description="A more recent authentication is required", max_age=%d`,
+			seconds,
+		))
+		writeErrorBody(w, http.StatusUnauthorized, struct {
+			errorResponse
+			MaxAge int `json:"max_age"`
+		}{
+			errorResponse{newAPIError(r, reauthenticationRequired, "A more recent authentication is required")},
+			seconds,
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 20
+
+	// suggestRefreshInterval bounds how stale suggestions get: the tries
+	// are rebuilt from the records on the first request after it.
+	suggestRefreshInterval = 5 * time.Second
+
+	// suggestMaxAge lets clients cache suggestions briefly, so that
+	// typeaheads repeating a prefix, e.g. after a backspace, need not wait
+	// for the backend.
+	suggestMaxAge = 5 * time.Second
+)
+
+// suggestFields maps the record fields suggestions can be made for to
+// their values. Tags are suggested by tagStore.suggest.
+var suggestFields = map[string]func(record SampleRecord) string{
+	"name":     func(record SampleRecord) string { return record.Name },
+	"category": func(record SampleRecord) string { return record.Category },
+	"status":   func(record SampleRecord) string { return record.Status },
+	"assignee": func(record SampleRecord) string { return record.Assignee },
+}
+
+// suggestion is a suggested value, with the number of records having it.
+type suggestion struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// suggestTrie is a trie of values, matched by the prefixes of their
+// words, ignoring case. Each node holds its best suggestions, so that
+// lookups only walk the prefix.
+type suggestTrie struct {
+	children map[rune]*suggestTrie
+	best     []suggestion
+
+	// values counts the values ending at the node.
+	values map[string]int64
+}
+
+func newSuggestTrie() *suggestTrie {
+	return &suggestTrie{children: make(map[rune]*suggestTrie)}
+}
+
+// add adds a value, under each of its words, so that "Database Migration"
+// is suggested for "mig" as well as "data".
+func (t *suggestTrie) add(value string) {
+	lower := []rune(strings.ToLower(value))
+	for i := range lower {
+		if i > 0 && !unicode.IsSpace(lower[i-1]) || unicode.IsSpace(lower[i]) {
+			continue
+		}
+		node := t
+		for _, r := range lower[i:] {
+			child := node.children[r]
+			if child == nil {
+				child = newSuggestTrie()
+				node.children[r] = child
+			}
+			node = child
+		}
+		if node.values == nil {
+			node.values = make(map[string]int64)
+		}
+		node.values[value]++
+	}
+}
+
+// finish computes the best suggestions of each node, once all values have
+// been added, and returns them for t.
+func (t *suggestTrie) finish() []suggestion {
+	counts := make(map[string]int64)
+	for value, count := range t.values {
+		counts[value] = count
+	}
+	for _, child := range t.children {
+		for _, s := range child.finish() {
+			// A value is reachable through each of its words starting with
+			// the node's prefix; count it once.
+			counts[s.Value] = max(counts[s.Value], s.Count)
+		}
+	}
+	t.best = make([]suggestion, 0, len(counts))
+	for value, count := range counts {
+		t.best = append(t.best, suggestion{value, count})
+	}
+	sort.Slice(t.best, func(i, j int) bool {
+		if t.best[i].Count != t.best[j].Count {
+			return t.best[i].Count > t.best[j].Count
+		}
+		return t.best[i].Value < t.best[j].Value
+	})
+	if len(t.best) > maxSuggestions {
+		t.best = t.best[:maxSuggestions]
+	}
+	return t.best
+}
+
+// suggest returns the best size values with a word starting with prefix.
+func (t *suggestTrie) suggest(prefix string, size int) []suggestion {
+	node := t
+	for _, r := range strings.ToLower(prefix) {
+		if node = node.children[r]; node == nil {
+			return []suggestion{}
+		}
+	}
+	return node.best[:min(size, len(node.best))]
+}
+
+// recordSuggester suggests values of record fields from tries, rebuilt
+// from the records at most every suggestRefreshInterval.
+type recordSuggester struct {
+	records recordSource
+	now     func() time.Time
+
+	mu      sync.Mutex
+	tries   map[string]*suggestTrie
+	builtAt time.Time
+}
+
+func newRecordSuggester(records recordSource) *recordSuggester {
+	return &recordSuggester{records: records, now: time.Now}
+}
+
+// suggest returns the best size values of field with a word starting
+// with prefix.
+func (s *recordSuggester) suggest(field, prefix string, size int) []suggestion {
+	s.mu.Lock()
+	if s.tries == nil || s.now().Sub(s.builtAt) >= suggestRefreshInterval {
+		s.tries = make(map[string]*suggestTrie, len(suggestFields))
+		for name := range suggestFields {
+			s.tries[name] = newSuggestTrie()
+		}
+		// The values are the same for all users.
+		for _, record := range s.records("", recordSearch{}) {
+			for name, value := range suggestFields {
+				if v := value(record); v != "" {
+					s.tries[name].add(v)
+				}
+			}
+		}
+		for _, trie := range s.tries {
+			trie.finish()
+		}
+		s.builtAt = s.now()
+	}
+	trie := s.tries[field]
+	s.mu.Unlock()
+	return trie.suggest(strings.TrimSpace(prefix), size)
+}
+
+// registerSuggestRoutes registers the endpoint suggesting values of record
+// fields, for typeaheads.
+func registerSuggestRoutes(routes *routeRegistry, suggester *recordSuggester, tags *tagStore, shares *shareStore) {
+	user := routes.group(groupUser)
+
+	fields := []string{"tags"}
+	for name := range suggestFields {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+
+	user.GET("/api/suggest", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		field := query.Get("field")
+		if !slices.Contains(fields, field) {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("field must be one of %s", strings.Join(fields, ", ")))
+			return
+		}
+		size := defaultSuggestions
+		if param := query.Get("size"); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 1 || n > maxSuggestions {
+				writeError(w, r, http.StatusBadRequest, "size must be between 1 and "+strconv.Itoa(maxSuggestions))
+				return
+			}
+			size = n
+		}
+
+		var suggestions []suggestion
+		if field == "tags" {
+			auth := authFromContext(r.Context())
+			hidden := shares.hidden(shares.accessor(auth.userID, auth.roles))
+			tagCounts, err := tags.suggest(r.Context(), query.Get("prefix"), size, hidden)
+			if err != nil {
+				writeError(w, r, http.StatusBadGateway, err.Error())
+				return
+			}
+			suggestions = make([]suggestion, 0, len(tagCounts))
+			for _, tc := range tagCounts {
+				suggestions = append(suggestions, suggestion{tc.Tag, tc.Count})
+			}
+		} else {
+			suggestions = suggester.suggest(field, query.Get("prefix"), size)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(suggestMaxAge.Seconds())))
+		json.NewEncoder(w).Encode(struct {
+			Suggestions []suggestion `json:"suggestions"`
+		}{suggestions})
+	})
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	recordTagsIndex = "app-record-tags"
+
+	maxTagLength     = 64
+	maxTagsPerRecord = 20
+
+	defaultTagSuggestions = 10
+	maxTagSuggestions     = 100
+)
+
+var (
+	errTagInvalid    = errors.New("tags must be 1 to 64 characters, without commas or control characters")
+	errTooManyTags   = fmt.Errorf("records may have at most %d tags", maxTagsPerRecord)
+	errUnknownRecord = errors.New("unknown record")
+)
+
+// normalizeTag returns the canonical form of a tag: trimmed and lowercased,
+// so that tags differing only in case are the same tag.
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || utf8.RuneCountInString(tag) > maxTagLength || strings.ContainsFunc(tag, func(r rune) bool {
+		return r == ',' || r < ' ' || r == 0x7f
+	}) {
+		return "", errTagInvalid
+	}
+	return tag, nil
+}
+
+// recordTagsDocument is the document holding the tags of a record.
+type recordTagsDocument struct {
+	RecordID  string    `json:"record_id"`
+	Tags      []string  `json:"tags"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// tagCount is a tag suggestion, with the number of records tagged with it.
+type tagCount struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+}
+
+// tagStore manages the tags of records, persisted to Elasticsearch if
+// configured, with a document per record.
+type tagStore struct {
+	client *elasticsearch.Client
+	logger *zap.Logger
+
+	// reads coalesces identical concurrent suggestion queries.
+	reads *readCoalescer
+
+	// writeMu serializes writes, so that documents are persisted in the
+	// order they were changed.
+	writeMu sync.Mutex
+
+	mu   sync.RWMutex
+	tags map[string][]string
+}
+
+func newTagStore(client *elasticsearch.Client, logger *zap.Logger) (*tagStore, error) {
+	s := &tagStore{
+		client: client,
+		logger: logger,
+		tags:   make(map[string][]string),
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init tag store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing tags from Elasticsearch.
+func (s *tagStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initTagStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(recordTagsIndex),
+		s.client.Search.WithSize(10000),
+	)
+	if err != nil {
+		logger.Info("could not load record tags from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.Info("could not load record tags from Elasticsearch", zap.String("status", res.Status()))
+		return nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source recordTagsDocument `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		if len(hit.Source.Tags) > 0 {
+			slices.Sort(hit.Source.Tags)
+			s.tags[hit.Source.RecordID] = hit.Source.Tags
+		}
+	}
+
+	logger.Info("loaded record tags", zap.Int("records", len(s.tags)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// get returns the tags of a record, sorted.
+func (s *tagStore) get(recordID string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tags[recordID]
+}
+
+// add tags a record. Adding a tag the record already has is a no-op.
+func (s *tagStore) add(ctx context.Context, recordID, tag string) error {
+	return s.update(ctx, recordID, func(tags []string) ([]string, error) {
+		i, found := slices.BinarySearch(tags, tag)
+		if found {
+			return tags, nil
+		}
+		if len(tags) >= maxTagsPerRecord {
+			return nil, errTooManyTags
+		}
+		return slices.Insert(slices.Clone(tags), i, tag), nil
+	})
+}
+
+// remove untags a record. Removing a tag the record lacks is a no-op.
+func (s *tagStore) remove(ctx context.Context, recordID, tag string) error {
+	return s.update(ctx, recordID, func(tags []string) ([]string, error) {
+		i, found := slices.BinarySearch(tags, tag)
+		if !found {
+			return tags, nil
+		}
+		return slices.Delete(slices.Clone(tags), i, i+1), nil
+	})
+}
+
+func (s *tagStore) update(ctx context.Context, recordID string, change func([]string) ([]string, error)) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	current := s.get(recordID)
+	tags, err := change(current)
+	if err != nil {
+		return err
+	}
+	if len(tags) == len(current) {
+		return nil
+	}
+
+	s.mu.Lock()
+	if len(tags) == 0 {
+		delete(s.tags, recordID)
+	} else {
+		s.tags[recordID] = tags
+	}
+	s.mu.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+	doc := recordTagsDocument{RecordID: recordID, Tags: tags, UpdatedAt: time.Now().UTC()}
+	if doc.Tags == nil {
+		doc.Tags = []string{}
+	}
+	res, err := s.client.Index(
+		recordTagsIndex, esutil.NewJSONReader(doc),
+		s.client.Index.WithDocumentID(recordID),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving record tags: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving record tags failed: %s", res.Status())
+	}
+	return nil
+}
+
+// suggest returns the most used tags starting with prefix, with a terms
+// aggregation if Elasticsearch is configured, leaving out the tags of the
+// records hidden, the sorted IDs of those the user may not read.
+func (s *tagStore) suggest(ctx context.Context, prefix string, size int, hidden []string) ([]tagCount, error) {
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	if s.client == nil {
+		return s.suggestInMemory(prefix, size, hidden), nil
+	}
+	key := fmt.Sprintf("%d/%q/%s", size, prefix, strings.Join(hidden, ","))
+	return coalesce(ctx, s.reads, "tags.suggest", key, func(ctx context.Context) ([]tagCount, error) {
+		return s.suggestFromES(ctx, prefix, size, hidden)
+	})
+}
+
+func (s *tagStore) suggestFromES(ctx context.Context, prefix string, size int, hidden []string) ([]tagCount, error) {
+	terms := map[string]interface{}{"field": "tags", "size": size}
+	if prefix != "" {
+		terms["include"] = regexpQuote(prefix) + ".*"
+	}
+	query := map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"tags": map[string]interface{}{"terms": terms},
+		},
+	}
+	if len(hidden) > 0 {
+		query["query"] = map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must_not": map[string]interface{}{"ids": map[string]interface{}{"values": hidden}},
+			},
+		}
+	}
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(recordTagsIndex),
+		s.client.Search.WithBody(esutil.NewJSONReader(query)),
+		s.client.Search.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, errors.New("tag suggestion search failed: " + res.Status())
+	}
+	var result struct {
+		Aggregations struct {
+			Tags struct {
+				Buckets []struct {
+					Key      string `json:"key"`
+					DocCount int64  `json:"doc_count"`
+				} `json:"buckets"`
+			} `json:"tags"`
+		} `json:"aggregations"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	suggestions := make([]tagCount, 0, len(result.Aggregations.Tags.Buckets))
+	for _, bucket := range result.Aggregations.Tags.Buckets {
+		suggestions = append(suggestions, tagCount{bucket.Key, bucket.DocCount})
+	}
+	return suggestions, nil
+}
+
+// suggestInMemory is suggest without Elasticsearch, ordered like a terms
+// aggregation: by count, then by tag.
+func (s *tagStore) suggestInMemory(prefix string, size int, hidden []string) []tagCount {
+	counts := make(map[string]int64)
+	s.mu.RLock()
+	for recordID, tags := range s.tags {
+		if _, found := slices.BinarySearch(hidden, recordID); found {
+			continue
+		}
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, prefix) {
+				counts[tag]++
+			}
+		}
+	}
+	s.mu.RUnlock()
+	suggestions := make([]tagCount, 0, len(counts))
+	for tag, count := range counts {
+		suggestions = append(suggestions, tagCount{tag, count})
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Count != suggestions[j].Count {
+			return suggestions[i].Count > suggestions[j].Count
+		}
+		return suggestions[i].Tag < suggestions[j].Tag
+	})
+	if len(suggestions) > size {
+		suggestions = suggestions[:size]
+	}
+	return suggestions
+}
+
+// regexpQuote escapes the characters of s that are special in Lucene
+// regular expressions.
+func regexpQuote(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`.?+*|{}[]()"\#@&<>~`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// tagged returns copies of records with their tags, keeping only those
+// with all of the tags in filter.
+func (s *tagStore) tagged(records []SampleRecord, filter []string) []SampleRecord {
+	result := make([]SampleRecord, 0, len(records))
+	for _, record := range records {
+		record.Tags = s.get(record.ID)
+		if !containsAll(record.Tags, filter) {
+			continue
+		}
+		if record.Tags == nil {
+			record.Tags = []string{}
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+func containsAll(tags, filter []string) bool {
+	for _, tag := range filter {
+		if _, found := slices.BinarySearch(tags, tag); !found {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTagFilter returns the normalized tags of the "tag" query parameters
+// of r, which list endpoints filter records by.
+func parseTagFilter(r *http.Request) ([]string, error) {
+	var filter []string
+	for _, tag := range r.URL.Query()["tag"] {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, tag)
+	}
+	return filter, nil
+}
+
+// registerTagRoutes registers the endpoints for tagging records and
+// suggesting tags.
+func registerTagRoutes(routes *routeRegistry, tags *tagStore, records *recordStore, shares *shareStore, logger *zap.Logger) {
+	user := routes.group(groupUser)
+
+	change := func(apply func(ctx context.Context, recordID, tag string) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			recordID := r.PathValue("id")
+			if !records.exists(recordID) {
+				writeError(w, r, http.StatusNotFound, errUnknownRecord.Error())
+				return
+			}
+			tag, err := normalizeTag(r.PathValue("tag"))
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := apply(r.Context(), recordID, tag); errors.Is(err, errTooManyTags) {
+				writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			} else if err != nil {
+				logger.Error("failed to save record tags", append(traceLogFields(r.Context()), zap.Error(err))...)
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	user.PUT("/api/data/{id}/tags/{tag}", change(tags.add))
+	user.DELETE("/api/data/{id}/tags/{tag}", change(tags.remove))
+
+	user.GET("/api/tags/suggest", func(w http.ResponseWriter, r *http.Request) {
+		size := defaultTagSuggestions
+		if param := r.URL.Query().Get("size"); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 1 || n > maxTagSuggestions {
+				writeError(w, r, http.StatusBadRequest, "size must be between 1 and "+strconv.Itoa(maxTagSuggestions))
+				return
+			}
+			size = n
+		}
+		// Only the tags of records the user may read are suggested.
+		auth := authFromContext(r.Context())
+		hidden := shares.hidden(shares.accessor(auth.userID, auth.roles))
+		suggestions, err := tags.suggest(r.Context(), r.URL.Query().Get("prefix"), size, hidden)
+		if err != nil {
+			writeError(w, r, http.StatusBadGateway, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Tags []tagCount `json:"tags"`
+		}{suggestions})
+	})
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	teamsIndex = "app-teams"
+
+	// teamCookieName holds the team selected for the session, encoded
+	// with the secure cookies.
+	teamCookieName = "team"
+
+	maxTeamNameLength = 100
+
+	auditActionTeamCreated       = "team.created"
+	auditActionTeamDeleted       = "team.deleted"
+	auditActionTeamMemberChanged = "team.member_changed"
+)
+
+// Roles of team members.
+const (
+	teamRoleAdmin  = "admin"
+	teamRoleMember = "member"
+)
+
+var (
+	errTeamNotFound     = errors.New("team not found")
+	errTeamAdminOnly    = errors.New("only team admins may manage the team")
+	errLastTeamAdmin    = errors.New("a team must keep at least one admin")
+	errInvalidTeamName  = fmt.Errorf("team name must be 1 to %d characters", maxTeamNameLength)
+	errInvalidTeamRole  = errors.New("role must be admin or member")
+	errTeamNotSelected  = errors.New("no team selected")
+	errTeamMemberAbsent = errors.New("not a member of the team")
+)
+
+// team organizes users, and the records and preferences they share.
+type team struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// Members maps the user IDs of members to their role in the team.
+	Members map[string]string `json:"members"`
+
+	// Preferences holds settings shared by the team's members, such as
+	// defaults of the frontend.
+	Preferences map[string]string `json:"preferences"`
+
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// isAdmin reports whether a user is an admin of the team.
+func (t *team) isAdmin(userID string) bool {
+	return t.Members[userID] == teamRoleAdmin
+}
+
+// admins returns the number of admins of the team.
+func (t *team) admins() int {
+	n := 0
+	for _, role := range t.Members {
+		if role == teamRoleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// clone returns a deep copy of the team, for changes to be applied to
+// before they are saved.
+func (t *team) clone() *team {
+	c := *t
+	c.Members = make(map[string]string, len(t.Members))
+	for userID, role := range t.Members {
+		c.Members[userID] = role
+	}
+	c.Preferences = make(map[string]string, len(t.Preferences))
+	for name, value := range t.Preferences {
+		c.Preferences[name] = value
+	}
+	return &c
+}
+
+// teamStore manages teams, persisted to Elasticsearch if configured, with
+// a document per team.
+type teamStore struct {
+	client        *elasticsearch.Client
+	logger        *zap.Logger
+	invalidations *invalidator
+	ids           idSource
+
+	mu    sync.RWMutex
+	teams map[string]*team
+}
+
+func newTeamStore(client *elasticsearch.Client, logger *zap.Logger) (*teamStore, error) {
+	s := &teamStore{
+		client: client,
+		logger: logger,
+		ids:    cryptoIDs{},
+		teams:  make(map[string]*team),
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init team store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing teams from Elasticsearch.
+func (s *teamStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initTeamStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(teamsIndex),
+		s.client.Search.WithSize(10000),
+	)
+	if err != nil {
+		logger.Info("could not load teams from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.Info("could not load teams from Elasticsearch", zap.String("status", res.Status()))
+		return nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source team `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	for i := range searchResult.Hits.Hits {
+		t := &searchResult.Hits.Hits[i].Source
+		s.teams[t.ID] = t
+	}
+
+	logger.Info("loaded teams", zap.Int("teams", len(s.teams)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// watch propagates teams changed by other replicas, reloading them from
+// Elasticsearch.
+func (s *teamStore) watch(invalidations *invalidator) {
+	s.invalidations = invalidations
+	invalidations.subscribe(invalidateTeam, func(ctx context.Context, inv invalidation) {
+		if err := s.reload(ctx, inv.Key); err != nil {
+			s.logger.Warn("failed to reload team", zap.String("team.id", inv.Key), zap.Error(err))
+		}
+	})
+}
+
+// reload loads a team from Elasticsearch, replacing the one in memory.
+func (s *teamStore) reload(ctx context.Context, teamID string) error {
+	res, err := s.client.Get(teamsIndex, teamID, s.client.Get.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("while loading team: %w", err)
+	}
+	defer res.Body.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if res.StatusCode == http.StatusNotFound {
+		delete(s.teams, teamID)
+		return nil
+	}
+	if res.IsError() {
+		return fmt.Errorf("loading team failed: %s", res.Status())
+	}
+	var doc struct {
+		Source team `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return err
+	}
+	s.teams[teamID] = &doc.Source
+	return nil
+}
+
+// get returns a copy of a team.
+func (s *teamStore) get(teamID string) (*team, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.teams[teamID]
+	if !ok {
+		return nil, errTeamNotFound
+	}
+	return t.clone(), nil
+}
+
+// forUser returns copies of the teams a user is a member of, by name.
+func (s *teamStore) forUser(userID string) []*team {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []*team
+	for _, t := range s.teams {
+		if _, ok := t.Members[userID]; ok {
+			result = append(result, t.clone())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// teamsOf returns the IDs of the teams a user is a member of.
+func (s *teamStore) teamsOf(userID string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []string
+	for id, t := range s.teams {
+		if _, ok := t.Members[userID]; ok {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// create creates a team, whose creator is its first admin.
+func (s *teamStore) create(ctx context.Context, name, userID string) (*team, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxTeamNameLength {
+		return nil, errInvalidTeamName
+	}
+	now := time.Now().UTC()
+	t := &team{
+		ID:          s.ids.NewID(),
+		Name:        name,
+		Members:     map[string]string{userID: teamRoleAdmin},
+		Preferences: map[string]string{},
+		CreatedBy:   userID,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := s.put(ctx, t); err != nil {
+		return nil, err
+	}
+	return t.clone(), nil
+}
+
+// update applies a change to a team, then saves it.
+func (s *teamStore) update(ctx context.Context, teamID string, change func(t *team) error) (*team, error) {
+	s.mu.Lock()
+	current, ok := s.teams[teamID]
+	if !ok {
+		s.mu.Unlock()
+		return nil, errTeamNotFound
+	}
+	t := current.clone()
+	if err := change(t); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	t.UpdatedAt = time.Now().UTC()
+	s.teams[teamID] = t
+	s.mu.Unlock()
+	if err := s.save(ctx, t); err != nil {
+		return nil, err
+	}
+	return t.clone(), nil
+}
+
+// setMember adds a member to a team, or changes their role, on behalf of
+// actorID, who must be an admin of the team.
+func (s *teamStore) setMember(ctx context.Context, teamID, actorID, userID, role string) (*team, error) {
+	if role != teamRoleAdmin && role != teamRoleMember {
+		return nil, errInvalidTeamRole
+	}
+	return s.update(ctx, teamID, func(t *team) error {
+		if !t.isAdmin(actorID) {
+			return errTeamAdminOnly
+		}
+		if t.isAdmin(userID) && role != teamRoleAdmin && t.admins() == 1 {
+			return errLastTeamAdmin
+		}
+		t.Members[userID] = role
+		return nil
+	})
+}
+
+// join adds a user to a team with a role, as when they accept an
+// invitation. Members keep their role if it is admin.
+func (s *teamStore) join(ctx context.Context, teamID, userID, role string) (*team, error) {
+	if role != teamRoleAdmin && role != teamRoleMember {
+		return nil, errInvalidTeamRole
+	}
+	return s.update(ctx, teamID, func(t *team) error {
+		if !t.isAdmin(userID) {
+			t.Members[userID] = role
+		}
+		return nil
+	})
+}
+
+// removeMember removes a member from a team on behalf of actorID, who must
+// be an admin of the team, or the member leaving it.
+func (s *teamStore) removeMember(ctx context.Context, teamID, actorID, userID string) (*team, error) {
+	return s.update(ctx, teamID, func(t *team) error {
+		if actorID != userID && !t.isAdmin(actorID) {
+			return errTeamAdminOnly
+		}
+		if _, ok := t.Members[userID]; !ok {
+			return errTeamMemberAbsent
+		}
+		if t.isAdmin(userID) && t.admins() == 1 {
+			return errLastTeamAdmin
+		}
+		delete(t.Members, userID)
+		return nil
+	})
+}
+
+// setPreferences replaces the preferences of a team on behalf of actorID,
+// who must be an admin of the team.
+func (s *teamStore) setPreferences(ctx context.Context, teamID, actorID string, preferences map[string]string) (*team, error) {
+	return s.update(ctx, teamID, func(t *team) error {
+		if !t.isAdmin(actorID) {
+			return errTeamAdminOnly
+		}
+		t.Preferences = preferences
+		if t.Preferences == nil {
+			t.Preferences = map[string]string{}
+		}
+		return nil
+	})
+}
+
+// put stores a new team.
+func (s *teamStore) put(ctx context.Context, t *team) error {
+	s.mu.Lock()
+	s.teams[t.ID] = t
+	s.mu.Unlock()
+	return s.save(ctx, t)
+}
+
+func (s *teamStore) save(ctx context.Context, t *team) error {
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Index(
+		teamsIndex, esutil.NewJSONReader(t),
+		s.client.Index.WithDocumentID(t.ID),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving team: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving team failed: %s", res.Status())
+	}
+	s.invalidations.notify(ctx, invalidateTeam, t.ID, t.UpdatedAt)
+	return nil
+}
+
+// remove deletes a team on behalf of actorID, who must be an admin of the
+// team.
+func (s *teamStore) remove(ctx context.Context, teamID, actorID string) error {
+	s.mu.Lock()
+	t, ok := s.teams[teamID]
+	switch {
+	case !ok:
+		s.mu.Unlock()
+		return errTeamNotFound
+	case !t.isAdmin(actorID):
+		s.mu.Unlock()
+		return errTeamAdminOnly
+	}
+	delete(s.teams, teamID)
+	s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Delete(teamsIndex, teamID, s.client.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("while deleting team: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting team failed: %s", res.Status())
+	}
+	s.invalidations.notify(ctx, invalidateTeam, teamID, time.Now())
+	return nil
+}
+
+type teamKey struct{}
+
+// teamFromContext returns the team selected for the session, or nil if
+// none is.
+func teamFromContext(ctx context.Context) *team {
+	t, _ := ctx.Value(teamKey{}).(*team)
+	return t
+}
+
+// middleware resolves the team selected for the session, for handlers to
+// get with teamFromContext. Selections of teams the user is no longer a
+// member of are ignored. It must run after authentication.
+func (s *teamStore) middleware(secureCookies secureCookies) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth, _ := r.Context().Value(authKey{}).(*authDetails)
+			cookie, err := r.Cookie(teamCookieName)
+			if auth == nil || err != nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+			teamID, err := secureCookies.Decode(cookie.Value)
+			if err != nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if t, err := s.get(teamID); err == nil && t.Members[auth.userID] != "" {
+				r = r.WithContext(context.WithValue(r.Context(), teamKey{}, t))
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseTeamOnly parses the team_only query parameter, returning the ID of
+// the session's team if records are to be limited to those shared with it.
+func parseTeamOnly(r *http.Request) (string, error) {
+	param := r.URL.Query().Get("team_only")
+	if param == "" {
+		return "", nil
+	}
+	teamOnly, err := strconv.ParseBool(param)
+	if err != nil {
+		return "", fmt.Errorf("invalid team_only %q", param)
+	}
+	if !teamOnly {
+		return "", nil
+	}
+	t := teamFromContext(r.Context())
+	if t == nil {
+		return "", errTeamNotSelected
+	}
+	return t.ID, nil
+}
+
+// clearTeamCookie instructs the browser to drop the session's team
+// selection.
+func clearTeamCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     teamCookieName,
+		Path:     credentialsCookiePath,
+		Value:    "",
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+}
+
+// teamError writes the response of an error of the team store.
+func teamError(w http.ResponseWriter, r *http.Request, err error, logger *zap.Logger) {
+	switch {
+	case errors.Is(err, errTeamNotFound):
+		writeError(w, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, errTeamAdminOnly):
+		writeError(w, r, http.StatusForbidden, err.Error())
+	case errors.Is(err, errLastTeamAdmin), errors.Is(err, errTeamMemberAbsent):
+		writeError(w, r, http.StatusConflict, err.Error())
+	case errors.Is(err, errInvalidTeamName), errors.Is(err, errInvalidTeamRole):
+		writeError(w, r, http.StatusBadRequest, err.Error())
+	default:
+		logger.Error("failed to save team", append(traceLogFields(r.Context()), zap.Error(err))...)
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// registerTeamRoutes registers the endpoints for managing teams, their
+// members and preferences, and selecting the session's team.
+func registerTeamRoutes(
+	routes *routeRegistry,
+	teams *teamStore,
+	secureCookies secureCookies,
+	audit *auditLog,
+	logger *zap.Logger,
+) {
+	user := routes.group(groupUser)
+
+	writeTeam := func(w http.ResponseWriter, status int, t *team) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(t)
+	}
+
+	// member returns the team of the request's path, if the user is a
+	// member. Teams of other users are reported as not found.
+	member := func(w http.ResponseWriter, r *http.Request) (*team, bool) {
+		t, err := teams.get(r.PathValue("team"))
+		if err == nil && t.Members[authFromContext(r.Context()).userID] == "" {
+			err = errTeamNotFound
+		}
+		if err != nil {
+			teamError(w, r, err, logger)
+			return nil, false
+		}
+		return t, true
+	}
+
+	user.GET("/api/teams", func(w http.ResponseWriter, r *http.Request) {
+		result := struct {
+			Teams    []*team `json:"teams"`
+			Selected string  `json:"selected,omitempty"`
+		}{Teams: teams.forUser(authFromContext(r.Context()).userID)}
+		if result.Teams == nil {
+			result.Teams = []*team{}
+		}
+		if t := teamFromContext(r.Context()); t != nil {
+			result.Selected = t.ID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	user.POST("/api/teams", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		auth := authFromContext(r.Context())
+		t, err := teams.create(r.Context(), req.Name, auth.userID)
+		if err != nil {
+			teamError(w, r, err, logger)
+			return
+		}
+		audit.record(r.Context(), auditActionTeamCreated, auth.userID, t.ID, map[string]string{"name": t.Name})
+		writeTeam(w, http.StatusCreated, t)
+	})
+
+	user.GET("/api/teams/{team}", func(w http.ResponseWriter, r *http.Request) {
+		if t, ok := member(w, r); ok {
+			writeTeam(w, http.StatusOK, t)
+		}
+	})
+
+	user.DELETE("/api/teams/{team}", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := member(w, r); !ok {
+			return
+		}
+		auth := authFromContext(r.Context())
+		if err := teams.remove(r.Context(), r.PathValue("team"), auth.userID); err != nil {
+			teamError(w, r, err, logger)
+			return
+		}
+		audit.record(r.Context(), auditActionTeamDeleted, auth.userID, r.PathValue("team"), nil)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	user.PUT("/api/teams/{team}/members/{user_id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := member(w, r); !ok {
+			return
+		}
+		var req struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		auth := authFromContext(r.Context())
+		t, err := teams.setMember(r.Context(), r.PathValue("team"), auth.userID, r.PathValue("user_id"), req.Role)
+		if err != nil {
+			teamError(w, r, err, logger)
+			return
+		}
+		audit.record(r.Context(), auditActionTeamMemberChanged, auth.userID, t.ID, map[string]string{
+			"member": r.PathValue("user_id"),
+			"role":   req.Role,
+		})
+		writeTeam(w, http.StatusOK, t)
+	})
+
+	user.DELETE("/api/teams/{team}/members/{user_id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := member(w, r); !ok {
+			return
+		}
+		auth := authFromContext(r.Context())
+		t, err := teams.removeMember(r.Context(), r.PathValue("team"), auth.userID, r.PathValue("user_id"))
+		if err != nil {
+			teamError(w, r, err, logger)
+			return
+		}
+		audit.record(r.Context(), auditActionTeamMemberChanged, auth.userID, t.ID, map[string]string{
+			"member": r.PathValue("user_id"),
+			"role":   "",
+		})
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	user.GET("/api/teams/{team}/preferences", func(w http.ResponseWriter, r *http.Request) {
+		if t, ok := member(w, r); ok {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(t.Preferences)
+		}
+	})
+
+	user.PUT("/api/teams/{team}/preferences", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := member(w, r); !ok {
+			return
+		}
+		var preferences map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&preferences); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		t, err := teams.setPreferences(r.Context(), r.PathValue("team"), authFromContext(r.Context()).userID, preferences)
+		if err != nil {
+			teamError(w, r, err, logger)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.Preferences)
+	})
+
+	// The selected team is kept in a cookie alongside the credentials,
+	// and checked against the team's members on every request.
+	user.PUT("/api/session/team", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Team string `json:"team"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		t, err := teams.get(req.Team)
+		if err == nil && t.Members[authFromContext(r.Context()).userID] == "" {
+			err = errTeamNotFound
+		}
+		if err != nil {
+			teamError(w, r, err, logger)
+			return
+		}
+		value, err := secureCookies.Encode(t.ID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     teamCookieName,
+			Path:     credentialsCookiePath,
+			Value:    value,
+			Secure:   true,
+			HttpOnly: true,
+		})
+		writeTeam(w, http.StatusOK, t)
+	})
+
+	user.DELETE("/api/session/team", func(w http.ResponseWriter, r *http.Request) {
+		clearTeamCookie(w)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	tenantsIndex = "app-tenants"
+
+	// defaultAppName is the name of the application shown to users of
+	// tenants which do not override it.
+	defaultAppName = "App Scaffold"
+)
+
+var errTenantNotFound = errors.New("tenant not found")
+
+// tenantQuotas holds limits which tenants may override. Zero values
+// inherit the configured limits.
+type tenantQuotas struct {
+	AttachmentMaxSize int64 `json:"attachment_max_size,omitempty"`
+	UploadMaxSize     int64 `json:"upload_max_size,omitempty"`
+}
+
+// tenantBranding holds strings shown to users which tenants may override.
+// Empty values inherit the configured branding.
+type tenantBranding struct {
+	AppName string `json:"app_name,omitempty"`
+}
+
+// tenantOverrides holds a tenant's overrides of configuration values.
+type tenantOverrides struct {
+	Tenant    string          `json:"tenant"`
+	Features  map[string]bool `json:"features,omitempty"`
+	Quotas    tenantQuotas    `json:"quotas"`
+	Branding  tenantBranding  `json:"branding"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// tenantSettings holds the configuration values in effect for a tenant:
+// its overrides, merged over the configuration.
+type tenantSettings struct {
+	Tenant   string          `json:"tenant,omitempty"`
+	Features map[string]bool `json:"features"`
+	Quotas   tenantQuotas    `json:"quotas"`
+	Branding tenantBranding  `json:"branding"`
+}
+
+// featureEnabled reports whether a feature flag is on.
+func (t *tenantSettings) featureEnabled(name string) bool {
+	return t.Features[name]
+}
+
+type tenantKey struct{}
+
+// tenantSettingsFromContext returns the settings resolved for the tenant
+// of the request's session, or the configured ones if none were resolved.
+func tenantSettingsFromContext(ctx context.Context) *tenantSettings {
+	if t, ok := ctx.Value(tenantKey{}).(*tenantSettings); ok {
+		return t
+	}
+	return &tenantSettings{Branding: tenantBranding{AppName: defaultAppName}}
+}
+
+// tenantOf returns the tenant of a session: the Microsoft Entra ID tenant
+// ("tid" claim), or else the Google Workspace domain ("hd" claim). Users
+// of personal accounts have no tenant.
+func tenantOf(auth *authDetails) string {
+	if auth == nil {
+		return ""
+	}
+	if tid, _ := auth.claims["tid"].(string); tid != "" {
+		return tid
+	}
+	hd, _ := auth.claims["hd"].(string)
+	return hd
+}
+
+// tenantStore manages tenants' overrides of configuration values, such as
+// feature flags, quotas, and branding strings, persisted to Elasticsearch
+// if configured, with a document per tenant.
+type tenantStore struct {
+	client        *elasticsearch.Client
+	logger        *zap.Logger
+	features      map[string]bool
+	appName       string
+	invalidations *invalidator
+
+	mu        sync.RWMutex
+	overrides map[string]*tenantOverrides
+}
+
+func newTenantStore(config *appConfig, client *elasticsearch.Client, logger *zap.Logger) (*tenantStore, error) {
+	s := &tenantStore{
+		client:    client,
+		logger:    logger,
+		features:  config.Features,
+		appName:   config.Branding.AppName,
+		overrides: make(map[string]*tenantOverrides),
+	}
+	if s.appName == "" {
+		s.appName = defaultAppName
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init tenant store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing overrides from Elasticsearch.
+func (s *tenantStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initTenantStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(tenantsIndex),
+		s.client.Search.WithSize(10000),
+	)
+	if err != nil {
+		logger.Info("could not load tenant overrides from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.Info("could not load tenant overrides from Elasticsearch", zap.String("status", res.Status()))
+		return nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source tenantOverrides `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	for i := range searchResult.Hits.Hits {
+		o := &searchResult.Hits.Hits[i].Source
+		s.overrides[o.Tenant] = o
+	}
+
+	logger.Info("loaded tenant overrides", zap.Int("tenants", len(s.overrides)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// watch propagates overrides changed by other replicas, reloading them
+// from Elasticsearch.
+func (s *tenantStore) watch(invalidations *invalidator) {
+	s.invalidations = invalidations
+	invalidations.subscribe(invalidateTenant, func(ctx context.Context, inv invalidation) {
+		if err := s.reload(ctx, inv.Key); err != nil {
+			s.logger.Warn("failed to reload tenant overrides", zap.String("tenant", inv.Key), zap.Error(err))
+		}
+	})
+}
+
+// reload loads a tenant's overrides from Elasticsearch, replacing those in
+// memory.
+func (s *tenantStore) reload(ctx context.Context, tenant string) error {
+	res, err := s.client.Get(tenantsIndex, tenant, s.client.Get.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("while loading tenant overrides: %w", err)
+	}
+	defer res.Body.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if res.StatusCode == http.StatusNotFound {
+		delete(s.overrides, tenant)
+		return nil
+	}
+	if res.IsError() {
+		return fmt.Errorf("loading tenant overrides failed: %s", res.Status())
+	}
+	var doc struct {
+		Source tenantOverrides `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return err
+	}
+	s.overrides[tenant] = &doc.Source
+	return nil
+}
+
+// resolve returns the settings in effect for a tenant.
+func (s *tenantStore) resolve(tenant string) *tenantSettings {
+	t := &tenantSettings{
+		Tenant:   tenant,
+		Features: make(map[string]bool, len(s.features)),
+		Branding: tenantBranding{AppName: s.appName},
+	}
+	for name, enabled := range s.features {
+		t.Features[name] = enabled
+	}
+	if tenant == "" {
+		return t
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o := s.overrides[tenant]
+	if o == nil {
+		return t
+	}
+	for name, enabled := range o.Features {
+		t.Features[name] = enabled
+	}
+	t.Quotas = o.Quotas
+	if o.Branding.AppName != "" {
+		t.Branding.AppName = o.Branding.AppName
+	}
+	return t
+}
+
+// middleware resolves the settings of the tenant of the request's session,
+// for handlers to get with tenantSettingsFromContext. It must run after
+// authentication.
+func (s *tenantStore) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, _ := r.Context().Value(authKey{}).(*authDetails)
+		ctx := context.WithValue(r.Context(), tenantKey{}, s.resolve(tenantOf(auth)))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// list returns all tenants' overrides, sorted by tenant.
+func (s *tenantStore) list() []*tenantOverrides {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]*tenantOverrides, 0, len(s.overrides))
+	for _, o := range s.overrides {
+		result = append(result, o)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Tenant < result[j].Tenant })
+	return result
+}
+
+// get returns a tenant's overrides.
+func (s *tenantStore) get(tenant string) (*tenantOverrides, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.overrides[tenant]
+	if !ok {
+		return nil, errTenantNotFound
+	}
+	return o, nil
+}
+
+// put replaces a tenant's overrides.
+func (s *tenantStore) put(ctx context.Context, o *tenantOverrides) error {
+	o.UpdatedAt = time.Now().UTC()
+	s.mu.Lock()
+	s.overrides[o.Tenant] = o
+	s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Index(
+		tenantsIndex, esutil.NewJSONReader(o),
+		s.client.Index.WithDocumentID(o.Tenant),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving tenant overrides: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving tenant overrides failed: %s", res.Status())
+	}
+	s.invalidations.notify(ctx, invalidateTenant, o.Tenant, o.UpdatedAt)
+	return nil
+}
+
+// remove deletes a tenant's overrides, so that it inherits the
+// configuration again.
+func (s *tenantStore) remove(ctx context.Context, tenant string) error {
+	s.mu.Lock()
+	_, ok := s.overrides[tenant]
+	delete(s.overrides, tenant)
+	s.mu.Unlock()
+	if !ok {
+		return errTenantNotFound
+	}
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Delete(tenantsIndex, tenant, s.client.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("while deleting tenant overrides: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting tenant overrides failed: %s", res.Status())
+	}
+	s.invalidations.notify(ctx, invalidateTenant, tenant, time.Now())
+	return nil
+}
+
+// registerTenantRoutes registers the admin endpoints managing tenants'
+// overrides of configuration values.
+func registerTenantRoutes(routes *routeRegistry, tenants *tenantStore, confirm *confirmations, logger *zap.Logger) {
+	admin := routes.group(groupAdmin)
+
+	admin.GET("/api/admin/tenants", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tenants.list())
+	})
+
+	admin.GET("/api/admin/tenants/{tenant}", func(w http.ResponseWriter, r *http.Request) {
+		o, err := tenants.get(r.PathValue("tenant"))
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			*tenantOverrides
+			Effective *tenantSettings `json:"effective"`
+		}{o, tenants.resolve(o.Tenant)})
+	})
+
+	admin.PUT("/api/admin/tenants/{tenant}", func(w http.ResponseWriter, r *http.Request) {
+		var o tenantOverrides
+		if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if o.Quotas.AttachmentMaxSize < 0 || o.Quotas.UploadMaxSize < 0 {
+			writeError(w, r, http.StatusBadRequest, "quotas must not be negative")
+			return
+		}
+		for name := range o.Features {
+			if name == "" {
+				writeError(w, r, http.StatusBadRequest, "feature names must not be empty")
+				return
+			}
+		}
+		o.Tenant = r.PathValue("tenant")
+		if dryRun(w, r, mutationEffect{DocumentsAffected: 1}) {
+			return
+		}
+		if err := tenants.put(r.Context(), &o); err != nil {
+			logger.Error("failed to save tenant overrides", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&o)
+	}, dryRunRoute())
+
+	admin.DELETE("/api/admin/tenants/{tenant}", confirm.wrap(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := tenants.get(r.PathValue("tenant")); err != nil {
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		if dryRun(w, r, mutationEffect{DocumentsAffected: 1}) {
+			return
+		}
+		err := tenants.remove(r.Context(), r.PathValue("tenant"))
+		switch {
+		case errors.Is(err, errTenantNotFound):
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		case err != nil:
+			logger.Error("failed to delete tenant overrides", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}), dryRunRoute())
+}
@@ -0,0 +1,193 @@
+package testsupport
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// Authenticator is a virtual WebAuthn authenticator, standing in for the
+// browser and a security key, so that tests can go through registration
+// and assertion ceremonies. Its passkeys are P-256 keys, attested with
+// the "none" format. It is safe for concurrent use.
+type Authenticator struct {
+	origin string
+
+	mu       sync.Mutex
+	passkeys []*passkey
+}
+
+type passkey struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+// NewAuthenticator returns an authenticator without passkeys, for a
+// client at origin, such as "https://localhost:8443".
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{origin: origin}
+}
+
+// Create answers the options of a registration ceremony, as returned by
+// webauthn.BeginRegistration, with a new passkey, returning the body of
+// the client's response.
+func (a *Authenticator) Create(options []byte) ([]byte, error) {
+	var creation struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RP        struct {
+				ID string `json:"id"`
+			} `json:"rp"`
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &creation); err != nil {
+		return nil, err
+	}
+	userHandle, err := base64.RawURLEncoding.DecodeString(creation.PublicKey.User.ID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	p := &passkey{id: make([]byte, 16), rpID: creation.PublicKey.RP.ID, userHandle: userHandle, key: key}
+	rand.Read(p.id)
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The attested credential data follows the flags and sign count: an
+	// AAGUID of zeros, and the credential's ID and public key.
+	authData := p.authenticatorData(0x45) // user present and verified, attested data
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(p.id)))
+	authData = append(authData, p.id...)
+	authData = append(authData, publicKey...)
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+	clientData, err := a.clientData("webauthn.create", creation.PublicKey.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.passkeys = append(a.passkeys, p)
+	a.mu.Unlock()
+	return json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(p.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(p.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	})
+}
+
+// Get answers the options of an assertion ceremony, as returned by
+// webauthn.BeginLogin or BeginDiscoverableLogin, signing with the first
+// passkey of the relying party which the options allow, returning the
+// body of the client's response.
+func (a *Authenticator) Get(options []byte) ([]byte, error) {
+	var assertion struct {
+		PublicKey struct {
+			Challenge        string `json:"challenge"`
+			RPID             string `json:"rpId"`
+			AllowCredentials []struct {
+				ID string `json:"id"`
+			} `json:"allowCredentials"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &assertion); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var p *passkey
+	for _, candidate := range a.passkeys {
+		allowed := len(assertion.PublicKey.AllowCredentials) == 0
+		for _, c := range assertion.PublicKey.AllowCredentials {
+			id, _ := base64.RawURLEncoding.DecodeString(c.ID)
+			allowed = allowed || bytes.Equal(id, candidate.id)
+		}
+		if candidate.rpID == assertion.PublicKey.RPID && allowed {
+			p = candidate
+			break
+		}
+	}
+	if p == nil {
+		return nil, errors.New("no passkey for the relying party")
+	}
+
+	p.signCount++
+	authData := p.authenticatorData(0x05) // user present and verified
+	clientData, err := a.clientData("webauthn.get", assertion.PublicKey.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, p.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(p.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(p.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(p.userHandle),
+		},
+	})
+}
+
+// authenticatorData returns the hash of the relying party ID, the flags,
+// and the sign count of the passkey.
+func (p *passkey) authenticatorData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(p.rpID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, p.signCount)
+}
+
+func (a *Authenticator) clientData(ceremony, challenge string) ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    a.origin,
+	})
+}
@@ -0,0 +1,221 @@
+package testsupport
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const idpKeyID = "testsupport"
+
+// IdP is a mock OpenID Connect identity provider, which signs in anyone
+// without prompting: its authorization endpoint redirects right back with
+// a code for the user named by the login_hint parameter, which its token
+// endpoint exchanges for tokens. Its endpoints are served at AuthURL,
+// TokenURL, JWKSURL, and RevokeURL, and advertised by its discovery
+// document, under Issuer.
+type IdP struct {
+	ClientID string
+
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu      sync.Mutex
+	codes   map[string]authorization
+	next    int
+	revoked map[string]bool
+}
+
+// authorization is what a code is exchanged for: the user, and the nonce
+// of the authorization request, if any.
+type authorization struct {
+	email string
+	nonce string
+}
+
+// NewIdP starts an identity provider issuing ID tokens for clientID. It
+// must be closed when done.
+func NewIdP(clientID string) (*IdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	p := &IdP{ClientID: clientID, key: key, codes: make(map[string]authorization), revoked: make(map[string]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+	mux.HandleFunc("GET /jwks", p.jwks)
+	mux.HandleFunc("POST /revoke", p.revoke)
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	p.server = httptest.NewServer(mux)
+	return p, nil
+}
+
+// Issuer returns the issuer of ID tokens, the base URL of the provider.
+func (p *IdP) Issuer() string { return p.server.URL }
+
+// AuthURL returns the URL of the authorization endpoint.
+func (p *IdP) AuthURL() string { return p.server.URL + "/authorize" }
+
+// TokenURL returns the URL of the token endpoint.
+func (p *IdP) TokenURL() string { return p.server.URL + "/token" }
+
+// JWKSURL returns the URL of the signing keys.
+func (p *IdP) JWKSURL() string { return p.server.URL + "/jwks" }
+
+// RevokeURL returns the URL of the token revocation endpoint.
+func (p *IdP) RevokeURL() string { return p.server.URL + "/revoke" }
+
+// Revoked reports whether a refresh token was revoked. Revoked refresh
+// tokens can no longer be exchanged.
+func (p *IdP) Revoked(refreshToken string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.revoked[refreshToken]
+}
+
+// Close shuts the identity provider down.
+func (p *IdP) Close() { p.server.Close() }
+
+// IDToken returns an ID token for the user with the given email address,
+// as issued when signing in with a client-side library, valid for an
+// hour. The email address doubles as the subject, and is verified.
+func (p *IdP) IDToken(email string) (string, error) {
+	return p.IDTokenWith(email, nil)
+}
+
+// IDTokenWith returns an ID token as IDToken does, with claims set, or
+// removed if nil, as in claims.
+func (p *IdP) IDTokenWith(email string, claims map[string]any) (string, error) {
+	return p.idToken(email, "", claims)
+}
+
+func (p *IdP) idToken(email, nonce string, extra map[string]any) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            p.server.URL,
+		"aud":            p.ClientID,
+		"sub":            email,
+		"email":          email,
+		"email_verified": true,
+		"name":           email,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idpKeyID
+	return token.SignedString(p.key)
+}
+
+func (p *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("client_id") != p.ClientID || query.Get("login_hint") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	p.next++
+	code := fmt.Sprintf("code-%d", p.next)
+	p.codes[code] = authorization{email: query.Get("login_hint"), nonce: query.Get("nonce")}
+	p.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *IdP) token(w http.ResponseWriter, r *http.Request) {
+	var auth authorization
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		p.mu.Lock()
+		auth = p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		p.mu.Unlock()
+	case "refresh_token":
+		if !p.Revoked(r.FormValue("refresh_token")) {
+			auth.email = r.FormValue("refresh_token")
+		}
+	}
+	email := auth.email
+	if email == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	idToken, err := p.idToken(email, auth.nonce, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token":  "access-" + email,
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+		"refresh_token": email,
+		"id_token":      idToken,
+	})
+}
+
+func (p *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idpKeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encode(p.key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *IdP) revoke(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	p.revoked[token] = true
+	p.mu.Unlock()
+}
+
+func (p *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                p.Issuer(),
+		"authorization_endpoint":                p.AuthURL(),
+		"token_endpoint":                        p.TokenURL(),
+		"jwks_uri":                              p.JWKSURL(),
+		"revocation_endpoint":                   p.RevokeURL(),
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
@@ -0,0 +1,38 @@
+package testsupport
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// IDs is a deterministic source of IDs and random bytes. Its IDs are
+// UUIDv7s with a zero timestamp and sequential random bits, so that they
+// sort in the order they were generated, and its random bytes are read
+// from a seeded generator. It is safe for concurrent use.
+type IDs struct {
+	mu   sync.Mutex
+	n    uint64
+	rand *rand.Rand
+}
+
+// NewIDs returns a source of IDs whose random bytes are generated from
+// seed.
+func NewIDs(seed int64) *IDs {
+	return &IDs{rand: rand.New(rand.NewSource(seed))}
+}
+
+// NewID returns the next ID, such as 00000000-0000-7000-8000-000000000001.
+func (g *IDs) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n++
+	return fmt.Sprintf("00000000-0000-7000-8000-%012x", g.n)
+}
+
+// Read fills b with the next random bytes.
+func (g *IDs) Read(b []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rand.Read(b)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // GIF attachments
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// maxImagePixels bounds the size of images thumbnails are generated for,
+// so that small, highly compressed files cannot exhaust memory when
+// decoded.
+const maxImagePixels = 50_000_000
+
+// thumbnailSizes maps the thumbnail variants of image attachments to the
+// size of the square they fit in, in pixels.
+var thumbnailSizes = map[string]int{
+	"small":  96,
+	"medium": 320,
+	"large":  640,
+}
+
+var errImageTooLarge = errors.New("image too large")
+
+// thumbnailable reports whether thumbnails can be generated for content
+// of the given type.
+func thumbnailable(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// renderThumbnail scales the image read from r down to fit a square of
+// size pixels, rotated upright as its EXIF orientation says. It returns
+// the thumbnail, as JPEG for JPEG images and PNG otherwise, to keep
+// transparency, and its content type. Thumbnails are encoded afresh, so
+// they carry none of the original's metadata, such as EXIF location.
+func renderThumbnail(r io.ReadSeeker, size int) ([]byte, string, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, "", errImageTooLarge
+	}
+	orientation := 1
+	if format == "jpeg" {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, "", err
+		}
+		orientation = jpegOrientation(r)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if scale := float64(size) / float64(max(width, height)); scale < 1 {
+		width, height = max(1, int(float64(width)*scale)), max(1, int(float64(height)*scale))
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	thumbnail := orient(dst, orientation)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, thumbnail)
+	return buf.Bytes(), "image/png", err
+}
+
+// jpegOrientation returns the EXIF orientation of the JPEG image read from
+// r, from 1 (upright) to 8, or 1 if it has none.
+func jpegOrientation(r io.Reader) int {
+	var marker [4]byte
+	if _, err := io.ReadFull(r, marker[:2]); err != nil || marker[0] != 0xff || marker[1] != 0xd8 {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if marker[1] == 0xda || length < 0 {
+			// Start of scan: the metadata segments are over.
+			return 1
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 1
+		}
+		if marker[1] == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+	}
+}
+
+// exifOrientation returns the orientation tag of the first IFD of TIFF
+// data, as found in EXIF segments, or 1 if it has none.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient returns img transformed from the given EXIF orientation to
+// upright.
+func orient(img *image.RGBA, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// Orientations 5 to 8 are rotated by 90 degrees.
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// (sx, sy) is the pixel of the stored image shown at (x, y).
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.SetRGBA(x, y, img.RGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
+
+// thumbnailVariant returns the size of a thumbnail variant.
+func thumbnailVariant(name string) (int, error) {
+	size, ok := thumbnailSizes[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown thumbnail size %q", name)
+	}
+	return size, nil
+}
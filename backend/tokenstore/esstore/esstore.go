@@ -0,0 +1,270 @@
+// Package esstore keeps OAuth tokens in Elasticsearch, in a document per
+// user holding their tokens by provider, so that tokens survive restarts
+// and are shared between replicas.
+package esstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"app-backend/tokenstore"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.uber.org/zap"
+)
+
+const (
+	index = "app-sessions"
+
+	// schemaVersion is the version of token documents written. Version 1
+	// documents held only a Google token, in a google field.
+	schemaVersion = 2
+
+	// maxTokens bounds the token documents loaded by List.
+	maxTokens = 1000
+)
+
+// tokenDocument represents a user's token document in Elasticsearch.
+type tokenDocument struct {
+	SchemaVersion int `json:"schema_version"`
+
+	// Providers holds tokens by provider.
+	Providers map[string]providerToken `json:"providers"`
+
+	// Google holds the token of version 1 documents.
+	Google *providerToken `json:"google,omitempty"`
+}
+
+// providerToken represents a token from a provider in Elasticsearch.
+type providerToken struct {
+	RefreshToken string    `json:"refresh_token"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	Scopes       []string  `json:"scopes,omitempty"`
+	IssuedAt     time.Time `json:"issued_at"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// migrate upgrades the document to schemaVersion, reporting whether it
+// changed.
+func (d *tokenDocument) migrate() bool {
+	if d.SchemaVersion >= schemaVersion {
+		return false
+	}
+	if d.Providers == nil {
+		d.Providers = make(map[string]providerToken)
+	}
+	if d.Google != nil {
+		if _, ok := d.Providers["google"]; !ok {
+			d.Providers["google"] = *d.Google
+		}
+		d.Google = nil
+	}
+	d.SchemaVersion = schemaVersion
+	return true
+}
+
+// migrateScript upgrades a stored version 1 token document in place,
+// keeping fields not managed by the store.
+const migrateScript = `
+if (ctx._source.providers == null) { ctx._source.providers = [:] }
+if (ctx._source.google != null) {
+  def google = ctx._source.remove('google');
+  if (ctx._source.providers.google == null) { ctx._source.providers.google = google }
+}
+ctx._source.schema_version = params.version;
+`
+
+// deleteScript removes a provider's token from a token document, migrating
+// it first.
+const deleteScript = migrateScript + `
+ctx._source.providers.remove(params.provider);
+`
+
+// Store is a tokenstore.Store in Elasticsearch.
+type Store struct {
+	client *elasticsearch.Client
+	logger *zap.Logger
+
+	// index is the index of token documents, and refresh the refresh
+	// parameter of writes, which tests set to wait for them to be
+	// searchable.
+	index   string
+	refresh string
+}
+
+// New returns a store of tokens in the app-sessions index.
+func New(client *elasticsearch.Client, logger *zap.Logger) *Store {
+	return &Store{client: client, logger: logger, index: index}
+}
+
+func (s *Store) Get(ctx context.Context, provider, userID string) (*tokenstore.Token, error) {
+	res, err := s.client.Get(s.index, userID, s.client.Get.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("while loading token for user ID %q: %w", userID, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, tokenstore.ErrNotFound
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("loading token failed: %s", res.Status())
+	}
+	var doc struct {
+		Source tokenDocument `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	doc.Source.migrate()
+	stored, ok := doc.Source.Providers[provider]
+	if !ok {
+		return nil, tokenstore.ErrNotFound
+	}
+	token := stored.token(provider, userID)
+	return &token, nil
+}
+
+func (s *Store) Set(ctx context.Context, token tokenstore.Token) error {
+	doc := map[string]interface{}{
+		"issued_at":     token.IssuedAt.UTC().Format(time.RFC3339),
+		"refresh_token": token.RefreshToken,
+		"access_token":  nil,
+		"expiry":        nil,
+		"scopes":        token.Scopes,
+	}
+	if token.AccessToken != "" {
+		doc["access_token"] = token.AccessToken
+	}
+	if !token.Expiry.IsZero() {
+		doc["expiry"] = token.Expiry.UTC().Format(time.RFC3339)
+	}
+	// Partial documents are merged, leaving tokens of other providers
+	// untouched.
+	body := esutil.NewJSONReader(map[string]interface{}{
+		"doc_as_upsert": true,
+		"doc": map[string]interface{}{
+			"schema_version": schemaVersion,
+			"providers":      map[string]interface{}{token.Provider: doc},
+		},
+	})
+	res, err := s.client.Update(s.index, token.UserID, body, s.updateOptions(ctx)...)
+	if err != nil {
+		return fmt.Errorf("while saving token for user ID %q: %w", token.UserID, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("updating token failed: %s", res.Status())
+	}
+	return nil
+}
+
+func (s *Store) Delete(ctx context.Context, provider, userID string) error {
+	body := esutil.NewJSONReader(map[string]interface{}{
+		"script": map[string]interface{}{
+			"source": deleteScript,
+			"params": map[string]interface{}{"version": schemaVersion, "provider": provider},
+		},
+	})
+	res, err := s.client.Update(s.index, userID, body, s.updateOptions(ctx)...)
+	if err != nil {
+		return fmt.Errorf("while deleting token for user ID %q: %w", userID, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting token failed: %s", res.Status())
+	}
+	return nil
+}
+
+// List returns the stored tokens, migrating documents of earlier schema
+// versions. If the index does not exist yet, there are no tokens.
+func (s *Store) List(ctx context.Context) ([]tokenstore.Token, error) {
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(s.index),
+		s.client.Search.WithSize(maxTokens),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("while loading tokens: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("loading tokens failed: %s", res.Status())
+	}
+
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				ID     string        `json:"_id"`
+				Source tokenDocument `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		return nil, err
+	}
+
+	var tokens []tokenstore.Token
+	for _, hit := range searchResult.Hits.Hits {
+		doc := hit.Source
+		if doc.migrate() {
+			if err := s.migrate(ctx, hit.ID); err != nil {
+				// The document is migrated again on next start, or
+				// rewritten when the token is next stored.
+				s.logger.Warn("failed to migrate token document", zap.String("id", hit.ID), zap.Error(err))
+			}
+		}
+		for provider, stored := range doc.Providers {
+			tokens = append(tokens, stored.token(provider, hit.ID))
+		}
+	}
+	return tokens, nil
+}
+
+// migrate upgrades a stored token document to schemaVersion.
+func (s *Store) migrate(ctx context.Context, id string) error {
+	body := esutil.NewJSONReader(map[string]interface{}{
+		"script": map[string]interface{}{
+			"source": migrateScript,
+			"params": map[string]interface{}{"version": schemaVersion},
+		},
+	})
+	res, err := s.client.Update(s.index, id, body, s.updateOptions(ctx)...)
+	if err != nil {
+		return fmt.Errorf("while migrating token for user ID %q: %w", id, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("migrating token failed: %s", res.Status())
+	}
+	return nil
+}
+
+func (s *Store) updateOptions(ctx context.Context) []func(*esapi.UpdateRequest) {
+	options := []func(*esapi.UpdateRequest){s.client.Update.WithContext(ctx)}
+	if s.refresh != "" {
+		options = append(options, s.client.Update.WithRefresh(s.refresh))
+	}
+	return options
+}
+
+// token returns the token stored for a provider and user.
+func (t providerToken) token(provider, userID string) tokenstore.Token {
+	return tokenstore.Token{
+		Provider:     provider,
+		UserID:       userID,
+		RefreshToken: t.RefreshToken,
+		AccessToken:  t.AccessToken,
+		Scopes:       t.Scopes,
+		IssuedAt:     t.IssuedAt,
+		Expiry:       t.Expiry,
+	}
+}
@@ -0,0 +1,62 @@
+package esstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"app-backend/tokenstore"
+	"app-backend/tokenstore/tokenstoretest"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"go.uber.org/zap"
+)
+
+func TestTokenDocumentMigration(t *testing.T) {
+	var doc tokenDocument
+	if err := json.Unmarshal([]byte(`{"google":{"refresh_token":"refresh","issued_at":"2024-01-01T00:00:00Z"}}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if !doc.migrate() {
+		t.Fatal("expected version 1 document to be migrated")
+	}
+	if doc.SchemaVersion != schemaVersion || doc.Google != nil {
+		t.Errorf("unexpected migrated document: %+v", doc)
+	}
+	if token := doc.Providers["google"]; token.RefreshToken != "refresh" || token.IssuedAt.IsZero() {
+		t.Errorf("expected google token to be moved to providers, got %+v", token)
+	}
+	if doc.migrate() {
+		t.Error("expected current document not to be migrated again")
+	}
+}
+
+// TestConformance runs the conformance tests against the Elasticsearch
+// cluster at TOKENSTORE_ELASTICSEARCH_URL, if set, in indices created and
+// deleted by each test.
+func TestConformance(t *testing.T) {
+	url := os.Getenv("TOKENSTORE_ELASTICSEARCH_URL")
+	if url == "" {
+		t.Skip("TOKENSTORE_ELASTICSEARCH_URL is not set")
+	}
+	client, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{url},
+		APIKey:    os.Getenv("TOKENSTORE_ELASTICSEARCH_API_KEY"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenstoretest.Run(t, func(t *testing.T) tokenstore.Store {
+		s := New(client, zap.NewNop())
+		s.index = fmt.Sprintf("tokenstore-test-%d", time.Now().UnixNano())
+		s.refresh = "wait_for"
+		t.Cleanup(func() {
+			if res, err := client.Indices.Delete([]string{s.index}); err == nil {
+				res.Body.Close()
+			}
+		})
+		return s
+	})
+}
@@ -0,0 +1,65 @@
+// Package memstore keeps OAuth tokens in memory, for development and for
+// deployments without Elasticsearch. Tokens are lost when the backend
+// restarts, and are not shared between replicas.
+package memstore
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"app-backend/tokenstore"
+)
+
+type key struct {
+	provider string
+	userID   string
+}
+
+// Store is a tokenstore.Store in memory.
+type Store struct {
+	mu     sync.RWMutex
+	tokens map[key]tokenstore.Token
+}
+
+// New returns an empty store.
+func New() *Store {
+	return &Store{tokens: make(map[key]tokenstore.Token)}
+}
+
+func (s *Store) Get(ctx context.Context, provider, userID string) (*tokenstore.Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	token, ok := s.tokens[key{provider, userID}]
+	if !ok {
+		return nil, tokenstore.ErrNotFound
+	}
+	token.Scopes = slices.Clone(token.Scopes)
+	return &token, nil
+}
+
+func (s *Store) Set(ctx context.Context, token tokenstore.Token) error {
+	token.Scopes = slices.Clone(token.Scopes)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[key{token.Provider, token.UserID}] = token
+	return nil
+}
+
+func (s *Store) Delete(ctx context.Context, provider, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, key{provider, userID})
+	return nil
+}
+
+func (s *Store) List(ctx context.Context) ([]tokenstore.Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokens := make([]tokenstore.Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		token.Scopes = slices.Clone(token.Scopes)
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
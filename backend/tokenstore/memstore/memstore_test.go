@@ -0,0 +1,14 @@
+package memstore
+
+import (
+	"testing"
+
+	"app-backend/tokenstore"
+	"app-backend/tokenstore/tokenstoretest"
+)
+
+func TestConformance(t *testing.T) {
+	tokenstoretest.Run(t, func(t *testing.T) tokenstore.Store {
+		return New()
+	})
+}
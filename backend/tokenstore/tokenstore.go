@@ -0,0 +1,51 @@
+// Package tokenstore defines how the OAuth tokens of users are persisted,
+// so that the backend can keep them in Elasticsearch, in memory, or in
+// other databases, such as Postgres, Redis, or DynamoDB, without changes to
+// the OAuth flows. Implementations are in the subpackages, and must pass
+// the conformance tests of package tokenstoretest.
+package tokenstore
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned when getting a token which is not stored.
+var ErrNotFound = errors.New("token not found")
+
+// Token is a user's OAuth token from a provider. Stores persist the access
+// token as given: the backend encrypts it beforehand.
+type Token struct {
+	Provider string
+	UserID   string
+
+	RefreshToken string
+	AccessToken  string
+
+	// Scopes holds the scopes granted to the token.
+	Scopes []string
+
+	// IssuedAt is when the token was stored, and Expiry when the access
+	// token expires, or zero if unknown. Stores keep both to at least the
+	// second.
+	IssuedAt time.Time
+	Expiry   time.Time
+}
+
+// Store stores the OAuth tokens of users, by provider and user ID. Stores
+// must be safe for concurrent use.
+type Store interface {
+	// Get returns the user's token from provider, or ErrNotFound.
+	Get(ctx context.Context, provider, userID string) (*Token, error)
+
+	// Set stores a token, replacing the user's token from the same
+	// provider, and leaving those from other providers untouched.
+	Set(ctx context.Context, token Token) error
+
+	// Delete deletes the user's token from provider, if it exists.
+	Delete(ctx context.Context, provider, userID string) error
+
+	// List returns all stored tokens, as loaded by the backend at start.
+	List(ctx context.Context) ([]Token, error)
+}
@@ -0,0 +1,259 @@
+// Package tokenstoretest provides the conformance tests of implementations
+// of tokenstore.Store. Implementations run them from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		tokenstoretest.Run(t, func(t *testing.T) tokenstore.Store {
+//			return newStore(t)
+//		})
+//	}
+package tokenstoretest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"app-backend/tokenstore"
+)
+
+// Run runs the conformance tests, each against an empty store returned by
+// newStore.
+func Run(t *testing.T, newStore func(t *testing.T) tokenstore.Store) {
+	ctx := context.Background()
+	issuedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	token := func(provider, userID, refreshToken string) tokenstore.Token {
+		return tokenstore.Token{
+			Provider:     provider,
+			UserID:       userID,
+			RefreshToken: refreshToken,
+			AccessToken:  "access-" + refreshToken,
+			Scopes:       []string{"openid", "email"},
+			IssuedAt:     issuedAt,
+			Expiry:       issuedAt.Add(time.Hour),
+		}
+	}
+
+	t.Run("GetMissing", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.Get(ctx, "google", "user"); !errors.Is(err, tokenstore.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("SetGet", func(t *testing.T) {
+		s := newStore(t)
+		expected := token("google", "user", "refresh-1")
+		if err := s.Set(ctx, expected); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get(ctx, "google", "user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := compare(*got, expected); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("SetWithoutAccessToken", func(t *testing.T) {
+		s := newStore(t)
+		expected := tokenstore.Token{Provider: "google", UserID: "user", RefreshToken: "refresh-1", IssuedAt: issuedAt}
+		if err := s.Set(ctx, expected); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get(ctx, "google", "user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := compare(*got, expected); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("SetReplaces", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Set(ctx, token("google", "user", "refresh-1")); err != nil {
+			t.Fatal(err)
+		}
+		expected := token("google", "user", "refresh-2")
+		expected.Scopes = []string{"openid"}
+		expected.Expiry = time.Time{}
+		expected.AccessToken = ""
+		if err := s.Set(ctx, expected); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get(ctx, "google", "user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := compare(*got, expected); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("ProvidersAndUsersAreIndependent", func(t *testing.T) {
+		s := newStore(t)
+		tokens := []tokenstore.Token{
+			token("google", "alice", "refresh-1"),
+			token("microsoft", "alice", "refresh-2"),
+			token("google", "bob", "refresh-3"),
+		}
+		for _, tok := range tokens {
+			if err := s.Set(ctx, tok); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, expected := range tokens {
+			got, err := s.Get(ctx, expected.Provider, expected.UserID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := compare(*got, expected); err != nil {
+				t.Error(err)
+			}
+		}
+		if _, err := s.Get(ctx, "microsoft", "bob"); !errors.Is(err, tokenstore.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := newStore(t)
+		for _, tok := range []tokenstore.Token{token("google", "alice", "refresh-1"), token("microsoft", "alice", "refresh-2")} {
+			if err := s.Set(ctx, tok); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Delete(ctx, "google", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get(ctx, "google", "alice"); !errors.Is(err, tokenstore.ErrNotFound) {
+			t.Errorf("expected the deleted token not to be found, got %v", err)
+		}
+		if _, err := s.Get(ctx, "microsoft", "alice"); err != nil {
+			t.Errorf("expected the user's other tokens to be kept, got %v", err)
+		}
+
+		// Deleting missing tokens is not an error
+		if err := s.Delete(ctx, "google", "alice"); err != nil {
+			t.Errorf("expected deleting a deleted token to succeed, got %v", err)
+		}
+		if err := s.Delete(ctx, "google", "nobody"); err != nil {
+			t.Errorf("expected deleting a missing token to succeed, got %v", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		s := newStore(t)
+		if tokens, err := s.List(ctx); err != nil || len(tokens) != 0 {
+			t.Fatalf("expected no tokens, got %v, %v", tokens, err)
+		}
+		expected := []tokenstore.Token{
+			token("google", "alice", "refresh-1"),
+			token("microsoft", "alice", "refresh-2"),
+			token("google", "bob", "refresh-3"),
+		}
+		for _, tok := range expected {
+			if err := s.Set(ctx, tok); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Delete(ctx, "google", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		expected = expected[:2]
+
+		got, err := s.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sortTokens(got)
+		sortTokens(expected)
+		if len(got) != len(expected) {
+			t.Fatalf("expected %d tokens, got %d: %+v", len(expected), len(got), got)
+		}
+		for i := range got {
+			if err := compare(got[i], expected[i]); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	t.Run("ReturnsCopies", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Set(ctx, token("google", "user", "refresh-1")); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get(ctx, "google", "user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.Scopes[0] = "changed"
+		got, err = s.Get(ctx, "google", "user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Scopes[0] != "openid" {
+			t.Error("expected changes to returned tokens not to change the store")
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		s := newStore(t)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				userID := fmt.Sprintf("user-%d", i)
+				if err := s.Set(ctx, token("google", userID, "refresh")); err != nil {
+					t.Error(err)
+				}
+				if _, err := s.Get(ctx, "google", userID); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if tokens, err := s.List(ctx); err != nil || len(tokens) != 10 {
+			t.Errorf("expected 10 tokens, got %d, %v", len(tokens), err)
+		}
+	})
+}
+
+// compare reports how got differs from expected, with times compared to
+// the second.
+func compare(got, expected tokenstore.Token) error {
+	sameTime := func(a, b time.Time) bool {
+		return a.Truncate(time.Second).Equal(b.Truncate(time.Second))
+	}
+	if got.Provider != expected.Provider || got.UserID != expected.UserID ||
+		got.RefreshToken != expected.RefreshToken || got.AccessToken != expected.AccessToken ||
+		!slices.Equal(got.Scopes, expected.Scopes) ||
+		!sameTime(got.IssuedAt, expected.IssuedAt) || !sameTime(got.Expiry, expected.Expiry) {
+		return fmt.Errorf("expected %+v, got %+v", expected, got)
+	}
+	return nil
+}
+
+func sortTokens(tokens []tokenstore.Token) {
+	slices.SortFunc(tokens, func(a, b tokenstore.Token) int {
+		if a.UserID != b.UserID {
+			if a.UserID < b.UserID {
+				return -1
+			}
+			return 1
+		}
+		if a.Provider < b.Provider {
+			return -1
+		}
+		if a.Provider > b.Provider {
+			return 1
+		}
+		return 0
+	})
+}
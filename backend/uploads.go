@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"app-backend/blobstore"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	uploadSessionsIndex = "app-upload-sessions"
+
+	defaultMaxUploadSize = 1 << 30
+	defaultUploadTTL     = 24 * time.Hour
+
+	// uploadExpiryInterval is how often expired upload sessions are
+	// deleted.
+	uploadExpiryInterval = 10 * time.Minute
+
+	// uploadChunkContentType is the content type of the chunks of
+	// resumable uploads, as in the tus protocol.
+	uploadChunkContentType = "application/offset+octet-stream"
+)
+
+var (
+	errUploadNotFound       = errors.New("upload not found")
+	errUploadTooLarge       = errors.New("upload too large")
+	errUploadOffsetMismatch = errors.New("upload offset mismatch")
+	errUploadChecksum       = errors.New("upload checksum mismatch")
+	errUploadIncomplete     = errors.New("upload incomplete")
+)
+
+// uploadSession is a resumable upload, whose content is uploaded in
+// chunks at increasing offsets. Each chunk is stored as a blob, and the
+// chunks are read back in order once the upload is complete.
+type uploadSession struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+
+	// SHA256 is the hex-encoded SHA-256 of the whole content, if the
+	// client declared it, verified once the last chunk is received.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Chunks are the blob keys of the chunks received so far, in order.
+	Chunks []string `json:"chunks"`
+
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (u *uploadSession) complete() bool {
+	return u.Offset == u.Size
+}
+
+// uploadStore manages resumable upload sessions, with sessions persisted
+// to Elasticsearch if configured, and chunks stored in the blob store.
+// Sessions expire ttl after their last chunk.
+type uploadStore struct {
+	client  *elasticsearch.Client
+	blobs   blobstore.Store
+	maxSize int64
+	ttl     time.Duration
+	logger  *zap.Logger
+	ids     idSource
+
+	// clock tells when sessions expire.
+	clock clock
+
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+func newUploadStore(config *appConfig, client *elasticsearch.Client, blobs blobstore.Store, logger *zap.Logger) (*uploadStore, error) {
+	s := &uploadStore{
+		client:   client,
+		blobs:    blobs,
+		maxSize:  config.Uploads.MaxSize,
+		ttl:      config.Uploads.TTL,
+		logger:   logger,
+		ids:      cryptoIDs{},
+		clock:    systemClock{},
+		sessions: make(map[string]*uploadSession),
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = defaultMaxUploadSize
+	}
+	if s.ttl <= 0 {
+		s.ttl = defaultUploadTTL
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init upload store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads the upload sessions in progress from Elasticsearch.
+func (s *uploadStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initUploadStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(uploadSessionsIndex),
+		s.client.Search.WithSize(10000),
+	)
+	if err != nil {
+		logger.Info("could not load upload sessions from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.Info("could not load upload sessions from Elasticsearch", zap.String("status", res.Status()))
+		return nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source uploadSession `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	for i := range searchResult.Hits.Hits {
+		u := &searchResult.Hits.Hits[i].Source
+		s.sessions[u.ID] = u
+	}
+
+	logger.Info("loaded upload sessions", zap.Int("uploads", len(s.sessions)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// create starts an upload session of size bytes for a user.
+func (s *uploadStore) create(ctx context.Context, filename string, size int64, sha256Hex, userID string) (*uploadSession, error) {
+	limit := s.maxSize
+	if quota := tenantSettingsFromContext(ctx).Quotas.UploadMaxSize; quota > 0 {
+		limit = quota
+	}
+	if size > limit {
+		return nil, errUploadTooLarge
+	}
+	now := s.clock.Now().UTC()
+	u := &uploadSession{
+		ID:        s.ids.NewID(),
+		Filename:  filepath.Base(filename),
+		Size:      size,
+		SHA256:    strings.ToLower(sha256Hex),
+		Chunks:    []string{},
+		CreatedBy: userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	s.mu.Lock()
+	s.sessions[u.ID] = u
+	s.mu.Unlock()
+	return u, s.persist(ctx, u)
+}
+
+// get returns a copy of an upload session of a user, which is not found
+// if it belongs to someone else or has expired.
+func (s *uploadStore) get(id, userID string) (*uploadSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.sessions[id]
+	if !ok || u.CreatedBy != userID || s.clock.Now().After(u.ExpiresAt) {
+		return nil, errUploadNotFound
+	}
+	copied := *u
+	copied.Chunks = append([]string(nil), u.Chunks...)
+	return &copied, nil
+}
+
+// write appends the chunk read from r, of size bytes, to an upload at
+// offset, which must be the upload's current offset. If checksum, the
+// SHA-256 of the chunk, is set, the chunk is verified against it. Once
+// the last chunk is written, the whole content is verified against the
+// declared SHA-256, if any, and the upload deleted if it does not match.
+func (s *uploadStore) write(ctx context.Context, id, userID string, offset, size int64, checksum []byte, r io.Reader) (*uploadSession, error) {
+	u, err := s.get(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if offset != u.Offset {
+		return u, errUploadOffsetMismatch
+	}
+	if size > u.Size-u.Offset {
+		return u, errUploadTooLarge
+	}
+
+	// Chunks are stored under unique keys, so that concurrent writes at
+	// the same offset do not overwrite each other.
+	suffix := make([]byte, 4)
+	if _, err := s.ids.Read(suffix); err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("uploads/%s/%020d-%s", id, offset, hex.EncodeToString(suffix))
+	hash := sha256.New()
+	counter := &countingReader{r: io.TeeReader(io.LimitReader(r, size), hash)}
+	if err := s.blobs.Put(ctx, key, counter, size, uploadChunkContentType); err != nil {
+		s.blobs.Delete(ctx, key)
+		return nil, err
+	}
+	switch {
+	case counter.n != size:
+		s.blobs.Delete(ctx, key)
+		return u, fmt.Errorf("chunk ended after %d of %d bytes", counter.n, size)
+	case checksum != nil && !bytes.Equal(hash.Sum(nil), checksum):
+		s.blobs.Delete(ctx, key)
+		return u, errUploadChecksum
+	}
+
+	s.mu.Lock()
+	current, ok := s.sessions[id]
+	if !ok || current.Offset != offset {
+		s.mu.Unlock()
+		s.blobs.Delete(ctx, key)
+		if !ok {
+			return nil, errUploadNotFound
+		}
+		return u, errUploadOffsetMismatch
+	}
+	current.Chunks = append(current.Chunks, key)
+	current.Offset += size
+	current.ExpiresAt = s.clock.Now().UTC().Add(s.ttl)
+	u = &uploadSession{}
+	*u = *current
+	u.Chunks = append([]string(nil), current.Chunks...)
+	s.mu.Unlock()
+
+	if u.complete() && u.SHA256 != "" {
+		if err := s.verify(ctx, u); err != nil {
+			if errors.Is(err, errUploadChecksum) {
+				s.remove(ctx, id)
+			}
+			return u, err
+		}
+	}
+	return u, s.persist(ctx, u)
+}
+
+// verify checks the content of a complete upload against its declared
+// SHA-256.
+func (s *uploadStore) verify(ctx context.Context, u *uploadSession) error {
+	r := &chunkReader{ctx: ctx, blobs: s.blobs, keys: u.Chunks}
+	defer r.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != u.SHA256 {
+		return errUploadChecksum
+	}
+	return nil
+}
+
+// open returns a complete upload of a user, and a reader of its content.
+func (s *uploadStore) open(ctx context.Context, id, userID string) (*uploadSession, io.ReadCloser, error) {
+	u, err := s.get(id, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !u.complete() {
+		return nil, nil, errUploadIncomplete
+	}
+	return u, &chunkReader{ctx: ctx, blobs: s.blobs, keys: u.Chunks}, nil
+}
+
+// remove deletes an upload session with its chunks.
+func (s *uploadStore) remove(ctx context.Context, id string) error {
+	s.mu.Lock()
+	u, ok := s.sessions[id]
+	delete(s.sessions, id)
+	s.mu.Unlock()
+	if !ok {
+		return errUploadNotFound
+	}
+	for _, key := range u.Chunks {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			s.logger.Warn("failed to delete upload chunk", zap.String("upload.id", id), zap.Error(err))
+		}
+	}
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Delete(uploadSessionsIndex, id, s.client.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("while deleting upload session: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting upload session failed: %s", res.Status())
+	}
+	return nil
+}
+
+// expire deletes the upload sessions which expired before now, returning
+// how many it deleted.
+func (s *uploadStore) expire(ctx context.Context, now time.Time) int {
+	var expired []string
+	s.mu.Lock()
+	for id, u := range s.sessions {
+		if now.After(u.ExpiresAt) {
+			expired = append(expired, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, id := range expired {
+		if err := s.remove(ctx, id); err != nil && !errors.Is(err, errUploadNotFound) {
+			s.logger.Warn("failed to delete expired upload session", zap.String("upload.id", id), zap.Error(err))
+		}
+	}
+	return len(expired)
+}
+
+// startExpiry periodically deletes expired upload sessions.
+func (s *uploadStore) startExpiry(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(uploadExpiryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if expired := s.expire(ctx, s.clock.Now()); expired > 0 {
+					s.logger.Info("deleted expired upload sessions", zap.Int("uploads.expired", expired))
+				}
+			}
+		}
+	}()
+}
+
+// persist indexes an upload session, if Elasticsearch is configured.
+func (s *uploadStore) persist(ctx context.Context, u *uploadSession) error {
+	if s.client == nil {
+		return nil
+	}
+	res, err := s.client.Index(
+		uploadSessionsIndex, esutil.NewJSONReader(u),
+		s.client.Index.WithDocumentID(u.ID),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while saving upload session: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving upload session failed: %s", res.Status())
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// chunkReader reads the chunks of an upload in order, opening each blob
+// as it gets to it.
+type chunkReader struct {
+	ctx     context.Context
+	blobs   blobstore.Store
+	keys    []string
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.keys) == 0 {
+				return 0, io.EOF
+			}
+			current, err := r.blobs.Get(r.ctx, r.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.keys = current, r.keys[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+// uploadView is an upload session as returned by the API.
+type uploadView struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	Complete  bool      `json:"complete"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// setUploadHeaders sets the tus headers describing the state of an
+// upload.
+func setUploadHeaders(h http.Header, u *uploadSession) {
+	h.Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(u.Size, 10))
+	h.Set("Upload-Expires", u.ExpiresAt.Format(http.TimeFormat))
+	h.Set("Cache-Control", "no-store")
+}
+
+// parseUploadChecksum parses an Upload-Checksum header, as in the tus
+// checksum extension: "sha256 <base64 digest>".
+func parseUploadChecksum(header string) ([]byte, error) {
+	if header == "" {
+		return nil, nil
+	}
+	algorithm, encoded, _ := strings.Cut(header, " ")
+	if algorithm != "sha256" {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	checksum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(checksum) != sha256.Size {
+		return nil, errors.New("invalid checksum")
+	}
+	return checksum, nil
+}
+
+// registerUploadRoutes registers the endpoints of resumable uploads,
+// which follow the core and checksum parts of the tus protocol, without
+// its version negotiation: an upload is created with its size, then its
+// chunks are sent with PATCH at increasing offsets, and its offset can be
+// queried to resume after an interruption. Complete uploads are consumed
+// by other endpoints, such as the attachments of records.
+func registerUploadRoutes(routes *routeRegistry, uploads *uploadStore, logger *zap.Logger) {
+	user := routes.group(groupUser)
+
+	user.POST("/api/uploads", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Filename string `json:"filename"`
+			Size     int64  `json:"size"`
+			SHA256   string `json:"sha256"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if req.Filename == "" || req.Size <= 0 {
+			writeError(w, r, http.StatusBadRequest, "filename and a positive size are required")
+			return
+		}
+		if _, err := hex.DecodeString(req.SHA256); err != nil || (req.SHA256 != "" && len(req.SHA256) != 2*sha256.Size) {
+			writeError(w, r, http.StatusBadRequest, "sha256 must be a hex-encoded SHA-256 digest")
+			return
+		}
+		u, err := uploads.create(r.Context(), req.Filename, req.Size, req.SHA256, authFromContext(r.Context()).userID)
+		switch {
+		case errors.Is(err, errUploadTooLarge):
+			writeError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		case err != nil:
+			logger.Error("failed to create upload session", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		setUploadHeaders(w.Header(), u)
+		w.Header().Set("Location", "/api/uploads/"+u.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(uploadView{u.ID, u.Filename, u.Size, u.Offset, u.complete(), u.ExpiresAt})
+	})
+
+	user.GET("/api/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		u, err := uploads.get(r.PathValue("id"), authFromContext(r.Context()).userID)
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		setUploadHeaders(w.Header(), u)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(uploadView{u.ID, u.Filename, u.Size, u.Offset, u.complete(), u.ExpiresAt})
+	})
+
+	user.PATCH("/api/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != uploadChunkContentType {
+			writeError(w, r, http.StatusUnsupportedMediaType, "expected "+uploadChunkContentType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			writeError(w, r, http.StatusBadRequest, "expected an Upload-Offset header")
+			return
+		}
+		if r.ContentLength < 0 {
+			writeError(w, r, http.StatusLengthRequired, "expected a Content-Length header")
+			return
+		}
+		checksum, err := parseUploadChecksum(r.Header.Get("Upload-Checksum"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		u, err := uploads.write(r.Context(), r.PathValue("id"), authFromContext(r.Context()).userID, offset, r.ContentLength, checksum, r.Body)
+		if u != nil {
+			setUploadHeaders(w.Header(), u)
+		}
+		switch {
+		case errors.Is(err, errUploadNotFound):
+			writeError(w, r, http.StatusNotFound, err.Error())
+		case errors.Is(err, errUploadOffsetMismatch):
+			writeError(w, r, http.StatusConflict, err.Error())
+		case errors.Is(err, errUploadTooLarge):
+			writeError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+		case errors.Is(err, errUploadChecksum):
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		case err != nil:
+			logger.Warn("failed to write upload chunk", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusBadRequest, err.Error())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	user.DELETE("/api/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := uploads.get(r.PathValue("id"), authFromContext(r.Context()).userID); err != nil {
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		if err := uploads.remove(r.Context(), r.PathValue("id")); err != nil && !errors.Is(err, errUploadNotFound) {
+			logger.Error("failed to delete upload session", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
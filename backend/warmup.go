@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/elastic/go-elasticsearch/v8"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const defaultWarmUpTimeout = 30 * time.Second
+
+// warmUpStep primes a cache or connection pool.
+type warmUpStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// warmUp runs the steps priming the backend's caches and connection pools
+// at startup, so that the first requests after a deploy do not pay for
+// cold caches. The backend reports ready once they all finished, failed,
+// or timed out: warming up is best effort, and failed steps are only
+// logged.
+type warmUp struct {
+	timeout time.Duration
+	logger  *zap.Logger
+	steps   []warmUpStep
+
+	ready   atomic.Bool
+	mu      sync.Mutex
+	results map[string]string
+}
+
+func newWarmUp(config *appConfig, logger *zap.Logger) *warmUp {
+	w := &warmUp{
+		timeout: config.WarmUp.Timeout,
+		logger:  logger,
+		results: make(map[string]string),
+	}
+	if w.timeout <= 0 {
+		w.timeout = defaultWarmUpTimeout
+	}
+	return w
+}
+
+// register adds a step. It must be called before run.
+func (w *warmUp) register(name string, run func(ctx context.Context) error) {
+	w.steps = append(w.steps, warmUpStep{name, run})
+}
+
+// run runs all steps concurrently, within the warm-up timeout, and then
+// marks the backend ready.
+func (w *warmUp) run(ctx context.Context) {
+	ctx, span := otel.Tracer("main").Start(ctx, "warmUp")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for _, step := range w.steps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stepStart := time.Now()
+			result := "ok"
+			if err := step.run(ctx); err != nil {
+				result = err.Error()
+				span.RecordError(err, trace.WithAttributes(attribute.String("warmup.step", step.name)))
+				w.logger.Warn("warm-up step failed", zap.String("warmup.step", step.name), zap.Error(err))
+			} else {
+				w.logger.Debug("warm-up step done", zap.String("warmup.step", step.name), zap.Duration("duration", time.Since(stepStart)))
+			}
+			w.mu.Lock()
+			w.results[step.name] = result
+			w.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	w.ready.Store(true)
+	span.SetStatus(codes.Ok, "")
+	w.logger.Info("warm-up done, ready to serve", zap.Int("warmup.steps", len(w.steps)), zap.Duration("duration", time.Since(start)))
+}
+
+// readyHandler serves GET /api/ready, the readiness probe, which fails
+// until warming up is done.
+func readyHandler(w *warmUp) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		w.mu.Lock()
+		result := struct {
+			Status string            `json:"status"`
+			WarmUp map[string]string `json:"warm_up"`
+		}{"warming_up", make(map[string]string, len(w.results))}
+		for name, outcome := range w.results {
+			result.WarmUp[name] = outcome
+		}
+		w.mu.Unlock()
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "no-store")
+		if w.ready.Load() {
+			result.Status = "ready"
+		} else {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(rw).Encode(result)
+	}
+}
+
+// warmJWKS makes sure the signing keys of an identity provider are
+// loaded, refreshing them if they are not.
+func warmJWKS(jwks *keyfunc.JWKS) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if jwks.Len() > 0 {
+			return nil
+		}
+		if err := jwks.Refresh(ctx, keyfunc.RefreshOptions{IgnoreRateLimit: true}); err != nil {
+			return err
+		}
+		if jwks.Len() == 0 {
+			return errors.New("no signing keys")
+		}
+		return nil
+	}
+}
+
+// warmElasticsearch opens as many connections to Elasticsearch as the
+// transport keeps idle, with concurrent pings, so that the first requests
+// do not wait for TLS handshakes.
+func warmElasticsearch(client *elasticsearch.Client) func(context.Context) error {
+	return func(ctx context.Context) error {
+		errs := make([]error, http.DefaultMaxIdleConnsPerHost)
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = elasticsearchHealthCheck(client)(ctx)
+			}()
+		}
+		wg.Wait()
+		return errors.Join(errs...)
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	webauthnSessionCookieName = "webauthn_session"
+
+	// localSessionIssuer is the "iss" claim of session tokens minted by the
+	// backend itself, for users signing in with a passkey or Microsoft
+	// instead of Google.
+	localSessionIssuer = "app-backend"
+
+	localSessionTTL = 7 * 24 * time.Hour
+)
+
+var (
+	errPasswordlessDisabled   = errors.New("passwordless login requires encryption_keys to be configured")
+	errLocalSessionKeyUnknown = errors.New("session token signed with an unknown or retired key")
+)
+
+// webauthnUser adapts a user's stored enrollment to webauthn.User.
+type webauthnUser struct {
+	handle      []byte
+	name        string
+	displayName string
+	credentials []webauthn.Credential
+}
+
+func (u *webauthnUser) WebAuthnID() []byte                         { return u.handle }
+func (u *webauthnUser) WebAuthnName() string                       { return u.name }
+func (u *webauthnUser) WebAuthnDisplayName() string                { return u.displayName }
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// passkeyUser returns the webauthn.User for the given user, assigning a
+// random user handle if they have not registered a passkey before.
+func (s *mfaStorage) passkeyUser(auth *authDetails) (*webauthnUser, error) {
+	user := &webauthnUser{name: auth.email, displayName: auth.name}
+	if doc := s.get(auth.userID); doc != nil && len(doc.WebAuthn.UserHandle) > 0 {
+		user.handle = doc.WebAuthn.UserHandle
+		user.credentials = doc.WebAuthn.Credentials
+		return user, nil
+	}
+	user.handle = make([]byte, 32)
+	if _, err := s.ids.Read(user.handle); err != nil {
+		return nil, fmt.Errorf("failed to generate user handle: %w", err)
+	}
+	return user, nil
+}
+
+// addPasskey stores a newly registered credential for the user, along with
+// the profile details needed to sign the user in with the passkey alone.
+func (s *mfaStorage) addPasskey(ctx context.Context, auth *authDetails, handle []byte, credential *webauthn.Credential) error {
+	var doc mfaDocument
+	if existing := s.get(auth.userID); existing != nil {
+		doc = *existing
+	}
+	doc.WebAuthn.UserHandle = handle
+	doc.WebAuthn.Credentials = append(append([]webauthn.Credential(nil), doc.WebAuthn.Credentials...), *credential)
+	doc.WebAuthn.Email = auth.email
+	doc.WebAuthn.Name = auth.name
+	doc.WebAuthn.Picture = auth.picture
+	return s.put(ctx, auth.userID, &doc)
+}
+
+// updatePasskey records the updated sign count and flags of a credential
+// after a successful assertion, for clone detection.
+func (s *mfaStorage) updatePasskey(ctx context.Context, userID string, credential *webauthn.Credential) error {
+	existing := s.get(userID)
+	if existing == nil {
+		return errMFANotEnrolled
+	}
+	doc := *existing
+	doc.WebAuthn.Credentials = append([]webauthn.Credential(nil), existing.WebAuthn.Credentials...)
+	for i, c := range doc.WebAuthn.Credentials {
+		if bytes.Equal(c.ID, credential.ID) {
+			doc.WebAuthn.Credentials[i] = *credential
+		}
+	}
+	return s.put(ctx, userID, &doc)
+}
+
+// userByHandle returns the user ID and enrollment with the given user handle.
+func (s *mfaStorage) userByHandle(handle []byte) (string, *mfaDocument) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for userID, doc := range s.docs {
+		if bytes.Equal(doc.WebAuthn.UserHandle, handle) {
+			return userID, doc
+		}
+	}
+	return "", nil
+}
+
+// passkeyCount returns the number of passkeys the user has registered.
+func (s *mfaStorage) passkeyCount(userID string) int {
+	doc := s.get(userID)
+	if doc == nil {
+		return 0
+	}
+	return len(doc.WebAuthn.Credentials)
+}
+
+// localSessionKey derives the HMAC key used for signing local session
+// tokens from the primary encryption key. Returns nil if no keys are
+// configured, in which case passwordless login is disabled.
+func localSessionKey(encryptionKeys []string) []byte {
+	if len(encryptionKeys) == 0 {
+		return nil
+	}
+	return deriveLocalSessionKey(encryptionKeys[0])
+}
+
+func deriveLocalSessionKey(encryptionKey string) []byte {
+	sum := sha256.Sum256([]byte("local-session:" + encryptionKey))
+	return sum[:]
+}
+
+// localSessionKeyID identifies the key a session token was signed with, in
+// its "kid" header, so that tokens remain valid after key rotation while
+// their key is retained.
+func localSessionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// issueLocalSession mints a session token for a user signing in with a
+// passkey, with the same claims as the Google ID tokens it stands in for.
+func issueLocalSession(key []byte, userID string, doc *mfaDocument, now time.Time) (string, error) {
+	return signLocalSession(key, jwt.MapClaims{
+		"sub":     userID,
+		"email":   doc.WebAuthn.Email,
+		"name":    doc.WebAuthn.Name,
+		"picture": doc.WebAuthn.Picture,
+		"amr":     []string{"hwk", "user"},
+	}, now)
+}
+
+// providerSessionClaims returns the claims of the session token minted for
+// a user signed in with provider, keeping the provider's "sid", for its
+// front-channel logouts to terminate the session, and its ID token, for
+// RP-initiated logouts to hint at the session to terminate with it.
+func providerSessionClaims(provider string, auth *authDetails) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"sub":   auth.userID,
+		"email": auth.email,
+		"name":  auth.name,
+		"idp":   provider,
+	}
+	if auth.sessionID != "" {
+		claims["sid"] = auth.sessionID
+	}
+	if auth.idToken != nil {
+		claims["id_token"] = auth.idToken.Raw
+	}
+	return claims
+}
+
+// signLocalSession signs a session token with the given claims, valid for
+// localSessionTTL from now unless claims sets its own "exp".
+func signLocalSession(key []byte, claims jwt.MapClaims, now time.Time) (string, error) {
+	if key == nil {
+		return "", errPasswordlessDisabled
+	}
+	claims["iss"] = localSessionIssuer
+	claims["iat"] = now.Unix()
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = now.Add(localSessionTTL).Unix()
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = localSessionKeyID(key)
+	return token.SignedString(key)
+}
+
+// verifyTimeClaims validates the exp, iat, and nbf claims of a token at a
+// time, as jwt.Parse does at the current time.
+func verifyTimeClaims(claims jwt.MapClaims, now time.Time) error {
+	switch {
+	case !claims.VerifyExpiresAt(now.Unix(), false):
+		return jwt.NewValidationError("token is expired", jwt.ValidationErrorExpired)
+	case !claims.VerifyIssuedAt(now.Unix(), false):
+		return jwt.NewValidationError("token used before issued", jwt.ValidationErrorIssuedAt)
+	case !claims.VerifyNotBefore(now.Unix(), false):
+		return jwt.NewValidationError("token is not valid yet", jwt.ValidationErrorNotValidYet)
+	}
+	return nil
+}
+
+// localSessionParser returns an ID token parser that accepts session tokens
+// issued by issueLocalSession, signed with the key derived from any of the
+// encryption keys and unexpired by the time of clk, delegating all other
+// tokens to parseIDToken.
+func localSessionParser(
+	secureCookies secureCookies,
+	clk clock,
+	parseIDToken func(string) (*authDetails, error),
+) func(string) (*authDetails, error) {
+	return func(idToken string) (*authDetails, error) {
+		var unverified jwt.MapClaims
+		if _, _, err := jwt.NewParser().ParseUnverified(idToken, &unverified); err != nil ||
+			!unverified.VerifyIssuer(localSessionIssuer, true) {
+			return parseIDToken(idToken)
+		}
+		encryptionKeys := secureCookies.keys()
+		if len(encryptionKeys) == 0 {
+			return nil, errPasswordlessDisabled
+		}
+		token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+			// Tokens issued before key IDs were added are signed with the
+			// primary key.
+			kid, _ := token.Header["kid"].(string)
+			if kid == "" {
+				return deriveLocalSessionKey(encryptionKeys[0]), nil
+			}
+			for _, encryptionKey := range encryptionKeys {
+				if key := deriveLocalSessionKey(encryptionKey); localSessionKeyID(key) == kid {
+					return key, nil
+				}
+			}
+			return nil, errLocalSessionKeyUnknown
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithoutClaimsValidation())
+		if err != nil {
+			return nil, err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		if err := verifyTimeClaims(claims, clk.Now()); err != nil {
+			return nil, err
+		}
+		userID, _ := claims["sub"].(string)
+		email, _ := claims["email"].(string)
+		name, _ := claims["name"].(string)
+		picture, _ := claims["picture"].(string)
+		principal, _ := claims["principal"].(string)
+		sid, _ := claims["sid"].(string)
+		providerIDToken, _ := claims["id_token"].(string)
+		var issuedAt time.Time
+		if iat, ok := claims["iat"].(float64); ok {
+			issuedAt = time.Unix(int64(iat), 0)
+		}
+		return &authDetails{
+			idToken:         token,
+			claims:          claims,
+			userID:          userID,
+			email:           email,
+			name:            name,
+			picture:         picture,
+			principal:       principal,
+			issuedAt:        issuedAt,
+			sessionID:       sid,
+			authTime:        issuedAt,
+			providerIDToken: providerIDToken,
+		}, nil
+	}
+}
+
+// setWebAuthnSession stores ceremony state in an encrypted, short-lived cookie.
+func setWebAuthnSession(w http.ResponseWriter, secureCookies secureCookies, session *webauthn.SessionData) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	value, err := secureCookies.Encode(string(data))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     webauthnSessionCookieName,
+		Path:     "/api/webauthn",
+		Value:    value,
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   300,
+	})
+	return nil
+}
+
+// takeWebAuthnSession reads and clears the ceremony state cookie.
+func takeWebAuthnSession(w http.ResponseWriter, r *http.Request, secureCookies secureCookies) (*webauthn.SessionData, error) {
+	cookie, err := r.Cookie(webauthnSessionCookieName)
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     webauthnSessionCookieName,
+		Path:     "/api/webauthn",
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+	value, err := secureCookies.Decode(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(value), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// registerWebAuthnRoutes registers the passkey registration and assertion
+// endpoints. Passkeys serve both as a second factor for Google sign-in,
+// and for passwordless sign-in.
+func registerWebAuthnRoutes(
+	routes *routeRegistry,
+	config *appConfig,
+	mfa *mfaStorage,
+	secureCookies secureCookies,
+	binding *sessionBinding,
+	security *securityEvents,
+	logger *zap.Logger,
+) error {
+	rpID := config.WebAuthn.RPID
+	if rpID == "" {
+		rpID = "localhost"
+	}
+	rpOrigins := config.WebAuthn.RPOrigins
+	if len(rpOrigins) == 0 {
+		rpOrigins = []string{"https://localhost:8443"}
+	}
+	rpDisplayName := config.WebAuthn.RPDisplayName
+	if rpDisplayName == "" {
+		rpDisplayName = mfa.issuer
+	}
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpDisplayName,
+		RPOrigins:     rpOrigins,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid webauthn configuration: %w", err)
+	}
+	stepUpMaxAge := config.stepUpMaxAge()
+	signedIn := routes.group(groupSignedIn)
+	public := routes.group(groupPublic)
+
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(v)
+	}
+
+	// Registration of a new passkey for the signed-in user. Users who
+	// already have a second factor must have passed it in this session,
+	// so that a first factor alone cannot add a passkey. Registering does
+	// not pass MFA: a new passkey must be asserted to do so.
+	requirePassedMFA := requireMFA(mfa, secureCookies, false)
+	signedIn.POST("/api/webauthn/register/begin", requireRecentAuth(mfa.clock, stepUpMaxAge,
+		requirePassedMFA(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := mfa.passkeyUser(authFromContext(r.Context()))
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			creation, session, err := wa.BeginRegistration(user)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if err := setWebAuthnSession(w, secureCookies, session); err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, creation)
+		})).ServeHTTP,
+	))
+	signedIn.POST("/api/webauthn/register/finish",
+		requirePassedMFA(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := authFromContext(r.Context())
+			session, err := takeWebAuthnSession(w, r, secureCookies)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "missing or invalid registration session")
+				return
+			}
+			user, err := mfa.passkeyUser(auth)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			user.handle = session.UserID
+			credential, err := wa.FinishRegistration(user, *session, r)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := mfa.addPasskey(r.Context(), auth, session.UserID, credential); err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})).ServeHTTP,
+	)
+
+	// Assertion with a passkey as the second factor for the current session.
+	signedIn.POST("/api/webauthn/login/begin",
+		func(w http.ResponseWriter, r *http.Request) {
+			user, err := mfa.passkeyUser(authFromContext(r.Context()))
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			assertion, session, err := wa.BeginLogin(user)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := setWebAuthnSession(w, secureCookies, session); err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, assertion)
+		},
+	)
+	signedIn.POST("/api/webauthn/login/finish",
+		func(w http.ResponseWriter, r *http.Request) {
+			auth := authFromContext(r.Context())
+			session, err := takeWebAuthnSession(w, r, secureCookies)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "missing or invalid login session")
+				return
+			}
+			user, err := mfa.passkeyUser(auth)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			credential, err := wa.FinishLogin(user, *session, r)
+			if err != nil {
+				security.record(r, securityEventMFA, reasonAssertionFailed, auth.userID)
+				writeError(w, r, http.StatusUnauthorized, err.Error())
+				return
+			}
+			security.record(r, securityEventMFA, reasonSuccess, auth.userID)
+			if err := mfa.updatePasskey(r.Context(), auth.userID, credential); err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if err := setMFAPassed(w, secureCookies, auth); err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		},
+	)
+
+	// Passwordless sign-in with a discoverable credential.
+	public.POST("/api/webauthn/passkey/begin",
+		func(w http.ResponseWriter, r *http.Request) {
+			if localSessionKey(secureCookies.keys()) == nil {
+				writeError(w, r, http.StatusNotImplemented, errPasswordlessDisabled.Error())
+				return
+			}
+			assertion, session, err := wa.BeginDiscoverableLogin()
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if err := setWebAuthnSession(w, secureCookies, session); err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, assertion)
+		},
+	)
+	public.POST("/api/webauthn/passkey/finish",
+		func(w http.ResponseWriter, r *http.Request) {
+			logger := logger.With(traceLogFields(r.Context())...)
+			session, err := takeWebAuthnSession(w, r, secureCookies)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "missing or invalid login session")
+				return
+			}
+			var userID string
+			var doc *mfaDocument
+			_, credential, err := wa.FinishPasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+				userID, doc = mfa.userByHandle(userHandle)
+				if doc == nil {
+					return nil, errors.New("unknown passkey")
+				}
+				return &webauthnUser{
+					handle:      doc.WebAuthn.UserHandle,
+					name:        doc.WebAuthn.Email,
+					displayName: doc.WebAuthn.Name,
+					credentials: doc.WebAuthn.Credentials,
+				}, nil
+			}, *session, r)
+			if err != nil {
+				security.record(r, securityEventPasskeyLogin, reasonAssertionFailed, "")
+				writeError(w, r, http.StatusUnauthorized, err.Error())
+				return
+			}
+			security.record(r, securityEventPasskeyLogin, reasonSuccess, userID)
+			if err := mfa.updatePasskey(r.Context(), userID, credential); err != nil {
+				logger.Warn("failed to update passkey sign count", zap.Error(err))
+			}
+
+			now := mfa.clock.Now()
+			token, err := issueLocalSession(localSessionKey(secureCookies.keys()), userID, doc, now)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			cookieValue, err := secureCookies.Encode(token)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+				return
+			}
+			if err := binding.set(w, r, token, now.Add(localSessionTTL)); err != nil {
+				writeError(w, r, http.StatusInternalServerError, "failed to encode cookie")
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     "credentials",
+				Path:     credentialsCookiePath,
+				Value:    cookieValue,
+				Secure:   true,
+				HttpOnly: true,
+				Expires:  now.Add(localSessionTTL),
+			})
+			// A passkey assertion is itself multi-factor (possession plus
+			// user verification), so the session has passed MFA.
+			auth := &authDetails{userID: userID, issuedAt: time.Unix(now.Unix(), 0)}
+			if err := setMFAPassed(w, secureCookies, auth); err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			logger.Info("user signed in with passkey", zap.String("user.id", userID))
+			w.WriteHeader(http.StatusNoContent)
+		},
+	)
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const recordWorkflowIndex = "app-record-workflow"
+
+// Audit event actions of the record workflow.
+const (
+	auditActionTransition = "record.transition"
+	auditActionAssign     = "record.assign"
+)
+
+// defaultWorkflowTransitions are the allowed status transitions of records
+// if none are configured.
+var defaultWorkflowTransitions = map[string][]string{
+	"Pending":   {"Active", "Cancelled"},
+	"Active":    {"On Hold", "Completed", "Cancelled"},
+	"On Hold":   {"Active", "Cancelled"},
+	"Completed": {"Active"},
+}
+
+var (
+	errUnknownStatus      = errors.New("unknown status")
+	errTransitionInvalid  = errors.New("transition not allowed")
+	errTransitionConflict = errors.New("record status changed")
+)
+
+// workflow is a state machine of record statuses.
+type workflow struct {
+	transitions map[string][]string
+}
+
+func newWorkflow(config *appConfig) *workflow {
+	transitions := config.Workflow.Transitions
+	if len(transitions) == 0 {
+		transitions = defaultWorkflowTransitions
+	}
+	return &workflow{transitions: transitions}
+}
+
+// known reports whether status is a status of the workflow.
+func (wf *workflow) known(status string) bool {
+	if _, ok := wf.transitions[status]; ok {
+		return true
+	}
+	for _, targets := range wf.transitions {
+		if slices.Contains(targets, status) {
+			return true
+		}
+	}
+	return false
+}
+
+// statuses returns the statuses of the workflow, sorted.
+func (wf *workflow) statuses() []string {
+	var statuses []string
+	for from, targets := range wf.transitions {
+		statuses = append(statuses, from)
+		statuses = append(statuses, targets...)
+	}
+	sort.Strings(statuses)
+	return slices.Compact(statuses)
+}
+
+// check returns an error if records may not move from one status to
+// another.
+func (wf *workflow) check(from, to string) error {
+	if !wf.known(to) {
+		return fmt.Errorf("%w %q", errUnknownStatus, to)
+	}
+	if !slices.Contains(wf.transitions[from], to) {
+		return fmt.Errorf("%w from %q to %q", errTransitionInvalid, from, to)
+	}
+	return nil
+}
+
+// recordState is the workflow state of a record, overriding its generated
+// status, as persisted to Elasticsearch.
+type recordState struct {
+	RecordID  string    `json:"record_id"`
+	Status    string    `json:"status,omitempty"`
+	Assignee  string    `json:"assignee,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by"`
+}
+
+// workflowStore manages the workflow state of records, persisted to
+// Elasticsearch if configured, with a document per record.
+type workflowStore struct {
+	client *elasticsearch.Client
+	logger *zap.Logger
+
+	mu     sync.RWMutex
+	states map[string]recordState
+}
+
+func newWorkflowStore(client *elasticsearch.Client, logger *zap.Logger) (*workflowStore, error) {
+	s := &workflowStore{
+		client: client,
+		logger: logger,
+		states: make(map[string]recordState),
+	}
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("failed to init workflow store: %w", err)
+	}
+	return s, nil
+}
+
+// init loads existing record states from Elasticsearch.
+func (s *workflowStore) init() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("main").Start(context.Background(), "initWorkflowStore")
+	defer span.End()
+	logger := s.logger.With(traceLogFields(ctx)...)
+
+	res, err := s.client.Search(
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(recordWorkflowIndex),
+		s.client.Search.WithSize(10000),
+	)
+	if err != nil {
+		logger.Info("could not load record states from Elasticsearch", zap.Error(err))
+		return nil
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.Info("could not load record states from Elasticsearch", zap.String("status", res.Status()))
+		return nil
+	}
+	var searchResult struct {
+		Hits struct {
+			Hits []struct {
+				Source recordState `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		s.states[hit.Source.RecordID] = hit.Source
+	}
+
+	logger.Info("loaded record states", zap.Int("records", len(s.states)))
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// apply sets the workflow state of records, which must be copies, as
+// returned by tagStore.tagged.
+func (s *workflowStore) apply(records []SampleRecord) []SampleRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := range records {
+		if state, ok := s.states[records[i].ID]; ok {
+			if state.Status != "" {
+				records[i].Status = state.Status
+			}
+			records[i].Assignee = state.Assignee
+		}
+	}
+	return records
+}
+
+// update changes the workflow state of record, after checking the change
+// against its current state. It returns the previous and updated states.
+func (s *workflowStore) update(
+	ctx context.Context, record SampleRecord, userID string, change func(*recordState) error,
+) (recordState, recordState, error) {
+	s.mu.Lock()
+	current, ok := s.states[record.ID]
+	if !ok {
+		current = recordState{RecordID: record.ID}
+	}
+	if current.Status == "" {
+		current.Status = record.Status
+	}
+	state := current
+	if err := change(&state); err != nil {
+		s.mu.Unlock()
+		return current, state, err
+	}
+	state.UpdatedAt, state.UpdatedBy = time.Now().UTC(), userID
+	s.states[record.ID] = state
+	s.mu.Unlock()
+
+	if s.client == nil {
+		return current, state, nil
+	}
+	res, err := s.client.Index(
+		recordWorkflowIndex, esutil.NewJSONReader(state),
+		s.client.Index.WithDocumentID(record.ID),
+		s.client.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return current, state, fmt.Errorf("while saving record state: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return current, state, fmt.Errorf("saving record state failed: %s", res.Status())
+	}
+	return current, state, nil
+}
+
+// registerWorkflowRoutes registers the endpoints for moving records
+// through the workflow and assigning them.
+func registerWorkflowRoutes(
+	routes *routeRegistry,
+	wf *workflow,
+	states *workflowStore,
+	records *recordStore,
+	audit *auditLog,
+	logger *zap.Logger,
+) {
+	user := routes.group(groupUser)
+
+	recordByID := func(id string) (SampleRecord, bool) {
+		stored, ok := records.get(id)
+		return stored.record, ok
+	}
+	writeState := func(w http.ResponseWriter, state recordState) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	}
+
+	user.POST("/api/records/{id}/transition", func(w http.ResponseWriter, r *http.Request) {
+		record, ok := recordByID(r.PathValue("id"))
+		if !ok {
+			writeError(w, r, http.StatusNotFound, errUnknownRecord.Error())
+			return
+		}
+		var req struct {
+			// From optionally guards against concurrent transitions.
+			From string `json:"from"`
+			To   string `json:"to"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		auth := authFromContext(r.Context())
+		previous, updated, err := states.update(r.Context(), record, auth.userID, func(state *recordState) error {
+			if req.From != "" && req.From != state.Status {
+				return fmt.Errorf("%w: %q, not %q", errTransitionConflict, state.Status, req.From)
+			}
+			if err := wf.check(state.Status, req.To); err != nil {
+				return err
+			}
+			state.Status = req.To
+			return nil
+		})
+		switch {
+		case errors.Is(err, errUnknownStatus):
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		case errors.Is(err, errTransitionInvalid), errors.Is(err, errTransitionConflict):
+			writeError(w, r, http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			logger.Error("failed to save record state", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		audit.record(r.Context(), auditActionTransition, auth.userID, record.ID, map[string]string{
+			"status.from": previous.Status,
+			"status.to":   req.To,
+		})
+		writeState(w, updated)
+	})
+
+	user.PUT("/api/records/{id}/assignee", func(w http.ResponseWriter, r *http.Request) {
+		record, ok := recordByID(r.PathValue("id"))
+		if !ok {
+			writeError(w, r, http.StatusNotFound, errUnknownRecord.Error())
+			return
+		}
+		var req struct {
+			Assignee string `json:"assignee"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		assignee := strings.TrimSpace(req.Assignee)
+		auth := authFromContext(r.Context())
+		previous, updated, err := states.update(r.Context(), record, auth.userID, func(state *recordState) error {
+			state.Assignee = assignee
+			return nil
+		})
+		if err != nil {
+			logger.Error("failed to save record state", append(traceLogFields(r.Context()), zap.Error(err))...)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if previous.Assignee != assignee {
+			audit.record(r.Context(), auditActionAssign, auth.userID, record.ID, map[string]string{
+				"assignee.from": previous.Assignee,
+				"assignee.to":   assignee,
+			})
+		}
+		writeState(w, updated)
+	})
+}
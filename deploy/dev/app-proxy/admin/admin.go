@@ -0,0 +1,96 @@
+// Package admin is a client of the admin API of the dev proxy, which
+// serves its routing table, the health of its upstreams, and its metrics
+// on a local port, and reloads its routes on demand.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Paths of the admin API.
+const (
+	RoutesPath  = "/routes"
+	ReloadPath  = "/routes/reload"
+	HealthPath  = "/health"
+	MetricsPath = "/metrics"
+)
+
+// Config is the routing table of the proxy, as read from its routes file.
+type Config struct {
+	Routes []Route `json:"routes"`
+}
+
+// Route sends requests whose path starts with Prefix to Upstream. The
+// longest matching prefix wins.
+type Route struct {
+	Prefix   string `json:"prefix"`
+	Upstream string `json:"upstream"`
+
+	// HealthPath is requested on the upstream to check its health, "/"
+	// if unset. Any response below 500 counts as healthy.
+	HealthPath string `json:"health_path,omitempty"`
+}
+
+// UpstreamHealth is the outcome of the last health check of a route's
+// upstream.
+type UpstreamHealth struct {
+	Prefix    string        `json:"prefix"`
+	Upstream  string        `json:"upstream"`
+	Healthy   bool          `json:"healthy"`
+	Status    int           `json:"status,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Latency   time.Duration `json:"latency_ns"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+// Client calls the admin API at BaseURL, such as http://127.0.0.1:9901.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// Routes returns the routing table in use.
+func (c *Client) Routes(ctx context.Context) ([]Route, error) {
+	var routes []Route
+	return routes, c.do(ctx, http.MethodGet, RoutesPath, &routes)
+}
+
+// Reload makes the proxy read its routes file again, and returns the new
+// routing table. If the file is invalid, the proxy keeps its routes.
+func (c *Client) Reload(ctx context.Context) ([]Route, error) {
+	var routes []Route
+	return routes, c.do(ctx, http.MethodPost, ReloadPath, &routes)
+}
+
+// Health returns the health of the upstreams, by route.
+func (c *Client) Health(ctx context.Context) ([]UpstreamHealth, error) {
+	var health []UpstreamHealth
+	return health, c.do(ctx, http.MethodGet, HealthPath, &health)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, result any) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("while calling %s %s: %w", method, path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s failed: %s: %s", method, path, res.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
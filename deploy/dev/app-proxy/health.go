@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"app-proxy/admin"
+)
+
+// healthCheckTimeout bounds each health check of an upstream.
+const healthCheckTimeout = 2 * time.Second
+
+// healthChecker periodically checks the upstreams of the routes in use,
+// and again whenever the routes are reloaded.
+type healthChecker struct {
+	proxy    *proxy
+	client   *http.Client
+	interval time.Duration
+	recheck  chan struct{}
+
+	mu      sync.Mutex
+	results map[[2]string]admin.UpstreamHealth
+}
+
+func newHealthChecker(p *proxy, interval time.Duration) *healthChecker {
+	return &healthChecker{
+		proxy:    p,
+		client:   &http.Client{Timeout: healthCheckTimeout},
+		interval: interval,
+		recheck:  make(chan struct{}, 1),
+		results:  make(map[[2]string]admin.UpstreamHealth),
+	}
+}
+
+// run checks the upstreams until ctx is done.
+func (h *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-h.recheck:
+		}
+	}
+}
+
+// trigger makes run check the upstreams without waiting for the interval.
+func (h *healthChecker) trigger() {
+	select {
+	case h.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// checkAll checks the upstreams of the routes in use, concurrently, and
+// forgets those of routes no longer in use.
+func (h *healthChecker) checkAll(ctx context.Context) {
+	table := h.proxy.routes()
+	results := make([]admin.UpstreamHealth, len(table))
+	var wg sync.WaitGroup
+	for i := range table {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = h.check(ctx, &table[i])
+		}()
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	h.results = make(map[[2]string]admin.UpstreamHealth, len(results))
+	for _, result := range results {
+		h.results[[2]string{result.Prefix, result.Upstream}] = result
+	}
+	h.mu.Unlock()
+	h.proxy.metrics.routes(table)
+	for _, result := range results {
+		h.proxy.metrics.health(result.Prefix, result.Upstream, result.Healthy)
+	}
+}
+
+// check requests the health path of a route's upstream.
+func (h *healthChecker) check(ctx context.Context, rt *route) admin.UpstreamHealth {
+	result := admin.UpstreamHealth{Prefix: rt.Prefix, Upstream: rt.Upstream, CheckedAt: time.Now().UTC()}
+	u := *rt.upstream
+	u.Path = rt.HealthPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	start := time.Now()
+	res, err := h.client.Do(req)
+	result.Latency = time.Since(start)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	res.Body.Close()
+	result.Status = res.StatusCode
+	result.Healthy = res.StatusCode < http.StatusInternalServerError
+	return result
+}
+
+// health returns the results of the last checks, in the order of the
+// routes in use. Upstreams not checked yet are reported unhealthy.
+func (h *healthChecker) health() []admin.UpstreamHealth {
+	table := h.proxy.routes()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	health := make([]admin.UpstreamHealth, len(table))
+	for i, rt := range table {
+		result, ok := h.results[[2]string{rt.Prefix, rt.Upstream}]
+		if !ok {
+			result = admin.UpstreamHealth{Prefix: rt.Prefix, Upstream: rt.Upstream, Error: "not checked yet"}
+		}
+		health[i] = result
+	}
+	return health
+}
@@ -1,27 +1,180 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
-	"strings"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"app-proxy/admin"
 )
 
-func main() {
-	frontendURL := &url.URL{Scheme: "http", Host: "app-frontend:3000"}
-	backendURL := &url.URL{Scheme: "http", Host: "app-backend:4000"}
-	rp := &httputil.ReverseProxy{
+// getenv returns the environment variable with the given name, or def if
+// it is unset. The defaults are those of the dev stack; the end-to-end
+// tests override them to run the proxy locally.
+func getenv(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+type routeKey struct{}
+
+// proxy reverse-proxies requests to the upstream of their route, in the
+// routing table read from routesFile, or the default one.
+type proxy struct {
+	routesFile string
+	table      atomic.Pointer[routeTable]
+	metrics    *metrics
+	rp         *httputil.ReverseProxy
+}
+
+func newProxy(routesFile string) (*proxy, error) {
+	p := &proxy{routesFile: routesFile, metrics: newMetrics()}
+	table, err := loadRoutes(routesFile)
+	if err != nil {
+		return nil, err
+	}
+	p.table.Store(&table)
+	p.rp = &httputil.ReverseProxy{
 		Rewrite: func(pr *httputil.ProxyRequest) {
-			if strings.HasPrefix(pr.In.URL.Path, "/api/") {
-				pr.SetURL(backendURL)
-			} else {
-				pr.SetURL(frontendURL)
-			}
+			pr.SetURL(pr.In.Context().Value(routeKey{}).(*route).upstream)
 			pr.SetXForwarded()
 		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			rt := r.Context().Value(routeKey{}).(*route)
+			p.metrics.upstreamError(rt.Prefix)
+			log.Printf("proxying %s %s to %s: %v", r.Method, r.URL.Path, rt.Upstream, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return p, nil
+}
+
+// routes returns the routing table in use.
+func (p *proxy) routes() routeTable {
+	return *p.table.Load()
+}
+
+// reload reads the routes file again. If it is invalid, the routes in use
+// are kept.
+func (p *proxy) reload() (routeTable, error) {
+	table, err := loadRoutes(p.routesFile)
+	p.metrics.reload(err)
+	if err != nil {
+		return nil, err
+	}
+	p.table.Store(&table)
+	return table, nil
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt := p.routes().match(r.URL.Path)
+	if rt == nil {
+		http.Error(w, "no route", http.StatusNotFound)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	start := time.Now()
+	p.rp.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), routeKey{}, rt)))
+	p.metrics.request(rt.Prefix, sw.status, sw.elapsed(start))
+}
+
+// statusWriter records the status code of a response, and when its
+// headers were written.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader time.Time
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status, w.wroteHeader = status, time.Now()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
 	}
-	if err := http.ListenAndServeTLS(":8443", "/tls/cert.pem", "/tls/key.pem", rp); err != nil {
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets the reverse proxy flush streamed responses, and hijack
+// upgraded connections.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) elapsed(start time.Time) time.Duration {
+	if w.wroteHeader.IsZero() {
+		return time.Since(start)
+	}
+	return w.wroteHeader.Sub(start)
+}
+
+// adminHandler serves the admin API: the routing table, the health of the
+// upstreams, and the metrics, and reloads the routes.
+func adminHandler(p *proxy, health *healthChecker) http.Handler {
+	writeJSON := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+admin.RoutesPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, p.routes().config())
+	})
+	mux.HandleFunc("POST "+admin.ReloadPath, func(w http.ResponseWriter, r *http.Request) {
+		table, err := p.reload()
+		if err != nil {
+			log.Printf("reloading routes: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		health.trigger()
+		writeJSON(w, table.config())
+	})
+	mux.HandleFunc("GET "+admin.HealthPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, health.health())
+	})
+	mux.HandleFunc("GET "+admin.MetricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		p.metrics.write(w)
+	})
+	return mux
+}
+
+func main() {
+	p, err := newProxy(os.Getenv("ROUTES_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	interval, err := time.ParseDuration(getenv("HEALTH_CHECK_INTERVAL", "10s"))
+	if err != nil || interval <= 0 {
+		log.Fatalf("invalid HEALTH_CHECK_INTERVAL: %v", err)
+	}
+	health := newHealthChecker(p, interval)
+	go health.run(context.Background())
+
+	// The admin API listens on the loopback interface by default, out of
+	// reach of the cluster; kubectl port-forward reaches it.
+	go func() {
+		if err := http.ListenAndServe(getenv("ADMIN_ADDR", "127.0.0.1:9901"), adminHandler(p, health)); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	addr := getenv("LISTEN_ADDR", ":8443")
+	certFile := getenv("TLS_CERT_FILE", "/tls/cert.pem")
+	keyFile := getenv("TLS_KEY_FILE", "/tls/key.pem")
+	if err := http.ListenAndServeTLS(addr, certFile, keyFile, p); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metrics counts the requests proxied, by route, and the outcomes of
+// health checks and reloads, served in the Prometheus text format.
+type metrics struct {
+	mu        sync.Mutex
+	requests  map[[2]string]int // by route and status code
+	durations map[string]*durationSum
+	errors    map[string]int // by route
+	up        map[[2]string]bool
+	reloads   map[string]int // by result
+}
+
+type durationSum struct {
+	count int
+	sum   time.Duration
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  make(map[[2]string]int),
+		durations: make(map[string]*durationSum),
+		errors:    make(map[string]int),
+		up:        make(map[[2]string]bool),
+		reloads:   make(map[string]int),
+	}
+}
+
+// request records a request proxied by a route.
+func (m *metrics) request(prefix string, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[2]string{prefix, strconv.Itoa(status)}]++
+	d := m.durations[prefix]
+	if d == nil {
+		d = &durationSum{}
+		m.durations[prefix] = d
+	}
+	d.count++
+	d.sum += elapsed
+}
+
+// upstreamError records a request a route's upstream failed to answer.
+func (m *metrics) upstreamError(prefix string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[prefix]++
+}
+
+// health records the outcome of a health check.
+func (m *metrics) health(prefix, upstream string, healthy bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.up[[2]string{prefix, upstream}] = healthy
+}
+
+// routes drops the health of upstreams of routes not in table.
+func (m *metrics) routes(table routeTable) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.up {
+		if rt := table.match(key[0]); rt == nil || rt.Prefix != key[0] || rt.Upstream != key[1] {
+			delete(m.up, key)
+		}
+	}
+}
+
+// reload records the result of a reload of the routes.
+func (m *metrics) reload(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.reloads["failure"]++
+	} else {
+		m.reloads["success"]++
+	}
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP proxy_requests_total Requests proxied, by route and status code.")
+	fmt.Fprintln(w, "# TYPE proxy_requests_total counter")
+	for _, key := range sortedKeys(m.requests) {
+		fmt.Fprintf(w, "proxy_requests_total{route=%q,code=%q} %d\n", key[0], key[1], m.requests[key])
+	}
+	fmt.Fprintln(w, "# HELP proxy_request_duration_seconds Time to proxy requests, by route, until their response headers.")
+	fmt.Fprintln(w, "# TYPE proxy_request_duration_seconds summary")
+	for _, prefix := range sortedKeys(m.durations) {
+		d := m.durations[prefix]
+		fmt.Fprintf(w, "proxy_request_duration_seconds_sum{route=%q} %g\n", prefix, d.sum.Seconds())
+		fmt.Fprintf(w, "proxy_request_duration_seconds_count{route=%q} %d\n", prefix, d.count)
+	}
+	fmt.Fprintln(w, "# HELP proxy_upstream_errors_total Requests the upstream of a route failed to answer.")
+	fmt.Fprintln(w, "# TYPE proxy_upstream_errors_total counter")
+	for _, prefix := range sortedKeys(m.errors) {
+		fmt.Fprintf(w, "proxy_upstream_errors_total{route=%q} %d\n", prefix, m.errors[prefix])
+	}
+	fmt.Fprintln(w, "# HELP proxy_upstream_up Whether the last health check of the upstream of a route succeeded.")
+	fmt.Fprintln(w, "# TYPE proxy_upstream_up gauge")
+	for _, key := range sortedKeys(m.up) {
+		up := 0
+		if m.up[key] {
+			up = 1
+		}
+		fmt.Fprintf(w, "proxy_upstream_up{route=%q,upstream=%q} %d\n", key[0], key[1], up)
+	}
+	fmt.Fprintln(w, "# HELP proxy_config_reloads_total Reloads of the routes, by result.")
+	fmt.Fprintln(w, "# TYPE proxy_config_reloads_total counter")
+	for _, result := range sortedKeys(m.reloads) {
+		fmt.Fprintf(w, "proxy_config_reloads_total{result=%q} %d\n", result, m.reloads[result])
+	}
+}
+
+func sortedKeys[K string | [2]string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+	return keys
+}
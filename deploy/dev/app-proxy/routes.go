@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"app-proxy/admin"
+)
+
+// route is a route of the table, with its upstream parsed.
+type route struct {
+	admin.Route
+	upstream *url.URL
+}
+
+// routeTable holds routes, longest prefix first.
+type routeTable []route
+
+// match returns the route of a request path, or nil if none matches.
+func (t routeTable) match(path string) *route {
+	for i := range t {
+		if strings.HasPrefix(path, t[i].Prefix) {
+			return &t[i]
+		}
+	}
+	return nil
+}
+
+// config returns the routes of the table, as served by the admin API.
+func (t routeTable) config() []admin.Route {
+	routes := make([]admin.Route, len(t))
+	for i, rt := range t {
+		routes[i] = rt.Route
+	}
+	return routes
+}
+
+// defaultRoutes are those of the dev stack: the API and SCIM endpoints go
+// to the backend, and everything else to the frontend.
+func defaultRoutes() admin.Config {
+	backend := getenv("BACKEND_URL", "http://app-backend:4000")
+	return admin.Config{Routes: []admin.Route{
+		{Prefix: "/api/", Upstream: backend, HealthPath: "/api/ready"},
+		{Prefix: "/scim/", Upstream: backend, HealthPath: "/api/ready"},
+		{Prefix: "/", Upstream: getenv("FRONTEND_URL", "http://app-frontend:3000")},
+	}}
+}
+
+// loadRoutes reads the routes file at path, or returns the default routes
+// if path is empty.
+func loadRoutes(path string) (routeTable, error) {
+	config := defaultRoutes()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		config = admin.Config{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+	return newRouteTable(config)
+}
+
+// newRouteTable checks the routes of config, and sorts them.
+func newRouteTable(config admin.Config) (routeTable, error) {
+	if len(config.Routes) == 0 {
+		return nil, fmt.Errorf("no routes")
+	}
+	table := make(routeTable, 0, len(config.Routes))
+	seen := make(map[string]bool)
+	for _, r := range config.Routes {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return nil, fmt.Errorf("route prefix %q does not start with /", r.Prefix)
+		}
+		if seen[r.Prefix] {
+			return nil, fmt.Errorf("duplicate route prefix %q", r.Prefix)
+		}
+		seen[r.Prefix] = true
+		upstream, err := url.Parse(r.Upstream)
+		if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") || upstream.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q of route %q", r.Upstream, r.Prefix)
+		}
+		if r.HealthPath == "" {
+			r.HealthPath = "/"
+		}
+		table = append(table, route{Route: r, upstream: upstream})
+	}
+	sort.SliceStable(table, func(i, j int) bool { return len(table[i].Prefix) > len(table[j].Prefix) })
+	return table, nil
+}
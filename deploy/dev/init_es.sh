@@ -19,6 +19,26 @@ curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-sessions" \
   -H "Content-Type: application/json" \
   -d '{
     "mappings": {
+      "dynamic_templates": [
+        {
+          "provider_tokens": {
+            "path_match": "providers.*.access_token",
+            "mapping": { "type": "keyword", "index": false }
+          }
+        },
+        {
+          "provider_keywords": {
+            "path_match": ["providers.*.refresh_token", "providers.*.scopes"],
+            "mapping": { "type": "keyword" }
+          }
+        },
+        {
+          "provider_dates": {
+            "path_match": ["providers.*.issued_at", "providers.*.expiry"],
+            "mapping": { "type": "date" }
+          }
+        }
+      ],
       "properties": {
         "user_id": { "type": "keyword" },
         "email": { "type": "keyword" },
@@ -26,9 +46,13 @@ curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-sessions" \
         "picture": { "type": "keyword" },
         "created_at": { "type": "date" },
         "updated_at": { "type": "date" },
+        "schema_version": { "type": "integer" },
+        "providers": { "type": "object" },
         "google": {
           "properties": {
             "refresh_token": { "type": "keyword" },
+            "access_token": { "type": "keyword", "index": false },
+            "expiry": { "type": "date" },
             "issued_at": { "type": "date" }
           }
         }
@@ -36,23 +60,260 @@ curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-sessions" \
     }
   }' || echo "Index may already exist"
 
-# Create the app-data index for sample application data
-echo "Creating app-data index..."
-curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-data" \
+# Create the app-records index for records, seeded by the backend
+echo "Creating app-records index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-records" \
   -H "Content-Type: application/json" \
   -d '{
     "mappings": {
       "properties": {
+        "id": { "type": "keyword" },
         "name": { "type": "text" },
         "description": { "type": "text" },
         "created_at": { "type": "date" },
-        "updated_at": { "type": "date" },
         "status": { "type": "keyword" },
         "category": { "type": "keyword" }
       }
     }
   }' || echo "Index may already exist"
 
+# Create the app-security-events index for authentication telemetry
+echo "Creating app-security-events index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-security-events" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "@timestamp": { "type": "date" },
+        "event": {
+          "properties": {
+            "kind": { "type": "keyword" },
+            "reason": { "type": "keyword" },
+            "outcome": { "type": "keyword" }
+          }
+        },
+        "user": { "properties": { "id": { "type": "keyword" } } },
+        "client": { "properties": { "ip": { "type": "ip" } } },
+        "user_agent": { "properties": { "original": { "type": "keyword" } } },
+        "trace": { "properties": { "id": { "type": "keyword" } } }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-health-history index for dependency health checks
+echo "Creating app-health-history index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-health-history" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "@timestamp": { "type": "date" },
+        "dependency": { "type": "keyword" },
+        "status": { "type": "keyword" },
+        "latency_ms": { "type": "float" },
+        "error": { "type": "text" }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-oauth-states index for server-side OAuth state
+echo "Creating app-oauth-states index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-oauth-states" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "data": { "type": "object", "enabled": false },
+        "expires_at": { "type": "date" }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-identities index for identities linked to user accounts
+echo "Creating app-identities index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-identities" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "provider": { "type": "keyword" },
+        "subject": { "type": "keyword" },
+        "user_id": { "type": "keyword" },
+        "email": { "type": "keyword" },
+        "created_at": { "type": "date" }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-record-tags index for the tags of records
+echo "Creating app-record-tags index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-record-tags" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "record_id": { "type": "keyword" },
+        "tags": { "type": "keyword" },
+        "updated_at": { "type": "date" }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-record-comments index for comments on records
+echo "Creating app-record-comments index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-record-comments" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "id": { "type": "keyword" },
+        "record_id": { "type": "keyword" },
+        "author_id": { "type": "keyword" },
+        "author_name": { "type": "text" },
+        "body": { "type": "text" },
+        "created_at": { "type": "date" },
+        "deleted_at": { "type": "date" },
+        "deleted_by": { "type": "keyword" }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-record-stars index for records starred by users
+echo "Creating app-record-stars index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-record-stars" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "user_id": { "type": "keyword" },
+        "record_id": { "type": "keyword" },
+        "starred_at": { "type": "date" }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-record-workflow index for the status and assignee of records
+echo "Creating app-record-workflow index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-record-workflow" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "record_id": { "type": "keyword" },
+        "status": { "type": "keyword" },
+        "assignee": { "type": "keyword" },
+        "updated_at": { "type": "date" },
+        "updated_by": { "type": "keyword" }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-audit-events index for changes to application data
+echo "Creating app-audit-events index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-audit-events" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "@timestamp": { "type": "date" },
+        "event.action": { "type": "keyword" },
+        "user.id": { "type": "keyword" },
+        "record.id": { "type": "keyword" },
+        "changes": { "type": "flattened" },
+        "startup": { "type": "flattened" },
+        "trace.id": { "type": "keyword" }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-record-attachments index for the metadata of record attachments
+echo "Creating app-record-attachments index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-record-attachments" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "id": { "type": "keyword" },
+        "record_id": { "type": "keyword" },
+        "filename": { "type": "keyword" },
+        "content_type": { "type": "keyword" },
+        "size": { "type": "long" },
+        "sha256": { "type": "keyword" },
+        "uploaded_by": { "type": "keyword" },
+        "uploaded_at": { "type": "date" },
+        "scan": {
+          "properties": {
+            "verdict": { "type": "keyword" },
+            "signature": { "type": "keyword" },
+            "scanner": { "type": "keyword" },
+            "scanned_at": { "type": "date" }
+          }
+        }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-upload-sessions index for resumable uploads in progress
+echo "Creating app-upload-sessions index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-upload-sessions" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "id": { "type": "keyword" },
+        "filename": { "type": "keyword" },
+        "size": { "type": "long" },
+        "offset": { "type": "long" },
+        "sha256": { "type": "keyword" },
+        "chunks": { "type": "keyword" },
+        "created_by": { "type": "keyword" },
+        "created_at": { "type": "date" },
+        "expires_at": { "type": "date" }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-invalidations index, the change log propagating in-memory state between replicas
+echo "Creating app-invalidations index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-invalidations" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "kind": { "type": "keyword" },
+        "key": { "type": "keyword" },
+        "replica": { "type": "keyword" },
+        "at": { "type": "date" },
+        "created_at": { "type": "date" }
+      }
+    }
+  }' || echo "Index may already exist"
+
+# Create the app-tenants index for tenants' overrides of configuration values
+echo "Creating app-tenants index..."
+curl -s -X PUT -u "$ES_AUTH" "$ES_URL/app-tenants" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "mappings": {
+      "properties": {
+        "tenant": { "type": "keyword" },
+        "features": { "type": "object", "enabled": false },
+        "quotas": {
+          "properties": {
+            "attachment_max_size": { "type": "long" },
+            "upload_max_size": { "type": "long" }
+          }
+        },
+        "branding": {
+          "properties": {
+            "app_name": { "type": "keyword" }
+          }
+        },
+        "updated_at": { "type": "date" }
+      }
+    }
+  }' || echo "Index may already exist"
+
 # Create an API key for the application
 echo "Creating API key for the application..."
 API_KEY_RESPONSE=$(curl -s -X POST -u "$ES_AUTH" "$ES_URL/_security/api_key" \
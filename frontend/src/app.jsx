@@ -10,7 +10,9 @@ import {
   EuiPageTemplate,
   EuiPanel,
   EuiSpacer,
+  EuiLink,
   EuiText,
+  EuiThemeProvider,
   EuiTitle,
 } from '@elastic/eui';
 
@@ -34,7 +36,11 @@ const router = createBrowserRouter([
     loader: async () => {
       const response = await fetch("/api/config");
       if (response.ok) return response.json();
-      return { apm: { server_url: '' }, google: { client_id: '', oauth_scope: 'openid email profile' } };
+      return {
+        apm: { server_url: '' },
+        google: { client_id: '', oauth_scope: 'openid email profile' },
+        branding: { app_name: 'App Scaffold', footer_links: [] },
+      };
     },
     children: [
       {
@@ -63,28 +69,51 @@ function Root() {
     breakdownMetrics: true,
     apiVersion: 3,
   });
+  const branding = config.branding;
+  useEffect(() => {
+    document.title = branding.app_name;
+  }, [branding.app_name]);
+  // Overrides the primary color of the EUI theme, if configured
+  const theme = branding.primary_color
+    ? { colors: { LIGHT: { primary: branding.primary_color } } }
+    : undefined;
   return (
-    <AuthProvider config={config}>
-      <PageLayout><Outlet/></PageLayout>
-    </AuthProvider>
+    <EuiThemeProvider modify={theme}>
+      <AuthProvider config={config}>
+        <PageLayout branding={branding}><Outlet/></PageLayout>
+      </AuthProvider>
+    </EuiThemeProvider>
   )
 }
 
-function PageLayout() {
+function PageLayout({branding}) {
   const {profile, signInButtonRef} = useAuth();
-  
+  const iconType = branding.logo_url || "logoElastic";
+  const footer = branding.footer_links.length > 0 && (
+    <EuiPageTemplate.BottomBar paddingSize="s">
+      <EuiFlexGroup gutterSize="l" justifyContent="center" responsive={false}>
+        {branding.footer_links.map(link => (
+          <EuiFlexItem grow={false} key={link.url}>
+            <EuiLink href={link.url} color="text" external={link.url.startsWith("http")}>{link.label}</EuiLink>
+          </EuiFlexItem>
+        ))}
+      </EuiFlexGroup>
+    </EuiPageTemplate.BottomBar>
+  );
+
   if (!profile) {
     return (
       <EuiPageTemplate panelled={true}>
         <EuiPageTemplate.Header
-             pageTitle="App Scaffold"
-             iconType="logoElastic"
+             pageTitle={branding.app_name}
+             iconType={iconType}
              rightSideItems={[<div key="signin" ref={signInButtonRef}></div>]}/>
         <EuiPageTemplate.Section>
           <EuiCallOut title="Welcome" color="primary" iconType="user">
             <p>Please sign in with your Google account to continue.</p>
           </EuiCallOut>
         </EuiPageTemplate.Section>
+        {footer}
       </EuiPageTemplate>
     )
   }
@@ -93,10 +122,11 @@ function PageLayout() {
   return (
     <EuiPageTemplate panelled={true}>
       <EuiPageTemplate.Header
-           pageTitle="App Scaffold"
-           iconType="logoElastic"
+           pageTitle={branding.app_name}
+           iconType={iconType}
            rightSideItems={[avatar]}/>
       <EuiPageTemplate.Section restrictWidth={1400}><Outlet/></EuiPageTemplate.Section>
+      {footer}
     </EuiPageTemplate>
   )
 }
@@ -177,6 +207,7 @@ function HelloSection() {
 
 function DataTableSection() {
   const [data, setData] = useState([]);
+  const [total, setTotal] = useState(0);
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState(null);
   const [searchValue, setSearchValue] = useState('');
@@ -184,70 +215,47 @@ function DataTableSection() {
   const [pageSize, setPageSize] = useState(10);
   const [sortField, setSortField] = useState('created_at');
   const [sortDirection, setSortDirection] = useState('desc');
+  const [reloads, setReloads] = useState(0);
 
+  // The table is paged, sorted and searched by the server, requesting
+  // one numbered page at a time.
   useEffect(() => {
-    fetch("/api/data")
+    const params = new URLSearchParams({
+      page: pageIndex + 1,
+      per_page: pageSize,
+      sort_field: sortField,
+      sort_order: sortDirection,
+    });
+    if (searchValue) {
+      params.set('q', searchValue);
+    }
+    let cancelled = false;
+    setLoading(true);
+    fetch(`/api/data?${params}`)
       .then(response => {
         if (!response.ok) {
           throw new Error(`HTTP error! status: ${response.status}`);
         }
         return response.json();
       })
-      .then(data => {
-        setData(data);
+      .then(page => {
+        if (cancelled) return;
+        setData(page.items);
+        setTotal(page.total);
+        setError(null);
         setLoading(false);
       })
       .catch(err => {
+        if (cancelled) return;
         setError(err.message);
         setLoading(false);
       });
-  }, []);
-
-  const refreshData = () => {
-    setLoading(true);
-    fetch("/api/data")
-      .then(response => response.json())
-      .then(data => {
-        setData(data);
-        setLoading(false);
-      })
-      .catch(err => {
-        setError(err.message);
-        setLoading(false);
-      });
-  };
-
-  // Filter data based on search
-  const filteredData = data.filter(item => {
-    if (!searchValue) return true;
-    const searchLower = searchValue.toLowerCase();
-    return (
-      item.id.toLowerCase().includes(searchLower) ||
-      item.name.toLowerCase().includes(searchLower) ||
-      item.description.toLowerCase().includes(searchLower) ||
-      item.status.toLowerCase().includes(searchLower) ||
-      item.category.toLowerCase().includes(searchLower)
-    );
-  });
-
-  // Sort data
-  const sortedData = [...filteredData].sort((a, b) => {
-    let aValue = a[sortField];
-    let bValue = b[sortField];
-    
-    if (sortField === 'created_at') {
-      aValue = new Date(aValue);
-      bValue = new Date(bValue);
-    }
-    
-    if (aValue < bValue) return sortDirection === 'asc' ? -1 : 1;
-    if (aValue > bValue) return sortDirection === 'asc' ? 1 : -1;
-    return 0;
-  });
+    return () => {
+      cancelled = true;
+    };
+  }, [pageIndex, pageSize, sortField, sortDirection, searchValue, reloads]);
 
-  // Paginate data
-  const startIndex = pageIndex * pageSize;
-  const pageData = sortedData.slice(startIndex, startIndex + pageSize);
+  const refreshData = () => setReloads(n => n + 1);
 
   const columns = [
     {
@@ -304,7 +312,7 @@ function DataTableSection() {
   const pagination = {
     pageIndex,
     pageSize,
-    totalItemCount: filteredData.length,
+    totalItemCount: total,
     pageSizeOptions: [10, 25, 50],
   };
 
@@ -320,9 +328,10 @@ function DataTableSection() {
       setPageIndex(page.index);
       setPageSize(page.size);
     }
-    if (sort) {
+    if (sort && (sort.field !== sortField || sort.direction !== sortDirection)) {
       setSortField(sort.field);
       setSortDirection(sort.direction);
+      setPageIndex(0);
     }
   };
 
@@ -362,7 +371,7 @@ function DataTableSection() {
       <EuiSpacer size="m" />
       <EuiBasicTable
         tableCaption="Sample data table"
-        items={pageData}
+        items={data}
         columns={columns}
         pagination={pagination}
         sorting={sorting}
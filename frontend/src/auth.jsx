@@ -81,7 +81,7 @@ export function AuthProvider({config, children}) {
 
   function authorizeGoogle() {
     const scope = encodeURI(config.google.oauth_scope);
-    const url = "https://accounts.google.com/o/oauth2/v2/auth?response_type=code&access_type=offline&prompt=consent&" +
+    const url = `${config.google.auth_url}?response_type=code&access_type=offline&prompt=consent&` +
                 `redirect_uri=${window.location.origin}/api/oauth/google&` +
                 `client_id=${config.google.client_id}&` +
                 `login_hint=${profile.email}&` +